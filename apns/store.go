@@ -0,0 +1,133 @@
+package apns
+
+import (
+	"database/sql"
+	"errors"
+	"net/netip"
+	"time"
+
+	"heckel.io/ntfy/v2/db"
+)
+
+const (
+	deviceLimitPerSubscriberIP = 10
+)
+
+// Errors returned by the store
+var (
+	ErrAPNSTooManyDevices           = errors.New("too many devices")
+	ErrAPNSUserIDCannotBeEmpty      = errors.New("user ID cannot be empty")
+	ErrAPNSDeviceTokenCannotBeEmpty = errors.New("device token cannot be empty")
+)
+
+// Store holds the database connection and queries for APNs device registrations.
+type Store struct {
+	db      *db.DB
+	queries queries
+}
+
+// queries holds the database-specific SQL queries.
+type queries struct {
+	selectDeviceExists              string
+	selectDeviceCountBySubscriberIP string
+	selectDevicesForTopic           string
+	upsertDevice                    string
+	updateDeviceUpdatedAt           string
+	deleteDeviceByToken             string
+	deleteDeviceByUserID            string
+	deleteDeviceByAge               string
+	insertDeviceTopic               string
+	deleteDeviceTopicAll            string
+	deleteDeviceTopicWithoutDevice  string
+}
+
+// UpsertDevice adds or updates the device with the given token, and replaces the topics it is registered for.
+func (s *Store) UpsertDevice(token, userID string, subscriberIP netip.Addr, topics []string) error {
+	if token == "" {
+		return ErrAPNSDeviceTokenCannotBeEmpty
+	}
+	return db.ExecTx(s.db, func(tx *sql.Tx) error {
+		// Read number of devices for subscriber IP address, and reject new devices if the limit is reached
+		var deviceCount, exists int
+		if err := tx.QueryRow(s.queries.selectDeviceCountBySubscriberIP, subscriberIP.String()).Scan(&deviceCount); err != nil {
+			return err
+		}
+		if err := tx.QueryRow(s.queries.selectDeviceExists, token).Scan(&exists); err != nil {
+			return err
+		}
+		if exists == 0 && deviceCount >= deviceLimitPerSubscriberIP {
+			return ErrAPNSTooManyDevices
+		}
+		// Insert or update device, and replace all device topics
+		if _, err := tx.Exec(s.queries.upsertDevice, token, userID, subscriberIP.String(), time.Now().Unix()); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(s.queries.deleteDeviceTopicAll, token); err != nil {
+			return err
+		}
+		for _, topic := range topics {
+			if _, err := tx.Exec(s.queries.insertDeviceTopic, token, topic); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DevicesForTopic returns all devices registered for the given topic.
+func (s *Store) DevicesForTopic(topic string) ([]*Device, error) {
+	rows, err := s.db.ReadOnly().Query(s.queries.selectDevicesForTopic, topic)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	devices := make([]*Device, 0)
+	for rows.Next() {
+		var token, userID string
+		if err := rows.Scan(&token, &userID); err != nil {
+			return nil, err
+		}
+		devices = append(devices, &Device{
+			Token:  token,
+			UserID: userID,
+		})
+	}
+	return devices, rows.Err()
+}
+
+// RemoveDevice removes the device with the given token, e.g. if APNs reports that the token is no longer valid.
+func (s *Store) RemoveDevice(token string) error {
+	_, err := s.db.Exec(s.queries.deleteDeviceByToken, token)
+	return err
+}
+
+// RemoveDevicesByUserID removes all devices for the given user ID.
+func (s *Store) RemoveDevicesByUserID(userID string) error {
+	if userID == "" {
+		return ErrAPNSUserIDCannotBeEmpty
+	}
+	_, err := s.db.Exec(s.queries.deleteDeviceByUserID, userID)
+	return err
+}
+
+// RemoveExpiredDevices removes all devices that have not been updated for a given time period.
+func (s *Store) RemoveExpiredDevices(expireAfter time.Duration) error {
+	return db.ExecTx(s.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(s.queries.deleteDeviceByAge, time.Now().Add(-expireAfter).Unix()); err != nil {
+			return err
+		}
+		_, err := tx.Exec(s.queries.deleteDeviceTopicWithoutDevice)
+		return err
+	})
+}
+
+// SetDeviceUpdatedAt updates the updated_at timestamp for a device. This is exported for testing purposes.
+func (s *Store) SetDeviceUpdatedAt(token string, updatedAt int64) error {
+	_, err := s.db.Exec(s.queries.updateDeviceUpdatedAt, updatedAt, token)
+	return err
+}
+
+// Close closes the underlying database connection.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,110 @@
+package apns
+
+import (
+	"database/sql"
+	"fmt"
+
+	"heckel.io/ntfy/v2/db"
+)
+
+const (
+	postgresCreateTablesQuery = `
+		CREATE TABLE IF NOT EXISTS apns_device (
+			token TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			subscriber_ip TEXT NOT NULL,
+			updated_at BIGINT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_apns_subscriber_ip ON apns_device (subscriber_ip);
+		CREATE INDEX IF NOT EXISTS idx_apns_updated_at ON apns_device (updated_at);
+		CREATE INDEX IF NOT EXISTS idx_apns_user_id ON apns_device (user_id);
+		CREATE TABLE IF NOT EXISTS apns_device_topic (
+			device_token TEXT NOT NULL REFERENCES apns_device (token) ON DELETE CASCADE,
+			topic TEXT NOT NULL,
+			PRIMARY KEY (device_token, topic)
+		);
+		CREATE INDEX IF NOT EXISTS idx_apns_topic ON apns_device_topic (topic);
+		CREATE TABLE IF NOT EXISTS schema_version (
+			store TEXT PRIMARY KEY,
+			version INT NOT NULL
+		);
+	`
+
+	postgresSelectDeviceExistsQuery              = `SELECT COUNT(*) FROM apns_device WHERE token = $1`
+	postgresSelectDeviceCountBySubscriberIPQuery = `SELECT COUNT(*) FROM apns_device WHERE subscriber_ip = $1`
+	postgresSelectDevicesForTopicQuery           = `
+		SELECT d.token, d.user_id
+		FROM apns_device_topic dt
+		JOIN apns_device d ON d.token = dt.device_token
+		WHERE dt.topic = $1
+		ORDER BY d.token
+	`
+	postgresUpsertDeviceQuery = `
+		INSERT INTO apns_device (token, user_id, subscriber_ip, updated_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (token)
+		DO UPDATE SET user_id = excluded.user_id, subscriber_ip = excluded.subscriber_ip, updated_at = excluded.updated_at
+	`
+	postgresUpdateDeviceUpdatedAtQuery = `UPDATE apns_device SET updated_at = $1 WHERE token = $2`
+	postgresDeleteDeviceByTokenQuery   = `DELETE FROM apns_device WHERE token = $1`
+	postgresDeleteDeviceByUserIDQuery  = `DELETE FROM apns_device WHERE user_id = $1`
+	postgresDeleteDeviceByAgeQuery     = `DELETE FROM apns_device WHERE updated_at <= $1`
+
+	postgresInsertDeviceTopicQuery              = `INSERT INTO apns_device_topic (device_token, topic) VALUES ($1, $2)`
+	postgresDeleteDeviceTopicAllQuery           = `DELETE FROM apns_device_topic WHERE device_token = $1`
+	postgresDeleteDeviceTopicWithoutDeviceQuery = `DELETE FROM apns_device_topic WHERE device_token NOT IN (SELECT token FROM apns_device)`
+)
+
+// PostgreSQL schema management queries
+const (
+	pgCurrentSchemaVersion           = 1
+	postgresInsertSchemaVersionQuery = `INSERT INTO schema_version (store, version) VALUES ('apns', $1)`
+	postgresSelectSchemaVersionQuery = `SELECT version FROM schema_version WHERE store = 'apns'`
+)
+
+// NewPostgresStore creates a new PostgreSQL-backed APNs device store using an existing database connection pool.
+func NewPostgresStore(d *db.DB) (*Store, error) {
+	if err := setupPostgres(d.Primary()); err != nil {
+		return nil, err
+	}
+	return &Store{
+		db: d,
+		queries: queries{
+			selectDeviceExists:              postgresSelectDeviceExistsQuery,
+			selectDeviceCountBySubscriberIP: postgresSelectDeviceCountBySubscriberIPQuery,
+			selectDevicesForTopic:           postgresSelectDevicesForTopicQuery,
+			upsertDevice:                    postgresUpsertDeviceQuery,
+			updateDeviceUpdatedAt:           postgresUpdateDeviceUpdatedAtQuery,
+			deleteDeviceByToken:             postgresDeleteDeviceByTokenQuery,
+			deleteDeviceByUserID:            postgresDeleteDeviceByUserIDQuery,
+			deleteDeviceByAge:               postgresDeleteDeviceByAgeQuery,
+			insertDeviceTopic:               postgresInsertDeviceTopicQuery,
+			deleteDeviceTopicAll:            postgresDeleteDeviceTopicAllQuery,
+			deleteDeviceTopicWithoutDevice:  postgresDeleteDeviceTopicWithoutDeviceQuery,
+		},
+	}, nil
+}
+
+func setupPostgres(d *sql.DB) error {
+	var schemaVersion int
+	err := d.QueryRow(postgresSelectSchemaVersionQuery).Scan(&schemaVersion)
+	if err != nil {
+		return setupNewPostgres(d)
+	}
+	if schemaVersion > pgCurrentSchemaVersion {
+		return fmt.Errorf("unexpected schema version: version %d is higher than current version %d", schemaVersion, pgCurrentSchemaVersion)
+	}
+	return nil
+}
+
+func setupNewPostgres(d *sql.DB) error {
+	return db.ExecTx(d, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(postgresCreateTablesQuery); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(postgresInsertSchemaVersionQuery, pgCurrentSchemaVersion); err != nil {
+			return err
+		}
+		return nil
+	})
+}
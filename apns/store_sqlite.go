@@ -0,0 +1,119 @@
+package apns
+
+import (
+	"database/sql"
+	"fmt"
+
+	_ "github.com/mattn/go-sqlite3" // SQLite driver
+
+	"heckel.io/ntfy/v2/db"
+)
+
+const (
+	sqliteCreateTablesQuery = `
+		CREATE TABLE IF NOT EXISTS device (
+			token TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			subscriber_ip TEXT NOT NULL,
+			updated_at INT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_subscriber_ip ON device (subscriber_ip);
+		CREATE TABLE IF NOT EXISTS device_topic (
+			device_token TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			PRIMARY KEY (device_token, topic),
+			FOREIGN KEY (device_token) REFERENCES device (token) ON DELETE CASCADE
+		);
+		CREATE INDEX IF NOT EXISTS idx_topic ON device_topic (topic);
+		CREATE TABLE IF NOT EXISTS schemaVersion (
+			id INT PRIMARY KEY,
+			version INT NOT NULL
+		);
+	`
+	sqliteBuiltinStartupQueries = `
+		PRAGMA foreign_keys = ON;
+	`
+
+	sqliteSelectDeviceExistsQuery              = `SELECT COUNT(*) FROM device WHERE token = ?`
+	sqliteSelectDeviceCountBySubscriberIPQuery = `SELECT COUNT(*) FROM device WHERE subscriber_ip = ?`
+	sqliteSelectDevicesForTopicQuery           = `
+		SELECT d.token, d.user_id
+		FROM device_topic dt
+		JOIN device d ON d.token = dt.device_token
+		WHERE dt.topic = ?
+		ORDER BY d.token
+	`
+	sqliteUpsertDeviceQuery = `
+		INSERT INTO device (token, user_id, subscriber_ip, updated_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (token)
+		DO UPDATE SET user_id = excluded.user_id, subscriber_ip = excluded.subscriber_ip, updated_at = excluded.updated_at
+	`
+	sqliteUpdateDeviceUpdatedAtQuery = `UPDATE device SET updated_at = ? WHERE token = ?`
+	sqliteDeleteDeviceByTokenQuery   = `DELETE FROM device WHERE token = ?`
+	sqliteDeleteDeviceByUserIDQuery  = `DELETE FROM device WHERE user_id = ?`
+	sqliteDeleteDeviceByAgeQuery     = `DELETE FROM device WHERE updated_at <= ?` // Full table scan!
+
+	sqliteInsertDeviceTopicQuery              = `INSERT INTO device_topic (device_token, topic) VALUES (?, ?)`
+	sqliteDeleteDeviceTopicAllQuery           = `DELETE FROM device_topic WHERE device_token = ?`
+	sqliteDeleteDeviceTopicWithoutDeviceQuery = `DELETE FROM device_topic WHERE device_token NOT IN (SELECT token FROM device)`
+)
+
+// SQLite schema management queries
+const (
+	sqliteCurrentSchemaVersion     = 1
+	sqliteInsertSchemaVersionQuery = `INSERT INTO schemaVersion VALUES (1, ?)`
+	sqliteSelectSchemaVersionQuery = `SELECT version FROM schemaVersion WHERE id = 1`
+)
+
+// NewSQLiteStore creates a new SQLite-backed APNs device store.
+func NewSQLiteStore(filename string) (*Store, error) {
+	d, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := setupSQLite(d); err != nil {
+		return nil, err
+	}
+	if _, err := d.Exec(sqliteBuiltinStartupQueries); err != nil {
+		return nil, err
+	}
+	return &Store{
+		db: db.New(&db.Host{DB: d}, nil),
+		queries: queries{
+			selectDeviceExists:              sqliteSelectDeviceExistsQuery,
+			selectDeviceCountBySubscriberIP: sqliteSelectDeviceCountBySubscriberIPQuery,
+			selectDevicesForTopic:           sqliteSelectDevicesForTopicQuery,
+			upsertDevice:                    sqliteUpsertDeviceQuery,
+			updateDeviceUpdatedAt:           sqliteUpdateDeviceUpdatedAtQuery,
+			deleteDeviceByToken:             sqliteDeleteDeviceByTokenQuery,
+			deleteDeviceByUserID:            sqliteDeleteDeviceByUserIDQuery,
+			deleteDeviceByAge:               sqliteDeleteDeviceByAgeQuery,
+			insertDeviceTopic:               sqliteInsertDeviceTopicQuery,
+			deleteDeviceTopicAll:            sqliteDeleteDeviceTopicAllQuery,
+			deleteDeviceTopicWithoutDevice:  sqliteDeleteDeviceTopicWithoutDeviceQuery,
+		},
+	}, nil
+}
+
+func setupSQLite(db *sql.DB) error {
+	var schemaVersion int
+	if err := db.QueryRow(sqliteSelectSchemaVersionQuery).Scan(&schemaVersion); err != nil {
+		return setupNewSQLite(db)
+	} else if schemaVersion > sqliteCurrentSchemaVersion {
+		return fmt.Errorf("unexpected schema version: version %d is higher than current version %d", schemaVersion, sqliteCurrentSchemaVersion)
+	}
+	return nil
+}
+
+func setupNewSQLite(sqlDB *sql.DB) error {
+	return db.ExecTx(sqlDB, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(sqliteCreateTablesQuery); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteInsertSchemaVersionQuery, sqliteCurrentSchemaVersion); err != nil {
+			return err
+		}
+		return nil
+	})
+}
@@ -0,0 +1,139 @@
+package apns_test
+
+import (
+	"fmt"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/apns"
+	dbtest "heckel.io/ntfy/v2/db/test"
+)
+
+const testDeviceToken = "740f4707bebcf74f9b7c25d48e3358945f6aa01da5ddb387462c7eaf61bb78a"
+
+func forEachBackend(t *testing.T, f func(t *testing.T, store *apns.Store)) {
+	t.Run("sqlite", func(t *testing.T) {
+		store, err := apns.NewSQLiteStore(filepath.Join(t.TempDir(), "apns.db"))
+		require.Nil(t, err)
+		t.Cleanup(func() { store.Close() })
+		f(t, store)
+	})
+	t.Run("postgres", func(t *testing.T) {
+		testDB := dbtest.CreateTestPostgres(t)
+		store, err := apns.NewPostgresStore(testDB)
+		require.Nil(t, err)
+		f(t, store)
+	})
+}
+
+func TestStoreUpsertDeviceDevicesForTopic(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store *apns.Store) {
+		require.Nil(t, store.UpsertDevice(testDeviceToken, "u_1234", netip.MustParseAddr("1.2.3.4"), []string{"test-topic", "mytopic"}))
+
+		devices, err := store.DevicesForTopic("test-topic")
+		require.Nil(t, err)
+		require.Len(t, devices, 1)
+		require.Equal(t, testDeviceToken, devices[0].Token)
+		require.Equal(t, "u_1234", devices[0].UserID)
+
+		devices, err = store.DevicesForTopic("mytopic")
+		require.Nil(t, err)
+		require.Len(t, devices, 1)
+
+		devices, err = store.DevicesForTopic("other-topic")
+		require.Nil(t, err)
+		require.Len(t, devices, 0)
+	})
+}
+
+func TestStoreUpsertDeviceSubscriberIPLimitReached(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store *apns.Store) {
+		// Insert 10 devices with the same IP address
+		for i := 0; i < 10; i++ {
+			require.Nil(t, store.UpsertDevice(fmt.Sprintf("%s%d", testDeviceToken, i), "u_1234", netip.MustParseAddr("1.2.3.4"), []string{"mytopic"}))
+		}
+
+		// Updating an existing device should be fine
+		require.Nil(t, store.UpsertDevice(testDeviceToken+"0", "u_1234", netip.MustParseAddr("1.2.3.4"), []string{"mytopic", "othertopic"}))
+
+		// But a new device should fail
+		require.Equal(t, apns.ErrAPNSTooManyDevices, store.UpsertDevice(testDeviceToken+"11", "u_1234", netip.MustParseAddr("1.2.3.4"), []string{"mytopic"}))
+
+		// With a different IP address it should be fine again
+		require.Nil(t, store.UpsertDevice(testDeviceToken+"99", "u_1234", netip.MustParseAddr("9.9.9.9"), []string{"mytopic"}))
+	})
+}
+
+func TestStoreUpsertDeviceUpdateTopicsAndUser(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store *apns.Store) {
+		require.Nil(t, store.UpsertDevice(testDeviceToken, "u_1234", netip.MustParseAddr("1.2.3.4"), []string{"topic1", "topic2"}))
+
+		// Update the device to have only one topic, and a different user
+		require.Nil(t, store.UpsertDevice(testDeviceToken, "u_5678", netip.MustParseAddr("1.2.3.4"), []string{"topic1"}))
+
+		devices, err := store.DevicesForTopic("topic1")
+		require.Nil(t, err)
+		require.Len(t, devices, 1)
+		require.Equal(t, "u_5678", devices[0].UserID)
+
+		devices, err = store.DevicesForTopic("topic2")
+		require.Nil(t, err)
+		require.Len(t, devices, 0)
+	})
+}
+
+func TestStoreUpsertDeviceEmptyToken(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store *apns.Store) {
+		require.Equal(t, apns.ErrAPNSDeviceTokenCannotBeEmpty, store.UpsertDevice("", "u_1234", netip.MustParseAddr("1.2.3.4"), []string{"topic1"}))
+	})
+}
+
+func TestStoreRemoveDevice(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store *apns.Store) {
+		require.Nil(t, store.UpsertDevice(testDeviceToken, "u_1234", netip.MustParseAddr("1.2.3.4"), []string{"topic1", "topic2"}))
+		require.Nil(t, store.RemoveDevice(testDeviceToken))
+
+		devices, err := store.DevicesForTopic("topic1")
+		require.Nil(t, err)
+		require.Len(t, devices, 0)
+	})
+}
+
+func TestStoreRemoveDevicesByUserID(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store *apns.Store) {
+		// Insert two devices for u_1234 and one for u_5678
+		require.Nil(t, store.UpsertDevice(testDeviceToken+"0", "u_1234", netip.MustParseAddr("1.2.3.4"), []string{"topic1"}))
+		require.Nil(t, store.UpsertDevice(testDeviceToken+"1", "u_1234", netip.MustParseAddr("1.2.3.4"), []string{"topic1"}))
+		require.Nil(t, store.UpsertDevice(testDeviceToken+"2", "u_5678", netip.MustParseAddr("9.9.9.9"), []string{"topic1"}))
+
+		// Remove all devices for u_1234
+		require.Nil(t, store.RemoveDevicesByUserID("u_1234"))
+
+		devices, err := store.DevicesForTopic("topic1")
+		require.Nil(t, err)
+		require.Len(t, devices, 1)
+		require.Equal(t, testDeviceToken+"2", devices[0].Token)
+
+		// Empty user ID is rejected
+		require.Equal(t, apns.ErrAPNSUserIDCannotBeEmpty, store.RemoveDevicesByUserID(""))
+	})
+}
+
+func TestStoreRemoveExpiredDevices(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store *apns.Store) {
+		require.Nil(t, store.UpsertDevice(testDeviceToken+"0", "u_1234", netip.MustParseAddr("1.2.3.4"), []string{"topic1"}))
+		require.Nil(t, store.UpsertDevice(testDeviceToken+"1", "", netip.MustParseAddr("1.2.3.4"), []string{"topic1"}))
+		require.Nil(t, store.SetDeviceUpdatedAt(testDeviceToken+"0", time.Now().Add(-61*24*time.Hour).Unix()))
+
+		// Remove devices that have not been updated for 60 days
+		require.Nil(t, store.RemoveExpiredDevices(60*24*time.Hour))
+
+		devices, err := store.DevicesForTopic("topic1")
+		require.Nil(t, err)
+		require.Len(t, devices, 1)
+		require.Equal(t, testDeviceToken+"1", devices[0].Token)
+	})
+}
@@ -0,0 +1,17 @@
+package apns
+
+import "heckel.io/ntfy/v2/log"
+
+// Device represents an iOS device that registered its APNs device token for a set of topics.
+type Device struct {
+	Token  string
+	UserID string
+}
+
+// Context returns the logging context for the device.
+func (d *Device) Context() log.Context {
+	return map[string]any{
+		"apns_device_token":   d.Token,
+		"apns_device_user_id": d.UserID,
+	}
+}
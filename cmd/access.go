@@ -8,6 +8,7 @@ import (
 	"github.com/urfave/cli/v2"
 	"heckel.io/ntfy/v2/user"
 	"heckel.io/ntfy/v2/util"
+	"strings"
 )
 
 func init() {
@@ -26,7 +27,7 @@ var flagsAccess = append(
 var cmdAccess = &cli.Command{
 	Name:      "access",
 	Usage:     "Grant/revoke access to a topic, or show access",
-	UsageText: "ntfy access [USERNAME [TOPIC [PERMISSION]]]",
+	UsageText: "ntfy access [USERNAME|group:GROUP [TOPIC [PERMISSION]]]",
 	Flags:     flagsAccess,
 	Before:    initConfigFileInputSourceFunc("config", flagsAccess, initLogFunc),
 	Action:    execUserAccess,
@@ -44,10 +45,13 @@ Usage:
   ntfy access                            # Shows access control list (alias: 'ntfy user list')
   ntfy access USERNAME                   # Shows access control entries for USERNAME
   ntfy access USERNAME TOPIC PERMISSION  # Allow/deny access for USERNAME to TOPIC
+  ntfy access group:GROUP                # Shows access control entries for GROUP
+  ntfy access group:GROUP TOPIC PERM     # Allow/deny access for all members of GROUP to TOPIC
 
 Arguments:
   USERNAME     an existing user, as created with 'ntfy user add', or "everyone"/"*"
                to define access rules for anonymous/unauthenticated clients
+  GROUP        an existing group, as created with 'ntfy group add'
   TOPIC        name of a topic with optional wildcards, e.g. "mytopic*"
   PERMISSION   one of the following:
                - read-write (alias: rw) 
@@ -61,9 +65,15 @@ Examples:
   ntfy access phil mytopic rw        # Allow read-write access to mytopic for user phil
   ntfy access everyone mytopic rw    # Allow anonymous read-write access to mytopic
   ntfy access everyone "up*" write   # Allow anonymous write-only access to topics "up..." 
+  ntfy access group:oncall "alerts*" rw  # Allow read-write access to topics "alerts..." for group oncall
   ntfy access --reset                # Reset entire access control list
   ntfy access --reset phil           # Reset all access for user phil
   ntfy access --reset phil mytopic   # Reset access for user phil and topic mytopic
+  ntfy access --reset group:oncall   # Reset all access for group oncall
+
+A user's own access control entries take precedence over the entries of their groups, and group
+entries take precedence over the entries for everyone. If a user is a member of multiple groups,
+the permissions of all groups are combined.
 `,
 }
 
@@ -82,6 +92,9 @@ func execUserAccess(c *cli.Context) error {
 	topic := c.Args().Get(1)
 	perms := c.Args().Get(2)
 	reset := c.Bool("reset")
+	if strings.HasPrefix(username, groupPrefix) {
+		return execGroupAccess(c, manager, strings.TrimPrefix(username, groupPrefix), topic, perms, reset)
+	}
 	if reset {
 		if perms != "" {
 			return errors.New("too many arguments, please check 'ntfy access --help' for usage details")
@@ -96,11 +109,65 @@ func execUserAccess(c *cli.Context) error {
 	return changeAccess(c, manager, username, topic, perms)
 }
 
-func changeAccess(c *cli.Context, manager *user.Manager, username string, topic string, perms string) error {
+func execGroupAccess(c *cli.Context, manager *user.Manager, group, topic, perms string, reset bool) error {
+	if reset {
+		if perms != "" {
+			return errors.New("too many arguments, please check 'ntfy access --help' for usage details")
+		}
+		g, err := manager.Group(group)
+		if err != nil {
+			return groupError(group, err)
+		}
+		if err := manager.ResetGroupAccess(group, topic); err != nil {
+			return groupError(group, err)
+		}
+		auditCLI(c, manager, user.AuditActionAccessReset, user.GroupTarget(group), user.NewAuditGrants(g.Grants, topic), nil)
+		if topic == "" {
+			fmt.Fprintf(c.App.Writer, "reset access for group %s\n\n", group)
+		} else {
+			fmt.Fprintf(c.App.Writer, "reset access for group %s and topic %s\n\n", group, topic)
+		}
+		return showGroupAccess(c, manager, group)
+	} else if perms == "" {
+		if topic != "" {
+			return errors.New("invalid syntax, please check 'ntfy access --help' for usage details")
+		}
+		return showGroupAccess(c, manager, group)
+	}
+	permission, err := parseAccessPermission(perms)
+	if err != nil {
+		return err
+	}
+	g, err := manager.Group(group)
+	if err != nil {
+		return groupError(group, err)
+	}
+	if err := manager.AllowGroupAccess(group, topic, permission); err != nil {
+		return groupError(group, err)
+	}
+	auditCLI(c, manager, user.AuditActionAccessAllow, user.GroupTarget(group), user.NewAuditGrants(g.Grants, topic), &user.AuditGrant{Topic: topic, Permission: permission.String()})
+	printAccessChange(c, topic, permission)
+	return showGroupAccess(c, manager, group)
+}
+
+func showGroupAccess(c *cli.Context, manager *user.Manager, name string) error {
+	group, err := manager.Group(name)
+	if err != nil {
+		return groupError(name, err)
+	}
+	showGroups(c, []*user.Group{group})
+	return nil
+}
+
+func parseAccessPermission(perms string) (user.Permission, error) {
 	if !util.Contains([]string{"", "read-write", "rw", "read-only", "read", "ro", "write-only", "write", "wo", "none", "deny"}, perms) {
-		return errors.New("permission must be one of: read-write, read-only, write-only, or deny (or the aliases: read, ro, write, wo, none)")
+		return user.PermissionDenyAll, errors.New("permission must be one of: read-write, read-only, write-only, or deny (or the aliases: read, ro, write, wo, none)")
 	}
-	permission, err := user.ParsePermission(perms)
+	return user.ParsePermission(perms)
+}
+
+func changeAccess(c *cli.Context, manager *user.Manager, username string, topic string, perms string) error {
+	permission, err := parseAccessPermission(perms)
 	if err != nil {
 		return err
 	}
@@ -112,9 +179,19 @@ func changeAccess(c *cli.Context, manager *user.Manager, username string, topic
 	} else if u.Role == user.RoleAdmin {
 		return fmt.Errorf("user %s is an admin user, access control entries have no effect", username)
 	}
+	grants, err := manager.Grants(username)
+	if err != nil {
+		return err
+	}
 	if err := manager.AllowAccess(username, topic, permission); err != nil {
 		return err
 	}
+	auditCLI(c, manager, user.AuditActionAccessAllow, username, user.NewAuditGrants(grants, topic), &user.AuditGrant{Topic: topic, Permission: permission.String()})
+	printAccessChange(c, topic, permission)
+	return showUserAccess(c, manager, username)
+}
+
+func printAccessChange(c *cli.Context, topic string, permission user.Permission) {
 	if permission.IsReadWrite() {
 		fmt.Fprintf(c.App.Writer, "granted read-write access to topic %s\n\n", topic)
 	} else if permission.IsRead() {
@@ -124,7 +201,6 @@ func changeAccess(c *cli.Context, manager *user.Manager, username string, topic
 	} else {
 		fmt.Fprintf(c.App.Writer, "revoked all access to topic %s\n\n", topic)
 	}
-	return showUserAccess(c, manager, username)
 }
 
 func resetAccess(c *cli.Context, manager *user.Manager, username, topic string) error {
@@ -140,22 +216,33 @@ func resetAllAccess(c *cli.Context, manager *user.Manager) error {
 	if err := manager.ResetAccess("", ""); err != nil {
 		return err
 	}
+	auditCLI(c, manager, user.AuditActionAccessReset, "", nil, nil)
 	fmt.Fprintln(c.App.Writer, "reset access for all users")
 	return nil
 }
 
 func resetUserAccess(c *cli.Context, manager *user.Manager, username string) error {
+	grants, err := manager.Grants(username)
+	if err != nil {
+		return err
+	}
 	if err := manager.ResetAccess(username, ""); err != nil {
 		return err
 	}
+	auditCLI(c, manager, user.AuditActionAccessReset, username, user.NewAuditGrants(grants, ""), nil)
 	fmt.Fprintf(c.App.Writer, "reset access for user %s\n\n", username)
 	return showUserAccess(c, manager, username)
 }
 
 func resetUserTopicAccess(c *cli.Context, manager *user.Manager, username string, topic string) error {
+	grants, err := manager.Grants(username)
+	if err != nil {
+		return err
+	}
 	if err := manager.ResetAccess(username, topic); err != nil {
 		return err
 	}
+	auditCLI(c, manager, user.AuditActionAccessReset, username, user.NewAuditGrants(grants, topic), nil)
 	fmt.Fprintf(c.App.Writer, "reset access for user %s and topic %s\n\n", username, topic)
 	return showUserAccess(c, manager, username)
 }
@@ -172,7 +259,15 @@ func showAllAccess(c *cli.Context, manager *user.Manager) error {
 	if err != nil {
 		return err
 	}
-	return showUsers(c, manager, users)
+	if err := showUsers(c, manager, users); err != nil {
+		return err
+	}
+	groups, err := manager.Groups()
+	if err != nil {
+		return err
+	}
+	showGroups(c, groups)
+	return nil
 }
 
 func showUserAccess(c *cli.Context, manager *user.Manager, username string) error {
@@ -198,29 +293,27 @@ func showUsers(c *cli.Context, manager *user.Manager, users []*user.User) error
 		provisioned := ""
 		if u.Provisioned {
 			provisioned = ", server config"
+		} else if provider := externalProvider(u); provider != "" {
+			provisioned = ", managed via " + provider
 		}
 		fmt.Fprintf(c.App.Writer, "user %s (role: %s, tier: %s%s)\n", u.Name, u.Role, tier, provisioned)
 		if u.Role == user.RoleAdmin {
 			fmt.Fprintf(c.App.Writer, "- read-write access to all topics (admin role)\n")
 		} else if len(grants) > 0 {
 			for _, grant := range grants {
-				grantProvisioned := ""
-				if grant.Provisioned {
-					grantProvisioned = " (server config)"
-				}
-				if grant.Permission.IsReadWrite() {
-					fmt.Fprintf(c.App.Writer, "- read-write access to topic %s%s\n", grant.TopicPattern, grantProvisioned)
-				} else if grant.Permission.IsRead() {
-					fmt.Fprintf(c.App.Writer, "- read-only access to topic %s%s\n", grant.TopicPattern, grantProvisioned)
-				} else if grant.Permission.IsWrite() {
-					fmt.Fprintf(c.App.Writer, "- write-only access to topic %s%s\n", grant.TopicPattern, grantProvisioned)
-				} else {
-					fmt.Fprintf(c.App.Writer, "- no access to topic %s%s\n", grant.TopicPattern, grantProvisioned)
-				}
+				showGrant(c, grant)
 			}
 		} else {
 			fmt.Fprintf(c.App.Writer, "- no topic-specific permissions\n")
 		}
+		if u.Name != user.Everyone && u.Role != user.RoleAdmin {
+			groups, err := manager.UserGroups(u.Name)
+			if err != nil {
+				return err
+			} else if len(groups) > 0 {
+				fmt.Fprintf(c.App.Writer, "- member of group %s\n", strings.Join(groups, ", "))
+			}
+		}
 		if u.Name == user.Everyone {
 			access := manager.DefaultAccess()
 			if access.IsReadWrite() {
@@ -236,3 +329,21 @@ func showUsers(c *cli.Context, manager *user.Manager, users []*user.User) error
 	}
 	return nil
 }
+
+func showGrant(c *cli.Context, grant user.Grant) {
+	grantProvisioned := ""
+	if grant.Provisioned {
+		grantProvisioned = " (server config)"
+	} else if grant.Managed {
+		grantProvisioned = " (synced from LDAP/OIDC groups)"
+	}
+	if grant.Permission.IsReadWrite() {
+		fmt.Fprintf(c.App.Writer, "- read-write access to topic %s%s\n", grant.TopicPattern, grantProvisioned)
+	} else if grant.Permission.IsRead() {
+		fmt.Fprintf(c.App.Writer, "- read-only access to topic %s%s\n", grant.TopicPattern, grantProvisioned)
+	} else if grant.Permission.IsWrite() {
+		fmt.Fprintf(c.App.Writer, "- write-only access to topic %s%s\n", grant.TopicPattern, grantProvisioned)
+	} else {
+		fmt.Fprintf(c.App.Writer, "- no access to topic %s%s\n", grant.TopicPattern, grantProvisioned)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"github.com/urfave/cli/v2"
 	"heckel.io/ntfy/v2/server"
 	"heckel.io/ntfy/v2/test"
+	"heckel.io/ntfy/v2/user"
+	"strings"
 	"testing"
 )
 
@@ -87,3 +89,27 @@ func runAccessCommand(app *cli.App, conf *server.Config, args ...string) error {
 	}
 	return app.Run(append(userArgs, args...))
 }
+
+func TestCLI_Access_Audit(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("benpass\nbenpass")
+	require.Nil(t, runUserCommand(app, conf, "add", "ben"))
+	require.Nil(t, runAccessCommand(app, conf, "ben", "prod-alerts", "ro"))
+	require.Nil(t, runAccessCommand(app, conf, "ben", "prod-alerts", "rw"))
+
+	m, err := user.NewSQLiteManager(conf.AuthFile, "", &user.Config{})
+	require.Nil(t, err)
+	defer m.Close()
+	entries, err := m.AuditEntries(&user.AuditFilter{Target: "ben"})
+	require.Nil(t, err)
+	require.Len(t, entries, 3)
+	require.True(t, strings.HasPrefix(entries[0].Actor, "cli"))
+	require.Equal(t, "", entries[0].IP)
+	require.Equal(t, user.AuditActionAccessAllow, entries[0].Action)
+	require.Equal(t, `[{"topic":"prod-alerts","permission":"read-only"}]`, entries[0].Before)
+	require.Equal(t, `{"topic":"prod-alerts","permission":"read-write"}`, entries[0].After)
+	require.Equal(t, user.AuditActionUserAdd, entries[2].Action)
+}
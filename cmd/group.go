@@ -0,0 +1,267 @@
+//go:build !noserver
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"heckel.io/ntfy/v2/user"
+	"strings"
+)
+
+func init() {
+	commands = append(commands, cmdGroup)
+}
+
+const (
+	groupPrefix = "group:"
+)
+
+var flagsGroup = append([]cli.Flag{}, flagsUser...)
+
+var cmdGroup = &cli.Command{
+	Name:      "group",
+	Usage:     "Manage/show groups",
+	UsageText: "ntfy group [list|add|remove|add-member|remove-member] ...",
+	Flags:     flagsGroup,
+	Before:    initConfigFileInputSourceFunc("config", flagsGroup, initLogFunc),
+	Category:  categoryServer,
+	Subcommands: []*cli.Command{
+		{
+			Name:      "add",
+			Aliases:   []string{"a"},
+			Usage:     "Adds a new group",
+			UsageText: "ntfy group add [--ignore-exists] GROUP",
+			Action:    execGroupAdd,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{Name: "ignore-exists", Usage: "if the group already exists, perform no action and exit"},
+			},
+			Description: `Add a new, empty group to the ntfy user database.
+
+Use 'ntfy group add-member' to add users to the group, and 'ntfy access group:GROUP ...' to
+grant the group access to topics. All members of a group inherit the group's access control entries.
+
+This is a server-only command. It directly reads from user.db as defined in the server config
+file server.yml. The command only works if 'auth-file' is properly defined.
+
+Example:
+  ntfy group add oncall
+`,
+		},
+		{
+			Name:      "remove",
+			Aliases:   []string{"del", "rm"},
+			Usage:     "Removes a group",
+			UsageText: "ntfy group remove GROUP",
+			Action:    execGroupDel,
+			Description: `Remove a group from the ntfy user database.
+
+This also removes all memberships and access control entries of the group. The users themselves
+are not removed.
+
+This is a server-only command. It directly reads from user.db as defined in the server config
+file server.yml. The command only works if 'auth-file' is properly defined.
+
+Example:
+  ntfy group del oncall
+`,
+		},
+		{
+			Name:      "add-member",
+			Aliases:   []string{"am"},
+			Usage:     "Adds users to a group",
+			UsageText: "ntfy group add-member GROUP USERNAME [USERNAME...]",
+			Action:    execGroupAddMember,
+			Description: `Add one or more existing users to a group.
+
+This is a server-only command. It directly reads from user.db as defined in the server config
+file server.yml. The command only works if 'auth-file' is properly defined.
+
+Example:
+  ntfy group add-member oncall phil ben
+`,
+		},
+		{
+			Name:      "remove-member",
+			Aliases:   []string{"rm-member", "rmm"},
+			Usage:     "Removes users from a group",
+			UsageText: "ntfy group remove-member GROUP USERNAME [USERNAME...]",
+			Action:    execGroupRemoveMember,
+			Description: `Remove one or more users from a group.
+
+This is a server-only command. It directly reads from user.db as defined in the server config
+file server.yml. The command only works if 'auth-file' is properly defined.
+
+Example:
+  ntfy group remove-member oncall ben
+`,
+		},
+		{
+			Name:    "list",
+			Aliases: []string{"l"},
+			Usage:   "Shows a list of groups",
+			Action:  execGroupList,
+			Description: `Shows a list of all groups, including their members and access control entries.
+
+This is a server-only command. It directly reads from user.db as defined in the server config
+file server.yml. The command only works if 'auth-file' is properly defined.
+`,
+		},
+	},
+	Description: `Manage groups of the ntfy server.
+
+Groups allow granting access to topics to a set of users at once. All members of a group
+inherit the group's access control entries. A user's own access control entries take precedence
+over the entries of their groups, and group entries take precedence over the entries for everyone.
+
+This is a server-only command. It directly manages the user.db as defined in the server config
+file server.yml. The command only works if 'auth-file' is properly defined. Please also refer
+to the related commands 'ntfy user' and 'ntfy access'.
+
+Examples:
+  ntfy group list                          # Shows list of groups
+  ntfy group add oncall                    # Add group oncall
+  ntfy group add-member oncall phil ben    # Add users phil and ben to group oncall
+  ntfy access group:oncall "alerts*" rw    # Allow read-write access to topics "alerts..." for group oncall
+  ntfy group remove-member oncall ben      # Remove user ben from group oncall
+  ntfy group del oncall                    # Delete group oncall
+`,
+}
+
+func execGroupAdd(c *cli.Context) error {
+	name := c.Args().Get(0)
+	if name == "" {
+		return errors.New("group name expected, type 'ntfy group add --help' for help")
+	} else if !user.AllowedGroupName(name) {
+		return errors.New("group name must consist only of numbers, letters, dots, dashes and underscores")
+	}
+	manager, err := createUserManager(c)
+	if err != nil {
+		return err
+	}
+	if err := manager.AddGroup(name); errors.Is(err, user.ErrGroupExists) {
+		if c.Bool("ignore-exists") {
+			fmt.Fprintf(c.App.Writer, "group %s already exists (exited successfully)\n", name)
+			return nil
+		}
+		return fmt.Errorf("group %s already exists", name)
+	} else if err != nil {
+		return err
+	}
+	auditCLI(c, manager, user.AuditActionGroupAdd, user.GroupTarget(name), nil, nil)
+	fmt.Fprintf(c.App.Writer, "group %s added\n", name)
+	return nil
+}
+
+func execGroupDel(c *cli.Context) error {
+	name := c.Args().Get(0)
+	if name == "" {
+		return errors.New("group name expected, type 'ntfy group remove --help' for help")
+	}
+	manager, err := createUserManager(c)
+	if err != nil {
+		return err
+	}
+	group, err := manager.Group(name)
+	if err != nil {
+		return groupError(name, err)
+	}
+	if err := manager.RemoveGroup(name); err != nil {
+		return groupError(name, err)
+	}
+	auditCLI(c, manager, user.AuditActionGroupRemove, user.GroupTarget(name), user.NewAuditGrants(group.Grants, ""), nil)
+	fmt.Fprintf(c.App.Writer, "group %s removed\n", name)
+	return nil
+}
+
+func execGroupAddMember(c *cli.Context) error {
+	name := c.Args().Get(0)
+	usernames := c.Args().Tail()
+	if name == "" || len(usernames) == 0 {
+		return errors.New("group name and username expected, type 'ntfy group add-member --help' for help")
+	}
+	manager, err := createUserManager(c)
+	if err != nil {
+		return err
+	}
+	for _, username := range usernames {
+		if err := manager.AddGroupMember(name, username); errors.Is(err, user.ErrUserNotFound) {
+			return fmt.Errorf("user %s does not exist", username)
+		} else if err != nil {
+			return groupError(name, err)
+		}
+		auditCLI(c, manager, user.AuditActionGroupMemberAdd, user.GroupTarget(name), nil, username)
+		fmt.Fprintf(c.App.Writer, "user %s added to group %s\n", username, name)
+	}
+	return nil
+}
+
+func execGroupRemoveMember(c *cli.Context) error {
+	name := c.Args().Get(0)
+	usernames := c.Args().Tail()
+	if name == "" || len(usernames) == 0 {
+		return errors.New("group name and username expected, type 'ntfy group remove-member --help' for help")
+	}
+	manager, err := createUserManager(c)
+	if err != nil {
+		return err
+	}
+	for _, username := range usernames {
+		if err := manager.RemoveGroupMember(name, username); errors.Is(err, user.ErrUserNotFound) {
+			return fmt.Errorf("user %s does not exist", username)
+		} else if err != nil {
+			return groupError(name, err)
+		}
+		auditCLI(c, manager, user.AuditActionGroupMemberRemove, user.GroupTarget(name), username, nil)
+		fmt.Fprintf(c.App.Writer, "user %s removed from group %s\n", username, name)
+	}
+	return nil
+}
+
+func execGroupList(c *cli.Context) error {
+	manager, err := createUserManager(c)
+	if err != nil {
+		return err
+	}
+	groups, err := manager.Groups()
+	if err != nil {
+		return err
+	}
+	if len(groups) == 0 {
+		fmt.Fprintln(c.App.Writer, "no groups")
+		return nil
+	}
+	showGroups(c, groups)
+	return nil
+}
+
+func showGroups(c *cli.Context, groups []*user.Group) {
+	for _, group := range groups {
+		provisioned := ""
+		if group.Provisioned {
+			provisioned = " (server config)"
+		}
+		members := "none"
+		if len(group.Members) > 0 {
+			members = strings.Join(group.Members, ", ")
+		}
+		fmt.Fprintf(c.App.Writer, "group %s (members: %s)%s\n", group.Name, members, provisioned)
+		if len(group.Grants) == 0 {
+			fmt.Fprintf(c.App.Writer, "- no topic-specific permissions\n")
+		}
+		for _, grant := range group.Grants {
+			showGrant(c, grant)
+		}
+	}
+}
+
+// groupError translates common group-related errors into user-friendly messages
+func groupError(name string, err error) error {
+	if errors.Is(err, user.ErrGroupNotFound) {
+		return fmt.Errorf("group %s does not exist", name)
+	} else if errors.Is(err, user.ErrProvisionedGroupChange) {
+		return fmt.Errorf("group %s is provisioned in the server config and cannot be changed", name)
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+	"heckel.io/ntfy/v2/server"
+	"heckel.io/ntfy/v2/test"
+	"testing"
+)
+
+func TestCLI_Group_AddMemberAccessRemove(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("benpass\nbenpass\njohnpass\njohnpass")
+	require.Nil(t, runUserCommand(app, conf, "add", "ben"))
+	require.Nil(t, runUserCommand(app, conf, "add", "john"))
+
+	app, _, stdout, _ := newTestApp()
+	require.Nil(t, runGroupCommand(app, conf, "add", "oncall"))
+	require.Equal(t, "group oncall added\n", stdout.String())
+
+	err := runGroupCommand(app, conf, "add", "oncall")
+	require.EqualError(t, err, "group oncall already exists")
+	require.Nil(t, runGroupCommand(app, conf, "add", "--ignore-exists", "oncall"))
+
+	app, _, stdout, _ = newTestApp()
+	require.Nil(t, runGroupCommand(app, conf, "add-member", "oncall", "ben", "john"))
+	require.Equal(t, "user ben added to group oncall\nuser john added to group oncall\n", stdout.String())
+	require.EqualError(t, runGroupCommand(app, conf, "add-member", "oncall", "nobody"), "user nobody does not exist")
+	require.EqualError(t, runGroupCommand(app, conf, "add-member", "nogroup", "ben"), "group nogroup does not exist")
+
+	app, _, stdout, _ = newTestApp()
+	require.Nil(t, runAccessCommand(app, conf, "group:oncall", "alerts*", "rw"))
+	require.Equal(t, `granted read-write access to topic alerts*
+
+group oncall (members: ben, john)
+- read-write access to topic alerts*
+`, stdout.String())
+
+	app, _, stdout, _ = newTestApp()
+	require.Nil(t, runGroupCommand(app, conf, "remove-member", "oncall", "john"))
+	require.Nil(t, runAccessCommand(app, conf))
+	require.Contains(t, stdout.String(), "user ben (role: user, tier: none)\n- no topic-specific permissions\n- member of group oncall\n")
+	require.Contains(t, stdout.String(), "group oncall (members: ben)\n- read-write access to topic alerts*\n")
+
+	// Members of the group can publish, others cannot
+	app, _, _, _ = newTestApp()
+	require.Nil(t, app.Run([]string{
+		"ntfy",
+		"publish",
+		"-u", "ben:benpass",
+		fmt.Sprintf("http://127.0.0.1:%d/alerts-db", port),
+	}))
+	require.Error(t, app.Run([]string{
+		"ntfy",
+		"publish",
+		"-u", "john:johnpass",
+		fmt.Sprintf("http://127.0.0.1:%d/alerts-db", port),
+	}))
+
+	app, _, stdout, _ = newTestApp()
+	require.Nil(t, runAccessCommand(app, conf, "--reset", "group:oncall"))
+	require.Equal(t, "reset access for group oncall\n\ngroup oncall (members: ben)\n- no topic-specific permissions\n", stdout.String())
+
+	app, _, stdout, _ = newTestApp()
+	require.Nil(t, runGroupCommand(app, conf, "remove", "oncall"))
+	require.Nil(t, runGroupCommand(app, conf, "list"))
+	require.Equal(t, "group oncall removed\nno groups\n", stdout.String())
+}
+
+func runGroupCommand(app *cli.App, conf *server.Config, args ...string) error {
+	userArgs := []string{
+		"ntfy",
+		"--log-level=ERROR",
+		"group",
+		"--config=" + conf.File, // Dummy config file to avoid lookups of real file
+		"--auth-file=" + conf.AuthFile,
+		"--auth-default-access=" + conf.AuthDefault.String(),
+	}
+	return app.Run(append(userArgs, args...))
+}
@@ -469,6 +469,114 @@ func TestParseTokens_Errors(t *testing.T) {
 	}
 }
 
+func TestParseOIDCGroupTiers(t *testing.T) {
+	groupTiers, err := parseOIDCGroupTiers([]string{"ntfy-pro:pro", " ntfy-business : business "})
+	require.Nil(t, err)
+	require.Len(t, groupTiers, 2)
+	require.Equal(t, "ntfy-pro", groupTiers[0].Group)
+	require.Equal(t, "pro", groupTiers[0].Tier)
+	require.Equal(t, "ntfy-business", groupTiers[1].Group)
+	require.Equal(t, "business", groupTiers[1].Tier)
+
+	_, err = parseOIDCGroupTiers([]string{"ntfy-pro"})
+	require.EqualError(t, err, "invalid oidc-group-tiers: ntfy-pro, expected format: 'group:tier'")
+	_, err = parseOIDCGroupTiers([]string{":pro"})
+	require.EqualError(t, err, "invalid oidc-group-tiers: :pro, group must not be empty")
+	_, err = parseOIDCGroupTiers([]string{"ntfy-pro:pro tier"})
+	require.EqualError(t, err, "invalid oidc-group-tiers: ntfy-pro:pro tier, tier pro tier invalid")
+}
+
+func TestParseGroupAccess(t *testing.T) {
+	access, err := parseGroupAccess("oidc-group-access", []string{"ops:alerts_*:rw", "ops:status:ro", "dev:builds:wo"})
+	require.Nil(t, err)
+	require.Len(t, access, 2)
+	require.Len(t, access["ops"], 2)
+	require.Equal(t, "alerts_*", access["ops"][0].TopicPattern)
+	require.Equal(t, user.PermissionReadWrite, access["ops"][0].Permission)
+	require.Equal(t, user.PermissionRead, access["ops"][1].Permission)
+	require.Equal(t, user.PermissionWrite, access["dev"][0].Permission)
+
+	_, err = parseGroupAccess("oidc-group-access", []string{"ops:alerts"})
+	require.EqualError(t, err, "invalid oidc-group-access: ops:alerts, expected format: 'group:topic:permission'")
+	_, err = parseGroupAccess("oidc-group-access", []string{"ops:alerts!:rw"})
+	require.EqualError(t, err, "invalid oidc-group-access: ops:alerts!:rw, topic pattern alerts! invalid")
+	_, err = parseGroupAccess("oidc-group-access", []string{"ops:alerts:nope"})
+	require.ErrorContains(t, err, "invalid oidc-group-access: ops:alerts:nope, permission nope invalid")
+	_, err = parseGroupAccess("ldap-group-access", []string{":alerts:rw"})
+	require.EqualError(t, err, "invalid ldap-group-access: :alerts:rw, group must not be empty")
+}
+
+func TestParseSMTPServerSubjectRules(t *testing.T) {
+	rules, err := parseSMTPServerSubjectRules([]string{`5:rotating_light,skull:(?i)\[(P1|CRITICAL)\]`, `high::\[P2\]`, `:warning:disk: full`})
+	require.Nil(t, err)
+	require.Len(t, rules, 3)
+	require.Equal(t, 5, rules[0].Priority)
+	require.Equal(t, []string{"rotating_light", "skull"}, rules[0].Tags)
+	require.True(t, rules[0].Regex.MatchString("[critical] Disk failure"))
+	require.Equal(t, 4, rules[1].Priority)
+	require.Empty(t, rules[1].Tags)
+	require.Equal(t, 0, rules[2].Priority)
+	require.Equal(t, []string{"warning"}, rules[2].Tags)
+	require.Equal(t, "disk: full", rules[2].Regex.String())
+
+	_, err = parseSMTPServerSubjectRules([]string{"5:warning"})
+	require.EqualError(t, err, "invalid smtp-server-subject-rules: 5:warning, expected format: 'priority:tags:regex'")
+	_, err = parseSMTPServerSubjectRules([]string{"9::P1"})
+	require.EqualError(t, err, "invalid smtp-server-subject-rules: 9::P1, priority 9 invalid")
+	_, err = parseSMTPServerSubjectRules([]string{"::P1"})
+	require.EqualError(t, err, "invalid smtp-server-subject-rules: ::P1, priority or tags must be set")
+	_, err = parseSMTPServerSubjectRules([]string{"5::"})
+	require.EqualError(t, err, "invalid smtp-server-subject-rules: 5::, regex must not be empty")
+	_, err = parseSMTPServerSubjectRules([]string{"5::[P1"})
+	require.ErrorContains(t, err, "invalid smtp-server-subject-rules: 5::[P1, regex invalid")
+}
+
+func TestParseGroups(t *testing.T) {
+	users := []*user.User{
+		{Name: "alice", Role: user.RoleUser},
+		{Name: "bob", Role: user.RoleUser},
+	}
+	groups, err := parseGroups(users, []string{"oncall:alice", " oncall : bob ", "oncall:alice", "empty"})
+	require.Nil(t, err)
+	require.Equal(t, map[string][]string{
+		"oncall": {"alice", "bob"},
+		"empty":  {},
+	}, groups)
+
+	_, err = parseGroups(users, []string{"oncall:alice:bob"})
+	require.EqualError(t, err, "invalid auth-groups: oncall:alice:bob, expected format: 'group[:user]'")
+	_, err = parseGroups(users, []string{"on call:alice"})
+	require.EqualError(t, err, "invalid auth-groups: on call:alice, group name on call invalid")
+	_, err = parseGroups(users, []string{"oncall:charlie"})
+	require.EqualError(t, err, "invalid auth-groups: oncall:charlie, user charlie is not provisioned")
+}
+
+func TestParseAuthGroupAccess(t *testing.T) {
+	groups := map[string][]string{"oncall": {"alice"}}
+	access, err := parseAuthGroupAccess(groups, []string{"oncall:alerts*:rw", "oncall:status:ro"})
+	require.Nil(t, err)
+	require.Equal(t, map[string][]*user.Grant{
+		"oncall": {
+			{TopicPattern: "alerts*", Permission: user.PermissionReadWrite, Provisioned: true},
+			{TopicPattern: "status", Permission: user.PermissionRead, Provisioned: true},
+		},
+	}, access)
+
+	_, err = parseAuthGroupAccess(groups, []string{"ops:alerts:rw"})
+	require.EqualError(t, err, "invalid auth-group-access: group ops is not provisioned, add it to auth-groups")
+	_, err = parseAuthGroupAccess(groups, []string{"oncall:alerts"})
+	require.EqualError(t, err, "invalid auth-group-access: oncall:alerts, expected format: 'group:topic:permission'")
+}
+
+func TestParseRoles(t *testing.T) {
+	roles, err := parseRoles("auth-require-totp", []string{"admin", " user "})
+	require.Nil(t, err)
+	require.Equal(t, []user.Role{user.RoleAdmin, user.RoleUser}, roles)
+
+	_, err = parseRoles("auth-require-totp", []string{"anonymous"})
+	require.EqualError(t, err, "invalid auth-require-totp: anonymous, allowed roles are 'admin' or 'user'")
+}
+
 func TestCLI_Serve_Unix_Curl(t *testing.T) {
 	sockFile := filepath.Join(t.TempDir(), "ntfy.sock")
 	configFile := newEmptyFile(t) // Avoid issues with existing server.yml file on system
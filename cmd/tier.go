@@ -19,6 +19,7 @@ const (
 	defaultMessageExpiryDuration    = "12h"
 	defaultEmailLimit               = 20
 	defaultCallLimit                = 0
+	defaultSMSLimit                 = 0
 	defaultReservationLimit         = 3
 	defaultAttachmentFileSizeLimit  = "15M"
 	defaultAttachmentTotalSizeLimit = "100M"
@@ -50,6 +51,7 @@ var cmdTier = &cli.Command{
 				&cli.StringFlag{Name: "message-expiry-duration", Value: defaultMessageExpiryDuration, Usage: "duration after which messages are deleted"},
 				&cli.Int64Flag{Name: "email-limit", Value: defaultEmailLimit, Usage: "daily email limit"},
 				&cli.Int64Flag{Name: "call-limit", Value: defaultCallLimit, Usage: "daily phone call limit"},
+				&cli.Int64Flag{Name: "sms-limit", Value: defaultSMSLimit, Usage: "daily SMS limit"},
 				&cli.Int64Flag{Name: "reservation-limit", Value: defaultReservationLimit, Usage: "topic reservation limit"},
 				&cli.StringFlag{Name: "attachment-file-size-limit", Value: defaultAttachmentFileSizeLimit, Usage: "per-attachment file size limit"},
 				&cli.StringFlag{Name: "attachment-total-size-limit", Value: defaultAttachmentTotalSizeLimit, Usage: "total size limit of attachments for the user"},
@@ -94,6 +96,7 @@ Examples:
 				&cli.StringFlag{Name: "message-expiry-duration", Usage: "duration after which messages are deleted"},
 				&cli.Int64Flag{Name: "email-limit", Usage: "daily email limit"},
 				&cli.Int64Flag{Name: "call-limit", Usage: "daily phone call limit"},
+				&cli.Int64Flag{Name: "sms-limit", Usage: "daily SMS limit"},
 				&cli.Int64Flag{Name: "reservation-limit", Usage: "topic reservation limit"},
 				&cli.StringFlag{Name: "attachment-file-size-limit", Usage: "per-attachment file size limit"},
 				&cli.StringFlag{Name: "attachment-total-size-limit", Usage: "total size limit of attachments for the user"},
@@ -219,6 +222,7 @@ func execTierAdd(c *cli.Context) error {
 		MessageExpiryDuration:    messageExpiryDuration,
 		EmailLimit:               c.Int64("email-limit"),
 		CallLimit:                c.Int64("call-limit"),
+		SMSLimit:                 c.Int64("sms-limit"),
 		ReservationLimit:         c.Int64("reservation-limit"),
 		AttachmentFileSizeLimit:  attachmentFileSizeLimit,
 		AttachmentTotalSizeLimit: attachmentTotalSizeLimit,
@@ -234,6 +238,7 @@ func execTierAdd(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	auditCLI(c, manager, user.AuditActionTierAdd, code, nil, user.NewAuditTier(tier))
 	fmt.Fprintf(c.App.Writer, "tier added\n\n")
 	printTier(c, tier)
 	return nil
@@ -256,6 +261,7 @@ func execTierChange(c *cli.Context) error {
 	} else if err != nil {
 		return err
 	}
+	before := user.NewAuditTier(tier)
 	if c.IsSet("name") {
 		tier.Name = c.String("name")
 	}
@@ -274,6 +280,9 @@ func execTierChange(c *cli.Context) error {
 	if c.IsSet("call-limit") {
 		tier.CallLimit = c.Int64("call-limit")
 	}
+	if c.IsSet("sms-limit") {
+		tier.SMSLimit = c.Int64("sms-limit")
+	}
 	if c.IsSet("reservation-limit") {
 		tier.ReservationLimit = c.Int64("reservation-limit")
 	}
@@ -315,6 +324,7 @@ func execTierChange(c *cli.Context) error {
 	if err := manager.UpdateTier(tier); err != nil {
 		return err
 	}
+	auditCLI(c, manager, user.AuditActionTierChange, code, before, user.NewAuditTier(tier))
 	fmt.Fprintf(c.App.Writer, "tier updated\n\n")
 	printTier(c, tier)
 	return nil
@@ -329,12 +339,16 @@ func execTierDel(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	if _, err := manager.Tier(code); err == user.ErrTierNotFound {
+	tier, err := manager.Tier(code)
+	if err == user.ErrTierNotFound {
 		return fmt.Errorf("tier %s does not exist", code)
+	} else if err != nil {
+		return err
 	}
 	if err := manager.RemoveTier(code); err != nil {
 		return err
 	}
+	auditCLI(c, manager, user.AuditActionTierRemove, code, user.NewAuditTier(tier), nil)
 	fmt.Fprintf(c.App.Writer, "tier %s removed\n", code)
 	return nil
 }
@@ -365,6 +379,7 @@ func printTier(c *cli.Context, tier *user.Tier) {
 	fmt.Fprintf(c.App.Writer, "- Message expiry duration: %s (%d seconds)\n", tier.MessageExpiryDuration.String(), int64(tier.MessageExpiryDuration.Seconds()))
 	fmt.Fprintf(c.App.Writer, "- Email limit: %d\n", tier.EmailLimit)
 	fmt.Fprintf(c.App.Writer, "- Phone call limit: %d\n", tier.CallLimit)
+	fmt.Fprintf(c.App.Writer, "- SMS limit: %d\n", tier.SMSLimit)
 	fmt.Fprintf(c.App.Writer, "- Reservation limit: %d\n", tier.ReservationLimit)
 	fmt.Fprintf(c.App.Writer, "- Attachment file size limit: %s\n", util.FormatSizeHuman(tier.AttachmentFileSizeLimit))
 	fmt.Fprintf(c.App.Writer, "- Attachment total size limit: %s\n", util.FormatSizeHuman(tier.AttachmentTotalSizeLimit))
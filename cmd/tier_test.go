@@ -31,6 +31,7 @@ func TestCLI_Tier_AddListChangeDelete(t *testing.T) {
 		"--message-limit=999",
 		"--message-expiry-duration=2d",
 		"--email-limit=91",
+		"--sms-limit=12",
 		"--reservation-limit=98",
 		"--attachment-file-size-limit=100m",
 		"--attachment-expiry-duration=1d",
@@ -43,6 +44,7 @@ func TestCLI_Tier_AddListChangeDelete(t *testing.T) {
 	require.Contains(t, stdout.String(), "- Message limit: 999")
 	require.Contains(t, stdout.String(), "- Message expiry duration: 48h")
 	require.Contains(t, stdout.String(), "- Email limit: 91")
+	require.Contains(t, stdout.String(), "- SMS limit: 12")
 	require.Contains(t, stdout.String(), "- Reservation limit: 98")
 	require.Contains(t, stdout.String(), "- Attachment file size limit: 100.0 MB")
 	require.Contains(t, stdout.String(), "- Attachment expiry duration: 24h")
@@ -9,6 +9,7 @@ import (
 	"heckel.io/ntfy/v2/user"
 	"heckel.io/ntfy/v2/util"
 	"net/netip"
+	"strings"
 	"time"
 )
 
@@ -30,17 +31,24 @@ var cmdToken = &cli.Command{
 			Name:      "add",
 			Aliases:   []string{"a"},
 			Usage:     "Create a new token",
-			UsageText: "ntfy token add [--expires=<duration>] [--label=..] USERNAME",
+			UsageText: "ntfy token add [--expires=<duration>] [--label=..] [--scope=TOPIC[:PERMISSION]...] [--no-account] USERNAME",
 			Action:    execTokenAdd,
 			Flags: []cli.Flag{
 				&cli.StringFlag{Name: "expires", Aliases: []string{"e"}, Value: "", Usage: "token expires after"},
 				&cli.StringFlag{Name: "label", Aliases: []string{"l"}, Value: "", Usage: "token label"},
+				&cli.StringSliceFlag{Name: "scope", Aliases: []string{"s"}, Usage: "restrict token to topic (pattern) and permission, e.g. ci-*:write-only"},
+				&cli.BoolFlag{Name: "no-account", Usage: "do not allow token to access the account API"},
 			},
 			Description: `Create a new user access token.
 
 User access tokens can be used to publish, subscribe, or perform any other user-specific tasks.
-Tokens have full access, and can perform any task a user can do. They are meant to be used to 
-avoid spreading the password to various places.
+By default, tokens have full access, and can perform any task a user can do. They are meant to be 
+used to avoid spreading the password to various places.
+
+Tokens can be restricted to certain topics with --scope, and to not allow account changes with
+--no-account. A scope is a topic or topic pattern (using * as wildcard), optionally followed by
+a colon and a permission (read-write, read-only, write-only, or rw, ro, wo). If no permission is
+given, read-write is assumed. Scopes never grant more access than the user has.
 
 This is a server-only command. It directly reads from user.db as defined in the server config
 file server.yml. The command only works if 'auth-file' is properly defined.
@@ -49,18 +57,24 @@ Examples:
   ntfy token add phil                   # Create token for user phil which never expires
   ntfy token add --expires=2d phil      # Create token for user phil which expires in 2 days
   ntfy token add -e "tuesday, 8pm" phil # Create token for user phil which expires next Tuesday
-  ntfy token add -l backups phil        # Create token for user phil with label "backups"`,
+  ntfy token add -l backups phil        # Create token for user phil with label "backups"
+  ntfy token add -s "ci-*:wo" phil      # Create token for user phil which can only publish to ci-* topics`,
 		},
 		{
 			Name:      "remove",
 			Aliases:   []string{"del", "rm"},
 			Usage:     "Removes a token",
-			UsageText: "ntfy token remove USERNAME TOKEN",
+			UsageText: "ntfy token remove USERNAME TOKEN|ID",
 			Action:    execTokenDel,
 			Description: `Remove a token from the ntfy user database.
 
-Example:
-  ntfy token del phil tk_th2srHVlxrANQHAso5t0HuQ1J1TjN`,
+Since tokens are stored hashed, 'ntfy token list' only shows the first few characters
+of each token, followed by the token ID in brackets. A token can be removed by either
+its value or its ID.
+
+Examples:
+  ntfy token del phil tk_th2srHVlxrANQHAso5t0HuQ1J1TjN  # Remove token by value
+  ntfy token del phil 3e1c5c0bd0a2b63c4c0c1ea3f4b8c53e7b0a3c2e1e8fa95c3b3ce2c9b1d3e6f0  # Remove token by ID`,
 		},
 		{
 			Name:    "list",
@@ -85,8 +99,9 @@ The output can be used in the 'auth-tokens' config option.`,
 	Description: `Manage access tokens for individual users.
 
 User access tokens can be used to publish, subscribe, or perform any other user-specific tasks.
-Tokens have full access, and can perform any task a user can do. They are meant to be used to 
-avoid spreading the password to various places.
+By default, tokens have full access, and can perform any task a user can do. They are meant to be 
+used to avoid spreading the password to various places. Tokens can be restricted to certain topics
+and permissions, see 'ntfy token add --help'.
 
 This is a server-only command. It directly manages the user.db as defined in the server config
 file server.yml. The command only works if 'auth-file' is properly defined.
@@ -96,6 +111,7 @@ Examples:
   ntfy token list phil                          # Shows list of tokens for user phil
   ntfy token add phil                           # Create token for user phil which never expires
   ntfy token add --expires=2d phil              # Create token for user phil which expires in 2 days
+  ntfy token add --scope "ci-*:wo" phil         # Create token for user phil which can only publish to ci-* topics
   ntfy token remove phil tk_th2srHVlxr...       # Delete token`,
 }
 
@@ -116,6 +132,10 @@ func execTokenAdd(c *cli.Context) error {
 			return err
 		}
 	}
+	scope, err := parseTokenScope(c.StringSlice("scope"), c.Bool("no-account"))
+	if err != nil {
+		return err
+	}
 	manager, err := createUserManager(c)
 	if err != nil {
 		return err
@@ -126,10 +146,11 @@ func execTokenAdd(c *cli.Context) error {
 	} else if err != nil {
 		return err
 	}
-	token, err := manager.CreateToken(u.ID, label, expires, netip.IPv4Unspecified(), false)
+	token, err := manager.CreateToken(u.ID, label, expires, netip.IPv4Unspecified(), scope, false)
 	if err != nil {
 		return err
 	}
+	auditCLI(c, manager, user.AuditActionTokenAdd, u.Name, nil, user.NewAuditToken(token))
 	if expires.Unix() == 0 {
 		fmt.Fprintf(c.App.Writer, "token %s created for user %s, never expires\n", token.Value, u.Name)
 	} else {
@@ -155,10 +176,17 @@ func execTokenDel(c *cli.Context) error {
 	} else if err != nil {
 		return err
 	}
+	t, err := manager.Token(u.ID, token)
+	if errors.Is(err, user.ErrTokenNotFound) {
+		return fmt.Errorf("token %s for user %s does not exist", token, username)
+	} else if err != nil {
+		return err
+	}
 	if err := manager.RemoveToken(u.ID, token); err != nil {
 		return err
 	}
-	fmt.Fprintf(c.App.Writer, "token %s for user %s removed\n", token, username)
+	auditCLI(c, manager, user.AuditActionTokenRemove, u.Name, user.NewAuditToken(t), nil)
+	fmt.Fprintf(c.App.Writer, "token %s... for user %s removed\n", t.Prefix, username)
 	return nil
 }
 
@@ -200,7 +228,7 @@ func execTokenList(c *cli.Context) error {
 		usersWithTokens++
 		fmt.Fprintf(c.App.Writer, "user %s\n", u.Name)
 		for _, t := range tokens {
-			var label, expires, provisioned string
+			var label, expires, scope, provisioned string
 			if t.Label != "" {
 				label = fmt.Sprintf(" (%s)", t.Label)
 			}
@@ -209,10 +237,13 @@ func execTokenList(c *cli.Context) error {
 			} else {
 				expires = fmt.Sprintf("expires %s", t.Expires.Format(time.RFC822))
 			}
+			if t.Scope != nil {
+				scope = fmt.Sprintf(", %s", formatTokenScope(t.Scope))
+			}
 			if t.Provisioned {
 				provisioned = " (server config)"
 			}
-			fmt.Fprintf(c.App.Writer, "- %s%s, %s, accessed from %s at %s%s\n", t.Value, label, expires, t.LastOrigin.String(), t.LastAccess.Format(time.RFC822), provisioned)
+			fmt.Fprintf(c.App.Writer, "- %s... [%s]%s, %s%s, accessed from %s at %s%s\n", t.Prefix, t.ID, label, expires, scope, t.LastOrigin.String(), t.LastAccess.Format(time.RFC822), provisioned)
 		}
 	}
 	if usersWithTokens == 0 {
@@ -225,3 +256,44 @@ func execTokenGenerate(c *cli.Context) error {
 	fmt.Fprintln(c.App.Writer, user.GenerateToken())
 	return nil
 }
+
+// parseTokenScope parses the --scope and --no-account flags into a token scope. Each scope is
+// of the form TOPIC[:PERMISSION]. If neither flag is set, nil is returned (unrestricted token).
+func parseTokenScope(scopes []string, noAccount bool) (*user.TokenScope, error) {
+	if len(scopes) == 0 && !noAccount {
+		return nil, nil
+	}
+	scope := &user.TokenScope{
+		Grants:    make([]user.Grant, 0, len(scopes)),
+		NoAccount: noAccount,
+	}
+	for _, s := range scopes {
+		topic, permissionStr, found := strings.Cut(s, ":")
+		if !found {
+			permissionStr = "read-write"
+		}
+		if !user.AllowedTopicPattern(topic) {
+			return nil, fmt.Errorf("invalid scope %s: topic or topic pattern not allowed", s)
+		}
+		permission, err := user.ParsePermission(permissionStr)
+		if err != nil || permission == user.PermissionDenyAll {
+			return nil, fmt.Errorf("invalid scope %s: permission must be read-write, read-only or write-only", s)
+		}
+		scope.Grants = append(scope.Grants, user.Grant{TopicPattern: topic, Permission: permission})
+	}
+	return scope, nil
+}
+
+func formatTokenScope(scope *user.TokenScope) string {
+	parts := make([]string, 0)
+	for _, grant := range scope.Grants {
+		parts = append(parts, fmt.Sprintf("%s:%s", grant.TopicPattern, grant.Permission.String()))
+	}
+	if len(parts) > 0 {
+		parts[0] = "scope " + parts[0]
+	}
+	if scope.NoAccount {
+		parts = append(parts, "no account access")
+	}
+	return strings.Join(parts, ", ")
+}
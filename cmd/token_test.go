@@ -6,6 +6,7 @@ import (
 	"github.com/urfave/cli/v2"
 	"heckel.io/ntfy/v2/server"
 	"heckel.io/ntfy/v2/test"
+	"heckel.io/ntfy/v2/user"
 	"regexp"
 	"testing"
 )
@@ -22,22 +23,45 @@ func TestCLI_Token_AddListRemove(t *testing.T) {
 	app, _, stdout, _ = newTestApp()
 	require.Nil(t, runTokenCommand(app, conf, "add", "phil"))
 	require.Regexp(t, `token tk_.+ created for user phil, never expires`, stdout.String())
+	token := regexp.MustCompile(`tk_\w+`).FindString(stdout.String())
 
 	app, _, stdout, _ = newTestApp()
 	require.Nil(t, runTokenCommand(app, conf, "list", "phil"))
-	require.Regexp(t, `user phil\n- tk_.+, never expires, accessed from 0.0.0.0 at .+`, stdout.String())
-	re := regexp.MustCompile(`tk_\w+`)
-	token := re.FindString(stdout.String())
+	require.Regexp(t, `user phil\n- tk_\w{5}\.\.\. \[[0-9a-f]{64}\], never expires, accessed from 0.0.0.0 at .+`, stdout.String())
+	require.NotContains(t, stdout.String(), token)
+	id := regexp.MustCompile(`[0-9a-f]{64}`).FindString(stdout.String())
+	require.Equal(t, user.TokenID(token), id)
 
 	app, _, stdout, _ = newTestApp()
-	require.Nil(t, runTokenCommand(app, conf, "remove", "phil", token))
-	require.Regexp(t, fmt.Sprintf("token %s for user phil removed", token), stdout.String())
+	require.Nil(t, runTokenCommand(app, conf, "remove", "phil", id))
+	require.Equal(t, fmt.Sprintf("token %s... for user phil removed\n", token[:8]), stdout.String())
 
 	app, _, stdout, _ = newTestApp()
 	require.Nil(t, runTokenCommand(app, conf, "list"))
 	require.Equal(t, "no users with tokens\n", stdout.String())
 }
 
+func TestCLI_Token_AddScoped(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("mypass\nmypass")
+	require.Nil(t, runUserCommand(app, conf, "add", "phil"))
+
+	app, _, _, _ = newTestApp()
+	require.Error(t, runTokenCommand(app, conf, "add", "--scope", "ci-*:deny", "phil"))
+	require.Error(t, runTokenCommand(app, conf, "add", "--scope", "ci/*:wo", "phil"))
+
+	app, _, stdout, _ := newTestApp()
+	require.Nil(t, runTokenCommand(app, conf, "add", "--scope", "ci-*:wo", "--scope", "status", "--no-account", "phil"))
+	require.Regexp(t, `token tk_.+ created for user phil, never expires`, stdout.String())
+
+	app, _, stdout, _ = newTestApp()
+	require.Nil(t, runTokenCommand(app, conf, "list", "phil"))
+	require.Regexp(t, `- tk_.+, never expires, scope ci-\*:write-only, status:read-write, no account access, accessed from 0.0.0.0 at .+`, stdout.String())
+}
+
 func runTokenCommand(app *cli.App, conf *server.Config, args ...string) error {
 	userArgs := []string{
 		"ntfy",
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	osuser "os/user"
 	"strings"
 	"time"
 
@@ -39,6 +40,9 @@ var flagsUser = append(
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "smtp-sender-user", Aliases: []string{"smtp_sender_user"}, EnvVars: []string{"NTFY_SMTP_SENDER_USER"}, Usage: "SMTP user (if e-mail sending is enabled)"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "smtp-sender-pass", Aliases: []string{"smtp_sender_pass"}, EnvVars: []string{"NTFY_SMTP_SENDER_PASS"}, Usage: "SMTP password (if e-mail sending is enabled)"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "smtp-sender-from", Aliases: []string{"smtp_sender_from"}, EnvVars: []string{"NTFY_SMTP_SENDER_FROM"}, Usage: "SMTP sender address (if e-mail sending is enabled)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "smtp-sender-dkim-domain", Aliases: []string{"smtp_sender_dkim_domain"}, EnvVars: []string{"NTFY_SMTP_SENDER_DKIM_DOMAIN"}, Usage: "domain to sign outgoing emails for with DKIM, e.g. ntfy.sh"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "smtp-sender-dkim-selector", Aliases: []string{"smtp_sender_dkim_selector"}, EnvVars: []string{"NTFY_SMTP_SENDER_DKIM_SELECTOR"}, Usage: "DKIM selector, i.e. the DNS record <selector>._domainkey.<domain> holding the public key"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "smtp-sender-dkim-key-file", Aliases: []string{"smtp_sender_dkim_key_file"}, EnvVars: []string{"NTFY_SMTP_SENDER_DKIM_KEY_FILE"}, Usage: "PEM-encoded RSA or Ed25519 private key file to sign outgoing emails with DKIM"}),
 )
 
 var cmdUser = &cli.Command{
@@ -129,6 +133,25 @@ requires SMTP to be configured and the user to have a verified primary email).
 Example:
   ntfy user reset-pass phil               # Print a reset link for user phil
   ntfy user reset-pass --send-email phil  # Print and email the reset link
+`,
+		},
+		{
+			Name:      "reset-totp",
+			Aliases:   []string{"rt"},
+			Usage:     "Disables two-factor authentication for a user",
+			UsageText: "ntfy user reset-totp USERNAME",
+			Action:    execUserResetTOTP,
+			Description: `Disable two-factor authentication (TOTP) for the given user.
+
+This command can be used if a user lost access to both their authenticator app and their
+recovery codes. It deletes the TOTP secret and all recovery codes, so the user can log in
+with just their password again, and then re-enroll. Existing access tokens are not affected.
+
+If two-factor authentication is required for the user's role (auth-require-totp), the user
+will be asked to re-enroll after logging in.
+
+Example:
+  ntfy user reset-totp phil
 `,
 		},
 		{
@@ -260,6 +283,7 @@ func execUserAdd(c *cli.Context) error {
 	if err := manager.AddUser(username, password, role, hashed); err != nil {
 		return err
 	}
+	auditCLI(c, manager, user.AuditActionUserAdd, username, nil, &user.AuditUser{Role: role})
 	fmt.Fprintf(c.App.Writer, "user %s added with role %s\n", username, role)
 	return nil
 }
@@ -275,12 +299,16 @@ func execUserDel(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	if _, err := manager.User(username); errors.Is(err, user.ErrUserNotFound) {
+	u, err := manager.User(username)
+	if errors.Is(err, user.ErrUserNotFound) {
 		return fmt.Errorf("user %s does not exist", username)
+	} else if err != nil {
+		return err
 	}
 	if err := manager.RemoveUser(username); err != nil {
 		return err
 	}
+	auditCLI(c, manager, user.AuditActionUserRemove, username, user.NewAuditUser(u), nil)
 	fmt.Fprintf(c.App.Writer, "user %s removed\n", username)
 	return nil
 }
@@ -300,8 +328,13 @@ func execUserChangePass(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	if _, err := manager.User(username); errors.Is(err, user.ErrUserNotFound) {
+	u, err := manager.User(username)
+	if errors.Is(err, user.ErrUserNotFound) {
 		return fmt.Errorf("user %s does not exist", username)
+	} else if err != nil {
+		return err
+	} else if user.IsLDAPUser(u) {
+		return fmt.Errorf("user %s is managed via LDAP; its password cannot be changed in ntfy", username)
 	}
 	if password == "" {
 		password, err = readPasswordAndConfirm(c)
@@ -312,6 +345,7 @@ func execUserChangePass(c *cli.Context) error {
 	if err := manager.ChangePassword(username, password, hashed); err != nil {
 		return err
 	}
+	auditCLI(c, manager, user.AuditActionUserPassword, username, nil, nil)
 	fmt.Fprintf(c.App.Writer, "changed password for user %s\n", username)
 	return nil
 }
@@ -338,6 +372,8 @@ func execUserResetPass(c *cli.Context) error {
 		return err
 	} else if u.Provisioned {
 		return fmt.Errorf("user %s is provisioned in the config file; its password cannot be reset", username)
+	} else if user.IsLDAPUser(u) {
+		return fmt.Errorf("user %s is managed via LDAP; its password cannot be reset in ntfy", username)
 	}
 	// Resolve the primary email up front if we need to send -- fail before creating a token
 	var primaryEmail string
@@ -357,12 +393,21 @@ func execUserResetPass(c *cli.Context) error {
 	link := baseURL + "/account/password/reset/" + token
 	fmt.Fprintln(c.App.Writer, link)
 	if sendEmail {
-		sender := mail.NewSender(&mail.Config{
+		mailConfig := &mail.Config{
 			SMTPAddr: c.String("smtp-sender-addr"),
 			SMTPUser: c.String("smtp-sender-user"),
 			SMTPPass: c.String("smtp-sender-pass"),
 			From:     c.String("smtp-sender-from"),
-		})
+		}
+		if keyFile := c.String("smtp-sender-dkim-key-file"); keyFile != "" {
+			mailConfig.DKIMDomain = c.String("smtp-sender-dkim-domain")
+			mailConfig.DKIMSelector = c.String("smtp-sender-dkim-selector")
+			mailConfig.DKIMKey, err = mail.ReadDKIMKeyFile(keyFile)
+			if err != nil {
+				return err
+			}
+		}
+		sender := mail.NewSender(mailConfig)
 		if err := sender.SendPasswordReset(primaryEmail, link); err != nil {
 			return fmt.Errorf("failed to send reset email to %s: %w", primaryEmail, err)
 		}
@@ -383,13 +428,44 @@ func execUserChangeRole(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	if _, err := manager.User(username); errors.Is(err, user.ErrUserNotFound) {
+	u, err := manager.User(username)
+	if errors.Is(err, user.ErrUserNotFound) {
 		return fmt.Errorf("user %s does not exist", username)
+	} else if err != nil {
+		return err
 	}
 	if err := manager.ChangeRole(username, role); err != nil {
 		return err
 	}
+	auditCLI(c, manager, user.AuditActionUserRole, username, &user.AuditUser{Role: u.Role}, &user.AuditUser{Role: role})
 	fmt.Fprintf(c.App.Writer, "changed role for user %s to %s\n", username, role)
+	if provider := externalProvider(u); provider != "" {
+		fmt.Fprintf(c.App.ErrWriter, "note: user %s is managed via %s; if admin groups are configured, the role is synced again on the next login\n", username, provider)
+	}
+	return nil
+}
+
+func execUserResetTOTP(c *cli.Context) error {
+	username := c.Args().Get(0)
+	if username == "" {
+		return errors.New("username expected, type 'ntfy user reset-totp --help' for help")
+	} else if username == userEveryone || username == user.Everyone {
+		return errors.New("username not allowed")
+	}
+	manager, err := createUserManager(c)
+	if err != nil {
+		return err
+	}
+	u, err := manager.User(username)
+	if errors.Is(err, user.ErrUserNotFound) {
+		return fmt.Errorf("user %s does not exist", username)
+	} else if err != nil {
+		return err
+	}
+	if err := manager.RemoveTOTP(u.ID); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.Writer, "two-factor authentication disabled for user %s\n", username)
 	return nil
 }
 
@@ -420,18 +496,27 @@ func execUserChangeTier(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	if _, err := manager.User(username); errors.Is(err, user.ErrUserNotFound) {
+	u, err := manager.User(username)
+	if errors.Is(err, user.ErrUserNotFound) {
 		return fmt.Errorf("user %s does not exist", username)
+	} else if err != nil {
+		return err
+	}
+	var before *user.AuditUser
+	if u.Tier != nil {
+		before = &user.AuditUser{Tier: u.Tier.Code}
 	}
 	if tier == tierReset {
 		if err := manager.ResetTier(username); err != nil {
 			return err
 		}
+		auditCLI(c, manager, user.AuditActionUserTier, username, before, nil)
 		fmt.Fprintf(c.App.Writer, "removed tier from user %s\n", username)
 	} else {
 		if err := manager.ChangeTier(username, tier); err != nil {
 			return err
 		}
+		auditCLI(c, manager, user.AuditActionUserTier, username, before, &user.AuditUser{Tier: tier})
 		fmt.Fprintf(c.App.Writer, "changed tier for user %s to %s\n", username, tier)
 	}
 	return nil
@@ -449,6 +534,28 @@ func execUserList(c *cli.Context) error {
 	return showUsers(c, manager, users)
 }
 
+// auditCLI records a change made via the CLI in the audit log. The actor is the operating system
+// user running the command. Errors are only printed, since the change itself has already been made.
+func auditCLI(c *cli.Context, manager *user.Manager, action user.AuditAction, target string, before, after any) {
+	actor := "cli"
+	if u, err := osuser.Current(); err == nil {
+		actor = "cli:" + u.Username
+	}
+	if err := manager.AddAuditEntry(actor, "", action, target, before, after); err != nil {
+		fmt.Fprintf(c.App.ErrWriter, "warning: cannot write audit log entry: %s\n", err.Error())
+	}
+}
+
+// externalProvider returns the name of the identity provider the user is managed by (e.g. "LDAP" or "OIDC"),
+// or an empty string for local users
+func externalProvider(u *user.User) string {
+	provider, _, ok := strings.Cut(u.ExternalID, ":")
+	if !ok {
+		return ""
+	}
+	return strings.ToUpper(provider)
+}
+
 func createUserManager(c *cli.Context) (*user.Manager, error) {
 	authFile := c.String("auth-file")
 	authStartupQueries := c.String("auth-startup-queries")
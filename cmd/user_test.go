@@ -122,6 +122,24 @@ func TestCLI_User_Delete(t *testing.T) {
 	require.Contains(t, err.Error(), "user phil does not exist")
 }
 
+func TestCLI_User_ResetTOTP(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("mypass\nmypass")
+	require.Nil(t, runUserCommand(app, conf, "add", "phil"))
+
+	app, _, stdout, _ := newTestApp()
+	require.Nil(t, runUserCommand(app, conf, "reset-totp", "phil"))
+	require.Contains(t, stdout.String(), "two-factor authentication disabled for user phil")
+
+	app, _, _, _ = newTestApp()
+	err := runUserCommand(app, conf, "reset-totp", "ben")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "user ben does not exist")
+}
+
 func TestCLI_User_ResetPass(t *testing.T) {
 	s, conf, port := newTestServerWithAuth(t)
 	defer test.StopServer(t, s, port)
@@ -185,6 +203,39 @@ func TestCLI_User_ResetPass_ProvisionedRejected(t *testing.T) {
 	require.Contains(t, err.Error(), "provisioned")
 }
 
+func TestCLI_User_LDAPUser(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	// Seed a user as the LDAP auther would create it, with an access control entry synced from a group
+	m, err := user.NewSQLiteManager(conf.AuthFile, "", &user.Config{})
+	require.Nil(t, err)
+	require.Nil(t, m.AddExternalUser("ldapuser", "random-pass", user.RoleUser, "ldap:ldapuser"))
+	require.Nil(t, m.SetManagedAccess("ldapuser", []*user.Grant{{TopicPattern: "alerts", Permission: user.PermissionReadWrite}}))
+	require.Nil(t, m.Close())
+
+	app, _, stdout, _ := newTestApp()
+	require.Nil(t, runUserCommand(app, conf, "list"))
+	require.Contains(t, stdout.String(), "user ldapuser (role: user, tier: none, managed via LDAP)\n- read-write access to topic alerts (synced from LDAP/OIDC groups)")
+
+	// Passwords are managed by the LDAP server
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("newpass\nnewpass")
+	err = runUserCommand(app, conf, "change-pass", "ldapuser")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "managed via LDAP")
+	app, _, _, _ = newTestApp()
+	err = runUserCommand(app, conf, "--base-url=https://ntfy.example.com", "reset-pass", "ldapuser")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "managed via LDAP")
+
+	// Roles can be changed, but may be synced again on the next login
+	app, _, stdout, stderr := newTestApp()
+	require.Nil(t, runUserCommand(app, conf, "change-role", "ldapuser", "admin"))
+	require.Contains(t, stdout.String(), "changed role for user ldapuser to admin")
+	require.Contains(t, stderr.String(), "user ldapuser is managed via LDAP")
+}
+
 func newTestServerWithAuth(t *testing.T) (s *server.Server, conf *server.Config, port int) {
 	configFile := filepath.Join(t.TempDir(), "server-dummy.yml")
 	require.Nil(t, os.WriteFile(configFile, []byte(""), 0600)) // Dummy config file to avoid lookup of real server.yml
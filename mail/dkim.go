@@ -0,0 +1,209 @@
+package mail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	dkimMinRSAKeyBits    = 1024 // RSA keys smaller than this must not be accepted by verifiers, see RFC 8301
+	dkimSignatureHeader  = "DKIM-Signature"
+	dkimSignatureLineLen = 72 // Length of the lines the signature (b=) is folded into
+)
+
+var (
+	// dkimSignedHeaders are the header fields that are signed, if they are present in the message. From is always present.
+	dkimSignedHeaders = []string{"From", "To", "Subject", "Date", "Reply-To", "MIME-Version", "Content-Type", "List-Unsubscribe"}
+
+	dkimWhitespaceRegex = regexp.MustCompile(`[ \t]+`)
+	dkimLineEndingRegex = regexp.MustCompile(`\r?\n`)
+
+	errDKIMKeyInvalid = errors.New("invalid DKIM private key, expected a PEM-encoded RSA (PKCS #1 or PKCS #8) or Ed25519 (PKCS #8) key")
+)
+
+// dkimSigner signs outgoing emails with DKIM (RFC 6376), using relaxed header and body canonicalization,
+// and either rsa-sha256 or ed25519-sha256 (RFC 8463), depending on the key type
+type dkimSigner struct {
+	domain    string
+	selector  string
+	key       crypto.Signer
+	algorithm string
+}
+
+// ReadDKIMKeyFile reads a PEM-encoded RSA or Ed25519 private key for DKIM signing from the given file
+func ReadDKIMKeyFile(filename string) (crypto.Signer, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parseDKIMKey(b)
+}
+
+func parseDKIMKey(b []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errDKIMKeyInvalid
+	}
+	var key any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, errDKIMKeyInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errDKIMKeyInvalid, err.Error())
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < dkimMinRSAKeyBits {
+			return nil, fmt.Errorf("DKIM RSA key too small, must be at least %d bits", dkimMinRSAKeyBits)
+		}
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	default:
+		return nil, errDKIMKeyInvalid
+	}
+}
+
+func newDKIMSigner(domain, selector string, key crypto.Signer) (*dkimSigner, error) {
+	var algorithm string
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		algorithm = "rsa-sha256"
+	case ed25519.PrivateKey:
+		algorithm = "ed25519-sha256"
+	default:
+		return nil, errDKIMKeyInvalid
+	}
+	return &dkimSigner{
+		domain:    domain,
+		selector:  selector,
+		key:       key,
+		algorithm: algorithm,
+	}, nil
+}
+
+// Sign returns the message with a DKIM-Signature header prepended. The message must use CRLF line endings,
+// since the signature is computed over the message as it is transmitted via SMTP.
+func (s *dkimSigner) Sign(message []byte, now time.Time) ([]byte, error) {
+	header, body, ok := bytes.Cut(message, []byte("\r\n\r\n"))
+	if !ok {
+		return nil, errors.New("invalid message, no header/body separator found")
+	}
+	fields := dkimHeaderFields(string(header) + "\r\n")
+	bodyHash := sha256.Sum256([]byte(dkimRelaxedBody(string(body))))
+	signedNames := make([]string, 0)
+	signedFields := make([]string, 0)
+	for _, name := range dkimSignedHeaders {
+		if field := dkimLastHeaderField(fields, name); field != "" {
+			signedNames = append(signedNames, strings.ToLower(name))
+			signedFields = append(signedFields, field)
+		}
+	}
+	signature := fmt.Sprintf("%s: v=1; a=%s; c=relaxed/relaxed;\r\n\td=%s; s=%s; t=%d;\r\n\th=%s;\r\n\tbh=%s;\r\n\tb=",
+		dkimSignatureHeader, s.algorithm, s.domain, s.selector, now.Unix(), strings.Join(signedNames, ":"), base64.StdEncoding.EncodeToString(bodyHash[:]))
+	var data strings.Builder
+	for _, field := range signedFields {
+		data.WriteString(dkimRelaxedHeader(field))
+	}
+	data.WriteString(strings.TrimSuffix(dkimRelaxedHeader(signature), "\r\n")) // The signature header itself is hashed without the trailing CRLF
+	digest := sha256.Sum256([]byte(data.String()))
+	opts := crypto.SignerOpts(crypto.SHA256)
+	if s.algorithm == "ed25519-sha256" {
+		opts = crypto.Hash(0) // Ed25519 signs the SHA-256 hash itself (PureEdDSA), see RFC 8463
+	}
+	b, err := s.key.Sign(rand.Reader, digest[:], opts)
+	if err != nil {
+		return nil, err
+	}
+	var signed bytes.Buffer
+	signed.WriteString(signature)
+	signed.WriteString(dkimFoldSignature(base64.StdEncoding.EncodeToString(b)))
+	signed.WriteString("\r\n")
+	signed.Write(message)
+	return signed.Bytes(), nil
+}
+
+// dkimHeaderFields splits a CRLF-terminated message header into header fields, including folded continuation lines
+func dkimHeaderFields(header string) []string {
+	fields := make([]string, 0)
+	for _, line := range strings.SplitAfter(header, "\r\n") {
+		if line == "" {
+			continue
+		} else if len(fields) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			fields[len(fields)-1] += line
+		} else {
+			fields = append(fields, line)
+		}
+	}
+	return fields
+}
+
+// dkimLastHeaderField returns the last header field with the given name, or an empty string if there is none
+func dkimLastHeaderField(fields []string, name string) string {
+	for i := len(fields) - 1; i >= 0; i-- {
+		fieldName, _, ok := strings.Cut(fields[i], ":")
+		if ok && strings.EqualFold(strings.TrimRight(fieldName, " \t"), name) {
+			return fields[i]
+		}
+	}
+	return ""
+}
+
+// dkimRelaxedHeader canonicalizes a header field using the "relaxed" algorithm, see RFC 6376, section 3.4.2
+func dkimRelaxedHeader(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	name = strings.ToLower(strings.TrimRight(name, " \t"))
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = strings.Trim(dkimWhitespaceRegex.ReplaceAllString(value, " "), " ")
+	return name + ":" + value + "\r\n"
+}
+
+// dkimRelaxedBody canonicalizes a message body using the "relaxed" algorithm, see RFC 6376, section 3.4.4
+func dkimRelaxedBody(body string) string {
+	lines := strings.Split(body, "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(dkimWhitespaceRegex.ReplaceAllString(line, " "), " ")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// dkimFoldSignature folds the base64-encoded signature into multiple header lines; whitespace in the b= tag is ignored
+func dkimFoldSignature(s string) string {
+	var folded strings.Builder
+	for len(s) > dkimSignatureLineLen {
+		folded.WriteString(s[:dkimSignatureLineLen] + "\r\n\t")
+		s = s[dkimSignatureLineLen:]
+	}
+	folded.WriteString(s)
+	return folded.String()
+}
+
+// toCRLF converts all line endings in the message to CRLF, as they are transmitted via SMTP
+func toCRLF(message []byte) []byte {
+	return dkimLineEndingRegex.ReplaceAll(message, []byte("\r\n"))
+}
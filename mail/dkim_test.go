@@ -0,0 +1,276 @@
+package mail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/model"
+)
+
+func TestDKIMRelaxedCanonicalization(t *testing.T) {
+	// Example from RFC 6376, section 3.4.5
+	fields := dkimHeaderFields("A: X\r\nB : Y\t\r\n\tZ  \r\n")
+	require.Equal(t, []string{"A: X\r\n", "B : Y\t\r\n\tZ  \r\n"}, fields)
+	require.Equal(t, "a:X\r\n", dkimRelaxedHeader(fields[0]))
+	require.Equal(t, "b:Y Z\r\n", dkimRelaxedHeader(fields[1]))
+	require.Equal(t, " C\r\nD E\r\n", dkimRelaxedBody(" C \r\nD \t E\r\n\r\n\r\n"))
+	require.Equal(t, "", dkimRelaxedBody("\r\n\r\n"))
+	require.Equal(t, "no newline\r\n", dkimRelaxedBody("no newline"))
+}
+
+func TestParseDKIMKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	pkcs8RSA, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	require.Nil(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	pkcs8Ed25519, err := x509.MarshalPKCS8PrivateKey(edKey)
+	require.Nil(t, err)
+
+	key, err := parseDKIMKey(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))
+	require.Nil(t, err)
+	require.True(t, rsaKey.Equal(key))
+
+	key, err = parseDKIMKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8RSA}))
+	require.Nil(t, err)
+	require.True(t, rsaKey.Equal(key))
+
+	key, err = parseDKIMKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8Ed25519}))
+	require.Nil(t, err)
+	require.True(t, edKey.Equal(key))
+
+	_, err = parseDKIMKey([]byte("not a key"))
+	require.ErrorIs(t, err, errDKIMKeyInvalid)
+	_, err = parseDKIMKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("whatever")}))
+	require.ErrorIs(t, err, errDKIMKeyInvalid)
+	_, err = parseDKIMKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("broken")}))
+	require.ErrorIs(t, err, errDKIMKeyInvalid)
+}
+
+func TestReadDKIMKeyFile(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(edKey)
+	require.Nil(t, err)
+	filename := filepath.Join(t.TempDir(), "dkim.key")
+	require.Nil(t, os.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), 0600))
+
+	key, err := ReadDKIMKeyFile(filename)
+	require.Nil(t, err)
+	require.True(t, edKey.Equal(key))
+
+	_, err = ReadDKIMKeyFile(filepath.Join(t.TempDir(), "does-not-exist.key"))
+	require.NotNil(t, err)
+}
+
+func TestDKIMSigner_Sign_RSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	signer, err := newDKIMSigner("ntfy.sh", "ntfy", key)
+	require.Nil(t, err)
+	message := "From: ntfy <ntfy@ntfy.sh>\r\nTo: phil@example.com\r\nSubject:   Hi  there\r\nX-Unsigned: 1\r\n\r\nHello  world \r\n\r\n"
+	signed, err := signer.Sign([]byte(message), time.Unix(1700000000, 0))
+	require.Nil(t, err)
+	require.True(t, strings.HasSuffix(string(signed), message))
+
+	tags := verifyTestDKIM(t, signed, key.Public())
+	require.Equal(t, "rsa-sha256", tags["a"])
+	require.Equal(t, "from:to:subject", tags["h"])
+	require.Equal(t, "1700000000", tags["t"])
+	for _, line := range strings.Split(string(signed), "\r\n") {
+		require.LessOrEqual(t, len(line), 78)
+	}
+
+	// Whitespace changes survive relaxed canonicalization, content changes do not
+	verifyTestDKIM(t, bytes.Replace(signed, []byte("Hello  world \r\n"), []byte("Hello world\r\n"), 1), key.Public())
+	require.ErrorContains(t, verifyDKIM(bytes.Replace(signed, []byte("Hello"), []byte("Hallo"), 1), key.Public()), "body hash mismatch")
+	require.ErrorContains(t, verifyDKIM(bytes.Replace(signed, []byte("Hi  there"), []byte("Hi you"), 1), key.Public()), "verification error")
+	require.Nil(t, verifyDKIM(bytes.Replace(signed, []byte("X-Unsigned: 1"), []byte("X-Unsigned: 2"), 1), key.Public()))
+}
+
+func TestDKIMSigner_Sign_Ed25519(t *testing.T) {
+	public, key, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	signer, err := newDKIMSigner("ntfy.sh", "ntfy", key)
+	require.Nil(t, err)
+	signed, err := signer.Sign([]byte("From: ntfy@ntfy.sh\r\nTo: phil@example.com\r\n\r\nHi\r\n"), time.Now())
+	require.Nil(t, err)
+	tags := verifyTestDKIM(t, signed, public)
+	require.Equal(t, "ed25519-sha256", tags["a"])
+	require.Equal(t, "from:to", tags["h"])
+	require.ErrorContains(t, verifyDKIM(bytes.Replace(signed, []byte("Hi"), []byte("Yo"), 1), public), "body hash mismatch")
+}
+
+func TestSender_DKIM(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	for _, key := range []crypto.Signer{rsaKey, edKey} {
+		addr, messages := newTestSMTPServer(t)
+		s := NewSender(&Config{
+			BaseURL:      "https://ntfy.sh",
+			SMTPAddr:     addr,
+			From:         "ntfy@ntfy.sh",
+			DKIMDomain:   "ntfy.sh",
+			DKIMSelector: "ntfy",
+			DKIMKey:      key,
+		})
+		m := model.NewDefaultMessage("mytopic", "This is a message\n. with a line starting with a dot")
+		m.Title = "Some title"
+		require.Nil(t, s.SendNotification("phil@example.com", m, "1.2.3.4"))
+		require.Nil(t, s.SendEmailVerification("phil@example.com", "https://ntfy.sh/account/email/verify/abc"))
+		require.Nil(t, s.SendPasswordReset("phil@example.com", "https://ntfy.sh/account/password/reset/abc"))
+		for _, subject := range []string{"Subject: Some title", "Subject: " + emailVerificationSubject, "Subject: " + passwordResetSubject} {
+			message := <-messages
+			require.Contains(t, string(message), subject)
+			verifyTestDKIM(t, message, key.Public())
+		}
+	}
+}
+
+func TestSender_NoDKIM(t *testing.T) {
+	addr, messages := newTestSMTPServer(t)
+	s := NewSender(&Config{
+		SMTPAddr: addr,
+		From:     "ntfy@ntfy.sh",
+	})
+	require.Nil(t, s.SendPasswordReset("phil@example.com", "https://ntfy.sh/account/password/reset/abc"))
+	require.NotContains(t, string(<-messages), dkimSignatureHeader)
+}
+
+var dkimTestSignatureValueRegex = regexp.MustCompile(`([;\s]b=)[^;]*`)
+
+func verifyTestDKIM(t *testing.T, message []byte, public crypto.PublicKey) map[string]string {
+	require.Nil(t, verifyDKIM(message, public))
+	header, _, _ := bytes.Cut(message, []byte("\r\n\r\n"))
+	tags, err := dkimTestTags(dkimLastHeaderField(dkimHeaderFields(string(header)+"\r\n"), dkimSignatureHeader))
+	require.Nil(t, err)
+	require.Equal(t, "1", tags["v"])
+	require.Equal(t, "relaxed/relaxed", tags["c"])
+	require.Equal(t, "ntfy.sh", tags["d"])
+	require.Equal(t, "ntfy", tags["s"])
+	return tags
+}
+
+// verifyDKIM verifies the DKIM-Signature of a message against the given public key, as a receiving
+// mail server would (minus the DNS lookup of the public key)
+func verifyDKIM(message []byte, public crypto.PublicKey) error {
+	header, body, ok := bytes.Cut(message, []byte("\r\n\r\n"))
+	if !ok {
+		return errors.New("no header/body separator")
+	}
+	fields := dkimHeaderFields(string(header) + "\r\n")
+	signatureField := dkimLastHeaderField(fields, dkimSignatureHeader)
+	if signatureField == "" {
+		return errors.New("no signature")
+	}
+	tags, err := dkimTestTags(signatureField)
+	if err != nil {
+		return err
+	}
+	bodyHash := sha256.Sum256([]byte(dkimRelaxedBody(string(body))))
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != tags["bh"] {
+		return errors.New("body hash mismatch")
+	}
+	var data strings.Builder
+	for _, name := range strings.Split(tags["h"], ":") {
+		if field := dkimLastHeaderField(fields, name); field != "" {
+			data.WriteString(dkimRelaxedHeader(field))
+		}
+	}
+	data.WriteString(strings.TrimSuffix(dkimRelaxedHeader(dkimTestSignatureValueRegex.ReplaceAllString(signatureField, "${1}")), "\r\n"))
+	digest := sha256.Sum256([]byte(data.String()))
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return err
+	}
+	switch tags["a"] {
+	case "rsa-sha256":
+		return rsa.VerifyPKCS1v15(public.(*rsa.PublicKey), crypto.SHA256, digest[:], signature)
+	case "ed25519-sha256":
+		if !ed25519.Verify(public.(ed25519.PublicKey), digest[:], signature) {
+			return errors.New("ed25519: verification error")
+		}
+		return nil
+	}
+	return errors.New("unknown algorithm")
+}
+
+func dkimTestTags(field string) (map[string]string, error) {
+	_, value, _ := strings.Cut(field, ":")
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(regexp.MustCompile(`\s+`).ReplaceAllString(value, ""), ";") {
+		if tag == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(tag, "=")
+		if !ok {
+			return nil, errors.New("invalid tag: " + tag)
+		}
+		tags[name] = value
+	}
+	return tags, nil
+}
+
+// newTestSMTPServer starts a minimal SMTP server that accepts all mail, and returns the messages
+// exactly as they were transmitted (with CRLF line endings, and after undoing the dot-stuffing)
+func newTestSMTPServer(t *testing.T) (addr string, messages chan []byte) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { listener.Close() })
+	messages = make(chan []byte, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c := textproto.NewConn(conn)
+				defer c.Close()
+				c.PrintfLine("220 localhost ESMTP")
+				for {
+					line, err := c.ReadLine()
+					if err != nil {
+						return
+					}
+					switch strings.ToUpper(strings.SplitN(line, " ", 2)[0]) {
+					case "DATA":
+						c.PrintfLine("354 Go ahead")
+						message, err := c.ReadDotBytes() // Converts CRLF to LF
+						if err != nil {
+							return
+						}
+						messages <- toCRLF(message)
+						c.PrintfLine("250 OK")
+					case "QUIT":
+						c.PrintfLine("221 Bye")
+						return
+					default:
+						c.PrintfLine("250 OK")
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), messages
+}
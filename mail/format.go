@@ -1,23 +1,48 @@
 package mail
 
 import (
+	"bytes"
 	_ "embed" // required by go:embed
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"html/template"
+	"io"
 	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/russross/blackfriday/v2"
 	"heckel.io/ntfy/v2/model"
 	"heckel.io/ntfy/v2/util"
 )
 
+const (
+	notificationTemplateName = "notification.html" // Name of the HTML template file, see Config.TemplateDir
+	actionView               = "view"              // Only view actions can be represented as links in emails
+	base64LineLength         = 76
+)
+
 var (
 	//go:embed "mailer_emoji_map.json"
 	emojisJSON string
 
+	//go:embed "templates/notification.html"
+	notificationTemplateDefault string
+
 	// emojiMap maps ntfy tag names to emoji, parsed once from the embedded JSON in init
 	emojiMap map[string]string
+
+	// markdownPolicy sanitizes the HTML rendered from markdown messages
+	markdownPolicy = bluemonday.UGCPolicy()
 )
 
 func init() {
@@ -26,8 +51,78 @@ func init() {
 	}
 }
 
-func formatMail(baseURL, senderIP, from, to string, m *model.Message) (string, error) {
-	topicURL := baseURL + "/" + m.Topic
+// notification holds the parameters to format a notification email, see formatMail
+type notification struct {
+	BaseURL        string
+	SenderIP       string
+	From           string
+	To             string
+	ReplyTo        string             // Signed Reply-To address (optional), see ReplyAddress
+	UnsubscribeURL string             // URL for the List-Unsubscribe header (optional)
+	Template       *template.Template // HTML template, see parseNotificationTemplate
+	Image          *inlineImage       // Image attachment to embed in the email (optional)
+}
+
+// inlineImage is an image attachment that is embedded in the email, and referenced from the HTML part via its Content-ID
+type inlineImage struct {
+	ContentID   string
+	ContentType string
+	Name        string
+	Data        []byte
+}
+
+// notificationTemplateData is passed to the HTML template of notification emails
+type notificationTemplateData struct {
+	Topic          string
+	TopicURL       string
+	ShortTopicURL  string
+	Title          string
+	Message        template.HTML // Rendered and sanitized message body
+	Emojis         []string
+	Tags           []string // Tags that do not map to emojis
+	Priority       string   // Empty for the default priority
+	Click          string
+	Icon           string
+	Actions        []*notificationTemplateAction
+	Attachment     *notificationTemplateAttachment
+	SenderIP       string
+	Time           string
+	UnsubscribeURL string
+}
+
+// notificationTemplateAction is a view action, rendered as a link in the HTML template
+type notificationTemplateAction struct {
+	Label string
+	URL   string
+}
+
+// notificationTemplateAttachment is the message attachment as passed to the HTML template
+type notificationTemplateAttachment struct {
+	Name  string
+	URL   string
+	Size  string       // Human-readable size, empty if unknown
+	Image template.URL // Image source (cid: reference or URL) if the attachment is an image, empty otherwise
+}
+
+// parseNotificationTemplate parses the HTML template for notification emails. If the template directory contains
+// a notification.html file, it is used instead of the built-in template.
+func parseNotificationTemplate(templateDir string) (*template.Template, error) {
+	content := notificationTemplateDefault
+	if templateDir != "" {
+		b, err := os.ReadFile(filepath.Join(templateDir, notificationTemplateName))
+		if err == nil {
+			content = string(b)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return template.New(notificationTemplateName).Parse(content)
+}
+
+// formatMail formats a notification email as multipart/alternative message, with a plain text part and an HTML
+// part rendered from the notification template. If an image is passed, it is embedded and referenced from the HTML.
+func formatMail(n *notification, m *model.Message) (string, error) {
+	topicURL := n.BaseURL + "/" + m.Topic
 	subject := m.Title
 	if subject == "" {
 		subject = m.Message
@@ -35,17 +130,17 @@ func formatMail(baseURL, senderIP, from, to string, m *model.Message) (string, e
 	subject = strings.ReplaceAll(strings.ReplaceAll(subject, "\r", ""), "\n", " ")
 	message := m.Message
 	trailer := ""
-	if len(m.Tags) > 0 {
-		emojis, tags := toEmojis(m.Tags)
-		if len(emojis) > 0 {
-			subject = strings.Join(emojis, " ") + " " + subject
-		}
-		if len(tags) > 0 {
-			trailer = "Tags: " + strings.Join(tags, ", ")
-		}
+	emojis, tags := toEmojis(m.Tags)
+	if len(emojis) > 0 {
+		subject = strings.Join(emojis, " ") + " " + subject
+	}
+	if len(tags) > 0 {
+		trailer = "Tags: " + strings.Join(tags, ", ")
 	}
+	priority := ""
 	if m.Priority != 0 && m.Priority != 3 {
-		priority, err := util.PriorityString(m.Priority)
+		var err error
+		priority, err = util.PriorityString(m.Priority)
 		if err != nil {
 			return "", err
 		}
@@ -57,28 +152,172 @@ func formatMail(baseURL, senderIP, from, to string, m *model.Message) (string, e
 	if trailer != "" {
 		message += "\n\n" + trailer
 	}
-	date := time.Unix(m.Time, 0).UTC().Format(time.RFC1123Z)
-	subject = mime.BEncoding.Encode("utf-8", subject)
-	body := `From: "{shortTopicURL}" <{from}>
-To: {to}
-Date: {date}
-Subject: {subject}
-Content-Type: text/plain; charset="utf-8"
-
-{message}
-
---
-This message was sent by {ip} at {time} via {topicURL}`
-	body = strings.ReplaceAll(body, "{from}", from)
-	body = strings.ReplaceAll(body, "{to}", to)
-	body = strings.ReplaceAll(body, "{date}", date)
-	body = strings.ReplaceAll(body, "{subject}", subject)
-	body = strings.ReplaceAll(body, "{message}", message)
-	body = strings.ReplaceAll(body, "{topicURL}", topicURL)
-	body = strings.ReplaceAll(body, "{shortTopicURL}", util.ShortTopicURL(topicURL))
-	body = strings.ReplaceAll(body, "{time}", time.Unix(m.Time, 0).UTC().Format(time.RFC1123))
-	body = strings.ReplaceAll(body, "{ip}", senderIP)
-	return body, nil
+	sentAt := time.Unix(m.Time, 0).UTC()
+	text := fmt.Sprintf("%s\n\n--\nThis message was sent by %s at %s via %s", message, n.SenderIP, sentAt.Format(time.RFC1123), topicURL)
+	var html bytes.Buffer
+	if err := n.Template.Execute(&html, &notificationTemplateData{
+		Topic:          m.Topic,
+		TopicURL:       topicURL,
+		ShortTopicURL:  util.ShortTopicURL(topicURL),
+		Title:          m.Title,
+		Message:        formatMailHTMLMessage(m),
+		Emojis:         emojis,
+		Tags:           tags,
+		Priority:       priority,
+		Click:          m.Click,
+		Icon:           m.Icon,
+		Actions:        formatMailHTMLActions(m),
+		Attachment:     formatMailHTMLAttachment(m, n.Image),
+		SenderIP:       n.SenderIP,
+		Time:           sentAt.Format(time.RFC1123),
+		UnsubscribeURL: n.UnsubscribeURL,
+	}); err != nil {
+		return "", err
+	}
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	if err := writeMailPart(w, "text/plain", text); err != nil {
+		return "", err
+	}
+	if n.Image != nil {
+		if err := writeMailRelatedPart(w, html.String(), n.Image); err != nil {
+			return "", err
+		}
+	} else if err := writeMailPart(w, "text/html", html.String()); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	var headers strings.Builder
+	headers.WriteString(fmt.Sprintf("From: \"%s\" <%s>\r\n", util.ShortTopicURL(topicURL), n.From))
+	headers.WriteString(fmt.Sprintf("To: %s\r\n", n.To))
+	if n.ReplyTo != "" {
+		headers.WriteString(fmt.Sprintf("Reply-To: %s\r\n", n.ReplyTo))
+	}
+	headers.WriteString(fmt.Sprintf("Date: %s\r\n", sentAt.Format(time.RFC1123Z)))
+	headers.WriteString(fmt.Sprintf("Subject: %s\r\n", mime.BEncoding.Encode("utf-8", subject)))
+	if n.UnsubscribeURL != "" {
+		headers.WriteString(fmt.Sprintf("List-Unsubscribe: <%s>\r\n", n.UnsubscribeURL))
+	}
+	headers.WriteString("MIME-Version: 1.0\r\n")
+	headers.WriteString(fmt.Sprintf("Content-Type: multipart/alternative; boundary=\"%s\"\r\n\r\n", w.Boundary()))
+	return headers.String() + body.String(), nil
+}
+
+// formatMailHTMLMessage renders the message body as HTML. Markdown messages are rendered and sanitized,
+// plain text messages are escaped. Binary (base64-encoded) message bodies are not included.
+func formatMailHTMLMessage(m *model.Message) template.HTML {
+	if m.Encoding != "" {
+		return ""
+	} else if m.ContentType == "text/markdown" {
+		return template.HTML(markdownPolicy.SanitizeBytes(blackfriday.Run([]byte(m.Message))))
+	}
+	return template.HTML(strings.ReplaceAll(template.HTMLEscapeString(m.Message), "\n", "<br>\n"))
+}
+
+// formatMailHTMLActions returns the view actions of the message. Other actions (http, broadcast, ...) cannot be
+// performed from an email, and are therefore not included.
+func formatMailHTMLActions(m *model.Message) []*notificationTemplateAction {
+	actions := make([]*notificationTemplateAction, 0)
+	for _, action := range m.Actions {
+		if action.Action == actionView && action.URL != "" {
+			actions = append(actions, &notificationTemplateAction{Label: action.Label, URL: action.URL})
+		}
+	}
+	return actions
+}
+
+// formatMailHTMLAttachment returns the attachment for the HTML template. Images are either embedded (if image is
+// passed), or referenced via their URL.
+func formatMailHTMLAttachment(m *model.Message, image *inlineImage) *notificationTemplateAttachment {
+	if m.Attachment == nil {
+		return nil
+	}
+	a := &notificationTemplateAttachment{
+		Name: m.Attachment.Name,
+		URL:  m.Attachment.URL,
+	}
+	if m.Attachment.Size > 0 {
+		a.Size = util.FormatSizeHuman(m.Attachment.Size)
+	}
+	if image != nil {
+		a.Image = template.URL("cid:" + image.ContentID) // Content ID is generated by us, see inlineImage
+	} else if u, err := url.Parse(m.Attachment.URL); err == nil && (u.Scheme == "http" || u.Scheme == "https") && isImage(m.Attachment) {
+		a.Image = template.URL(m.Attachment.URL) // Scheme is checked above
+	}
+	return a
+}
+
+// writeMailPart writes a quoted-printable encoded text part to the multipart writer
+func writeMailPart(w *multipart.Writer, contentType, content string) error {
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType + `; charset="utf-8"`},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+	qp := quotedprintable.NewWriter(part)
+	if _, err := io.WriteString(qp, content); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// writeMailRelatedPart writes a multipart/related part to the multipart writer, containing the HTML part and
+// the embedded image, so that mail clients display the image inline
+func writeMailRelatedPart(w *multipart.Writer, html string, image *inlineImage) error {
+	var related bytes.Buffer
+	rw := multipart.NewWriter(&related)
+	if err := writeMailPart(rw, "text/html", html); err != nil {
+		return err
+	}
+	imagePart, err := rw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {image.ContentType},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-ID":                {"<" + image.ContentID + ">"},
+		"Content-Disposition":       {mime.FormatMediaType("inline", map[string]string{"filename": image.Name})},
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeBase64Lines(imagePart, image.Data); err != nil {
+		return err
+	}
+	if err := rw.Close(); err != nil {
+		return err
+	}
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {fmt.Sprintf(`multipart/related; boundary="%s"`, rw.Boundary())},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = part.Write(related.Bytes())
+	return err
+}
+
+// writeBase64Lines writes the base64-encoded data, wrapped at 76 characters per line as required by RFC 2045
+func writeBase64Lines(w io.Writer, data []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 0 {
+		n := min(len(encoded), base64LineLength)
+		if _, err := io.WriteString(w, encoded[:n]+"\r\n"); err != nil {
+			return err
+		}
+		encoded = encoded[n:]
+	}
+	return nil
+}
+
+// isImage returns true if the attachment is an image, based on its content type or its file name
+func isImage(a *model.Attachment) bool {
+	contentType := a.Type
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(a.Name))
+	}
+	return strings.HasPrefix(contentType, "image/")
 }
 
 func toEmojis(tags []string) (emojisOut []string, tagsOut []string) {
@@ -1,6 +1,17 @@
 package mail
 
 import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -8,28 +19,27 @@ import (
 )
 
 func TestFormatMail_Basic(t *testing.T) {
-	actual, _ := formatMail("https://ntfy.sh", "1.2.3.4", "ntfy@ntfy.sh", "phil@example.com", &model.Message{
+	actual, err := formatMail(newTestNotification(t, ""), &model.Message{
 		ID:      "abc",
 		Time:    1640382204,
 		Event:   "message",
 		Topic:   "alerts",
 		Message: "A simple message",
 	})
-	expected := `From: "ntfy.sh/alerts" <ntfy@ntfy.sh>
+	require.Nil(t, err)
+	email := parseTestMail(t, actual)
+	require.Equal(t, `From: "ntfy.sh/alerts" <ntfy@ntfy.sh>
 To: phil@example.com
 Date: Fri, 24 Dec 2021 21:43:24 +0000
-Subject: A simple message
-Content-Type: text/plain; charset="utf-8"
-
-A simple message
+Subject: A simple message`, email.Headers)
+	require.Equal(t, `A simple message
 
 --
-This message was sent by 1.2.3.4 at Fri, 24 Dec 2021 21:43:24 UTC via https://ntfy.sh/alerts`
-	require.Equal(t, expected, actual)
+This message was sent by 1.2.3.4 at Fri, 24 Dec 2021 21:43:24 UTC via https://ntfy.sh/alerts`, email.Text)
 }
 
 func TestFormatMail_JustEmojis(t *testing.T) {
-	actual, _ := formatMail("https://ntfy.sh", "1.2.3.4", "ntfy@ntfy.sh", "phil@example.com", &model.Message{
+	actual, err := formatMail(newTestNotification(t, ""), &model.Message{
 		ID:      "abc",
 		Time:    1640382204,
 		Event:   "message",
@@ -37,21 +47,20 @@ func TestFormatMail_JustEmojis(t *testing.T) {
 		Message: "A simple message",
 		Tags:    []string{"grinning"},
 	})
-	expected := `From: "ntfy.sh/alerts" <ntfy@ntfy.sh>
+	require.Nil(t, err)
+	email := parseTestMail(t, actual)
+	require.Equal(t, `From: "ntfy.sh/alerts" <ntfy@ntfy.sh>
 To: phil@example.com
 Date: Fri, 24 Dec 2021 21:43:24 +0000
-Subject: =?utf-8?b?8J+YgCBBIHNpbXBsZSBtZXNzYWdl?=
-Content-Type: text/plain; charset="utf-8"
-
-A simple message
+Subject: =?utf-8?b?8J+YgCBBIHNpbXBsZSBtZXNzYWdl?=`, email.Headers)
+	require.Equal(t, `A simple message
 
 --
-This message was sent by 1.2.3.4 at Fri, 24 Dec 2021 21:43:24 UTC via https://ntfy.sh/alerts`
-	require.Equal(t, expected, actual)
+This message was sent by 1.2.3.4 at Fri, 24 Dec 2021 21:43:24 UTC via https://ntfy.sh/alerts`, email.Text)
 }
 
 func TestFormatMail_JustOtherTags(t *testing.T) {
-	actual, _ := formatMail("https://ntfy.sh", "1.2.3.4", "ntfy@ntfy.sh", "phil@example.com", &model.Message{
+	actual, err := formatMail(newTestNotification(t, ""), &model.Message{
 		ID:      "abc",
 		Time:    1640382204,
 		Event:   "message",
@@ -59,23 +68,22 @@ func TestFormatMail_JustOtherTags(t *testing.T) {
 		Message: "A simple message",
 		Tags:    []string{"not-an-emoji"},
 	})
-	expected := `From: "ntfy.sh/alerts" <ntfy@ntfy.sh>
+	require.Nil(t, err)
+	email := parseTestMail(t, actual)
+	require.Equal(t, `From: "ntfy.sh/alerts" <ntfy@ntfy.sh>
 To: phil@example.com
 Date: Fri, 24 Dec 2021 21:43:24 +0000
-Subject: A simple message
-Content-Type: text/plain; charset="utf-8"
-
-A simple message
+Subject: A simple message`, email.Headers)
+	require.Equal(t, `A simple message
 
 Tags: not-an-emoji
 
 --
-This message was sent by 1.2.3.4 at Fri, 24 Dec 2021 21:43:24 UTC via https://ntfy.sh/alerts`
-	require.Equal(t, expected, actual)
+This message was sent by 1.2.3.4 at Fri, 24 Dec 2021 21:43:24 UTC via https://ntfy.sh/alerts`, email.Text)
 }
 
 func TestFormatMail_JustPriority(t *testing.T) {
-	actual, _ := formatMail("https://ntfy.sh", "1.2.3.4", "ntfy@ntfy.sh", "phil@example.com", &model.Message{
+	actual, err := formatMail(newTestNotification(t, ""), &model.Message{
 		ID:       "abc",
 		Time:     1640382204,
 		Event:    "message",
@@ -83,23 +91,22 @@ func TestFormatMail_JustPriority(t *testing.T) {
 		Message:  "A simple message",
 		Priority: 2,
 	})
-	expected := `From: "ntfy.sh/alerts" <ntfy@ntfy.sh>
+	require.Nil(t, err)
+	email := parseTestMail(t, actual)
+	require.Equal(t, `From: "ntfy.sh/alerts" <ntfy@ntfy.sh>
 To: phil@example.com
 Date: Fri, 24 Dec 2021 21:43:24 +0000
-Subject: A simple message
-Content-Type: text/plain; charset="utf-8"
-
-A simple message
+Subject: A simple message`, email.Headers)
+	require.Equal(t, `A simple message
 
 Priority: low
 
 --
-This message was sent by 1.2.3.4 at Fri, 24 Dec 2021 21:43:24 UTC via https://ntfy.sh/alerts`
-	require.Equal(t, expected, actual)
+This message was sent by 1.2.3.4 at Fri, 24 Dec 2021 21:43:24 UTC via https://ntfy.sh/alerts`, email.Text)
 }
 
 func TestFormatMail_UTF8Subject(t *testing.T) {
-	actual, _ := formatMail("https://ntfy.sh", "1.2.3.4", "ntfy@ntfy.sh", "phil@example.com", &model.Message{
+	actual, err := formatMail(newTestNotification(t, ""), &model.Message{
 		ID:      "abc",
 		Time:    1640382204,
 		Event:   "message",
@@ -107,21 +114,20 @@ func TestFormatMail_UTF8Subject(t *testing.T) {
 		Message: "A simple message",
 		Title:   " :: A not so simple title öäüß ¡Hola, señor!",
 	})
-	expected := `From: "ntfy.sh/alerts" <ntfy@ntfy.sh>
+	require.Nil(t, err)
+	email := parseTestMail(t, actual)
+	require.Equal(t, `From: "ntfy.sh/alerts" <ntfy@ntfy.sh>
 To: phil@example.com
 Date: Fri, 24 Dec 2021 21:43:24 +0000
-Subject: =?utf-8?b?IDo6IEEgbm90IHNvIHNpbXBsZSB0aXRsZSDDtsOkw7zDnyDCoUhvbGEsIHNl?= =?utf-8?b?w7FvciE=?=
-Content-Type: text/plain; charset="utf-8"
-
-A simple message
+Subject: =?utf-8?b?IDo6IEEgbm90IHNvIHNpbXBsZSB0aXRsZSDDtsOkw7zDnyDCoUhvbGEsIHNl?= =?utf-8?b?w7FvciE=?=`, email.Headers)
+	require.Equal(t, `A simple message
 
 --
-This message was sent by 1.2.3.4 at Fri, 24 Dec 2021 21:43:24 UTC via https://ntfy.sh/alerts`
-	require.Equal(t, expected, actual)
+This message was sent by 1.2.3.4 at Fri, 24 Dec 2021 21:43:24 UTC via https://ntfy.sh/alerts`, email.Text)
 }
 
 func TestFormatMail_WithAllTheThings(t *testing.T) {
-	actual, _ := formatMail("https://ntfy.sh", "1.2.3.4", "ntfy@ntfy.sh", "phil@example.com", &model.Message{
+	actual, err := formatMail(newTestNotification(t, ""), &model.Message{
 		ID:       "abc",
 		Time:     1640382204,
 		Event:    "message",
@@ -131,19 +137,306 @@ func TestFormatMail_WithAllTheThings(t *testing.T) {
 		Title:    "Oh no 🙈\nThis is a message across\nmultiple lines",
 		Message:  "A message that contains monkeys 🙉\nNo really, though. Monkeys!",
 	})
-	expected := `From: "ntfy.sh/alerts" <ntfy@ntfy.sh>
+	require.Nil(t, err)
+	email := parseTestMail(t, actual)
+	require.Equal(t, `From: "ntfy.sh/alerts" <ntfy@ntfy.sh>
 To: phil@example.com
 Date: Fri, 24 Dec 2021 21:43:24 +0000
-Subject: =?utf-8?b?4pqg77iPIPCfkoAgT2ggbm8g8J+ZiCBUaGlzIGlzIGEgbWVzc2FnZSBhY3Jv?= =?utf-8?b?c3MgbXVsdGlwbGUgbGluZXM=?=
-Content-Type: text/plain; charset="utf-8"
-
-A message that contains monkeys 🙉
+Subject: =?utf-8?b?4pqg77iPIPCfkoAgT2ggbm8g8J+ZiCBUaGlzIGlzIGEgbWVzc2FnZSBhY3Jv?= =?utf-8?b?c3MgbXVsdGlwbGUgbGluZXM=?=`, email.Headers)
+	require.Equal(t, `A message that contains monkeys 🙉
 No really, though. Monkeys!
 
 Tags: tag123, other
 Priority: max
 
 --
-This message was sent by 1.2.3.4 at Fri, 24 Dec 2021 21:43:24 UTC via https://ntfy.sh/alerts`
-	require.Equal(t, expected, actual)
+This message was sent by 1.2.3.4 at Fri, 24 Dec 2021 21:43:24 UTC via https://ntfy.sh/alerts`, email.Text)
+}
+
+func TestFormatMail_ReplyTo(t *testing.T) {
+	actual, err := formatMail(newTestNotification(t, "ntfy-alerts+re_abc@ntfy.sh"), &model.Message{
+		ID:      "abc",
+		Time:    1640382204,
+		Event:   "message",
+		Topic:   "alerts",
+		Message: "A simple message",
+	})
+	require.Nil(t, err)
+	email := parseTestMail(t, actual)
+	require.Equal(t, `From: "ntfy.sh/alerts" <ntfy@ntfy.sh>
+To: phil@example.com
+Reply-To: ntfy-alerts+re_abc@ntfy.sh
+Date: Fri, 24 Dec 2021 21:43:24 +0000
+Subject: A simple message`, email.Headers)
+	require.Equal(t, `A simple message
+
+--
+This message was sent by 1.2.3.4 at Fri, 24 Dec 2021 21:43:24 UTC via https://ntfy.sh/alerts`, email.Text)
+}
+
+func TestFormatMail_HTML(t *testing.T) {
+	actual, err := formatMail(newTestNotification(t, ""), &model.Message{
+		ID:       "abc",
+		Time:     1640382204,
+		Event:    "message",
+		Topic:    "alerts",
+		Priority: 4,
+		Tags:     []string{"warning", "backup"},
+		Title:    "Backup <failed>",
+		Message:  "Disk full\nPlease check",
+		Click:    "https://example.com/backups",
+		Icon:     "https://example.com/icon.png",
+	})
+	require.Nil(t, err)
+	email := parseTestMail(t, actual)
+	require.Contains(t, email.HTML, `<title>Backup &lt;failed&gt;</title>`)
+	require.Contains(t, email.HTML, `<img src="https://example.com/icon.png"`)
+	require.Contains(t, email.HTML, `<a href="https://ntfy.sh/alerts" style="color: #338574; text-decoration: none;">ntfy.sh/alerts</a> &middot; Priority: high`)
+	require.Contains(t, email.HTML, `⚠️ Backup &lt;failed&gt;</h2>`)
+	require.Contains(t, email.HTML, "Disk full<br>\nPlease check")
+	require.Contains(t, email.HTML, "Tags: backup</div>")
+	require.Contains(t, email.HTML, `<a href="https://example.com/backups"`)
+	require.Contains(t, email.HTML, `This message was sent by 1.2.3.4 at Fri, 24 Dec 2021 21:43:24 UTC`)
+	require.NotContains(t, email.HTML, "account settings")
+}
+
+func TestFormatMail_HTML_MarkdownAndActions(t *testing.T) {
+	actual, err := formatMail(newTestNotification(t, ""), &model.Message{
+		ID:          "abc",
+		Time:        1640382204,
+		Event:       "message",
+		Topic:       "alerts",
+		Message:     "**Backup** failed, see [logs](https://example.com/logs)\n\n<script>alert('hi')</script>",
+		ContentType: "text/markdown",
+		Click:       "javascript:alert('hi')",
+		Actions: []*model.Action{
+			{ID: "1", Action: "view", Label: "Open logs", URL: "https://example.com/logs"},
+			{ID: "2", Action: "http", Label: "Retry", URL: "https://example.com/retry", Method: "POST"},
+		},
+	})
+	require.Nil(t, err)
+	email := parseTestMail(t, actual)
+	require.Contains(t, email.HTML, `<strong>Backup</strong> failed, see <a href="https://example.com/logs" rel="nofollow">logs</a>`)
+	require.NotContains(t, email.HTML, "<script>")
+	require.Contains(t, email.HTML, `<a href="#ZgotmplZ"`) // Unsafe click URL is neutralized
+	require.Contains(t, email.HTML, ">Open logs</a>")
+	require.NotContains(t, email.HTML, "Retry")
+	require.Contains(t, email.Text, "**Backup** failed") // Markdown is kept as-is in the plain text part
+}
+
+func TestFormatMail_HTML_Attachment(t *testing.T) {
+	actual, err := formatMail(newTestNotification(t, ""), &model.Message{
+		ID:      "abc",
+		Time:    1640382204,
+		Event:   "message",
+		Topic:   "alerts",
+		Message: "Here's the report",
+		Attachment: &model.Attachment{
+			Name: "report.pdf",
+			Type: "application/pdf",
+			Size: 2048,
+			URL:  "https://ntfy.sh/file/abc.pdf",
+		},
+	})
+	require.Nil(t, err)
+	email := parseTestMail(t, actual)
+	require.Contains(t, email.HTML, `<a href="https://ntfy.sh/file/abc.pdf" style="color: #338574;">report.pdf</a> (2.0 KB)`)
+	require.NotContains(t, email.HTML, "<img")
+	require.Nil(t, email.Image)
+}
+
+func TestFormatMail_HTML_ExternalImage(t *testing.T) {
+	actual, err := formatMail(newTestNotification(t, ""), &model.Message{
+		ID:      "abc",
+		Time:    1640382204,
+		Event:   "message",
+		Topic:   "alerts",
+		Message: "Motion detected",
+		Attachment: &model.Attachment{
+			Name: "cam.jpg",
+			URL:  "https://example.com/cam.jpg",
+		},
+	})
+	require.Nil(t, err)
+	email := parseTestMail(t, actual)
+	require.Contains(t, email.HTML, `<img src="https://example.com/cam.jpg" alt="cam.jpg"`)
+	require.Nil(t, email.Image)
+}
+
+func TestFormatMail_HTML_InlineImage(t *testing.T) {
+	n := newTestNotification(t, "")
+	n.Image = &inlineImage{
+		ContentID:   "abc@ntfy",
+		ContentType: "image/png",
+		Name:        "cam.png",
+		Data:        bytes.Repeat([]byte{0x89, 'P', 'N', 'G'}, 1000),
+	}
+	actual, err := formatMail(n, &model.Message{
+		ID:      "abc",
+		Time:    1640382204,
+		Event:   "message",
+		Topic:   "alerts",
+		Message: "Motion detected",
+		Attachment: &model.Attachment{
+			Name: "cam.png",
+			Type: "image/png",
+			Size: 4000,
+			URL:  "https://ntfy.sh/file/abc.png",
+		},
+	})
+	require.Nil(t, err)
+	email := parseTestMail(t, actual)
+	require.Contains(t, email.HTML, `<img src="cid:abc@ntfy" alt="cam.png"`)
+	require.Equal(t, "<abc@ntfy>", email.ImageHeader.Get("Content-ID"))
+	require.Equal(t, "image/png", email.ImageHeader.Get("Content-Type"))
+	require.Equal(t, `inline; filename=cam.png`, email.ImageHeader.Get("Content-Disposition"))
+	require.Equal(t, n.Image.Data, email.Image)
+	for _, line := range strings.Split(actual, "\r\n") {
+		require.LessOrEqual(t, len(line), 998) // RFC 5322 line length limit
+	}
+}
+
+func TestFormatMail_ListUnsubscribe(t *testing.T) {
+	n := newTestNotification(t, "")
+	n.UnsubscribeURL = "https://ntfy.sh/account"
+	actual, err := formatMail(n, &model.Message{
+		ID:      "abc",
+		Time:    1640382204,
+		Event:   "message",
+		Topic:   "alerts",
+		Message: "A simple message",
+	})
+	require.Nil(t, err)
+	email := parseTestMail(t, actual)
+	require.Equal(t, `From: "ntfy.sh/alerts" <ntfy@ntfy.sh>
+To: phil@example.com
+Date: Fri, 24 Dec 2021 21:43:24 +0000
+Subject: A simple message
+List-Unsubscribe: <https://ntfy.sh/account>`, email.Headers)
+	require.Contains(t, email.HTML, `<a href="https://ntfy.sh/account" style="color: #9e9e9e;">account settings</a>`)
+}
+
+func TestParseNotificationTemplate_TemplateDir(t *testing.T) {
+	templateDir := t.TempDir()
+	tpl, err := parseNotificationTemplate(templateDir) // No notification.html, falls back to built-in template
+	require.Nil(t, err)
+	require.NotNil(t, tpl)
+
+	require.Nil(t, os.WriteFile(filepath.Join(templateDir, "notification.html"), []byte(`<p>{{ .Title }}: {{ .Message }}</p>`), 0600))
+	n := newTestNotification(t, "")
+	n.Template, err = parseNotificationTemplate(templateDir)
+	require.Nil(t, err)
+	actual, err := formatMail(n, &model.Message{
+		ID:      "abc",
+		Time:    1640382204,
+		Event:   "message",
+		Topic:   "alerts",
+		Title:   "Alert",
+		Message: "Something <happened>",
+	})
+	require.Nil(t, err)
+	require.Equal(t, "<p>Alert: Something &lt;happened&gt;</p>", parseTestMail(t, actual).HTML)
+
+	require.Nil(t, os.WriteFile(filepath.Join(templateDir, "notification.html"), []byte(`{{ .Title `), 0600))
+	_, err = parseNotificationTemplate(templateDir)
+	require.Error(t, err)
+}
+
+func TestSender_InlineImage(t *testing.T) {
+	data := bytes.Repeat([]byte{0x89, 'P', 'N', 'G'}, 100)
+	s := &realSender{config: &Config{
+		BaseURL:     "https://ntfy.sh",
+		Attachments: &testAttachmentReader{files: map[string][]byte{"abc": data}},
+	}}
+	image := s.inlineImage(&model.Message{ID: "abc", Attachment: &model.Attachment{Name: "cam.png", Type: "image/png", Size: 400, URL: "https://ntfy.sh/file/abc.png"}})
+	require.NotNil(t, image)
+	require.Equal(t, "abc@ntfy", image.ContentID)
+	require.Equal(t, "image/png", image.ContentType)
+	require.Equal(t, data, image.Data)
+
+	require.Nil(t, s.inlineImage(&model.Message{ID: "abc"}))                                                                                                                             // No attachment
+	require.Nil(t, s.inlineImage(&model.Message{ID: "abc", Attachment: &model.Attachment{Name: "report.pdf", Type: "application/pdf", Size: 400, URL: "https://ntfy.sh/file/abc.pdf"}})) // Not an image
+	require.Nil(t, s.inlineImage(&model.Message{ID: "abc", Attachment: &model.Attachment{Name: "cam.png", Type: "image/png", Size: 400, URL: "https://example.com/cam.png"}}))           // External
+	require.Nil(t, s.inlineImage(&model.Message{ID: "abc", Attachment: &model.Attachment{Name: "cam.png", Type: "image/png", Size: 3 * 1024 * 1024, URL: "https://ntfy.sh/file/abc.png"}}))
+	require.Nil(t, s.inlineImage(&model.Message{ID: "xyz", Attachment: &model.Attachment{Name: "cam.png", Type: "image/png", Size: 400, URL: "https://ntfy.sh/file/xyz.png"}})) // Not found
+}
+
+type testMail struct {
+	Headers     string // Headers, without MIME-Version and Content-Type
+	Text        string
+	HTML        string
+	Image       []byte
+	ImageHeader textproto.MIMEHeader
+}
+
+type testAttachmentReader struct {
+	files map[string][]byte
+}
+
+func (r *testAttachmentReader) Read(id string) (io.ReadCloser, int64, error) {
+	data, ok := r.files[id]
+	if !ok {
+		return nil, 0, errors.New("not found")
+	}
+	return io.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+func newTestNotification(t *testing.T, replyTo string) *notification {
+	tpl, err := parseNotificationTemplate("")
+	require.Nil(t, err)
+	return &notification{
+		BaseURL:  "https://ntfy.sh",
+		SenderIP: "1.2.3.4",
+		From:     "ntfy@ntfy.sh",
+		To:       "phil@example.com",
+		ReplyTo:  replyTo,
+		Template: tpl,
+	}
+}
+
+func parseTestMail(t *testing.T, s string) *testMail {
+	headerEnd := strings.Index(s, "\r\n\r\n")
+	require.True(t, headerEnd > 0)
+	headers := make([]string, 0)
+	for _, line := range strings.Split(s[:headerEnd], "\r\n") {
+		if !strings.HasPrefix(line, "MIME-Version:") && !strings.HasPrefix(line, "Content-Type:") {
+			headers = append(headers, line)
+		}
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(s))
+	require.Nil(t, err)
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.Nil(t, err)
+	require.Equal(t, "multipart/alternative", mediaType)
+	email := &testMail{Headers: strings.Join(headers, "\n")}
+	readTestMailParts(t, email, multipart.NewReader(msg.Body, params["boundary"]))
+	return email
+}
+
+func readTestMailParts(t *testing.T, email *testMail, reader *multipart.Reader) {
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return
+		}
+		require.Nil(t, err)
+		mediaType, params, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		require.Nil(t, err)
+		if mediaType == "multipart/related" {
+			readTestMailParts(t, email, multipart.NewReader(part, params["boundary"]))
+			continue
+		}
+		b, err := io.ReadAll(part)
+		require.Nil(t, err)
+		switch mediaType {
+		case "text/plain":
+			email.Text = strings.ReplaceAll(string(b), "\r\n", "\n")
+		case "text/html":
+			email.HTML = strings.ReplaceAll(string(b), "\r\n", "\n")
+		default:
+			email.Image, err = base64.StdEncoding.DecodeString(strings.ReplaceAll(string(b), "\r\n", ""))
+			require.Nil(t, err)
+			email.ImageHeader = part.Header
+		}
+	}
 }
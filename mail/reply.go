@@ -0,0 +1,84 @@
+package mail
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"heckel.io/ntfy/v2/model"
+)
+
+// ReplyTokenPrefix is the prefix of the address sub-part that carries the reply token in the Reply-To
+// address of notification emails, e.g. ntfy-mytopic+re_<token>@ntfy.sh
+const ReplyTokenPrefix = "re_"
+
+const (
+	// ReplyTokenExpiry is how long replies to a notification email are accepted
+	ReplyTokenExpiry = 7 * 24 * time.Hour
+
+	// replySignatureLength is the number of bytes of the HMAC-SHA256 used as a reply token signature
+	replySignatureLength = 10
+
+	// replyExpiresLength is the number of bytes of the expiry (Unix time) at the end of the reply token payload
+	replyExpiresLength = 4
+)
+
+var (
+	// ErrReplyTokenInvalid is returned by ParseReplyToken if a reply token is malformed or its signature does not match
+	ErrReplyTokenInvalid = errors.New("invalid reply token")
+
+	// ErrReplyTokenExpired is returned by ParseReplyToken if a reply token is valid, but expired
+	ErrReplyTokenExpired = errors.New("reply token expired")
+
+	// replyTokenEncoding is used to encode message ID and signature. Base32 is used (and lower-cased in the address)
+	// because mail servers may change the case of the local part of an address.
+	replyTokenEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// ReplyAddress returns the signed Reply-To address for the notification email for the given message,
+// e.g. ntfy-mytopic+re_<payload>_<signature>@ntfy.sh, where the payload is the message ID and the expiry
+// of the address (see ReplyTokenExpiry). Replies sent to this address are received by ntfy's SMTP server,
+// and published to the topic as a message that references the original message.
+func ReplyAddress(secret, addrPrefix, domain string, m *model.Message) string {
+	token := replyToken(secret, m.Topic, m.ID, time.Now().Add(ReplyTokenExpiry))
+	return fmt.Sprintf("%s%s+%s%s@%s", addrPrefix, m.Topic, ReplyTokenPrefix, token, domain)
+}
+
+// ParseReplyToken verifies a reply token (without the ReplyTokenPrefix) for the given topic, and returns
+// the ID of the message that is being replied to. Expired tokens are rejected with ErrReplyTokenExpired.
+func ParseReplyToken(secret, topic, token string) (messageID string, err error) {
+	encodedPayload, encodedSignature, ok := strings.Cut(strings.ToUpper(token), "_")
+	if !ok {
+		return "", ErrReplyTokenInvalid
+	}
+	payload, err := replyTokenEncoding.DecodeString(encodedPayload)
+	if err != nil || len(payload) <= replyExpiresLength {
+		return "", ErrReplyTokenInvalid
+	}
+	id, expires := string(payload[:len(payload)-replyExpiresLength]), int64(binary.BigEndian.Uint32(payload[len(payload)-replyExpiresLength:]))
+	signature, err := replyTokenEncoding.DecodeString(encodedSignature)
+	if err != nil || !hmac.Equal(signature, replySignature(secret, topic, id, expires)) {
+		return "", ErrReplyTokenInvalid
+	} else if time.Now().Unix() > expires {
+		return "", ErrReplyTokenExpired
+	}
+	return id, nil
+}
+
+func replyToken(secret, topic, messageID string, expires time.Time) string {
+	payload := binary.BigEndian.AppendUint32([]byte(messageID), uint32(expires.Unix()))
+	signature := replySignature(secret, topic, messageID, int64(uint32(expires.Unix())))
+	return strings.ToLower(replyTokenEncoding.EncodeToString(payload) + "_" + replyTokenEncoding.EncodeToString(signature))
+}
+
+func replySignature(secret, topic, messageID string, expires int64) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(topic + "/" + messageID + "/" + strconv.FormatInt(expires, 10))) // Neither topic nor message ID can contain a slash
+	return h.Sum(nil)[:replySignatureLength]
+}
@@ -0,0 +1,59 @@
+package mail
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/model"
+)
+
+func TestReplyAddress_ParseReplyToken(t *testing.T) {
+	m := &model.Message{ID: "aBcDeF123456", Topic: "alerts"}
+	address := ReplyAddress("secret", "ntfy-", "ntfy.sh", m)
+	require.Regexp(t, `^ntfy-alerts\+re_[a-z2-7]+_[a-z2-7]+@ntfy\.sh$`, address)
+
+	token := strings.TrimSuffix(strings.TrimPrefix(address, "ntfy-alerts+re_"), "@ntfy.sh")
+	messageID, err := ParseReplyToken("secret", "alerts", token)
+	require.Nil(t, err)
+	require.Equal(t, "aBcDeF123456", messageID)
+
+	// Mail servers may change the case of the local part
+	messageID, err = ParseReplyToken("secret", "alerts", strings.ToUpper(token))
+	require.Nil(t, err)
+	require.Equal(t, "aBcDeF123456", messageID)
+}
+
+func TestParseReplyToken_Invalid(t *testing.T) {
+	expires := time.Now().Add(time.Hour)
+	token := replyToken("secret", "alerts", "aBcDeF123456", expires)
+	encodedID, encodedSignature, _ := strings.Cut(token, "_")
+	otherEncodedID, _, _ := strings.Cut(replyToken("secret", "alerts", "otherid12345", expires), "_")
+	laterEncodedID, _, _ := strings.Cut(replyToken("secret", "alerts", "aBcDeF123456", expires.Add(time.Hour)), "_")
+
+	_, err := ParseReplyToken("other secret", "alerts", token)
+	require.Equal(t, ErrReplyTokenInvalid, err)
+	_, err = ParseReplyToken("secret", "othertopic", token)
+	require.Equal(t, ErrReplyTokenInvalid, err)
+	_, err = ParseReplyToken("secret", "alerts", otherEncodedID+"_"+encodedSignature)
+	require.Equal(t, ErrReplyTokenInvalid, err)
+	_, err = ParseReplyToken("secret", "alerts", laterEncodedID+"_"+encodedSignature) // Extended expiry
+	require.Equal(t, ErrReplyTokenInvalid, err)
+	_, err = ParseReplyToken("secret", "alerts", encodedID)
+	require.Equal(t, ErrReplyTokenInvalid, err)
+	_, err = ParseReplyToken("secret", "alerts", "_"+encodedSignature)
+	require.Equal(t, ErrReplyTokenInvalid, err)
+	_, err = ParseReplyToken("secret", "alerts", "not!base32_"+encodedSignature)
+	require.Equal(t, ErrReplyTokenInvalid, err)
+}
+
+func TestParseReplyToken_Expired(t *testing.T) {
+	token := replyToken("secret", "alerts", "aBcDeF123456", time.Now().Add(-time.Minute))
+	_, err := ParseReplyToken("secret", "alerts", token)
+	require.Equal(t, ErrReplyTokenExpired, err)
+
+	// Expired tokens with an invalid signature are still invalid
+	_, err = ParseReplyToken("other secret", "alerts", token)
+	require.Equal(t, ErrReplyTokenInvalid, err)
+}
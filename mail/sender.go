@@ -1,10 +1,13 @@
 package mail
 
 import (
+	"crypto"
 	"fmt"
+	"io"
 	"mime"
 	"net"
 	"net/smtp"
+	"path"
 	"strings"
 	"sync"
 	"time"
@@ -18,6 +21,8 @@ const (
 
 	emailVerificationSubject = "Verify your email for ntfy"
 	passwordResetSubject     = "Reset your ntfy password"
+
+	maxInlineImageSize = 2 * 1024 * 1024 // Image attachments up to this size are embedded in notification emails
 )
 
 // Config holds the SMTP configuration for the mail sender
@@ -27,6 +32,26 @@ type Config struct {
 	SMTPUser string // SMTP auth username
 	SMTPPass string // SMTP auth password
 	From     string // Sender email address
+
+	TemplateDir    string           // Directory to load the notification email HTML template from (optional)
+	UnsubscribeURL string           // URL for the List-Unsubscribe header of notification emails (optional)
+	Attachments    AttachmentReader // Attachment store, to embed image attachments in notification emails (optional)
+
+	// If ReplySecret is set, notification emails carry a signed Reply-To address on ntfy's SMTP server,
+	// so that replies are published to the topic, see ReplyAddress
+	ReplySecret     string // Secret used to sign reply tokens
+	ReplyAddrPrefix string // SMTP server address prefix, e.g. "ntfy-"
+	ReplyDomain     string // SMTP server domain, e.g. "ntfy.sh"
+
+	// If DKIMKey is set, all outgoing emails are signed with DKIM, see ReadDKIMKeyFile
+	DKIMDomain   string        // Signing domain (d=), e.g. "ntfy.sh"
+	DKIMSelector string        // Selector (s=) of the DNS record holding the public key, e.g. "ntfy"
+	DKIMKey      crypto.Signer // RSA or Ed25519 private key
+}
+
+// AttachmentReader reads attachment files, e.g. the attachment.Store
+type AttachmentReader interface {
+	Read(id string) (io.ReadCloser, int64, error)
 }
 
 // Sender sends all of ntfy's outgoing email: notification emails (the email-on-publish feature)
@@ -56,7 +81,25 @@ func NewSender(config *Config) Sender {
 // SendNotification formats a ntfy message into a notification email and sends it via SMTP. It
 // tracks success/failure counts, exposed via Counts (used for the server stats).
 func (s *realSender) SendNotification(to string, m *model.Message, senderIP string) error {
-	message, err := formatMail(s.config.BaseURL, senderIP, s.config.From, to, m)
+	replyTo := ""
+	if s.config.ReplySecret != "" {
+		replyTo = ReplyAddress(s.config.ReplySecret, s.config.ReplyAddrPrefix, s.config.ReplyDomain, m)
+	}
+	tpl, err := parseNotificationTemplate(s.config.TemplateDir)
+	if err != nil {
+		s.count(false)
+		return err
+	}
+	message, err := formatMail(&notification{
+		BaseURL:        s.config.BaseURL,
+		SenderIP:       senderIP,
+		From:           s.config.From,
+		To:             to,
+		ReplyTo:        replyTo,
+		UnsubscribeURL: s.config.UnsubscribeURL,
+		Template:       tpl,
+		Image:          s.inlineImage(m),
+	}, m)
 	if err != nil {
 		s.count(false)
 		return err
@@ -67,6 +110,35 @@ func (s *realSender) SendNotification(to string, m *model.Message, senderIP stri
 	return err
 }
 
+// inlineImage reads the image attachment of the message from the attachment store, so that it can be embedded in
+// the notification email. It returns nil if the attachment is not an image, is too large, or is not stored on this server.
+func (s *realSender) inlineImage(m *model.Message) *inlineImage {
+	a := m.Attachment
+	if s.config.Attachments == nil || a == nil || a.Size > maxInlineImageSize || !isImage(a) || !strings.HasPrefix(a.URL, s.config.BaseURL+"/file/") {
+		return nil
+	}
+	reader, _, err := s.config.Attachments.Read(m.ID)
+	if err != nil {
+		log.Tag(tagMail).Err(err).Debug("Unable to read attachment, not embedding it in email")
+		return nil
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(io.LimitReader(reader, maxInlineImageSize+1))
+	if err != nil || len(data) > maxInlineImageSize {
+		return nil
+	}
+	contentType := a.Type
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(a.Name))
+	}
+	return &inlineImage{
+		ContentID:   m.ID + "@ntfy",
+		ContentType: contentType,
+		Name:        a.Name,
+		Data:        data,
+	}
+}
+
 // NotificationCounts returns the number of notification emails sent, broken down into total, success and failure
 func (s *realSender) NotificationCounts() (total int64, success int64, failure int64) {
 	s.mu.Lock()
@@ -116,12 +188,22 @@ Content-Type: text/plain; charset="utf-8"
 	return s.sendRaw(to, []byte(message))
 }
 
-// sendRaw sends a raw email message via SMTP
+// sendRaw sends a raw email message via SMTP, and signs it with DKIM if configured
 func (s *realSender) sendRaw(to string, message []byte) error {
 	host, _, err := net.SplitHostPort(s.config.SMTPAddr)
 	if err != nil {
 		return err
 	}
+	if s.config.DKIMKey != nil {
+		signer, err := newDKIMSigner(s.config.DKIMDomain, s.config.DKIMSelector, s.config.DKIMKey)
+		if err != nil {
+			return err
+		}
+		message, err = signer.Sign(toCRLF(message), time.Now())
+		if err != nil {
+			return err
+		}
+	}
 	var auth smtp.Auth
 	if s.config.SMTPUser != "" {
 		auth = smtp.PlainAuth("", s.config.SMTPUser, s.config.SMTPPass, host)
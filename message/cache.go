@@ -172,6 +172,7 @@ func (c *Cache) addMessages(ms []*model.Message) error {
 			util.SanitizeUTF8(m.ContentType),
 			m.Encoding,
 			published,
+			m.InReplyTo,
 		)
 		if err != nil {
 			return err
@@ -476,7 +477,7 @@ func readMessages(rows *sql.Rows) ([]*model.Message, error) {
 func readMessage(rows *sql.Rows) (*model.Message, error) {
 	var timestamp, expires, attachmentSize, attachmentExpires int64
 	var priority int
-	var id, sequenceID, event, topic, msg, title, tagsStr, click, icon, actionsStr, attachmentName, attachmentType, attachmentURL, sender, user, contentType, encoding string
+	var id, sequenceID, event, topic, msg, title, tagsStr, click, icon, actionsStr, attachmentName, attachmentType, attachmentURL, sender, user, contentType, encoding, inReplyTo string
 	err := rows.Scan(
 		&id,
 		&sequenceID,
@@ -500,6 +501,7 @@ func readMessage(rows *sql.Rows) (*model.Message, error) {
 		&user,
 		&contentType,
 		&encoding,
+		&inReplyTo,
 	)
 	if err != nil {
 		return nil, err
@@ -547,6 +549,7 @@ func readMessage(rows *sql.Rows) (*model.Message, error) {
 		User:        user,
 		ContentType: contentType,
 		Encoding:    encoding,
+		InReplyTo:   inReplyTo,
 	}, nil
 }
 
@@ -36,7 +36,8 @@ const (
 			user_id TEXT NOT NULL,
 			content_type TEXT NOT NULL,
 			encoding TEXT NOT NULL,
-			published BOOLEAN NOT NULL DEFAULT FALSE
+			published BOOLEAN NOT NULL DEFAULT FALSE,
+			in_reply_to TEXT NOT NULL DEFAULT ''
 		);
 		CREATE INDEX IF NOT EXISTS idx_message_mid ON message (mid);
 		CREATE INDEX IF NOT EXISTS idx_message_sequence_id ON message (sequence_id);
@@ -59,7 +60,7 @@ const (
 
 // PostgreSQL schema management queries
 const (
-	postgresCurrentSchemaVersion     = 15
+	postgresCurrentSchemaVersion     = 16
 	postgresInsertSchemaVersionQuery = `INSERT INTO schema_version (store, version) VALUES ('message', $1)`
 	postgresUpdateSchemaVersionQuery = `UPDATE schema_version SET version = $1 WHERE store = 'message'`
 	postgresSelectSchemaVersionQuery = `SELECT version FROM schema_version WHERE store = 'message'`
@@ -71,10 +72,16 @@ const (
 	postgresMigrate14To15CreateIndexQuery = `
 		CREATE INDEX IF NOT EXISTS idx_message_attachment_expires ON message (attachment_expires) WHERE attachment_deleted = FALSE;
 	`
+
+	// 15 -> 16
+	postgresMigrate15To16AlterMessageTableQuery = `
+		ALTER TABLE message ADD COLUMN IF NOT EXISTS in_reply_to TEXT NOT NULL DEFAULT '';
+	`
 )
 
 var postgresMigrations = map[int]func(d *sql.DB) error{
 	14: postgresMigrateFrom14,
+	15: postgresMigrateFrom15,
 }
 
 func setupPostgres(d *sql.DB) error {
@@ -110,6 +117,19 @@ func postgresMigrateFrom14(d *sql.DB) error {
 	})
 }
 
+func postgresMigrateFrom15(d *sql.DB) error {
+	log.Tag(tagMessageCache).Info("Migrating message cache database schema: from 15 to 16")
+	return db.ExecTx(d, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(postgresMigrate15To16AlterMessageTableQuery); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(postgresUpdateSchemaVersionQuery, 16); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
 func setupNewPostgresDB(sqlDB *sql.DB) error {
 	return db.ExecTx(sqlDB, func(tx *sql.Tx) error {
 		if _, err := tx.Exec(postgresCreateTablesQuery); err != nil {
@@ -37,7 +37,8 @@ const (
 			user TEXT NOT NULL,
 			content_type TEXT NOT NULL,
 			encoding TEXT NOT NULL,
-			published INT NOT NULL
+			published INT NOT NULL,
+			in_reply_to TEXT NOT NULL
 		);
 		CREATE INDEX IF NOT EXISTS idx_mid ON messages (mid);
 		CREATE INDEX IF NOT EXISTS idx_sequence_id ON messages (sequence_id);
@@ -57,7 +58,7 @@ const (
 
 // Schema version management for SQLite
 const (
-	sqliteCurrentSchemaVersion          = 15
+	sqliteCurrentSchemaVersion          = 16
 	sqliteCreateSchemaVersionTableQuery = `
 		CREATE TABLE IF NOT EXISTS schemaVersion (
 			id INT PRIMARY KEY,
@@ -190,6 +191,11 @@ const (
 		ALTER TABLE messages ADD COLUMN event TEXT NOT NULL DEFAULT('message');
 		CREATE INDEX IF NOT EXISTS idx_sequence_id ON messages (sequence_id);
 	`
+
+	// 15 -> 16
+	sqliteMigrate15To16AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN in_reply_to TEXT NOT NULL DEFAULT('');
+	`
 )
 
 var (
@@ -209,6 +215,7 @@ var (
 		12: sqliteMigrateFrom12,
 		13: sqliteMigrateFrom13,
 		14: sqliteMigrateFrom14,
+		15: sqliteMigrateFrom15,
 	}
 )
 
@@ -464,3 +471,16 @@ func sqliteMigrateFrom14(sqlDB *sql.DB, _ time.Duration) error {
 		return nil
 	})
 }
+
+func sqliteMigrateFrom15(sqlDB *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 15 to 16")
+	return db.ExecTx(sqlDB, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(sqliteMigrate15To16AlterMessagesTableQuery); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteUpdateSchemaVersionQuery, 16); err != nil {
+			return err
+		}
+		return nil
+	})
+}
@@ -768,6 +768,7 @@ func TestStore_MessageFieldRoundTrip(t *testing.T) {
 		m.Encoding = "base64"
 		m.Sender = netip.MustParseAddr("9.8.7.6")
 		m.User = "u_TestUser123"
+		m.InReplyTo = "abcDEF123456"
 		require.Nil(t, s.AddMessage(m))
 
 		// Retrieve and verify every field
@@ -790,6 +791,7 @@ func TestStore_MessageFieldRoundTrip(t *testing.T) {
 		require.Equal(t, "base64", retrieved.Encoding)
 		require.Equal(t, netip.MustParseAddr("9.8.7.6"), retrieved.Sender)
 		require.Equal(t, "u_TestUser123", retrieved.User)
+		require.Equal(t, "abcDEF123456", retrieved.InReplyTo)
 
 		// Verify actions round-trip
 		require.Equal(t, 2, len(retrieved.Actions))
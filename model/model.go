@@ -2,6 +2,7 @@ package model
 
 import (
 	"errors"
+	"fmt"
 	"net/netip"
 	"time"
 
@@ -17,6 +18,7 @@ const (
 	MessageDeleteEvent = "message_delete"
 	MessageClearEvent  = "message_clear"
 	PollRequestEvent   = "poll_request"
+	DroppedEvent       = "messages_dropped"
 )
 
 // messageIDLength is the length of a randomly generated message ID
@@ -47,6 +49,7 @@ type Message struct {
 	PollID      string      `json:"poll_id,omitempty"`
 	ContentType string      `json:"content_type,omitempty"` // text/plain by default (if empty), or text/markdown
 	Encoding    string      `json:"encoding,omitempty"`     // Empty for raw UTF-8, or "base64" for encoded bytes
+	InReplyTo   string      `json:"in_reply_to,omitempty"`  // ID of the message this message is a reply to
 	Sender      netip.Addr  `json:"-"`                      // IP address of uploader, used for rate limiting
 	User        string      `json:"-"`                      // UserID of the uploader, used to associated attachments
 }
@@ -183,6 +186,12 @@ func NewPollRequestMessage(topic, pollID string) *Message {
 	return m
 }
 
+// NewDroppedMessage is a convenience method to create a messages_dropped message, which tells
+// a subscriber that it was too slow to keep up, and that it should re-poll with since=
+func NewDroppedMessage(topic string, dropped int) *Message {
+	return NewMessage(DroppedEvent, topic, fmt.Sprintf("%d message(s) dropped", dropped))
+}
+
 // SinceMarker represents a point in time or message ID from which to retrieve messages
 type SinceMarker struct {
 	time time.Time
@@ -147,9 +147,38 @@ var (
 	errHTTPBadRequestEmailAddressNotVerified         = &errHTTP{40052, http.StatusBadRequest, "invalid request: email address not verified", "https://ntfy.sh/docs/publish/#e-mail-notifications", nil}
 	errHTTPBadRequestAnonymousEmailNotAllowed        = &errHTTP{40053, http.StatusBadRequest, "invalid request: anonymous email sending is not allowed", "https://ntfy.sh/docs/publish/#e-mail-notifications", nil}
 	errHTTPBadRequestResetLinkInvalid                = &errHTTP{40054, http.StatusBadRequest, "invalid request: password reset link invalid or expired", "", nil}
+	errHTTPBadRequestCursorInvalid                   = &errHTTP{40055, http.StatusBadRequest, "invalid request: subscription name or topics invalid", "https://ntfy.sh/docs/subscribe/api/#durable-subscriptions", nil}
+	errHTTPBadRequestCursorTopicsMismatch            = &errHTTP{40056, http.StatusBadRequest, "invalid request: topics do not match durable subscription", "https://ntfy.sh/docs/subscribe/api/#durable-subscriptions", nil}
+	errHTTPBadRequestMessageIDInvalid                = &errHTTP{40057, http.StatusBadRequest, "invalid request: message ID invalid", "", nil}
+	errHTTPBadRequestCloudEventInvalid               = &errHTTP{40058, http.StatusBadRequest, "invalid request: CloudEvent invalid", "https://ntfy.sh/docs/publish/#cloudevents", nil}
+	errHTTPBadRequestOIDCStateInvalid                = &errHTTP{40059, http.StatusBadRequest, "invalid request: login state invalid or expired, please try again", "https://ntfy.sh/docs/config/#openid-connect-oidc", nil}
+	errHTTPBadRequestTOTPCodeInvalid                 = &errHTTP{40060, http.StatusBadRequest, "invalid request: two-factor authentication code invalid", "https://ntfy.sh/docs/config/#two-factor-authentication", nil}
+	errHTTPBadRequestTokenScopeInvalid               = &errHTTP{40061, http.StatusBadRequest, "invalid request: token scope invalid", "https://ntfy.sh/docs/config/#scoped-access-tokens", nil}
+	errHTTPBadRequestGroupNotFound                   = &errHTTP{40062, http.StatusBadRequest, "invalid request: group does not exist", "https://ntfy.sh/docs/config/#groups", nil}
+	errHTTPBadRequestAuditFilterInvalid              = &errHTTP{40063, http.StatusBadRequest, "invalid request: audit log filter invalid", "https://ntfy.sh/docs/config/#audit-log", nil}
+	errHTTPBadRequestInReplyToInvalid                = &errHTTP{40064, http.StatusBadRequest, "invalid request: in-reply-to message ID invalid", "https://ntfy.sh/docs/publish/#replying-to-e-mail-notifications", nil}
+	errHTTPBadRequestSMSDisabled                     = &errHTTP{40065, http.StatusBadRequest, "invalid request: SMS notifications are disabled", "https://ntfy.sh/docs/config/#phone-calls", nil}
+	errHTTPBadRequestAnonymousSMSNotAllowed          = &errHTTP{40066, http.StatusBadRequest, "invalid request: anonymous SMS notifications are not allowed", "https://ntfy.sh/docs/publish/#sms-notifications", nil}
+	errHTTPBadRequestDelayNoSMS                      = &errHTTP{40067, http.StatusBadRequest, "invalid request: delayed SMS notifications are not supported", "", nil}
+	errHTTPBadRequestTwilioRequestInvalid            = &errHTTP{40068, http.StatusBadRequest, "invalid request: not a valid Twilio request", "", nil}
+	errHTTPBadRequestAPNSDeviceInvalid               = &errHTTP{40069, http.StatusBadRequest, "invalid request: APNs device token malformed", "https://ntfy.sh/docs/config/#ios-push-notifications-via-apns", nil}
+	errHTTPBadRequestAPNSTopicCountTooHigh           = &errHTTP{40070, http.StatusBadRequest, "invalid request: too many APNs topic subscriptions", "https://ntfy.sh/docs/config/#ios-push-notifications-via-apns", nil}
 	errHTTPNotFound                                  = &errHTTP{40401, http.StatusNotFound, "page not found", "", nil}
+	errHTTPNotFoundCursor                            = &errHTTP{40402, http.StatusNotFound, "durable subscription not found", "https://ntfy.sh/docs/subscribe/api/#durable-subscriptions", nil}
+	errHTTPNotFoundTOTP                              = &errHTTP{40403, http.StatusNotFound, "two-factor authentication enrollment not found", "https://ntfy.sh/docs/config/#two-factor-authentication", nil}
+	errHTTPNotFoundToken                             = &errHTTP{40404, http.StatusNotFound, "access token not found", "https://ntfy.sh/docs/config/#admin-api", nil}
+	errHTTPNotFoundReservation                       = &errHTTP{40405, http.StatusNotFound, "topic reservation not found", "https://ntfy.sh/docs/config/#admin-api", nil}
 	errHTTPUnauthorized                              = &errHTTP{40101, http.StatusUnauthorized, "unauthorized", "https://ntfy.sh/docs/publish/#authentication", nil}
+	errHTTPUnauthorizedOIDC                          = &errHTTP{40102, http.StatusUnauthorized, "unauthorized: OpenID Connect login failed", "https://ntfy.sh/docs/config/#openid-connect-oidc", nil}
+	errHTTPUnauthorizedTOTPRequired                  = &errHTTP{40103, http.StatusUnauthorized, "unauthorized: two-factor authentication code required", "https://ntfy.sh/docs/config/#two-factor-authentication", nil}
+	errHTTPUnauthorizedTOTPInvalid                   = &errHTTP{40104, http.StatusUnauthorized, "unauthorized: two-factor authentication code invalid", "https://ntfy.sh/docs/config/#two-factor-authentication", nil}
+	errHTTPUnauthorizedTOTPTokenRequired             = &errHTTP{40105, http.StatusUnauthorized, "unauthorized: two-factor authentication is enabled for this user, use an access token instead of a password", "https://ntfy.sh/docs/config/#two-factor-authentication", nil}
+	errHTTPUnauthorizedProxyAuth                     = &errHTTP{40106, http.StatusUnauthorized, "unauthorized: user passed by reverse proxy is invalid or unknown", "https://ntfy.sh/docs/config/#reverse-proxy-authentication", nil}
+	errHTTPUnauthorizedClientCert                    = &errHTTP{40107, http.StatusUnauthorized, "unauthorized: client certificate does not map to a valid user", "https://ntfy.sh/docs/config/#client-certificate-authentication", nil}
 	errHTTPForbidden                                 = &errHTTP{40301, http.StatusForbidden, "forbidden", "https://ntfy.sh/docs/publish/#authentication", nil}
+	errHTTPForbiddenTOTPRequired                     = &errHTTP{40302, http.StatusForbidden, "forbidden: two-factor authentication must be enabled for this account", "https://ntfy.sh/docs/config/#two-factor-authentication", nil}
+	errHTTPForbiddenTokenScope                       = &errHTTP{40303, http.StatusForbidden, "forbidden: not permitted by the scope of the access token", "https://ntfy.sh/docs/config/#scoped-access-tokens", nil}
+	errHTTPForbiddenTwilioSignatureInvalid           = &errHTTP{40304, http.StatusForbidden, "forbidden: Twilio request signature invalid", "https://ntfy.sh/docs/config/#phone-calls", nil}
 	errHTTPConflictUserExists                        = &errHTTP{40901, http.StatusConflict, "conflict: user already exists", "", nil}
 	errHTTPConflictTopicReserved                     = &errHTTP{40902, http.StatusConflict, "conflict: access control entry for topic or topic pattern already exists", "", nil}
 	errHTTPConflictSubscriptionExists                = &errHTTP{40903, http.StatusConflict, "conflict: topic subscription already exists", "", nil}
@@ -158,6 +187,13 @@ var (
 	errHTTPConflictProvisionedTokenChange            = &errHTTP{40906, http.StatusConflict, "conflict: cannot change or delete provisioned token", "", nil}
 	errHTTPConflictEmailExists                       = &errHTTP{40907, http.StatusConflict, "conflict: email address already exists", "", nil}
 	errHTTPConflictEmailPrimaryElsewhere             = &errHTTP{40908, http.StatusConflict, "conflict: email address is the primary email on another account", "", nil}
+	errHTTPConflictLDAPUserChange                    = &errHTTP{40909, http.StatusConflict, "conflict: password is managed by the LDAP server", "https://ntfy.sh/docs/config/#ldap-authentication", nil}
+	errHTTPConflictTOTPEnabled                       = &errHTTP{40910, http.StatusConflict, "conflict: two-factor authentication already enabled", "https://ntfy.sh/docs/config/#two-factor-authentication", nil}
+	errHTTPConflictTOTPRequired                      = &errHTTP{40911, http.StatusConflict, "conflict: two-factor authentication is required for this account", "https://ntfy.sh/docs/config/#two-factor-authentication", nil}
+	errHTTPConflictGroupExists                       = &errHTTP{40912, http.StatusConflict, "conflict: group already exists", "https://ntfy.sh/docs/config/#groups", nil}
+	errHTTPConflictProvisionedGroupChange            = &errHTTP{40913, http.StatusConflict, "conflict: cannot change or delete provisioned group", "https://ntfy.sh/docs/config/#groups", nil}
+	errHTTPConflictTierExists                        = &errHTTP{40914, http.StatusConflict, "conflict: tier already exists", "https://ntfy.sh/docs/config/#admin-api", nil}
+	errHTTPConflictTierInUse                         = &errHTTP{40915, http.StatusConflict, "conflict: tier is still assigned to users", "https://ntfy.sh/docs/config/#admin-api", nil}
 	errHTTPGonePhoneVerificationExpired              = &errHTTP{41001, http.StatusGone, "phone number verification expired or does not exist", "", nil}
 	errHTTPEntityTooLargeAttachment                  = &errHTTP{41301, http.StatusRequestEntityTooLarge, "attachment too large, or bandwidth limit reached", "https://ntfy.sh/docs/publish/#limitations", nil}
 	errHTTPEntityTooLargeMatrixRequest               = &errHTTP{41302, http.StatusRequestEntityTooLarge, "Matrix request is larger than the max allowed length", "", nil}
@@ -173,9 +209,13 @@ var (
 	errHTTPTooManyRequestsLimitAuthFailure           = &errHTTP{42909, http.StatusTooManyRequests, "limit reached: too many auth failures", "https://ntfy.sh/docs/publish/#limitations", nil} // FIXME document limit
 	errHTTPTooManyRequestsLimitCalls                 = &errHTTP{42910, http.StatusTooManyRequests, "limit reached: daily phone call quota reached", "https://ntfy.sh/docs/publish/#limitations", nil}
 	errHTTPTooManyRequestsLimitTopicCreation         = &errHTTP{42911, http.StatusTooManyRequests, "limit reached: too many new topics, please wait", "https://ntfy.sh/docs/publish/#limitations", nil}
+	errHTTPTooManyRequestsLimitCursors               = &errHTTP{42912, http.StatusTooManyRequests, "limit reached: too many durable subscriptions for this user", "", nil}
+	errHTTPTooManyRequestsLimitSMS                   = &errHTTP{42913, http.StatusTooManyRequests, "limit reached: daily SMS quota reached", "https://ntfy.sh/docs/publish/#limitations", nil}
+	errHTTPTooManyRequestsLimitAPNSDevices           = &errHTTP{42914, http.StatusTooManyRequests, "limit reached: too many APNs devices registered from this IP address", "https://ntfy.sh/docs/config/#ios-push-notifications-via-apns", nil}
 	errHTTPInternalError                             = &errHTTP{50001, http.StatusInternalServerError, "internal server error", "", nil}
 	errHTTPInternalErrorInvalidPath                  = &errHTTP{50002, http.StatusInternalServerError, "internal server error: invalid path", "", nil}
 	errHTTPInternalErrorMissingBaseURL               = &errHTTP{50003, http.StatusInternalServerError, "internal server error: base-url must be be configured for this feature", "https://ntfy.sh/docs/config/", nil}
 	errHTTPInternalErrorWebPushUnableToPublish       = &errHTTP{50004, http.StatusInternalServerError, "internal server error: unable to publish web push message", "", nil}
+	errHTTPInternalErrorOIDCProviderUnavailable      = &errHTTP{50005, http.StatusInternalServerError, "internal server error: OpenID Connect provider unavailable", "https://ntfy.sh/docs/config/#openid-connect-oidc", nil}
 	errHTTPInsufficientStorageUnifiedPush            = &errHTTP{50701, http.StatusInsufficientStorage, "cannot publish to UnifiedPush topic without previously active subscriber", "", nil}
 )
@@ -21,9 +21,11 @@ const (
 	tagPublish      = "publish"
 	tagSubscribe    = "subscribe"
 	tagFirebase     = "firebase"
+	tagAPNS         = "apns"
 	tagSMTP         = "smtp"  // Receive email
 	tagEmail        = "email" // Send email
 	tagTwilio       = "twilio"
+	tagTelephony    = "telephony" // Calls and SMS, regardless of provider
 	tagMessageCache = "message_cache"
 	tagStripe       = "stripe"
 	tagAccount      = "account"
@@ -32,6 +34,10 @@ const (
 	tagWebsocket    = "websocket"
 	tagMatrix       = "matrix"
 	tagWebPush      = "webpush"
+	tagOIDC         = "oidc"
+	tagAuthProxy    = "auth_proxy"
+	tagAuthCert     = "auth_cert"
+	tagAuthJWT      = "auth_jwt"
 )
 
 var (
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"crypto/tls"
 	"embed"
 	"encoding/base64"
 	"encoding/json"
@@ -32,6 +33,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/sync/errgroup"
 	"gopkg.in/yaml.v2"
+	"heckel.io/ntfy/v2/apns"
 	"heckel.io/ntfy/v2/attachment"
 	"heckel.io/ntfy/v2/db"
 	"heckel.io/ntfy/v2/db/pg"
@@ -61,9 +63,15 @@ type Server struct {
 	topics            map[string]*topic
 	visitors          map[string]*visitor // ip:<ip> or user:<user>
 	firebaseClient    *firebaseClient
+	apns              *apnsClient                         // Sends to registered iOS devices directly via APNs, nil if not configured
+	telephony         telephonyProvider                   // Makes phone calls and sends SMS (Twilio or webhook), nil if not configured
+	oidc              *oidcProvider                       // OpenID Connect login, nil if not configured
+	tlsConfig         *tls.Config                         // TLS config of the HTTPS listener for client certificates, nil if not configured
+	jwt               *jwtVerifier                        // Verifies external JWT bearer tokens, nil if not configured
 	messages          int64                               // Total number of messages (persisted if messageCache enabled)
 	messagesHistory   []int64                             // Last n values of the messages counter, used to determine rate
 	userManager       *user.Manager                       // Might be nil!
+	auther            user.Auther                         // Verifies passwords, either userManager or LDAP; nil if userManager is nil
 	messageCache      *message.Cache                      // Database that stores the messages
 	webPush           *webpush.Store                      // Database that stores web push subscriptions
 	attachment        *attachment.Store                   // Attachment store (file system or S3)
@@ -85,6 +93,9 @@ var (
 	jsonPathRegex          = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/json$`)
 	ssePathRegex           = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/sse$`)
 	rawPathRegex           = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/raw$`)
+	cloudEventsPathRegex   = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/cloudevents$`)
+	rssPathRegex           = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/rss$`)
+	atomPathRegex          = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/atom$`)
 	wsPathRegex            = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/ws$`)
 	authPathRegex          = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/auth$`)
 	publishPathRegex       = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/(publish|send|trigger)$`)
@@ -92,8 +103,10 @@ var (
 	clearPathRegex         = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/[-_A-Za-z0-9]{1,64}/(read|clear)$`)
 	deletePathRegex        = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/[-_A-Za-z0-9]{1,64}/delete$`)
 	sequenceIDRegex        = topicRegex
+	inReplyToRegex         = topicRegex
 
 	webAppConfigPath              = "/config.js"
+	webAppLoginPath               = "/login"
 	webAppManifestPath            = "/manifest.webmanifest"
 	webAppEmailVerifyPathPrefix   = "/account/email/verify/"                                       // Browser landing route; raw token appended
 	webAppEmailVerifyRegex        = regexp.MustCompile(`^/account/email/verify/[-_A-Za-z0-9]+$`)   // Magic-link landing (served by the web app)
@@ -108,15 +121,26 @@ var (
 	apiConfigPath                                        = "/v1/config"
 	apiStatsPath                                         = "/v1/stats"
 	apiWebPushPath                                       = "/v1/webpush"
+	apiAPNSPath                                          = "/v1/apns"
 	apiTiersPath                                         = "/v1/tiers"
 	apiUsersPath                                         = "/v1/users"
 	apiUsersAccessPath                                   = "/v1/users/access"
+	apiGroupsPath                                        = "/v1/groups"
+	apiGroupsMembersPath                                 = "/v1/groups/members"
+	apiGroupsAccessPath                                  = "/v1/groups/access"
+	apiAuditPath                                         = "/v1/audit"
+	apiAdminTiersPath                                    = "/v1/admin/tiers"
+	apiAdminTokensPath                                   = "/v1/admin/tokens"
+	apiAdminReservationsPath                             = "/v1/admin/reservations"
+	apiAdminVisitorsPath                                 = "/v1/admin/visitors"
 	apiAccountPath                                       = "/v1/account"
 	apiAccountTokenPath                                  = "/v1/account/token"
 	apiAccountPasswordPath                               = "/v1/account/password"
+	apiAccountTOTPPath                                   = "/v1/account/totp"
 	apiAccountSettingsPath                               = "/v1/account/settings"
 	apiAccountSubscriptionPath                           = "/v1/account/subscription"
 	apiAccountReservationPath                            = "/v1/account/reservation"
+	apiAccountCursorPath                                 = "/v1/account/cursor"
 	apiAccountPhonePath                                  = "/v1/account/phone"
 	apiAccountPhoneVerifyPath                            = "/v1/account/phone/verify"
 	apiAccountEmailPath                                  = "/v1/account/email"
@@ -128,9 +152,15 @@ var (
 	apiAccountBillingPortalPath                          = "/v1/account/billing/portal"
 	apiAccountBillingWebhookPath                         = "/v1/account/billing/webhook"
 	apiAccountBillingSubscriptionPath                    = "/v1/account/billing/subscription"
+	apiAuthOIDCPath                                      = "/v1/auth/oidc"
+	apiAuthOIDCLoginPath                                 = "/v1/auth/oidc/login"
+	apiAuthOIDCCallbackPath                              = "/v1/auth/oidc/callback"
+	apiTwilioCallAckPath                                 = "/v1/twilio/call/ack"
 	apiAccountBillingSubscriptionCheckoutSuccessTemplate = "/v1/account/billing/subscription/success/{CHECKOUT_SESSION_ID}"
 	apiAccountBillingSubscriptionCheckoutSuccessRegex    = regexp.MustCompile(`/v1/account/billing/subscription/success/(.+)$`)
 	apiAccountReservationSingleRegex                     = regexp.MustCompile(`/v1/account/reservation/([-_A-Za-z0-9]{1,64})$`)
+	apiAccountCursorSingleRegex                          = regexp.MustCompile(`/v1/account/cursor/([-_A-Za-z0-9]{1,64})$`)
+	apiAccountCursorAckRegex                             = regexp.MustCompile(`/v1/account/cursor/([-_A-Za-z0-9]{1,64})/ack$`)
 	staticRegex                                          = regexp.MustCompile(`^/(static/.+|app.html|sw.js|sw.js.map)$`)
 	docsRegex                                            = regexp.MustCompile(`^/docs(|/.*)$`)
 	fileRegex                                            = regexp.MustCompile(`^/file/([-_A-Za-z0-9]{1,64})(?:\.[A-Za-z0-9]{1,16})?$`)
@@ -185,16 +215,6 @@ const (
 // New instantiates a new Server. It creates the cache and adds a Firebase
 // subscriber (if configured).
 func New(conf *Config) (*Server, error) {
-	var sender mail.Sender
-	if conf.SMTPSenderAddr != "" {
-		sender = mail.NewSender(&mail.Config{
-			BaseURL:  conf.BaseURL,
-			SMTPAddr: conf.SMTPSenderAddr,
-			SMTPUser: conf.SMTPSenderUser,
-			SMTPPass: conf.SMTPSenderPass,
-			From:     conf.SMTPSenderFrom,
-		})
-	}
 	var stripe stripeAPI
 	if payments.Available && conf.StripeSecretKey != "" {
 		stripe = newStripeAPI()
@@ -252,6 +272,35 @@ func New(conf *Config) (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
+	var sender mail.Sender
+	if conf.SMTPSenderAddr != "" {
+		mailConfig := &mail.Config{
+			BaseURL:         conf.BaseURL,
+			SMTPAddr:        conf.SMTPSenderAddr,
+			SMTPUser:        conf.SMTPSenderUser,
+			SMTPPass:        conf.SMTPSenderPass,
+			From:            conf.SMTPSenderFrom,
+			TemplateDir:     conf.SMTPSenderTemplateDir,
+			ReplySecret:     conf.SMTPServerReplySecret,
+			ReplyAddrPrefix: conf.SMTPServerAddrPrefix,
+			ReplyDomain:     conf.SMTPServerDomain,
+		}
+		if conf.SMTPSenderVerify && conf.WebRoot != "" {
+			mailConfig.UnsubscribeURL = conf.BaseURL + accountPath // Verified addresses can be removed in the account settings
+		}
+		if attachmentStore != nil {
+			mailConfig.Attachments = attachmentStore
+		}
+		if conf.SMTPSenderDKIMKeyFile != "" {
+			mailConfig.DKIMDomain = conf.SMTPSenderDKIMDomain
+			mailConfig.DKIMSelector = conf.SMTPSenderDKIMSelector
+			mailConfig.DKIMKey, err = mail.ReadDKIMKeyFile(conf.SMTPSenderDKIMKeyFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+		sender = mail.NewSender(mailConfig)
+	}
 	var userManager *user.Manager
 	if conf.AuthFile != "" || pool != nil {
 		authConfig := &user.Config{
@@ -263,10 +312,13 @@ func New(conf *Config) (*Server, error) {
 			Users:                     conf.AuthUsers,
 			Access:                    conf.AuthAccess,
 			Tokens:                    conf.AuthTokens,
+			Groups:                    conf.AuthGroups,
+			GroupAccess:               conf.AuthGroupAccess,
 			BcryptCost:                conf.AuthBcryptCost,
 			QueueWriterInterval:       conf.AuthStatsQueueWriterInterval,
 			AccessCacheEnabled:        conf.AuthAccessCacheEnabled,
 			AccessCacheReloadInterval: conf.AuthAccessCacheReloadInterval,
+			AuditRetention:            conf.AuthAuditRetention,
 		}
 		if pool != nil {
 			userManager, err = user.NewPostgresManager(pool, authConfig)
@@ -277,20 +329,69 @@ func New(conf *Config) (*Server, error) {
 			return nil, err
 		}
 	}
+	// This awkward logic is required because Go is weird about nil types and interfaces.
+	// See issue #641, and https://go.dev/play/p/uur1flrv1t3 for an example
+	var auther user.Auther
+	if userManager != nil && conf.LDAPURL != "" {
+		auther, err = user.NewLDAPAuther(&user.LDAPConfig{
+			URL:            conf.LDAPURL,
+			StartTLS:       conf.LDAPStartTLS,
+			BindDN:         conf.LDAPBindDN,
+			BindPassword:   conf.LDAPBindPassword,
+			UserDN:         conf.LDAPUserDN,
+			UserBaseDN:     conf.LDAPUserBaseDN,
+			UserFilter:     conf.LDAPUserFilter,
+			GroupBaseDN:    conf.LDAPGroupBaseDN,
+			GroupFilter:    conf.LDAPGroupFilter,
+			GroupAttribute: conf.LDAPGroupAttribute,
+			AdminGroups:    conf.LDAPAdminGroups,
+			GroupAccess:    conf.LDAPGroupAccess,
+			CacheDuration:  conf.LDAPCacheDuration,
+		}, userManager)
+		if err != nil {
+			return nil, err
+		}
+	} else if userManager != nil {
+		auther = userManager
+	}
 	var firebaseClient *firebaseClient
 	if conf.FirebaseKeyFile != "" {
 		sender, err := newFirebaseSender(conf.FirebaseKeyFile)
 		if err != nil {
 			return nil, err
 		}
-		// This awkward logic is required because Go is weird about nil types and interfaces.
-		// See issue #641, and https://go.dev/play/p/uur1flrv1t3 for an example
-		var auther user.Auther
-		if userManager != nil {
-			auther = userManager
-		}
 		firebaseClient = newFirebaseClient(sender, auther)
 	}
+	var apnsClient *apnsClient
+	if conf.APNSKeyFile != "" {
+		var apnsStore *apns.Store
+		if pool != nil {
+			apnsStore, err = apns.NewPostgresStore(pool)
+		} else {
+			apnsStore, err = apns.NewSQLiteStore(conf.APNSFile)
+		}
+		if err != nil {
+			return nil, err
+		}
+		sender, err := newAPNSSender(conf)
+		if err != nil {
+			return nil, err
+		}
+		apnsClient = newAPNSClient(sender, apnsStore, auther)
+	}
+	var oidc *oidcProvider
+	if conf.OIDCIssuer != "" {
+		oidc = newOIDCProvider(conf)
+	}
+	tlsConfig, err := newClientCertTLSConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	var jwtVerifier *jwtVerifier
+	if conf.JWTJWKS != "" {
+		jwtVerifier = newJWTVerifier(conf)
+	}
+	telephony := newTelephonyProvider(conf)
 	s := &Server{
 		config:          conf,
 		db:              pool,
@@ -298,9 +399,15 @@ func New(conf *Config) (*Server, error) {
 		webPush:         wp,
 		attachment:      attachmentStore,
 		firebaseClient:  firebaseClient,
+		apns:            apnsClient,
+		telephony:       telephony,
+		oidc:            oidc,
+		tlsConfig:       tlsConfig,
+		jwt:             jwtVerifier,
 		mailer:          sender,
 		topics:          topics,
 		userManager:     userManager,
+		auther:          auther,
 		messages:        messages,
 		messagesHistory: []int64{messages},
 		visitors:        make(map[string]*visitor),
@@ -346,6 +453,9 @@ func (s *Server) Run() error {
 	if s.config.SMTPServerListen != "" {
 		listenStr += fmt.Sprintf(" %s[smtp]", s.config.SMTPServerListen)
 	}
+	if s.config.SMTPServerListenTLS != "" {
+		listenStr += fmt.Sprintf(" %s[smtps]", s.config.SMTPServerListenTLS)
+	}
 	if s.config.MetricsListenHTTP != "" {
 		listenStr += fmt.Sprintf(" %s[http/metrics]", s.config.MetricsListenHTTP)
 	}
@@ -369,7 +479,7 @@ func (s *Server) Run() error {
 		}()
 	}
 	if s.config.ListenHTTPS != "" {
-		s.httpsServer = &http.Server{Addr: s.config.ListenHTTPS, Handler: mux}
+		s.httpsServer = &http.Server{Addr: s.config.ListenHTTPS, Handler: mux, TLSConfig: s.tlsConfig}
 		go func() {
 			errChan <- s.httpsServer.ListenAndServeTLS(s.config.CertFile, s.config.KeyFile)
 		}()
@@ -420,7 +530,7 @@ func (s *Server) Run() error {
 			errChan <- s.httpProfileServer.ListenAndServe()
 		}()
 	}
-	if s.config.SMTPServerListen != "" {
+	if s.config.SMTPServerListen != "" || s.config.SMTPServerListenTLS != "" {
 		go func() {
 			errChan <- s.runSMTPServer()
 		}()
@@ -469,6 +579,9 @@ func (s *Server) closeDatabases() {
 	if s.webPush != nil {
 		s.webPush.Close()
 	}
+	if s.apns != nil {
+		s.apns.Close()
+	}
 	if s.db != nil {
 		s.db.Close()
 	}
@@ -571,20 +684,62 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 		return s.ensureAdmin(s.handleAccessAllow)(w, r, v)
 	} else if r.Method == http.MethodDelete && r.URL.Path == apiUsersAccessPath {
 		return s.ensureAdmin(s.handleAccessReset)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiGroupsPath {
+		return s.ensureAdmin(s.handleGroupsGet)(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && r.URL.Path == apiGroupsPath {
+		return s.ensureAdmin(s.handleGroupsAdd)(w, r, v)
+	} else if r.Method == http.MethodDelete && r.URL.Path == apiGroupsPath {
+		return s.ensureAdmin(s.handleGroupsDelete)(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && r.URL.Path == apiGroupsMembersPath {
+		return s.ensureAdmin(s.handleGroupMembersAdd)(w, r, v)
+	} else if r.Method == http.MethodDelete && r.URL.Path == apiGroupsMembersPath {
+		return s.ensureAdmin(s.handleGroupMembersDelete)(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && r.URL.Path == apiGroupsAccessPath {
+		return s.ensureAdmin(s.handleGroupAccessAllow)(w, r, v)
+	} else if r.Method == http.MethodDelete && r.URL.Path == apiGroupsAccessPath {
+		return s.ensureAdmin(s.handleGroupAccessReset)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAuditPath {
+		return s.ensureAdmin(s.handleAuditGet)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAdminTiersPath {
+		return s.ensureAdmin(s.handleAdminTiersGet)(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == apiAdminTiersPath {
+		return s.ensureAdmin(s.handleAdminTiersAdd)(w, r, v)
+	} else if r.Method == http.MethodPut && r.URL.Path == apiAdminTiersPath {
+		return s.ensureAdmin(s.handleAdminTiersUpdate)(w, r, v)
+	} else if r.Method == http.MethodDelete && r.URL.Path == apiAdminTiersPath {
+		return s.ensureAdmin(s.handleAdminTiersDelete)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAdminTokensPath {
+		return s.ensureAdmin(s.handleAdminTokensGet)(w, r, v)
+	} else if r.Method == http.MethodDelete && r.URL.Path == apiAdminTokensPath {
+		return s.ensureAdmin(s.handleAdminTokensDelete)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAdminReservationsPath {
+		return s.ensureAdmin(s.handleAdminReservationsGet)(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && r.URL.Path == apiAdminReservationsPath {
+		return s.ensureAdmin(s.handleAdminReservationsAdd)(w, r, v)
+	} else if r.Method == http.MethodDelete && r.URL.Path == apiAdminReservationsPath {
+		return s.ensureAdmin(s.handleAdminReservationsDelete)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAdminVisitorsPath {
+		return s.ensureAdmin(s.handleAdminVisitorsGet)(w, r, v)
 	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountPath {
 		return s.ensureUserManager(s.handleAccountCreate)(w, r, v)
 	} else if r.Method == http.MethodGet && r.URL.Path == apiAccountPath {
 		return s.handleAccountGet(w, r, v) // Allowed by anonymous
 	} else if r.Method == http.MethodDelete && r.URL.Path == apiAccountPath {
-		return s.ensureUser(s.withAccountSync(s.handleAccountDelete))(w, r, v)
+		return s.ensureUnscoped(s.withAccountSync(s.handleAccountDelete))(w, r, v)
 	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountPasswordPath {
-		return s.ensureUser(s.handleAccountPasswordChange)(w, r, v)
+		return s.ensureUnscoped(s.handleAccountPasswordChange)(w, r, v)
 	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountTokenPath {
-		return s.ensureUser(s.withAccountSync(s.handleAccountTokenCreate))(w, r, v)
+		return s.ensureUnscoped(s.withAccountSync(s.handleAccountTokenCreate))(w, r, v)
 	} else if r.Method == http.MethodPatch && r.URL.Path == apiAccountTokenPath {
 		return s.ensureUser(s.withAccountSync(s.handleAccountTokenUpdate))(w, r, v)
 	} else if r.Method == http.MethodDelete && r.URL.Path == apiAccountTokenPath {
 		return s.ensureUser(s.withAccountSync(s.handleAccountTokenDelete))(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountTOTPPath {
+		return s.ensureUnscoped(s.handleAccountTOTPAdd)(w, r, v)
+	} else if r.Method == http.MethodPut && r.URL.Path == apiAccountTOTPPath {
+		return s.ensureUnscoped(s.withAccountSync(s.handleAccountTOTPEnable))(w, r, v)
+	} else if r.Method == http.MethodDelete && r.URL.Path == apiAccountTOTPPath {
+		return s.ensureUnscoped(s.withAccountSync(s.handleAccountTOTPDelete))(w, r, v)
 	} else if r.Method == http.MethodPatch && r.URL.Path == apiAccountSettingsPath {
 		return s.ensureUser(s.withAccountSync(s.handleAccountSettingsChange))(w, r, v)
 	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountSubscriptionPath {
@@ -594,11 +749,17 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 	} else if r.Method == http.MethodDelete && r.URL.Path == apiAccountSubscriptionPath {
 		return s.ensureUser(s.withAccountSync(s.handleAccountSubscriptionDelete))(w, r, v)
 	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountReservationPath {
-		return s.ensureUser(s.withAccountSync(s.handleAccountReservationAdd))(w, r, v)
+		return s.ensureUnscoped(s.withAccountSync(s.handleAccountReservationAdd))(w, r, v)
 	} else if r.Method == http.MethodDelete && apiAccountReservationSingleRegex.MatchString(r.URL.Path) {
-		return s.ensureUser(s.withAccountSync(s.handleAccountReservationDelete))(w, r, v)
+		return s.ensureUnscoped(s.withAccountSync(s.handleAccountReservationDelete))(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountCursorPath {
+		return s.ensureUser(s.withAccountSync(s.handleAccountCursorAdd))(w, r, v)
+	} else if r.Method == http.MethodDelete && apiAccountCursorSingleRegex.MatchString(r.URL.Path) {
+		return s.ensureUser(s.withAccountSync(s.handleAccountCursorDelete))(w, r, v)
+	} else if r.Method == http.MethodPost && apiAccountCursorAckRegex.MatchString(r.URL.Path) {
+		return s.ensureUser(s.handleAccountCursorAck)(w, r, v) // No account sync, this is called for every message
 	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountBillingSubscriptionPath {
-		return s.ensurePaymentsEnabled(s.ensureUser(s.handleAccountBillingSubscriptionCreate))(w, r, v) // Account sync via incoming Stripe webhook
+		return s.ensurePaymentsEnabled(s.ensureUnscoped(s.handleAccountBillingSubscriptionCreate))(w, r, v) // Account sync via incoming Stripe webhook
 	} else if r.Method == http.MethodGet && apiAccountBillingSubscriptionCheckoutSuccessRegex.MatchString(r.URL.Path) {
 		return s.ensurePaymentsEnabled(s.ensureUserManager(s.handleAccountBillingSubscriptionCreateSuccess))(w, r, v) // No user context!
 	} else if r.Method == http.MethodPut && r.URL.Path == apiAccountBillingSubscriptionPath {
@@ -609,26 +770,36 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 		return s.ensurePaymentsEnabled(s.ensureStripeCustomer(s.handleAccountBillingPortalSessionCreate))(w, r, v)
 	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountBillingWebhookPath {
 		return s.ensurePaymentsEnabled(s.ensureUserManager(s.handleAccountBillingWebhook))(w, r, v) // This request comes from Stripe!
+	} else if r.Method == http.MethodPost && r.URL.Path == apiTwilioCallAckPath {
+		return s.ensureCallsEnabled(s.handleTwilioCallAck)(w, r, v) // This request comes from Twilio!
 	} else if r.Method == http.MethodPut && r.URL.Path == apiAccountPhoneVerifyPath {
-		return s.ensureUser(s.ensureCallsEnabled(s.withAccountSync(s.handleAccountPhoneNumberVerify)))(w, r, v)
+		return s.ensureUnscoped(s.ensureCallsEnabled(s.withAccountSync(s.handleAccountPhoneNumberVerify)))(w, r, v)
 	} else if r.Method == http.MethodPut && r.URL.Path == apiAccountPhonePath {
-		return s.ensureUser(s.ensureCallsEnabled(s.withAccountSync(s.handleAccountPhoneNumberAdd)))(w, r, v)
+		return s.ensureUnscoped(s.ensureCallsEnabled(s.withAccountSync(s.handleAccountPhoneNumberAdd)))(w, r, v)
 	} else if r.Method == http.MethodDelete && r.URL.Path == apiAccountPhonePath {
-		return s.ensureUser(s.ensureCallsEnabled(s.withAccountSync(s.handleAccountPhoneNumberDelete)))(w, r, v)
+		return s.ensureUnscoped(s.ensureCallsEnabled(s.withAccountSync(s.handleAccountPhoneNumberDelete)))(w, r, v)
 	} else if r.Method == http.MethodPut && r.URL.Path == apiAccountEmailPath {
-		return s.ensureUser(s.ensureEmailsEnabled(s.withAccountSync(s.handleAccountEmailAdd)))(w, r, v)
+		return s.ensureUnscoped(s.ensureEmailsEnabled(s.withAccountSync(s.handleAccountEmailAdd)))(w, r, v)
 	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountEmailVerifyPath {
 		return s.ensureEmailsEnabled(s.limitRequests(s.handleAccountEmailVerify))(w, r, v) // No ensureUser: clicked from a mail client, possibly logged out
 	} else if r.Method == http.MethodDelete && r.URL.Path == apiAccountEmailPath {
-		return s.ensureUser(s.ensureEmailsEnabled(s.withAccountSync(s.handleAccountEmailDelete)))(w, r, v)
+		return s.ensureUnscoped(s.ensureEmailsEnabled(s.withAccountSync(s.handleAccountEmailDelete)))(w, r, v)
 	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountEmailPrimaryPath {
-		return s.ensureUser(s.withAccountSync(s.handleAccountEmailSetPrimary))(w, r, v)
+		return s.ensureUnscoped(s.withAccountSync(s.handleAccountEmailSetPrimary))(w, r, v)
 	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountEmailResendPath {
-		return s.ensureUser(s.ensureEmailsEnabled(s.handleAccountEmailResend))(w, r, v)
+		return s.ensureUnscoped(s.ensureEmailsEnabled(s.handleAccountEmailResend))(w, r, v)
 	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountPasswordResetRequestPath {
 		return s.ensureEmailsEnabled(s.limitRequests(s.handleAccountPasswordResetRequest))(w, r, v) // Unauthenticated
 	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountPasswordResetPath {
 		return s.ensureEmailsEnabled(s.limitRequests(s.handleAccountPasswordReset))(w, r, v) // Unauthenticated
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAuthOIDCLoginPath {
+		return s.ensureOIDCEnabled(s.limitRequests(s.handleAuthOIDCLogin))(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAuthOIDCCallbackPath {
+		return s.ensureOIDCEnabled(s.limitRequests(s.handleAuthOIDCCallback))(w, r, v) // Redirect from the OIDC provider
+	} else if r.Method == http.MethodPost && apiAPNSPath == r.URL.Path {
+		return s.ensureAPNSEnabled(s.limitRequests(s.handleAPNSUpdate))(w, r, v)
+	} else if r.Method == http.MethodDelete && apiAPNSPath == r.URL.Path {
+		return s.ensureAPNSEnabled(s.limitRequests(s.handleAPNSDelete))(w, r, v)
 	} else if r.Method == http.MethodPost && apiWebPushPath == r.URL.Path {
 		return s.ensureWebPushEnabled(s.limitRequests(s.handleWebPushUpdate))(w, r, v)
 	} else if r.Method == http.MethodDelete && apiWebPushPath == r.URL.Path {
@@ -654,7 +825,7 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 	} else if r.Method == http.MethodPost && r.URL.Path == matrixPushPath {
 		return s.transformMatrixJSON(s.limitRequestsWithTopic(s.authorizeTopicWrite(s.handlePublishMatrix)))(w, r, v)
 	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && (topicPathRegex.MatchString(r.URL.Path) || updatePathRegex.MatchString(r.URL.Path)) {
-		return s.limitRequestsWithTopic(s.authorizeTopicWrite(s.handlePublish))(w, r, v)
+		return s.transformCloudEvent(s.limitRequestsWithTopic(s.authorizeTopicWrite(s.handlePublish)))(w, r, v)
 	} else if (r.Method == http.MethodDelete && updatePathRegex.MatchString(r.URL.Path)) || (r.Method == http.MethodGet && deletePathRegex.MatchString(r.URL.Path)) {
 		return s.limitRequestsWithTopic(s.authorizeTopicWrite(s.handleDelete))(w, r, v)
 	} else if (r.Method == http.MethodGet || r.Method == http.MethodPut) && clearPathRegex.MatchString(r.URL.Path) {
@@ -667,6 +838,12 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 		return s.limitRequests(s.authorizeTopicRead(s.handleSubscribeSSE))(w, r, v)
 	} else if r.Method == http.MethodGet && rawPathRegex.MatchString(r.URL.Path) {
 		return s.limitRequests(s.authorizeTopicRead(s.handleSubscribeRaw))(w, r, v)
+	} else if r.Method == http.MethodGet && cloudEventsPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authorizeTopicRead(s.handleSubscribeCloudEvents))(w, r, v)
+	} else if r.Method == http.MethodGet && rssPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authorizeTopicRead(s.handleSubscribeRSS))(w, r, v)
+	} else if r.Method == http.MethodGet && atomPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authorizeTopicRead(s.handleSubscribeAtom))(w, r, v)
 	} else if r.Method == http.MethodGet && wsPathRegex.MatchString(r.URL.Path) {
 		return s.limitRequests(s.authorizeTopicRead(s.handleSubscribeWS))(w, r, v)
 	} else if r.Method == http.MethodGet && authPathRegex.MatchString(r.URL.Path) {
@@ -742,10 +919,13 @@ func (s *Server) configResponse() *apiConfigResponse {
 		BaseURL:             "", // Will translate to window.location.origin
 		AppRoot:             s.config.WebRoot,
 		EnableLogin:         s.config.EnableLogin,
+		EnableOIDC:          s.oidc != nil,
+		EnableProxyAuth:     s.config.AuthProxyHeader != "",
 		RequireLogin:        s.config.RequireLogin,
 		EnableSignup:        s.config.EnableSignup,
 		EnablePayments:      s.config.StripeSecretKey != "",
-		EnableCalls:         s.config.TwilioAccount != "",
+		EnableCalls:         s.telephony != nil,
+		EnableSMS:           s.telephony != nil,
 		EnableEmails:        s.config.SMTPSenderFrom != "",
 		EnableResetPassword: s.config.SMTPSenderFrom != "" && s.config.BaseURL != "", // Reset links need SMTP + an absolute base-url
 		EnableReservations:  s.config.EnableReservations,
@@ -901,7 +1081,7 @@ func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (*model.Mess
 		return nil, err
 	}
 	m := model.NewDefaultMessage(t.ID, "")
-	cache, firebase, email, call, template, unifiedpush, priorityStr, e := s.parsePublishParams(r, m)
+	cache, firebase, email, call, sms, template, unifiedpush, priorityStr, e := s.parsePublishParams(r, m)
 	if e != nil {
 		return nil, e.With(t)
 	}
@@ -932,6 +1112,18 @@ func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (*model.Mess
 			return nil, errHTTPTooManyRequestsLimitCalls.With(t)
 		}
 	}
+	if sms != "" {
+		if v.User() == nil {
+			return nil, errHTTPBadRequestAnonymousSMSNotAllowed.With(t)
+		}
+		var httpErr *errHTTP
+		sms, httpErr = s.convertPhoneNumber(v.User(), sms)
+		if httpErr != nil {
+			return nil, httpErr.With(t)
+		} else if !vrate.SMSAllowed() {
+			return nil, errHTTPTooManyRequestsLimitSMS.With(t)
+		}
+	}
 	if m.PollID != "" {
 		m = model.NewPollRequestMessage(t.ID, m.PollID)
 	}
@@ -957,6 +1149,7 @@ func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (*model.Mess
 			"message_unifiedpush": unifiedpush,
 			"message_email":       email,
 			"message_call":        call,
+			"message_sms":         sms,
 		})
 	if ev.IsTrace() {
 		ev.Field("message_body", util.MaybeMarshalJSON(m)).Trace("Received message")
@@ -964,32 +1157,64 @@ func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (*model.Mess
 		ev.Debug("Received message")
 	}
 	if !delayed {
-		if err := t.Publish(v, m); err != nil {
+		if err := s.sendMessage(v, t, m, firebase, unifiedpush); err != nil {
 			return nil, err
 		}
-		if s.firebaseClient != nil && firebase {
-			go s.sendToFirebase(v, m)
-		}
 		if s.mailer != nil && email != "" {
 			go s.sendEmail(v, m, email)
 		}
-		if s.config.TwilioAccount != "" && call != "" {
+		if s.telephony != nil && call != "" {
 			go s.callPhone(v, r, m, call)
 		}
-		if s.config.UpstreamBaseURL != "" && !unifiedpush { // UP messages are not sent to upstream
-			go s.forwardPollRequest(v, m)
-		}
-		if s.config.WebPushPublicKey != "" {
-			go s.publishToWebPushEndpoints(v, m)
+		if s.telephony != nil && sms != "" {
+			go s.sendSMS(v, r, m, sms)
 		}
 	} else {
 		logvrm(v, r, m).Tag(tagPublish).Debug("Message delayed, will process later")
 	}
+	if err := s.addMessage(v, r, t, m, cache); err != nil {
+		return nil, err
+	}
+	u := v.User()
+	if s.userManager != nil && u != nil && u.Tier != nil {
+		go s.userManager.EnqueueUserStats(u.ID, v.Stats())
+	}
+	if unifiedpush {
+		minc(metricUnifiedPushPublishedSuccess)
+	}
+	mset(metricMessagePublishDurationMillis, time.Since(start).Milliseconds())
+	return m, nil
+}
+
+// sendMessage publishes the message to the topic's subscribers, and forwards it to Firebase, the upstream
+// server, APNs and web push subscribers. UnifiedPush messages are never sent to the upstream server or APNs.
+func (s *Server) sendMessage(v *visitor, t *topic, m *model.Message, firebase, unifiedpush bool) error {
+	if err := t.Publish(v, m); err != nil {
+		return err
+	}
+	if s.firebaseClient != nil && firebase {
+		go s.sendToFirebase(v, m)
+	}
+	if s.config.UpstreamBaseURL != "" && !unifiedpush { // UP messages are not sent to upstream
+		go s.forwardPollRequest(v, m)
+	}
+	if s.apns != nil && !unifiedpush {
+		go s.sendToAPNS(v, m)
+	}
+	if s.config.WebPushPublicKey != "" {
+		go s.publishToWebPushEndpoints(v, m)
+	}
+	return nil
+}
+
+// addMessage adds the message to the message cache (if cache is true), replacing any scheduled
+// message with the same sequence ID, and counts it towards the published messages
+func (s *Server) addMessage(v *visitor, r *http.Request, t *topic, m *model.Message, cache bool) error {
 	if cache {
 		// Delete any existing scheduled message with the same sequence ID
 		deletedIDs, err := s.messageCache.DeleteScheduledBySequenceID(t.ID, m.SequenceID)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		// Delete attachment files for deleted scheduled messages
 		if s.attachment != nil && len(deletedIDs) > 0 {
@@ -999,21 +1224,13 @@ func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (*model.Mess
 		}
 		logvrm(v, r, m).Tag(tagPublish).Debug("Adding message to cache")
 		if err := s.messageCache.AddMessage(m); err != nil {
-			return nil, err
+			return err
 		}
 	}
-	u := v.User()
-	if s.userManager != nil && u != nil && u.Tier != nil {
-		go s.userManager.EnqueueUserStats(u.ID, v.Stats())
-	}
 	s.mu.Lock()
 	s.messages++
 	s.mu.Unlock()
-	if unifiedpush {
-		minc(metricUnifiedPushPublishedSuccess)
-	}
-	mset(metricMessagePublishDurationMillis, time.Since(start).Milliseconds())
-	return m, nil
+	return nil
 }
 
 func (s *Server) handlePublish(w http.ResponseWriter, r *http.Request, v *visitor) error {
@@ -1088,6 +1305,10 @@ func (s *Server) handleActionMessage(w http.ResponseWriter, r *http.Request, v *
 	if s.firebaseClient != nil {
 		go s.sendToFirebase(v, m)
 	}
+	// Send to iOS devices via APNs
+	if s.apns != nil {
+		go s.sendToAPNS(v, m)
+	}
 	// Send to web push endpoints
 	if s.config.WebPushPublicKey != "" {
 		go s.publishToWebPushEndpoints(v, m)
@@ -1172,11 +1393,11 @@ func (s *Server) forwardPollRequest(v *visitor, m *model.Message) {
 	}
 }
 
-func (s *Server) parsePublishParams(r *http.Request, m *model.Message) (cache bool, firebase bool, email, call string, template templateMode, unifiedpush bool, priorityStr string, err *errHTTP) {
+func (s *Server) parsePublishParams(r *http.Request, m *model.Message) (cache bool, firebase bool, email, call, sms string, template templateMode, unifiedpush bool, priorityStr string, err *errHTTP) {
 	if r.Method != http.MethodGet && updatePathRegex.MatchString(r.URL.Path) {
 		pathSequenceID, err := s.sequenceIDFromPath(r.URL.Path)
 		if err != nil {
-			return false, false, "", "", "", false, "", err
+			return false, false, "", "", "", "", false, "", err
 		}
 		m.SequenceID = pathSequenceID
 	} else {
@@ -1185,12 +1406,19 @@ func (s *Server) parsePublishParams(r *http.Request, m *model.Message) (cache bo
 			if sequenceIDRegex.MatchString(sequenceID) {
 				m.SequenceID = sequenceID
 			} else {
-				return false, false, "", "", "", false, "", errHTTPBadRequestSequenceIDInvalid
+				return false, false, "", "", "", "", false, "", errHTTPBadRequestSequenceIDInvalid
 			}
 		} else {
 			m.SequenceID = m.ID
 		}
 	}
+	inReplyTo := readParam(r, "x-in-reply-to", "in-reply-to")
+	if inReplyTo != "" {
+		if !inReplyToRegex.MatchString(inReplyTo) {
+			return false, false, "", "", "", "", false, "", errHTTPBadRequestInReplyToInvalid
+		}
+		m.InReplyTo = inReplyTo
+	}
 	cache = readBoolParam(r, true, "x-cache", "cache")
 	firebase = readBoolParam(r, true, "x-firebase", "firebase")
 	m.Title = readParam(r, "x-title", "title", "t")
@@ -1206,7 +1434,7 @@ func (s *Server) parsePublishParams(r *http.Request, m *model.Message) (cache bo
 	}
 	if attach != "" {
 		if !urlRegex.MatchString(attach) {
-			return false, false, "", "", "", false, "", errHTTPBadRequestAttachmentURLInvalid
+			return false, false, "", "", "", "", false, "", errHTTPBadRequestAttachmentURLInvalid
 		}
 		m.Attachment.URL = attach
 		if m.Attachment.Name == "" {
@@ -1224,22 +1452,28 @@ func (s *Server) parsePublishParams(r *http.Request, m *model.Message) (cache bo
 	}
 	if icon != "" {
 		if !urlRegex.MatchString(icon) {
-			return false, false, "", "", "", false, "", errHTTPBadRequestIconURLInvalid
+			return false, false, "", "", "", "", false, "", errHTTPBadRequestIconURLInvalid
 		}
 		m.Icon = icon
 	}
 	email = readParam(r, "x-email", "x-e-mail", "email", "e-mail", "mail", "e")
 	if email != "" && !emailAddressRegex.MatchString(email) && !toBool(email) {
-		return false, false, "", "", "", false, "", errHTTPBadRequestEmailAddressInvalid
+		return false, false, "", "", "", "", false, "", errHTTPBadRequestEmailAddressInvalid
 	}
 	if s.mailer == nil && email != "" {
-		return false, false, "", "", "", false, "", errHTTPBadRequestEmailDisabled
+		return false, false, "", "", "", "", false, "", errHTTPBadRequestEmailDisabled
 	}
 	call = readParam(r, "x-call", "call")
-	if call != "" && (s.config.TwilioAccount == "" || s.userManager == nil) {
-		return false, false, "", "", "", false, "", errHTTPBadRequestPhoneCallsDisabled
+	if call != "" && (s.telephony == nil || s.userManager == nil) {
+		return false, false, "", "", "", "", false, "", errHTTPBadRequestPhoneCallsDisabled
 	} else if call != "" && !isBoolValue(call) && !phoneNumberRegex.MatchString(call) {
-		return false, false, "", "", "", false, "", errHTTPBadRequestPhoneNumberInvalid
+		return false, false, "", "", "", "", false, "", errHTTPBadRequestPhoneNumberInvalid
+	}
+	sms = readParam(r, "x-sms", "sms")
+	if sms != "" && (s.telephony == nil || s.userManager == nil) {
+		return false, false, "", "", "", "", false, "", errHTTPBadRequestSMSDisabled
+	} else if sms != "" && !isBoolValue(sms) && !phoneNumberRegex.MatchString(sms) {
+		return false, false, "", "", "", "", false, "", errHTTPBadRequestPhoneNumberInvalid
 	}
 	template = templateMode(readParam(r, "x-template", "template", "tpl"))
 	messageStr := readParam(r, "x-message", "message", "m")
@@ -1255,7 +1489,7 @@ func (s *Server) parsePublishParams(r *http.Request, m *model.Message) (cache bo
 	if !template.Enabled() {
 		m.Priority, e = util.ParsePriority(priorityStr)
 		if e != nil {
-			return false, false, "", "", "", false, "", errHTTPBadRequestPriorityInvalid
+			return false, false, "", "", "", "", false, "", errHTTPBadRequestPriorityInvalid
 		}
 		priorityStr = "" // Clear since it's already parsed
 	}
@@ -1263,21 +1497,24 @@ func (s *Server) parsePublishParams(r *http.Request, m *model.Message) (cache bo
 	delayStr := readParam(r, "x-delay", "delay", "x-at", "at", "x-in", "in")
 	if delayStr != "" {
 		if !cache {
-			return false, false, "", "", "", false, "", errHTTPBadRequestDelayNoCache
+			return false, false, "", "", "", "", false, "", errHTTPBadRequestDelayNoCache
 		}
 		if email != "" {
-			return false, false, "", "", "", false, "", errHTTPBadRequestDelayNoEmail // we cannot store the email address (yet)
+			return false, false, "", "", "", "", false, "", errHTTPBadRequestDelayNoEmail // we cannot store the email address (yet)
 		}
 		if call != "" {
-			return false, false, "", "", "", false, "", errHTTPBadRequestDelayNoCall // we cannot store the phone number (yet)
+			return false, false, "", "", "", "", false, "", errHTTPBadRequestDelayNoCall // we cannot store the phone number (yet)
+		}
+		if sms != "" {
+			return false, false, "", "", "", "", false, "", errHTTPBadRequestDelayNoSMS // we cannot store the phone number (yet)
 		}
 		delay, err := util.ParseFutureTime(delayStr, time.Now())
 		if err != nil {
-			return false, false, "", "", "", false, "", errHTTPBadRequestDelayCannotParse
+			return false, false, "", "", "", "", false, "", errHTTPBadRequestDelayCannotParse
 		} else if delay.Unix() < time.Now().Add(s.config.MessageDelayMin).Unix() {
-			return false, false, "", "", "", false, "", errHTTPBadRequestDelayTooSmall
+			return false, false, "", "", "", "", false, "", errHTTPBadRequestDelayTooSmall
 		} else if delay.Unix() > time.Now().Add(s.config.MessageDelayMax).Unix() {
-			return false, false, "", "", "", false, "", errHTTPBadRequestDelayTooLarge
+			return false, false, "", "", "", "", false, "", errHTTPBadRequestDelayTooLarge
 		}
 		m.Time = delay.Unix()
 	}
@@ -1285,7 +1522,7 @@ func (s *Server) parsePublishParams(r *http.Request, m *model.Message) (cache bo
 	if actionsStr != "" {
 		m.Actions, e = parseActions(actionsStr)
 		if e != nil {
-			return false, false, "", "", "", false, "", errHTTPBadRequestActionsInvalid.Wrap("%s", e.Error())
+			return false, false, "", "", "", "", false, "", errHTTPBadRequestActionsInvalid.Wrap("%s", e.Error())
 		}
 	}
 	contentType, markdown := readParam(r, "content-type", "content_type"), readBoolParam(r, false, "x-markdown", "markdown", "md")
@@ -1304,7 +1541,7 @@ func (s *Server) parsePublishParams(r *http.Request, m *model.Message) (cache bo
 		cache = false
 		email = ""
 	}
-	return cache, firebase, email, call, template, unifiedpush, priorityStr, nil
+	return cache, firebase, email, call, sms, template, unifiedpush, priorityStr, nil
 }
 
 // handlePublishBody consumes the PUT/POST body and decides whether the body is an attachment or the message.
@@ -1505,7 +1742,12 @@ func (s *Server) handleBodyAsAttachment(r *http.Request, v *visitor, m *model.Me
 	}
 	var ext string
 	m.Attachment.Expires = attachmentExpiry
-	m.Attachment.Type, ext = util.DetectContentType(body.PeekedBytes, m.Attachment.Name)
+	if declaredType, err := fromContext[string](r, contextAttachmentType); err == nil {
+		// Content type declared by the sender, e.g. for attachments of incoming emails; only used if it matches the content
+		m.Attachment.Type, ext = util.DetectContentTypeDeclared(body.PeekedBytes, m.Attachment.Name, declaredType)
+	} else {
+		m.Attachment.Type, ext = util.DetectContentType(body.PeekedBytes, m.Attachment.Name)
+	}
 	m.Attachment.URL = fmt.Sprintf("%s/file/%s%s", s.config.BaseURL, m.ID, ext)
 	if m.Attachment.Name == "" {
 		m.Attachment.Name = fmt.Sprintf("attachment%s", ext)
@@ -1528,6 +1770,9 @@ func (s *Server) handleBodyAsAttachment(r *http.Request, v *visitor, m *model.Me
 }
 
 func (s *Server) handleSubscribeJSON(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	if readParam(r, "x-format", "format") == cloudEventsFormat {
+		return s.handleSubscribeCloudEvents(w, r, v)
+	}
 	encoder := func(msg *model.Message) (string, error) {
 		var buf bytes.Buffer
 		if err := util.EncodeJSON(&buf, msg.ForJSON()); err != nil {
@@ -1577,6 +1822,11 @@ func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *
 	if err != nil {
 		return err
 	}
+	cursor, since, err := s.maybeSubscribeCursor(r, v, topics, since)
+	if err != nil {
+		return err
+	}
+	delivered := s.cursorDelivered(v, cursor)
 	var wlock sync.Mutex
 	var closed bool
 	defer func() {
@@ -1608,6 +1858,7 @@ func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *
 		if fl, ok := w.(http.Flusher); ok {
 			fl.Flush()
 		}
+		delivered(msg)
 		return nil
 	}
 	if err := s.maybeSetRateVisitors(r, v, topics); err != nil {
@@ -1623,9 +1874,10 @@ func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	queue, live := s.maybeQueueSubscriber(topicsStr, sub, cancel)
 	subscriberIDs := make([]int, 0)
 	for _, t := range topics {
-		subscriberIDs = append(subscriberIDs, t.Subscribe(sub, v.MaybeUserID(), cancel))
+		subscriberIDs = append(subscriberIDs, t.Subscribe(live, v.MaybeUserID(), cancel))
 	}
 	defer func() {
 		for i, subscriberID := range subscriberIDs {
@@ -1638,10 +1890,19 @@ func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *
 	if err := s.sendOldMessages(topics, since, scheduled, v, sub); err != nil {
 		return err
 	}
+	var queueErr chan error // Stays nil (blocks forever) if the subscriber queue is disabled
+	if queue != nil {
+		queueErr = make(chan error, 1)
+		go func() {
+			queueErr <- queue.Run(ctx)
+		}()
+	}
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
+		case err := <-queueErr:
+			return err
 		case <-r.Context().Done():
 			return nil
 		case <-time.After(s.config.KeepaliveInterval):
@@ -1680,6 +1941,11 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 	if err != nil {
 		return err
 	}
+	cursor, since, err := s.maybeSubscribeCursor(r, v, topics, since)
+	if err != nil {
+		return err
+	}
+	delivered := s.cursorDelivered(v, cursor)
 	upgrader := &websocket.Upgrader{
 		ReadBufferSize:  wsBufferSize,
 		WriteBufferSize: wsBufferSize,
@@ -1760,7 +2026,11 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 		if err := conn.SetWriteDeadline(time.Now().Add(wsWriteWait)); err != nil {
 			return err
 		}
-		return conn.WriteJSON(msg)
+		if err := conn.WriteJSON(msg); err != nil {
+			return err
+		}
+		delivered(msg)
+		return nil
 	}
 	if err := s.maybeSetRateVisitors(r, v, topics); err != nil {
 		return err
@@ -1772,9 +2042,10 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 		}
 		return s.sendOldMessages(topics, since, scheduled, v, sub)
 	}
+	queue, live := s.maybeQueueSubscriber(topicsStr, sub, cancel)
 	subscriberIDs := make([]int, 0)
 	for _, t := range topics {
-		subscriberIDs = append(subscriberIDs, t.Subscribe(sub, v.MaybeUserID(), cancel))
+		subscriberIDs = append(subscriberIDs, t.Subscribe(live, v.MaybeUserID(), cancel))
 	}
 	defer func() {
 		for i, subscriberID := range subscriberIDs {
@@ -1787,6 +2058,11 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 	if err := s.sendOldMessages(topics, since, scheduled, v, sub); err != nil {
 		return err
 	}
+	if queue != nil {
+		g.Go(func() error {
+			return queue.Run(gctx)
+		})
+	}
 	err = g.Wait()
 	if err != nil && websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseAbnormalClosure, websocket.CloseNoStatusReceived) {
 		logvr(v, r).Tag(tagWebsocket).Err(err).Fields(websocketErrorContext(err)).Trace("WebSocket connection closed")
@@ -1798,6 +2074,17 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 	return nil
 }
 
+// maybeQueueSubscriber puts a bounded subscriberQueue in front of sub, if the queue is enabled. It returns the
+// queue (or nil), and the subscriber to register with the topics. Live messages then only block the queue, not
+// the publisher, and slow subscribers are handled according to the configured overflow policy.
+func (s *Server) maybeQueueSubscriber(topicsStr string, sub subscriber, cancel func()) (*subscriberQueue, subscriber) {
+	if s.config.SubscriberQueueSize <= 0 {
+		return nil, sub
+	}
+	queue := newSubscriberQueue(topicsStr, s.config.SubscriberQueueSize, s.config.SubscriberQueuePolicy, sub, cancel)
+	return queue, queue.Enqueue
+}
+
 func parseSubscribeParams(r *http.Request) (poll bool, since model.SinceMarker, scheduled bool, filters *queryFilter, err error) {
 	poll = readBoolParam(r, false, "x-poll", "poll", "po")
 	scheduled = readBoolParam(r, false, "x-scheduled", "scheduled", "sched")
@@ -1812,6 +2099,59 @@ func parseSubscribeParams(r *http.Request) (poll bool, since model.SinceMarker,
 	return
 }
 
+// maybeSubscribeCursor reads the "subscription" parameter, and returns the user's durable subscription (cursor)
+// of that name, if set. If the client acknowledged a message before, the since marker is moved to that message,
+// so that the client receives exactly the messages it has not acknowledged yet. Otherwise, the since marker
+// passed by the client is used.
+func (s *Server) maybeSubscribeCursor(r *http.Request, v *visitor, topics []*topic, since model.SinceMarker) (*user.Cursor, model.SinceMarker, error) {
+	name := readParam(r, "x-subscription", "subscription", "sub")
+	if name == "" {
+		return nil, since, nil
+	}
+	u := v.User()
+	if s.userManager == nil || u == nil {
+		return nil, since, errHTTPUnauthorized
+	}
+	cursor, err := s.userManager.Cursor(u.ID, name)
+	if errors.Is(err, user.ErrCursorNotFound) {
+		return nil, since, errHTTPNotFoundCursor
+	} else if err != nil {
+		return nil, since, err
+	}
+	for _, t := range topics {
+		if !util.Contains(cursor.Topics, t.ID) {
+			return nil, since, errHTTPBadRequestCursorTopicsMismatch
+		}
+	}
+	if cursor.LastAcked != "" {
+		since = model.NewSinceID(cursor.LastAcked)
+	}
+	logvr(v, r).
+		Tag(tagSubscribe).
+		Fields(log.Context{
+			"cursor_name":       cursor.Name,
+			"cursor_last_acked": cursor.LastAcked,
+		}).
+		Debug("Subscribing with durable subscription %s", cursor.Name)
+	return cursor, since, nil
+}
+
+// cursorDelivered returns a function that must be called for every message that was written to the client. It
+// records the message ID as the last delivered message of the durable subscription (if any). Since this is called
+// on the fan-out path, the database write is batched by the user manager (see user.Manager.EnqueueCursorDelivered).
+func (s *Server) cursorDelivered(v *visitor, cursor *user.Cursor) func(msg *model.Message) {
+	if cursor == nil {
+		return func(msg *model.Message) {}
+	}
+	userID := v.MaybeUserID() // Subscriber, not the publishing visitor passed to the subscriber function
+	return func(msg *model.Message) {
+		if msg.Event == model.OpenEvent || msg.Event == model.KeepaliveEvent || msg.Event == model.PollRequestEvent || msg.Event == model.DroppedEvent {
+			return
+		}
+		s.userManager.EnqueueCursorDelivered(userID, cursor.Name, msg.ID)
+	}
+}
+
 // maybeSetRateVisitors sets the rate visitor on a topic (v.SetRateVisitor), indicating that all messages published
 // to that topic will be rate limited against the rate visitor instead of the publishing visitor.
 //
@@ -1941,6 +2281,18 @@ func (s *Server) handleOptions(w http.ResponseWriter, _ *http.Request, _ *visito
 	return nil
 }
 
+// requestBaseURL returns the configured base URL, or derives it from the request if it is not set
+func (s *Server) requestBaseURL(r *http.Request) string {
+	if s.config.BaseURL != "" {
+		return s.config.BaseURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, r.Host)
+}
+
 // topicFromPath returns the topic from a root path (e.g. /mytopic), creating it if it doesn't exist.
 // The visitor is consulted for the per-visitor topic-creation rate limit; pass nil to bypass (internal use).
 func (s *Server) topicFromPath(v *visitor, path string) (*topic, error) {
@@ -2028,16 +2380,33 @@ func (s *Server) topicsFromPattern(pattern string) ([]*topic, error) {
 }
 
 func (s *Server) runSMTPServer() error {
-	s.smtpServerBackend = newMailBackend(s.config, s.handle)
-	s.smtpServer = smtp.NewServer(s.smtpServerBackend)
-	s.smtpServer.Addr = s.config.SMTPServerListen
-	s.smtpServer.Domain = s.config.SMTPServerDomain
-	s.smtpServer.ReadTimeout = 10 * time.Second
-	s.smtpServer.WriteTimeout = 10 * time.Second
-	s.smtpServer.MaxMessageBytes = 1024 * 1024 // Must be much larger than message size (headers, multipart, etc.)
-	s.smtpServer.MaxRecipients = 1
-	s.smtpServer.AllowInsecureAuth = true
-	return s.smtpServer.ListenAndServe()
+	var auther smtpAuther
+	if s.userManager != nil {
+		auther = s
+	}
+	tlsConfig, err := newSMTPServerTLSConfig(s.config)
+	if err != nil {
+		return err
+	}
+	s.smtpServerBackend = newMailBackend(s.config, auther, s.handle)
+	s.smtpServer = newSMTPServer(s.config, s.smtpServerBackend, tlsConfig)
+	errChan := make(chan error, 2)
+	if s.config.SMTPServerListen != "" {
+		go func() {
+			errChan <- s.smtpServer.ListenAndServe()
+		}()
+	}
+	if s.config.SMTPServerListenTLS != "" {
+		go func() {
+			listener, err := tls.Listen("tcp", s.config.SMTPServerListenTLS, tlsConfig)
+			if err != nil {
+				errChan <- err
+				return
+			}
+			errChan <- s.smtpServer.Serve(listener)
+		}()
+	}
+	return <-errChan
 }
 
 func (s *Server) runManager() {
@@ -2164,6 +2533,9 @@ func (s *Server) sendDelayedMessage(v *visitor, m *model.Message) error {
 	if s.config.UpstreamBaseURL != "" {
 		go s.forwardPollRequest(v, m)
 	}
+	if s.apns != nil {
+		go s.sendToAPNS(v, m)
+	}
 	if s.config.WebPushPublicKey != "" {
 		go s.publishToWebPushEndpoints(v, m)
 	}
@@ -2229,6 +2601,9 @@ func (s *Server) transformBodyJSON(next handleFunc) handleFunc {
 		if m.Call != "" {
 			r.Header.Set("X-Call", m.Call)
 		}
+		if m.SMS != "" {
+			r.Header.Set("X-SMS", m.SMS)
+		}
 		if m.Cache != "" {
 			r.Header.Set("X-Cache", m.Cache)
 		}
@@ -2238,6 +2613,9 @@ func (s *Server) transformBodyJSON(next handleFunc) handleFunc {
 		if m.SequenceID != "" {
 			r.Header.Set("X-Sequence-ID", m.SequenceID)
 		}
+		if m.InReplyTo != "" {
+			r.Header.Set("X-In-Reply-To", m.InReplyTo)
+		}
 		return next(w, r, v)
 	}
 }
@@ -2292,6 +2670,9 @@ func (s *Server) authorizeTopic(next handleFunc, perm user.Permission) handleFun
 // if it is set.
 //
 //   - If auth-file is not configured, immediately return an IP-based visitor
+//   - If auth-proxy-header is set and the request comes from a trusted proxy, or if the client sent a
+//     verified TLS client certificate, that user is used, unless an Authorization header is also set
+//     (which must then match the user)
 //   - If the header is not set or not supported (anything non-Basic and non-Bearer),
 //     an IP-based visitor is returned
 //   - If the header is set, authenticate will be called to check the username/password (Basic auth),
@@ -2306,10 +2687,20 @@ func (s *Server) maybeAuthenticate(r *http.Request) (*visitor, error) {
 	if s.userManager == nil {
 		return vip, nil
 	}
+	// A trusted reverse proxy or a TLS client certificate may have authenticated the user already
+	implicitUser, err := s.authenticateImplicit(r)
+	if err != nil {
+		logr(r).Err(err).Debug("Authentication failed")
+		return vip, err // Always return visitor, even when error occurs!
+	}
 	header, err := readAuthHeader(r)
 	if err != nil {
 		return vip, err
 	} else if !supportedAuthHeader(header) {
+		if implicitUser != nil {
+			// No checkTOTP here: implicit users are exempt from two-factor authentication, see totpRequired
+			return s.visitor(ip, implicitUser), nil
+		}
 		return vip, nil
 	}
 	// If we're trying to auth, check the rate limiter first
@@ -2321,8 +2712,14 @@ func (s *Server) maybeAuthenticate(r *http.Request) (*visitor, error) {
 		vip.AuthFailed()
 		logr(r).Err(err).Debug("Authentication failed")
 		return vip, errHTTPUnauthorized // Always return visitor, even when error occurs!
+	} else if implicitUser != nil && implicitUser.ID != u.ID {
+		logr(r).Debug("Authorization header user %s does not match user %s", u.Name, implicitUser.Name)
+		return vip, errHTTPUnauthorized
+	}
+	// Authentication with user was successful, but two-factor authentication may limit what the user can do
+	if err := s.checkTOTP(r, u); err != nil {
+		return vip, err
 	}
-	// Authentication with user was successful
 	return s.visitor(ip, u), nil
 }
 
@@ -2337,6 +2734,25 @@ func (s *Server) authenticate(r *http.Request, header string) (user *user.User,
 	return s.authenticateBasicAuth(r, header)
 }
 
+// authenticateImplicit returns the user identified by a trusted reverse proxy (see authenticateProxy), or
+// by a TLS client certificate (see authenticateClientCert), or nil if neither applies. If both identify
+// a user, it must be the same one.
+func (s *Server) authenticateImplicit(r *http.Request) (*user.User, error) {
+	proxyUser, err := s.authenticateProxy(r)
+	if err != nil {
+		return nil, err
+	}
+	certUser, err := s.authenticateClientCert(r)
+	if err != nil {
+		return nil, err
+	} else if proxyUser != nil && certUser != nil && proxyUser.ID != certUser.ID {
+		return nil, errHTTPUnauthorized
+	} else if proxyUser != nil {
+		return proxyUser, nil
+	}
+	return certUser, nil
+}
+
 // readAuthHeader reads the raw value of the Authorization header, either from the actual HTTP header,
 // or from the ?auth... query parameter
 func readAuthHeader(r *http.Request) (string, error) {
@@ -2368,10 +2784,13 @@ func (s *Server) authenticateBasicAuth(r *http.Request, value string) (user *use
 	} else if username == "" {
 		return s.authenticateBearerAuth(r, password) // Treat password as token
 	}
-	return s.userManager.Authenticate(username, password)
+	return s.auther.Authenticate(username, password)
 }
 
 func (s *Server) authenticateBearerAuth(r *http.Request, token string) (*user.User, error) {
+	if s.jwt != nil && isJWT(token) {
+		return s.authenticateJWT(r, token)
+	}
 	u, err := s.userManager.AuthenticateToken(token)
 	if err != nil {
 		return nil, err
@@ -1,13 +1,18 @@
 package server
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"image/png"
 	"net/http"
 	"net/netip"
+	"net/url"
 	"strings"
 	"time"
 
+	"github.com/pquerna/otp"
 	"heckel.io/ntfy/v2/log"
 	"heckel.io/ntfy/v2/model"
 	"heckel.io/ntfy/v2/user"
@@ -19,6 +24,8 @@ const (
 	tokenExpiryDuration          = 72 * time.Hour // Extend tokens by this much
 	emailVerificationTokenExpiry = 24 * time.Hour // Magic-link lifetime for email verification
 	passwordResetTokenExpiry     = time.Hour      // Magic-link lifetime for password reset (higher-privilege -> shorter)
+	totpQRCodeSize               = 256            // Width and height of the TOTP provisioning QR code, in pixels
+	totpDefaultIssuer            = "ntfy"         // Issuer shown in authenticator apps, if base-url is not set
 )
 
 func (s *Server) handleAccountCreate(w http.ResponseWriter, r *http.Request, v *visitor) error {
@@ -50,6 +57,7 @@ func (s *Server) handleAccountCreate(w http.ResponseWriter, r *http.Request, v *
 		}
 		return err
 	}
+	s.audit(v, user.AuditActionUserAdd, newAccount.Username, nil, &user.AuditUser{Role: user.RoleUser})
 	v.AccountActionPerformed()
 	// If an email was provided and email sending is configured, start verification (best-effort).
 	// The address becomes the primary email on verify (the new account has no primary yet); a
@@ -65,37 +73,17 @@ func (s *Server) handleAccountCreate(w http.ResponseWriter, r *http.Request, v *
 }
 
 func (s *Server) handleAccountGet(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	if u := v.User(); u != nil && u.Scope != nil && u.Scope.NoAccount {
+		return errHTTPForbiddenTokenScope
+	}
 	info, err := v.Info()
 	if err != nil {
 		return err
 	}
 	logvr(v, r).Tag(tagAccount).Fields(visitorExtendedInfoContext(info)).Debug("Retrieving account stats")
-	limits, stats := info.Limits, info.Stats
 	response := &apiAccountResponse{
-		Limits: &apiAccountLimits{
-			Basis:                    string(limits.Basis),
-			Messages:                 limits.MessageLimit,
-			MessagesExpiryDuration:   int64(limits.MessageExpiryDuration.Seconds()),
-			Emails:                   limits.EmailLimit,
-			Calls:                    limits.CallLimit,
-			Reservations:             limits.ReservationsLimit,
-			AttachmentTotalSize:      limits.AttachmentTotalSizeLimit,
-			AttachmentFileSize:       limits.AttachmentFileSizeLimit,
-			AttachmentExpiryDuration: int64(limits.AttachmentExpiryDuration.Seconds()),
-			AttachmentBandwidth:      limits.AttachmentBandwidthLimit,
-		},
-		Stats: &apiAccountStats{
-			Messages:                     stats.Messages,
-			MessagesRemaining:            stats.MessagesRemaining,
-			Emails:                       stats.Emails,
-			EmailsRemaining:              stats.EmailsRemaining,
-			Calls:                        stats.Calls,
-			CallsRemaining:               stats.CallsRemaining,
-			Reservations:                 stats.Reservations,
-			ReservationsRemaining:        stats.ReservationsRemaining,
-			AttachmentTotalSize:          stats.AttachmentTotalSize,
-			AttachmentTotalSizeRemaining: stats.AttachmentTotalSizeRemaining,
-		},
+		Limits: newAPIAccountLimits(info.Limits),
+		Stats:  newAPIAccountStats(info.Stats),
 	}
 	u := v.User()
 	if u != nil {
@@ -163,16 +151,30 @@ func (s *Server) handleAccountGet(w http.ResponseWriter, r *http.Request, v *vis
 					lastOrigin = t.LastOrigin.String()
 				}
 				response.Tokens = append(response.Tokens, &apiAccountTokenResponse{
-					Token:       t.Value,
+					ID:          t.ID,
+					Prefix:      t.Prefix,
 					Label:       t.Label,
 					LastAccess:  t.LastAccess.Unix(),
 					LastOrigin:  lastOrigin,
 					Expires:     t.Expires.Unix(),
 					Provisioned: t.Provisioned,
+					Current:     t.ID == user.TokenID(u.Token),
+					Scope:       newAPIAccountTokenScope(t.Scope),
 				})
 			}
 		}
-		if s.config.TwilioAccount != "" {
+		totp, err := s.userManager.TOTP(u.ID)
+		if err != nil && !errors.Is(err, user.ErrTOTPNotFound) {
+			return err
+		}
+		response.TOTP = &apiAccountTOTP{
+			Required: s.totpRequired(u),
+		}
+		if totp != nil && totp.Enabled {
+			response.TOTP.Enabled = true
+			response.TOTP.RecoveryCodes = totp.RecoveryCodes
+		}
+		if s.telephony != nil {
 			phoneNumbers, err := s.userManager.PhoneNumbers(u.ID)
 			if err != nil {
 				return err
@@ -202,6 +204,21 @@ func (s *Server) handleAccountGet(w http.ResponseWriter, r *http.Request, v *vis
 				response.Emails = emailInfos
 			}
 		}
+		cursors, err := s.userManager.Cursors(u.ID)
+		if err != nil {
+			return err
+		}
+		if len(cursors) > 0 {
+			response.Cursors = make([]*apiAccountCursor, 0)
+			for _, c := range cursors {
+				response.Cursors = append(response.Cursors, &apiAccountCursor{
+					Name:          c.Name,
+					Topics:        c.Topics,
+					LastDelivered: c.LastDelivered,
+					LastAcked:     c.LastAcked,
+				})
+			}
+		}
 	} else {
 		response.Username = user.Everyone
 		response.Role = string(user.RoleAnonymous)
@@ -217,7 +234,7 @@ func (s *Server) handleAccountDelete(w http.ResponseWriter, r *http.Request, v *
 		return errHTTPBadRequest
 	}
 	u := v.User()
-	if _, err := s.userManager.Authenticate(u.Name, req.Password); err != nil {
+	if _, err := s.auther.Authenticate(u.Name, req.Password); err != nil {
 		return errHTTPBadRequestIncorrectPasswordConfirmation
 	}
 	if err := s.userManager.CanChangeUser(u.Name); err != nil {
@@ -231,6 +248,11 @@ func (s *Server) handleAccountDelete(w http.ResponseWriter, r *http.Request, v *
 			logvr(v, r).Err(err).Warn("Error removing web push subscriptions for %s", u.Name)
 		}
 	}
+	if s.apns != nil && u.ID != "" {
+		if err := s.apns.RemoveDevicesByUserID(u.ID); err != nil {
+			logvr(v, r).Err(err).Warn("Error removing APNs devices for %s", u.Name)
+		}
+	}
 	if u.Billing.StripeSubscriptionID != "" {
 		logvr(v, r).Tag(tagStripe).Info("Canceling billing subscription for user %s", u.Name)
 		if _, err := s.stripe.CancelSubscription(u.Billing.StripeSubscriptionID); err != nil {
@@ -244,6 +266,7 @@ func (s *Server) handleAccountDelete(w http.ResponseWriter, r *http.Request, v *
 	if err := s.userManager.MarkUserRemoved(u); err != nil {
 		return err
 	}
+	s.audit(v, user.AuditActionUserRemove, u.Name, user.NewAuditUser(u), nil)
 	return s.writeJSON(w, newSuccessResponse())
 }
 
@@ -255,9 +278,12 @@ func (s *Server) handleAccountPasswordChange(w http.ResponseWriter, r *http.Requ
 		return errHTTPBadRequest
 	}
 	u := v.User()
-	if _, err := s.userManager.Authenticate(u.Name, req.Password); err != nil {
+	if _, err := s.auther.Authenticate(u.Name, req.Password); err != nil {
 		return errHTTPBadRequestIncorrectPasswordConfirmation
 	}
+	if s.isLDAPUser(u) {
+		return errHTTPConflictLDAPUserChange
+	}
 	logvr(v, r).Tag(tagAccount).Debug("Changing password for user %s", u.Name)
 	if err := s.userManager.ChangePassword(u.Name, req.NewPassword, false); err != nil {
 		if errors.Is(err, user.ErrProvisionedUserChange) {
@@ -265,6 +291,7 @@ func (s *Server) handleAccountPasswordChange(w http.ResponseWriter, r *http.Requ
 		}
 		return err
 	}
+	s.audit(v, user.AuditActionUserPassword, u.Name, nil, nil)
 	return s.writeJSON(w, newSuccessResponse())
 }
 
@@ -281,24 +308,38 @@ func (s *Server) handleAccountTokenCreate(w http.ResponseWriter, r *http.Request
 	if req.Expires != nil {
 		expires = time.Unix(*req.Expires, 0)
 	}
+	scope, err := parseTokenScope(req.Scope)
+	if err != nil {
+		return err
+	}
 	u := v.User()
+	if u.PasswordAuth() { // Logged in with password, second factor may be required
+		if err := s.verifyTOTPLogin(r, v, u, req.TOTP); err != nil {
+			return err
+		}
+	}
 	logvr(v, r).
 		Tag(tagAccount).
 		Fields(log.Context{
 			"token_label":   label,
 			"token_expires": expires,
+			"token_scoped":  scope != nil,
 		}).
 		Debug("Creating token for user %s", u.Name)
-	token, err := s.userManager.CreateToken(u.ID, label, expires, v.IP(), false)
+	token, err := s.userManager.CreateToken(u.ID, label, expires, v.IP(), scope, false)
 	if err != nil {
 		return err
 	}
+	s.audit(v, user.AuditActionTokenAdd, u.Name, nil, user.NewAuditToken(token))
 	response := &apiAccountTokenResponse{
+		ID:         token.ID,
 		Token:      token.Value,
+		Prefix:     token.Prefix,
 		Label:      token.Label,
 		LastAccess: token.LastAccess.Unix(),
 		LastOrigin: token.LastOrigin.String(),
 		Expires:    token.Expires.Unix(),
+		Scope:      newAPIAccountTokenScope(token.Scope),
 	}
 	return s.writeJSON(w, response)
 }
@@ -314,6 +355,9 @@ func (s *Server) handleAccountTokenUpdate(w http.ResponseWriter, r *http.Request
 			return errHTTPBadRequestNoTokenProvided
 		}
 	}
+	if u.Scope != nil && user.TokenID(req.Token) != user.TokenID(u.Token) {
+		return errHTTPForbiddenTokenScope // Scoped tokens can only change themselves
+	}
 	var expires *time.Time
 	if req.Expires != nil {
 		expires = util.Time(time.Unix(*req.Expires, 0))
@@ -327,6 +371,10 @@ func (s *Server) handleAccountTokenUpdate(w http.ResponseWriter, r *http.Request
 			"token_expires": expires,
 		}).
 		Debug("Updating token for user %s as deleted", u.Name)
+	before, err := s.userManager.Token(u.ID, req.Token)
+	if err != nil {
+		return err
+	}
 	token, err := s.userManager.ChangeToken(u.ID, req.Token, req.Label, expires)
 	if err != nil {
 		if errors.Is(err, user.ErrProvisionedTokenChange) {
@@ -334,12 +382,18 @@ func (s *Server) handleAccountTokenUpdate(w http.ResponseWriter, r *http.Request
 		}
 		return err
 	}
+	if req.Label != nil || req.Expires != nil { // Don't log automatic token extensions of the web app
+		s.audit(v, user.AuditActionTokenChange, u.Name, user.NewAuditToken(before), user.NewAuditToken(token))
+	}
 	response := &apiAccountTokenResponse{
-		Token:      token.Value,
+		ID:         token.ID,
+		Prefix:     token.Prefix,
 		Label:      token.Label,
 		LastAccess: token.LastAccess.Unix(),
 		LastOrigin: token.LastOrigin.String(),
 		Expires:    token.Expires.Unix(),
+		Current:    token.ID == user.TokenID(u.Token),
+		Scope:      newAPIAccountTokenScope(token.Scope),
 	}
 	return s.writeJSON(w, response)
 }
@@ -353,19 +407,99 @@ func (s *Server) handleAccountTokenDelete(w http.ResponseWriter, r *http.Request
 			return errHTTPBadRequestNoTokenProvided
 		}
 	}
+	if u.Scope != nil && user.TokenID(token) != user.TokenID(u.Token) {
+		return errHTTPForbiddenTokenScope // Scoped tokens can only delete themselves
+	}
+	before, err := s.userManager.Token(u.ID, token)
+	if err != nil {
+		return err
+	}
 	if err := s.userManager.RemoveToken(u.ID, token); err != nil {
 		if errors.Is(err, user.ErrProvisionedTokenChange) {
 			return errHTTPConflictProvisionedTokenChange
 		}
 		return err
 	}
+	s.audit(v, user.AuditActionTokenRemove, u.Name, user.NewAuditToken(before), nil)
 	logvr(v, r).
 		Tag(tagAccount).
-		Field("token", token).
+		Field("token_prefix", before.Prefix).
 		Debug("Deleted token for user %s", u.Name)
 	return s.writeJSON(w, newSuccessResponse())
 }
 
+// parseTokenScope converts the token scope of a token request to a user.TokenScope. A nil scope
+// results in an unrestricted token.
+func parseTokenScope(req *apiAccountTokenScope) (*user.TokenScope, error) {
+	if req == nil {
+		return nil, nil
+	}
+	scope := &user.TokenScope{
+		Grants:    make([]user.Grant, 0, len(req.Topics)),
+		NoAccount: req.NoAccount,
+	}
+	for _, t := range req.Topics {
+		if t == nil || !user.AllowedTopicPattern(t.Topic) {
+			return nil, errHTTPBadRequestTokenScopeInvalid
+		}
+		permission, err := user.ParsePermission(t.Permission)
+		if err != nil || permission == user.PermissionDenyAll {
+			return nil, errHTTPBadRequestTokenScopeInvalid
+		}
+		scope.Grants = append(scope.Grants, user.Grant{TopicPattern: t.Topic, Permission: permission})
+	}
+	return scope, nil
+}
+
+func newAPIAccountTokenScope(scope *user.TokenScope) *apiAccountTokenScope {
+	if scope == nil {
+		return nil
+	}
+	response := &apiAccountTokenScope{
+		NoAccount: scope.NoAccount,
+	}
+	for _, grant := range scope.Grants {
+		response.Topics = append(response.Topics, &apiAccountTokenScopeTopic{
+			Topic:      grant.TopicPattern,
+			Permission: grant.Permission.String(),
+		})
+	}
+	return response
+}
+
+func newAPIAccountLimits(limits *visitorLimits) *apiAccountLimits {
+	return &apiAccountLimits{
+		Basis:                    string(limits.Basis),
+		Messages:                 limits.MessageLimit,
+		MessagesExpiryDuration:   int64(limits.MessageExpiryDuration.Seconds()),
+		Emails:                   limits.EmailLimit,
+		Calls:                    limits.CallLimit,
+		SMS:                      limits.SMSLimit,
+		Reservations:             limits.ReservationsLimit,
+		AttachmentTotalSize:      limits.AttachmentTotalSizeLimit,
+		AttachmentFileSize:       limits.AttachmentFileSizeLimit,
+		AttachmentExpiryDuration: int64(limits.AttachmentExpiryDuration.Seconds()),
+		AttachmentBandwidth:      limits.AttachmentBandwidthLimit,
+	}
+}
+
+func newAPIAccountStats(stats *visitorStats) *apiAccountStats {
+	return &apiAccountStats{
+		Messages:                     stats.Messages,
+		MessagesRemaining:            stats.MessagesRemaining,
+		Emails:                       stats.Emails,
+		EmailsRemaining:              stats.EmailsRemaining,
+		Calls:                        stats.Calls,
+		CallsRemaining:               stats.CallsRemaining,
+		SMS:                          stats.SMS,
+		SMSRemaining:                 stats.SMSRemaining,
+		Reservations:                 stats.Reservations,
+		ReservationsRemaining:        stats.ReservationsRemaining,
+		AttachmentTotalSize:          stats.AttachmentTotalSize,
+		AttachmentTotalSizeRemaining: stats.AttachmentTotalSizeRemaining,
+	}
+}
+
 func (s *Server) handleAccountSettingsChange(w http.ResponseWriter, r *http.Request, v *visitor) error {
 	newPrefs, err := readJSONWithLimit[user.Prefs](r.Body, jsonBodyBytesLimit, false)
 	if err != nil {
@@ -523,6 +657,7 @@ func (s *Server) handleAccountReservationAdd(w http.ResponseWriter, r *http.Requ
 		}
 		return err
 	}
+	s.audit(v, user.AuditActionReservationAdd, u.Name, nil, &user.AuditGrant{Topic: req.Topic, Permission: everyone.String()})
 	// Kill existing subscribers
 	t, err := s.topicFromID(v, req.Topic)
 	if err != nil {
@@ -560,6 +695,7 @@ func (s *Server) handleAccountReservationDelete(w http.ResponseWriter, r *http.R
 	if err := s.userManager.RemoveReservations(u.Name, topic); err != nil {
 		return err
 	}
+	s.audit(v, user.AuditActionReservationRemove, u.Name, &user.AuditGrant{Topic: topic}, nil)
 	if deleteMessages {
 		if err := s.messageCache.ExpireMessages(topic); err != nil {
 			return err
@@ -569,6 +705,87 @@ func (s *Server) handleAccountReservationDelete(w http.ResponseWriter, r *http.R
 	return s.writeJSON(w, newSuccessResponse())
 }
 
+// handleAccountCursorAdd creates (or updates the topics of) a durable subscription for the user. Subscribing with
+// ?subscription=<name> then tracks delivered messages and replays everything after the last acknowledged message.
+func (s *Server) handleAccountCursorAdd(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u := v.User()
+	req, err := readJSONWithLimit[apiAccountCursorRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	if !user.AllowedCursorName(req.Name) || len(req.Topics) == 0 {
+		return errHTTPBadRequestCursorInvalid
+	}
+	for _, topic := range req.Topics {
+		if !topicRegex.MatchString(topic) {
+			return errHTTPBadRequestTopicInvalid
+		} else if err := s.userManager.Authorize(u, topic, user.PermissionRead); err != nil {
+			return errHTTPForbidden.Fields(log.Context{"topic": topic})
+		}
+	}
+	logvr(v, r).
+		Tag(tagAccount).
+		Fields(log.Context{
+			"cursor_name":   req.Name,
+			"cursor_topics": req.Topics,
+		}).
+		Debug("Adding durable subscription")
+	if err := s.userManager.AddCursor(u.ID, req.Name, req.Topics); err != nil {
+		if errors.Is(err, user.ErrTooManyCursors) {
+			return errHTTPTooManyRequestsLimitCursors
+		} else if errors.Is(err, user.ErrInvalidArgument) {
+			return errHTTPBadRequestCursorInvalid
+		}
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+func (s *Server) handleAccountCursorDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	matches := apiAccountCursorSingleRegex.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		return errHTTPInternalErrorInvalidPath
+	}
+	name := matches[1]
+	u := v.User()
+	logvr(v, r).Tag(tagAccount).Field("cursor_name", name).Debug("Removing durable subscription")
+	if err := s.userManager.RemoveCursor(u.ID, name); err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// handleAccountCursorAck advances a durable subscription to the given message ID. The next time a client subscribes
+// with ?subscription=<name>, only messages after this message are replayed.
+func (s *Server) handleAccountCursorAck(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	matches := apiAccountCursorAckRegex.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		return errHTTPInternalErrorInvalidPath
+	}
+	name := matches[1]
+	req, err := readJSONWithLimit[apiAccountCursorAckRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	} else if !model.ValidMessageID(req.ID) {
+		return errHTTPBadRequestMessageIDInvalid
+	}
+	u := v.User()
+	logvr(v, r).
+		Tag(tagAccount).
+		Fields(log.Context{
+			"cursor_name": name,
+			"message_id":  req.ID,
+		}).
+		Trace("Acknowledging message for durable subscription")
+	if err := s.userManager.AckCursor(u.ID, name, req.ID); err != nil {
+		if errors.Is(err, user.ErrCursorNotFound) {
+			return errHTTPNotFoundCursor
+		}
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
 // maybeRemoveMessagesAndExcessReservations deletes topic reservations for the given user (if too many for tier),
 // and marks associated messages for the topics as deleted. This also eventually deletes attachments.
 // The process relies on the manager to perform the actual deletions (see runManager).
@@ -581,6 +798,9 @@ func (s *Server) maybeRemoveMessagesAndExcessReservations(r *http.Request, v *vi
 		return nil
 	}
 	logvr(v, r).Tag(tagAccount).Info("Removed excess topic reservations, now removing messages for topics %s", strings.Join(removedTopics, ", "))
+	for _, topic := range removedTopics {
+		s.audit(v, user.AuditActionReservationRemove, u.Name, &user.AuditGrant{Topic: topic}, nil)
+	}
 	if err := s.messageCache.ExpireMessages(removedTopics...); err != nil {
 		return err
 	}
@@ -601,7 +821,7 @@ func (s *Server) handleAccountPhoneNumberVerify(w http.ResponseWriter, r *http.R
 	// Check user is allowed to add phone numbers
 	if u == nil || (u.IsUser() && u.Tier == nil) {
 		return errHTTPUnauthorized
-	} else if u.IsUser() && u.Tier.CallLimit == 0 {
+	} else if u.IsUser() && u.Tier.CallLimit == 0 && u.Tier.SMSLimit == 0 {
 		return errHTTPUnauthorized
 	}
 	// Check if phone number exists
@@ -613,7 +833,7 @@ func (s *Server) handleAccountPhoneNumberVerify(w http.ResponseWriter, r *http.R
 	}
 	// Actually add the unverified number, and send verification
 	logvr(v, r).Tag(tagAccount).Field("phone_number", req.Number).Debug("Sending phone number verification")
-	if err := s.verifyPhoneNumber(v, r, req.Number, req.Channel); err != nil {
+	if err := s.telephony.Verify(v, r, req.Number, req.Channel); err != nil {
 		return err
 	}
 	return s.writeJSON(w, newSuccessResponse())
@@ -628,7 +848,7 @@ func (s *Server) handleAccountPhoneNumberAdd(w http.ResponseWriter, r *http.Requ
 	if !phoneNumberRegex.MatchString(req.Number) {
 		return errHTTPBadRequestPhoneNumberInvalid
 	}
-	if err := s.verifyPhoneNumberCheck(v, r, req.Number, req.Code); err != nil {
+	if err := s.telephony.VerifyCheck(v, r, req.Number, req.Code); err != nil {
 		return err
 	}
 	logvr(v, r).Tag(tagAccount).Field("phone_number", req.Number).Debug("Adding phone number as verified")
@@ -654,6 +874,157 @@ func (s *Server) handleAccountPhoneNumberDelete(w http.ResponseWriter, r *http.R
 	return s.writeJSON(w, newSuccessResponse())
 }
 
+// handleAccountTOTPAdd starts the two-factor authentication enrollment (POST /v1/account/totp). It returns
+// a new secret, along with the otpauth:// provisioning URI and a QR code to add it to an authenticator app.
+// Two-factor authentication is not enabled until the user confirms a code (handleAccountTOTPEnable).
+func (s *Server) handleAccountTOTPAdd(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u := v.User()
+	key, err := s.userManager.AddTOTP(u.ID, s.totpIssuer(), u.Name)
+	if errors.Is(err, user.ErrTOTPEnabled) {
+		return errHTTPConflictTOTPEnabled
+	} else if err != nil {
+		return err
+	}
+	qrCode, err := totpQRCode(key)
+	if err != nil {
+		return err
+	}
+	logvr(v, r).Tag(tagAccount).Info("Starting two-factor authentication enrollment")
+	response := &apiAccountTOTPResponse{
+		Secret: key.Secret(),
+		URI:    key.URL(),
+		QRCode: qrCode,
+	}
+	return s.writeJSON(w, response)
+}
+
+// handleAccountTOTPEnable completes the two-factor authentication enrollment (PUT /v1/account/totp), if the
+// code matches the pending secret. The response contains the recovery codes, which are only shown once.
+func (s *Server) handleAccountTOTPEnable(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u := v.User()
+	req, err := readJSONWithLimit[apiAccountTOTPEnableRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	recoveryCodes, err := s.userManager.EnableTOTP(u.ID, req.Code)
+	if errors.Is(err, user.ErrTOTPNotFound) {
+		return errHTTPNotFoundTOTP
+	} else if errors.Is(err, user.ErrTOTPEnabled) {
+		return errHTTPConflictTOTPEnabled
+	} else if errors.Is(err, user.ErrTOTPCodeInvalid) {
+		return errHTTPBadRequestTOTPCodeInvalid
+	} else if err != nil {
+		return err
+	}
+	logvr(v, r).Tag(tagAccount).Info("Two-factor authentication enabled")
+	return s.writeJSON(w, &apiAccountTOTPEnableResponse{RecoveryCodes: recoveryCodes})
+}
+
+// handleAccountTOTPDelete disables two-factor authentication (DELETE /v1/account/totp), or cancels a pending
+// enrollment. Since this weakens the account security, the password must be confirmed.
+func (s *Server) handleAccountTOTPDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u := v.User()
+	req, err := readJSONWithLimit[apiAccountTOTPDeleteRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	} else if req.Password == "" {
+		return errHTTPBadRequest
+	}
+	if _, err := s.auther.Authenticate(u.Name, req.Password); err != nil {
+		return errHTTPBadRequestIncorrectPasswordConfirmation
+	}
+	if s.totpRequired(u) {
+		return errHTTPConflictTOTPRequired
+	}
+	logvr(v, r).Tag(tagAccount).Info("Disabling two-factor authentication")
+	if err := s.userManager.RemoveTOTP(u.ID); err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// verifyTOTPLogin checks the second factor when a session token is created with a password. If two-factor
+// authentication is not enabled for the user, this is a no-op. Invalid codes count as failed logins, so they
+// are subject to the same rate limiting as wrong passwords.
+func (s *Server) verifyTOTPLogin(r *http.Request, v *visitor, u *user.User, code string) error {
+	enabled, err := s.userManager.TOTPEnabled(u.ID)
+	if err != nil {
+		return err
+	} else if !enabled {
+		return nil
+	} else if code == "" {
+		return errHTTPUnauthorizedTOTPRequired
+	}
+	if err := s.userManager.VerifyTOTP(u.ID, code); errors.Is(err, user.ErrTOTPCodeInvalid) {
+		s.visitor(v.IP(), nil).AuthFailed()
+		logvr(v, r).Tag(tagAccount).Debug("Two-factor authentication code invalid")
+		return errHTTPUnauthorizedTOTPInvalid
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// checkTOTP limits what an authenticated user can do based on their two-factor authentication settings. If
+// two-factor authentication is enabled, a password can only be used to create a session token (along with a
+// code, see verifyTOTPLogin); everything else requires an access token. If two-factor authentication is
+// required for the user's role, but not enabled yet, the user can only access the endpoints needed to enroll.
+func (s *Server) checkTOTP(r *http.Request, u *user.User) error {
+	passwordAuth, required := u.PasswordAuth(), s.totpRequired(u)
+	if !passwordAuth && !required {
+		return nil // Fast path, avoids a database query for most token requests
+	}
+	enabled, err := s.userManager.TOTPEnabled(u.ID)
+	if err != nil {
+		return err
+	}
+	if enabled && passwordAuth && !(r.Method == http.MethodPost && r.URL.Path == apiAccountTokenPath) {
+		return errHTTPUnauthorizedTOTPTokenRequired
+	} else if required && !enabled && !isTOTPEnrollmentRequest(r) {
+		return errHTTPForbiddenTOTPRequired
+	}
+	return nil
+}
+
+// totpRequired returns true if two-factor authentication is mandatory for the given user, based on their role.
+// Provisioned users are exempt, since they are defined in the server config and typically used by scripts, and
+// so are users authenticated with an external JWT, since the identity provider is responsible for the second factor.
+//
+// Users that were authenticated implicitly, by a trusted reverse proxy or with a TLS client certificate (see
+// authenticateImplicit), are exempt as well: they never present a password or a TOTP code to ntfy, so the proxy
+// (or the possession of the certificate's private key) takes the place of the second factor. If such a request also
+// carries an Authorization header, the flags are not set, and the user is subject to the requirement as usual.
+func (s *Server) totpRequired(u *user.User) bool {
+	return !u.Provisioned && !u.JWT && !u.ProxyAuth && !u.ClientCert && util.Contains(s.config.AuthRequireTOTP, u.Role)
+}
+
+// totpIssuer returns the issuer that authenticator apps display next to the account name
+func (s *Server) totpIssuer() string {
+	if baseURL, err := url.Parse(s.config.BaseURL); err == nil && baseURL.Host != "" {
+		return baseURL.Host
+	}
+	return totpDefaultIssuer
+}
+
+// isTOTPEnrollmentRequest returns true if the request is needed to log in and enroll in two-factor
+// authentication, i.e. if it must be allowed even if two-factor authentication is required but not enabled
+func isTOTPEnrollmentRequest(r *http.Request) bool {
+	return (r.Method == http.MethodGet && r.URL.Path == apiAccountPath) || r.URL.Path == apiAccountTokenPath || r.URL.Path == apiAccountTOTPPath
+}
+
+// totpQRCode renders the provisioning URI of the given key as a PNG image, and returns it as a data: URL
+func totpQRCode(key *otp.Key) (string, error) {
+	img, err := key.Image(totpQRCodeSize, totpQRCodeSize)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", err
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
 // handleAccountEmailAdd starts email verification (PUT /v1/account/email): it generates a
 // magic-link token, stores a pending verification, and emails the link. The address is NOT
 // added to the verified list until the user clicks the link (handleAccountEmailVerify).
@@ -832,12 +1203,12 @@ func (s *Server) handleAccountPasswordResetRequest(w http.ResponseWriter, r *htt
 }
 
 // resolveResetPasswordTarget resolves a reset identifier (username or primary email) to a single account
-// and its primary email. It applies the reset policy on top of the lookup: provisioned users are
+// and its primary email. It applies the reset policy on top of the lookup: provisioned and LDAP users are
 // excluded, and ok=false is returned unless the account has a verified primary email (reset
 // requires one, and that is where the link is sent).
 func (s *Server) resolveResetPasswordTarget(identifier string) (userID string, email string, ok bool) {
 	u, err := s.userManager.UserByEmailOrUsername(identifier)
-	if err != nil || u == nil || u.Provisioned {
+	if err != nil || u == nil || u.Provisioned || s.isLDAPUser(u) {
 		return "", "", false
 	}
 	primary, err := s.userManager.PrimaryEmail(u.ID)
@@ -847,6 +1218,13 @@ func (s *Server) resolveResetPasswordTarget(identifier string) (userID string, e
 	return u.ID, primary, true
 }
 
+// isLDAPUser returns true if the user's password is verified against the LDAP server, in which
+// case it cannot be changed or reset in ntfy
+func (s *Server) isLDAPUser(u *user.User) bool {
+	_, ok := s.auther.(*user.LDAPAuther)
+	return ok && !u.Provisioned
+}
+
 // handleAccountPasswordReset performs the reset (POST /v1/account/password/reset, unauthenticated):
 // it validates the token and sets the new password. Existing access tokens stay valid.
 func (s *Server) handleAccountPasswordReset(w http.ResponseWriter, r *http.Request, v *visitor) error {
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"encoding/base64"
 	"fmt"
 	"github.com/stretchr/testify/require"
 	"heckel.io/ntfy/v2/log"
@@ -8,10 +9,12 @@ import (
 	"heckel.io/ntfy/v2/user"
 	"heckel.io/ntfy/v2/util"
 	"io"
+	"net/http/httptest"
 	"net/netip"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -195,7 +198,7 @@ func TestAccount_ChangeSettings(t *testing.T) {
 
 		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
 		u, _ := s.userManager.User("phil")
-		token, _ := s.userManager.CreateToken(u.ID, "", time.Unix(0, 0), netip.IPv4Unspecified(), false)
+		token, _ := s.userManager.CreateToken(u.ID, "", time.Unix(0, 0), netip.IPv4Unspecified(), nil, false)
 
 		rr := request(t, s, "PATCH", "/v1/account/settings", `{"notification": {"sound": "juntos"},"ignored": true}`, map[string]string{
 			"Authorization": util.BasicAuth("phil", "phil"),
@@ -279,6 +282,176 @@ func TestAccount_Subscription_AddUpdateDelete(t *testing.T) {
 	})
 }
 
+func TestAccount_Cursor_AddAckReplay(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		s := newTestServer(t, newTestConfigWithAuthFile(t, databaseURL))
+		defer s.closeDatabases()
+
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+		auth := map[string]string{
+			"Authorization": util.BasicAuth("phil", "phil"),
+		}
+
+		rr := request(t, s, "POST", "/v1/account/cursor", `{"name": "phone", "topics": ["mytopic", "othertopic"]}`, auth)
+		require.Equal(t, 200, rr.Code)
+
+		// Messages are forwarded to subscribers asynchronously (see topic.Publish). The fan-out must be complete
+		// before subscribing live below, or the live subscriber may receive the messages in addition to the replay.
+		topics, err := s.topicsFromIDs(nil, "mytopic")
+		require.Nil(t, err)
+		var fanoutCount atomic.Int32
+		fanoutSubscriberID := topics[0].Subscribe(func(v *visitor, msg *model.Message) error {
+			fanoutCount.Add(1)
+			return nil
+		}, "", func() {})
+
+		messageIDs := make([]string, 0)
+		for i := 1; i <= 3; i++ {
+			rr = request(t, s, "PUT", "/mytopic", fmt.Sprintf("message %d", i), nil)
+			require.Equal(t, 200, rr.Code)
+			messageIDs = append(messageIDs, toMessage(t, rr.Body.String()).ID)
+		}
+		waitFor(t, func() bool {
+			return fanoutCount.Load() == 3
+		})
+		topics[0].Unsubscribe(fanoutSubscriberID)
+
+		// Nothing acknowledged yet: poll returns everything
+		rr = request(t, s, "GET", "/mytopic/json?poll=1&subscription=phone", "", auth)
+		require.Equal(t, 200, rr.Code)
+		messages := toMessages(t, rr.Body.String())
+		require.Equal(t, 3, len(messages))
+
+		// Acknowledge the second message, then only the third one is replayed
+		rr = request(t, s, "POST", "/v1/account/cursor/phone/ack", fmt.Sprintf(`{"id":"%s"}`, messageIDs[1]), auth)
+		require.Equal(t, 200, rr.Code)
+
+		rr = request(t, s, "GET", "/mytopic/json?poll=1&subscription=phone", "", auth)
+		require.Equal(t, 200, rr.Code)
+		messages = toMessages(t, rr.Body.String())
+		require.Equal(t, 1, len(messages))
+		require.Equal(t, "message 3", messages[0].Message)
+
+		rr = request(t, s, "GET", "/v1/account", "", auth)
+		require.Equal(t, 200, rr.Code)
+		account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(rr.Body))
+		require.Equal(t, 1, len(account.Cursors))
+		require.Equal(t, "phone", account.Cursors[0].Name)
+		require.Equal(t, []string{"mytopic", "othertopic"}, account.Cursors[0].Topics)
+		require.Equal(t, messageIDs[1], account.Cursors[0].LastAcked)
+		require.Equal(t, messageIDs[2], account.Cursors[0].LastDelivered)
+
+		// Errors: wrong topic, unknown subscription, anonymous, bad message ID
+		rr = request(t, s, "GET", "/sometopic/json?poll=1&subscription=phone", "", auth)
+		require.Equal(t, 400, rr.Code)
+		require.Equal(t, 40056, toHTTPError(t, rr.Body.String()).Code)
+
+		rr = request(t, s, "GET", "/mytopic/json?poll=1&subscription=laptop", "", auth)
+		require.Equal(t, 404, rr.Code)
+		require.Equal(t, 40402, toHTTPError(t, rr.Body.String()).Code)
+
+		rr = request(t, s, "GET", "/mytopic/json?poll=1&subscription=phone", "", nil)
+		require.Equal(t, 401, rr.Code)
+
+		rr = request(t, s, "POST", "/v1/account/cursor/phone/ack", `{"id":"not-valid"}`, auth)
+		require.Equal(t, 400, rr.Code)
+		require.Equal(t, 40057, toHTTPError(t, rr.Body.String()).Code)
+
+		rr = request(t, s, "POST", "/v1/account/cursor/laptop/ack", fmt.Sprintf(`{"id":"%s"}`, messageIDs[1]), auth)
+		require.Equal(t, 404, rr.Code)
+
+		// Live subscription: messages published by others are recorded as delivered to phil's cursor
+		u, err := s.userManager.User("phil")
+		require.Nil(t, err)
+		subscribeRR := httptest.NewRecorder()
+		subscribeURL := fmt.Sprintf("/mytopic/json?subscription=phone&auth=%s", base64.RawURLEncoding.EncodeToString([]byte(util.BasicAuth("phil", "phil"))))
+		subscribeCancel := subscribe(t, s, subscribeURL, subscribeRR)
+		rr = request(t, s, "PUT", "/mytopic", "message 4", nil)
+		require.Equal(t, 200, rr.Code)
+		liveMessageID := toMessage(t, rr.Body.String()).ID
+		waitFor(t, func() bool {
+			cursor, err := s.userManager.Cursor(u.ID, "phone")
+			return err == nil && cursor.LastDelivered == liveMessageID
+		})
+		subscribeCancel()
+		messages = toMessages(t, subscribeRR.Body.String())
+		require.Equal(t, 3, len(messages)) // open, replayed "message 3", live "message 4"
+		require.Equal(t, "message 3", messages[1].Message)
+		require.Equal(t, "message 4", messages[2].Message)
+
+		// Delete
+		rr = request(t, s, "DELETE", "/v1/account/cursor/phone", "", auth)
+		require.Equal(t, 200, rr.Code)
+
+		rr = request(t, s, "GET", "/mytopic/json?poll=1&subscription=phone", "", auth)
+		require.Equal(t, 404, rr.Code)
+	})
+}
+
+func TestAccount_Cursor_FilteredNotDelivered(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		s := newTestServer(t, newTestConfigWithAuthFile(t, databaseURL))
+		defer s.closeDatabases()
+
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+		auth := map[string]string{
+			"Authorization": util.BasicAuth("phil", "phil"),
+		}
+		rr := request(t, s, "POST", "/v1/account/cursor", `{"name": "phone", "topics": ["mytopic"]}`, auth)
+		require.Equal(t, 200, rr.Code)
+
+		rr = request(t, s, "PUT", "/mytopic", "urgent", map[string]string{"Priority": "5"})
+		require.Equal(t, 200, rr.Code)
+		urgentMessageID := toMessage(t, rr.Body.String()).ID
+		rr = request(t, s, "PUT", "/mytopic", "not urgent", nil)
+		require.Equal(t, 200, rr.Code)
+
+		// The second message is filtered out, so it was never written to the client and is not recorded
+		rr = request(t, s, "GET", "/mytopic/json?poll=1&subscription=phone&priority=5", "", auth)
+		require.Equal(t, 200, rr.Code)
+		messages := toMessages(t, rr.Body.String())
+		require.Equal(t, 1, len(messages))
+		require.Equal(t, "urgent", messages[0].Message)
+
+		u, err := s.userManager.User("phil")
+		require.Nil(t, err)
+		cursor, err := s.userManager.Cursor(u.ID, "phone")
+		require.Nil(t, err)
+		require.Equal(t, urgentMessageID, cursor.LastDelivered)
+	})
+}
+
+func TestAccount_Cursor_AddInvalid(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		conf := newTestConfigWithAuthFile(t, databaseURL)
+		conf.AuthDefault = user.PermissionDenyAll
+		s := newTestServer(t, conf)
+		defer s.closeDatabases()
+
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+		require.Nil(t, s.userManager.AllowAccess("phil", "mytopic", user.PermissionRead))
+		auth := map[string]string{
+			"Authorization": util.BasicAuth("phil", "phil"),
+		}
+
+		rr := request(t, s, "POST", "/v1/account/cursor", `{"name": "my phone", "topics": ["mytopic"]}`, auth)
+		require.Equal(t, 400, rr.Code)
+		require.Equal(t, 40055, toHTTPError(t, rr.Body.String()).Code)
+
+		rr = request(t, s, "POST", "/v1/account/cursor", `{"name": "phone", "topics": []}`, auth)
+		require.Equal(t, 400, rr.Code)
+
+		rr = request(t, s, "POST", "/v1/account/cursor", `{"name": "phone", "topics": ["mytopic", "secret"]}`, auth)
+		require.Equal(t, 403, rr.Code)
+
+		rr = request(t, s, "POST", "/v1/account/cursor", `{"name": "phone", "topics": ["mytopic"]}`, nil)
+		require.Equal(t, 401, rr.Code)
+
+		rr = request(t, s, "POST", "/v1/account/cursor", `{"name": "phone", "topics": ["mytopic"]}`, auth)
+		require.Equal(t, 200, rr.Code)
+	})
+}
+
 func TestAccount_ChangePassword(t *testing.T) {
 	forEachBackend(t, func(t *testing.T, databaseURL string) {
 		conf := newTestConfigWithAuthFile(t, databaseURL)
@@ -357,7 +530,9 @@ func TestAccount_ExtendToken(t *testing.T) {
 		require.Equal(t, 200, rr.Code)
 		extendedToken, err := util.UnmarshalJSON[apiAccountTokenResponse](io.NopCloser(rr.Body))
 		require.Nil(t, err)
-		require.Equal(t, token.Token, extendedToken.Token)
+		require.Equal(t, token.ID, extendedToken.ID)
+		require.Empty(t, extendedToken.Token) // Token value is only returned when it is created
+		require.True(t, extendedToken.Current)
 		require.True(t, token.Expires < extendedToken.Expires)
 
 		expires := time.Now().Add(999 * time.Hour)
@@ -366,19 +541,19 @@ func TestAccount_ExtendToken(t *testing.T) {
 			"Authorization": util.BearerAuth(token.Token),
 		})
 		require.Equal(t, 200, rr.Code)
-		token, err = util.UnmarshalJSON[apiAccountTokenResponse](io.NopCloser(rr.Body))
+		updatedToken, err := util.UnmarshalJSON[apiAccountTokenResponse](io.NopCloser(rr.Body))
 		require.Nil(t, err)
-		require.Equal(t, "some label", token.Label)
-		require.Equal(t, expires.Unix(), token.Expires)
+		require.Equal(t, "some label", updatedToken.Label)
+		require.Equal(t, expires.Unix(), updatedToken.Expires)
 
-		body = fmt.Sprintf(`{"token":"%s", "expires": 0}`, token.Token)
+		body = fmt.Sprintf(`{"token":"%s", "expires": 0}`, token.ID) // Token can also be referred to by ID
 		rr = request(t, s, "PATCH", "/v1/account/token", body, map[string]string{
 			"Authorization": util.BearerAuth(token.Token),
 		})
 		require.Equal(t, 200, rr.Code)
-		token, err = util.UnmarshalJSON[apiAccountTokenResponse](io.NopCloser(rr.Body))
+		updatedToken, err = util.UnmarshalJSON[apiAccountTokenResponse](io.NopCloser(rr.Body))
 		require.Nil(t, err)
-		require.Equal(t, int64(0), token.Expires)
+		require.Equal(t, int64(0), updatedToken.Expires)
 	})
 }
 
@@ -439,6 +614,173 @@ func TestAccount_DeleteToken(t *testing.T) {
 	})
 }
 
+func TestAccount_ListAndDeleteToken_ByID(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		s := newTestServer(t, newTestConfigWithAuthFile(t, databaseURL))
+		defer s.closeDatabases()
+
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+
+		rr := request(t, s, "POST", "/v1/account/token", `{"label": "session"}`, map[string]string{
+			"Authorization": util.BasicAuth("phil", "phil"),
+		})
+		require.Equal(t, 200, rr.Code)
+		token1, err := util.UnmarshalJSON[apiAccountTokenResponse](io.NopCloser(rr.Body))
+		require.Nil(t, err)
+		require.Equal(t, user.TokenID(token1.Token), token1.ID)
+		require.Equal(t, token1.Token[:8], token1.Prefix)
+
+		rr = request(t, s, "POST", "/v1/account/token", `{"label": "backups"}`, map[string]string{
+			"Authorization": util.BasicAuth("phil", "phil"),
+		})
+		require.Equal(t, 200, rr.Code)
+		token2, err := util.UnmarshalJSON[apiAccountTokenResponse](io.NopCloser(rr.Body))
+		require.Nil(t, err)
+
+		// Token values are not returned when listing tokens, only the prefix and ID
+		rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+			"Authorization": util.BearerAuth(token1.Token),
+		})
+		require.Equal(t, 200, rr.Code)
+		require.NotContains(t, rr.Body.String(), token1.Token)
+		require.NotContains(t, rr.Body.String(), token2.Token)
+		account, err := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(rr.Body))
+		require.Nil(t, err)
+		require.Equal(t, 2, len(account.Tokens))
+		for _, tk := range account.Tokens {
+			require.Empty(t, tk.Token)
+			switch tk.ID {
+			case token1.ID:
+				require.Equal(t, token1.Prefix, tk.Prefix)
+				require.True(t, tk.Current)
+			case token2.ID:
+				require.Equal(t, token2.Prefix, tk.Prefix)
+				require.False(t, tk.Current)
+			default:
+				t.Fatalf("unexpected token ID %s", tk.ID)
+			}
+		}
+
+		// Delete other token by ID
+		rr = request(t, s, "DELETE", "/v1/account/token", "", map[string]string{
+			"Authorization": util.BearerAuth(token1.Token),
+			"X-Token":       token2.ID,
+		})
+		require.Equal(t, 200, rr.Code)
+		rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+			"Authorization": util.BearerAuth(token2.Token),
+		})
+		require.Equal(t, 401, rr.Code)
+	})
+}
+
+func TestAccount_ScopedToken_Topics(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		conf := newTestConfigWithAuthFile(t, databaseURL)
+		conf.AuthDefault = user.PermissionDenyAll
+		s := newTestServer(t, conf)
+		defer s.closeDatabases()
+
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin, false))
+		rr := request(t, s, "POST", "/v1/account/token", `{"label": "ci", "scope": {"topics": [{"topic": "ci-*", "permission": "write-only"}]}}`, map[string]string{
+			"Authorization": util.BasicAuth("phil", "phil"),
+		})
+		require.Equal(t, 200, rr.Code)
+		token, err := util.UnmarshalJSON[apiAccountTokenResponse](io.NopCloser(rr.Body))
+		require.Nil(t, err)
+		require.Equal(t, []*apiAccountTokenScopeTopic{{Topic: "ci-*", Permission: "write-only"}}, token.Scope.Topics)
+		require.False(t, token.Scope.NoAccount)
+		tokenAuth := map[string]string{"Authorization": util.BearerAuth(token.Token)}
+
+		// Topic access is restricted, even for admins
+		rr = request(t, s, "PUT", "/ci-builds", "build done", tokenAuth)
+		require.Equal(t, 200, rr.Code)
+		rr = request(t, s, "GET", "/ci-builds/json?poll=1", "", tokenAuth)
+		require.Equal(t, 403, rr.Code)
+		rr = request(t, s, "PUT", "/mytopic", "hi", tokenAuth)
+		require.Equal(t, 403, rr.Code)
+		rr = request(t, s, "PUT", "/mytopic", "hi", map[string]string{"Authorization": util.BasicAuth("", token.Token)})
+		require.Equal(t, 403, rr.Code)
+
+		// Account can be read, but not used to escalate privileges
+		account := getAccount(t, s, tokenAuth)
+		require.Equal(t, "phil", account.Username)
+		require.Equal(t, "ci-*", account.Tokens[0].Scope.Topics[0].Topic)
+		rr = request(t, s, "POST", "/v1/account/token", "", tokenAuth)
+		require.Equal(t, 403, rr.Code)
+		require.Equal(t, 40303, toHTTPError(t, rr.Body.String()).Code)
+		rr = request(t, s, "POST", "/v1/account/password", `{"password": "phil", "new_password": "new"}`, tokenAuth)
+		require.Equal(t, 403, rr.Code)
+		rr = request(t, s, "GET", "/v1/users", "", tokenAuth)
+		require.Equal(t, 403, rr.Code)
+		require.Equal(t, 40303, toHTTPError(t, rr.Body.String()).Code)
+		rr = request(t, s, "PUT", "/v1/users/access", `{"username": "phil", "topic": "*", "permission": "rw"}`, tokenAuth)
+		require.Equal(t, 403, rr.Code)
+
+		// Scoped token can only delete itself
+		rr = request(t, s, "POST", "/v1/account/token", "", map[string]string{
+			"Authorization": util.BasicAuth("phil", "phil"),
+		})
+		require.Equal(t, 200, rr.Code)
+		other, _ := util.UnmarshalJSON[apiAccountTokenResponse](io.NopCloser(rr.Body))
+		rr = request(t, s, "DELETE", "/v1/account/token", "", map[string]string{
+			"Authorization": util.BearerAuth(token.Token),
+			"X-Token":       other.Token,
+		})
+		require.Equal(t, 403, rr.Code)
+		rr = request(t, s, "DELETE", "/v1/account/token", "", tokenAuth)
+		require.Equal(t, 200, rr.Code)
+	})
+}
+
+func TestAccount_ScopedToken_NoAccount(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		s := newTestServer(t, newTestConfigWithAuthFile(t, databaseURL))
+		defer s.closeDatabases()
+
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+		rr := request(t, s, "POST", "/v1/account/token", `{"scope": {"no_account": true}}`, map[string]string{
+			"Authorization": util.BasicAuth("phil", "phil"),
+		})
+		require.Equal(t, 200, rr.Code)
+		token, err := util.UnmarshalJSON[apiAccountTokenResponse](io.NopCloser(rr.Body))
+		require.Nil(t, err)
+		require.True(t, token.Scope.NoAccount)
+		tokenAuth := map[string]string{"Authorization": util.BearerAuth(token.Token)}
+
+		// Topics are not restricted, but the account API is off limits
+		rr = request(t, s, "PUT", "/mytopic", "hi", tokenAuth)
+		require.Equal(t, 200, rr.Code)
+		rr = request(t, s, "GET", "/v1/account", "", tokenAuth)
+		require.Equal(t, 403, rr.Code)
+		require.Equal(t, 40303, toHTTPError(t, rr.Body.String()).Code)
+		rr = request(t, s, "PATCH", "/v1/account/settings", `{"language": "de"}`, tokenAuth)
+		require.Equal(t, 403, rr.Code)
+		rr = request(t, s, "DELETE", "/v1/account/token", "", tokenAuth)
+		require.Equal(t, 403, rr.Code)
+	})
+}
+
+func TestAccount_ScopedToken_Invalid(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		s := newTestServer(t, newTestConfigWithAuthFile(t, databaseURL))
+		defer s.closeDatabases()
+
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+		for _, body := range []string{
+			`{"scope": {"topics": [{"topic": "ci/*", "permission": "rw"}]}}`,
+			`{"scope": {"topics": [{"topic": "ci-*", "permission": "deny-all"}]}}`,
+			`{"scope": {"topics": [{"topic": "ci-*", "permission": "invalid"}]}}`,
+		} {
+			rr := request(t, s, "POST", "/v1/account/token", body, map[string]string{
+				"Authorization": util.BasicAuth("phil", "phil"),
+			})
+			require.Equal(t, 400, rr.Code)
+			require.Equal(t, 40061, toHTTPError(t, rr.Body.String()).Code)
+		}
+	})
+}
+
 func TestAccount_Delete_Success(t *testing.T) {
 	forEachBackend(t, func(t *testing.T, databaseURL string) {
 		conf := newTestConfigWithAuthFile(t, databaseURL)
@@ -582,6 +924,7 @@ func TestAccount_Reservation_AddRemoveUserWithTierSuccess(t *testing.T) {
 			MessageExpiryDuration:    86400 * time.Second,
 			EmailLimit:               32,
 			CallLimit:                10,
+			SMSLimit:                 15,
 			ReservationLimit:         2,
 			AttachmentFileSizeLimit:  1231231,
 			AttachmentTotalSizeLimit: 123123,
@@ -624,6 +967,7 @@ func TestAccount_Reservation_AddRemoveUserWithTierSuccess(t *testing.T) {
 		require.Equal(t, int64(86400), account.Limits.MessagesExpiryDuration)
 		require.Equal(t, int64(32), account.Limits.Emails)
 		require.Equal(t, int64(10), account.Limits.Calls)
+		require.Equal(t, int64(15), account.Limits.SMS)
 		require.Equal(t, int64(2), account.Limits.Reservations)
 		require.Equal(t, int64(1231231), account.Limits.AttachmentFileSize)
 		require.Equal(t, int64(123123), account.Limits.AttachmentTotalSize)
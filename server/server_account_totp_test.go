@@ -0,0 +1,198 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestAccount_TOTP_EnrollAndLogin(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		conf := newTestConfigWithAuthFile(t, databaseURL)
+		conf.BaseURL = "https://ntfy.example.com"
+		s := newTestServer(t, conf)
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+		passwordAuth := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+
+		// Start enrollment, not enforced until confirmed
+		rr := request(t, s, "POST", "/v1/account/totp", "", passwordAuth)
+		require.Equal(t, 200, rr.Code)
+		enrollment, _ := util.UnmarshalJSON[apiAccountTOTPResponse](io.NopCloser(rr.Body))
+		require.NotEmpty(t, enrollment.Secret)
+		require.True(t, strings.HasPrefix(enrollment.URI, "otpauth://totp/ntfy.example.com:phil?"))
+		require.True(t, strings.HasPrefix(enrollment.QRCode, "data:image/png;base64,"))
+		require.False(t, getAccount(t, s, passwordAuth).TOTP.Enabled)
+
+		// Confirm enrollment
+		rr = request(t, s, "PUT", "/v1/account/totp", `{"code": "000000"}`, passwordAuth)
+		require.Equal(t, 400, rr.Code)
+		require.Equal(t, 40060, toHTTPError(t, rr.Body.String()).Code)
+		rr = request(t, s, "PUT", "/v1/account/totp", fmt.Sprintf(`{"code": "%s"}`, totpCode(t, enrollment.Secret, time.Now())), passwordAuth)
+		require.Equal(t, 200, rr.Code)
+		enabled, _ := util.UnmarshalJSON[apiAccountTOTPEnableResponse](io.NopCloser(rr.Body))
+		require.Len(t, enabled.RecoveryCodes, 10)
+
+		// Password alone is no longer enough, except to create a session token with a code
+		rr = request(t, s, "GET", "/v1/account", "", passwordAuth)
+		require.Equal(t, 401, rr.Code)
+		require.Equal(t, 40105, toHTTPError(t, rr.Body.String()).Code)
+		rr = request(t, s, "PUT", "/mytopic", "hi", passwordAuth)
+		require.Equal(t, 401, rr.Code)
+		rr = request(t, s, "POST", "/v1/account/token", "", passwordAuth)
+		require.Equal(t, 401, rr.Code)
+		require.Equal(t, 40103, toHTTPError(t, rr.Body.String()).Code)
+		rr = request(t, s, "POST", "/v1/account/token", `{"totp": "000000"}`, passwordAuth)
+		require.Equal(t, 401, rr.Code)
+		require.Equal(t, 40104, toHTTPError(t, rr.Body.String()).Code)
+
+		code := totpCode(t, enrollment.Secret, time.Now().Add(30*time.Second)) // Next period, the current code was used for enrollment
+		rr = request(t, s, "POST", "/v1/account/token", fmt.Sprintf(`{"totp": "%s"}`, code), passwordAuth)
+		require.Equal(t, 200, rr.Code)
+		token, _ := util.UnmarshalJSON[apiAccountTokenResponse](io.NopCloser(rr.Body))
+
+		// Codes cannot be replayed
+		rr = request(t, s, "POST", "/v1/account/token", fmt.Sprintf(`{"totp": "%s"}`, code), passwordAuth)
+		require.Equal(t, 401, rr.Code)
+		require.Equal(t, 40104, toHTTPError(t, rr.Body.String()).Code)
+
+		// Access tokens work as before, also via basic auth
+		rr = request(t, s, "PUT", "/mytopic", "hi", map[string]string{"Authorization": util.BearerAuth(token.Token)})
+		require.Equal(t, 200, rr.Code)
+		rr = request(t, s, "PUT", "/mytopic", "hi", map[string]string{"Authorization": util.BasicAuth("", token.Token)})
+		require.Equal(t, 200, rr.Code)
+		account := getAccount(t, s, map[string]string{"Authorization": util.BearerAuth(token.Token)})
+		require.True(t, account.TOTP.Enabled)
+		require.Equal(t, 10, account.TOTP.RecoveryCodes)
+
+		// Recovery codes work once
+		rr = request(t, s, "POST", "/v1/account/token", fmt.Sprintf(`{"totp": "%s"}`, strings.ToUpper(enabled.RecoveryCodes[0])), passwordAuth)
+		require.Equal(t, 200, rr.Code)
+		rr = request(t, s, "POST", "/v1/account/token", fmt.Sprintf(`{"totp": "%s"}`, enabled.RecoveryCodes[0]), passwordAuth)
+		require.Equal(t, 401, rr.Code)
+		require.Equal(t, 9, getAccount(t, s, map[string]string{"Authorization": util.BearerAuth(token.Token)}).TOTP.RecoveryCodes)
+
+		// Cannot enroll twice
+		rr = request(t, s, "POST", "/v1/account/totp", "", map[string]string{"Authorization": util.BearerAuth(token.Token)})
+		require.Equal(t, 409, rr.Code)
+		require.Equal(t, 40910, toHTTPError(t, rr.Body.String()).Code)
+	})
+}
+
+func TestAccount_TOTP_Disable(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		s := newTestServer(t, newTestConfigWithAuthFile(t, databaseURL))
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+		tokenAuth := newTOTPEnabledSession(t, s, "phil", "phil")
+
+		rr := request(t, s, "DELETE", "/v1/account/totp", `{"password": "wrong"}`, tokenAuth)
+		require.Equal(t, 400, rr.Code)
+		require.Equal(t, 40026, toHTTPError(t, rr.Body.String()).Code)
+		rr = request(t, s, "DELETE", "/v1/account/totp", `{"password": "phil"}`, tokenAuth)
+		require.Equal(t, 200, rr.Code)
+
+		// Password works again
+		rr = request(t, s, "PUT", "/mytopic", "hi", map[string]string{"Authorization": util.BasicAuth("phil", "phil")})
+		require.Equal(t, 200, rr.Code)
+		require.False(t, getAccount(t, s, tokenAuth).TOTP.Enabled)
+	})
+}
+
+func TestAccount_TOTP_RequiredForRole(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		conf := newTestConfigWithAuthFile(t, databaseURL)
+		conf.AuthRequireTOTP = []user.Role{user.RoleAdmin}
+		s := newTestServer(t, conf)
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin, false))
+		require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser, false))
+		passwordAuth := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+
+		// Users of other roles are not affected
+		rr := request(t, s, "PUT", "/mytopic", "hi", map[string]string{"Authorization": util.BasicAuth("ben", "ben")})
+		require.Equal(t, 200, rr.Code)
+
+		// Admin can only log in and enroll
+		rr = request(t, s, "PUT", "/mytopic", "hi", passwordAuth)
+		require.Equal(t, 403, rr.Code)
+		require.Equal(t, 40302, toHTTPError(t, rr.Body.String()).Code)
+		rr = request(t, s, "GET", "/v1/users", "", passwordAuth)
+		require.Equal(t, 403, rr.Code)
+		account := getAccount(t, s, passwordAuth)
+		require.True(t, account.TOTP.Required)
+		require.False(t, account.TOTP.Enabled)
+
+		tokenAuth := newTOTPEnabledSession(t, s, "phil", "phil")
+		rr = request(t, s, "PUT", "/mytopic", "hi", tokenAuth)
+		require.Equal(t, 200, rr.Code)
+
+		// Cannot be disabled
+		rr = request(t, s, "DELETE", "/v1/account/totp", `{"password": "phil"}`, tokenAuth)
+		require.Equal(t, 409, rr.Code)
+		require.Equal(t, 40911, toHTTPError(t, rr.Body.String()).Code)
+	})
+}
+
+func TestAccount_TOTP_RequiredForRole_ProvisionedUserExempt(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		hash, err := bcrypt.GenerateFromPassword([]byte("backup"), bcrypt.MinCost)
+		require.Nil(t, err)
+		conf := newTestConfigWithAuthFile(t, databaseURL)
+		conf.AuthRequireTOTP = []user.Role{user.RoleAdmin}
+		conf.AuthUsers = []*user.User{{Name: "backup", Hash: string(hash), Role: user.RoleAdmin}}
+		s := newTestServer(t, conf)
+
+		rr := request(t, s, "PUT", "/backups", "done", map[string]string{"Authorization": util.BasicAuth("backup", "backup")})
+		require.Equal(t, 200, rr.Code)
+	})
+}
+
+func TestAccount_TOTP_RequiredForRole_ProxyUserExempt(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		conf := newTestConfigWithAuthProxy(t, databaseURL)
+		conf.AuthRequireTOTP = []user.Role{user.RoleAdmin}
+		s := newTestServer(t, conf)
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin, false))
+
+		// Authenticated by the proxy: the proxy is responsible for the second factor
+		rr := request(t, s, "PUT", "/mytopic", "hi", map[string]string{"Remote-User": "phil"}, fromTrustedProxy)
+		require.Equal(t, 200, rr.Code)
+		rr = request(t, s, "GET", "/v1/account", "", map[string]string{"Remote-User": "phil"}, fromTrustedProxy)
+		require.Equal(t, 200, rr.Code)
+		account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(rr.Body))
+		require.False(t, account.TOTP.Required)
+
+		// Password auth through the proxy is still subject to the requirement
+		rr = request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+			"Remote-User":   "phil",
+			"Authorization": util.BasicAuth("phil", "phil"),
+		}, fromTrustedProxy)
+		require.Equal(t, 403, rr.Code)
+		require.Equal(t, 40302, toHTTPError(t, rr.Body.String()).Code)
+	})
+}
+
+func newTOTPEnabledSession(t *testing.T, s *Server, username, password string) map[string]string {
+	passwordAuth := map[string]string{"Authorization": util.BasicAuth(username, password)}
+	rr := request(t, s, "POST", "/v1/account/totp", "", passwordAuth)
+	require.Equal(t, 200, rr.Code)
+	enrollment, _ := util.UnmarshalJSON[apiAccountTOTPResponse](io.NopCloser(rr.Body))
+	rr = request(t, s, "PUT", "/v1/account/totp", fmt.Sprintf(`{"code": "%s"}`, totpCode(t, enrollment.Secret, time.Now())), passwordAuth)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "POST", "/v1/account/token", fmt.Sprintf(`{"totp": "%s"}`, totpCode(t, enrollment.Secret, time.Now().Add(30*time.Second))), passwordAuth)
+	require.Equal(t, 200, rr.Code)
+	token, _ := util.UnmarshalJSON[apiAccountTokenResponse](io.NopCloser(rr.Body))
+	return map[string]string{"Authorization": util.BearerAuth(token.Token)}
+}
+
+func totpCode(t *testing.T, secret string, now time.Time) string {
+	code, err := totp.GenerateCode(secret, now)
+	require.Nil(t, err)
+	return code
+}
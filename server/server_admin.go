@@ -2,8 +2,29 @@ package server
 
 import (
 	"errors"
+	"heckel.io/ntfy/v2/log"
 	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+	"maps"
 	"net/http"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// Defaults for tiers added via the admin API, if not specified in the request. These match
+// the defaults of the "ntfy tier add" command.
+const (
+	defaultAdminTierMessageLimit             = 5000
+	defaultAdminTierMessageExpiryDuration    = 12 * time.Hour
+	defaultAdminTierEmailLimit               = 20
+	defaultAdminTierCallLimit                = 0
+	defaultAdminTierSMSLimit                 = 0
+	defaultAdminTierReservationLimit         = 3
+	defaultAdminTierAttachmentFileSizeLimit  = 15 * 1024 * 1024
+	defaultAdminTierAttachmentTotalSizeLimit = 100 * 1024 * 1024
+	defaultAdminTierAttachmentExpiryDuration = 6 * time.Hour
+	defaultAdminTierAttachmentBandwidthLimit = 1024 * 1024 * 1024
 )
 
 func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request, v *visitor) error {
@@ -80,6 +101,7 @@ func (s *Server) handleUsersAdd(w http.ResponseWriter, r *http.Request, v *visit
 			return err
 		}
 	}
+	s.audit(v, user.AuditActionUserAdd, req.Username, nil, &user.AuditUser{Role: user.RoleUser, Tier: req.Tier})
 	return s.writeJSON(w, newSuccessResponse())
 }
 
@@ -103,10 +125,12 @@ func (s *Server) handleUsersUpdate(w http.ResponseWriter, r *http.Request, v *vi
 			if err := s.userManager.ChangePassword(req.Username, req.Hash, true); err != nil {
 				return err
 			}
+			s.audit(v, user.AuditActionUserPassword, req.Username, nil, nil)
 		} else if req.Password != "" {
 			if err := s.userManager.ChangePassword(req.Username, req.Password, false); err != nil {
 				return err
 			}
+			s.audit(v, user.AuditActionUserPassword, req.Username, nil, nil)
 		}
 	} else {
 		password, hashed := req.Password, false
@@ -116,6 +140,7 @@ func (s *Server) handleUsersUpdate(w http.ResponseWriter, r *http.Request, v *vi
 		if err := s.userManager.AddUser(req.Username, password, user.RoleUser, hashed); err != nil {
 			return err
 		}
+		s.audit(v, user.AuditActionUserAdd, req.Username, nil, &user.AuditUser{Role: user.RoleUser})
 	}
 	if req.Tier != "" {
 		if _, err = s.userManager.Tier(req.Tier); errors.Is(err, user.ErrTierNotFound) {
@@ -126,6 +151,11 @@ func (s *Server) handleUsersUpdate(w http.ResponseWriter, r *http.Request, v *vi
 		if err := s.userManager.ChangeTier(req.Username, req.Tier); err != nil {
 			return err
 		}
+		var before *user.AuditUser
+		if u != nil && u.Tier != nil {
+			before = &user.AuditUser{Tier: u.Tier.Code}
+		}
+		s.audit(v, user.AuditActionUserTier, req.Username, before, &user.AuditUser{Tier: req.Tier})
 	}
 	return s.writeJSON(w, newSuccessResponse())
 }
@@ -146,6 +176,7 @@ func (s *Server) handleUsersDelete(w http.ResponseWriter, r *http.Request, v *vi
 	if err := s.userManager.RemoveUser(req.Username); err != nil {
 		return err
 	}
+	s.audit(v, user.AuditActionUserRemove, req.Username, user.NewAuditUser(u), nil)
 	if err := s.killUserSubscriber(u, "*"); err != nil { // FIXME super inefficient
 		return err
 	}
@@ -167,9 +198,14 @@ func (s *Server) handleAccessAllow(w http.ResponseWriter, r *http.Request, v *vi
 	if err != nil {
 		return errHTTPBadRequestPermissionInvalid
 	}
+	grants, err := s.userManager.Grants(req.Username)
+	if err != nil {
+		return err
+	}
 	if err := s.userManager.AllowAccess(req.Username, req.Topic, permission); err != nil {
 		return err
 	}
+	s.audit(v, user.AuditActionAccessAllow, req.Username, user.NewAuditGrants(grants, req.Topic), &user.AuditGrant{Topic: req.Topic, Permission: permission.String()})
 	return s.writeJSON(w, newSuccessResponse())
 }
 
@@ -182,15 +218,585 @@ func (s *Server) handleAccessReset(w http.ResponseWriter, r *http.Request, v *vi
 	if err != nil {
 		return err
 	}
+	grants, err := s.userManager.Grants(req.Username)
+	if err != nil {
+		return err
+	}
 	if err := s.userManager.ResetAccess(req.Username, req.Topic); err != nil {
 		return err
 	}
+	s.audit(v, user.AuditActionAccessReset, req.Username, user.NewAuditGrants(grants, req.Topic), nil)
 	if err := s.killUserSubscriber(u, req.Topic); err != nil { // This may be a pattern
 		return err
 	}
 	return s.writeJSON(w, newSuccessResponse())
 }
 
+func (s *Server) handleGroupsGet(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	groups, err := s.userManager.Groups()
+	if err != nil {
+		return err
+	}
+	groupsResponse := make([]*apiGroupResponse, len(groups))
+	for i, g := range groups {
+		groupGrants := make([]*apiUserGrantResponse, len(g.Grants))
+		for j, grant := range g.Grants {
+			groupGrants[j] = &apiUserGrantResponse{
+				Topic:      grant.TopicPattern,
+				Permission: grant.Permission.String(),
+			}
+		}
+		members := g.Members
+		if members == nil {
+			members = []string{}
+		}
+		groupsResponse[i] = &apiGroupResponse{
+			Name:        g.Name,
+			Members:     members,
+			Grants:      groupGrants,
+			Provisioned: g.Provisioned,
+		}
+	}
+	return s.writeJSON(w, groupsResponse)
+}
+
+func (s *Server) handleGroupsAdd(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiGroupAddOrDeleteRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	} else if !user.AllowedGroupName(req.Name) {
+		return errHTTPBadRequest.Wrap("group name invalid")
+	}
+	if err := s.userManager.AddGroup(req.Name); err != nil {
+		return groupErrorToHTTP(err)
+	}
+	s.audit(v, user.AuditActionGroupAdd, user.GroupTarget(req.Name), nil, nil)
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+func (s *Server) handleGroupsDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiGroupAddOrDeleteRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	group, err := s.userManager.Group(req.Name)
+	if err != nil {
+		return groupErrorToHTTP(err)
+	}
+	if err := s.userManager.RemoveGroup(req.Name); err != nil {
+		return groupErrorToHTTP(err)
+	}
+	s.audit(v, user.AuditActionGroupRemove, user.GroupTarget(req.Name), user.NewAuditGrants(group.Grants, ""), nil)
+	if err := s.killGroupSubscribers(group.Members, group.Grants); err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+func (s *Server) handleGroupMembersAdd(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiGroupMemberRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	if err := s.userManager.AddGroupMember(req.Group, req.Username); err != nil {
+		return groupErrorToHTTP(err)
+	}
+	s.audit(v, user.AuditActionGroupMemberAdd, user.GroupTarget(req.Group), nil, req.Username)
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+func (s *Server) handleGroupMembersDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiGroupMemberRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	group, err := s.userManager.Group(req.Group)
+	if err != nil {
+		return groupErrorToHTTP(err)
+	}
+	if err := s.userManager.RemoveGroupMember(req.Group, req.Username); err != nil {
+		return groupErrorToHTTP(err)
+	}
+	s.audit(v, user.AuditActionGroupMemberRemove, user.GroupTarget(req.Group), req.Username, nil)
+	if err := s.killGroupSubscribers([]string{req.Username}, group.Grants); err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+func (s *Server) handleGroupAccessAllow(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiGroupAccessAllowRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	permission, err := user.ParsePermission(req.Permission)
+	if err != nil {
+		return errHTTPBadRequestPermissionInvalid
+	}
+	group, err := s.userManager.Group(req.Group)
+	if err != nil {
+		return groupErrorToHTTP(err)
+	}
+	if err := s.userManager.AllowGroupAccess(req.Group, req.Topic, permission); err != nil {
+		return groupErrorToHTTP(err)
+	}
+	s.audit(v, user.AuditActionAccessAllow, user.GroupTarget(req.Group), user.NewAuditGrants(group.Grants, req.Topic), &user.AuditGrant{Topic: req.Topic, Permission: permission.String()})
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+func (s *Server) handleGroupAccessReset(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiGroupAccessResetRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	group, err := s.userManager.Group(req.Group)
+	if err != nil {
+		return groupErrorToHTTP(err)
+	}
+	if err := s.userManager.ResetGroupAccess(req.Group, req.Topic); err != nil {
+		return groupErrorToHTTP(err)
+	}
+	s.audit(v, user.AuditActionAccessReset, user.GroupTarget(req.Group), user.NewAuditGrants(group.Grants, req.Topic), nil)
+	topic := req.Topic
+	if topic == "" {
+		topic = "*"
+	}
+	if err := s.killGroupSubscribers(group.Members, []user.Grant{{TopicPattern: topic}}); err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+func (s *Server) handleAdminTiersGet(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	tiers, err := s.userManager.Tiers()
+	if err != nil {
+		return err
+	}
+	response := make([]*apiAdminTierResponse, len(tiers))
+	for i, tier := range tiers {
+		response[i] = newAPIAdminTierResponse(tier)
+	}
+	return s.writeJSON(w, response)
+}
+
+func (s *Server) handleAdminTiersAdd(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiAdminTierRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	} else if !user.AllowedTier(req.Code) {
+		return errHTTPBadRequest.Wrap("tier code must consist only of numbers and letters")
+	}
+	if _, err := s.userManager.Tier(req.Code); err == nil {
+		return errHTTPConflictTierExists
+	} else if !errors.Is(err, user.ErrTierNotFound) {
+		return err
+	}
+	tier := &user.Tier{
+		Code:                     req.Code,
+		Name:                     req.Code,
+		MessageLimit:             defaultAdminTierMessageLimit,
+		MessageExpiryDuration:    defaultAdminTierMessageExpiryDuration,
+		EmailLimit:               defaultAdminTierEmailLimit,
+		CallLimit:                defaultAdminTierCallLimit,
+		SMSLimit:                 defaultAdminTierSMSLimit,
+		ReservationLimit:         defaultAdminTierReservationLimit,
+		AttachmentFileSizeLimit:  defaultAdminTierAttachmentFileSizeLimit,
+		AttachmentTotalSizeLimit: defaultAdminTierAttachmentTotalSizeLimit,
+		AttachmentExpiryDuration: defaultAdminTierAttachmentExpiryDuration,
+		AttachmentBandwidthLimit: defaultAdminTierAttachmentBandwidthLimit,
+	}
+	if err := applyAdminTierRequest(tier, req); err != nil {
+		return err
+	}
+	if err := s.userManager.AddTier(tier); err != nil {
+		return err
+	}
+	tier, err = s.userManager.Tier(req.Code)
+	if err != nil {
+		return err
+	}
+	s.audit(v, user.AuditActionTierAdd, tier.Code, nil, user.NewAuditTier(tier))
+	return s.writeJSON(w, newAPIAdminTierResponse(tier))
+}
+
+// handleAdminTiersUpdate changes the given fields of an existing tier. Similar to "ntfy tier change",
+// the new limits apply to active visitors only after their tier changes, or after a server restart.
+func (s *Server) handleAdminTiersUpdate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiAdminTierRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	tier, err := s.userManager.Tier(req.Code)
+	if errors.Is(err, user.ErrTierNotFound) {
+		return errHTTPBadRequestTierInvalid
+	} else if err != nil {
+		return err
+	}
+	before := user.NewAuditTier(tier)
+	if err := applyAdminTierRequest(tier, req); err != nil {
+		return err
+	}
+	if err := s.userManager.UpdateTier(tier); err != nil {
+		return err
+	}
+	s.audit(v, user.AuditActionTierChange, tier.Code, before, user.NewAuditTier(tier))
+	return s.writeJSON(w, newAPIAdminTierResponse(tier))
+}
+
+func (s *Server) handleAdminTiersDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiAdminTierDeleteRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	tier, err := s.userManager.Tier(req.Code)
+	if errors.Is(err, user.ErrTierNotFound) {
+		return errHTTPBadRequestTierInvalid
+	} else if err != nil {
+		return err
+	}
+	users, err := s.userManager.Users()
+	if err != nil {
+		return err
+	}
+	if slices.ContainsFunc(users, func(u *user.User) bool { return u.TierID() == tier.ID }) {
+		return errHTTPConflictTierInUse
+	}
+	if err := s.userManager.RemoveTier(tier.Code); err != nil {
+		return err
+	}
+	s.audit(v, user.AuditActionTierRemove, tier.Code, user.NewAuditTier(tier), nil)
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// applyAdminTierRequest sets all fields that are present in the request on the given tier
+func applyAdminTierRequest(tier *user.Tier, req *apiAdminTierRequest) error {
+	var err error
+	if req.Name != nil {
+		tier.Name = *req.Name
+	}
+	if req.MessageLimit != nil {
+		tier.MessageLimit = *req.MessageLimit
+	}
+	if req.MessageExpiryDuration != nil {
+		if tier.MessageExpiryDuration, err = util.ParseDuration(*req.MessageExpiryDuration); err != nil {
+			return errHTTPBadRequest.Wrap("invalid message_expiry_duration")
+		}
+	}
+	if req.EmailLimit != nil {
+		tier.EmailLimit = *req.EmailLimit
+	}
+	if req.CallLimit != nil {
+		tier.CallLimit = *req.CallLimit
+	}
+	if req.SMSLimit != nil {
+		tier.SMSLimit = *req.SMSLimit
+	}
+	if req.ReservationLimit != nil {
+		tier.ReservationLimit = *req.ReservationLimit
+	}
+	if req.AttachmentFileSizeLimit != nil {
+		if tier.AttachmentFileSizeLimit, err = util.ParseSize(*req.AttachmentFileSizeLimit); err != nil {
+			return errHTTPBadRequest.Wrap("invalid attachment_file_size_limit")
+		}
+	}
+	if req.AttachmentTotalSizeLimit != nil {
+		if tier.AttachmentTotalSizeLimit, err = util.ParseSize(*req.AttachmentTotalSizeLimit); err != nil {
+			return errHTTPBadRequest.Wrap("invalid attachment_total_size_limit")
+		}
+	}
+	if req.AttachmentExpiryDuration != nil {
+		if tier.AttachmentExpiryDuration, err = util.ParseDuration(*req.AttachmentExpiryDuration); err != nil {
+			return errHTTPBadRequest.Wrap("invalid attachment_expiry_duration")
+		}
+	}
+	if req.AttachmentBandwidthLimit != nil {
+		if tier.AttachmentBandwidthLimit, err = util.ParseSize(*req.AttachmentBandwidthLimit); err != nil {
+			return errHTTPBadRequest.Wrap("invalid attachment_bandwidth_limit")
+		}
+	}
+	if req.StripeMonthlyPriceID != nil {
+		tier.StripeMonthlyPriceID = *req.StripeMonthlyPriceID
+	}
+	if req.StripeYearlyPriceID != nil {
+		tier.StripeYearlyPriceID = *req.StripeYearlyPriceID
+	}
+	if (tier.StripeMonthlyPriceID == "") != (tier.StripeYearlyPriceID == "") {
+		return errHTTPBadRequest.Wrap("stripe_monthly_price_id and stripe_yearly_price_id must be set together")
+	}
+	return nil
+}
+
+func newAPIAdminTierResponse(tier *user.Tier) *apiAdminTierResponse {
+	return &apiAdminTierResponse{
+		ID:   tier.ID,
+		Code: tier.Code,
+		Name: tier.Name,
+		Limits: &apiAccountLimits{
+			Basis:                    string(visitorLimitBasisTier),
+			Messages:                 tier.MessageLimit,
+			MessagesExpiryDuration:   int64(tier.MessageExpiryDuration.Seconds()),
+			Emails:                   tier.EmailLimit,
+			Calls:                    tier.CallLimit,
+			SMS:                      tier.SMSLimit,
+			Reservations:             tier.ReservationLimit,
+			AttachmentTotalSize:      tier.AttachmentTotalSizeLimit,
+			AttachmentFileSize:       tier.AttachmentFileSizeLimit,
+			AttachmentExpiryDuration: int64(tier.AttachmentExpiryDuration.Seconds()),
+			AttachmentBandwidth:      tier.AttachmentBandwidthLimit,
+		},
+		StripeMonthlyPriceID: tier.StripeMonthlyPriceID,
+		StripeYearlyPriceID:  tier.StripeYearlyPriceID,
+	}
+}
+
+// handleAdminTokensGet lists the access tokens of the user given in the "username" query parameter.
+// Token values are never returned, only their IDs and prefixes.
+func (s *Server) handleAdminTokensGet(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u, err := s.adminUserFromName(readQueryParam(r, "username"))
+	if err != nil {
+		return err
+	}
+	tokens, err := s.userManager.Tokens(u.ID)
+	if err != nil {
+		return err
+	}
+	response := make([]*apiAccountTokenResponse, len(tokens))
+	for i, t := range tokens {
+		var lastOrigin string
+		if t.LastOrigin != netip.IPv4Unspecified() {
+			lastOrigin = t.LastOrigin.String()
+		}
+		response[i] = &apiAccountTokenResponse{
+			ID:          t.ID,
+			Prefix:      t.Prefix,
+			Label:       t.Label,
+			LastAccess:  t.LastAccess.Unix(),
+			LastOrigin:  lastOrigin,
+			Expires:     t.Expires.Unix(),
+			Provisioned: t.Provisioned,
+			Scope:       newAPIAccountTokenScope(t.Scope),
+		}
+	}
+	return s.writeJSON(w, response)
+}
+
+func (s *Server) handleAdminTokensDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiAdminTokenDeleteRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	} else if req.Token == "" {
+		return errHTTPBadRequestNoTokenProvided
+	}
+	u, err := s.adminUserFromName(req.Username)
+	if err != nil {
+		return err
+	}
+	before, err := s.userManager.Token(u.ID, req.Token)
+	if errors.Is(err, user.ErrTokenNotFound) {
+		return errHTTPNotFoundToken
+	} else if err != nil {
+		return err
+	}
+	if err := s.userManager.RemoveToken(u.ID, req.Token); err != nil {
+		if errors.Is(err, user.ErrProvisionedTokenChange) {
+			return errHTTPConflictProvisionedTokenChange
+		}
+		return err
+	}
+	s.audit(v, user.AuditActionTokenRemove, u.Name, user.NewAuditToken(before), nil)
+	logvr(v, r).
+		Tag(tagAccount).
+		Fields(log.Context{
+			"user_name":    u.Name,
+			"token_prefix": before.Prefix,
+		}).
+		Debug("Admin removed access token")
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// handleAdminReservationsGet lists the topic reservations of the user given in the "username" query
+// parameter, or of all users if no username is given
+func (s *Server) handleAdminReservationsGet(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	var usernames []string
+	if username := readQueryParam(r, "username"); username != "" {
+		u, err := s.adminUserFromName(username)
+		if err != nil {
+			return err
+		}
+		usernames = []string{u.Name}
+	} else {
+		users, err := s.userManager.Users()
+		if err != nil {
+			return err
+		}
+		for _, u := range users {
+			if u.Name != user.Everyone {
+				usernames = append(usernames, u.Name)
+			}
+		}
+	}
+	response := make([]*apiAdminReservationResponse, 0)
+	for _, username := range usernames {
+		reservations, err := s.userManager.Reservations(username)
+		if err != nil {
+			return err
+		}
+		for _, reservation := range reservations {
+			response = append(response, &apiAdminReservationResponse{
+				Username: username,
+				Topic:    reservation.Topic,
+				Everyone: reservation.Everyone.String(),
+			})
+		}
+	}
+	return s.writeJSON(w, response)
+}
+
+// handleAdminReservationsAdd reserves a topic for the given user. Unlike reservations made via the
+// account API, the reservation limit of the user's tier is not enforced.
+func (s *Server) handleAdminReservationsAdd(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiAdminReservationRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	} else if !topicRegex.MatchString(req.Topic) {
+		return errHTTPBadRequestTopicInvalid
+	}
+	everyone, err := user.ParsePermission(req.Everyone)
+	if err != nil {
+		return errHTTPBadRequestPermissionInvalid
+	}
+	u, err := s.adminUserFromName(req.Username)
+	if err != nil {
+		return err
+	}
+	if err := s.userManager.AllowReservation(u.Name, req.Topic); err != nil {
+		return errHTTPConflictTopicReserved
+	}
+	if err := s.userManager.AddReservation(u.Name, req.Topic, everyone, 0); err != nil {
+		return err
+	}
+	s.audit(v, user.AuditActionReservationAdd, u.Name, nil, &user.AuditGrant{Topic: req.Topic, Permission: everyone.String()})
+	t, err := s.topicFromID(v, req.Topic)
+	if err != nil {
+		return err
+	}
+	t.CancelSubscribersExceptUser(u.ID)
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+func (s *Server) handleAdminReservationsDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiAdminReservationRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	} else if !topicRegex.MatchString(req.Topic) {
+		return errHTTPBadRequestTopicInvalid
+	}
+	u, err := s.adminUserFromName(req.Username)
+	if err != nil {
+		return err
+	}
+	exists, err := s.userManager.HasReservation(u.Name, req.Topic)
+	if err != nil {
+		return err
+	} else if !exists {
+		return errHTTPNotFoundReservation
+	}
+	if err := s.userManager.RemoveReservations(u.Name, req.Topic); err != nil {
+		return err
+	}
+	s.audit(v, user.AuditActionReservationRemove, u.Name, &user.AuditGrant{Topic: req.Topic}, nil)
+	if req.DeleteMessages {
+		if err := s.messageCache.ExpireMessages(req.Topic); err != nil {
+			return err
+		}
+		s.pruneMessages()
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// handleAdminVisitorsGet lists all visitors currently held in memory, along with their limits and stats
+func (s *Server) handleAdminVisitorsGet(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	s.mu.RLock()
+	visitors := make(map[string]*visitor, len(s.visitors))
+	for id, vis := range s.visitors {
+		visitors[id] = vis
+	}
+	s.mu.RUnlock()
+	ids := slices.Sorted(maps.Keys(visitors))
+	response := make([]*apiAdminVisitorResponse, 0, len(ids))
+	for _, id := range ids {
+		vis := visitors[id]
+		info, err := vis.Info() // Queries the database, so this must not hold the lock
+		if err != nil {
+			return err
+		}
+		visitorResponse := &apiAdminVisitorResponse{
+			ID:     id,
+			IP:     vis.IP().String(),
+			Limits: newAPIAccountLimits(info.Limits),
+			Stats:  newAPIAccountStats(info.Stats),
+		}
+		if u := vis.User(); u != nil {
+			visitorResponse.Username = u.Name
+			if u.Tier != nil {
+				visitorResponse.Tier = u.Tier.Code
+			}
+		}
+		response = append(response, visitorResponse)
+	}
+	return s.writeJSON(w, response)
+}
+
+// adminUserFromName returns the user with the given name, or errHTTPBadRequestUserNotFound
+func (s *Server) adminUserFromName(username string) (*user.User, error) {
+	if username == "" {
+		return nil, errHTTPBadRequest.Wrap("username missing")
+	}
+	u, err := s.userManager.User(username)
+	if errors.Is(err, user.ErrUserNotFound) {
+		return nil, errHTTPBadRequestUserNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// killGroupSubscribers cancels the subscriptions of the given users on all topics matching the
+// given grants. This is used after group access was revoked, so that subscribers re-authorize.
+func (s *Server) killGroupSubscribers(usernames []string, grants []user.Grant) error {
+	for _, username := range usernames {
+		u, err := s.userManager.User(username)
+		if errors.Is(err, user.ErrUserNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		for _, grant := range grants {
+			if err := s.killUserSubscriber(u, grant.TopicPattern); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// groupErrorToHTTP translates group-related errors from the user manager into HTTP errors
+func groupErrorToHTTP(err error) error {
+	switch {
+	case errors.Is(err, user.ErrGroupNotFound):
+		return errHTTPBadRequestGroupNotFound
+	case errors.Is(err, user.ErrGroupExists):
+		return errHTTPConflictGroupExists
+	case errors.Is(err, user.ErrProvisionedGroupChange):
+		return errHTTPConflictProvisionedGroupChange
+	case errors.Is(err, user.ErrUserNotFound):
+		return errHTTPBadRequestUserNotFound
+	case errors.Is(err, user.ErrInvalidArgument):
+		return errHTTPBadRequest.Wrap("group name or topic invalid")
+	}
+	return err
+}
+
 func (s *Server) killUserSubscriber(u *user.User, topicPattern string) error {
 	topics, err := s.topicsFromPattern(topicPattern)
 	if err != nil {
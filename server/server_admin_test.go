@@ -2,9 +2,13 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/stretchr/testify/require"
 	"heckel.io/ntfy/v2/user"
 	"heckel.io/ntfy/v2/util"
+	"io"
+	"net/http"
+	"net/netip"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -459,3 +463,313 @@ func TestAccess_AllowReset_KillConnection(t *testing.T) {
 		})
 	})
 }
+
+func TestGroup_AddMemberAccessRemove(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		c := newTestConfigWithAuthFile(t, databaseURL)
+		c.AuthDefault = user.PermissionDenyAll
+		s := newTestServer(t, c)
+		defer s.closeDatabases()
+
+		// User and admin
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin, false))
+		require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser, false))
+		admin := map[string]string{
+			"Authorization": util.BasicAuth("phil", "phil"),
+		}
+
+		// Create group, grant access, add member
+		rr := request(t, s, "POST", "/v1/groups", `{"name": "oncall"}`, admin)
+		require.Equal(t, 200, rr.Code)
+		rr = request(t, s, "POST", "/v1/groups", `{"name": "oncall"}`, admin)
+		require.Equal(t, 409, rr.Code)
+		require.Equal(t, 40912, toHTTPError(t, rr.Body.String()).Code)
+		rr = request(t, s, "POST", "/v1/groups", `{"name": "on call"}`, admin)
+		require.Equal(t, 400, rr.Code)
+		rr = request(t, s, "POST", "/v1/groups/access", `{"group": "oncall", "topic":"gold*", "permission":"ro"}`, admin)
+		require.Equal(t, 200, rr.Code)
+
+		// Subscribing not allowed, not yet a member
+		rr = request(t, s, "GET", "/gold1/json?poll=1", "", map[string]string{
+			"Authorization": util.BasicAuth("ben", "ben"),
+		})
+		require.Equal(t, 403, rr.Code)
+
+		rr = request(t, s, "POST", "/v1/groups/members", `{"group": "oncall", "username":"ben"}`, admin)
+		require.Equal(t, 200, rr.Code)
+		rr = request(t, s, "POST", "/v1/groups/members", `{"group": "oncall", "username":"nobody"}`, admin)
+		require.Equal(t, 400, rr.Code)
+		require.Equal(t, 40031, toHTTPError(t, rr.Body.String()).Code)
+		rr = request(t, s, "POST", "/v1/groups/members", `{"group": "nogroup", "username":"ben"}`, admin)
+		require.Equal(t, 400, rr.Code)
+		require.Equal(t, 40062, toHTTPError(t, rr.Body.String()).Code)
+
+		// Now subscribing is allowed
+		rr = request(t, s, "GET", "/gold1/json?poll=1", "", map[string]string{
+			"Authorization": util.BasicAuth("ben", "ben"),
+		})
+		require.Equal(t, 200, rr.Code)
+
+		// List groups
+		rr = request(t, s, "GET", "/v1/groups", "", admin)
+		require.Equal(t, 200, rr.Code)
+		var groups []*apiGroupResponse
+		require.Nil(t, json.NewDecoder(rr.Body).Decode(&groups))
+		require.Equal(t, 1, len(groups))
+		require.Equal(t, "oncall", groups[0].Name)
+		require.Equal(t, []string{"ben"}, groups[0].Members)
+		require.Equal(t, 1, len(groups[0].Grants))
+		require.Equal(t, "gold*", groups[0].Grants[0].Topic)
+		require.Equal(t, "read-only", groups[0].Grants[0].Permission)
+
+		// Remove member, subscribing not allowed (again)
+		rr = request(t, s, "DELETE", "/v1/groups/members", `{"group": "oncall", "username":"ben"}`, admin)
+		require.Equal(t, 200, rr.Code)
+		rr = request(t, s, "GET", "/gold1/json?poll=1", "", map[string]string{
+			"Authorization": util.BasicAuth("ben", "ben"),
+		})
+		require.Equal(t, 403, rr.Code)
+
+		// Reset access and delete group
+		rr = request(t, s, "DELETE", "/v1/groups/access", `{"group": "oncall", "topic":"gold*"}`, admin)
+		require.Equal(t, 200, rr.Code)
+		rr = request(t, s, "DELETE", "/v1/groups", `{"name": "oncall"}`, admin)
+		require.Equal(t, 200, rr.Code)
+		groupsAfter, err := s.userManager.Groups()
+		require.Nil(t, err)
+		require.Equal(t, 0, len(groupsAfter))
+	})
+}
+
+func TestGroup_NonAdminAttempt(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		s := newTestServer(t, newTestConfigWithAuthFile(t, databaseURL))
+		defer s.closeDatabases()
+
+		require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser, false))
+		rr := request(t, s, "POST", "/v1/groups", `{"name": "oncall"}`, map[string]string{
+			"Authorization": util.BasicAuth("ben", "ben"),
+		})
+		require.Equal(t, 401, rr.Code)
+		rr = request(t, s, "GET", "/v1/groups", "", nil)
+		require.Equal(t, 401, rr.Code)
+	})
+}
+
+func TestAdmin_TiersAddChangeRemove(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		s := newTestServer(t, newTestConfigWithAuthFile(t, databaseURL))
+		defer s.closeDatabases()
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin, false))
+		require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser, false))
+		admin := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+
+		// Add tier with defaults and custom limits
+		rr := request(t, s, "POST", "/v1/admin/tiers", `{"code":"pro", "name":"Pro", "message_limit":10000, "attachment_file_size_limit":"50M"}`, admin)
+		require.Equal(t, 200, rr.Code)
+		tier, _ := util.UnmarshalJSON[apiAdminTierResponse](io.NopCloser(rr.Body))
+		require.Equal(t, "pro", tier.Code)
+		require.Equal(t, "Pro", tier.Name)
+		require.Equal(t, int64(10000), tier.Limits.Messages)
+		require.Equal(t, int64(50*1024*1024), tier.Limits.AttachmentFileSize)
+		require.Equal(t, int64(3), tier.Limits.Reservations)
+		require.Equal(t, int64(12*3600), tier.Limits.MessagesExpiryDuration)
+
+		rr = request(t, s, "POST", "/v1/admin/tiers", `{"code":"pro"}`, admin)
+		require.Equal(t, 40914, toHTTPError(t, rr.Body.String()).Code)
+		rr = request(t, s, "POST", "/v1/admin/tiers", `{"code":"not valid"}`, admin)
+		require.Equal(t, 400, rr.Code)
+		rr = request(t, s, "POST", "/v1/admin/tiers", `{"code":"other", "stripe_monthly_price_id":"price_123"}`, admin)
+		require.Equal(t, 400, rr.Code)
+
+		// Change tier
+		rr = request(t, s, "PUT", "/v1/admin/tiers", `{"code":"pro", "reservation_limit":10, "message_expiry_duration":"1d"}`, admin)
+		require.Equal(t, 200, rr.Code)
+		changed, err := s.userManager.Tier("pro")
+		require.Nil(t, err)
+		require.Equal(t, "Pro", changed.Name)
+		require.Equal(t, int64(10000), changed.MessageLimit)
+		require.Equal(t, int64(10), changed.ReservationLimit)
+		require.Equal(t, 24*time.Hour, changed.MessageExpiryDuration)
+
+		rr = request(t, s, "PUT", "/v1/admin/tiers", `{"code":"doesnotexist", "name":"x"}`, admin)
+		require.Equal(t, 40030, toHTTPError(t, rr.Body.String()).Code)
+		rr = request(t, s, "PUT", "/v1/admin/tiers", `{"code":"pro", "attachment_expiry_duration":"invalid"}`, admin)
+		require.Equal(t, 400, rr.Code)
+
+		// List tiers
+		rr = request(t, s, "GET", "/v1/admin/tiers", "", admin)
+		require.Equal(t, 200, rr.Code)
+		tiers, _ := util.UnmarshalJSON[[]*apiAdminTierResponse](io.NopCloser(rr.Body))
+		require.Len(t, *tiers, 1)
+		require.Equal(t, "pro", (*tiers)[0].Code)
+		require.Equal(t, int64(10), (*tiers)[0].Limits.Reservations)
+
+		// Tiers in use cannot be removed
+		require.Nil(t, s.userManager.ChangeTier("ben", "pro"))
+		rr = request(t, s, "DELETE", "/v1/admin/tiers", `{"code":"pro"}`, admin)
+		require.Equal(t, 40915, toHTTPError(t, rr.Body.String()).Code)
+		require.Nil(t, s.userManager.ResetTier("ben"))
+		rr = request(t, s, "DELETE", "/v1/admin/tiers", `{"code":"pro"}`, admin)
+		require.Equal(t, 200, rr.Code)
+		_, err = s.userManager.Tier("pro")
+		require.Equal(t, user.ErrTierNotFound, err)
+
+		// Changes are audited
+		entries, err := s.userManager.AuditEntries(&user.AuditFilter{Target: "pro"})
+		require.Nil(t, err)
+		require.Len(t, entries, 3)
+		require.Equal(t, user.AuditActionTierRemove, entries[0].Action)
+		require.Equal(t, "phil", entries[0].Actor)
+	})
+}
+
+func TestAdmin_TokensListRemove(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		s := newTestServer(t, newTestConfigWithAuthFile(t, databaseURL))
+		defer s.closeDatabases()
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin, false))
+		require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser, false))
+		admin := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+
+		ben, err := s.userManager.User("ben")
+		require.Nil(t, err)
+		token, err := s.userManager.CreateToken(ben.ID, "laptop", time.Unix(0, 0), netip.IPv4Unspecified(), nil, false)
+		require.Nil(t, err)
+
+		rr := request(t, s, "GET", "/v1/admin/tokens?username=ben", "", admin)
+		require.Equal(t, 200, rr.Code)
+		tokens, _ := util.UnmarshalJSON[[]*apiAccountTokenResponse](io.NopCloser(rr.Body))
+		require.Len(t, *tokens, 1)
+		require.Equal(t, token.ID, (*tokens)[0].ID)
+		require.Equal(t, "laptop", (*tokens)[0].Label)
+		require.Equal(t, "", (*tokens)[0].Token)
+
+		rr = request(t, s, "GET", "/v1/admin/tokens?username=nobody", "", admin)
+		require.Equal(t, 40031, toHTTPError(t, rr.Body.String()).Code)
+		rr = request(t, s, "GET", "/v1/admin/tokens", "", admin)
+		require.Equal(t, 400, rr.Code)
+
+		// Remove by ID
+		rr = request(t, s, "DELETE", "/v1/admin/tokens", fmt.Sprintf(`{"username":"ben", "token":"%s"}`, token.ID), admin)
+		require.Equal(t, 200, rr.Code)
+		rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+			"Authorization": util.BearerAuth(token.Value),
+		})
+		require.Equal(t, 401, rr.Code)
+		rr = request(t, s, "DELETE", "/v1/admin/tokens", fmt.Sprintf(`{"username":"ben", "token":"%s"}`, token.ID), admin)
+		require.Equal(t, 40404, toHTTPError(t, rr.Body.String()).Code)
+	})
+}
+
+func TestAdmin_ReservationsAddListRemove(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		s := newTestServer(t, newTestConfigWithAuthFile(t, databaseURL))
+		defer s.closeDatabases()
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin, false))
+		require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser, false))
+		require.Nil(t, s.userManager.AddUser("emma", "emma", user.RoleUser, false))
+		admin := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+
+		rr := request(t, s, "POST", "/v1/admin/reservations", `{"username":"ben", "topic":"mytopic", "everyone":"read-only"}`, admin)
+		require.Equal(t, 200, rr.Code)
+		rr = request(t, s, "POST", "/v1/admin/reservations", `{"username":"emma", "topic":"emmastopic", "everyone":"deny-all"}`, admin)
+		require.Equal(t, 200, rr.Code)
+
+		// Topic is already reserved by another user
+		rr = request(t, s, "POST", "/v1/admin/reservations", `{"username":"emma", "topic":"mytopic", "everyone":"deny-all"}`, admin)
+		require.Equal(t, 40902, toHTTPError(t, rr.Body.String()).Code)
+		rr = request(t, s, "POST", "/v1/admin/reservations", `{"username":"emma", "topic":"another", "everyone":"invalid"}`, admin)
+		require.Equal(t, 40025, toHTTPError(t, rr.Body.String()).Code)
+
+		// List for one and all users
+		rr = request(t, s, "GET", "/v1/admin/reservations?username=ben", "", admin)
+		require.Equal(t, 200, rr.Code)
+		reservations, _ := util.UnmarshalJSON[[]*apiAdminReservationResponse](io.NopCloser(rr.Body))
+		require.Len(t, *reservations, 1)
+		require.Equal(t, "mytopic", (*reservations)[0].Topic)
+		require.Equal(t, "read-only", (*reservations)[0].Everyone)
+
+		rr = request(t, s, "GET", "/v1/admin/reservations", "", admin)
+		require.Equal(t, 200, rr.Code)
+		reservations, _ = util.UnmarshalJSON[[]*apiAdminReservationResponse](io.NopCloser(rr.Body))
+		require.Len(t, *reservations, 2)
+
+		// Access control entries were created
+		require.Nil(t, s.userManager.Authorize(nil, "mytopic", user.PermissionRead))
+		require.Equal(t, user.ErrUnauthorized, s.userManager.Authorize(nil, "mytopic", user.PermissionWrite))
+
+		// Remove
+		rr = request(t, s, "DELETE", "/v1/admin/reservations", `{"username":"ben", "topic":"mytopic"}`, admin)
+		require.Equal(t, 200, rr.Code)
+		rr = request(t, s, "DELETE", "/v1/admin/reservations", `{"username":"ben", "topic":"mytopic"}`, admin)
+		require.Equal(t, 40405, toHTTPError(t, rr.Body.String()).Code)
+		has, err := s.userManager.HasReservation("ben", "mytopic")
+		require.Nil(t, err)
+		require.False(t, has)
+	})
+}
+
+func TestAdmin_Visitors(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		s := newTestServer(t, newTestConfigWithAuthFile(t, databaseURL))
+		defer s.closeDatabases()
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin, false))
+		require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser, false))
+		require.Nil(t, s.userManager.AddTier(&user.Tier{Code: "pro", MessageLimit: 123}))
+		require.Nil(t, s.userManager.ChangeTier("ben", "pro"))
+		require.Nil(t, s.userManager.AllowAccess(user.Everyone, "mytopic", user.PermissionReadWrite))
+
+		rr := request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+			"Authorization": util.BasicAuth("ben", "ben"),
+		})
+		require.Equal(t, 200, rr.Code)
+		rr = request(t, s, "PUT", "/mytopic", "hi", nil, func(r *http.Request) {
+			r.RemoteAddr = "1.2.3.4:1234"
+		})
+		require.Equal(t, 200, rr.Code)
+
+		rr = request(t, s, "GET", "/v1/admin/visitors", "", map[string]string{
+			"Authorization": util.BasicAuth("phil", "phil"),
+		})
+		require.Equal(t, 200, rr.Code)
+		visitors, _ := util.UnmarshalJSON[[]*apiAdminVisitorResponse](io.NopCloser(rr.Body))
+		var ben, anonymous *apiAdminVisitorResponse
+		for _, v := range *visitors {
+			if v.Username == "ben" {
+				ben = v
+			} else if v.IP == "1.2.3.4" {
+				anonymous = v
+			}
+		}
+		require.NotNil(t, ben)
+		require.Equal(t, "pro", ben.Tier)
+		require.Equal(t, "tier", ben.Limits.Basis)
+		require.Equal(t, int64(123), ben.Limits.Messages)
+		require.Equal(t, int64(1), ben.Stats.Messages)
+		require.NotNil(t, anonymous)
+		require.Equal(t, "ip:1.2.3.4", anonymous.ID)
+		require.Equal(t, "ip", anonymous.Limits.Basis)
+		require.Equal(t, int64(1), anonymous.Stats.Messages)
+	})
+}
+
+func TestAdmin_NonAdminAttempt(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		s := newTestServer(t, newTestConfigWithAuthFile(t, databaseURL))
+		defer s.closeDatabases()
+		require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser, false))
+		for _, path := range []string{"/v1/admin/tiers", "/v1/admin/tokens?username=ben", "/v1/admin/reservations", "/v1/admin/visitors"} {
+			rr := request(t, s, "GET", path, "", map[string]string{
+				"Authorization": util.BasicAuth("ben", "ben"),
+			})
+			require.Equal(t, 401, rr.Code)
+			rr = request(t, s, "GET", path, "", nil)
+			require.Equal(t, 401, rr.Code)
+		}
+		rr := request(t, s, "POST", "/v1/admin/tiers", `{"code":"pro"}`, map[string]string{
+			"Authorization": util.BasicAuth("ben", "ben"),
+		})
+		require.Equal(t, 401, rr.Code)
+	})
+}
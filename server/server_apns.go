@@ -0,0 +1,366 @@
+//go:build !nofirebase
+
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	"heckel.io/ntfy/v2/apns"
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/model"
+	"heckel.io/ntfy/v2/user"
+)
+
+const (
+	// APNSAvailable is a constant used to indicate that direct APNs support is available. Since it shares the
+	// message format with Firebase, it is disabled along with Firebase with the 'nofirebase' build tag.
+	APNSAvailable = true
+
+	apnsPayloadLimit            = 4096             // Max. size of the JSON payload of a regular (non-VoIP) notification
+	apnsAuthTokenRefreshAfter   = 30 * time.Minute // Apple rejects tokens older than 1 hour, and refreshing more than every 20 minutes
+	apnsTopicSubscribeLimit     = 50
+	apnsRequestTimeout          = 10 * time.Second
+	apnsReasonBadDeviceToken    = "BadDeviceToken"
+	apnsReasonUnregistered      = "Unregistered"
+	apnsReasonTokenNotForTopic  = "DeviceTokenNotForTopic"
+	apnsReasonExpiredAuthToken  = "ExpiredProviderToken"
+	apnsReasonInvalidAuthToken  = "InvalidProviderToken"
+	apnsReasonTooManyAuthTokens = "TooManyProviderTokenUpdates"
+)
+
+var (
+	errAPNSDeviceTokenInvalid = errors.New("APNs device token is invalid or no longer registered")
+	errAPNSKeyInvalid         = errors.New("invalid APNs auth key, expected a PEM-encoded P-256 private key (.p8 file)")
+
+	// apnsDeviceTokenRegex matches APNs device tokens, which are hex-encoded. They are currently
+	// 32 bytes long, but Apple says that their length may change in the future.
+	apnsDeviceTokenRegex = regexp.MustCompile(`^[0-9a-fA-F]{32,200}$`)
+)
+
+// apnsClient formats messages and sends them directly to the Apple Push Notification service (APNs), to all
+// iOS devices that registered for the message topic. The notifications are identical to the ones sent to iOS
+// devices via Firebase, see toFirebaseMessage. The HTTP/2 implementation is in apnsSenderImpl, to make it testable.
+type apnsClient struct {
+	sender apnsSender
+	store  *apns.Store
+	auther user.Auther
+}
+
+// apnsNotification is a notification for a single device, as it is sent to APNs
+type apnsNotification struct {
+	Headers map[string]string // apns-push-type, apns-priority, ...
+	Payload []byte            // JSON payload, including the "aps" dictionary
+}
+
+func newAPNSClient(sender apnsSender, store *apns.Store, auther user.Auther) *apnsClient {
+	return &apnsClient{
+		sender: sender,
+		store:  store,
+		auther: auther,
+	}
+}
+
+// Send sends the message to all devices that registered for the message topic. Devices whose token
+// is no longer valid are removed from the store.
+func (c *apnsClient) Send(v *visitor, m *model.Message) error {
+	devices, err := c.store.DevicesForTopic(m.Topic)
+	if err != nil {
+		return err
+	} else if len(devices) == 0 {
+		return nil
+	}
+	n, err := toAPNSNotification(m, c.auther)
+	if err != nil {
+		return err
+	} else if n == nil {
+		return nil // Event is not sent to iOS devices
+	}
+	ev := logvm(v, m).Tag(tagAPNS)
+	if ev.IsTrace() {
+		ev.Field("apns_payload", string(n.Payload)).Trace("APNs notification")
+	}
+	ev.Debug("Sending APNs notification to %d device(s)", len(devices))
+	var lastErr error
+	for _, device := range devices {
+		if err := c.sender.Send(device.Token, n); errors.Is(err, errAPNSDeviceTokenInvalid) {
+			logvm(v, m).Tag(tagAPNS).With(device).Debug("APNs device token no longer valid, removing device")
+			if err := c.store.RemoveDevice(device.Token); err != nil {
+				logvm(v, m).Tag(tagAPNS).With(device).Err(err).Warn("Unable to remove APNs device")
+			}
+		} else if err != nil {
+			logvm(v, m).Tag(tagAPNS).With(device).Err(err).Debug("Unable to send APNs notification")
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// RemoveDevicesByUserID removes all devices of the given user, e.g. when the user account is deleted
+func (c *apnsClient) RemoveDevicesByUserID(userID string) error {
+	return c.store.RemoveDevicesByUserID(userID)
+}
+
+// Close closes the device store
+func (c *apnsClient) Close() error {
+	return c.store.Close()
+}
+
+// toAPNSNotification converts a message to an APNs notification. It reuses the APNs config that is sent to iOS
+// devices via Firebase (see createAPNSAlertConfig and createAPNSBackgroundConfig), so that the iOS app can process
+// both in the same way. It returns nil if the message event is not sent to iOS devices.
+func toAPNSNotification(m *model.Message, auther user.Auther) (*apnsNotification, error) {
+	fbm, err := toFirebaseMessage(m, auther)
+	if err != nil {
+		return nil, err
+	} else if fbm.APNS == nil || fbm.APNS.Payload == nil {
+		return nil, nil
+	}
+	payload, err := json.Marshal(maybeTruncateAPNSPayload(fbm.APNS.Payload))
+	if err != nil {
+		return nil, err
+	}
+	return &apnsNotification{
+		Headers: fbm.APNS.Headers,
+		Payload: payload,
+	}, nil
+}
+
+// maybeTruncateAPNSPayload performs best-effort truncation of the "message" field in the APNs payload,
+// since APNs rejects notifications with a payload larger than 4 KB (see maybeTruncateFCMMessage).
+func maybeTruncateAPNSPayload(p *messaging.APNSPayload) *messaging.APNSPayload {
+	s, err := json.Marshal(p)
+	if err != nil || len(s) <= apnsPayloadLimit {
+		return p
+	}
+	over := len(s) - apnsPayloadLimit + 16 // = len("truncated":"1",)
+	message, ok := p.CustomData["message"].(string)
+	if ok && len(message) > over {
+		p.CustomData["truncated"] = "1"
+		p.CustomData["message"] = message[:len(message)-over]
+	}
+	return p
+}
+
+// apnsSender is an interface that represents a client that can send notifications to APNs.
+// In tests, this can be implemented with a mock.
+type apnsSender interface {
+	// Send sends a notification to the given device, or returns an error. It returns errAPNSDeviceTokenInvalid
+	// if the device token is invalid or no longer registered, in which case the device should be removed.
+	Send(deviceToken string, n *apnsNotification) error
+}
+
+// apnsSenderImpl is an apnsSender that talks to APNs via HTTP/2, using token-based authentication
+// with a signing key (.p8 file) from the Apple Developer account.
+//
+// See https://developer.apple.com/documentation/usernotifications/sending-notification-requests-to-apns
+type apnsSenderImpl struct {
+	baseURL     string // e.g. https://api.push.apple.com
+	topic       string // Bundle ID of the iOS app
+	keyID       string
+	teamID      string
+	key         *ecdsa.PrivateKey
+	client      *http.Client
+	token       string
+	tokenIssued time.Time
+	mu          sync.Mutex
+}
+
+func newAPNSSender(conf *Config) (apnsSender, error) {
+	b, err := os.ReadFile(conf.APNSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseAPNSKey(b)
+	if err != nil {
+		return nil, err
+	}
+	return &apnsSenderImpl{
+		baseURL: strings.TrimSuffix(conf.APNSBaseURL, "/"),
+		topic:   conf.APNSTopic,
+		keyID:   conf.APNSKeyID,
+		teamID:  conf.APNSTeamID,
+		key:     key,
+		client: &http.Client{
+			Timeout: apnsRequestTimeout,
+			Transport: &http.Transport{
+				ForceAttemptHTTP2: true, // APNs only supports HTTP/2
+			},
+		},
+	}, nil
+}
+
+// parseAPNSKey parses the PEM-encoded PKCS #8 P-256 private key, as it is contained in the .p8 file
+func parseAPNSKey(b []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errAPNSKeyInvalid
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errAPNSKeyInvalid, err.Error())
+	}
+	ecdsaKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok || ecdsaKey.Curve != elliptic.P256() {
+		return nil, errAPNSKeyInvalid
+	}
+	return ecdsaKey, nil
+}
+
+func (c *apnsSenderImpl) Send(deviceToken string, n *apnsNotification) error {
+	token, err := c.authToken()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/3/device/%s", c.baseURL, deviceToken), bytes.NewReader(n.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("apns-topic", c.topic)
+	req.Header.Set("apns-push-type", "alert")
+	for k, v := range n.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	var response struct {
+		Reason string `json:"reason"`
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, jsonBodyBytesLimit))
+	_ = json.Unmarshal(body, &response)
+	switch response.Reason {
+	case apnsReasonBadDeviceToken, apnsReasonUnregistered, apnsReasonTokenNotForTopic:
+		return errAPNSDeviceTokenInvalid
+	case apnsReasonExpiredAuthToken, apnsReasonInvalidAuthToken, apnsReasonTooManyAuthTokens:
+		c.resetAuthToken()
+	}
+	return fmt.Errorf("APNs responded with HTTP %d, reason: %s", resp.StatusCode, response.Reason)
+}
+
+// authToken returns the JSON Web Token used to authenticate with APNs. The token is signed with ES256, and is
+// reused until it is about to expire, since Apple rejects requests if the token is refreshed too often.
+func (c *apnsSenderImpl) authToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Since(c.tokenIssued) < apnsAuthTokenRefreshAfter {
+		return c.token, nil
+	}
+	now := time.Now()
+	token, err := signAPNSAuthToken(c.key, c.keyID, c.teamID, now)
+	if err != nil {
+		return "", err
+	}
+	c.token, c.tokenIssued = token, now
+	return token, nil
+}
+
+func (c *apnsSenderImpl) resetAuthToken() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = ""
+}
+
+// signAPNSAuthToken creates a JSON Web Token, signed with ES256 using the given key, as required by APNs.
+// The signature is the concatenation of the 32-byte big-endian R and S values, see RFC 7518, section 3.4.
+func signAPNSAuthToken(key *ecdsa.PrivateKey, keyID, teamID string, issuedAt time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "ES256", "kid": keyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]any{"iss": teamID, "iat": issuedAt.Unix()})
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func (s *Server) handleAPNSUpdate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiAPNSUpdateDeviceRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil || !apnsDeviceTokenRegex.MatchString(req.Token) {
+		return errHTTPBadRequestAPNSDeviceInvalid
+	} else if len(req.Topics) > apnsTopicSubscribeLimit {
+		return errHTTPBadRequestAPNSTopicCountTooHigh
+	}
+	topics, err := s.topicsFromIDs(v, req.Topics...)
+	if err != nil {
+		return err
+	}
+	if s.userManager != nil {
+		u := v.User()
+		for _, t := range topics {
+			if err := s.userManager.Authorize(u, t.ID, user.PermissionRead); err != nil {
+				logvr(v, r).With(t).Err(err).Debug("Access to topic %s not authorized", t.ID)
+				return errHTTPForbidden.With(t)
+			}
+		}
+	}
+	if err := s.apns.store.UpsertDevice(strings.ToLower(req.Token), v.MaybeUserID(), v.IP(), req.Topics); errors.Is(err, apns.ErrAPNSTooManyDevices) {
+		return errHTTPTooManyRequestsLimitAPNSDevices
+	} else if err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+func (s *Server) handleAPNSDelete(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	req, err := readJSONWithLimit[apiAPNSUpdateDeviceRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil || !apnsDeviceTokenRegex.MatchString(req.Token) {
+		return errHTTPBadRequestAPNSDeviceInvalid
+	}
+	if err := s.apns.store.RemoveDevice(strings.ToLower(req.Token)); err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+func (s *Server) sendToAPNS(v *visitor, m *model.Message) {
+	if err := s.apns.Send(v, m); err != nil {
+		logvm(v, m).Tag(tagAPNS).Err(err).Warn("Unable to publish to APNs: %v", err.Error())
+		minc(metricAPNSPublishedFailure)
+		return
+	}
+	minc(metricAPNSPublishedSuccess)
+}
+
+func (s *Server) pruneAPNSDevices() {
+	if s.apns == nil {
+		return
+	}
+	if err := s.apns.store.RemoveExpiredDevices(s.config.APNSExpiryDuration); err != nil {
+		log.Tag(tagAPNS).Err(err).Warn("Unable to prune APNs devices")
+	}
+}
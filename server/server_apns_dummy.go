@@ -0,0 +1,65 @@
+//go:build nofirebase
+
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"heckel.io/ntfy/v2/apns"
+	"heckel.io/ntfy/v2/model"
+	"heckel.io/ntfy/v2/user"
+)
+
+const (
+	// APNSAvailable is a constant used to indicate that direct APNs support is available. Since it shares the
+	// message format with Firebase, it is disabled along with Firebase with the 'nofirebase' build tag.
+	APNSAvailable = false
+)
+
+var (
+	errAPNSNotAvailable = errors.New("APNs not available")
+)
+
+type apnsClient struct {
+}
+
+func (c *apnsClient) Send(v *visitor, m *model.Message) error {
+	return errAPNSNotAvailable
+}
+
+func (c *apnsClient) RemoveDevicesByUserID(userID string) error {
+	return errAPNSNotAvailable
+}
+
+func (c *apnsClient) Close() error {
+	return nil
+}
+
+type apnsSender interface {
+	Send(deviceToken string, payload []byte) error
+}
+
+func newAPNSClient(sender apnsSender, store *apns.Store, auther user.Auther) *apnsClient {
+	return nil
+}
+
+func newAPNSSender(conf *Config) (apnsSender, error) {
+	return nil, errAPNSNotAvailable
+}
+
+func (s *Server) handleAPNSUpdate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	return errHTTPNotFound
+}
+
+func (s *Server) handleAPNSDelete(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	return errHTTPNotFound
+}
+
+func (s *Server) sendToAPNS(v *visitor, m *model.Message) {
+	// Nothing to see here
+}
+
+func (s *Server) pruneAPNSDevices() {
+	// Nothing to see here
+}
@@ -0,0 +1,436 @@
+//go:build !nofirebase
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/model"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+const (
+	testAPNSDeviceToken = "740f4707bebcf74f9b7c25d48e3358945f6aa01da5ddb387462c7eaf61bb78ad"
+	testAPNSKeyID       = "ABC123DEFG"
+	testAPNSTeamID      = "DEF123GHIJ"
+	testAPNSTopic       = "com.example.ntfy"
+)
+
+type testAPNSRequest struct {
+	Proto   int
+	Path    string
+	Headers http.Header
+	Body    string
+}
+
+type testAPNSGateway struct {
+	server   *httptest.Server
+	requests []*testAPNSRequest
+	status   int
+	reason   string
+	mu       sync.Mutex
+}
+
+func newTestAPNSGateway(t *testing.T) *testAPNSGateway {
+	g := &testAPNSGateway{status: http.StatusOK}
+	g.server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.Nil(t, err)
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		g.requests = append(g.requests, &testAPNSRequest{
+			Proto:   r.ProtoMajor,
+			Path:    r.URL.Path,
+			Headers: r.Header,
+			Body:    string(body),
+		})
+		w.WriteHeader(g.status)
+		if g.reason != "" {
+			_, _ = w.Write([]byte(`{"reason":"` + g.reason + `"}`))
+		}
+	}))
+	g.server.EnableHTTP2 = true
+	g.server.StartTLS()
+	t.Cleanup(g.server.Close)
+	return g
+}
+
+func (g *testAPNSGateway) Requests() []*testAPNSRequest {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.requests
+}
+
+func (g *testAPNSGateway) Respond(status int, reason string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.status, g.reason = status, reason
+}
+
+func TestServer_APNS_Success(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		gateway := newTestAPNSGateway(t)
+		conf, key := newTestConfigWithAPNS(t, databaseURL, gateway)
+		s := newTestAPNSServer(t, conf, gateway)
+
+		response := request(t, s, "POST", "/v1/apns", `{"token":"`+strings.ToUpper(testAPNSDeviceToken)+`","topics":["mytopic"]}`, nil)
+		require.Equal(t, 200, response.Code)
+		require.Equal(t, `{"success":true}`+"\n", response.Body.String())
+
+		response = request(t, s, "PUT", "/mytopic", "This is a test", map[string]string{
+			"Title": "Test title",
+			"Tags":  "warning",
+		})
+		require.Equal(t, 200, response.Code)
+		m := toMessage(t, response.Body.String())
+
+		waitFor(t, func() bool {
+			return len(gateway.Requests()) == 1
+		})
+		r := gateway.Requests()[0]
+		require.Equal(t, 2, r.Proto)
+		require.Equal(t, "/3/device/"+testAPNSDeviceToken, r.Path)
+		require.Equal(t, testAPNSTopic, r.Headers.Get("apns-topic"))
+		require.Equal(t, "alert", r.Headers.Get("apns-push-type"))
+		require.True(t, strings.HasPrefix(r.Headers.Get("Authorization"), "bearer "))
+		requireValidAPNSAuthToken(t, &key.PublicKey, strings.TrimPrefix(r.Headers.Get("Authorization"), "bearer "))
+
+		var payload map[string]any
+		require.Nil(t, json.Unmarshal([]byte(r.Body), &payload))
+		require.Equal(t, map[string]any{
+			"alert": map[string]any{
+				"title": "Test title",
+				"body":  "This is a test",
+			},
+			"mutable-content": float64(1),
+		}, payload["aps"])
+		require.Equal(t, m.ID, payload["id"])
+		require.Equal(t, "mytopic", payload["topic"])
+		require.Equal(t, "message", payload["event"])
+		require.Equal(t, "This is a test", payload["message"])
+		require.Equal(t, "warning", payload["tags"])
+
+		// Messages to other topics are not sent to the device
+		response = request(t, s, "PUT", "/othertopic", "This is another test", nil)
+		require.Equal(t, 200, response.Code)
+		time.Sleep(100 * time.Millisecond)
+		require.Len(t, gateway.Requests(), 1)
+	})
+}
+
+func TestServer_APNS_DeleteMessage_Background(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		gateway := newTestAPNSGateway(t)
+		conf, _ := newTestConfigWithAPNS(t, databaseURL, gateway)
+		s := newTestAPNSServer(t, conf, gateway)
+
+		response := request(t, s, "POST", "/v1/apns", `{"token":"`+testAPNSDeviceToken+`","topics":["mytopic"]}`, nil)
+		require.Equal(t, 200, response.Code)
+
+		response = request(t, s, "PUT", "/mytopic/seq1", "This is a test", nil)
+		require.Equal(t, 200, response.Code)
+		response = request(t, s, "DELETE", "/mytopic/seq1", "", nil)
+		require.Equal(t, 200, response.Code)
+
+		waitFor(t, func() bool {
+			return len(gateway.Requests()) == 2
+		})
+		var r *testAPNSRequest
+		for _, req := range gateway.Requests() {
+			if strings.Contains(req.Body, `"message_delete"`) {
+				r = req
+			}
+		}
+		require.NotNil(t, r)
+		require.Equal(t, "background", r.Headers.Get("apns-push-type"))
+		require.Equal(t, "5", r.Headers.Get("apns-priority"))
+		require.Contains(t, r.Body, `"aps":{"content-available":1}`)
+		require.Contains(t, r.Body, `"sequence_id":"seq1"`)
+	})
+}
+
+func TestServer_APNS_Unregistered(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		gateway := newTestAPNSGateway(t)
+		gateway.Respond(http.StatusGone, apnsReasonUnregistered)
+		conf, _ := newTestConfigWithAPNS(t, databaseURL, gateway)
+		s := newTestAPNSServer(t, conf, gateway)
+
+		response := request(t, s, "POST", "/v1/apns", `{"token":"`+testAPNSDeviceToken+`","topics":["mytopic"]}`, nil)
+		require.Equal(t, 200, response.Code)
+		requireAPNSDeviceCount(t, s, "mytopic", 1)
+
+		response = request(t, s, "PUT", "/mytopic", "This is a test", nil)
+		require.Equal(t, 200, response.Code)
+
+		// Device is removed, since APNs says it is no longer registered
+		waitFor(t, func() bool {
+			devices, err := s.apns.store.DevicesForTopic("mytopic")
+			require.Nil(t, err)
+			return len(devices) == 0
+		})
+		require.Len(t, gateway.Requests(), 1)
+	})
+}
+
+func TestServer_APNS_Error_KeepsDevice(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		gateway := newTestAPNSGateway(t)
+		gateway.Respond(http.StatusForbidden, apnsReasonExpiredAuthToken)
+		conf, _ := newTestConfigWithAPNS(t, databaseURL, gateway)
+		s := newTestAPNSServer(t, conf, gateway)
+		sender := s.apns.sender.(*apnsSenderImpl)
+
+		response := request(t, s, "POST", "/v1/apns", `{"token":"`+testAPNSDeviceToken+`","topics":["mytopic"]}`, nil)
+		require.Equal(t, 200, response.Code)
+
+		response = request(t, s, "PUT", "/mytopic", "This is a test", nil)
+		require.Equal(t, 200, response.Code)
+
+		// Device is kept, and the auth token is discarded, so that a new one is created for the next request
+		waitFor(t, func() bool {
+			sender.mu.Lock()
+			defer sender.mu.Unlock()
+			return len(gateway.Requests()) == 1 && sender.token == ""
+		})
+		requireAPNSDeviceCount(t, s, "mytopic", 1)
+	})
+}
+
+func TestServer_APNS_UpdateAndDelete(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		gateway := newTestAPNSGateway(t)
+		conf, _ := newTestConfigWithAPNS(t, databaseURL, gateway)
+		s := newTestAPNSServer(t, conf, gateway)
+
+		response := request(t, s, "POST", "/v1/apns", `{"token":"`+testAPNSDeviceToken+`","topics":["mytopic","othertopic"]}`, nil)
+		require.Equal(t, 200, response.Code)
+		requireAPNSDeviceCount(t, s, "mytopic", 1)
+		requireAPNSDeviceCount(t, s, "othertopic", 1)
+
+		response = request(t, s, "POST", "/v1/apns", `{"token":"`+testAPNSDeviceToken+`","topics":["othertopic"]}`, nil)
+		require.Equal(t, 200, response.Code)
+		requireAPNSDeviceCount(t, s, "mytopic", 0)
+		requireAPNSDeviceCount(t, s, "othertopic", 1)
+
+		response = request(t, s, "DELETE", "/v1/apns", `{"token":"`+testAPNSDeviceToken+`"}`, nil)
+		require.Equal(t, 200, response.Code)
+		requireAPNSDeviceCount(t, s, "othertopic", 0)
+	})
+}
+
+func TestServer_APNS_InvalidRequests(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		gateway := newTestAPNSGateway(t)
+		conf, _ := newTestConfigWithAPNS(t, databaseURL, gateway)
+		s := newTestAPNSServer(t, conf, gateway)
+
+		response := request(t, s, "POST", "/v1/apns", `{"token":"not-a-token","topics":["mytopic"]}`, nil)
+		require.Equal(t, 40069, toHTTPError(t, response.Body.String()).Code)
+
+		response = request(t, s, "POST", "/v1/apns", `{"topics":["mytopic"]}`, nil)
+		require.Equal(t, 40069, toHTTPError(t, response.Body.String()).Code)
+
+		topics := make([]string, apnsTopicSubscribeLimit+1)
+		for i := range topics {
+			topics[i] = util.RandomString(10)
+		}
+		topicsJSON, _ := json.Marshal(topics)
+		response = request(t, s, "POST", "/v1/apns", `{"token":"`+testAPNSDeviceToken+`","topics":`+string(topicsJSON)+`}`, nil)
+		require.Equal(t, 40070, toHTTPError(t, response.Body.String()).Code)
+
+		response = request(t, s, "DELETE", "/v1/apns", `{"token":""}`, nil)
+		require.Equal(t, 40069, toHTTPError(t, response.Body.String()).Code)
+	})
+}
+
+func TestServer_APNS_TopicNotAllowed(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		gateway := newTestAPNSGateway(t)
+		conf, _ := newTestConfigWithAPNS(t, databaseURL, gateway)
+		conf = configureAuth(t, conf)
+		conf.AuthDefault = user.PermissionDenyAll
+		s := newTestAPNSServer(t, conf, gateway)
+
+		require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser, false))
+		require.Nil(t, s.userManager.AllowAccess("ben", "mytopic", user.PermissionRead))
+
+		response := request(t, s, "POST", "/v1/apns", `{"token":"`+testAPNSDeviceToken+`","topics":["mytopic"]}`, nil)
+		require.Equal(t, 403, response.Code)
+		requireAPNSDeviceCount(t, s, "mytopic", 0)
+
+		response = request(t, s, "POST", "/v1/apns", `{"token":"`+testAPNSDeviceToken+`","topics":["mytopic"]}`, map[string]string{
+			"Authorization": util.BasicAuth("ben", "ben"),
+		})
+		require.Equal(t, 200, response.Code)
+		requireAPNSDeviceCount(t, s, "mytopic", 1)
+
+		// Devices are removed when the user is deleted
+		response = request(t, s, "DELETE", "/v1/account", `{"password":"ben"}`, map[string]string{
+			"Authorization": util.BasicAuth("ben", "ben"),
+		})
+		require.Equal(t, 200, response.Code)
+		requireAPNSDeviceCount(t, s, "mytopic", 0)
+	})
+}
+
+func TestServer_APNS_Disabled(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		s := newTestServer(t, newTestConfig(t, databaseURL))
+		response := request(t, s, "POST", "/v1/apns", `{"token":"`+testAPNSDeviceToken+`","topics":["mytopic"]}`, nil)
+		require.Equal(t, 404, response.Code)
+	})
+}
+
+func TestToAPNSNotification_Keepalive(t *testing.T) {
+	n, err := toAPNSNotification(model.NewKeepaliveMessage("mytopic"), nil)
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{
+		"apns-push-type": "background",
+		"apns-priority":  "5",
+	}, n.Headers)
+	require.Contains(t, string(n.Payload), `"aps":{"content-available":1}`)
+	require.Contains(t, string(n.Payload), `"event":"keepalive"`)
+}
+
+func TestToAPNSNotification_PollRequest(t *testing.T) {
+	m := model.NewDefaultMessage("mytopic", "This is a secret")
+	n, err := toAPNSNotification(m, &testAuther{Allow: false})
+	require.Nil(t, err)
+	require.Nil(t, n.Headers)
+	require.NotContains(t, string(n.Payload), "This is a secret")
+	require.Contains(t, string(n.Payload), `"event":"poll_request"`)
+	require.Contains(t, string(n.Payload), `"poll_id":"`+m.ID+`"`)
+}
+
+func TestMaybeTruncateAPNSPayload(t *testing.T) {
+	m := model.NewDefaultMessage("mytopic", strings.Repeat("a", 4096))
+	n, err := toAPNSNotification(m, nil)
+	require.Nil(t, err)
+	require.LessOrEqual(t, len(n.Payload), apnsPayloadLimit)
+	require.Contains(t, string(n.Payload), `"truncated":"1"`)
+}
+
+func TestParseAPNSKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	parsed, err := parseAPNSKey(testAPNSKeyPEM(t, key))
+	require.Nil(t, err)
+	require.True(t, key.Equal(parsed))
+
+	_, err = parseAPNSKey([]byte("not a key"))
+	require.ErrorIs(t, err, errAPNSKeyInvalid)
+
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.Nil(t, err)
+	_, err = parseAPNSKey(testAPNSKeyPEM(t, p384Key))
+	require.ErrorIs(t, err, errAPNSKeyInvalid)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	_, err = parseAPNSKey(testAPNSKeyPEM(t, rsaKey))
+	require.ErrorIs(t, err, errAPNSKeyInvalid)
+}
+
+func TestSignAPNSAuthToken(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	token, err := signAPNSAuthToken(key, testAPNSKeyID, testAPNSTeamID, time.Unix(1700000000, 0))
+	require.Nil(t, err)
+	claims := requireValidAPNSAuthToken(t, &key.PublicKey, token)
+	require.Equal(t, float64(1700000000), claims["iat"])
+}
+
+func TestAPNSSender_AuthTokenReused(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	sender := &apnsSenderImpl{keyID: testAPNSKeyID, teamID: testAPNSTeamID, key: key}
+	token1, err := sender.authToken()
+	require.Nil(t, err)
+	token2, err := sender.authToken()
+	require.Nil(t, err)
+	require.Equal(t, token1, token2)
+
+	// Token is refreshed once it is about to expire
+	sender.tokenIssued = time.Now().Add(-apnsAuthTokenRefreshAfter)
+	token3, err := sender.authToken()
+	require.Nil(t, err)
+	require.NotEqual(t, token1, token3)
+}
+
+func newTestConfigWithAPNS(t *testing.T, databaseURL string, gateway *testAPNSGateway) (*Config, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	keyFile := filepath.Join(t.TempDir(), "AuthKey.p8")
+	require.Nil(t, os.WriteFile(keyFile, testAPNSKeyPEM(t, key), 0600))
+	conf := newTestConfig(t, databaseURL)
+	if conf.DatabaseURL == "" {
+		conf.APNSFile = filepath.Join(t.TempDir(), "apns.db")
+	}
+	conf.APNSKeyFile = keyFile
+	conf.APNSKeyID = testAPNSKeyID
+	conf.APNSTeamID = testAPNSTeamID
+	conf.APNSTopic = testAPNSTopic
+	conf.APNSBaseURL = gateway.server.URL
+	return conf, key
+}
+
+// newTestAPNSServer creates a test server, and makes the APNs sender trust the TLS certificate of the gateway
+func newTestAPNSServer(t *testing.T, conf *Config, gateway *testAPNSGateway) *Server {
+	s := newTestServer(t, conf)
+	s.apns.sender.(*apnsSenderImpl).client = gateway.server.Client()
+	return s
+}
+
+func testAPNSKeyPEM(t *testing.T, key any) []byte {
+	b, err := x509.MarshalPKCS8PrivateKey(key)
+	require.Nil(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b})
+}
+
+func requireAPNSDeviceCount(t *testing.T, s *Server, topic string, expectedLength int) {
+	devices, err := s.apns.store.DevicesForTopic(topic)
+	require.Nil(t, err)
+	require.Len(t, devices, expectedLength)
+}
+
+func requireValidAPNSAuthToken(t *testing.T, key *ecdsa.PublicKey, token string) map[string]any {
+	parts := strings.Split(token, ".")
+	require.Len(t, parts, 3)
+	var header, claims map[string]any
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	require.Nil(t, err)
+	require.Nil(t, json.Unmarshal(headerJSON, &header))
+	require.Equal(t, map[string]any{"alg": "ES256", "kid": testAPNSKeyID}, header)
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	require.Nil(t, err)
+	require.Nil(t, json.Unmarshal(claimsJSON, &claims))
+	require.Equal(t, testAPNSTeamID, claims["iss"])
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	require.Nil(t, err)
+	require.Len(t, signature, 64)
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	require.True(t, ecdsa.Verify(key, digest[:], r, s))
+	return claims
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+// handleAuditGet returns the audit log entries matching the filters given as query parameters,
+// newest first. The "since" and "until" parameters may be Unix timestamps or durations (e.g. "24h"),
+// which are interpreted relative to now.
+func (s *Server) handleAuditGet(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	filter := &user.AuditFilter{
+		Actor:  readQueryParam(r, "actor"),
+		Action: user.AuditAction(readQueryParam(r, "action")),
+		Target: readQueryParam(r, "target"),
+	}
+	var err error
+	if filter.Since, err = parseAuditTime(readQueryParam(r, "since")); err != nil {
+		return errHTTPBadRequestAuditFilterInvalid.Wrap("invalid since parameter")
+	}
+	if filter.Until, err = parseAuditTime(readQueryParam(r, "until")); err != nil {
+		return errHTTPBadRequestAuditFilterInvalid.Wrap("invalid until parameter")
+	}
+	if limit := readQueryParam(r, "limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit <= 0 {
+			return errHTTPBadRequestAuditFilterInvalid.Wrap("invalid limit parameter")
+		}
+	}
+	entries, err := s.userManager.AuditEntries(filter)
+	if err != nil {
+		return err
+	}
+	response := make([]*apiAuditEntryResponse, len(entries))
+	for i, e := range entries {
+		response[i] = &apiAuditEntryResponse{
+			ID:     e.ID,
+			Time:   e.Time.Unix(),
+			Actor:  e.Actor,
+			IP:     e.IP,
+			Action: string(e.Action),
+			Target: e.Target,
+		}
+		if e.Before != "" {
+			response[i].Before = json.RawMessage(e.Before)
+		}
+		if e.After != "" {
+			response[i].After = json.RawMessage(e.After)
+		}
+	}
+	return s.writeJSON(w, response)
+}
+
+// audit records a change in the audit log, using the visitor's user and IP address as actor.
+// Errors are only logged, since the change itself has already been made at this point.
+func (s *Server) audit(v *visitor, action user.AuditAction, target string, before, after any) {
+	actor := user.Everyone
+	if u := v.User(); u != nil {
+		actor = u.Name
+	}
+	if err := s.userManager.AddAuditEntry(actor, v.IP().String(), action, target, before, after); err != nil {
+		logv(v).Err(err).Warn("Cannot write audit log entry for action %s on %s", action, target)
+	}
+}
+
+func parseAuditTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	} else if timestamp, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(timestamp, 0), nil
+	}
+	d, err := util.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Now().Add(-d), nil
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestAudit_AdminChanges(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		s := newTestServer(t, newTestConfigWithAuthFile(t, databaseURL))
+		defer s.closeDatabases()
+
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin, false))
+		admin := map[string]string{
+			"Authorization": util.BasicAuth("phil", "phil"),
+		}
+
+		// Make some changes via the admin API
+		rr := request(t, s, "POST", "/v1/users", `{"username": "ben", "password":"ben"}`, admin)
+		require.Equal(t, 200, rr.Code)
+		rr = request(t, s, "POST", "/v1/users/access", `{"username": "ben", "topic":"prod-alerts", "permission":"ro"}`, admin)
+		require.Equal(t, 200, rr.Code)
+		rr = request(t, s, "POST", "/v1/users/access", `{"username": "ben", "topic":"prod-alerts", "permission":"rw"}`, admin)
+		require.Equal(t, 200, rr.Code)
+		rr = request(t, s, "DELETE", "/v1/users/access", `{"username": "ben", "topic":"prod-alerts"}`, admin)
+		require.Equal(t, 200, rr.Code)
+
+		// Who granted ben write access to prod-alerts?
+		rr = request(t, s, "GET", "/v1/audit?target=ben&action=access_allow", "", admin)
+		require.Equal(t, 200, rr.Code)
+		var entries []*apiAuditEntryResponse
+		require.Nil(t, json.NewDecoder(rr.Body).Decode(&entries))
+		require.Len(t, entries, 2)
+		require.Equal(t, "phil", entries[0].Actor)
+		require.Equal(t, "9.9.9.9", entries[0].IP)
+		require.Equal(t, "access_allow", entries[0].Action)
+		require.Equal(t, "ben", entries[0].Target)
+		require.JSONEq(t, `[{"topic":"prod-alerts","permission":"read-only"}]`, string(entries[0].Before))
+		require.JSONEq(t, `{"topic":"prod-alerts","permission":"read-write"}`, string(entries[0].After))
+		require.Nil(t, entries[1].Before)
+
+		// All changes, newest first
+		rr = request(t, s, "GET", "/v1/audit", "", admin)
+		require.Equal(t, 200, rr.Code)
+		entries = nil
+		require.Nil(t, json.NewDecoder(rr.Body).Decode(&entries))
+		require.Len(t, entries, 4)
+		require.Equal(t, "access_reset", entries[0].Action)
+		require.JSONEq(t, `[{"topic":"prod-alerts","permission":"read-write"}]`, string(entries[0].Before))
+		require.Nil(t, entries[0].After)
+		require.Equal(t, "user_add", entries[3].Action)
+		require.JSONEq(t, `{"role":"user"}`, string(entries[3].After))
+
+		// Limit and time filters
+		rr = request(t, s, "GET", "/v1/audit?limit=1", "", admin)
+		require.Equal(t, 200, rr.Code)
+		require.Nil(t, json.NewDecoder(rr.Body).Decode(&entries))
+		require.Len(t, entries, 1)
+		rr = request(t, s, "GET", "/v1/audit?since=1h", "", admin)
+		require.Equal(t, 200, rr.Code)
+		require.Nil(t, json.NewDecoder(rr.Body).Decode(&entries))
+		require.Len(t, entries, 4)
+		rr = request(t, s, "GET", "/v1/audit?until=1h", "", admin)
+		require.Equal(t, 200, rr.Code)
+		require.Nil(t, json.NewDecoder(rr.Body).Decode(&entries))
+		require.Len(t, entries, 0)
+
+		// Invalid filters
+		rr = request(t, s, "GET", "/v1/audit?limit=abc", "", admin)
+		require.Equal(t, 400, rr.Code)
+		require.Equal(t, 40063, toHTTPError(t, rr.Body.String()).Code)
+		rr = request(t, s, "GET", "/v1/audit?since=yesterday", "", admin)
+		require.Equal(t, 400, rr.Code)
+	})
+}
+
+func TestAudit_AccountChanges(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		conf := newTestConfigWithAuthFile(t, databaseURL)
+		conf.EnableSignup = true
+		s := newTestServer(t, conf)
+		defer s.closeDatabases()
+
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin, false))
+
+		// Sign up and create a token
+		rr := request(t, s, "POST", "/v1/account", `{"username":"ben", "password":"ben"}`, nil)
+		require.Equal(t, 200, rr.Code)
+		rr = request(t, s, "POST", "/v1/account/token", `{"label": "backup host"}`, map[string]string{
+			"Authorization": util.BasicAuth("ben", "ben"),
+		})
+		require.Equal(t, 200, rr.Code)
+		var token apiAccountTokenResponse
+		require.Nil(t, json.NewDecoder(rr.Body).Decode(&token))
+
+		// Check audit log
+		entries, err := s.userManager.AuditEntries(&user.AuditFilter{Target: "ben"})
+		require.Nil(t, err)
+		require.Len(t, entries, 2)
+		require.Equal(t, user.AuditActionTokenAdd, entries[0].Action)
+		require.Equal(t, "ben", entries[0].Actor)
+		require.Contains(t, entries[0].After, `"label":"backup host"`)
+		require.Contains(t, entries[0].After, token.Token[:8]+"...")
+		require.NotContains(t, entries[0].After, token.Token)
+		require.Equal(t, user.AuditActionUserAdd, entries[1].Action)
+		require.Equal(t, user.Everyone, entries[1].Actor)
+	})
+}
+
+func TestAudit_NonAdminAttempt(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		s := newTestServer(t, newTestConfigWithAuthFile(t, databaseURL))
+		defer s.closeDatabases()
+
+		require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser, false))
+		rr := request(t, s, "GET", "/v1/audit", "", map[string]string{
+			"Authorization": util.BasicAuth("ben", "ben"),
+		})
+		require.Equal(t, 401, rr.Code)
+		rr = request(t, s, "GET", "/v1/audit", "", nil)
+		require.Equal(t, 401, rr.Code)
+	})
+}
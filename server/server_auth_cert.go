@@ -0,0 +1,109 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"heckel.io/ntfy/v2/user"
+)
+
+// Mutual TLS client certificate authentication:
+//
+// If client-ca-file is set, the HTTPS listener asks clients for a certificate signed by one of the CAs in that
+// bundle (client-cert-mode "request"), or refuses the connection without one ("require"). The username is read
+// from the verified certificate (client-cert-user-field), optionally extracted via a regular expression
+// (client-cert-user-pattern), and the user must exist in the user database.
+
+// Verification modes for TLS client certificates, see Config.ClientCertMode
+const (
+	ClientCertModeRequest = "request" // Verify a client certificate if one is sent, but allow connections without one
+	ClientCertModeRequire = "require" // Refuse connections without a valid client certificate
+)
+
+// Certificate fields that can be mapped to a username, see Config.ClientCertUserField
+const (
+	ClientCertUserFieldCN    = "cn"    // Subject common name
+	ClientCertUserFieldEmail = "email" // Email address SANs
+	ClientCertUserFieldDNS   = "dns"   // DNS name SANs
+	ClientCertUserFieldURI   = "uri"   // URI SANs
+)
+
+// newClientCertTLSConfig returns the TLS config for the HTTPS listener that verifies client certificates
+// against the CA bundle in client-ca-file, or nil if client certificate authentication is disabled.
+func newClientCertTLSConfig(conf *Config) (*tls.Config, error) {
+	if conf.ClientCAFile == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(conf.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no PEM-encoded certificates found in %s", conf.ClientCAFile)
+	}
+	clientAuth := tls.VerifyClientCertIfGiven
+	if conf.ClientCertMode == ClientCertModeRequire {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: clientAuth,
+	}, nil
+}
+
+// authenticateClientCert returns the user identified by the verified TLS client certificate, or nil if
+// client certificate authentication is disabled, or if the client did not send a certificate.
+func (s *Server) authenticateClientCert(r *http.Request) (*user.User, error) {
+	if s.config.ClientCAFile == "" || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	username := s.clientCertUsername(cert)
+	if !user.AllowedUsername(username) {
+		logr(r).Tag(tagAuthCert).Debug("No valid username found in client certificate %s", cert.Subject.String())
+		return nil, errHTTPUnauthorizedClientCert
+	}
+	u, err := s.userManager.User(username)
+	if errors.Is(err, user.ErrUserNotFound) {
+		return nil, errHTTPUnauthorizedClientCert
+	} else if err != nil {
+		return nil, err
+	} else if u.Deleted {
+		return nil, errHTTPUnauthorizedClientCert
+	}
+	u.ClientCert = true
+	return u, nil
+}
+
+// clientCertUsername returns the username for the given certificate, based on the configured field
+// and pattern. If the field has multiple values (SANs), the first one matching the pattern is used.
+func (s *Server) clientCertUsername(cert *x509.Certificate) string {
+	var values []string
+	switch s.config.ClientCertUserField {
+	case ClientCertUserFieldEmail:
+		values = cert.EmailAddresses
+	case ClientCertUserFieldDNS:
+		values = cert.DNSNames
+	case ClientCertUserFieldURI:
+		for _, u := range cert.URIs {
+			values = append(values, u.String())
+		}
+	default:
+		values = []string{cert.Subject.CommonName}
+	}
+	for _, value := range values {
+		if s.config.ClientCertUserPattern == nil {
+			return value
+		} else if m := s.config.ClientCertUserPattern.FindStringSubmatch(value); len(m) > 1 {
+			return m[1]
+		} else if len(m) == 1 {
+			return m[0]
+		}
+	}
+	return ""
+}
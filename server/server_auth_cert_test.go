@@ -0,0 +1,200 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestServer_ClientCert_Authenticate(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		ca := newTestClientCA(t)
+		conf := newTestConfigWithClientCA(t, databaseURL, ca)
+		s, ts := newTestClientCertServer(t, conf)
+		require.Nil(t, s.userManager.AddUser("sensor1", "sensor1", user.RoleUser, false))
+		require.Nil(t, s.userManager.AllowAccess("sensor1", "mytopic", user.PermissionReadWrite))
+
+		client := newTestClientCertClient(t, ts, ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "sensor1"}}))
+		resp, err := client.Get(ts.URL + "/v1/account")
+		require.Nil(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		account, _ := util.UnmarshalJSON[apiAccountResponse](resp.Body)
+		require.Equal(t, "sensor1", account.Username)
+
+		resp, err = client.Post(ts.URL+"/mytopic", "text/plain", strings.NewReader("hi"))
+		require.Nil(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+
+		// Without a certificate, the request is anonymous
+		resp, err = newTestClientCertClient(t, ts, nil).Post(ts.URL+"/mytopic", "text/plain", strings.NewReader("hi"))
+		require.Nil(t, err)
+		require.Equal(t, 403, resp.StatusCode)
+	})
+}
+
+func TestServer_ClientCert_UnknownUser(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		ca := newTestClientCA(t)
+		_, ts := newTestClientCertServer(t, newTestConfigWithClientCA(t, databaseURL, ca))
+
+		client := newTestClientCertClient(t, ts, ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "nobody"}}))
+		resp, err := client.Get(ts.URL + "/v1/account")
+		require.Nil(t, err)
+		require.Equal(t, 401, resp.StatusCode)
+		body, _ := io.ReadAll(resp.Body)
+		require.Equal(t, 40107, toHTTPError(t, string(body)).Code)
+	})
+}
+
+func TestServer_ClientCert_UntrustedCA(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		ca, otherCA := newTestClientCA(t), newTestClientCA(t)
+		s, ts := newTestClientCertServer(t, newTestConfigWithClientCA(t, databaseURL, ca))
+		require.Nil(t, s.userManager.AddUser("sensor1", "sensor1", user.RoleUser, false))
+
+		// A certificate for an existing user, but signed by a different CA, is rejected during the handshake
+		client := newTestClientCertClient(t, ts, otherCA.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "sensor1"}}))
+		_, err := client.Get(ts.URL + "/v1/account")
+		require.NotNil(t, err)
+	})
+}
+
+func TestServer_ClientCert_RequireMode(t *testing.T) {
+	ca := newTestClientCA(t)
+	conf := newTestConfigWithClientCA(t, "", ca)
+	conf.ClientCertMode = ClientCertModeRequire
+	s, ts := newTestClientCertServer(t, conf)
+	require.Nil(t, s.userManager.AddUser("sensor1", "sensor1", user.RoleUser, false))
+
+	_, err := newTestClientCertClient(t, ts, nil).Get(ts.URL + "/v1/account")
+	require.NotNil(t, err)
+
+	resp, err := newTestClientCertClient(t, ts, ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "sensor1"}})).Get(ts.URL + "/v1/account")
+	require.Nil(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+}
+
+func TestServer_ClientCert_AuthorizationHeaderMismatch(t *testing.T) {
+	ca := newTestClientCA(t)
+	s, ts := newTestClientCertServer(t, newTestConfigWithClientCA(t, "", ca))
+	require.Nil(t, s.userManager.AddUser("sensor1", "sensor1", user.RoleUser, false))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin, false))
+
+	req, _ := http.NewRequest("GET", ts.URL+"/v1/account", nil)
+	req.Header.Set("Authorization", util.BasicAuth("phil", "phil"))
+	resp, err := newTestClientCertClient(t, ts, ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "sensor1"}})).Do(req)
+	require.Nil(t, err)
+	require.Equal(t, 401, resp.StatusCode)
+}
+
+func TestServer_ClientCertUsername(t *testing.T) {
+	deviceURL, _ := url.Parse("spiffe://example.com/device/sensor3")
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "Sensor 1"},
+		EmailAddresses: []string{"ops@other.com", "sensor2@devices.example.com"},
+		DNSNames:       []string{"sensor4.devices.example.com"},
+		URIs:           []*url.URL{deviceURL},
+	}
+	s := &Server{config: NewConfig()}
+	require.Equal(t, "Sensor 1", s.clientCertUsername(cert))
+
+	s.config.ClientCertUserField = ClientCertUserFieldEmail
+	require.Equal(t, "ops@other.com", s.clientCertUsername(cert))
+	s.config.ClientCertUserPattern = regexp.MustCompile(`^(.+)@devices\.example\.com$`)
+	require.Equal(t, "sensor2", s.clientCertUsername(cert))
+
+	s.config.ClientCertUserField = ClientCertUserFieldDNS
+	s.config.ClientCertUserPattern = regexp.MustCompile(`^[^.]+`)
+	require.Equal(t, "sensor4", s.clientCertUsername(cert))
+
+	s.config.ClientCertUserField = ClientCertUserFieldURI
+	s.config.ClientCertUserPattern = regexp.MustCompile(`/device/(.+)$`)
+	require.Equal(t, "sensor3", s.clientCertUsername(cert))
+
+	s.config.ClientCertUserPattern = regexp.MustCompile(`^nomatch$`)
+	require.Equal(t, "", s.clientCertUsername(cert))
+}
+
+type testClientCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func newTestClientCA(t *testing.T) *testClientCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ntfy test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	require.Nil(t, os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	return &testClientCA{cert: cert, key: key, file: file}
+}
+
+func (ca *testClientCA) issue(t *testing.T, template *x509.Certificate) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.Nil(t, err)
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func newTestConfigWithClientCA(t *testing.T, databaseURL string, ca *testClientCA) *Config {
+	conf := newTestConfigWithAuthFile(t, databaseURL)
+	conf.AuthDefault = user.PermissionDenyAll
+	conf.ClientCAFile = ca.file
+	return conf
+}
+
+func newTestClientCertServer(t *testing.T, conf *Config) (*Server, *httptest.Server) {
+	s := newTestServer(t, conf)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(s.handle))
+	ts.TLS = s.tlsConfig
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+func newTestClientCertClient(t *testing.T, ts *httptest.Server, cert *tls.Certificate) *http.Client {
+	transport := ts.Client().Transport.(*http.Transport).Clone()
+	if cert != nil {
+		transport.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+	}
+	t.Cleanup(transport.CloseIdleConnections)
+	return &http.Client{Transport: transport}
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+)
+
+// External JWT bearer tokens:
+//
+// If jwt-jwks is set, "Authorization: Bearer <jwt>" is accepted in addition to ntfy access tokens (tk_...). The
+// JWT's signature is verified against the JWKS (from a file or URL), and its issuer, audience and expiry are checked.
+// The username claim maps to an existing ntfy user, or, if jwt-ephemeral-users is set, to a user that only exists
+// for the duration of the request, with its role and access control entries derived from the JWT's claims.
+
+const (
+	jwtHTTPTimeout = 10 * time.Second
+)
+
+// jwtVerifier verifies external JWT bearer tokens. The signing keys are loaded lazily on first use, and
+// reloaded after JWTJWKSCacheDuration, or if a token references an unknown key ID (e.g. after key rotation).
+type jwtVerifier struct {
+	config      *Config
+	client      *http.Client
+	keys        *jose.JSONWebKeySet
+	keysUpdated time.Time // Last successful load
+	keysAttempt time.Time // Last load attempt, successful or not
+	mu          sync.Mutex
+}
+
+func newJWTVerifier(conf *Config) *jwtVerifier {
+	return &jwtVerifier{
+		config: conf,
+		client: &http.Client{Timeout: jwtHTTPTimeout},
+	}
+}
+
+// authenticateJWT verifies the JWT and returns the user it identifies
+func (s *Server) authenticateJWT(r *http.Request, rawToken string) (*user.User, error) {
+	claims, err := s.jwt.Verify(r.Context(), rawToken)
+	if err != nil {
+		return nil, err
+	}
+	username := oidcClaimString(claims, s.config.JWTUsernameClaim)
+	if !user.AllowedUsername(username) {
+		return nil, errors.New("username claim is missing or not a valid username")
+	}
+	if s.config.JWTEphemeralUsers {
+		return s.jwtEphemeralUser(r, username, claims), nil
+	}
+	u, err := s.userManager.User(username)
+	if err != nil {
+		return nil, err
+	} else if u.Deleted {
+		return nil, errors.New("user is marked for deletion")
+	}
+	u.JWT = true
+	return u, nil
+}
+
+// jwtEphemeralUser creates a user that is not stored in the database, with the role and access control
+// entries derived from the JWT's role and groups claims
+func (s *Server) jwtEphemeralUser(r *http.Request, username string, claims map[string]any) *user.User {
+	role := user.RoleUser
+	if s.config.JWTRoleClaim != "" && slices.ContainsFunc(oidcClaimStrings(claims, s.config.JWTRoleClaim), func(role string) bool {
+		return slices.Contains(s.config.JWTAdminRoles, role)
+	}) {
+		role = user.RoleAdmin
+	}
+	grants := make([]user.Grant, 0)
+	for _, group := range oidcClaimStrings(claims, s.config.JWTGroupsClaim) {
+		for _, grant := range s.config.JWTGroupAccess[group] {
+			grants = append(grants, *grant)
+		}
+	}
+	logr(r).Tag(tagAuthJWT).Field("user_name", username).Trace("Authenticated ephemeral user %s with role %s and %d grant(s)", username, role, len(grants))
+	u := user.NewEphemeralUser(username, role, grants)
+	u.JWT = true
+	return u
+}
+
+// Verify verifies the JWT's signature, issuer, audience and expiry, and returns its claims
+func (j *jwtVerifier) Verify(ctx context.Context, rawToken string) (map[string]any, error) {
+	token, err := jwt.ParseSigned(rawToken, oidcSignatureAlgorithms)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := j.Keys(ctx, token.Headers)
+	if err != nil {
+		return nil, err
+	}
+	var standardClaims jwt.Claims
+	var claims map[string]any
+	if err := token.Claims(keys, &standardClaims, &claims); err != nil {
+		return nil, err
+	}
+	expected := jwt.Expected{
+		Issuer:      j.config.JWTIssuer,
+		AnyAudience: jwt.Audience{j.config.JWTAudience},
+	}
+	if err := standardClaims.ValidateWithLeeway(expected, oidcClockLeeway); err != nil {
+		return nil, err
+	} else if standardClaims.Expiry == nil {
+		return nil, errors.New("token has no expiry")
+	}
+	return claims, nil
+}
+
+// Keys returns the signing keys from the JWKS file or URL. Keys are cached for JWTJWKSCacheDuration, and
+// reloaded early (at most once per oidcKeysRefreshInterval) if a token references an unknown key ID. If
+// reloading fails, the previously loaded keys continue to be used.
+func (j *jwtVerifier) Keys(ctx context.Context, headers []jose.Header) (*jose.JSONWebKeySet, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.keys != nil {
+		expired := time.Since(j.keysUpdated) > j.config.JWTJWKSCacheDuration
+		if (!expired && oidcKeysContain(j.keys, headers)) || time.Since(j.keysAttempt) < oidcKeysRefreshInterval {
+			return j.keys, nil
+		}
+	}
+	j.keysAttempt = time.Now()
+	keys, err := j.load(ctx)
+	if err != nil && j.keys != nil {
+		log.Tag(tagAuthJWT).Err(err).Warn("Cannot reload JWKS from %s, continuing to use previously loaded keys", j.config.JWTJWKS)
+		return j.keys, nil
+	} else if err != nil {
+		return nil, err
+	}
+	log.Tag(tagAuthJWT).Debug("Loaded %d signing key(s) from %s", len(keys.Keys), j.config.JWTJWKS)
+	j.keys = keys
+	j.keysUpdated = time.Now()
+	return j.keys, nil
+}
+
+func (j *jwtVerifier) load(ctx context.Context) (*jose.JSONWebKeySet, error) {
+	var keys jose.JSONWebKeySet
+	if strings.HasPrefix(j.config.JWTJWKS, "https://") || strings.HasPrefix(j.config.JWTJWKS, "http://") {
+		if err := fetchJSON(ctx, j.client, j.config.JWTJWKS, &keys); err != nil {
+			return nil, err
+		}
+		return &keys, nil
+	}
+	b, err := os.ReadFile(j.config.JWTJWKS)
+	if err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(b, &keys); err != nil {
+		return nil, err
+	}
+	return &keys, nil
+}
+
+// isJWT returns true if the bearer token looks like a JWT (header.payload.signature), as opposed to a
+// ntfy access token
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
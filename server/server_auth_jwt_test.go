@@ -0,0 +1,240 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestServer_JWT_ExistingUser(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		issuer := newTestJWTIssuer(t)
+		s := newTestServer(t, newTestConfigWithJWT(t, databaseURL, issuer.File(t)))
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+		require.Nil(t, s.userManager.AllowAccess("phil", "mytopic", user.PermissionReadWrite))
+
+		token := issuer.Sign(t, map[string]any{"sub": "phil"})
+		response := request(t, s, "GET", "/v1/account", "", map[string]string{
+			"Authorization": util.BearerAuth(token),
+		})
+		require.Equal(t, 200, response.Code)
+		account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(response.Body))
+		require.Equal(t, "phil", account.Username)
+
+		response = request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+			"Authorization": util.BearerAuth(token),
+		})
+		require.Equal(t, 200, response.Code)
+		response = request(t, s, "PUT", "/othertopic", "hi", map[string]string{
+			"Authorization": util.BearerAuth(token),
+		})
+		require.Equal(t, 403, response.Code)
+
+		// ntfy access tokens still work
+		u, err := s.userManager.User("phil")
+		require.Nil(t, err)
+		tk, err := s.userManager.CreateToken(u.ID, "", time.Unix(0, 0), netip.IPv4Unspecified(), nil, false)
+		require.Nil(t, err)
+		response = request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+			"Authorization": util.BearerAuth(tk.Value),
+		})
+		require.Equal(t, 200, response.Code)
+
+		// Unknown users are rejected
+		response = request(t, s, "GET", "/v1/account", "", map[string]string{
+			"Authorization": util.BearerAuth(issuer.Sign(t, map[string]any{"sub": "nobody"})),
+		})
+		require.Equal(t, 401, response.Code)
+	})
+}
+
+func TestServer_JWT_InvalidToken(t *testing.T) {
+	issuer, otherIssuer := newTestJWTIssuer(t), newTestJWTIssuer(t)
+	s := newTestServer(t, newTestConfigWithJWT(t, "", issuer.File(t)))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+
+	for name, token := range map[string]string{
+		"wrong issuer":    issuer.Sign(t, map[string]any{"sub": "phil", "iss": "https://evil.example.com"}),
+		"wrong audience":  issuer.Sign(t, map[string]any{"sub": "phil", "aud": "other"}),
+		"expired":         issuer.Sign(t, map[string]any{"sub": "phil", "exp": time.Now().Add(-time.Hour).Unix()}),
+		"no expiry":       issuer.Sign(t, map[string]any{"sub": "phil", "exp": nil}),
+		"wrong key":       otherIssuer.Sign(t, map[string]any{"sub": "phil"}),
+		"invalid subject": issuer.Sign(t, map[string]any{"sub": "not a valid name!"}),
+		"malformed":       "not.a.jwt",
+	} {
+		t.Run(name, func(t *testing.T) {
+			response := request(t, s, "GET", "/v1/account", "", map[string]string{
+				"Authorization": util.BearerAuth(token),
+			})
+			require.Equal(t, 401, response.Code)
+		})
+	}
+}
+
+func TestServer_JWT_EphemeralUser(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		issuer := newTestJWTIssuer(t)
+		conf := newTestConfigWithJWT(t, databaseURL, issuer.File(t))
+		conf.JWTEphemeralUsers = true
+		conf.JWTRoleClaim = "roles"
+		conf.JWTAdminRoles = []string{"ntfy-admin"}
+		conf.JWTGroupAccess = map[string][]*user.Grant{
+			"ci":  {{TopicPattern: "ci-*", Permission: user.PermissionReadWrite}},
+			"ops": {{TopicPattern: "alerts", Permission: user.PermissionWrite}},
+		}
+		s := newTestServer(t, conf)
+
+		token := issuer.Sign(t, map[string]any{"sub": "build-bot", "groups": []string{"ci", "other"}})
+		response := request(t, s, "PUT", "/ci-builds", "hi", map[string]string{
+			"Authorization": util.BearerAuth(token),
+		})
+		require.Equal(t, 200, response.Code)
+		response = request(t, s, "PUT", "/alerts", "hi", map[string]string{
+			"Authorization": util.BearerAuth(token),
+		})
+		require.Equal(t, 403, response.Code)
+
+		// Ephemeral users are not stored, and cannot use the account API
+		response = request(t, s, "GET", "/v1/account", "", map[string]string{
+			"Authorization": util.BearerAuth(token),
+		})
+		require.Equal(t, 403, response.Code)
+		_, err := s.userManager.User("build-bot")
+		require.Equal(t, user.ErrUserNotFound, err)
+
+		// Role claim maps to admin
+		adminToken := issuer.Sign(t, map[string]any{"sub": "ops-bot", "roles": []string{"ntfy-admin"}})
+		response = request(t, s, "PUT", "/anything", "hi", map[string]string{
+			"Authorization": util.BearerAuth(adminToken),
+		})
+		require.Equal(t, 200, response.Code)
+	})
+}
+
+func TestServer_JWT_KeysFromURLWithRotation(t *testing.T) {
+	issuer := newTestJWTIssuer(t)
+	jwksServer := httptest.NewServer(http.HandlerFunc(issuer.handleJWKS))
+	t.Cleanup(jwksServer.Close)
+	s := newTestServer(t, newTestConfigWithJWT(t, "", jwksServer.URL))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+
+	response := request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BearerAuth(issuer.Sign(t, map[string]any{"sub": "phil"})),
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, 1, issuer.Fetches())
+
+	// Keys are cached
+	response = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BearerAuth(issuer.Sign(t, map[string]any{"sub": "phil"})),
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, 1, issuer.Fetches())
+
+	// After key rotation, the unknown key ID triggers a reload (at most once per refresh interval)
+	issuer.Rotate(t)
+	s.jwt.keysAttempt = time.Now().Add(-oidcKeysRefreshInterval)
+	response = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BearerAuth(issuer.Sign(t, map[string]any{"sub": "phil"})),
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, 2, issuer.Fetches())
+}
+
+type testJWTIssuer struct {
+	key     *ecdsa.PrivateKey
+	keyID   string
+	fetches int
+	mu      sync.Mutex
+}
+
+func newTestJWTIssuer(t *testing.T) *testJWTIssuer {
+	i := &testJWTIssuer{}
+	i.Rotate(t)
+	return i
+}
+
+func (i *testJWTIssuer) Rotate(t *testing.T) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	i.key, i.keyID = key, util.RandomString(8)
+}
+
+func (i *testJWTIssuer) Sign(t *testing.T, claims map[string]any) string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	allClaims := map[string]any{
+		"iss": "https://id.example.com",
+		"aud": "ntfy",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+	}
+	for k, v := range claims {
+		if v == nil {
+			delete(allClaims, k)
+		} else {
+			allClaims[k] = v
+		}
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: i.key}, (&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", i.keyID))
+	require.Nil(t, err)
+	token, err := jwt.Signed(signer).Claims(allClaims).Serialize()
+	require.Nil(t, err)
+	return token
+}
+
+func (i *testJWTIssuer) JWKS() *jose.JSONWebKeySet {
+	return &jose.JSONWebKeySet{
+		Keys: []jose.JSONWebKey{{Key: &i.key.PublicKey, KeyID: i.keyID, Algorithm: string(jose.ES256), Use: "sig"}},
+	}
+}
+
+func (i *testJWTIssuer) File(t *testing.T) string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	b, err := json.Marshal(i.JWKS())
+	require.Nil(t, err)
+	filename := filepath.Join(t.TempDir(), "jwks.json")
+	require.Nil(t, os.WriteFile(filename, b, 0600))
+	return filename
+}
+
+func (i *testJWTIssuer) Fetches() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.fetches
+}
+
+func (i *testJWTIssuer) handleJWKS(w http.ResponseWriter, _ *http.Request) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.fetches++
+	json.NewEncoder(w).Encode(i.JWKS())
+}
+
+func newTestConfigWithJWT(t *testing.T, databaseURL, jwks string) *Config {
+	conf := newTestConfigWithAuthFile(t, databaseURL)
+	conf.AuthDefault = user.PermissionDenyAll
+	conf.JWTJWKS = jwks
+	conf.JWTIssuer = "https://id.example.com"
+	conf.JWTAudience = "ntfy"
+	return conf
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+// Reverse proxy authentication (forward auth):
+//
+// If auth-proxy-header is set, a reverse proxy such as oauth2-proxy or Authelia authenticates the user, and
+// passes the username in the configured header (e.g. Remote-User). The header is only trusted if the request
+// comes directly from one of the proxy-trusted-hosts. For all other requests, it is ignored, so that clients
+// cannot impersonate users by setting the header themselves.
+
+const (
+	authProxyPasswordLength = 32
+)
+
+// authenticateProxy returns the user identified by the reverse proxy header, or nil if the header is
+// disabled, not set, or if the request does not come from a trusted proxy. If the user does not exist,
+// it is created if auth-proxy-create-users is set.
+func (s *Server) authenticateProxy(r *http.Request) (*user.User, error) {
+	if s.config.AuthProxyHeader == "" {
+		return nil, nil
+	}
+	username := strings.TrimSpace(r.Header.Get(s.config.AuthProxyHeader))
+	if username == "" {
+		return nil, nil
+	} else if !s.isTrustedProxy(r) {
+		logr(r).Tag(tagAuthProxy).Debug("Ignoring %s header from untrusted address %s", s.config.AuthProxyHeader, r.RemoteAddr)
+		return nil, nil
+	} else if !user.AllowedUsername(username) {
+		return nil, errHTTPUnauthorizedProxyAuth
+	}
+	u, err := s.userManager.User(username)
+	if errors.Is(err, user.ErrUserNotFound) && s.config.AuthProxyCreateUsers {
+		if u, err = s.authProxyCreateUser(r, username); err != nil {
+			return nil, err
+		}
+	} else if errors.Is(err, user.ErrUserNotFound) {
+		return nil, errHTTPUnauthorizedProxyAuth
+	} else if err != nil {
+		return nil, err
+	} else if u.Deleted {
+		return nil, errHTTPUnauthorizedProxyAuth
+	}
+	u.ProxyAuth = true
+	return u, nil
+}
+
+// authProxyCreateUser creates a user with a random password, the default role and tier. The password is
+// never handed out, so the user can only log in via the reverse proxy, or with a token created there.
+func (s *Server) authProxyCreateUser(r *http.Request, username string) (*user.User, error) {
+	logr(r).Tag(tagAuthProxy).Field("user_name", username).Info("Creating user %s from reverse proxy login", username)
+	if err := s.userManager.AddUser(username, util.RandomString(authProxyPasswordLength), s.config.AuthProxyDefaultRole, false); err != nil {
+		return nil, err
+	}
+	if s.config.AuthProxyDefaultTier != "" {
+		if err := s.userManager.ChangeTier(username, s.config.AuthProxyDefaultTier); err != nil {
+			return nil, err
+		}
+	}
+	return s.userManager.User(username)
+}
+
+// isTrustedProxy returns true if the direct peer of the request (not the forwarded client address)
+// is one of the trusted proxies.
+func (s *Server) isTrustedProxy(r *http.Request) bool {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	addr := addrPort.Addr().Unmap()
+	for _, prefix := range s.config.ProxyTrustedPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestServer_AuthProxy_TrustedProxy(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		s := newTestServer(t, newTestConfigWithAuthProxy(t, databaseURL))
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+		require.Nil(t, s.userManager.AllowAccess("phil", "mytopic", user.PermissionReadWrite))
+
+		response := request(t, s, "GET", "/v1/account", "", map[string]string{
+			"Remote-User": "phil",
+		}, fromTrustedProxy)
+		require.Equal(t, 200, response.Code)
+		account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(response.Body))
+		require.Equal(t, "phil", account.Username)
+
+		response = request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+			"Remote-User": "phil",
+		}, fromTrustedProxy)
+		require.Equal(t, 200, response.Code)
+	})
+}
+
+func TestServer_AuthProxy_UntrustedIPIgnoresHeader(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		s := newTestServer(t, newTestConfigWithAuthProxy(t, databaseURL))
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin, false))
+
+		// Spoofed header from a client that is not a trusted proxy is ignored
+		response := request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+			"Remote-User": "phil",
+		})
+		require.Equal(t, 403, response.Code)
+
+		response = request(t, s, "GET", "/v1/account", "", map[string]string{
+			"Remote-User": "phil",
+		})
+		require.Equal(t, 200, response.Code)
+		account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(response.Body))
+		require.Equal(t, user.Everyone, account.Username)
+
+		// Forwarded-for header does not make the client trusted either
+		response = request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+			"Remote-User":     "phil",
+			"X-Forwarded-For": "10.0.0.1",
+		})
+		require.Equal(t, 403, response.Code)
+	})
+}
+
+func TestServer_AuthProxy_UnknownUser(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		s := newTestServer(t, newTestConfigWithAuthProxy(t, databaseURL))
+
+		response := request(t, s, "GET", "/v1/account", "", map[string]string{
+			"Remote-User": "nobody",
+		}, fromTrustedProxy)
+		require.Equal(t, 401, response.Code)
+		require.Equal(t, 40106, toHTTPError(t, response.Body.String()).Code)
+
+		response = request(t, s, "GET", "/v1/account", "", map[string]string{
+			"Remote-User": "not a valid name!",
+		}, fromTrustedProxy)
+		require.Equal(t, 401, response.Code)
+		require.Equal(t, 40106, toHTTPError(t, response.Body.String()).Code)
+
+		_, err := s.userManager.User("nobody")
+		require.Equal(t, user.ErrUserNotFound, err)
+	})
+}
+
+func TestServer_AuthProxy_CreateUser(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		conf := newTestConfigWithAuthProxy(t, databaseURL)
+		conf.AuthProxyCreateUsers = true
+		conf.AuthProxyDefaultTier = "pro"
+		s := newTestServer(t, conf)
+		require.Nil(t, s.userManager.AddTier(&user.Tier{Code: "pro"}))
+
+		response := request(t, s, "GET", "/v1/account", "", map[string]string{
+			"Remote-User": "phil",
+		}, fromTrustedProxy)
+		require.Equal(t, 200, response.Code)
+		account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(response.Body))
+		require.Equal(t, "phil", account.Username)
+		require.Equal(t, "user", account.Role)
+		require.Equal(t, "pro", account.Tier.Code)
+
+		// Session token can be created without password, e.g. for the web app
+		response = request(t, s, "POST", "/v1/account/token", "", map[string]string{
+			"Remote-User": "phil",
+		}, fromTrustedProxy)
+		require.Equal(t, 200, response.Code)
+		token, _ := util.UnmarshalJSON[apiAccountTokenResponse](io.NopCloser(response.Body))
+		require.NotEmpty(t, token.Token)
+
+		response = request(t, s, "GET", "/v1/account", "", map[string]string{
+			"Authorization": util.BearerAuth(token.Token),
+		})
+		require.Equal(t, 200, response.Code)
+	})
+}
+
+func TestServer_AuthProxy_AuthorizationHeaderMismatch(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		s := newTestServer(t, newTestConfigWithAuthProxy(t, databaseURL))
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+		require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser, false))
+
+		response := request(t, s, "GET", "/v1/account", "", map[string]string{
+			"Remote-User":   "phil",
+			"Authorization": util.BasicAuth("ben", "ben"),
+		}, fromTrustedProxy)
+		require.Equal(t, 401, response.Code)
+
+		response = request(t, s, "GET", "/v1/account", "", map[string]string{
+			"Remote-User":   "phil",
+			"Authorization": util.BasicAuth("phil", "phil"),
+		}, fromTrustedProxy)
+		require.Equal(t, 200, response.Code)
+	})
+}
+
+func newTestConfigWithAuthProxy(t *testing.T, databaseURL string) *Config {
+	conf := newTestConfigWithAuthFile(t, databaseURL)
+	conf.AuthDefault = user.PermissionDenyAll
+	conf.AuthProxyHeader = "Remote-User"
+	conf.ProxyTrustedPrefixes = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	return conf
+}
+
+func fromTrustedProxy(r *http.Request) {
+	r.RemoteAddr = "10.1.2.3:1234"
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"heckel.io/ntfy/v2/model"
+	"heckel.io/ntfy/v2/util"
+)
+
+// CloudEvents integration:
+//
+// Subscribers can receive messages as CloudEvents (https://cloudevents.io/) in structured mode, i.e. one
+// JSON-encoded event per line, via GET /<topics>/cloudevents or GET /<topics>/json?format=cloudevents.
+//
+// Publishers can send CloudEvents to PUT/POST /<topic>, either in structured mode (Content-Type:
+// application/cloudevents+json), or in binary mode (ce-* headers, the body is the event data).
+
+const (
+	cloudEventsSpecVersion     = "1.0"
+	cloudEventsContentType     = "application/cloudevents+json"
+	cloudEventsFormat          = "cloudevents"
+	cloudEventsTypePrefix      = "sh.ntfy."
+	cloudEventsDataContentType = "application/json"
+)
+
+// cloudEvent is a CloudEvent in the structured-mode JSON format, see
+// https://github.com/cloudevents/spec/blob/v1.0.2/cloudevents/formats/json-format.md
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            string          `json:"time,omitempty"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	DataBase64      string          `json:"data_base64,omitempty"`
+}
+
+func (s *Server) handleSubscribeCloudEvents(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	return s.handleSubscribeHTTP(w, r, v, "application/x-ndjson", s.cloudEventsEncoder(r))
+}
+
+// cloudEventsEncoder returns a messageEncoder that encodes messages as structured-mode CloudEvents. The
+// event type is derived from the ntfy event (e.g. sh.ntfy.message), and the data is the ntfy JSON message.
+func (s *Server) cloudEventsEncoder(r *http.Request) messageEncoder {
+	baseURL := s.requestBaseURL(r)
+	return func(msg *model.Message) (string, error) {
+		data, err := json.Marshal(msg.ForJSON())
+		if err != nil {
+			return "", err
+		}
+		event := &cloudEvent{
+			SpecVersion:     cloudEventsSpecVersion,
+			ID:              msg.ID,
+			Source:          baseURL + "/" + msg.Topic,
+			Type:            cloudEventsTypePrefix + msg.Event,
+			Time:            time.Unix(msg.Time, 0).UTC().Format(time.RFC3339),
+			DataContentType: cloudEventsDataContentType,
+			Data:            data,
+		}
+		var buf bytes.Buffer
+		if err := util.EncodeJSON(&buf, event); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}
+}
+
+// transformCloudEvent converts a CloudEvent publish request (structured or binary mode) to a regular
+// publish request before passing it on to the next handler. Other requests are passed through as is.
+// This is meant to be used in combination with handlePublish.
+func (s *Server) transformCloudEvent(next handleFunc) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
+		if r.Header.Get("ce-specversion") != "" {
+			if err := transformCloudEventBinary(r); err != nil {
+				return err
+			}
+		} else if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == cloudEventsContentType {
+			if err := s.transformCloudEventStructured(r); err != nil {
+				return err
+			}
+		}
+		return next(w, r, v)
+	}
+}
+
+// transformCloudEventBinary handles binary-mode CloudEvents: the event attributes are passed as ce-* headers,
+// and the body is the event data, so only the title needs to be set.
+func transformCloudEventBinary(r *http.Request) error {
+	event := &cloudEvent{
+		SpecVersion: r.Header.Get("ce-specversion"),
+		ID:          r.Header.Get("ce-id"),
+		Source:      r.Header.Get("ce-source"),
+		Type:        r.Header.Get("ce-type"),
+	}
+	if err := validateCloudEvent(event); err != nil {
+		return err
+	}
+	setCloudEventTitle(r, event)
+	return nil
+}
+
+// transformCloudEventStructured handles structured-mode CloudEvents: the event is a JSON document, and the
+// data is either embedded JSON (strings are used as message as is), or base64-encoded binary data.
+func (s *Server) transformCloudEventStructured(r *http.Request) error {
+	event, err := readJSONWithLimit[cloudEvent](r.Body, s.config.MessageSizeLimit*2, false) // 2x to account for JSON format overhead
+	if errors.Is(err, errHTTPBadRequestJSONInvalid) {
+		return errHTTPBadRequestCloudEventInvalid
+	} else if err != nil {
+		return err
+	} else if err := validateCloudEvent(event); err != nil {
+		return err
+	}
+	var body []byte
+	if event.DataBase64 != "" {
+		body, err = base64.StdEncoding.DecodeString(event.DataBase64)
+		if err != nil {
+			return errHTTPBadRequestCloudEventInvalid
+		}
+	} else if len(event.Data) > 0 {
+		var str string
+		if err := json.Unmarshal(event.Data, &str); err == nil {
+			body = []byte(str)
+		} else {
+			var compacted bytes.Buffer
+			if err := json.Compact(&compacted, event.Data); err != nil {
+				return errHTTPBadRequestCloudEventInvalid
+			}
+			body = compacted.Bytes()
+		}
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	if event.DataContentType != "" {
+		r.Header.Set("Content-Type", event.DataContentType)
+	} else {
+		r.Header.Del("Content-Type")
+	}
+	setCloudEventTitle(r, event)
+	return nil
+}
+
+func validateCloudEvent(event *cloudEvent) error {
+	if event.SpecVersion != cloudEventsSpecVersion {
+		return errHTTPBadRequestCloudEventInvalid.Wrap("unsupported specversion %s", event.SpecVersion)
+	} else if event.ID == "" || event.Source == "" || event.Type == "" {
+		return errHTTPBadRequestCloudEventInvalid.Wrap("id, source and type are required")
+	}
+	return nil
+}
+
+// setCloudEventTitle uses the event type as message title, unless a title was passed explicitly
+func setCloudEventTitle(r *http.Request, event *cloudEvent) {
+	if readParam(r, "x-title", "title", "t") == "" {
+		r.Header.Set("X-Title", strings.TrimSpace(event.Type))
+	}
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/model"
+)
+
+func TestServer_SubscribeCloudEvents_Poll(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		s := newTestServer(t, newTestConfig(t, databaseURL))
+		msg := toMessage(t, request(t, s, "PUT", "/mytopic", "backup done", map[string]string{
+			"Title": "Backup",
+			"Tags":  "backup",
+		}).Body.String())
+
+		for _, u := range []string{"/mytopic/cloudevents?poll=1", "/mytopic/json?poll=1&format=cloudevents"} {
+			response := request(t, s, "GET", u, "", nil)
+			require.Equal(t, 200, response.Code)
+			events := toCloudEvents(t, response.Body.String())
+			require.Len(t, events, 1)
+			event := events[0]
+			require.Equal(t, "1.0", event.SpecVersion)
+			require.Equal(t, msg.ID, event.ID)
+			require.Equal(t, "http://127.0.0.1:12345/mytopic", event.Source)
+			require.Equal(t, "sh.ntfy.message", event.Type)
+			require.Equal(t, "application/json", event.DataContentType)
+			require.NotEmpty(t, event.Time)
+
+			var data model.Message
+			require.Nil(t, json.Unmarshal(event.Data, &data))
+			require.Equal(t, msg.ID, data.ID)
+			require.Equal(t, "Backup", data.Title)
+			require.Equal(t, "backup done", data.Message)
+			require.Equal(t, []string{"backup"}, data.Tags)
+		}
+	})
+}
+
+func TestServer_SubscribeCloudEvents_Stream(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t, ""))
+	rr := httptest.NewRecorder()
+	cancel := subscribe(t, s, "/mytopic/cloudevents", rr)
+	request(t, s, "PUT", "/mytopic", "hi there", nil)
+	cancel()
+
+	events := toCloudEvents(t, rr.Body.String())
+	require.Len(t, events, 2)
+	require.Equal(t, "sh.ntfy.open", events[0].Type)
+	require.Equal(t, "sh.ntfy.message", events[1].Type)
+}
+
+func TestServer_PublishCloudEvent_Structured(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		s := newTestServer(t, newTestConfig(t, databaseURL))
+
+		// String data
+		response := request(t, s, "POST", "/mytopic", `{"specversion":"1.0","id":"1","source":"/backups","type":"com.example.backup.done","data":"Backup of db1 done"}`, map[string]string{
+			"Content-Type": "application/cloudevents+json; charset=utf-8",
+		})
+		require.Equal(t, 200, response.Code)
+		msg := toMessage(t, response.Body.String())
+		require.Equal(t, "com.example.backup.done", msg.Title)
+		require.Equal(t, "Backup of db1 done", msg.Message)
+
+		// JSON data, explicit title, markdown content type
+		response = request(t, s, "POST", "/mytopic?title=Custom", `{"specversion":"1.0","id":"2","source":"/backups","type":"com.example.backup.done","datacontenttype":"text/markdown","data":"**done**"}`, map[string]string{
+			"Content-Type": "application/cloudevents+json",
+		})
+		require.Equal(t, 200, response.Code)
+		msg = toMessage(t, response.Body.String())
+		require.Equal(t, "Custom", msg.Title)
+		require.Equal(t, "**done**", msg.Message)
+		require.Equal(t, "text/markdown", msg.ContentType)
+
+		// JSON object data
+		response = request(t, s, "POST", "/mytopic", `{"specversion":"1.0","id":"3","source":"/backups","type":"com.example.backup.done","datacontenttype":"application/json","data":{ "db": "db1", "ok": true }}`, map[string]string{
+			"Content-Type": "application/cloudevents+json",
+		})
+		require.Equal(t, 200, response.Code)
+		msg = toMessage(t, response.Body.String())
+		require.Equal(t, `{"db":"db1","ok":true}`, msg.Message)
+
+		// Base64 data
+		response = request(t, s, "POST", "/mytopic", `{"specversion":"1.0","id":"4","source":"/backups","type":"com.example.backup.done","data_base64":"aGVsbG8gd29ybGQ="}`, map[string]string{
+			"Content-Type": "application/cloudevents+json",
+		})
+		require.Equal(t, 200, response.Code)
+		msg = toMessage(t, response.Body.String())
+		require.Equal(t, "hello world", msg.Message)
+	})
+}
+
+func TestServer_PublishCloudEvent_Binary(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		s := newTestServer(t, newTestConfig(t, databaseURL))
+		response := request(t, s, "PUT", "/mytopic", "Disk is full", map[string]string{
+			"ce-specversion": "1.0",
+			"ce-id":          "abc",
+			"ce-source":      "/monitoring",
+			"ce-type":        "com.example.disk.full",
+			"Content-Type":   "text/plain",
+		})
+		require.Equal(t, 200, response.Code)
+		msg := toMessage(t, response.Body.String())
+		require.Equal(t, "com.example.disk.full", msg.Title)
+		require.Equal(t, "Disk is full", msg.Message)
+	})
+}
+
+func TestServer_PublishCloudEvent_Invalid(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t, ""))
+
+	response := request(t, s, "PUT", "/mytopic", "Disk is full", map[string]string{
+		"ce-specversion": "0.3",
+		"ce-id":          "abc",
+		"ce-source":      "/monitoring",
+		"ce-type":        "com.example.disk.full",
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40058, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "POST", "/mytopic", `{"specversion":"1.0","source":"/backups","type":"com.example.backup.done"}`, map[string]string{
+		"Content-Type": "application/cloudevents+json",
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40058, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "POST", "/mytopic", `not json`, map[string]string{
+		"Content-Type": "application/cloudevents+json",
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40058, toHTTPError(t, response.Body.String()).Code)
+}
+
+func toCloudEvents(t *testing.T, s string) []*cloudEvent {
+	events := make([]*cloudEvent, 0)
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	for scanner.Scan() {
+		var event cloudEvent
+		require.Nil(t, json.Unmarshal(scanner.Bytes(), &event))
+		events = append(events, &event)
+	}
+	return events
+}
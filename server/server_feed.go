@@ -0,0 +1,375 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/russross/blackfriday/v2"
+	"heckel.io/ntfy/v2/model"
+)
+
+// RSS/Atom feeds:
+//
+// GET /<topics>/rss and GET /<topics>/atom render the cached messages of one or more topics as an RSS 2.0
+// or Atom 1.0 feed, so that topics can be followed in feed readers. Like /json, the "since" parameter and
+// message filters are supported; by default, all cached messages are included (newest first, up to feedMaxItems).
+// Feeds are always polled, so a weak validator (ETag/If-None-Match) is supported to save bandwidth.
+
+const (
+	feedFormatRSS  = "rss"
+	feedFormatAtom = "atom"
+	feedMaxItems   = 100
+	feedTitleMax   = 80 // Max. length of an item title derived from the message body
+	feedGenerator  = "ntfy"
+)
+
+var (
+	feedPolicy = bluemonday.UGCPolicy()
+)
+
+// rssFeed is the root element of an RSS 2.0 feed, see https://www.rssboard.org/rss-specification
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	AtomNS  string     `xml:"xmlns:atom,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string     `xml:"title"`
+	Link          string     `xml:"link"`
+	Description   string     `xml:"description"`
+	Generator     string     `xml:"generator"`
+	LastBuildDate string     `xml:"lastBuildDate"`
+	AtomLink      atomLink   `xml:"atom:link"`
+	Items         []*rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string        `xml:"title"`
+	Link        string        `xml:"link"`
+	Description string        `xml:"description"`
+	GUID        rssGUID       `xml:"guid"`
+	PubDate     string        `xml:"pubDate"`
+	Categories  []string      `xml:"category"`
+	Enclosure   *rssEnclosure `xml:"enclosure,omitempty"`
+}
+
+type rssGUID struct {
+	IsPermaLink string `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+// atomFeed is the root element of an Atom 1.0 feed, see RFC 4287
+type atomFeed struct {
+	XMLName   xml.Name     `xml:"http://www.w3.org/2005/Atom feed"`
+	ID        string       `xml:"id"`
+	Title     string       `xml:"title"`
+	Updated   string       `xml:"updated"`
+	Generator string       `xml:"generator"`
+	Links     []atomLink   `xml:"link"`
+	Entries   []*atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	ID         string         `xml:"id"`
+	Title      string         `xml:"title"`
+	Updated    string         `xml:"updated"`
+	Links      []atomLink     `xml:"link"`
+	Categories []atomCategory `xml:"category"`
+	Content    atomContent    `xml:"content"`
+}
+
+type atomLink struct {
+	Href   string `xml:"href,attr"`
+	Rel    string `xml:"rel,attr,omitempty"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length int64  `xml:"length,attr,omitempty"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomContent struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+func (s *Server) handleSubscribeRSS(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	return s.handleSubscribeFeed(w, r, v, feedFormatRSS)
+}
+
+func (s *Server) handleSubscribeAtom(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	return s.handleSubscribeFeed(w, r, v, feedFormatAtom)
+}
+
+func (s *Server) handleSubscribeFeed(w http.ResponseWriter, r *http.Request, v *visitor, format string) error {
+	topics, topicsStr, err := s.topicsFromPath(v, r.URL.Path)
+	if err != nil {
+		return err
+	}
+	since, err := parseSince(r, true)
+	if err != nil {
+		return err
+	}
+	filters, err := parseQueryFilters(r)
+	if err != nil {
+		return err
+	}
+	messages, err := s.feedMessages(topics, since, filters)
+	if err != nil {
+		return err
+	}
+	etag := feedETag(format, topicsStr, messages)
+	w.Header().Set("Access-Control-Allow-Origin", s.config.AccessControlAllowOrigin) // CORS, allow cross-origin requests
+	w.Header().Set("ETag", etag)
+	if feedETagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	baseURL := s.requestBaseURL(r)
+	var feed any
+	var contentType string
+	if format == feedFormatAtom {
+		feed, contentType = newAtomFeed(baseURL, r.URL.Path, topicsStr, messages), "application/atom+xml"
+	} else {
+		feed, contentType = newRSSFeed(baseURL, r.URL.Path, topicsStr, messages), "application/rss+xml"
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feed); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// feedMessages returns the (newest first) messages to be rendered in a feed. Since messages can be updated or
+// deleted via sequence IDs, only the latest version of each sequence is kept, and deleted sequences are skipped.
+func (s *Server) feedMessages(topics []*topic, since model.SinceMarker, filters *queryFilter) ([]*model.Message, error) {
+	messages := make([]*model.Message, 0)
+	for _, t := range topics {
+		topicMessages, err := s.messageCache.Messages(t.ID, since, false)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, topicMessages...)
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Time < messages[j].Time
+	})
+	latest := make(map[string]*model.Message)
+	for _, m := range messages {
+		switch m.Event {
+		case model.MessageEvent:
+			latest[feedSequenceKey(m)] = m
+		case model.MessageDeleteEvent:
+			delete(latest, feedSequenceKey(m))
+		}
+	}
+	items := make([]*model.Message, 0, len(latest))
+	for i := len(messages) - 1; i >= 0; i-- {
+		m := messages[i]
+		if latest[feedSequenceKey(m)] == m && filters.Pass(m) {
+			items = append(items, m)
+		}
+	}
+	if len(items) > feedMaxItems {
+		items = items[:feedMaxItems]
+	}
+	return items, nil
+}
+
+func feedSequenceKey(m *model.Message) string {
+	if m.SequenceID != "" {
+		return m.Topic + "/" + m.SequenceID
+	}
+	return m.Topic + "/" + m.ID
+}
+
+func newRSSFeed(baseURL, selfPath, topicsStr string, messages []*model.Message) *rssFeed {
+	title := feedTitle(baseURL, topicsStr)
+	channel := rssChannel{
+		Title:         title,
+		Link:          feedTopicURL(baseURL, topicsStr),
+		Description:   fmt.Sprintf("Messages published to %s", title),
+		Generator:     feedGenerator,
+		LastBuildDate: feedUpdated(messages).Format(time.RFC1123Z),
+		AtomLink:      atomLink{Href: baseURL + selfPath, Rel: "self", Type: "application/rss+xml"},
+		Items:         make([]*rssItem, 0, len(messages)),
+	}
+	for _, m := range messages {
+		item := &rssItem{
+			Title:       feedItemTitle(m),
+			Link:        feedItemLink(baseURL, m),
+			Description: feedItemContent(m),
+			GUID:        rssGUID{IsPermaLink: "false", Value: m.ID},
+			PubDate:     time.Unix(m.Time, 0).UTC().Format(time.RFC1123Z),
+			Categories:  m.Tags,
+		}
+		if m.Attachment != nil && m.Attachment.URL != "" {
+			item.Enclosure = &rssEnclosure{
+				URL:    m.Attachment.URL,
+				Length: m.Attachment.Size,
+				Type:   feedAttachmentType(m.Attachment),
+			}
+		}
+		channel.Items = append(channel.Items, item)
+	}
+	return &rssFeed{
+		Version: "2.0",
+		AtomNS:  "http://www.w3.org/2005/Atom",
+		Channel: channel,
+	}
+}
+
+func newAtomFeed(baseURL, selfPath, topicsStr string, messages []*model.Message) *atomFeed {
+	topicURL := feedTopicURL(baseURL, topicsStr)
+	feed := &atomFeed{
+		ID:        topicURL,
+		Title:     feedTitle(baseURL, topicsStr),
+		Updated:   feedUpdated(messages).Format(time.RFC3339),
+		Generator: feedGenerator,
+		Links: []atomLink{
+			{Href: topicURL, Rel: "alternate", Type: "text/html"},
+			{Href: baseURL + selfPath, Rel: "self", Type: "application/atom+xml"},
+		},
+		Entries: make([]*atomEntry, 0, len(messages)),
+	}
+	for _, m := range messages {
+		entry := &atomEntry{
+			ID:         feedTopicURL(baseURL, m.Topic) + "#" + m.ID,
+			Title:      feedItemTitle(m),
+			Updated:    time.Unix(m.Time, 0).UTC().Format(time.RFC3339),
+			Links:      []atomLink{{Href: feedItemLink(baseURL, m), Rel: "alternate"}},
+			Categories: make([]atomCategory, 0, len(m.Tags)),
+			Content:    atomContent{Type: "html", Value: feedItemContent(m)},
+		}
+		for _, tag := range m.Tags {
+			entry.Categories = append(entry.Categories, atomCategory{Term: tag})
+		}
+		if m.Attachment != nil && m.Attachment.URL != "" {
+			entry.Links = append(entry.Links, atomLink{
+				Href:   m.Attachment.URL,
+				Rel:    "enclosure",
+				Type:   feedAttachmentType(m.Attachment),
+				Length: m.Attachment.Size,
+			})
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	return feed
+}
+
+func feedTitle(baseURL, topicsStr string) string {
+	return fmt.Sprintf("%s/%s", strings.TrimPrefix(strings.TrimPrefix(baseURL, "https://"), "http://"), topicsStr)
+}
+
+func feedTopicURL(baseURL, topic string) string {
+	return fmt.Sprintf("%s/%s", baseURL, topic)
+}
+
+// feedUpdated returns the time of the newest message, or the current time if there are no messages
+func feedUpdated(messages []*model.Message) time.Time {
+	if len(messages) == 0 {
+		return time.Now().UTC()
+	}
+	return time.Unix(messages[0].Time, 0).UTC()
+}
+
+// feedItemTitle returns the message title, or the first line of the message body if no title is set
+func feedItemTitle(m *model.Message) string {
+	if m.Title != "" {
+		return m.Title
+	} else if m.Encoding != "" {
+		if m.Attachment != nil && m.Attachment.Name != "" {
+			return m.Attachment.Name
+		}
+		return m.Topic
+	}
+	title, _, _ := strings.Cut(strings.TrimSpace(m.Message), "\n")
+	if runes := []rune(title); len(runes) > feedTitleMax {
+		title = string(runes[:feedTitleMax-3]) + "..."
+	}
+	if title == "" {
+		return m.Topic
+	}
+	return title
+}
+
+// feedItemLink returns the click URL of the message if it is a web link, or the topic URL otherwise
+func feedItemLink(baseURL string, m *model.Message) string {
+	if u, err := url.Parse(m.Click); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		return m.Click
+	}
+	return feedTopicURL(baseURL, m.Topic)
+}
+
+// feedItemContent renders the message body as HTML. Markdown messages are rendered and sanitized,
+// plain text messages are escaped. Binary (base64-encoded) message bodies are not included.
+func feedItemContent(m *model.Message) string {
+	if m.Encoding != "" {
+		return ""
+	} else if m.ContentType == "text/markdown" {
+		return string(feedPolicy.SanitizeBytes(blackfriday.Run([]byte(m.Message))))
+	}
+	return strings.ReplaceAll(html.EscapeString(m.Message), "\n", "<br>\n")
+}
+
+// feedAttachmentType returns the attachment's content type, guessing it from the file name for external attachments
+func feedAttachmentType(a *model.Attachment) string {
+	if a.Type != "" {
+		return a.Type
+	} else if contentType := mime.TypeByExtension(path.Ext(a.Name)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// feedETag computes a weak validator from the messages in the feed. It only changes if messages are added,
+// updated or deleted, so that feed readers can use If-None-Match to avoid re-downloading unchanged feeds.
+func feedETag(format, topicsStr string, messages []*model.Message) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s|%s", format, topicsStr)
+	for _, m := range messages {
+		fmt.Fprintf(h, "|%s:%d", m.ID, m.Time)
+	}
+	return fmt.Sprintf(`W/"%s"`, hex.EncodeToString(h.Sum(nil))[:32])
+}
+
+// feedETagMatches returns true if the If-None-Match header contains the given ETag (or "*"), using
+// weak comparison as defined in RFC 9110, section 13.1.2
+func feedETagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
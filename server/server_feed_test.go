@@ -0,0 +1,164 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestServer_SubscribeRSS(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		s := newTestServer(t, newTestConfig(t, databaseURL))
+
+		request(t, s, "PUT", "/mytopic", "first line\nsecond <line>", nil)
+		request(t, s, "PUT", "/mytopic", "Some **bold** text <script>alert(1)</script>", map[string]string{
+			"Title":    "Markdown",
+			"Markdown": "yes",
+			"Tags":     "warning,backup",
+			"Click":    "https://example.com/details",
+		})
+		request(t, s, "PUT", "/othertopic", "With attachment", map[string]string{
+			"Attach":   "https://example.com/file.jpg",
+			"Filename": "file.jpg",
+		})
+
+		response := request(t, s, "GET", "/mytopic,othertopic/rss", "", nil)
+		require.Equal(t, 200, response.Code)
+		require.Equal(t, "application/rss+xml; charset=utf-8", response.Header().Get("Content-Type"))
+		require.NotEmpty(t, response.Header().Get("ETag"))
+
+		var feed rssFeed
+		require.Nil(t, xml.Unmarshal(response.Body.Bytes(), &feed))
+		require.Equal(t, "2.0", feed.Version)
+		require.Equal(t, "127.0.0.1:12345/mytopic,othertopic", feed.Channel.Title)
+		require.Contains(t, response.Body.String(), "<link>http://127.0.0.1:12345/mytopic,othertopic</link>")
+		require.Contains(t, response.Body.String(), `<atom:link href="http://127.0.0.1:12345/mytopic,othertopic/rss" rel="self" type="application/rss+xml"></atom:link>`)
+		require.Len(t, feed.Channel.Items, 3)
+
+		// Newest first
+		attachmentItem := feed.Channel.Items[0]
+		require.Equal(t, "With attachment", attachmentItem.Title)
+		require.NotNil(t, attachmentItem.Enclosure)
+		require.Equal(t, "https://example.com/file.jpg", attachmentItem.Enclosure.URL)
+		require.Equal(t, "image/jpeg", attachmentItem.Enclosure.Type)
+
+		markdownItem := feed.Channel.Items[1]
+		require.Equal(t, "Markdown", markdownItem.Title)
+		require.Equal(t, "https://example.com/details", markdownItem.Link)
+		require.Contains(t, markdownItem.Description, "<strong>bold</strong>")
+		require.NotContains(t, markdownItem.Description, "<script>")
+		require.Equal(t, []string{"warning", "backup"}, markdownItem.Categories)
+		require.Equal(t, "false", markdownItem.GUID.IsPermaLink)
+		require.NotEmpty(t, markdownItem.GUID.Value)
+
+		plainItem := feed.Channel.Items[2]
+		require.Equal(t, "first line", plainItem.Title)
+		require.Equal(t, "http://127.0.0.1:12345/mytopic", plainItem.Link)
+		require.Equal(t, "first line<br>\nsecond &lt;line&gt;", plainItem.Description)
+		require.Nil(t, plainItem.Enclosure)
+	})
+}
+
+func TestServer_SubscribeAtom(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		s := newTestServer(t, newTestConfig(t, databaseURL))
+
+		request(t, s, "PUT", "/mytopic", "to be deleted", map[string]string{
+			"X-Sequence-ID": "seq1",
+		})
+		request(t, s, "PUT", "/mytopic", "first version", map[string]string{
+			"X-Sequence-ID": "seq2",
+		})
+		request(t, s, "PUT", "/mytopic", "second version", map[string]string{
+			"X-Sequence-ID": "seq2",
+			"Tags":          "tag1",
+			"Attach":        "https://example.com/file.pdf",
+		})
+		request(t, s, "DELETE", "/mytopic/seq1", "", nil)
+
+		response := request(t, s, "GET", "/mytopic/atom", "", nil)
+		require.Equal(t, 200, response.Code)
+		require.Equal(t, "application/atom+xml; charset=utf-8", response.Header().Get("Content-Type"))
+
+		var feed atomFeed
+		require.Nil(t, xml.Unmarshal(response.Body.Bytes(), &feed))
+		require.Equal(t, "http://127.0.0.1:12345/mytopic", feed.ID)
+		require.Len(t, feed.Entries, 1)
+		entry := feed.Entries[0]
+		require.Equal(t, "second version", entry.Title)
+		require.Equal(t, "html", entry.Content.Type)
+		require.Equal(t, []atomCategory{{Term: "tag1"}}, entry.Categories)
+		require.Len(t, entry.Links, 2)
+		require.Equal(t, "enclosure", entry.Links[1].Rel)
+		require.Equal(t, "https://example.com/file.pdf", entry.Links[1].Href)
+		require.Equal(t, "application/pdf", entry.Links[1].Type)
+	})
+}
+
+func TestServer_SubscribeFeed_ETag(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		s := newTestServer(t, newTestConfig(t, databaseURL))
+		request(t, s, "PUT", "/mytopic", "message 1", nil)
+
+		response := request(t, s, "GET", "/mytopic/rss", "", nil)
+		require.Equal(t, 200, response.Code)
+		etag := response.Header().Get("ETag")
+		require.NotEmpty(t, etag)
+
+		response = request(t, s, "GET", "/mytopic/rss", "", map[string]string{
+			"If-None-Match": etag,
+		})
+		require.Equal(t, 304, response.Code)
+		require.Empty(t, response.Body.String())
+
+		// Atom feed has a different ETag
+		response = request(t, s, "GET", "/mytopic/atom", "", map[string]string{
+			"If-None-Match": etag,
+		})
+		require.Equal(t, 200, response.Code)
+
+		// New message, new ETag
+		request(t, s, "PUT", "/mytopic", "message 2", nil)
+		response = request(t, s, "GET", "/mytopic/rss", "", map[string]string{
+			"If-None-Match": etag,
+		})
+		require.Equal(t, 200, response.Code)
+		require.NotEqual(t, etag, response.Header().Get("ETag"))
+	})
+}
+
+func TestServer_SubscribeFeed_Auth(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		c := newTestConfigWithAuthFile(t, databaseURL)
+		c.AuthDefault = user.PermissionDenyAll
+		s := newTestServer(t, c)
+
+		require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser, false))
+		require.Nil(t, s.userManager.AllowAccess("ben", "mytopic", user.PermissionReadWrite))
+		request(t, s, "PUT", "/mytopic", "secret", map[string]string{
+			"Authorization": util.BasicAuth("ben", "ben"),
+		})
+
+		response := request(t, s, "GET", "/mytopic/rss", "", nil)
+		require.Equal(t, 403, response.Code)
+
+		response = request(t, s, "GET", "/mytopic,othertopic/atom", "", map[string]string{
+			"Authorization": util.BasicAuth("ben", "ben"),
+		})
+		require.Equal(t, 403, response.Code)
+
+		u := fmt.Sprintf("/mytopic/rss?auth=%s", base64.RawURLEncoding.EncodeToString([]byte(util.BasicAuth("ben", "ben"))))
+		response = request(t, s, "GET", u, "", nil)
+		require.Equal(t, 200, response.Code)
+		var feed rssFeed
+		require.Nil(t, xml.Unmarshal(response.Body.Bytes(), &feed))
+		require.Len(t, feed.Channel.Items, 1)
+		require.Equal(t, "secret", feed.Channel.Items[0].Title)
+		require.NotContains(t, response.Body.String(), "auth=")
+	})
+}
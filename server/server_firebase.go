@@ -198,6 +198,9 @@ func toFirebaseMessage(m *model.Message, auther user.Auther) (*messaging.Message
 		if m.PollID != "" {
 			data["poll_id"] = m.PollID
 		}
+		if m.InReplyTo != "" {
+			data["in_reply_to"] = m.InReplyTo
+		}
 		apnsConfig = createAPNSAlertConfig(m, data)
 	}
 	var androidConfig *messaging.AndroidConfig
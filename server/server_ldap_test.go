@@ -0,0 +1,128 @@
+package server
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"heckel.io/ntfy/v2/test/ldaptest"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestServer_LDAPAuth_PublishAndSubscribe(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		s := newTestServer(t, newTestConfigWithLDAP(t, databaseURL, newTestLDAPServer(t)))
+
+		// Group grants apply, default access is deny-all
+		response := request(t, s, "PUT", "/alerts", "hi", map[string]string{
+			"Authorization": util.BasicAuth("ben", "ben-pass"),
+		})
+		require.Equal(t, 200, response.Code)
+		response = request(t, s, "PUT", "/other", "hi", map[string]string{
+			"Authorization": util.BasicAuth("ben", "ben-pass"),
+		})
+		require.Equal(t, 403, response.Code)
+
+		// Admin group maps to admin role
+		response = request(t, s, "PUT", "/other", "hi", map[string]string{
+			"Authorization": util.BasicAuth("phil", "phil-pass"),
+		})
+		require.Equal(t, 200, response.Code)
+
+		// Wrong password
+		response = request(t, s, "GET", "/alerts/json?poll=1", "", map[string]string{
+			"Authorization": util.BasicAuth("ben", "wrong-pass"),
+		})
+		require.Equal(t, 401, response.Code)
+	})
+}
+
+func TestServer_LDAPAuth_Account(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		s := newTestServer(t, newTestConfigWithLDAP(t, databaseURL, newTestLDAPServer(t)))
+
+		// Login token works like for local users
+		response := request(t, s, "POST", "/v1/account/token", "", map[string]string{
+			"Authorization": util.BasicAuth("ben", "ben-pass"),
+		})
+		require.Equal(t, 200, response.Code)
+		token, _ := util.UnmarshalJSON[apiAccountTokenResponse](io.NopCloser(response.Body))
+		response = request(t, s, "GET", "/v1/account", "", map[string]string{
+			"Authorization": util.BearerAuth(token.Token),
+		})
+		require.Equal(t, 200, response.Code)
+		account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(response.Body))
+		require.Equal(t, "ben", account.Username)
+
+		// Password is managed by the LDAP server
+		response = request(t, s, "POST", "/v1/account/password", `{"password": "ben-pass", "new_password": "new-pass"}`, map[string]string{
+			"Authorization": util.BearerAuth(token.Token),
+		})
+		require.Equal(t, 409, response.Code)
+		require.Equal(t, 40909, toHTTPError(t, response.Body.String()).Code)
+		response = request(t, s, "POST", "/v1/account/password", `{"password": "wrong-pass", "new_password": "new-pass"}`, map[string]string{
+			"Authorization": util.BearerAuth(token.Token),
+		})
+		require.Equal(t, 400, response.Code)
+	})
+}
+
+func TestServer_LDAPAuth_ProvisionedUser(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		hash, err := bcrypt.GenerateFromPassword([]byte("local-pass"), bcrypt.MinCost)
+		require.Nil(t, err)
+		conf := newTestConfigWithLDAP(t, databaseURL, newTestLDAPServer(t))
+		conf.AuthUsers = []*user.User{{Name: "backup", Hash: string(hash), Role: user.RoleUser}}
+		conf.AuthAccess = map[string][]*user.Grant{"backup": {{TopicPattern: "backups", Permission: user.PermissionWrite}}}
+		s := newTestServer(t, conf)
+
+		response := request(t, s, "PUT", "/backups", "done", map[string]string{
+			"Authorization": util.BasicAuth("backup", "local-pass"),
+		})
+		require.Equal(t, 200, response.Code)
+	})
+}
+
+func newTestLDAPServer(t *testing.T) *ldaptest.Server {
+	return ldaptest.NewServer(t,
+		&ldaptest.Entry{
+			DN:         "uid=phil,ou=people,dc=example,dc=com",
+			Password:   "phil-pass",
+			Attributes: map[string][]string{"uid": {"phil"}},
+		},
+		&ldaptest.Entry{
+			DN:         "uid=ben,ou=people,dc=example,dc=com",
+			Password:   "ben-pass",
+			Attributes: map[string][]string{"uid": {"ben"}},
+		},
+		&ldaptest.Entry{
+			DN: "cn=ntfy-admins,ou=groups,dc=example,dc=com",
+			Attributes: map[string][]string{
+				"cn":     {"ntfy-admins"},
+				"member": {"uid=phil,ou=people,dc=example,dc=com"},
+			},
+		},
+		&ldaptest.Entry{
+			DN: "cn=alerts,ou=groups,dc=example,dc=com",
+			Attributes: map[string][]string{
+				"cn":     {"alerts"},
+				"member": {"uid=ben,ou=people,dc=example,dc=com"},
+			},
+		},
+	)
+}
+
+func newTestConfigWithLDAP(t *testing.T, databaseURL string, server *ldaptest.Server) *Config {
+	conf := newTestConfigWithAuthFile(t, databaseURL)
+	conf.AuthDefault = user.PermissionDenyAll
+	conf.LDAPURL = server.URL
+	conf.LDAPUserBaseDN = "ou=people,dc=example,dc=com"
+	conf.LDAPGroupBaseDN = "ou=groups,dc=example,dc=com"
+	conf.LDAPAdminGroups = []string{"ntfy-admins"}
+	conf.LDAPGroupAccess = map[string][]*user.Grant{
+		"alerts": {{TopicPattern: "alerts", Permission: user.PermissionReadWrite}},
+	}
+	return conf
+}
@@ -15,6 +15,7 @@ func (s *Server) execManager() {
 	s.pruneAttachments()
 	s.pruneMessages()
 	s.pruneAndNotifyWebPushSubscriptions()
+	s.pruneAPNSDevices()
 
 	// Message count
 	messagesCached, err := s.messageCache.MessagesCount()
@@ -133,8 +134,11 @@ func (s *Server) pruneTokens() {
 				if err := s.userManager.RemoveDeletedUsers(); err != nil {
 					log.Tag(tagManager).Err(err).Warn("Error deleting soft-deleted users")
 				}
+				if err := s.userManager.RemoveExpiredAuditEntries(); err != nil {
+					log.Tag(tagManager).Err(err).Warn("Error deleting expired audit log entries")
+				}
 			}).
-			Debug("Finished deleting expired tokens and users")
+			Debug("Finished deleting expired tokens, users and audit log entries")
 	}
 }
 
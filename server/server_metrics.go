@@ -11,18 +11,25 @@ var (
 	metricMessagePublishDurationMillis prometheus.Gauge
 	metricFirebasePublishedSuccess     prometheus.Counter
 	metricFirebasePublishedFailure     prometheus.Counter
+	metricAPNSPublishedSuccess         prometheus.Counter
+	metricAPNSPublishedFailure         prometheus.Counter
 	metricEmailsPublishedSuccess       prometheus.Counter
 	metricEmailsPublishedFailure       prometheus.Counter
 	metricEmailsReceivedSuccess        prometheus.Counter
 	metricEmailsReceivedFailure        prometheus.Counter
 	metricCallsMadeSuccess             prometheus.Counter
 	metricCallsMadeFailure             prometheus.Counter
+	metricCallsAcknowledged            prometheus.Counter
+	metricSMSSentSuccess               prometheus.Counter
+	metricSMSSentFailure               prometheus.Counter
 	metricUnifiedPushPublishedSuccess  prometheus.Counter
 	metricMatrixPublishedSuccess       prometheus.Counter
 	metricMatrixPublishedFailure       prometheus.Counter
 	metricAttachmentsTotalSize         prometheus.Gauge
 	metricVisitors                     prometheus.Gauge
 	metricSubscribers                  prometheus.Gauge
+	metricSubscribersLagging           prometheus.Gauge
+	metricSubscriberMessagesDropped    prometheus.Counter
 	metricTopics                       prometheus.Gauge
 	metricUsers                        prometheus.Gauge
 	metricHTTPRequests                 *prometheus.CounterVec
@@ -47,6 +54,12 @@ func initMetrics() {
 	metricFirebasePublishedFailure = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "ntfy_firebase_published_failure",
 	})
+	metricAPNSPublishedSuccess = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ntfy_apns_published_success",
+	})
+	metricAPNSPublishedFailure = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ntfy_apns_published_failure",
+	})
 	metricEmailsPublishedSuccess = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "ntfy_emails_sent_success",
 	})
@@ -65,6 +78,15 @@ func initMetrics() {
 	metricCallsMadeFailure = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "ntfy_calls_made_failure",
 	})
+	metricCallsAcknowledged = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ntfy_calls_acknowledged",
+	})
+	metricSMSSentSuccess = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ntfy_sms_sent_success",
+	})
+	metricSMSSentFailure = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ntfy_sms_sent_failure",
+	})
 	metricUnifiedPushPublishedSuccess = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "ntfy_unifiedpush_published_success",
 	})
@@ -86,6 +108,12 @@ func initMetrics() {
 	metricSubscribers = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "ntfy_subscribers_total",
 	})
+	metricSubscribersLagging = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ntfy_subscribers_lagging",
+	})
+	metricSubscriberMessagesDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ntfy_subscriber_messages_dropped_total",
+	})
 	metricTopics = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "ntfy_topics_total",
 	})
@@ -99,12 +127,17 @@ func initMetrics() {
 		metricMessagePublishDurationMillis,
 		metricFirebasePublishedSuccess,
 		metricFirebasePublishedFailure,
+		metricAPNSPublishedSuccess,
+		metricAPNSPublishedFailure,
 		metricEmailsPublishedSuccess,
 		metricEmailsPublishedFailure,
 		metricEmailsReceivedSuccess,
 		metricEmailsReceivedFailure,
 		metricCallsMadeSuccess,
 		metricCallsMadeFailure,
+		metricCallsAcknowledged,
+		metricSMSSentSuccess,
+		metricSMSSentFailure,
 		metricUnifiedPushPublishedSuccess,
 		metricMatrixPublishedSuccess,
 		metricMatrixPublishedFailure,
@@ -112,6 +145,8 @@ func initMetrics() {
 		metricVisitors,
 		metricUsers,
 		metricSubscribers,
+		metricSubscribersLagging,
+		metricSubscriberMessagesDropped,
 		metricTopics,
 		metricHTTPRequests,
 	)
@@ -124,6 +159,20 @@ func minc(counter prometheus.Counter) {
 	}
 }
 
+// madd adds a value to a prometheus.Counter if it is non-nil
+func madd[T int | int64 | float64](counter prometheus.Counter, value T) {
+	if counter != nil {
+		counter.Add(float64(value))
+	}
+}
+
+// mdec decrements a prometheus.Gauge if it is non-nil
+func mdec(gauge prometheus.Gauge) {
+	if gauge != nil {
+		gauge.Dec()
+	}
+}
+
 // mset sets a prometheus.Gauge if it is non-nil
 func mset[T int | int64 | float64](gauge prometheus.Gauge, value T) {
 	if gauge != nil {
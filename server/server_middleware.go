@@ -12,6 +12,7 @@ const (
 	contextRateVisitor contextKey = iota + 2586
 	contextTopic
 	contextMatrixPushKey
+	contextAttachmentType
 )
 
 func (s *Server) limitRequests(next handleFunc) handleFunc {
@@ -58,6 +59,15 @@ func (s *Server) ensureWebEnabled(next handleFunc) handleFunc {
 	}
 }
 
+func (s *Server) ensureAPNSEnabled(next handleFunc) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
+		if s.apns == nil {
+			return errHTTPNotFound
+		}
+		return next(w, r, v)
+	}
+}
+
 func (s *Server) ensureWebPushEnabled(next handleFunc) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
 		if s.config.WebRoot == "" || s.config.WebPushPublicKey == "" {
@@ -78,8 +88,22 @@ func (s *Server) ensureUserManager(next handleFunc) handleFunc {
 
 func (s *Server) ensureUser(next handleFunc) handleFunc {
 	return s.ensureUserManager(func(w http.ResponseWriter, r *http.Request, v *visitor) error {
-		if v.User() == nil {
+		u := v.User()
+		if u == nil {
 			return errHTTPUnauthorized
+		} else if u.Scope != nil && u.Scope.NoAccount {
+			return errHTTPForbiddenTokenScope
+		}
+		return next(w, r, v)
+	})
+}
+
+// ensureUnscoped ensures that the request is made by a user, and not with a scoped access token. This is used
+// for account changes that could be used to escalate privileges, e.g. creating new (unscoped) tokens.
+func (s *Server) ensureUnscoped(next handleFunc) handleFunc {
+	return s.ensureUser(func(w http.ResponseWriter, r *http.Request, v *visitor) error {
+		if v.User().Scope != nil {
+			return errHTTPForbiddenTokenScope
 		}
 		return next(w, r, v)
 	})
@@ -87,8 +111,11 @@ func (s *Server) ensureUser(next handleFunc) handleFunc {
 
 func (s *Server) ensureAdmin(next handleFunc) handleFunc {
 	return s.ensureUserManager(func(w http.ResponseWriter, r *http.Request, v *visitor) error {
-		if !v.User().IsAdmin() {
+		u := v.User()
+		if !u.IsAdmin() {
 			return errHTTPUnauthorized
+		} else if u.Scope != nil {
+			return errHTTPForbiddenTokenScope
 		}
 		return next(w, r, v)
 	})
@@ -96,7 +123,16 @@ func (s *Server) ensureAdmin(next handleFunc) handleFunc {
 
 func (s *Server) ensureCallsEnabled(next handleFunc) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
-		if s.config.TwilioAccount == "" || s.userManager == nil {
+		if s.telephony == nil || s.userManager == nil {
+			return errHTTPNotFound
+		}
+		return next(w, r, v)
+	}
+}
+
+func (s *Server) ensureOIDCEnabled(next handleFunc) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
+		if s.oidc == nil || s.userManager == nil {
 			return errHTTPNotFound
 		}
 		return next(w, r, v)
@@ -122,7 +158,7 @@ func (s *Server) ensurePaymentsEnabled(next handleFunc) handleFunc {
 }
 
 func (s *Server) ensureStripeCustomer(next handleFunc) handleFunc {
-	return s.ensureUser(func(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	return s.ensureUnscoped(func(w http.ResponseWriter, r *http.Request, v *visitor) error {
 		if v.User().Billing.StripeCustomerID == "" {
 			return errHTTPBadRequestNotAPaidUser
 		}
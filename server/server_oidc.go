@@ -0,0 +1,467 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"golang.org/x/oauth2"
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+// OpenID Connect login:
+//
+// The web app (or any browser) calls GET /v1/auth/oidc/login, which redirects to the identity provider's
+// authorization endpoint (authorization code flow with PKCE). The provider redirects back to
+// GET /v1/auth/oidc/callback, where the code is exchanged for an ID token. The ID token is verified against
+// the provider's JWKS, the user is provisioned (or updated) from its claims, and a regular ntfy session token
+// is issued via user.Manager.CreateToken, exactly like a username/password login.
+
+const (
+	oidcDiscoveryPath       = "/.well-known/openid-configuration"
+	oidcStateCookie         = "ntfy_oidc_state"
+	oidcStateExpiry         = 10 * time.Minute
+	oidcStateLimit          = 10000 // Max. number of pending logins, to avoid unbounded memory usage
+	oidcHTTPTimeout         = 10 * time.Second
+	oidcKeysRefreshInterval = time.Minute // Min. interval between JWKS refreshes if an unknown key is encountered
+	oidcClockLeeway         = time.Minute
+	oidcPasswordLength      = 32
+	oidcWebAppTokenParam    = "oidc_token"
+	oidcWebAppUsernameParam = "oidc_username"
+	oidcSubjectClaim        = "sub"
+	oidcExternalIDPrefix    = "oidc:" // Prefix of user.User.ExternalID for users created via OIDC, followed by the subject
+)
+
+var oidcSignatureAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+// oidcProvider handles the communication with the OpenID Connect identity provider. Discovery metadata
+// and signing keys are fetched lazily on first use, so that the server can start even if the provider is down.
+type oidcProvider struct {
+	config      *Config
+	client      *http.Client
+	metadata    *oidcMetadata
+	keys        *jose.JSONWebKeySet
+	keysUpdated time.Time
+	states      map[string]*oidcState // State -> pending login
+	mu          sync.Mutex
+}
+
+// oidcMetadata is the relevant subset of the provider's discovery document,
+// see https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderMetadata
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcState is a pending login, created when the user is redirected to the provider
+type oidcState struct {
+	nonce    string
+	verifier string // PKCE code verifier
+	expires  time.Time
+}
+
+func newOIDCProvider(conf *Config) *oidcProvider {
+	return &oidcProvider{
+		config: conf,
+		client: &http.Client{Timeout: oidcHTTPTimeout},
+		states: make(map[string]*oidcState),
+	}
+}
+
+// handleAuthOIDCLogin starts the login by redirecting to the provider's authorization endpoint
+func (s *Server) handleAuthOIDCLogin(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	metadata, err := s.oidc.Metadata(r.Context())
+	if err != nil {
+		return errHTTPInternalErrorOIDCProviderUnavailable.Wrap("%s", err.Error())
+	}
+	state, nonce, verifier, err := s.oidc.AddState()
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     apiAuthOIDCPath,
+		MaxAge:   int(oidcStateExpiry.Seconds()),
+		Secure:   strings.HasPrefix(s.config.BaseURL, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	authURL := s.oidc.OAuth2Config(metadata).AuthCodeURL(state, oauth2.S256ChallengeOption(verifier), oauth2.SetAuthURLParam("nonce", nonce))
+	logvr(v, r).Tag(tagOIDC).Debug("Redirecting to OpenID Connect provider %s", metadata.Issuer)
+	http.Redirect(w, r, authURL, http.StatusFound)
+	return nil
+}
+
+// handleAuthOIDCCallback completes the login: It verifies the state, exchanges the authorization code for
+// an ID token, provisions or updates the user from the ID token claims, and issues a ntfy session token.
+// If the web app is enabled, the token is passed to it via the URL fragment, otherwise it is returned as JSON.
+func (s *Server) handleAuthOIDCCallback(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	if errorCode := r.URL.Query().Get("error"); errorCode != "" {
+		return errHTTPUnauthorizedOIDC.Wrap("provider returned error %s: %s", errorCode, r.URL.Query().Get("error_description"))
+	}
+	stateParam, code := r.URL.Query().Get("state"), r.URL.Query().Get("code")
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || stateParam == "" || code == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(stateParam)) != 1 {
+		return errHTTPBadRequestOIDCStateInvalid
+	}
+	state := s.oidc.RemoveState(stateParam)
+	if state == nil {
+		return errHTTPBadRequestOIDCStateInvalid
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   oidcStateCookie,
+		Path:   apiAuthOIDCPath,
+		MaxAge: -1,
+	})
+	claims, err := s.oidc.Exchange(r.Context(), code, state)
+	if err != nil {
+		logvr(v, r).Tag(tagOIDC).Err(err).Warn("OpenID Connect login failed")
+		v.AuthFailed()
+		return errHTTPUnauthorizedOIDC
+	}
+	u, err := s.oidcSyncUser(v, r, claims)
+	if err != nil {
+		return err
+	}
+	token, err := s.userManager.CreateToken(u.ID, "", time.Now().Add(tokenExpiryDuration), v.IP(), nil, false)
+	if err != nil {
+		return err
+	}
+	logvr(v, r).Tag(tagOIDC).Field("user_name", u.Name).Info("User %s logged in via OpenID Connect", u.Name)
+	if s.config.WebRoot == "" {
+		return s.writeJSON(w, &apiAccountTokenResponse{
+			ID:         token.ID,
+			Token:      token.Value,
+			Prefix:     token.Prefix,
+			Label:      token.Label,
+			LastAccess: token.LastAccess.Unix(),
+			LastOrigin: token.LastOrigin.String(),
+			Expires:    token.Expires.Unix(),
+		})
+	}
+	fragment := url.Values{}
+	fragment.Set(oidcWebAppTokenParam, token.Value)
+	fragment.Set(oidcWebAppUsernameParam, u.Name)
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	http.Redirect(w, r, strings.TrimSuffix(s.config.BaseURL, "/")+webAppLoginPath+"#"+fragment.Encode(), http.StatusFound)
+	return nil
+}
+
+// oidcSyncUser provisions the user on first login, and updates role, tier and grants from the ID token
+// claims on every login.
+//
+// Users are linked to the provider's stable subject identifier ("sub" claim), not to the username claim. The
+// username is only used to name the user on first login. Existing users that were not created via OIDC (local
+// users, and users provisioned via the config file) are never taken over, even if their username matches.
+func (s *Server) oidcSyncUser(v *visitor, r *http.Request, claims map[string]any) (*user.User, error) {
+	subject := oidcClaimString(claims, oidcSubjectClaim)
+	if subject == "" {
+		return nil, errHTTPUnauthorizedOIDC.Wrap("claim %s is missing", oidcSubjectClaim)
+	}
+	externalID := oidcExternalIDPrefix + subject
+	role := user.RoleUser
+	if s.config.OIDCRoleClaim != "" && slices.ContainsFunc(oidcClaimStrings(claims, s.config.OIDCRoleClaim), func(role string) bool {
+		return slices.Contains(s.config.OIDCAdminRoles, role)
+	}) {
+		role = user.RoleAdmin
+	}
+	groups := oidcClaimStrings(claims, s.config.OIDCGroupsClaim)
+	u, err := s.userManager.UserByExternalID(externalID)
+	if errors.Is(err, user.ErrUserNotFound) {
+		username := oidcClaimString(claims, s.config.OIDCUsernameClaim)
+		if !user.AllowedUsername(username) {
+			return nil, errHTTPUnauthorizedOIDC.Wrap("claim %s is missing or not a valid username", s.config.OIDCUsernameClaim)
+		}
+		logvr(v, r).Tag(tagOIDC).Field("user_name", username).Info("Creating user %s from OpenID Connect login", username)
+		if err := s.userManager.AddExternalUser(username, util.RandomString(oidcPasswordLength), role, externalID); errors.Is(err, user.ErrUserExists) {
+			return nil, errHTTPUnauthorizedOIDC.Wrap("user %s already exists, and was not created via OpenID Connect", username)
+		} else if err != nil {
+			return nil, err
+		}
+		if u, err = s.userManager.User(username); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else if u.Deleted {
+		return nil, errHTTPUnauthorizedOIDC.Wrap("user is marked for deletion")
+	} else if s.config.OIDCRoleClaim != "" && u.Role != role {
+		logvr(v, r).Tag(tagOIDC).Field("user_name", u.Name).Info("Changing role of user %s to %s", u.Name, role)
+		if err := s.userManager.ChangeRole(u.Name, role); err != nil {
+			return nil, err
+		}
+		u.Role = role
+	}
+	if err := s.oidcSyncTier(u, groups); err != nil {
+		return nil, err
+	}
+	grants := make([]*user.Grant, 0)
+	if u.Role == user.RoleUser {
+		for _, group := range groups {
+			grants = append(grants, s.config.OIDCGroupAccess[group]...)
+		}
+	}
+	if err := s.userManager.SetManagedAccess(u.Name, grants); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// oidcSyncTier sets the user's tier to the tier of the first matching group mapping. If group-to-tier
+// mappings are configured and none of them match, the tier is removed, unless it is managed by Stripe.
+func (s *Server) oidcSyncTier(u *user.User, groups []string) error {
+	if len(s.config.OIDCGroupTiers) == 0 {
+		return nil
+	}
+	var tier string
+	for _, groupTier := range s.config.OIDCGroupTiers {
+		if slices.Contains(groups, groupTier.Group) {
+			tier = groupTier.Tier
+			break
+		}
+	}
+	if tier != "" && (u.Tier == nil || u.Tier.Code != tier) {
+		return s.userManager.ChangeTier(u.Name, tier)
+	} else if tier == "" && u.Tier != nil && (u.Billing == nil || u.Billing.StripeSubscriptionID == "") {
+		return s.userManager.ResetTier(u.Name)
+	}
+	return nil
+}
+
+// Metadata returns the provider's discovery document, fetching it on first use. The document is fetched
+// without holding the lock, so that a slow provider does not block pending logins (AddState, RemoveState).
+func (p *oidcProvider) Metadata(ctx context.Context) (*oidcMetadata, error) {
+	p.mu.Lock()
+	cached := p.metadata
+	p.mu.Unlock()
+	if cached != nil {
+		return cached, nil
+	}
+	var metadata oidcMetadata
+	if err := fetchJSON(ctx, p.client, strings.TrimSuffix(p.config.OIDCIssuer, "/")+oidcDiscoveryPath, &metadata); err != nil {
+		return nil, err
+	} else if metadata.Issuer != p.config.OIDCIssuer {
+		return nil, fmt.Errorf("issuer mismatch, expected %s, got %s", p.config.OIDCIssuer, metadata.Issuer)
+	} else if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, errors.New("discovery document incomplete, authorization_endpoint, token_endpoint and jwks_uri are required")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.metadata == nil {
+		p.metadata = &metadata
+	}
+	return p.metadata, nil
+}
+
+// OAuth2Config returns the OAuth 2.0 client configuration for the given provider metadata
+func (p *oidcProvider) OAuth2Config(metadata *oidcMetadata) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     p.config.OIDCClientID,
+		ClientSecret: p.config.OIDCClientSecret,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  metadata.AuthorizationEndpoint,
+			TokenURL: metadata.TokenEndpoint,
+		},
+		RedirectURL: p.config.BaseURL + apiAuthOIDCCallbackPath,
+		Scopes:      p.config.OIDCScopes,
+	}
+}
+
+// AddState creates a new pending login, and returns its state, nonce and PKCE code verifier
+func (p *oidcProvider) AddState() (state, nonce, verifier string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for s, pending := range p.states {
+		if now.After(pending.expires) {
+			delete(p.states, s)
+		}
+	}
+	if len(p.states) >= oidcStateLimit {
+		return "", "", "", errHTTPTooManyRequestsLimitAccountActions
+	}
+	state, nonce, verifier = util.RandomString(32), util.RandomString(32), oauth2.GenerateVerifier()
+	p.states[state] = &oidcState{
+		nonce:    nonce,
+		verifier: verifier,
+		expires:  now.Add(oidcStateExpiry),
+	}
+	return state, nonce, verifier, nil
+}
+
+// RemoveState removes and returns the pending login for the given state, or nil if it does not exist or is expired
+func (p *oidcProvider) RemoveState(state string) *oidcState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pending, ok := p.states[state]
+	if !ok {
+		return nil
+	}
+	delete(p.states, state)
+	if time.Now().After(pending.expires) {
+		return nil
+	}
+	return pending
+}
+
+// Exchange exchanges the authorization code for tokens, and returns the claims of the verified ID token
+func (p *oidcProvider) Exchange(ctx context.Context, code string, state *oidcState) (map[string]any, error) {
+	metadata, err := p.Metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, p.client)
+	token, err := p.OAuth2Config(metadata).Exchange(ctx, code, oauth2.VerifierOption(state.verifier))
+	if err != nil {
+		return nil, err
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok || rawIDToken == "" {
+		return nil, errors.New("token response does not contain an id_token")
+	}
+	return p.Verify(ctx, rawIDToken, state.nonce)
+}
+
+// Verify verifies the ID token's signature, issuer, audience, expiry and nonce, and returns its claims
+func (p *oidcProvider) Verify(ctx context.Context, rawIDToken, nonce string) (map[string]any, error) {
+	idToken, err := jwt.ParseSigned(rawIDToken, oidcSignatureAlgorithms)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := p.Keys(ctx, idToken.Headers)
+	if err != nil {
+		return nil, err
+	}
+	var standardClaims jwt.Claims
+	var claims map[string]any
+	if err := idToken.Claims(keys, &standardClaims, &claims); err != nil {
+		return nil, err
+	}
+	expected := jwt.Expected{
+		Issuer:      p.config.OIDCIssuer,
+		AnyAudience: jwt.Audience{p.config.OIDCClientID},
+	}
+	if err := standardClaims.ValidateWithLeeway(expected, oidcClockLeeway); err != nil {
+		return nil, err
+	} else if standardClaims.Expiry == nil {
+		return nil, errors.New("id_token has no expiry")
+	} else if azp, ok := claims["azp"].(string); ok && azp != p.config.OIDCClientID {
+		return nil, fmt.Errorf("id_token authorized party mismatch, expected %s, got %s", p.config.OIDCClientID, azp)
+	} else if claimNonce, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(claimNonce), []byte(nonce)) != 1 {
+		return nil, errors.New("id_token nonce mismatch")
+	}
+	return claims, nil
+}
+
+// Keys returns the provider's signing keys. The key set is fetched on first use, and refreshed
+// (at most once per oidcKeysRefreshInterval) if a token references an unknown key ID, e.g. after key rotation.
+// Like the discovery document, the key set is fetched without holding the lock.
+func (p *oidcProvider) Keys(ctx context.Context, headers []jose.Header) (*jose.JSONWebKeySet, error) {
+	metadata, err := p.Metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	cached, updated := p.keys, p.keysUpdated
+	p.mu.Unlock()
+	if cached != nil && (oidcKeysContain(cached, headers) || time.Since(updated) < oidcKeysRefreshInterval) {
+		return cached, nil
+	}
+	var keys jose.JSONWebKeySet
+	if err := fetchJSON(ctx, p.client, metadata.JWKSURI, &keys); err != nil {
+		return nil, err
+	}
+	log.Tag(tagOIDC).Debug("Fetched %d signing key(s) from %s", len(keys.Keys), metadata.JWKSURI)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys = &keys
+	p.keysUpdated = time.Now()
+	return p.keys, nil
+}
+
+// fetchJSON fetches the JSON document at the given URL, and decodes it into v
+func fetchJSON(ctx context.Context, client *http.Client, u string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response from %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// oidcKeysContain returns true if the key set contains the key IDs referenced in the JWS headers
+func oidcKeysContain(keys *jose.JSONWebKeySet, headers []jose.Header) bool {
+	for _, header := range headers {
+		if len(keys.Key(header.KeyID)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// oidcClaim returns the claim with the given name. Nested claims can be referenced using a
+// dot-separated path, e.g. "realm_access.roles" (Keycloak).
+func oidcClaim(claims map[string]any, name string) any {
+	var value any = claims
+	for _, part := range strings.Split(name, ".") {
+		m, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = m[part]
+	}
+	return value
+}
+
+func oidcClaimString(claims map[string]any, name string) string {
+	s, _ := oidcClaim(claims, name).(string)
+	return s
+}
+
+// oidcClaimStrings returns a claim that is either a string or a list of strings as a list
+func oidcClaimStrings(claims map[string]any, name string) []string {
+	if name == "" {
+		return nil
+	}
+	switch value := oidcClaim(claims, name).(type) {
+	case string:
+		return []string{value}
+	case []any:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
@@ -0,0 +1,479 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestServer_OIDCLogin_ProvisionUser(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		p := newTestOIDCProvider(t)
+		s := newTestServer(t, newTestConfigWithOIDC(t, databaseURL, p))
+		require.Nil(t, s.userManager.AddTier(&user.Tier{Code: "pro"}))
+
+		p.SetClaims(map[string]any{
+			"preferred_username": "phil",
+			"groups":             []any{"ntfy-pro", "ops"},
+		})
+		rr := oidcLogin(t, s, p)
+		require.Equal(t, 302, rr.Code)
+		require.Equal(t, "no-referrer", rr.Header().Get("Referrer-Policy"))
+		location, err := url.Parse(rr.Header().Get("Location"))
+		require.Nil(t, err)
+		require.Equal(t, "http://127.0.0.1:12345/login", location.Scheme+"://"+location.Host+location.Path)
+		fragment, err := url.ParseQuery(location.Fragment)
+		require.Nil(t, err)
+		require.Equal(t, "phil", fragment.Get("oidc_username"))
+		token := fragment.Get("oidc_token")
+		require.NotEmpty(t, token)
+
+		// Session token works like a regular login token
+		response := request(t, s, "GET", "/v1/account", "", map[string]string{
+			"Authorization": "Bearer " + token,
+		})
+		require.Equal(t, 200, response.Code)
+		account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(response.Body))
+		require.Equal(t, "phil", account.Username)
+		require.Equal(t, "user", account.Role)
+		require.Equal(t, "pro", account.Tier.Code)
+
+		grants, err := s.userManager.Grants("phil")
+		require.Nil(t, err)
+		require.Len(t, grants, 1)
+		require.Equal(t, "ops_*", grants[0].TopicPattern)
+		require.Equal(t, user.PermissionReadWrite, grants[0].Permission)
+		require.True(t, grants[0].Managed)
+
+		u, err := s.userManager.User("phil")
+		require.Nil(t, err)
+		require.Equal(t, "oidc:1234", u.ExternalID)
+
+		// Cannot log in with a password
+		_, err = s.userManager.Authenticate("phil", "")
+		require.Equal(t, user.ErrUnauthenticated, err)
+	})
+}
+
+func TestServer_OIDCLogin_UpdateUser(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		p := newTestOIDCProvider(t)
+		s := newTestServer(t, newTestConfigWithOIDC(t, databaseURL, p))
+		require.Nil(t, s.userManager.AddTier(&user.Tier{Code: "pro"}))
+
+		// First login as admin, with tier
+		p.SetClaims(map[string]any{
+			"preferred_username": "phil",
+			"realm_access":       map[string]any{"roles": []any{"ntfy-admin"}},
+			"groups":             []any{"ntfy-pro"},
+		})
+		require.Equal(t, 302, oidcLogin(t, s, p).Code)
+		u, err := s.userManager.User("phil")
+		require.Nil(t, err)
+		require.Equal(t, user.RoleAdmin, u.Role)
+		require.Equal(t, "pro", u.Tier.Code)
+
+		// Second login: role and tier removed at the provider
+		p.SetClaims(map[string]any{
+			"preferred_username": "phil",
+			"realm_access":       map[string]any{"roles": []any{"other"}},
+		})
+		require.Equal(t, 302, oidcLogin(t, s, p).Code)
+		u, err = s.userManager.User("phil")
+		require.Nil(t, err)
+		require.Equal(t, user.RoleUser, u.Role)
+		require.Nil(t, u.Tier)
+	})
+}
+
+func TestServer_OIDCLogin_RevokeGrants(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		p := newTestOIDCProvider(t)
+		s := newTestServer(t, newTestConfigWithOIDC(t, databaseURL, p))
+
+		// First login: group grant is added
+		p.SetClaims(map[string]any{
+			"preferred_username": "phil",
+			"groups":             []any{"ops"},
+		})
+		require.Equal(t, 302, oidcLogin(t, s, p).Code)
+		require.Nil(t, s.userManager.AllowAccess("phil", "manual", user.PermissionRead))
+		grants, err := s.userManager.Grants("phil")
+		require.Nil(t, err)
+		require.Len(t, grants, 2)
+
+		// Second login: user left the group, grant is revoked, manual grant is kept
+		p.SetClaims(map[string]any{
+			"preferred_username": "phil",
+			"groups":             []any{},
+		})
+		require.Equal(t, 302, oidcLogin(t, s, p).Code)
+		grants, err = s.userManager.Grants("phil")
+		require.Nil(t, err)
+		require.Len(t, grants, 1)
+		require.Equal(t, "manual", grants[0].TopicPattern)
+		require.False(t, grants[0].Managed)
+	})
+}
+
+func TestServer_OIDCLogin_LinkedBySubject(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	s := newTestServer(t, newTestConfigWithOIDC(t, "", p))
+
+	// Username changed at the provider: same subject, same user
+	p.SetClaims(map[string]any{"sub": "abcd", "preferred_username": "phil"})
+	require.Equal(t, 302, oidcLogin(t, s, p).Code)
+	p.SetClaims(map[string]any{"sub": "abcd", "preferred_username": "philipp"})
+	rr := oidcLogin(t, s, p)
+	require.Equal(t, 302, rr.Code)
+	location, err := url.Parse(rr.Header().Get("Location"))
+	require.Nil(t, err)
+	fragment, err := url.ParseQuery(location.Fragment)
+	require.Nil(t, err)
+	require.Equal(t, "phil", fragment.Get("oidc_username"))
+	_, err = s.userManager.User("philipp")
+	require.Equal(t, user.ErrUserNotFound, err)
+
+	// Different subject, same username: not the same user
+	p.SetClaims(map[string]any{"sub": "efgh", "preferred_username": "phil"})
+	rr = oidcLogin(t, s, p)
+	require.Equal(t, 401, rr.Code)
+	require.Equal(t, 40102, toHTTPError(t, rr.Body.String()).Code)
+}
+
+func TestServer_OIDCLogin_ExistingUserNotTakenOver(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	c := newTestConfigWithOIDC(t, "", p)
+	c.AuthUsers = []*user.User{{Name: "provisioned", Hash: "$2a$10$YLiO8U21sX1uhZamTLJXHuxgVC0Z/GKISibrKCLohPgtG7yIxSk4C", Role: user.RoleAdmin, Provisioned: true}}
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin, false))
+
+	for _, username := range []string{"phil", "provisioned"} {
+		p.SetClaims(map[string]any{
+			"preferred_username": username,
+			"groups":             []any{"ops"},
+		})
+		rr := oidcLogin(t, s, p)
+		require.Equal(t, 401, rr.Code)
+		require.Equal(t, 40102, toHTTPError(t, rr.Body.String()).Code)
+		u, err := s.userManager.User(username)
+		require.Nil(t, err)
+		require.Equal(t, user.RoleAdmin, u.Role)
+		require.Equal(t, "", u.ExternalID)
+	}
+}
+
+func TestServer_OIDCLogin_BaseURLWithPath(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	c := newTestConfigWithOIDC(t, "", p)
+	c.BaseURL = "https://example.com/ntfy"
+	s := newTestServer(t, c)
+
+	p.SetClaims(map[string]any{"preferred_username": "phil"})
+	rr := oidcLogin(t, s, p)
+	require.Equal(t, 302, rr.Code)
+	location, err := url.Parse(rr.Header().Get("Location"))
+	require.Nil(t, err)
+	require.Equal(t, "https://example.com/ntfy/login", location.Scheme+"://"+location.Host+location.Path)
+}
+
+func TestOIDCProvider_SlowProviderDoesNotBlockLogins(t *testing.T) {
+	release := make(chan struct{})
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(provider.Close)
+	defer close(release)
+
+	p := newOIDCProvider(&Config{OIDCIssuer: provider.URL})
+	go p.Metadata(context.Background())
+	time.Sleep(100 * time.Millisecond) // Wait for the discovery request to be in flight
+
+	done := make(chan error)
+	go func() {
+		state, _, _, err := p.AddState()
+		p.RemoveState(state)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		require.Nil(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("AddState blocked by in-flight discovery request")
+	}
+}
+
+func TestServer_OIDCLogin_WebDisabled(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	c := newTestConfigWithOIDC(t, "", p)
+	c.WebRoot = ""
+	s := newTestServer(t, c)
+
+	p.SetClaims(map[string]any{"preferred_username": "phil"})
+	rr := oidcLogin(t, s, p)
+	require.Equal(t, 200, rr.Code)
+	token, _ := util.UnmarshalJSON[apiAccountTokenResponse](io.NopCloser(rr.Body))
+	require.NotEmpty(t, token.Token)
+	require.Greater(t, token.Expires, time.Now().Unix())
+}
+
+func TestServer_OIDCLogin_InvalidState(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	s := newTestServer(t, newTestConfigWithOIDC(t, "", p))
+	p.SetClaims(map[string]any{"preferred_username": "phil"})
+
+	rr := request(t, s, "GET", "/v1/auth/oidc/login", "", nil)
+	require.Equal(t, 302, rr.Code)
+	state := oidcAuthorizeParams(t, rr).Get("state")
+
+	// No cookie
+	response := request(t, s, "GET", "/v1/auth/oidc/callback?code=abc&state="+state, "", nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40059, toHTTPError(t, response.Body.String()).Code)
+
+	// Cookie does not match state
+	response = request(t, s, "GET", "/v1/auth/oidc/callback?code=abc&state="+state, "", map[string]string{
+		"Cookie": oidcStateCookie + "=other",
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40059, toHTTPError(t, response.Body.String()).Code)
+
+	// Unknown state
+	response = request(t, s, "GET", "/v1/auth/oidc/callback?code=abc&state=unknown", "", map[string]string{
+		"Cookie": oidcStateCookie + "=unknown",
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40059, toHTTPError(t, response.Body.String()).Code)
+
+	// Error returned by provider
+	response = request(t, s, "GET", "/v1/auth/oidc/callback?error=access_denied&error_description=nope", "", nil)
+	require.Equal(t, 401, response.Code)
+	require.Equal(t, 40102, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_OIDCLogin_InvalidIDToken(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	s := newTestServer(t, newTestConfigWithOIDC(t, "", p))
+
+	tests := []struct {
+		name   string
+		claims map[string]any
+	}{
+		{"wrong audience", map[string]any{"aud": "other-client"}},
+		{"wrong issuer", map[string]any{"iss": "https://evil.example.com"}},
+		{"expired", map[string]any{"exp": time.Now().Add(-time.Hour).Unix()}},
+		{"wrong nonce", map[string]any{"nonce": "other-nonce"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.claims["preferred_username"] = "phil"
+			p.SetClaims(test.claims)
+			rr := oidcLogin(t, s, p)
+			require.Equal(t, 401, rr.Code)
+			require.Equal(t, 40102, toHTTPError(t, rr.Body.String()).Code)
+		})
+	}
+
+	// Signed with a key that is not in the provider's JWKS
+	p.SetClaims(map[string]any{"preferred_username": "phil"})
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	p.signingKey = otherKey
+	rr := oidcLogin(t, s, p)
+	require.Equal(t, 401, rr.Code)
+	require.Equal(t, 40102, toHTTPError(t, rr.Body.String()).Code)
+
+	_, err = s.userManager.User("phil")
+	require.Equal(t, user.ErrUserNotFound, err)
+}
+
+func TestServer_OIDCLogin_InvalidUsername(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	s := newTestServer(t, newTestConfigWithOIDC(t, "", p))
+	p.SetClaims(map[string]any{"preferred_username": "not a valid/username"})
+	rr := oidcLogin(t, s, p)
+	require.Equal(t, 401, rr.Code)
+	require.Equal(t, 40102, toHTTPError(t, rr.Body.String()).Code)
+}
+
+func TestServer_OIDCLogin_Disabled(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t, ""))
+	response := request(t, s, "GET", "/v1/auth/oidc/login", "", nil)
+	require.Equal(t, 404, response.Code)
+
+	response = request(t, s, "GET", "/v1/config", "", nil)
+	require.Contains(t, response.Body.String(), `"enable_oidc":false`)
+}
+
+func TestOIDCClaimStrings(t *testing.T) {
+	claims := map[string]any{
+		"role":         "admin",
+		"groups":       []any{"a", 1, "b"},
+		"realm_access": map[string]any{"roles": []any{"x"}},
+	}
+	require.Equal(t, []string{"admin"}, oidcClaimStrings(claims, "role"))
+	require.Equal(t, []string{"a", "b"}, oidcClaimStrings(claims, "groups"))
+	require.Equal(t, []string{"x"}, oidcClaimStrings(claims, "realm_access.roles"))
+	require.Nil(t, oidcClaimStrings(claims, "realm_access.roles.nope"))
+	require.Nil(t, oidcClaimStrings(claims, "missing"))
+	require.Nil(t, oidcClaimStrings(claims, ""))
+}
+
+// testOIDCProvider is a minimal OpenID Connect provider, supporting discovery, JWKS and
+// the token endpoint of the authorization code flow with PKCE
+type testOIDCProvider struct {
+	t           *testing.T
+	server      *httptest.Server
+	signingKey  *rsa.PrivateKey
+	publicKey   *rsa.PublicKey
+	claims      map[string]any
+	nonce       string
+	challenge   string
+	redirectURI string
+	mu          sync.Mutex
+}
+
+func newTestOIDCProvider(t *testing.T) *testOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	p := &testOIDCProvider{
+		t:          t,
+		signingKey: key,
+		publicKey:  &key.PublicKey,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.handleDiscovery)
+	mux.HandleFunc("/jwks", p.handleJWKS)
+	mux.HandleFunc("/token", p.handleToken)
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func (p *testOIDCProvider) SetClaims(claims map[string]any) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.claims = claims
+}
+
+func (p *testOIDCProvider) handleDiscovery(w http.ResponseWriter, _ *http.Request) {
+	json.NewEncoder(w).Encode(&oidcMetadata{
+		Issuer:                p.server.URL,
+		AuthorizationEndpoint: p.server.URL + "/authorize",
+		TokenEndpoint:         p.server.URL + "/token",
+		JWKSURI:               p.server.URL + "/jwks",
+	})
+}
+
+func (p *testOIDCProvider) handleJWKS(w http.ResponseWriter, _ *http.Request) {
+	json.NewEncoder(w).Encode(&jose.JSONWebKeySet{
+		Keys: []jose.JSONWebKey{{Key: p.publicKey, KeyID: "key1", Algorithm: string(jose.RS256), Use: "sig"}},
+	})
+}
+
+func (p *testOIDCProvider) handleToken(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	require.Nil(p.t, r.ParseForm())
+	require.Equal(p.t, "authorization_code", r.PostForm.Get("grant_type"))
+	require.Equal(p.t, "testcode", r.PostForm.Get("code"))
+	require.Equal(p.t, p.redirectURI, r.PostForm.Get("redirect_uri"))
+	clientID, clientSecret, _ := r.BasicAuth()
+	require.Equal(p.t, "ntfy", clientID)
+	require.Equal(p.t, "secret", clientSecret)
+	verifierHash := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	require.Equal(p.t, p.challenge, base64.RawURLEncoding.EncodeToString(verifierHash[:]))
+
+	claims := map[string]any{
+		"iss":   p.server.URL,
+		"sub":   "1234",
+		"aud":   "ntfy",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": p.nonce,
+	}
+	for k, v := range p.claims {
+		claims[k] = v
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: p.signingKey}, (&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "key1"))
+	require.Nil(p.t, err)
+	idToken, err := jwt.Signed(signer).Claims(claims).Serialize()
+	require.Nil(p.t, err)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+func newTestConfigWithOIDC(t *testing.T, databaseURL string, p *testOIDCProvider) *Config {
+	c := newTestConfigWithAuthFile(t, databaseURL)
+	c.EnableLogin = true
+	c.OIDCIssuer = p.server.URL
+	c.OIDCClientID = "ntfy"
+	c.OIDCClientSecret = "secret"
+	c.OIDCRoleClaim = "realm_access.roles"
+	c.OIDCAdminRoles = []string{"ntfy-admin"}
+	c.OIDCGroupTiers = []*OIDCGroupTier{{Group: "ntfy-pro", Tier: "pro"}}
+	c.OIDCGroupAccess = map[string][]*user.Grant{
+		"ops": {{TopicPattern: "ops_*", Permission: user.PermissionReadWrite}},
+	}
+	return c
+}
+
+// oidcLogin performs the login flow: it starts the login, simulates the provider's redirect
+// back to the callback URL, and returns the callback response
+func oidcLogin(t *testing.T, s *Server, p *testOIDCProvider) *httptest.ResponseRecorder {
+	rr := request(t, s, "GET", "/v1/auth/oidc/login", "", nil)
+	require.Equal(t, 302, rr.Code)
+	params := oidcAuthorizeParams(t, rr)
+	require.Equal(t, "code", params.Get("response_type"))
+	require.Equal(t, "ntfy", params.Get("client_id"))
+	require.Equal(t, s.config.BaseURL+"/v1/auth/oidc/callback", params.Get("redirect_uri"))
+	require.Equal(t, "openid profile email", params.Get("scope"))
+	require.Equal(t, "S256", params.Get("code_challenge_method"))
+
+	p.mu.Lock()
+	p.nonce = params.Get("nonce")
+	p.challenge = params.Get("code_challenge")
+	p.redirectURI = params.Get("redirect_uri")
+	p.mu.Unlock()
+
+	var cookie *http.Cookie
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == oidcStateCookie {
+			cookie = c
+		}
+	}
+	require.NotNil(t, cookie)
+	require.True(t, cookie.HttpOnly)
+	return request(t, s, "GET", "/v1/auth/oidc/callback?code=testcode&state="+url.QueryEscape(params.Get("state")), "", map[string]string{
+		"Cookie": cookie.Name + "=" + cookie.Value,
+	})
+}
+
+func oidcAuthorizeParams(t *testing.T, rr *httptest.ResponseRecorder) url.Values {
+	location, err := url.Parse(rr.Header().Get("Location"))
+	require.Nil(t, err)
+	require.Equal(t, "/authorize", location.Path)
+	return location.Query()
+}
@@ -72,6 +72,7 @@ func (s *Server) handleBillingTiersGet(w http.ResponseWriter, _ *http.Request, _
 				MessagesExpiryDuration:   int64(freeTier.MessageExpiryDuration.Seconds()),
 				Emails:                   freeTier.EmailLimit,
 				Calls:                    freeTier.CallLimit,
+				SMS:                      freeTier.SMSLimit,
 				Reservations:             freeTier.ReservationsLimit,
 				AttachmentTotalSize:      freeTier.AttachmentTotalSizeLimit,
 				AttachmentFileSize:       freeTier.AttachmentFileSizeLimit,
@@ -101,6 +102,7 @@ func (s *Server) handleBillingTiersGet(w http.ResponseWriter, _ *http.Request, _
 				MessagesExpiryDuration:   int64(tier.MessageExpiryDuration.Seconds()),
 				Emails:                   tier.EmailLimit,
 				Calls:                    tier.CallLimit,
+				SMS:                      tier.SMSLimit,
 				Reservations:             tier.ReservationLimit,
 				AttachmentTotalSize:      tier.AttachmentTotalSizeLimit,
 				AttachmentFileSize:       tier.AttachmentFileSizeLimit,
@@ -482,6 +484,7 @@ func (s *Server) updateSubscriptionAndTier(r *http.Request, v *visitor, u *user.
 		if err := s.userManager.ResetTier(u.Name); err != nil {
 			return err
 		}
+		s.audit(v, user.AuditActionUserTier, u.Name, &user.AuditUser{Tier: u.Tier.Code}, nil)
 	} else if tier != nil && u.TierID() != tier.ID {
 		logvr(v, r).
 			Tag(tagStripe).
@@ -493,6 +496,11 @@ func (s *Server) updateSubscriptionAndTier(r *http.Request, v *visitor, u *user.
 		if err := s.userManager.ChangeTier(u.Name, tier.Code); err != nil {
 			return err
 		}
+		var before *user.AuditUser
+		if u.Tier != nil {
+			before = &user.AuditUser{Tier: u.Tier.Code}
+		}
+		s.audit(v, user.AuditActionUserTier, u.Name, before, &user.AuditUser{Tier: tier.Code})
 	}
 	// Update billing fields
 	billing := &user.Billing{
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/model"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+const (
+	smsMaxSegments           = 4     // Messages longer than this many SMS segments are truncated
+	smsSegmentLengthGSM7     = 153   // Characters per segment of a multi-part SMS in the GSM-7 encoding
+	smsSegmentLengthUCS2     = 67    // Characters per segment of a multi-part SMS in the UCS-2 encoding
+	smsTruncatedSuffix       = "..." // Appended to truncated messages; the ellipsis character is not part of GSM-7
+	smsGSM7Alphabet          = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà"
+	smsGSM7AlphabetExtension = "\f^{}\\[~]|€"
+)
+
+// Request types of the telephony webhook, see telephonyWebhookRequest
+const (
+	telephonyWebhookTypeCall        = "call"
+	telephonyWebhookTypeSMS         = "sms"
+	telephonyWebhookTypeVerify      = "verify"
+	telephonyWebhookTypeVerifyCheck = "verify_check"
+)
+
+// telephonyProvider makes phone calls, sends SMS and verifies phone numbers. It is implemented by twilioProvider,
+// which uses the Twilio APIs, and by telephonyWebhookProvider, which sends requests to an arbitrary HTTP endpoint,
+// e.g. a carrier API or a self-hosted SIP gateway.
+type telephonyProvider interface {
+	// Call makes a phone call to the given phone number, reading out the given message
+	Call(v *visitor, r *http.Request, m *model.Message, to string) error
+
+	// SMS sends the given message as a text message to the given phone number
+	SMS(v *visitor, r *http.Request, m *model.Message, to string) error
+
+	// Verify sends a verification code to the given phone number, via the given channel ("sms" or "call")
+	Verify(v *visitor, r *http.Request, phoneNumber, channel string) error
+
+	// VerifyCheck checks the verification code for the given phone number. It returns
+	// errHTTPGonePhoneVerificationExpired if the verification does not exist or has expired.
+	VerifyCheck(v *visitor, r *http.Request, phoneNumber, code string) error
+}
+
+// newTelephonyProvider returns the telephony provider for the given config, or nil if calls and SMS are not configured
+func newTelephonyProvider(conf *Config) telephonyProvider {
+	if conf.TwilioAccount != "" {
+		return newTwilioProvider(conf)
+	} else if conf.TelephonyWebhookURL != "" {
+		return newTelephonyWebhookProvider(conf)
+	}
+	return nil
+}
+
+// convertPhoneNumber checks if the given phone number is verified for the given user, and if so, returns the verified
+// phone number. It also converts a boolean string ("yes", "1", "true") to the first verified phone number.
+// If the user is anonymous, it will return an error.
+func (s *Server) convertPhoneNumber(u *user.User, phoneNumber string) (string, *errHTTP) {
+	if u == nil {
+		return "", errHTTPBadRequestAnonymousCallsNotAllowed
+	}
+	phoneNumbers, err := s.userManager.PhoneNumbers(u.ID)
+	if err != nil {
+		return "", errHTTPInternalError
+	} else if len(phoneNumbers) == 0 {
+		return "", errHTTPBadRequestPhoneNumberNotVerified
+	}
+	if toBool(phoneNumber) {
+		return phoneNumbers[0], nil
+	} else if util.Contains(phoneNumbers, phoneNumber) {
+		return phoneNumber, nil
+	}
+	return "", errHTTPBadRequestPhoneNumberNotVerified
+}
+
+// callPhone makes a phone call to the given phone number via the telephony provider, using the given message.
+// Failures will be logged, but not returned to the caller.
+func (s *Server) callPhone(v *visitor, r *http.Request, m *model.Message, to string) {
+	if err := s.telephony.Call(v, r, m, to); err != nil {
+		logvrm(v, r, m).Tag(tagTelephony).Field("phone_to", to).Err(err).Warn("Error making phone call")
+		minc(metricCallsMadeFailure)
+		return
+	}
+	minc(metricCallsMadeSuccess)
+}
+
+// sendSMS sends a text message to the given phone number via the telephony provider, using the given message.
+// Failures will be logged, but not returned to the caller.
+func (s *Server) sendSMS(v *visitor, r *http.Request, m *model.Message, to string) {
+	if err := s.telephony.SMS(v, r, m, to); err != nil {
+		logvrm(v, r, m).Tag(tagTelephony).Field("phone_to", to).Err(err).Warn("Error sending SMS")
+		minc(metricSMSSentFailure)
+		return
+	}
+	minc(metricSMSSentSuccess)
+}
+
+// telephonyWebhookProvider is a telephonyProvider that sends a POST request to the configured webhook URL for each
+// phone call, SMS and phone number verification. This allows integrating any carrier or gateway. The request body is
+// rendered from the template configured for the request type, or is a telephonyWebhookRequest as JSON if there is none.
+type telephonyWebhookProvider struct {
+	config  *Config
+	headers http.Header
+}
+
+// telephonyWebhookRequest holds the data passed to the telephony webhook request templates
+type telephonyWebhookRequest struct {
+	Type     string   `json:"type"` // One of the telephonyWebhookType* constants
+	To       string   `json:"to"`
+	Topic    string   `json:"topic,omitempty"`
+	Title    string   `json:"title,omitempty"`
+	Message  string   `json:"message,omitempty"`
+	Text     string   `json:"text,omitempty"` // Message formatted as SMS, see formatSMS (SMS only)
+	Priority int      `json:"priority,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	Sender   string   `json:"sender,omitempty"`
+	Channel  string   `json:"channel,omitempty"` // Verification channel, "sms" or "call" (verify only)
+	Code     string   `json:"code,omitempty"`    // Verification code (verify_check only)
+}
+
+func newTelephonyWebhookProvider(conf *Config) *telephonyWebhookProvider {
+	headers := make(http.Header)
+	for _, header := range conf.TelephonyWebhookHeaders {
+		name, value, _ := strings.Cut(header, ":")
+		headers.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	return &telephonyWebhookProvider{
+		config:  conf,
+		headers: headers,
+	}
+}
+
+// Call sends a "call" request to the telephony webhook
+func (p *telephonyWebhookProvider) Call(v *visitor, r *http.Request, m *model.Message, to string) error {
+	ev := logvrm(v, r, m).Tag(tagTelephony).Field("phone_to", to).Debug("Sending telephony webhook call request")
+	return p.send(ev, p.config.TelephonyWebhookCallTemplate, p.messageRequest(telephonyWebhookTypeCall, v, m, to))
+}
+
+// SMS sends an "sms" request to the telephony webhook
+func (p *telephonyWebhookProvider) SMS(v *visitor, r *http.Request, m *model.Message, to string) error {
+	req := p.messageRequest(telephonyWebhookTypeSMS, v, m, to)
+	req.Text = formatSMS(m)
+	ev := logvrm(v, r, m).Tag(tagTelephony).Field("phone_to", to).Debug("Sending telephony webhook SMS request")
+	return p.send(ev, p.config.TelephonyWebhookSMSTemplate, req)
+}
+
+// Verify sends a "verify" request to the telephony webhook. The gateway is expected to send a verification
+// code to the phone number, and to check it when it receives the "verify_check" request.
+func (p *telephonyWebhookProvider) Verify(v *visitor, r *http.Request, phoneNumber, channel string) error {
+	ev := logvr(v, r).Tag(tagTelephony).Field("phone_to", phoneNumber).Field("phone_channel", channel).Debug("Sending telephony webhook verify request")
+	return p.send(ev, p.config.TelephonyWebhookVerifyTemplate, &telephonyWebhookRequest{
+		Type:    telephonyWebhookTypeVerify,
+		To:      phoneNumber,
+		Channel: channel,
+	})
+}
+
+// VerifyCheck sends a "verify_check" request to the telephony webhook. Any 2xx response means that the code is valid,
+// a 404 or 410 response means that the code is wrong or has expired.
+func (p *telephonyWebhookProvider) VerifyCheck(v *visitor, r *http.Request, phoneNumber, code string) error {
+	ev := logvr(v, r).Tag(tagTelephony).Field("phone_to", phoneNumber).Debug("Sending telephony webhook verify check request")
+	err := p.send(ev, p.config.TelephonyWebhookVerifyCheckTemplate, &telephonyWebhookRequest{
+		Type: telephonyWebhookTypeVerifyCheck,
+		To:   phoneNumber,
+		Code: code,
+	})
+	var statusErr *telephonyWebhookStatusError
+	if errors.As(err, &statusErr) && (statusErr.StatusCode == http.StatusNotFound || statusErr.StatusCode == http.StatusGone) {
+		return errHTTPGonePhoneVerificationExpired
+	}
+	return err
+}
+
+func (p *telephonyWebhookProvider) messageRequest(requestType string, v *visitor, m *model.Message, to string) *telephonyWebhookRequest {
+	sender := m.Sender.String()
+	if u := v.User(); u != nil {
+		sender = u.Name
+	}
+	return &telephonyWebhookRequest{
+		Type:     requestType,
+		To:       to,
+		Topic:    m.Topic,
+		Title:    m.Title,
+		Message:  m.Message,
+		Priority: m.Priority,
+		Tags:     m.Tags,
+		Sender:   sender,
+	}
+}
+
+// send renders the request body using the given template (or as JSON if the template is nil), and sends it to the
+// webhook URL. It returns a telephonyWebhookStatusError if the webhook does not respond with a 2xx status code.
+func (p *telephonyWebhookProvider) send(ev *log.Event, tmpl *template.Template, req *telephonyWebhookRequest) error {
+	var body []byte
+	if tmpl != nil {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, req); err != nil {
+			return fmt.Errorf("error executing telephony webhook %s template: %w", req.Type, err)
+		}
+		body = buf.Bytes()
+	} else {
+		var err error
+		body, err = json.Marshal(req)
+		if err != nil {
+			return err
+		}
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, p.config.TelephonyWebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("User-Agent", "ntfy/"+p.config.BuildVersion)
+	httpReq.Header.Set("Content-Type", "application/json")
+	for name, values := range p.headers {
+		httpReq.Header[name] = values
+	}
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	response, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	ev.FieldIf("telephony_request", string(body), log.TraceLevel).FieldIf("telephony_response", string(response), log.TraceLevel)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		ev.Field("telephony_status", resp.StatusCode).Debug("Telephony webhook request failed")
+		return &telephonyWebhookStatusError{StatusCode: resp.StatusCode}
+	}
+	ev.Debug("Received successful telephony webhook response")
+	return nil
+}
+
+// telephonyWebhookStatusError is returned if the telephony webhook responds with a non-2xx status code
+type telephonyWebhookStatusError struct {
+	StatusCode int
+}
+
+func (e *telephonyWebhookStatusError) Error() string {
+	return fmt.Sprintf("unexpected telephony webhook response status code %d", e.StatusCode)
+}
+
+// formatSMS formats the message as the SMS body. Since SMS are split into segments of 153 characters (or 67, if
+// the message contains characters outside of the GSM-7 alphabet, e.g. emojis), which are billed individually,
+// messages are truncated to smsMaxSegments segments.
+func formatSMS(m *model.Message) string {
+	body := m.Message
+	if m.Title != "" {
+		body = m.Title + "\n" + body
+	}
+	body = fmt.Sprintf("[%s] %s", m.Topic, body)
+	gsm := isGSM7(body)
+	maxLength := smsMaxSegments * smsSegmentLengthUCS2
+	if gsm {
+		maxLength = smsMaxSegments * smsSegmentLengthGSM7
+	}
+	var length int
+	for _, r := range body {
+		length += smsCharLength(r, gsm)
+	}
+	if length <= maxLength {
+		return body
+	}
+	var truncated strings.Builder
+	length = len(smsTruncatedSuffix)
+	for _, r := range body {
+		if length += smsCharLength(r, gsm); length > maxLength {
+			break
+		}
+		truncated.WriteRune(r)
+	}
+	return strings.TrimRightFunc(truncated.String(), unicode.IsSpace) + smsTruncatedSuffix
+}
+
+// isGSM7 returns true if the text can be encoded with the GSM-7 alphabet (including its extension table)
+func isGSM7(text string) bool {
+	for _, r := range text {
+		if !strings.ContainsRune(smsGSM7Alphabet, r) && !strings.ContainsRune(smsGSM7AlphabetExtension, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// smsCharLength returns the number of characters a rune takes up in an SMS segment: characters of the GSM-7
+// extension table take up two, and characters outside the basic multilingual plane take up two in UCS-2
+func smsCharLength(r rune, gsm bool) int {
+	if gsm && strings.ContainsRune(smsGSM7AlphabetExtension, r) {
+		return 2
+	} else if !gsm && r > 0xFFFF {
+		return 2
+	}
+	return 1
+}
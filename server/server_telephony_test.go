@@ -0,0 +1,199 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+	"heckel.io/ntfy/v2/util/sprig"
+)
+
+func TestServer_TelephonyWebhook_Verify_Call_SMS_Success(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		var mu sync.Mutex
+		requests := make([]string, 0)
+		gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(r.Body)
+			require.Nil(t, err)
+			require.Equal(t, "POST", r.Method)
+			require.Equal(t, "/telephony", r.URL.Path)
+			require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+			require.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+			mu.Lock()
+			requests = append(requests, string(body))
+			mu.Unlock()
+		}))
+		defer gateway.Close()
+
+		c := newTestConfigWithAuthFile(t, databaseURL)
+		c.TelephonyWebhookURL = gateway.URL + "/telephony"
+		c.TelephonyWebhookHeaders = []string{"Authorization: Bearer secret"}
+		s := newTestServer(t, c)
+
+		// Add tier and user
+		require.Nil(t, s.userManager.AddTier(&user.Tier{
+			Code:         "pro",
+			MessageLimit: 10,
+			CallLimit:    1,
+			SMSLimit:     1,
+		}))
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+		require.Nil(t, s.userManager.ChangeTier("phil", "pro"))
+
+		// Config advertises calls and SMS
+		response := request(t, s, "GET", "/v1/config", "", nil)
+		config, _ := util.UnmarshalJSON[apiConfigResponse](io.NopCloser(response.Body))
+		require.True(t, config.EnableCalls)
+		require.True(t, config.EnableSMS)
+
+		// Verify and add phone number
+		response = request(t, s, "PUT", "/v1/account/phone/verify", `{"number":"+12223334444","channel":"sms"}`, map[string]string{
+			"authorization": util.BasicAuth("phil", "phil"),
+		})
+		require.Equal(t, 200, response.Code)
+		response = request(t, s, "PUT", "/v1/account/phone", `{"number":"+12223334444","code":"123456"}`, map[string]string{
+			"authorization": util.BasicAuth("phil", "phil"),
+		})
+		require.Equal(t, 200, response.Code)
+
+		// Publish with call and SMS
+		response = request(t, s, "POST", "/mytopic", "hi there", map[string]string{
+			"authorization": util.BasicAuth("phil", "phil"),
+			"x-title":       "Disk full",
+			"x-call":        "yes",
+			"x-sms":         "yes",
+		})
+		require.Equal(t, 200, response.Code)
+		waitFor(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(requests) == 4
+		})
+
+		mu.Lock()
+		defer mu.Unlock()
+		require.Equal(t, `{"type":"verify","to":"+12223334444","channel":"sms"}`, requests[0])
+		require.Equal(t, `{"type":"verify_check","to":"+12223334444","code":"123456"}`, requests[1])
+		require.ElementsMatch(t, []string{
+			`{"type":"call","to":"+12223334444","topic":"mytopic","title":"Disk full","message":"hi there","sender":"phil"}`,
+			`{"type":"sms","to":"+12223334444","topic":"mytopic","title":"Disk full","message":"hi there","text":"[mytopic] Disk full\nhi there","sender":"phil"}`,
+		}, requests[2:])
+	})
+}
+
+func TestServer_TelephonyWebhook_Templates(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		var body atomic.Pointer[string]
+		gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, err := io.ReadAll(r.Body)
+			require.Nil(t, err)
+			require.Equal(t, "application/x-www-form-urlencoded", r.Header.Get("Content-Type"))
+			body.Store(util.String(string(b)))
+		}))
+		defer gateway.Close()
+
+		c := newTestConfigWithAuthFile(t, databaseURL)
+		c.TelephonyWebhookURL = gateway.URL
+		c.TelephonyWebhookHeaders = []string{"Content-Type: application/x-www-form-urlencoded"}
+		c.TelephonyWebhookCallTemplate = template.Must(template.New("").Funcs(sprig.TxtFuncMap()).Parse(`number={{ .To | urlquery }}&text={{ printf "%s: %s" .Topic .Message | urlquery }}`))
+		s := newTestServer(t, c)
+
+		require.Nil(t, s.userManager.AddTier(&user.Tier{
+			Code:         "pro",
+			MessageLimit: 10,
+			CallLimit:    1,
+		}))
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+		require.Nil(t, s.userManager.ChangeTier("phil", "pro"))
+		u, err := s.userManager.User("phil")
+		require.Nil(t, err)
+		require.Nil(t, s.userManager.AddPhoneNumber(u.ID, "+12223334444"))
+
+		response := request(t, s, "POST", "/mytopic", "Garage on fire", map[string]string{
+			"authorization": util.BasicAuth("phil", "phil"),
+			"x-call":        "+12223334444",
+		})
+		require.Equal(t, 200, response.Code)
+		waitFor(t, func() bool {
+			return body.Load() != nil
+		})
+		require.Equal(t, "number=%2B12223334444&text=mytopic%3A+Garage+on+fire", *body.Load())
+	})
+}
+
+func TestServer_TelephonyWebhook_VerifyCheck_Expired(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer gateway.Close()
+
+		c := newTestConfigWithAuthFile(t, databaseURL)
+		c.TelephonyWebhookURL = gateway.URL
+		s := newTestServer(t, c)
+
+		require.Nil(t, s.userManager.AddTier(&user.Tier{
+			Code:         "pro",
+			MessageLimit: 10,
+			CallLimit:    1,
+		}))
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+		require.Nil(t, s.userManager.ChangeTier("phil", "pro"))
+		u, err := s.userManager.User("phil")
+		require.Nil(t, err)
+
+		response := request(t, s, "PUT", "/v1/account/phone", `{"number":"+12223334444","code":"123456"}`, map[string]string{
+			"authorization": util.BasicAuth("phil", "phil"),
+		})
+		require.Equal(t, 41001, toHTTPError(t, response.Body.String()).Code)
+
+		// Phone number was not added
+		phoneNumbers, err := s.userManager.PhoneNumbers(u.ID)
+		require.Nil(t, err)
+		require.Empty(t, phoneNumbers)
+	})
+}
+
+func TestServer_TelephonyWebhook_Verify_Failure(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer gateway.Close()
+
+		c := newTestConfigWithAuthFile(t, databaseURL)
+		c.TelephonyWebhookURL = gateway.URL
+		s := newTestServer(t, c)
+
+		require.Nil(t, s.userManager.AddTier(&user.Tier{
+			Code:         "pro",
+			MessageLimit: 10,
+			CallLimit:    1,
+		}))
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+		require.Nil(t, s.userManager.ChangeTier("phil", "pro"))
+
+		response := request(t, s, "PUT", "/v1/account/phone/verify", `{"number":"+12223334444","channel":"call"}`, map[string]string{
+			"authorization": util.BasicAuth("phil", "phil"),
+		})
+		require.Equal(t, 500, response.Code)
+	})
+}
+
+func TestServer_TelephonyWebhook_NoTwilioCallAck(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		c := newTestConfigWithAuthFile(t, databaseURL)
+		c.TelephonyWebhookURL = "http://127.0.0.1:1/telephony"
+		s := newTestServer(t, c)
+
+		response := request(t, s, "POST", "/v1/twilio/call/ack?id=abc&topic=mytopic&user=u_123", "Digits=1", nil)
+		require.Equal(t, 404, response.Code)
+	})
+}
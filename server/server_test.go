@@ -863,6 +863,45 @@ func TestServer_PublishWithInvalidSIDInHeader(t *testing.T) {
 	})
 }
 
+func TestServer_PublishInReplyTo(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		s := newTestServer(t, newTestConfig(t, databaseURL))
+
+		response := request(t, s, "POST", "/mytopic", "Backup failed", nil)
+		original := toMessage(t, response.Body.String())
+
+		response = request(t, s, "POST", "/mytopic", "On it", map[string]string{
+			"In-Reply-To": original.ID,
+		})
+		require.Equal(t, 200, response.Code)
+		require.Equal(t, original.ID, toMessage(t, response.Body.String()).InReplyTo)
+
+		response = request(t, s, "POST", "/", `{"topic":"mytopic","message":"Fixed","in_reply_to":"`+original.ID+`"}`, nil)
+		require.Equal(t, 200, response.Code)
+		require.Equal(t, original.ID, toMessage(t, response.Body.String()).InReplyTo)
+
+		response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+		messages := toMessages(t, response.Body.String())
+		require.Equal(t, 3, len(messages))
+		require.Equal(t, "", messages[0].InReplyTo)
+		require.Equal(t, original.ID, messages[1].InReplyTo)
+		require.Equal(t, original.ID, messages[2].InReplyTo)
+	})
+}
+
+func TestServer_PublishWithInvalidInReplyTo(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		s := newTestServer(t, newTestConfig(t, databaseURL))
+
+		response := request(t, s, "POST", "/mytopic", "message", map[string]string{
+			"X-In-Reply-To": "*&?",
+		})
+
+		require.Equal(t, 400, response.Code)
+		require.Equal(t, 40064, toHTTPError(t, response.Body.String()).Code)
+	})
+}
+
 func TestServer_PollWithQueryFilters(t *testing.T) {
 	forEachBackend(t, func(t *testing.T, databaseURL string) {
 		s := newTestServer(t, newTestConfig(t, databaseURL))
@@ -2,13 +2,22 @@ package server
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
 	"net/url"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 
 	"heckel.io/ntfy/v2/log"
 	"heckel.io/ntfy/v2/model"
@@ -16,26 +25,42 @@ import (
 	"heckel.io/ntfy/v2/util"
 )
 
+const (
+	twilioCallAckDigit    = "1"              // Key the callee has to press to acknowledge a message
+	twilioCallAckTimeout  = 15 * time.Minute // How long the callback URL of a call is valid, see twilioCallAckURL
+	twilioSignatureHeader = "X-Twilio-Signature"
+)
+
+const (
+	twilioCallAckResponse           = `<Response><Say>The message has been acknowledged. Goodbye.</Say></Response>`
+	twilioCallNotAckResponse        = `<Response><Say>Goodbye.</Say></Response>`
+	twilioCallNotAuthorizedResponse = `<Response><Say>You are not allowed to acknowledge this message. Goodbye.</Say></Response>`
+)
+
 // defaultTwilioCallFormatTemplate is the default TwiML template used for Twilio calls.
 // It can be overridden in the server configuration's twilio-call-format field.
 //
 // The format uses Go template syntax with the following fields:
-// {{.Topic}}, {{.Title}}, {{.Message}}, {{.Priority}}, {{.Tags}}, {{.Sender}}
-// String fields are automatically XML-escaped.
+// {{.Topic}}, {{.Title}}, {{.Message}}, {{.Priority}}, {{.Tags}}, {{.Sender}}, {{.AckURL}}
+// String fields are automatically XML-escaped. AckURL is the callback URL for the <Gather> step,
+// which publishes an acknowledgement to the topic if the callee presses 1, see handleTwilioCallAck.
 var defaultTwilioCallFormatTemplate = template.Must(template.New("twiml").Parse(`
 <Response>
 	<Pause length="1"/>
-	<Say loop="3">
-		You have a message from notify on topic {{.Topic}}. Message:
-		<break time="1s"/>
-		{{.Message}}
-		<break time="1s"/>
-		End of message.
-		<break time="1s"/>
-		This message was sent by user {{.Sender}}. It will be repeated three times.
-		To unsubscribe from calls like this, remove your phone number in the notify web app.
-		<break time="3s"/>
-	</Say>
+	<Gather numDigits="1" action="{{.AckURL}}" method="POST">
+		<Say loop="3">
+			You have a message from notify on topic {{.Topic}}. Message:
+			<break time="1s"/>
+			{{.Message}}
+			<break time="1s"/>
+			End of message.
+			<break time="1s"/>
+			This message was sent by user {{.Sender}}. It will be repeated three times.
+			To acknowledge the message, press 1.
+			To unsubscribe from calls like this, remove your phone number in the notify web app.
+			<break time="3s"/>
+		</Say>
+	</Gather>
 	<Say>Goodbye.</Say>
 </Response>`))
 
@@ -47,39 +72,35 @@ type twilioCallData struct {
 	Priority int
 	Tags     []string
 	Sender   string
+	AckURL   string
 }
 
-// convertPhoneNumber checks if the given phone number is verified for the given user, and if so, returns the verified
-// phone number. It also converts a boolean string ("yes", "1", "true") to the first verified phone number.
-// If the user is anonymous, it will return an error.
-func (s *Server) convertPhoneNumber(u *user.User, phoneNumber string) (string, *errHTTP) {
-	if u == nil {
-		return "", errHTTPBadRequestAnonymousCallsNotAllowed
-	}
-	phoneNumbers, err := s.userManager.PhoneNumbers(u.ID)
-	if err != nil {
-		return "", errHTTPInternalError
-	} else if len(phoneNumbers) == 0 {
-		return "", errHTTPBadRequestPhoneNumberNotVerified
-	}
-	if toBool(phoneNumber) {
-		return phoneNumbers[0], nil
-	} else if util.Contains(phoneNumbers, phoneNumber) {
-		return phoneNumber, nil
+// twilioProvider is a telephonyProvider that makes phone calls and sends SMS via the Twilio REST API, and
+// verifies phone numbers via the Twilio Verify API
+type twilioProvider struct {
+	config *Config
+	acks   map[string]int64 // Call SID -> expiry (Unix time) of acknowledged calls, see markCallAcknowledged
+	mu     sync.Mutex
+}
+
+func newTwilioProvider(conf *Config) *twilioProvider {
+	return &twilioProvider{
+		config: conf,
+		acks:   make(map[string]int64),
 	}
-	return "", errHTTPBadRequestPhoneNumberNotVerified
 }
 
-// callPhone calls the Twilio API to make a phone call to the given phone number, using the given message.
-// Failures will be logged, but not returned to the caller.
-func (s *Server) callPhone(v *visitor, r *http.Request, m *model.Message, to string) {
-	u, sender := v.User(), m.Sender.String()
+// Call calls the Twilio API to make a phone call to the given phone number, reading out the given message
+// using the TwiML call format template
+func (p *twilioProvider) Call(v *visitor, r *http.Request, m *model.Message, to string) error {
+	u, sender, ackURL := v.User(), m.Sender.String(), ""
 	if u != nil {
 		sender = u.Name
+		ackURL = twilioCallAckURL(p.config.BaseURL, u, m)
 	}
 	tmpl := defaultTwilioCallFormatTemplate
-	if s.config.TwilioCallFormat != nil {
-		tmpl = s.config.TwilioCallFormat
+	if p.config.TwilioCallFormat != nil {
+		tmpl = p.config.TwilioCallFormat
 	}
 	tags := make([]string, len(m.Tags))
 	for i, tag := range m.Tags {
@@ -92,66 +113,226 @@ func (s *Server) callPhone(v *visitor, r *http.Request, m *model.Message, to str
 		Priority: m.Priority,
 		Tags:     tags,
 		Sender:   xmlEscapeText(sender),
+		AckURL:   xmlEscapeText(ackURL),
 	}
 	var bodyBuf bytes.Buffer
 	if err := tmpl.Execute(&bodyBuf, templateData); err != nil {
-		logvrm(v, r, m).Tag(tagTwilio).Err(err).Warn("Error executing Twilio call format template")
-		minc(metricCallsMadeFailure)
-		return
+		return fmt.Errorf("error executing Twilio call format template: %w", err)
 	}
 	body := bodyBuf.String()
 	data := url.Values{}
-	data.Set("From", s.config.TwilioPhoneNumber)
+	data.Set("From", p.config.TwilioPhoneNumber)
 	data.Set("To", to)
 	data.Set("Twiml", body)
 	ev := logvrm(v, r, m).Tag(tagTwilio).Field("twilio_to", to).FieldIf("twilio_body", body, log.TraceLevel).Debug("Sending Twilio request")
-	response, err := s.callPhoneInternal(data)
+	response, err := p.request("Calls", data)
 	if err != nil {
-		ev.Field("twilio_response", response).Err(err).Warn("Error sending Twilio request")
-		minc(metricCallsMadeFailure)
-		return
+		ev.Field("twilio_response", response).Err(err).Debug("Error sending Twilio request")
+		return err
 	}
 	ev.FieldIf("twilio_response", response, log.TraceLevel).Debug("Received successful Twilio response")
-	minc(metricCallsMadeSuccess)
+	return nil
+}
+
+// SMS calls the Twilio Messaging API to send a text message to the given phone number, using the given message.
+// Long messages are truncated, see formatSMS.
+func (p *twilioProvider) SMS(v *visitor, r *http.Request, m *model.Message, to string) error {
+	body := formatSMS(m)
+	data := url.Values{}
+	data.Set("From", p.config.TwilioPhoneNumber)
+	data.Set("To", to)
+	data.Set("Body", body)
+	ev := logvrm(v, r, m).Tag(tagTwilio).Field("twilio_to", to).FieldIf("twilio_body", body, log.TraceLevel).Debug("Sending Twilio SMS request")
+	response, err := p.request("Messages", data)
+	if err != nil {
+		ev.Field("twilio_response", response).Err(err).Debug("Error sending Twilio SMS request")
+		return err
+	}
+	ev.FieldIf("twilio_response", response, log.TraceLevel).Debug("Received successful Twilio SMS response")
+	return nil
+}
+
+// twilioCallAckURL returns the callback URL for the <Gather> step of a phone call. It identifies the message and
+// the user that is called, and expires after twilioCallAckTimeout. Since Twilio signs its requests including the
+// URL, the parameters cannot be tampered with.
+func twilioCallAckURL(baseURL string, u *user.User, m *model.Message) string {
+	params := url.Values{}
+	params.Set("expires", strconv.FormatInt(time.Now().Add(twilioCallAckTimeout).Unix(), 10))
+	params.Set("topic", m.Topic)
+	params.Set("id", m.ID)
+	params.Set("user", u.ID)
+	return fmt.Sprintf("%s%s?%s", baseURL, apiTwilioCallAckPath, params.Encode())
 }
 
-func (s *Server) callPhoneInternal(data url.Values) (string, error) {
-	requestURL := fmt.Sprintf("%s/2010-04-01/Accounts/%s/Calls.json", s.config.TwilioCallsBaseURL, s.config.TwilioAccount)
+// handleTwilioCallAck handles the Twilio callback for the <Gather> step of a phone call, i.e. it is called when the
+// callee presses a key. If they pressed 1, an acknowledgement message referencing the original message is published to
+// the topic, so that others know the message was handled. This endpoint is authorized via the Twilio request signature,
+// and the called user must still be allowed to write to the topic. Since a signed request can be replayed, the callback
+// URL expires, and every call can only be acknowledged once.
+// Note that the visitor (v) in this endpoint is the Twilio API, so the user is taken from the callback URL.
+func (s *Server) handleTwilioCallAck(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	provider, ok := s.telephony.(*twilioProvider)
+	if !ok {
+		return errHTTPNotFound
+	}
+	body, err := util.Peek(r.Body, jsonBodyBytesLimit)
+	if err != nil {
+		return err
+	} else if body.LimitReached {
+		return errHTTPEntityTooLargeJSONBody
+	}
+	params, err := url.ParseQuery(string(body.PeekedBytes))
+	if err != nil {
+		return errHTTPBadRequestTwilioRequestInvalid
+	} else if !s.validTwilioSignature(r, params) {
+		return errHTTPForbiddenTwilioSignatureInvalid
+	}
+	topicID, messageID, userID := r.URL.Query().Get("topic"), r.URL.Query().Get("id"), r.URL.Query().Get("user")
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil || !topicRegex.MatchString(topicID) || !inReplyToRegex.MatchString(messageID) || userID == "" || params.Get("CallSid") == "" {
+		return errHTTPBadRequestTwilioRequestInvalid
+	} else if time.Now().Unix() > expires {
+		return errHTTPBadRequestTwilioRequestInvalid
+	}
+	phoneNumber := params.Get("To")
+	ev := logvr(v, r).Tag(tagTwilio).Fields(log.Context{
+		"twilio_to":     phoneNumber,
+		"twilio_digits": params.Get("Digits"),
+		"topic":         topicID,
+		"message_id":    messageID,
+	})
+	if params.Get("Digits") != twilioCallAckDigit {
+		ev.Debug("Phone call not acknowledged")
+		return s.writeTwiML(w, twilioCallNotAckResponse)
+	}
+	u, err := s.userManager.UserByID(userID)
+	if errors.Is(err, user.ErrUserNotFound) {
+		return errHTTPBadRequestTwilioRequestInvalid
+	} else if err != nil {
+		return err
+	}
+	if err := s.userManager.Authorize(u, topicID, user.PermissionWrite); err != nil {
+		ev.Field("user_name", u.Name).Info("Phone call acknowledgement by %s rejected, user cannot write to topic", u.Name)
+		return s.writeTwiML(w, twilioCallNotAuthorizedResponse)
+	} else if !provider.markCallAcknowledged(params.Get("CallSid"), expires) {
+		ev.Field("user_name", u.Name).Debug("Phone call already acknowledged, ignoring")
+		return s.writeTwiML(w, twilioCallAckResponse)
+	}
+	t, err := s.topicFromID(nil, topicID)
+	if err != nil {
+		return err
+	}
+	vu := s.visitor(v.IP(), u)
+	m := model.NewDefaultMessage(t.ID, fmt.Sprintf("Acknowledged by %s via phone call", u.Name))
+	m.Tags = []string{"white_check_mark"}
+	m.InReplyTo = messageID
+	m.Sender = v.IP()
+	m.User = u.ID
+	m.Expires = time.Unix(m.Time, 0).Add(vu.Limits().MessageExpiryDuration).Unix()
+	// We do not rate-limit acknowledgements here, since the call itself has been rate limited
+	if err := s.sendMessage(vu, t, m, true, false); err != nil {
+		return err
+	} else if err := s.addMessage(vu, r, t, m, true); err != nil {
+		return err
+	}
+	ev.Field("user_name", u.Name).Info("Phone call acknowledged by %s", u.Name)
+	minc(metricCallsAcknowledged)
+	return s.writeTwiML(w, twilioCallAckResponse)
+}
+
+// markCallAcknowledged records that the call with the given SID was acknowledged, and returns false if it was
+// acknowledged before. Entries are kept until the callback URL expires, since replays are rejected after that anyway.
+func (p *twilioProvider) markCallAcknowledged(callSID string, expires int64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now().Unix()
+	for sid, e := range p.acks {
+		if now > e {
+			delete(p.acks, sid)
+		}
+	}
+	if _, ok := p.acks[callSID]; ok {
+		return false
+	}
+	p.acks[callSID] = expires
+	return true
+}
+
+// validTwilioSignature checks the signature of an incoming Twilio request, which is the Base64-encoded HMAC-SHA1 of
+// the full request URL and the sorted POST parameters, signed with the auth token.
+// See https://www.twilio.com/docs/usage/webhooks/webhooks-security
+func (s *Server) validTwilioSignature(r *http.Request, params url.Values) bool {
+	signature, err := base64.StdEncoding.DecodeString(r.Header.Get(twilioSignatureHeader))
+	if err != nil || len(signature) == 0 {
+		return false
+	}
+	return hmac.Equal(signature, twilioSignature(s.config.TwilioAuthToken, s.config.BaseURL+r.URL.RequestURI(), params))
+}
+
+func (s *Server) writeTwiML(w http.ResponseWriter, twiml string) error {
+	w.Header().Set("Content-Type", "text/xml")
+	_, err := io.WriteString(w, twiml)
+	return err
+}
+
+func twilioSignature(authToken, requestURL string, params url.Values) []byte {
+	var data strings.Builder
+	data.WriteString(requestURL)
+	for _, key := range slices.Sorted(maps.Keys(params)) {
+		values := slices.Clone(params[key])
+		slices.Sort(values)
+		for _, value := range values {
+			data.WriteString(key + value)
+		}
+	}
+	h := hmac.New(sha1.New, []byte(authToken))
+	h.Write([]byte(data.String()))
+	return h.Sum(nil)
+}
+
+// request sends a request to the given Twilio REST API resource (e.g. "Calls" or "Messages")
+func (p *twilioProvider) request(resource string, data url.Values) (string, error) {
+	requestURL := fmt.Sprintf("%s/2010-04-01/Accounts/%s/%s.json", p.config.TwilioCallsBaseURL, p.config.TwilioAccount, resource)
 	req, err := http.NewRequest(http.MethodPost, requestURL, strings.NewReader(data.Encode()))
 	if err != nil {
 		return "", err
 	}
-	req.Header.Set("User-Agent", "ntfy/"+s.config.BuildVersion)
+	req.Header.Set("User-Agent", "ntfy/"+p.config.BuildVersion)
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("Authorization", util.BasicAuth(s.config.TwilioAccount, s.config.TwilioAuthToken))
+	req.Header.Set("Authorization", util.BasicAuth(p.config.TwilioAccount, p.config.TwilioAuthToken))
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return "", err
 	}
+	defer resp.Body.Close()
 	response, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return "", err
+	} else if resp.StatusCode >= 400 {
+		return string(response), fmt.Errorf("unexpected Twilio response status code %d", resp.StatusCode)
 	}
 	return string(response), nil
 }
 
-func (s *Server) verifyPhoneNumber(v *visitor, r *http.Request, phoneNumber, channel string) error {
+// Verify sends a verification code to the given phone number via the Twilio Verify API
+func (p *twilioProvider) Verify(v *visitor, r *http.Request, phoneNumber, channel string) error {
 	ev := logvr(v, r).Tag(tagTwilio).Field("twilio_to", phoneNumber).Field("twilio_channel", channel).Debug("Sending phone verification")
 	data := url.Values{}
 	data.Set("To", phoneNumber)
 	data.Set("Channel", channel)
-	requestURL := fmt.Sprintf("%s/v2/Services/%s/Verifications", s.config.TwilioVerifyBaseURL, s.config.TwilioVerifyService)
+	requestURL := fmt.Sprintf("%s/v2/Services/%s/Verifications", p.config.TwilioVerifyBaseURL, p.config.TwilioVerifyService)
 	req, err := http.NewRequest(http.MethodPost, requestURL, strings.NewReader(data.Encode()))
 	if err != nil {
 		return err
 	}
-	req.Header.Set("User-Agent", "ntfy/"+s.config.BuildVersion)
+	req.Header.Set("User-Agent", "ntfy/"+p.config.BuildVersion)
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("Authorization", util.BasicAuth(s.config.TwilioAccount, s.config.TwilioAuthToken))
+	req.Header.Set("Authorization", util.BasicAuth(p.config.TwilioAccount, p.config.TwilioAuthToken))
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 	response, err := io.ReadAll(resp.Body)
 	if err != nil {
 		ev.Err(err).Warn("Error sending Twilio phone verification request")
@@ -161,23 +342,26 @@ func (s *Server) verifyPhoneNumber(v *visitor, r *http.Request, phoneNumber, cha
 	return nil
 }
 
-func (s *Server) verifyPhoneNumberCheck(v *visitor, r *http.Request, phoneNumber, code string) error {
+// VerifyCheck checks the verification code for the given phone number via the Twilio Verify API
+func (p *twilioProvider) VerifyCheck(v *visitor, r *http.Request, phoneNumber, code string) error {
 	ev := logvr(v, r).Tag(tagTwilio).Field("twilio_to", phoneNumber).Debug("Checking phone verification")
 	data := url.Values{}
 	data.Set("To", phoneNumber)
 	data.Set("Code", code)
-	requestURL := fmt.Sprintf("%s/v2/Services/%s/VerificationCheck", s.config.TwilioVerifyBaseURL, s.config.TwilioVerifyService)
+	requestURL := fmt.Sprintf("%s/v2/Services/%s/VerificationCheck", p.config.TwilioVerifyBaseURL, p.config.TwilioVerifyService)
 	req, err := http.NewRequest(http.MethodPost, requestURL, strings.NewReader(data.Encode()))
 	if err != nil {
 		return err
 	}
-	req.Header.Set("User-Agent", "ntfy/"+s.config.BuildVersion)
+	req.Header.Set("User-Agent", "ntfy/"+p.config.BuildVersion)
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("Authorization", util.BasicAuth(s.config.TwilioAccount, s.config.TwilioAuthToken))
+	req.Header.Set("Authorization", util.BasicAuth(p.config.TwilioAccount, p.config.TwilioAuthToken))
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
-	} else if resp.StatusCode != http.StatusOK {
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
 		if ev.IsTrace() {
 			response, err := io.ReadAll(resp.Body)
 			if err != nil {
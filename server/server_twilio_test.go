@@ -1,18 +1,33 @@
 package server
 
 import (
+	"encoding/base64"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"text/template"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/model"
 	"heckel.io/ntfy/v2/user"
 	"heckel.io/ntfy/v2/util"
 )
 
+// twilioCallAckURLRegex matches the URL-encoded callback URL of the <Gather> step in a call, which contains
+// the (random) message and user ID
+var twilioCallAckURLRegex = regexp.MustCompile(`action%3D%22http%3A%2F%2F127\.0\.0\.1%3A12345%2Fv1%2Ftwilio%2Fcall%2Fack%3Fexpires%3D[0-9]+%26amp%3Bid%3D[A-Za-z0-9]+%26amp%3Btopic%3Dmytopic%26amp%3Buser%3Du_[A-Za-z0-9]+%22`)
+
+func normalizeTwilioCallAckURL(body string) string {
+	return twilioCallAckURLRegex.ReplaceAllString(body, "action%3D%22%7BackURL%7D%22")
+}
+
 func TestServer_Twilio_Call_Add_Verify_Call_Delete_Success(t *testing.T) {
 	forEachBackend(t, func(t *testing.T, databaseURL string) {
 		var called, verified atomic.Bool
@@ -46,7 +61,7 @@ func TestServer_Twilio_Call_Add_Verify_Call_Delete_Success(t *testing.T) {
 			require.Nil(t, err)
 			require.Equal(t, "/2010-04-01/Accounts/AC1234567890/Calls.json", r.URL.Path)
 			require.Equal(t, "Basic QUMxMjM0NTY3ODkwOkFBRUFBMTIzNDU2Nzg5MA==", r.Header.Get("Authorization"))
-			require.Equal(t, "From=%2B1234567890&To=%2B12223334444&Twiml=%0A%3CResponse%3E%0A%09%3CPause+length%3D%221%22%2F%3E%0A%09%3CSay+loop%3D%223%22%3E%0A%09%09You+have+a+message+from+notify+on+topic+mytopic.+Message%3A%0A%09%09%3Cbreak+time%3D%221s%22%2F%3E%0A%09%09hi+there%0A%09%09%3Cbreak+time%3D%221s%22%2F%3E%0A%09%09End+of+message.%0A%09%09%3Cbreak+time%3D%221s%22%2F%3E%0A%09%09This+message+was+sent+by+user+phil.+It+will+be+repeated+three+times.%0A%09%09To+unsubscribe+from+calls+like+this%2C+remove+your+phone+number+in+the+notify+web+app.%0A%09%09%3Cbreak+time%3D%223s%22%2F%3E%0A%09%3C%2FSay%3E%0A%09%3CSay%3EGoodbye.%3C%2FSay%3E%0A%3C%2FResponse%3E", string(body))
+			require.Equal(t, "From=%2B1234567890&To=%2B12223334444&Twiml=%0A%3CResponse%3E%0A%09%3CPause+length%3D%221%22%2F%3E%0A%09%3CGather+numDigits%3D%221%22+action%3D%22%7BackURL%7D%22+method%3D%22POST%22%3E%0A%09%09%3CSay+loop%3D%223%22%3E%0A%09%09%09You+have+a+message+from+notify+on+topic+mytopic.+Message%3A%0A%09%09%09%3Cbreak+time%3D%221s%22%2F%3E%0A%09%09%09hi+there%0A%09%09%09%3Cbreak+time%3D%221s%22%2F%3E%0A%09%09%09End+of+message.%0A%09%09%09%3Cbreak+time%3D%221s%22%2F%3E%0A%09%09%09This+message+was+sent+by+user+phil.+It+will+be+repeated+three+times.%0A%09%09%09To+acknowledge+the+message%2C+press+1.%0A%09%09%09To+unsubscribe+from+calls+like+this%2C+remove+your+phone+number+in+the+notify+web+app.%0A%09%09%09%3Cbreak+time%3D%223s%22%2F%3E%0A%09%09%3C%2FSay%3E%0A%09%3C%2FGather%3E%0A%09%3CSay%3EGoodbye.%3C%2FSay%3E%0A%3C%2FResponse%3E", normalizeTwilioCallAckURL(string(body)))
 			called.Store(true)
 		}))
 		defer twilioCallsServer.Close()
@@ -127,7 +142,7 @@ func TestServer_Twilio_Call_Success(t *testing.T) {
 			require.Nil(t, err)
 			require.Equal(t, "/2010-04-01/Accounts/AC1234567890/Calls.json", r.URL.Path)
 			require.Equal(t, "Basic QUMxMjM0NTY3ODkwOkFBRUFBMTIzNDU2Nzg5MA==", r.Header.Get("Authorization"))
-			require.Equal(t, "From=%2B1234567890&To=%2B11122233344&Twiml=%0A%3CResponse%3E%0A%09%3CPause+length%3D%221%22%2F%3E%0A%09%3CSay+loop%3D%223%22%3E%0A%09%09You+have+a+message+from+notify+on+topic+mytopic.+Message%3A%0A%09%09%3Cbreak+time%3D%221s%22%2F%3E%0A%09%09hi+there%0A%09%09%3Cbreak+time%3D%221s%22%2F%3E%0A%09%09End+of+message.%0A%09%09%3Cbreak+time%3D%221s%22%2F%3E%0A%09%09This+message+was+sent+by+user+phil.+It+will+be+repeated+three+times.%0A%09%09To+unsubscribe+from+calls+like+this%2C+remove+your+phone+number+in+the+notify+web+app.%0A%09%09%3Cbreak+time%3D%223s%22%2F%3E%0A%09%3C%2FSay%3E%0A%09%3CSay%3EGoodbye.%3C%2FSay%3E%0A%3C%2FResponse%3E", string(body))
+			require.Equal(t, "From=%2B1234567890&To=%2B11122233344&Twiml=%0A%3CResponse%3E%0A%09%3CPause+length%3D%221%22%2F%3E%0A%09%3CGather+numDigits%3D%221%22+action%3D%22%7BackURL%7D%22+method%3D%22POST%22%3E%0A%09%09%3CSay+loop%3D%223%22%3E%0A%09%09%09You+have+a+message+from+notify+on+topic+mytopic.+Message%3A%0A%09%09%09%3Cbreak+time%3D%221s%22%2F%3E%0A%09%09%09hi+there%0A%09%09%09%3Cbreak+time%3D%221s%22%2F%3E%0A%09%09%09End+of+message.%0A%09%09%09%3Cbreak+time%3D%221s%22%2F%3E%0A%09%09%09This+message+was+sent+by+user+phil.+It+will+be+repeated+three+times.%0A%09%09%09To+acknowledge+the+message%2C+press+1.%0A%09%09%09To+unsubscribe+from+calls+like+this%2C+remove+your+phone+number+in+the+notify+web+app.%0A%09%09%09%3Cbreak+time%3D%223s%22%2F%3E%0A%09%09%3C%2FSay%3E%0A%09%3C%2FGather%3E%0A%09%3CSay%3EGoodbye.%3C%2FSay%3E%0A%3C%2FResponse%3E", normalizeTwilioCallAckURL(string(body)))
 			called.Store(true)
 		}))
 		defer twilioServer.Close()
@@ -174,7 +189,7 @@ func TestServer_Twilio_Call_Success_With_Yes(t *testing.T) {
 			require.Nil(t, err)
 			require.Equal(t, "/2010-04-01/Accounts/AC1234567890/Calls.json", r.URL.Path)
 			require.Equal(t, "Basic QUMxMjM0NTY3ODkwOkFBRUFBMTIzNDU2Nzg5MA==", r.Header.Get("Authorization"))
-			require.Equal(t, "From=%2B1234567890&To=%2B11122233344&Twiml=%0A%3CResponse%3E%0A%09%3CPause+length%3D%221%22%2F%3E%0A%09%3CSay+loop%3D%223%22%3E%0A%09%09You+have+a+message+from+notify+on+topic+mytopic.+Message%3A%0A%09%09%3Cbreak+time%3D%221s%22%2F%3E%0A%09%09hi+there%0A%09%09%3Cbreak+time%3D%221s%22%2F%3E%0A%09%09End+of+message.%0A%09%09%3Cbreak+time%3D%221s%22%2F%3E%0A%09%09This+message+was+sent+by+user+phil.+It+will+be+repeated+three+times.%0A%09%09To+unsubscribe+from+calls+like+this%2C+remove+your+phone+number+in+the+notify+web+app.%0A%09%09%3Cbreak+time%3D%223s%22%2F%3E%0A%09%3C%2FSay%3E%0A%09%3CSay%3EGoodbye.%3C%2FSay%3E%0A%3C%2FResponse%3E", string(body))
+			require.Equal(t, "From=%2B1234567890&To=%2B11122233344&Twiml=%0A%3CResponse%3E%0A%09%3CPause+length%3D%221%22%2F%3E%0A%09%3CGather+numDigits%3D%221%22+action%3D%22%7BackURL%7D%22+method%3D%22POST%22%3E%0A%09%09%3CSay+loop%3D%223%22%3E%0A%09%09%09You+have+a+message+from+notify+on+topic+mytopic.+Message%3A%0A%09%09%09%3Cbreak+time%3D%221s%22%2F%3E%0A%09%09%09hi+there%0A%09%09%09%3Cbreak+time%3D%221s%22%2F%3E%0A%09%09%09End+of+message.%0A%09%09%09%3Cbreak+time%3D%221s%22%2F%3E%0A%09%09%09This+message+was+sent+by+user+phil.+It+will+be+repeated+three+times.%0A%09%09%09To+acknowledge+the+message%2C+press+1.%0A%09%09%09To+unsubscribe+from+calls+like+this%2C+remove+your+phone+number+in+the+notify+web+app.%0A%09%09%09%3Cbreak+time%3D%223s%22%2F%3E%0A%09%09%3C%2FSay%3E%0A%09%3C%2FGather%3E%0A%09%3CSay%3EGoodbye.%3C%2FSay%3E%0A%3C%2FResponse%3E", normalizeTwilioCallAckURL(string(body)))
 			called.Store(true)
 		}))
 		defer twilioServer.Close()
@@ -341,3 +356,475 @@ func TestServer_Twilio_Call_Unconfigured(t *testing.T) {
 		require.Equal(t, 40032, toHTTPError(t, response.Body.String()).Code)
 	})
 }
+
+func TestServer_Twilio_Call_Ack_Success(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		var twiml atomic.Pointer[string]
+		twilioServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Nil(t, r.ParseForm())
+			twiml.Store(util.String(r.PostForm.Get("Twiml")))
+		}))
+		defer twilioServer.Close()
+
+		c := newTestConfigWithAuthFile(t, databaseURL)
+		c.TwilioCallsBaseURL = twilioServer.URL
+		c.TwilioAccount = "AC1234567890"
+		c.TwilioAuthToken = "AAEAA1234567890"
+		c.TwilioPhoneNumber = "+1234567890"
+		s := newTestServer(t, c)
+
+		// Add tier and user
+		require.Nil(t, s.userManager.AddTier(&user.Tier{
+			Code:         "pro",
+			MessageLimit: 10,
+			CallLimit:    1,
+		}))
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+		require.Nil(t, s.userManager.ChangeTier("phil", "pro"))
+		u, err := s.userManager.User("phil")
+		require.Nil(t, err)
+		require.Nil(t, s.userManager.AddPhoneNumber(u.ID, "+11122233344"))
+
+		// Publish message with call
+		response := request(t, s, "POST", "/mytopic", "Disk full", map[string]string{
+			"authorization": util.BasicAuth("phil", "phil"),
+			"x-call":        "yes",
+		})
+		m := toMessage(t, response.Body.String())
+		waitFor(t, func() bool {
+			return twiml.Load() != nil
+		})
+		matches := regexp.MustCompile(`<Gather numDigits="1" action="([^"]+)" method="POST">`).FindStringSubmatch(*twiml.Load())
+		require.Equal(t, 2, len(matches))
+		ackURL := strings.ReplaceAll(matches[1], "&amp;", "&")
+		require.Regexp(t, fmt.Sprintf(`^http://127\.0\.0\.1:12345/v1/twilio/call/ack\?expires=[0-9]+&id=%s&topic=mytopic&user=%s$`, m.ID, u.ID), ackURL)
+
+		// Callee presses 1
+		params := url.Values{}
+		params.Set("CallSid", "CA1234567890")
+		params.Set("Digits", "1")
+		params.Set("From", "+1234567890")
+		params.Set("To", "+11122233344")
+		response = request(t, s, "POST", strings.TrimPrefix(ackURL, c.BaseURL), params.Encode(), map[string]string{
+			"Content-Type":       "application/x-www-form-urlencoded",
+			"X-Twilio-Signature": base64.StdEncoding.EncodeToString(twilioSignature("AAEAA1234567890", ackURL, params)),
+		})
+		require.Equal(t, 200, response.Code)
+		require.Equal(t, "text/xml", response.Header().Get("Content-Type"))
+		require.Equal(t, twilioCallAckResponse, response.Body.String())
+
+		// Acknowledgement is published to the topic, referencing the original message
+		response = request(t, s, "GET", "/mytopic/json?poll=1", "", map[string]string{
+			"authorization": util.BasicAuth("phil", "phil"),
+		})
+		messages := toMessages(t, response.Body.String())
+		require.Equal(t, 2, len(messages))
+		require.Equal(t, "Acknowledged by phil via phone call", messages[1].Message)
+		require.Equal(t, []string{"white_check_mark"}, messages[1].Tags)
+		require.Equal(t, m.ID, messages[1].InReplyTo)
+
+		// Replaying the signed request does not publish another acknowledgement
+		response = request(t, s, "POST", strings.TrimPrefix(ackURL, c.BaseURL), params.Encode(), map[string]string{
+			"Content-Type":       "application/x-www-form-urlencoded",
+			"X-Twilio-Signature": base64.StdEncoding.EncodeToString(twilioSignature("AAEAA1234567890", ackURL, params)),
+		})
+		require.Equal(t, 200, response.Code)
+		require.Equal(t, twilioCallAckResponse, response.Body.String())
+		response = request(t, s, "GET", "/mytopic/json?poll=1", "", map[string]string{
+			"authorization": util.BasicAuth("phil", "phil"),
+		})
+		require.Equal(t, 2, len(toMessages(t, response.Body.String())))
+	})
+}
+
+func TestServer_Twilio_Call_Ack_NotAuthorized(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		c := newTestConfigWithAuthFile(t, databaseURL)
+		c.AuthDefault = user.PermissionDenyAll
+		c.TwilioAccount = "AC1234567890"
+		c.TwilioAuthToken = "AAEAA1234567890"
+		c.TwilioPhoneNumber = "+1234567890"
+		s := newTestServer(t, c)
+
+		// User lost write access to the topic after the call was made
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+		require.Nil(t, s.userManager.AllowAccess("phil", "mytopic", user.PermissionRead))
+		u, err := s.userManager.User("phil")
+		require.Nil(t, err)
+
+		ackURL := twilioCallAckURL(c.BaseURL, u, model.NewDefaultMessage("mytopic", "Disk full"))
+		params := url.Values{}
+		params.Set("CallSid", "CA1234567890")
+		params.Set("Digits", "1")
+		params.Set("To", "+11122233344")
+		response := request(t, s, "POST", strings.TrimPrefix(ackURL, c.BaseURL), params.Encode(), map[string]string{
+			"X-Twilio-Signature": base64.StdEncoding.EncodeToString(twilioSignature("AAEAA1234567890", ackURL, params)),
+		})
+		require.Equal(t, 200, response.Code)
+		require.Equal(t, twilioCallNotAuthorizedResponse, response.Body.String())
+
+		// Nothing was published
+		response = request(t, s, "GET", "/mytopic/json?poll=1", "", map[string]string{
+			"authorization": util.BasicAuth("phil", "phil"),
+		})
+		require.Equal(t, 0, len(toMessages(t, response.Body.String())))
+	})
+}
+
+func TestServer_Twilio_Call_Ack_Expired(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		c := newTestConfigWithAuthFile(t, databaseURL)
+		c.TwilioAccount = "AC1234567890"
+		c.TwilioAuthToken = "AAEAA1234567890"
+		c.TwilioPhoneNumber = "+1234567890"
+		s := newTestServer(t, c)
+
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+		u, err := s.userManager.User("phil")
+		require.Nil(t, err)
+
+		ackURL := fmt.Sprintf("%s/v1/twilio/call/ack?expires=%d&id=abcdefghijkl&topic=mytopic&user=%s", c.BaseURL, time.Now().Add(-time.Minute).Unix(), u.ID)
+		params := url.Values{}
+		params.Set("CallSid", "CA1234567890")
+		params.Set("Digits", "1")
+		params.Set("To", "+11122233344")
+		response := request(t, s, "POST", strings.TrimPrefix(ackURL, c.BaseURL), params.Encode(), map[string]string{
+			"X-Twilio-Signature": base64.StdEncoding.EncodeToString(twilioSignature("AAEAA1234567890", ackURL, params)),
+		})
+		require.Equal(t, 400, response.Code)
+
+		// Nothing was published
+		response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+		require.Equal(t, 0, len(toMessages(t, response.Body.String())))
+	})
+}
+
+func TestServer_Twilio_Call_Ack_OtherDigit(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		c := newTestConfigWithAuthFile(t, databaseURL)
+		c.TwilioAccount = "AC1234567890"
+		c.TwilioAuthToken = "AAEAA1234567890"
+		c.TwilioPhoneNumber = "+1234567890"
+		s := newTestServer(t, c)
+
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+		u, err := s.userManager.User("phil")
+		require.Nil(t, err)
+
+		ackURL := twilioCallAckURL(c.BaseURL, u, model.NewDefaultMessage("mytopic", "Disk full"))
+		params := url.Values{}
+		params.Set("CallSid", "CA1234567890")
+		params.Set("Digits", "2")
+		params.Set("To", "+11122233344")
+		response := request(t, s, "POST", strings.TrimPrefix(ackURL, c.BaseURL), params.Encode(), map[string]string{
+			"X-Twilio-Signature": base64.StdEncoding.EncodeToString(twilioSignature("AAEAA1234567890", ackURL, params)),
+		})
+		require.Equal(t, 200, response.Code)
+		require.Equal(t, twilioCallNotAckResponse, response.Body.String())
+
+		// Nothing was published
+		response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+		require.Equal(t, 0, len(toMessages(t, response.Body.String())))
+	})
+}
+
+func TestServer_Twilio_Call_Ack_InvalidSignature(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		c := newTestConfigWithAuthFile(t, databaseURL)
+		c.TwilioAccount = "AC1234567890"
+		c.TwilioAuthToken = "AAEAA1234567890"
+		c.TwilioPhoneNumber = "+1234567890"
+		s := newTestServer(t, c)
+
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+		u, err := s.userManager.User("phil")
+		require.Nil(t, err)
+
+		ackURL := twilioCallAckURL(c.BaseURL, u, model.NewDefaultMessage("mytopic", "Disk full"))
+		params := url.Values{}
+		params.Set("Digits", "1")
+		params.Set("To", "+11122233344")
+
+		// No signature
+		response := request(t, s, "POST", strings.TrimPrefix(ackURL, c.BaseURL), params.Encode(), nil)
+		require.Equal(t, 40304, toHTTPError(t, response.Body.String()).Code)
+
+		// Wrong auth token
+		response = request(t, s, "POST", strings.TrimPrefix(ackURL, c.BaseURL), params.Encode(), map[string]string{
+			"X-Twilio-Signature": base64.StdEncoding.EncodeToString(twilioSignature("wrong", ackURL, params)),
+		})
+		require.Equal(t, 40304, toHTTPError(t, response.Body.String()).Code)
+
+		// Tampered URL (different topic)
+		tamperedURL := strings.Replace(ackURL, "topic=mytopic", "topic=othertopic", 1)
+		response = request(t, s, "POST", strings.TrimPrefix(tamperedURL, c.BaseURL), params.Encode(), map[string]string{
+			"X-Twilio-Signature": base64.StdEncoding.EncodeToString(twilioSignature("AAEAA1234567890", ackURL, params)),
+		})
+		require.Equal(t, 40304, toHTTPError(t, response.Body.String()).Code)
+
+		// Nothing was published
+		response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+		require.Equal(t, 0, len(toMessages(t, response.Body.String())))
+	})
+}
+
+func TestServer_Twilio_Call_Ack_Unconfigured(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		s := newTestServer(t, newTestConfig(t, databaseURL))
+		response := request(t, s, "POST", "/v1/twilio/call/ack?id=abc&topic=mytopic&user=u_123", "Digits=1", nil)
+		require.Equal(t, 404, response.Code)
+	})
+}
+
+func TestTwilioSignature(t *testing.T) {
+	// Example from the Twilio helper libraries
+	params := url.Values{}
+	params.Set("CallSid", "CA1234567890ABCDE")
+	params.Set("Caller", "+14158675309")
+	params.Set("Digits", "1234")
+	params.Set("From", "+14158675309")
+	params.Set("To", "+18005551212")
+	signature := twilioSignature("12345", "https://mycompany.com/myapp.php?foo=1&bar=2", params)
+	require.Equal(t, "RSOYDt4T1cUTdK1PDd93/VVr8B8=", base64.StdEncoding.EncodeToString(signature))
+}
+
+func TestServer_Twilio_SMS_Success(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		var sent atomic.Bool
+		twilioServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if sent.Load() {
+				t.Fatal("Should be only called once")
+			}
+			body, err := io.ReadAll(r.Body)
+			require.Nil(t, err)
+			require.Equal(t, "/2010-04-01/Accounts/AC1234567890/Messages.json", r.URL.Path)
+			require.Equal(t, "Basic QUMxMjM0NTY3ODkwOkFBRUFBMTIzNDU2Nzg5MA==", r.Header.Get("Authorization"))
+			require.Equal(t, "Body=%5Bmytopic%5D+Disk+full%0Ahi+there&From=%2B1234567890&To=%2B11122233344", string(body))
+			w.WriteHeader(http.StatusCreated)
+			sent.Store(true)
+		}))
+		defer twilioServer.Close()
+
+		c := newTestConfigWithAuthFile(t, databaseURL)
+		c.TwilioCallsBaseURL = twilioServer.URL
+		c.TwilioAccount = "AC1234567890"
+		c.TwilioAuthToken = "AAEAA1234567890"
+		c.TwilioPhoneNumber = "+1234567890"
+		s := newTestServer(t, c)
+
+		// Add tier and user
+		require.Nil(t, s.userManager.AddTier(&user.Tier{
+			Code:         "pro",
+			MessageLimit: 10,
+			SMSLimit:     1,
+		}))
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+		require.Nil(t, s.userManager.ChangeTier("phil", "pro"))
+		u, err := s.userManager.User("phil")
+		require.Nil(t, err)
+		require.Nil(t, s.userManager.AddPhoneNumber(u.ID, "+11122233344"))
+
+		// Do the thing
+		response := request(t, s, "POST", "/mytopic", "hi there", map[string]string{
+			"authorization": util.BasicAuth("phil", "phil"),
+			"x-title":       "Disk full",
+			"x-sms":         "yes",
+		})
+		require.Equal(t, "hi there", toMessage(t, response.Body.String()).Message)
+		waitFor(t, func() bool {
+			return sent.Load()
+		})
+
+		// Second SMS exceeds the daily limit
+		response = request(t, s, "POST", "/mytopic", "hi again", map[string]string{
+			"authorization": util.BasicAuth("phil", "phil"),
+			"x-sms":         "+11122233344",
+		})
+		require.Equal(t, 42913, toHTTPError(t, response.Body.String()).Code)
+
+		// Stats are reflected in the account
+		response = request(t, s, "GET", "/v1/account", "", map[string]string{
+			"authorization": util.BasicAuth("phil", "phil"),
+		})
+		account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(response.Body))
+		require.Equal(t, int64(1), account.Limits.SMS)
+		require.Equal(t, int64(1), account.Stats.SMS)
+		require.Equal(t, int64(0), account.Stats.SMSRemaining)
+	})
+}
+
+func TestServer_Twilio_SMS_JSON(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		var sent atomic.Bool
+		twilioServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(r.Body)
+			require.Nil(t, err)
+			require.Equal(t, "/2010-04-01/Accounts/AC1234567890/Messages.json", r.URL.Path)
+			require.Equal(t, "Body=%5Bmytopic%5D+hi+there&From=%2B1234567890&To=%2B11122233344", string(body))
+			sent.Store(true)
+		}))
+		defer twilioServer.Close()
+
+		c := newTestConfigWithAuthFile(t, databaseURL)
+		c.TwilioCallsBaseURL = twilioServer.URL
+		c.TwilioAccount = "AC1234567890"
+		c.TwilioAuthToken = "AAEAA1234567890"
+		c.TwilioPhoneNumber = "+1234567890"
+		s := newTestServer(t, c)
+
+		require.Nil(t, s.userManager.AddTier(&user.Tier{
+			Code:         "pro",
+			MessageLimit: 10,
+			SMSLimit:     5,
+		}))
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+		require.Nil(t, s.userManager.ChangeTier("phil", "pro"))
+		u, err := s.userManager.User("phil")
+		require.Nil(t, err)
+		require.Nil(t, s.userManager.AddPhoneNumber(u.ID, "+11122233344"))
+
+		response := request(t, s, "POST", "/", `{"topic":"mytopic","message":"hi there","sms":"+11122233344"}`, map[string]string{
+			"authorization": util.BasicAuth("phil", "phil"),
+		})
+		require.Equal(t, 200, response.Code)
+		waitFor(t, func() bool {
+			return sent.Load()
+		})
+	})
+}
+
+func TestServer_Twilio_SMS_UnverifiedNumber(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		c := newTestConfigWithAuthFile(t, databaseURL)
+		c.TwilioCallsBaseURL = "http://dummy.invalid"
+		c.TwilioAccount = "AC1234567890"
+		c.TwilioAuthToken = "AAEAA1234567890"
+		c.TwilioPhoneNumber = "+1234567890"
+		s := newTestServer(t, c)
+
+		require.Nil(t, s.userManager.AddTier(&user.Tier{
+			Code:         "pro",
+			MessageLimit: 10,
+			SMSLimit:     1,
+		}))
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+		require.Nil(t, s.userManager.ChangeTier("phil", "pro"))
+
+		response := request(t, s, "POST", "/mytopic", "test", map[string]string{
+			"authorization": util.BasicAuth("phil", "phil"),
+			"x-sms":         "+11122233344",
+		})
+		require.Equal(t, 40034, toHTTPError(t, response.Body.String()).Code)
+	})
+}
+
+func TestServer_Twilio_SMS_NoLimit(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		c := newTestConfigWithAuthFile(t, databaseURL)
+		c.TwilioCallsBaseURL = "http://dummy.invalid"
+		c.TwilioAccount = "AC1234567890"
+		c.TwilioAuthToken = "AAEAA1234567890"
+		c.TwilioPhoneNumber = "+1234567890"
+		s := newTestServer(t, c)
+
+		// Tier allows calls, but no SMS
+		require.Nil(t, s.userManager.AddTier(&user.Tier{
+			Code:         "pro",
+			MessageLimit: 10,
+			CallLimit:    1,
+		}))
+		require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+		require.Nil(t, s.userManager.ChangeTier("phil", "pro"))
+		u, err := s.userManager.User("phil")
+		require.Nil(t, err)
+		require.Nil(t, s.userManager.AddPhoneNumber(u.ID, "+11122233344"))
+
+		response := request(t, s, "POST", "/mytopic", "test", map[string]string{
+			"authorization": util.BasicAuth("phil", "phil"),
+			"x-sms":         "yes",
+		})
+		require.Equal(t, 42913, toHTTPError(t, response.Body.String()).Code)
+	})
+}
+
+func TestServer_Twilio_SMS_InvalidNumber(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		c := newTestConfigWithAuthFile(t, databaseURL)
+		c.TwilioCallsBaseURL = "https://127.0.0.1"
+		c.TwilioAccount = "AC1234567890"
+		c.TwilioAuthToken = "AAEAA1234567890"
+		c.TwilioPhoneNumber = "+1234567890"
+		s := newTestServer(t, c)
+
+		response := request(t, s, "POST", "/mytopic", "test", map[string]string{
+			"x-sms": "+invalid",
+		})
+		require.Equal(t, 40033, toHTTPError(t, response.Body.String()).Code)
+	})
+}
+
+func TestServer_Twilio_SMS_Anonymous(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		c := newTestConfigWithAuthFile(t, databaseURL)
+		c.TwilioCallsBaseURL = "https://127.0.0.1"
+		c.TwilioAccount = "AC1234567890"
+		c.TwilioAuthToken = "AAEAA1234567890"
+		c.TwilioPhoneNumber = "+1234567890"
+		s := newTestServer(t, c)
+
+		response := request(t, s, "POST", "/mytopic", "test", map[string]string{
+			"x-sms": "+123123",
+		})
+		require.Equal(t, 40066, toHTTPError(t, response.Body.String()).Code)
+	})
+}
+
+func TestServer_Twilio_SMS_Delayed(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		c := newTestConfigWithAuthFile(t, databaseURL)
+		c.TwilioCallsBaseURL = "https://127.0.0.1"
+		c.TwilioAccount = "AC1234567890"
+		c.TwilioAuthToken = "AAEAA1234567890"
+		c.TwilioPhoneNumber = "+1234567890"
+		s := newTestServer(t, c)
+
+		response := request(t, s, "POST", "/mytopic", "test", map[string]string{
+			"x-sms":   "yes",
+			"x-delay": "1h",
+		})
+		require.Equal(t, 40067, toHTTPError(t, response.Body.String()).Code)
+	})
+}
+
+func TestServer_Twilio_SMS_Unconfigured(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, databaseURL string) {
+		s := newTestServer(t, newTestConfig(t, databaseURL))
+		response := request(t, s, "POST", "/mytopic", "test", map[string]string{
+			"x-sms": "+1234",
+		})
+		require.Equal(t, 40065, toHTTPError(t, response.Body.String()).Code)
+	})
+}
+
+func TestFormatSMS(t *testing.T) {
+	m := model.NewDefaultMessage("mytopic", "Disk /dev/sda1 is 95% full")
+	require.Equal(t, "[mytopic] Disk /dev/sda1 is 95% full", formatSMS(m))
+
+	m.Title = "Disk alert"
+	require.Equal(t, "[mytopic] Disk alert\nDisk /dev/sda1 is 95% full", formatSMS(m))
+
+	// GSM-7: 4 segments of 153 characters; characters of the extension table ("[", "]", "€") count twice
+	m = model.NewDefaultMessage("mytopic", strings.Repeat("a", 600)+" the end")
+	require.Equal(t, "[mytopic] "+strings.Repeat("a", 597)+"...", formatSMS(m))
+
+	m = model.NewDefaultMessage("mytopic", strings.Repeat("€", 400))
+	require.Equal(t, "[mytopic] "+strings.Repeat("€", 298)+"...", formatSMS(m))
+
+	// UCS-2: 4 segments of 67 characters, emojis count twice
+	m = model.NewDefaultMessage("mytopic", "🔥 "+strings.Repeat("b", 300))
+	require.Equal(t, "[mytopic] 🔥 "+strings.Repeat("b", 252)+"...", formatSMS(m))
+
+	// Trailing whitespace is removed before the suffix
+	m = model.NewDefaultMessage("mytopic", strings.Repeat("a", 590)+"          b")
+	require.Equal(t, "[mytopic] "+strings.Repeat("a", 590)+"...", formatSMS(m))
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -13,37 +14,100 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/mail"
+	"net/netip"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
 	"github.com/microcosm-cc/bluemonday"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"heckel.io/ntfy/v2/log"
+	ntfymail "heckel.io/ntfy/v2/mail"
 	"heckel.io/ntfy/v2/model"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
 )
 
+// Values for the smtp-server-attachments option, which defines which attachments of incoming emails are published
+const (
+	SMTPServerAttachmentsFirst = "first" // Only the first attachment is published, along with the message
+	SMTPServerAttachmentsAll   = "all"   // The first attachment is published with the message, all others as separate messages
+	SMTPServerAttachmentsNone  = "none"  // Attachments are discarded
+)
+
+// SMTPServerSubjectRule maps incoming emails with a subject matching Regex to a priority and/or tags,
+// see smtp-server-subject-rules
+type SMTPServerSubjectRule struct {
+	Regex    *regexp.Regexp
+	Priority int      // Zero if the rule does not set a priority
+	Tags     []string // Empty if the rule does not set tags
+}
+
 var (
 	errInvalidDomain          = errors.New("invalid domain")
 	errInvalidAddress         = errors.New("invalid address")
 	errInvalidTopic           = errors.New("invalid topic")
+	errInvalidPriority        = errors.New("invalid priority")
 	errTooManyRecipients      = errors.New("too many recipients")
 	errMultipartNestedTooDeep = errors.New("multipart message nested too deep")
 	errUnsupportedContentType = errors.New("unsupported content type")
+	errAttachmentTooLarge     = errors.New("attachment too large")
+	errAuthFailed             = &smtp.SMTPError{Code: 535, EnhancedCode: smtp.EnhancedCode{5, 7, 8}, Message: "Authentication failed"}
+	errAuthRequired           = &smtp.SMTPError{Code: 530, EnhancedCode: smtp.EnhancedCode{5, 7, 0}, Message: "Authentication required"}
+	errAuthTooManyAttempts    = &smtp.SMTPError{Code: 454, EnhancedCode: smtp.EnhancedCode{4, 7, 0}, Message: "Too many failed authentication attempts, try again later"}
+	errAuthTOTPTokenRequired  = &smtp.SMTPError{Code: 535, EnhancedCode: smtp.EnhancedCode{5, 7, 8}, Message: "Two-factor authentication enabled, use an access token as password"}
+	errAuthTOTPRequired       = &smtp.SMTPError{Code: 535, EnhancedCode: smtp.EnhancedCode{5, 7, 8}, Message: "Two-factor authentication required, set it up in the web app first"}
+	errAddressTokenNotAllowed = &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Access tokens in addresses are not allowed, use SMTP AUTH"}
+	errTopicNotAllowed        = &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Not authorized to publish to topic"}
+	errSenderNotAllowed       = &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Sender not allowed"}
+	errReplyAddressInvalid    = &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "Invalid reply address"}
+	errReplyAddressExpired    = &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "Reply address expired"}
 )
 
 var (
 	onlySpacesRegex          = regexp.MustCompile(`(?m)^\s+$`)
 	consecutiveNewLinesRegex = regexp.MustCompile(`\n{3,}`)
 	htmlLineBreakRegex       = regexp.MustCompile(`(?i)<br\s*/?>`)
+	replyHeaderRegex         = regexp.MustCompile(`(?m)^(On\s[^\n]*(\n[^\n]*)?\swrote:|-{2,}\s*Original Message\s*-{2,}|_{10,})\s*$`)
+	replySubjectPrefixRegex  = regexp.MustCompile(`(?i)^((re|aw|sv):\s*)+`)
 )
 
 const (
-	maxMultipartDepth = 2
+	maxMultipartDepth  = 2
+	addrPriorityPrefix = "prio" // Address sub-part to set the priority, e.g. topic+prio5@domain
+	addrTagPrefix      = "tag_" // Address sub-part to add a tag, e.g. topic+tag_warning@domain
 )
 
+// mailBody is the content extracted from an incoming email
+type mailBody struct {
+	Text        string
+	Markdown    bool // True if Text was converted from HTML to markdown
+	Attachments []*mailAttachment
+}
+
+// mailAttachment is a file attached to an incoming email
+type mailAttachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// smtpAuther verifies SMTP AUTH credentials, and checks whether a user may publish to a topic
+type smtpAuther interface {
+	authenticateSMTP(ip netip.Addr, username, password string) (u *user.User, token bool, err error)
+	authorizeSMTP(u *user.User, topic string) error
+}
+
 // smtpBackend implements SMTP server methods.
 type smtpBackend struct {
 	config  *Config
+	auther  smtpAuther // May be nil, if auth is not enabled
 	handler func(http.ResponseWriter, *http.Request)
 	success int64
 	failure int64
@@ -53,9 +117,103 @@ type smtpBackend struct {
 var _ smtp.Backend = (*smtpBackend)(nil)
 var _ smtp.Session = (*smtpSession)(nil)
 
-func newMailBackend(conf *Config, handler func(http.ResponseWriter, *http.Request)) *smtpBackend {
+// newSMTPServerTLSConfig returns the TLS config for STARTTLS and the implicit TLS listener, using
+// smtp-server-cert-file/smtp-server-key-file, or cert-file/key-file. It returns nil if neither is set.
+func newSMTPServerTLSConfig(conf *Config) (*tls.Config, error) {
+	certFile, keyFile := conf.SMTPServerCertFile, conf.SMTPServerKeyFile
+	if certFile == "" && keyFile == "" {
+		certFile, keyFile = conf.CertFile, conf.KeyFile
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}, nil
+}
+
+// newSMTPServer creates the SMTP server for the given backend. If tlsConfig is set, STARTTLS is enabled, and
+// AUTH is only allowed on TLS connections (after STARTTLS, or via the implicit TLS listener), so that credentials
+// are never sent in cleartext. Without TLS config, AUTH is allowed on plaintext connections.
+func newSMTPServer(conf *Config, backend *smtpBackend, tlsConfig *tls.Config) *smtp.Server {
+	server := smtp.NewServer(backend)
+	server.Addr = conf.SMTPServerListen
+	server.Domain = conf.SMTPServerDomain
+	server.TLSConfig = tlsConfig // Enables STARTTLS, if set
+	server.ReadTimeout = 10 * time.Second
+	server.WriteTimeout = 10 * time.Second
+	server.MaxMessageBytes = 1024 * 1024 // Must be much larger than message size (headers, multipart, etc.)
+	if conf.SMTPServerAttachments != SMTPServerAttachmentsNone && conf.AttachmentCacheDir != "" {
+		server.MaxMessageBytes += int(conf.AttachmentFileSizeLimit * 4 / 3) // Attachments are base64-encoded
+	}
+	server.MaxRecipients = 1
+	server.AllowInsecureAuth = tlsConfig == nil
+	enableSMTPAuthLogin(server)
+	return server
+}
+
+// authenticateSMTP verifies SMTP AUTH credentials. Like with HTTP Basic auth, an empty username means that the
+// password is an access token. Since many mail clients do not allow empty usernames, the password may also be an
+// access token of the given user.
+//
+// Failed attempts count towards the same per-IP limit as failed HTTP logins. Two-factor authentication is enforced
+// like for the HTTP API (see checkTOTP), except that there is no enrollment exception: users with two-factor
+// authentication enabled must use an access token, and users whose role requires it must set it up first.
+// Errors returned by this function are SMTP errors, so they can be passed on to the client as is.
+func (s *Server) authenticateSMTP(ip netip.Addr, username, password string) (*user.User, bool, error) {
+	vip := s.visitor(ip, nil)
+	if !vip.AuthAllowed() {
+		return nil, false, errAuthTooManyAttempts
+	}
+	u, token, err := s.authenticateSMTPCredentials(username, password)
+	if err != nil {
+		vip.AuthFailed()
+		return nil, false, errAuthFailed
+	}
+	passwordAuth, required := !token, s.totpRequired(u)
+	if !passwordAuth && !required {
+		return u, token, nil
+	}
+	enabled, err := s.userManager.TOTPEnabled(u.ID)
+	if err != nil {
+		log.Tag(tagSMTP).Field("user_name", u.Name).Err(err).Warn("Cannot check two-factor authentication of user")
+		return nil, false, errAuthFailed
+	} else if enabled && passwordAuth {
+		return nil, false, errAuthTOTPTokenRequired
+	} else if required && !enabled {
+		return nil, false, errAuthTOTPRequired
+	}
+	return u, token, nil
+}
+
+func (s *Server) authenticateSMTPCredentials(username, password string) (*user.User, bool, error) {
+	if username != "" {
+		if u, err := s.auther.Authenticate(username, password); err == nil {
+			return u, false, nil
+		}
+	}
+	u, err := s.userManager.AuthenticateToken(password)
+	if err != nil {
+		return nil, false, err
+	} else if username != "" && u.Name != username {
+		return nil, false, user.ErrUnauthenticated
+	}
+	return u, true, nil
+}
+
+// authorizeSMTP checks if the given user (nil for anonymous) may publish to the topic
+func (s *Server) authorizeSMTP(u *user.User, topic string) error {
+	return s.userManager.Authorize(u, topic, user.PermissionWrite)
+}
+
+func newMailBackend(conf *Config, auther smtpAuther, handler func(http.ResponseWriter, *http.Request)) *smtpBackend {
 	return &smtpBackend{
 		config:  conf,
+		auther:  auther,
 		handler: handler,
 	}
 }
@@ -76,22 +234,63 @@ type smtpSession struct {
 	backend   *smtpBackend
 	conn      *smtp.Conn
 	topic     string
-	token     string // If email address contains token, e.g. topic+token@domain
-	basicAuth string // If SMTP AUTH PLAIN was used
+	token     string     // If email address contains token, e.g. topic+token@domain
+	priority  int        // If email address contains priority, e.g. topic+prio5@domain
+	tags      []string   // If email address contains tags, e.g. topic+tag_warning@domain
+	inReplyTo string     // If email address is a signed reply address, e.g. topic+re_...@domain, see mail.ReplyAddress
+	user      *user.User // If SMTP AUTH was used, and the credentials were verified
+	authToken string     // If SMTP AUTH was used with an access token as password
+	basicAuth string     // If SMTP AUTH was used with username and password
 	mu        sync.Mutex
 }
 
+// AuthPlain is called for SMTP AUTH PLAIN and LOGIN. If auth is enabled, the credentials are verified right away,
+// so that mail clients get immediate feedback. Like with HTTP Basic auth, the password may be an access token.
 func (s *smtpSession) AuthPlain(username, password string) error {
-	logem(s.conn).Field("smtp_username", username).Debug("AUTH PLAIN (with username %s)", username)
-	s.mu.Lock()
-	s.basicAuth = base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", username, password)))
-	s.mu.Unlock()
-	return nil
+	logem(s.conn).Field("smtp_username", username).Debug("AUTH (with username %s)", username)
+	return s.withFailCount(func() error {
+		if s.backend.auther == nil {
+			s.mu.Lock()
+			s.basicAuth = base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", username, password)))
+			s.mu.Unlock()
+			return nil
+		}
+		u, token, err := s.backend.auther.authenticateSMTP(s.remoteIP(), username, password)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.user = u
+		if token {
+			s.authToken = password
+		} else {
+			s.basicAuth = base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", username, password)))
+		}
+		return nil
+	})
 }
 
 func (s *smtpSession) Mail(from string, opts *smtp.MailOptions) error {
 	logem(s.conn).Field("smtp_mail_from", from).Debug("MAIL FROM: %s", from)
-	return nil
+	return s.withFailCount(func() error {
+		s.mu.Lock()
+		authenticated := s.user != nil
+		s.mu.Unlock()
+		if authenticated {
+			return nil // Authenticated senders are not subject to the sender allowlists
+		}
+		conf := s.backend.config
+		if len(conf.SMTPServerSenderDomains) > 0 && !senderDomainAllowed(conf.SMTPServerSenderDomains, from) {
+			return errSenderNotAllowed
+		}
+		if len(conf.SMTPServerSenderPrefixes) > 0 {
+			if ip := s.remoteIP(); !ip.IsValid() || !util.ContainsIP(conf.SMTPServerSenderPrefixes, ip) {
+				return errSenderNotAllowed
+			}
+		}
+		return nil
+	})
 }
 
 func (s *smtpSession) Rcpt(to string) error {
@@ -118,23 +317,92 @@ func (s *smtpSession) Rcpt(to string) error {
 			// remove ntfy- from beginning of email
 			to = strings.TrimPrefix(to, conf.SMTPServerAddrPrefix)
 		}
-		// If email contains token, split topic and token
+		// If email contains token, priority or tags, split them off the topic, e.g. topic+prio5+tag_warning+tk_...
+		priority := 0
+		tags := make([]string, 0)
+		inReplyTo := ""
 		if strings.Contains(to, "+") {
 			parts := strings.Split(to, "+")
 			to = parts[0]
-			token = parts[1]
+			for _, part := range parts[1:] {
+				if p, ok := strings.CutPrefix(strings.ToLower(part), addrPriorityPrefix); ok {
+					priority, err = util.ParsePriority(p)
+					if err != nil || priority == 0 {
+						return errInvalidPriority
+					}
+				} else if tag, ok := strings.CutPrefix(part, addrTagPrefix); ok && tag != "" {
+					tags = append(tags, tag)
+				} else if replyToken, ok := strings.CutPrefix(strings.ToLower(part), ntfymail.ReplyTokenPrefix); ok && conf.SMTPServerReplySecret != "" {
+					inReplyTo, err = ntfymail.ParseReplyToken(conf.SMTPServerReplySecret, to, replyToken)
+					if errors.Is(err, ntfymail.ErrReplyTokenExpired) {
+						return errReplyAddressExpired
+					} else if err != nil {
+						return errReplyAddressInvalid
+					}
+				} else {
+					token = part
+				}
+			}
 		}
 		if !topicRegex.MatchString(to) {
 			return errInvalidTopic
 		}
+		if conf.SMTPServerRequireAuth {
+			if err := s.checkRequireAuth(to, token); err != nil {
+				return err
+			}
+		} else if inReplyTo != "" && token == "" {
+			if err := s.checkReplyAuth(to); err != nil {
+				return err
+			}
+		}
 		s.mu.Lock()
 		s.topic = to
 		s.token = token
+		s.priority = priority
+		s.tags = tags
+		s.inReplyTo = inReplyTo
 		s.mu.Unlock()
 		return nil
 	})
 }
 
+// checkRequireAuth enforces the smtp-server-require-auth option: Access tokens may not be passed in the address
+// (since addresses end up in mail logs), and topics that cannot be written to anonymously require SMTP AUTH.
+func (s *smtpSession) checkRequireAuth(topic, addressToken string) error {
+	if addressToken != "" {
+		return errAddressTokenNotAllowed
+	} else if s.backend.auther == nil {
+		return nil
+	}
+	s.mu.Lock()
+	u := s.user
+	s.mu.Unlock()
+	if err := s.backend.auther.authorizeSMTP(u, topic); err != nil {
+		if u == nil {
+			return errAuthRequired
+		}
+		return errTopicNotAllowed
+	}
+	return nil
+}
+
+// checkReplyAuth rejects replies to topics that the sender cannot write to right away, rather than after the
+// e-mail was received. The reply address only identifies the original message, it does not grant write access,
+// so replies to protected topics require anonymous write access, or SMTP AUTH.
+func (s *smtpSession) checkReplyAuth(topic string) error {
+	if s.backend.auther == nil {
+		return nil
+	}
+	s.mu.Lock()
+	u := s.user
+	s.mu.Unlock()
+	if err := s.backend.auther.authorizeSMTP(u, topic); err != nil {
+		return errTopicNotAllowed
+	}
+	return nil
+}
+
 func (s *smtpSession) Data(r io.Reader) error {
 	return s.withFailCount(func() error {
 		conf := s.backend.config
@@ -152,15 +420,21 @@ func (s *smtpSession) Data(r io.Reader) error {
 		if err != nil {
 			return err
 		}
-		body, err := readMailBody(msg.Body, msg.Header)
+		body, err := readMailBody(msg.Body, msg.Header, conf.SMTPServerHTMLMarkdown)
 		if err != nil {
 			return err
 		}
-		body = strings.TrimSpace(body)
-		if len(body) > conf.MessageSizeLimit {
-			body = body[:conf.MessageSizeLimit]
+		text := strings.TrimSpace(body.Text)
+		if s.inReplyTo != "" {
+			text = stripQuotedReply(text)
+		}
+		if len(text) > conf.MessageSizeLimit {
+			text = text[:conf.MessageSizeLimit]
+		}
+		m := model.NewDefaultMessage(s.topic, text)
+		if body.Markdown {
+			m.ContentType = "text/markdown"
 		}
-		m := model.NewDefaultMessage(s.topic, body)
 		subject := strings.TrimSpace(msg.Header.Get("Subject"))
 		if subject != "" {
 			dec := mime.WordDecoder{}
@@ -170,11 +444,16 @@ func (s *smtpSession) Data(r io.Reader) error {
 			}
 			m.Title = subject
 		}
+		if s.inReplyTo != "" {
+			m.InReplyTo = s.inReplyTo
+			m.Title = replySubjectPrefixRegex.ReplaceAllString(m.Title, "")
+		}
+		s.applyMappingRules(m, msg.Header)
 		if m.Title != "" && m.Message == "" {
 			m.Message = m.Title // Flip them, this makes more sense
 			m.Title = ""
 		}
-		if err := s.publishMessage(m); err != nil {
+		if err := s.publishMessageWithAttachments(m, s.publishableAttachments(body.Attachments)); err != nil {
 			return err
 		}
 		s.backend.mu.Lock()
@@ -185,7 +464,87 @@ func (s *smtpSession) Data(r io.Reader) error {
 	})
 }
 
-func (s *smtpSession) publishMessage(m *model.Message) error {
+// applyMappingRules maps email headers, the subject and the address sub-parts to message fields. Subject rules
+// override the priority from the headers, and the priority from the address overrides both.
+func (s *smtpSession) applyMappingRules(m *model.Message, header mail.Header) {
+	conf := s.backend.config
+	if conf.SMTPServerHeaderPriority {
+		m.Priority = readMailHeaderPriority(header)
+	}
+	for _, rule := range conf.SMTPServerSubjectRules {
+		if !rule.Regex.MatchString(m.Title) {
+			continue
+		}
+		if rule.Priority > 0 {
+			m.Priority = rule.Priority
+		}
+		m.Tags = appendTags(m.Tags, rule.Tags...)
+	}
+	if s.priority > 0 {
+		m.Priority = s.priority
+	}
+	m.Tags = appendTags(m.Tags, s.tags...)
+	if conf.SMTPServerSenderClick {
+		if sender := readMailHeaderSender(header); sender != "" {
+			m.Click = "mailto:" + sender
+		}
+	}
+}
+
+// publishableAttachments returns the attachments of an incoming email that should be published, depending
+// on the smtp-server-attachments option. If attachments are not enabled on this server, they are discarded.
+func (s *smtpSession) publishableAttachments(attachments []*mailAttachment) []*mailAttachment {
+	conf := s.backend.config
+	if len(attachments) == 0 || conf.AttachmentCacheDir == "" || conf.BaseURL == "" {
+		return nil
+	}
+	switch conf.SMTPServerAttachments {
+	case SMTPServerAttachmentsFirst:
+		return attachments[:1]
+	case SMTPServerAttachmentsAll:
+		return attachments
+	}
+	return nil
+}
+
+// publishMessageWithAttachments publishes the message along with the first attachment, and all other attachments
+// as separate messages. Attachments that exceed the visitor's attachment limits are dropped, so that the
+// message itself is still delivered.
+func (s *smtpSession) publishMessageWithAttachments(m *model.Message, attachments []*mailAttachment) error {
+	if len(attachments) == 0 {
+		return s.publishMessage(m, nil)
+	}
+	for i, a := range attachments {
+		am := m
+		if i > 0 {
+			am = model.NewDefaultMessage(m.Topic, "")
+			am.Title = m.Title
+			am.Priority = m.Priority
+			am.Tags = m.Tags
+			am.Click = m.Click
+			am.InReplyTo = m.InReplyTo
+		}
+		err := s.publishMessage(am, a)
+		if errors.Is(err, errAttachmentTooLarge) {
+			logem(s.conn).
+				Err(err).
+				Field("smtp_attachment_name", a.Name).
+				Field("smtp_attachment_size", len(a.Data)).
+				Info("Attachment exceeds limits, dropping it")
+			if i == 0 {
+				err = s.publishMessage(m, nil)
+			} else {
+				err = nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *smtpSession) publishMessage(m *model.Message, a *mailAttachment) error {
 	// Extract remote address (for rate limiting)
 	remoteAddr, _, err := net.SplitHostPort(s.conn.Conn().RemoteAddr().String())
 	if err != nil {
@@ -193,7 +552,11 @@ func (s *smtpSession) publishMessage(m *model.Message) error {
 	}
 	// Call HTTP handler with fake HTTP request
 	url := fmt.Sprintf("%s/%s", s.backend.config.BaseURL, m.Topic)
-	req, err := http.NewRequest("POST", url, strings.NewReader(m.Message))
+	var body io.Reader = strings.NewReader(m.Message)
+	if a != nil {
+		body = bytes.NewReader(a.Data)
+	}
+	req, err := http.NewRequest("POST", url, body)
 	if err != nil {
 		return err
 	}
@@ -203,14 +566,42 @@ func (s *smtpSession) publishMessage(m *model.Message) error {
 	if m.Title != "" {
 		req.Header.Set("Title", m.Title)
 	}
+	if m.ContentType == "text/markdown" {
+		req.Header.Set("Markdown", "yes")
+	}
+	if m.Priority > 0 {
+		req.Header.Set("Priority", strconv.Itoa(m.Priority))
+	}
+	if len(m.Tags) > 0 {
+		req.Header.Set("Tags", strings.Join(m.Tags, ","))
+	}
+	if m.Click != "" {
+		req.Header.Set("Click", m.Click)
+	}
+	if m.InReplyTo != "" {
+		req.Header.Set("X-In-Reply-To", m.InReplyTo)
+	}
+	if a != nil {
+		req.Header.Set("Filename", a.Name)
+		if m.Message != "" {
+			req.Header.Set("Message", m.Message)
+		}
+		req = withContext(req, map[contextKey]any{
+			contextAttachmentType: a.ContentType,
+		})
+	}
 	if s.token != "" {
 		req.Header.Add("Authorization", "Bearer "+s.token)
+	} else if s.authToken != "" {
+		req.Header.Add("Authorization", "Bearer "+s.authToken)
 	} else if s.basicAuth != "" {
 		req.Header.Add("Authorization", "Basic "+s.basicAuth)
 	}
 	rr := httptest.NewRecorder()
 	s.backend.handler(rr, req)
-	if rr.Code != http.StatusOK {
+	if rr.Code == http.StatusRequestEntityTooLarge && a != nil {
+		return fmt.Errorf("%w: %s", errAttachmentTooLarge, rr.Body.String())
+	} else if rr.Code != http.StatusOK {
 		return errors.New("error: " + rr.Body.String())
 	}
 	return nil
@@ -224,11 +615,22 @@ func (s *smtpSession) Reset() {
 
 func (s *smtpSession) Logout() error {
 	s.mu.Lock()
+	s.user = nil
+	s.authToken = ""
 	s.basicAuth = ""
 	s.mu.Unlock()
 	return nil
 }
 
+// remoteIP returns the IP address of the client, or an invalid address if it cannot be determined
+func (s *smtpSession) remoteIP() netip.Addr {
+	addrPort, err := netip.ParseAddrPort(s.conn.Conn().RemoteAddr().String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addrPort.Addr().Unmap()
+}
+
 func (s *smtpSession) withFailCount(fn func() error) error {
 	err := fn()
 	s.backend.mu.Lock()
@@ -243,36 +645,166 @@ func (s *smtpSession) withFailCount(fn func() error) error {
 	return err
 }
 
-func readMailBody(body io.Reader, header mail.Header) (string, error) {
+// senderDomainAllowed returns true if the domain of the envelope sender address (MAIL FROM) is one of the given
+// domains, or a subdomain of one of them
+func senderDomainAllowed(domains []string, from string) bool {
+	_, domain, found := strings.Cut(from, "@")
+	if !found {
+		return false
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, ">"))
+	for _, allowed := range domains {
+		allowed = strings.ToLower(allowed)
+		if domain == allowed || strings.HasSuffix(domain, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// enableSMTPAuthLogin adds support for the (obsolete, but still widely used) AUTH LOGIN mechanism. Like AUTH PLAIN,
+// the credentials are passed to smtpSession.AuthPlain.
+func enableSMTPAuthLogin(server *smtp.Server) {
+	server.EnableAuth(sasl.Login, func(conn *smtp.Conn) sasl.Server {
+		return &smtpLoginServer{
+			authenticate: func(username, password string) error {
+				return conn.Session().AuthPlain(username, password)
+			},
+		}
+	})
+}
+
+// smtpLoginServer implements the server side of the LOGIN SASL mechanism, which go-sasl does not provide
+type smtpLoginServer struct {
+	authenticate func(username, password string) error
+	username     *string
+}
+
+var _ sasl.Server = (*smtpLoginServer)(nil)
+
+func (a *smtpLoginServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	if a.username == nil {
+		if response == nil {
+			return []byte("Username:"), false, nil
+		}
+		username := string(response)
+		a.username = &username
+		return []byte("Password:"), false, nil
+	}
+	return nil, true, a.authenticate(*a.username, string(response))
+}
+
+// readMailHeaderPriority maps the "X-Priority" header (1 = highest, 5 = lowest) or the "Importance" header
+// (high, normal, low) to a message priority, or returns 0 if neither is set
+func readMailHeaderPriority(header mail.Header) int {
+	if fields := strings.Fields(header.Get("X-Priority")); len(fields) > 0 { // e.g. "1 (Highest)"
+		if p, err := strconv.Atoi(fields[0]); err == nil && p >= 1 && p <= 5 {
+			return 6 - p
+		}
+	}
+	switch strings.ToLower(strings.TrimSpace(header.Get("Importance"))) {
+	case "high":
+		return 4
+	case "low":
+		return 2
+	}
+	return 0
+}
+
+// readMailHeaderSender returns the address to reply to, i.e. the "Reply-To" address, or the "From" address
+func readMailHeaderSender(header mail.Header) string {
+	for _, key := range []string{"Reply-To", "From"} {
+		if addresses, err := header.AddressList(key); err == nil && len(addresses) > 0 {
+			return addresses[0].Address
+		}
+	}
+	return ""
+}
+
+// stripQuotedReply removes the quoted original message from an email reply. Everything after a reply header
+// such as "On ... wrote:" or "-----Original Message-----" is cut off, as well as all lines quoted with ">".
+func stripQuotedReply(s string) string {
+	if loc := replyHeaderRegex.FindStringIndex(s); loc != nil {
+		s = s[:loc[0]]
+	}
+	lines := strings.Split(s, "\n")
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if !strings.HasPrefix(strings.TrimSpace(line), ">") {
+			kept = append(kept, line)
+		}
+	}
+	return removeExtraEmptyLines(strings.TrimSpace(strings.Join(kept, "\n")))
+}
+
+func appendTags(tags []string, newTags ...string) []string {
+	for _, tag := range newTags {
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func readMailBody(body io.Reader, header mail.Header, htmlAsMarkdown bool) (*mailBody, error) {
 	if header.Get("Content-Type") == "" {
-		return readPlainTextMailBody(body, header.Get("Content-Transfer-Encoding"))
+		text, err := readPlainTextMailBody(body, header.Get("Content-Transfer-Encoding"))
+		if err != nil {
+			return nil, err
+		}
+		return &mailBody{Text: text}, nil
 	}
 	contentType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	canonicalContentType := strings.ToLower(contentType)
-	if canonicalContentType == "text/plain" || canonicalContentType == "text/html" {
-		return readTextMailBody(body, canonicalContentType, header.Get("Content-Transfer-Encoding"))
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if strings.ToLower(disposition) == "attachment" {
+		a, err := readMailAttachment(body, canonicalContentType, params, dispositionParams, header.Get("Content-Transfer-Encoding"))
+		if err != nil {
+			return nil, err
+		}
+		return &mailBody{Attachments: []*mailAttachment{a}}, nil
+	} else if canonicalContentType == "text/plain" {
+		text, err := readPlainTextMailBody(body, header.Get("Content-Transfer-Encoding"))
+		if err != nil {
+			return nil, err
+		}
+		return &mailBody{Text: text}, nil
+	} else if canonicalContentType == "text/html" {
+		return readHTMLMailBodyMaybeMarkdown(body, header.Get("Content-Transfer-Encoding"), htmlAsMarkdown)
 	} else if strings.HasPrefix(canonicalContentType, "multipart/") {
-		return readMultipartMailBody(body, params)
+		return readMultipartMailBody(body, params, htmlAsMarkdown)
 	}
-	return "", errUnsupportedContentType
+	return nil, errUnsupportedContentType
 }
 
-func readMultipartMailBody(body io.Reader, params map[string]string) (string, error) {
+func readMultipartMailBody(body io.Reader, params map[string]string, htmlAsMarkdown bool) (*mailBody, error) {
 	parts := make(map[string]string)
-	if err := readMultipartMailBodyParts(body, params, 0, parts); err != nil && err != io.EOF {
-		return "", err
+	attachments := make([]*mailAttachment, 0)
+	if err := readMultipartMailBodyParts(body, params, 0, parts, &attachments); err != nil && err != io.EOF {
+		return nil, err
 	} else if s, ok := parts["text/plain"]; ok {
-		return s, nil
+		return &mailBody{Text: s, Attachments: attachments}, nil
 	} else if s, ok := parts["text/html"]; ok {
-		return s, nil
+		mb, err := readHTMLMailBodyMaybeMarkdown(strings.NewReader(s), "", htmlAsMarkdown)
+		if err != nil {
+			return nil, err
+		}
+		mb.Attachments = attachments
+		return mb, nil
+	} else if len(attachments) > 0 {
+		return &mailBody{Attachments: attachments}, nil
 	}
-	return "", io.EOF
+	return nil, io.EOF
 }
 
-func readMultipartMailBodyParts(body io.Reader, params map[string]string, depth int, parts map[string]string) error {
+// readMultipartMailBodyParts reads all text parts into the parts map (raw, keyed by content type), and
+// all attachments into the attachments slice. A part is an attachment if it is marked as such via
+// "Content-Disposition: attachment", or if it has a filename and is not referenced from the HTML body
+// (i.e. has no Content-ID, like inline images). All other parts are ignored.
+func readMultipartMailBodyParts(body io.Reader, params map[string]string, depth int, parts map[string]string, attachments *[]*mailAttachment) error {
 	if depth >= maxMultipartDepth {
 		return errMultipartNestedTooDeep
 	}
@@ -287,28 +819,79 @@ func readMultipartMailBodyParts(body io.Reader, params map[string]string, depth
 			return err
 		}
 		canonicalPartContentType := strings.ToLower(partContentType)
-		if canonicalPartContentType == "text/plain" || canonicalPartContentType == "text/html" {
-			s, err := readTextMailBody(part, canonicalPartContentType, part.Header.Get("Content-Transfer-Encoding"))
+		disposition, dispositionParams, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		hasFilename := dispositionParams["filename"] != "" || partParams["name"] != ""
+		isAttachment := strings.ToLower(disposition) == "attachment" || (hasFilename && part.Header.Get("Content-ID") == "")
+		if !isAttachment && (canonicalPartContentType == "text/plain" || canonicalPartContentType == "text/html") {
+			s, err := readPlainTextMailBody(part, part.Header.Get("Content-Transfer-Encoding"))
 			if err != nil {
 				return err
 			}
 			parts[canonicalPartContentType] = s
-		} else if strings.HasPrefix(strings.ToLower(partContentType), "multipart/") {
-			if err := readMultipartMailBodyParts(part, partParams, depth+1, parts); err != nil {
+		} else if !isAttachment && strings.HasPrefix(canonicalPartContentType, "multipart/") {
+			if err := readMultipartMailBodyParts(part, partParams, depth+1, parts, attachments); err != nil && err != io.EOF {
+				return err
+			}
+		} else if isAttachment {
+			a, err := readMailAttachment(part, canonicalPartContentType, partParams, dispositionParams, part.Header.Get("Content-Transfer-Encoding"))
+			if err != nil {
 				return err
 			}
+			*attachments = append(*attachments, a)
 		}
 		// Continue with next part
 	}
 }
 
-func readTextMailBody(reader io.Reader, contentType, transferEncoding string) (string, error) {
-	if contentType == "text/plain" {
-		return readPlainTextMailBody(reader, transferEncoding)
-	} else if contentType == "text/html" {
-		return readHTMLMailBody(reader, transferEncoding)
+func readMailAttachment(reader io.Reader, contentType string, params, dispositionParams map[string]string, transferEncoding string) (*mailAttachment, error) {
+	if strings.ToLower(transferEncoding) == "base64" {
+		reader = base64.NewDecoder(base64.StdEncoding, reader)
+	} else if strings.ToLower(transferEncoding) == "quoted-printable" {
+		reader = quotedprintable.NewReader(reader)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
 	}
-	return "", fmt.Errorf("unsupported content type: %s", contentType)
+	name := dispositionParams["filename"]
+	if name == "" {
+		name = params["name"]
+	}
+	dec := mime.WordDecoder{}
+	if decoded, err := dec.DecodeHeader(name); err == nil {
+		name = decoded
+	}
+	name = strings.TrimSpace(strings.ReplaceAll(name, "/", "_"))
+	if name == "" {
+		name = "attachment"
+		if exts, _ := mime.ExtensionsByType(contentType); len(exts) > 0 {
+			name += exts[0]
+		}
+	}
+	return &mailAttachment{
+		Name:        name,
+		ContentType: contentType,
+		Data:        data,
+	}, nil
+}
+
+func readHTMLMailBodyMaybeMarkdown(reader io.Reader, transferEncoding string, htmlAsMarkdown bool) (*mailBody, error) {
+	if !htmlAsMarkdown {
+		text, err := readHTMLMailBody(reader, transferEncoding)
+		if err != nil {
+			return nil, err
+		}
+		return &mailBody{Text: text}, nil
+	}
+	body, err := readPlainTextMailBody(reader, transferEncoding)
+	if err != nil {
+		return nil, err
+	}
+	text, err := htmlToMarkdown(body)
+	if err != nil {
+		return nil, err
+	}
+	return &mailBody{Text: text, Markdown: true}, nil
 }
 
 func readPlainTextMailBody(reader io.Reader, transferEncoding string) (string, error) {
@@ -344,3 +927,218 @@ func removeExtraEmptyLines(s string) string {
 	s = consecutiveNewLinesRegex.ReplaceAllString(s, "\n\n")
 	return s
 }
+
+// htmlToMarkdown converts the HTML body of an email to markdown. Only a safe subset of elements
+// is converted (headings, emphasis, links, lists, quotes, code); everything else is reduced to its text.
+func htmlToMarkdown(s string) (string, error) {
+	doc, err := html.Parse(strings.NewReader(s))
+	if err != nil {
+		return "", err
+	}
+	w := &markdownWriter{}
+	w.writeNode(doc)
+	return removeExtraEmptyLines(strings.TrimSpace(w.buf.String())), nil
+}
+
+var markdownEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `_`, `\_`, "`", "\\`", `[`, `\[`, `]`, `\]`)
+
+// markdownWriter walks an HTML node tree and writes markdown. Like a browser, it collapses
+// whitespace in text nodes, except inside <pre> blocks.
+type markdownWriter struct {
+	buf    bytes.Buffer
+	prefix string // Prefix for new lines, e.g. "> " in block quotes
+	pre    bool   // True inside <pre>
+	space  bool   // True if a space is pending, i.e. will be written before the next text
+}
+
+func (w *markdownWriter) writeNode(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		w.writeText(n.Data)
+		return
+	case html.ElementNode:
+		w.writeElement(n)
+		return
+	}
+	w.writeChildren(n)
+}
+
+func (w *markdownWriter) writeChildren(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		w.writeNode(c)
+	}
+}
+
+func (w *markdownWriter) writeElement(n *html.Node) {
+	switch n.DataAtom {
+	case atom.Script, atom.Style, atom.Head, atom.Title, atom.Img:
+		// Skip entirely
+	case atom.Br:
+		w.trimTrailingSpace()
+		w.buf.WriteString("  \n" + w.prefix) // Two trailing spaces mark a hard line break
+		w.space = false
+	case atom.P:
+		w.blankLine()
+		w.writeChildren(n)
+		w.blankLine()
+	case atom.Td, atom.Th:
+		w.space = true
+		w.writeChildren(n)
+		w.space = true
+	case atom.Div, atom.Tr, atom.Table:
+		w.newline()
+		w.writeChildren(n)
+		w.newline()
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		w.blankLine()
+		w.write(strings.Repeat("#", int(n.Data[1]-'0')) + " ")
+		w.writeChildren(n)
+		w.blankLine()
+	case atom.B, atom.Strong:
+		w.writeWrapped(n, "**")
+	case atom.I, atom.Em:
+		w.writeWrapped(n, "_")
+	case atom.Code:
+		if w.pre {
+			w.writeChildren(n)
+		} else {
+			w.write("`" + strings.ReplaceAll(textContent(n), "`", "") + "`")
+		}
+	case atom.A:
+		href := strings.TrimSpace(attr(n, "href"))
+		lowerHref := strings.ToLower(href)
+		if strings.HasPrefix(lowerHref, "http://") || strings.HasPrefix(lowerHref, "https://") || strings.HasPrefix(lowerHref, "mailto:") {
+			w.write("[")
+			w.writeChildren(n)
+			w.writeClosing("](" + strings.NewReplacer("(", "%28", ")", "%29", " ", "%20").Replace(href) + ")")
+		} else {
+			w.writeChildren(n)
+		}
+	case atom.Ul, atom.Ol:
+		w.blankLine()
+		i := 1
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode || c.DataAtom != atom.Li {
+				continue
+			}
+			w.newline()
+			if n.DataAtom == atom.Ol {
+				w.write(fmt.Sprintf("%d. ", i))
+			} else {
+				w.write("- ")
+			}
+			w.writeChildren(c)
+			i++
+		}
+		w.blankLine()
+	case atom.Blockquote:
+		w.blankLine()
+		prefix := w.prefix
+		w.prefix += "> "
+		w.write("> ")
+		w.writeChildren(n)
+		w.prefix = prefix
+		w.blankLine()
+	case atom.Pre:
+		w.blankLine()
+		w.write("```")
+		w.newline()
+		w.pre = true
+		w.writeChildren(n)
+		w.pre = false
+		w.newline()
+		w.write("```")
+		w.blankLine()
+	case atom.Hr:
+		w.blankLine()
+		w.write("---")
+		w.blankLine()
+	default:
+		w.writeChildren(n)
+	}
+}
+
+func (w *markdownWriter) writeWrapped(n *html.Node, marker string) {
+	text := strings.TrimSpace(textContent(n))
+	if text == "" {
+		return
+	}
+	w.write(marker)
+	w.writeText(text)
+	w.writeClosing(marker)
+}
+
+func (w *markdownWriter) writeText(s string) {
+	if w.pre {
+		w.write(strings.ReplaceAll(s, "\n", "\n"+w.prefix))
+		return
+	}
+	isSpace := func(r rune) bool { return r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '\f' }
+	for i, field := range strings.FieldsFunc(s, isSpace) {
+		if i > 0 || strings.IndexFunc(s, isSpace) == 0 {
+			w.space = true
+		}
+		w.write(markdownEscaper.Replace(field))
+	}
+	if s != "" && strings.LastIndexFunc(s, isSpace) == len(s)-1 {
+		w.space = true
+	}
+}
+
+// write writes s, preceded by a pending space (if any)
+func (w *markdownWriter) write(s string) {
+	if w.space && w.buf.Len() > 0 && !bytes.HasSuffix(w.buf.Bytes(), []byte(" ")) && !bytes.HasSuffix(w.buf.Bytes(), []byte("\n")) {
+		w.buf.WriteString(" ")
+	}
+	w.space = false
+	w.buf.WriteString(s)
+}
+
+// writeClosing writes a closing marker (e.g. "**"), leaving a pending space for the next text
+func (w *markdownWriter) writeClosing(s string) {
+	w.buf.WriteString(s)
+}
+
+func (w *markdownWriter) newline() {
+	w.trimTrailingSpace()
+	if w.buf.Len() > 0 && !bytes.HasSuffix(w.buf.Bytes(), []byte("\n")) {
+		w.buf.WriteString("\n" + w.prefix)
+	}
+	w.space = false
+}
+
+func (w *markdownWriter) blankLine() {
+	w.trimTrailingSpace()
+	if w.buf.Len() > 0 && !bytes.HasSuffix(w.buf.Bytes(), []byte("\n\n")) {
+		if bytes.HasSuffix(w.buf.Bytes(), []byte("\n")) {
+			w.buf.WriteString(strings.TrimSpace(w.prefix) + "\n" + w.prefix)
+		} else {
+			w.buf.WriteString("\n" + strings.TrimSpace(w.prefix) + "\n" + w.prefix)
+		}
+	}
+	w.space = false
+}
+
+func (w *markdownWriter) trimTrailingSpace() {
+	w.buf.Truncate(len(bytes.TrimRight(w.buf.Bytes(), " ")))
+}
+
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var sb strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		sb.WriteString(textContent(c))
+	}
+	return sb.String()
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
@@ -2,11 +2,29 @@ package server
 
 import (
 	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
 	"github.com/stretchr/testify/require"
+	ntfymail "heckel.io/ntfy/v2/mail"
+	"heckel.io/ntfy/v2/model"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
 	"io"
+	"math/big"
 	"net"
 	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"testing"
 	"time"
@@ -1441,14 +1459,820 @@ what's up
 	writeAndReadUntilLine(t, email, c, scanner, "250 2.0.0 OK: queued")
 }
 
+const attachmentEmail = `EHLO example.com
+MAIL FROM: scanner@example.com
+RCPT TO: ntfy-scans@ntfy.sh
+DATA
+MIME-Version: 1.0
+Subject: Scan from office printer
+From: Scanner <scanner@example.com>
+To: ntfy-scans@ntfy.sh
+Content-Type: multipart/mixed; boundary="boundary1"
+
+--boundary1
+Content-Type: multipart/alternative; boundary="boundary2"
+
+--boundary2
+Content-Type: text/plain; charset="UTF-8"
+
+Your scan is attached
+
+--boundary2
+Content-Type: text/html; charset="UTF-8"
+
+<p>Your scan is attached</p>
+
+--boundary2--
+
+--boundary1
+Content-Type: text/csv; name="scan-index.csv"
+Content-Disposition: attachment; filename="scan-index.csv"
+Content-Transfer-Encoding: base64
+
+cGFnZSxzaXplCjEsMTIzNAo=
+
+--boundary1
+Content-Type: image/png; name="=?UTF-8?B?U2NhbiDDvGJlcnNpY2h0LnBuZw==?="
+Content-Transfer-Encoding: base64
+
+iVBORw0KGgo=
+
+--boundary1--
+.
+`
+
+func TestSmtpBackend_Attachment_First(t *testing.T) {
+	count := 0
+	s, c, _, scanner := newTestSMTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		count++
+		require.Equal(t, "/scans", r.URL.Path)
+		require.Equal(t, "Scan from office printer", r.Header.Get("Title"))
+		require.Equal(t, "Your scan is attached", r.Header.Get("Message"))
+		require.Equal(t, "scan-index.csv", r.Header.Get("Filename"))
+		contentType, err := fromContext[string](r, contextAttachmentType)
+		require.Nil(t, err)
+		require.Equal(t, "text/csv", contentType)
+		require.Equal(t, "page,size\n1,1234\n", readAll(t, r.Body))
+	})
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, attachmentEmail, c, scanner, "250 2.0.0 OK: queued")
+	require.Equal(t, 1, count)
+}
+
+func TestSmtpBackend_Attachment_All(t *testing.T) {
+	var filenames, messages, bodies []string
+	s, c, conf, scanner := newTestSMTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/scans", r.URL.Path)
+		require.Equal(t, "Scan from office printer", r.Header.Get("Title"))
+		filenames = append(filenames, r.Header.Get("Filename"))
+		messages = append(messages, r.Header.Get("Message"))
+		bodies = append(bodies, readAll(t, r.Body))
+	})
+	conf.SMTPServerAttachments = SMTPServerAttachmentsAll
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, attachmentEmail, c, scanner, "250 2.0.0 OK: queued")
+	require.Equal(t, []string{"scan-index.csv", "Scan übersicht.png"}, filenames)
+	require.Equal(t, []string{"Your scan is attached", ""}, messages)
+	require.Equal(t, []string{"page,size\n1,1234\n", "\x89PNG\r\n\x1a\n"}, bodies)
+}
+
+func TestSmtpBackend_Attachment_None(t *testing.T) {
+	count := 0
+	s, c, conf, scanner := newTestSMTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		count++
+		require.Equal(t, "", r.Header.Get("Filename"))
+		require.Equal(t, "Your scan is attached", readAll(t, r.Body))
+	})
+	conf.SMTPServerAttachments = SMTPServerAttachmentsNone
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, attachmentEmail, c, scanner, "250 2.0.0 OK: queued")
+	require.Equal(t, 1, count)
+}
+
+func TestSmtpBackend_Attachment_AttachmentsDisabled(t *testing.T) {
+	s, c, conf, scanner := newTestSMTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "", r.Header.Get("Filename"))
+		require.Equal(t, "Your scan is attached", readAll(t, r.Body))
+	})
+	conf.AttachmentCacheDir = ""
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, attachmentEmail, c, scanner, "250 2.0.0 OK: queued")
+}
+
+func TestSmtpBackend_Attachment_TooLarge(t *testing.T) {
+	var filenames, bodies []string
+	s, c, _, scanner := newTestSMTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		filenames = append(filenames, r.Header.Get("Filename"))
+		bodies = append(bodies, readAll(t, r.Body))
+		if r.Header.Get("Filename") != "" {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, attachmentEmail, c, scanner, "250 2.0.0 OK: queued")
+	require.Equal(t, []string{"scan-index.csv", ""}, filenames)
+	require.Equal(t, "Your scan is attached", bodies[1])
+}
+
+func TestSmtpBackend_Attachment_OnlyAttachment(t *testing.T) {
+	email := `EHLO example.com
+MAIL FROM: scanner@example.com
+RCPT TO: ntfy-scans@ntfy.sh
+DATA
+Subject: Scan
+Content-Type: application/pdf
+Content-Disposition: attachment
+Content-Transfer-Encoding: base64
+
+JVBERi0xLjQK
+.
+`
+	s, c, _, scanner := newTestSMTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "", r.Header.Get("Title")) // We flipped message and title
+		require.Equal(t, "Scan", r.Header.Get("Message"))
+		require.Equal(t, "attachment.pdf", r.Header.Get("Filename"))
+		require.Equal(t, "%PDF-1.4\n", readAll(t, r.Body))
+	})
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, email, c, scanner, "250 2.0.0 OK: queued")
+}
+
+func TestSmtpBackend_Attachment_RealServer(t *testing.T) {
+	srv := newTestServer(t, newTestConfig(t, ""))
+	s, c, conf, scanner := newTestSMTPServer(t, srv.handle)
+	conf.SMTPServerAttachments = SMTPServerAttachmentsAll
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, attachmentEmail, c, scanner, "250 2.0.0 OK: queued")
+
+	response := request(t, srv, "GET", "/scans/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "Your scan is attached", messages[0].Message)
+	require.Equal(t, "scan-index.csv", messages[0].Attachment.Name)
+	require.Equal(t, "text/csv", messages[0].Attachment.Type)
+	require.Equal(t, int64(17), messages[0].Attachment.Size)
+	require.Equal(t, "Scan übersicht.png", messages[1].Attachment.Name)
+	require.Equal(t, "image/png", messages[1].Attachment.Type)
+	require.Equal(t, "You received a file: Scan übersicht.png", messages[1].Message)
+}
+
+func TestSmtpBackend_Attachment_DeclaredTypeMismatch(t *testing.T) {
+	email := `EHLO example.com
+MAIL FROM: scanner@example.com
+RCPT TO: ntfy-scans@ntfy.sh
+DATA
+Subject: Scan
+Content-Type: image/png; name="scan.png"
+Content-Disposition: attachment; filename="scan.png"
+Content-Transfer-Encoding: base64
+
+TVqQAAMAAAAEAAAA//8AAA==
+.
+`
+	srv := newTestServer(t, newTestConfig(t, ""))
+	s, c, conf, scanner := newTestSMTPServer(t, srv.handle)
+	conf.SMTPServerAttachments = SMTPServerAttachmentsAll
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, email, c, scanner, "250 2.0.0 OK: queued")
+
+	// The declared type does not match the content, so the detected type is used
+	response := request(t, srv, "GET", "/scans/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "scan.png", messages[0].Attachment.Name)
+	require.Equal(t, "application/vnd.microsoft.portable-executable", messages[0].Attachment.Type)
+	require.True(t, strings.HasSuffix(messages[0].Attachment.URL, ".exe"))
+}
+
+func TestSmtpBackend_HTMLOnly_Markdown(t *testing.T) {
+	email := `EHLO example.com
+MAIL FROM: nas@example.com
+RCPT TO: ntfy-alerts@ntfy.sh
+DATA
+Content-Type: text/html; charset=utf-8
+Subject: Backup failed
+
+<html><head><style>p { color: red; }</style></head><body>
+<h2>Backup failed</h2>
+<p>The task <b>daily_backup</b> failed. See <a href="https://nas.example.com/logs">the logs</a>.</p>
+<ul><li>Volume 1</li><li>Volume 2</li></ul>
+</body></html>
+.
+`
+	s, c, conf, scanner := newTestSMTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "yes", r.Header.Get("Markdown"))
+		expected := "## Backup failed\n\n" +
+			"The task **daily\\_backup** failed. See [the logs](https://nas.example.com/logs).\n\n" +
+			"- Volume 1\n" +
+			"- Volume 2"
+		require.Equal(t, expected, readAll(t, r.Body))
+	})
+	conf.SMTPServerHTMLMarkdown = true
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, email, c, scanner, "250 2.0.0 OK: queued")
+}
+
+func TestSmtpBackend_HTMLToMarkdown(t *testing.T) {
+	tests := map[string]string{
+		`Line 1<br>Line 2`:                                    "Line 1  \nLine 2",
+		`<p>one</p><p>two</p>`:                                "one\n\ntwo",
+		`<h1>Title</h1>text`:                                  "# Title\n\ntext",
+		`<em>a</em> and <strong> b </strong>`:                 "_a_ and **b**",
+		`<code>x_y</code>`:                                    "`x_y`",
+		`<a href="javascript:alert(1)">click</a>`:             "click",
+		`<a href="mailto:phil@example.com">mail</a>`:          "[mail](mailto:phil@example.com)",
+		`<ol><li>first</li><li>second</li></ol>`:              "1. first\n2. second",
+		`<blockquote>quoted<br>text</blockquote>`:             "> quoted  \n> text",
+		"<pre>a  b\n  c</pre>":                                "```\na  b\n  c\n```",
+		`<script>alert(1)</script><img src="x.png">hi  there`: "hi there",
+		`1 * 2 [x]`: "1 \\* 2 \\[x\\]",
+		`<div>row 1</div><div>row 2</div><hr><table><tr><td>a</td><td>b</td></tr></table>`: "row 1\nrow 2\n\n---\n\na b",
+	}
+	for input, expected := range tests {
+		actual, err := htmlToMarkdown(input)
+		require.Nil(t, err)
+		require.Equal(t, expected, actual, "input: %s", input)
+	}
+}
+
+func TestSmtpBackend_MappingRules_HeaderPriority(t *testing.T) {
+	email := `EHLO example.com
+MAIL FROM: phil@example.com
+RCPT TO: ntfy-mytopic@ntfy.sh
+DATA
+Subject: Server on fire
+X-Priority: 1 (Highest)
+Importance: high
+
+Help!
+.
+`
+	s, c, conf, scanner := newTestSMTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "5", r.Header.Get("Priority"))
+		require.Equal(t, "", r.Header.Get("Tags"))
+		require.Equal(t, "", r.Header.Get("Click"))
+	})
+	conf.SMTPServerHeaderPriority = true
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, email, c, scanner, "250 2.0.0 OK: queued")
+}
+
+func TestSmtpBackend_MappingRules_HeaderPriorityDisabled(t *testing.T) {
+	email := `EHLO example.com
+MAIL FROM: phil@example.com
+RCPT TO: ntfy-mytopic@ntfy.sh
+DATA
+Subject: Server on fire
+Importance: low
+
+Help!
+.
+`
+	s, c, _, scanner := newTestSMTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "", r.Header.Get("Priority"))
+	})
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, email, c, scanner, "250 2.0.0 OK: queued")
+}
+
+func TestSmtpBackend_MappingRules_SubjectAndSender(t *testing.T) {
+	email := `EHLO example.com
+MAIL FROM: monitoring@example.com
+RCPT TO: ntfy-mytopic@ntfy.sh
+DATA
+From: Monitoring <monitoring@example.com>
+Reply-To: Ops Team <ops@example.com>
+Subject: [CRITICAL] Disk full on backup01
+Importance: low
+
+Disk /dev/sda1 is full
+.
+`
+	s, c, conf, scanner := newTestSMTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "[CRITICAL] Disk full on backup01", r.Header.Get("Title"))
+		require.Equal(t, "5", r.Header.Get("Priority"))
+		require.Equal(t, "rotating_light,floppy_disk", r.Header.Get("Tags"))
+		require.Equal(t, "mailto:ops@example.com", r.Header.Get("Click"))
+	})
+	conf.SMTPServerHeaderPriority = true
+	conf.SMTPServerSenderClick = true
+	conf.SMTPServerSubjectRules = []*SMTPServerSubjectRule{
+		{Regex: regexp.MustCompile(`\[(P1|CRITICAL)\]`), Priority: 5, Tags: []string{"rotating_light"}},
+		{Regex: regexp.MustCompile(`(?i)disk full`), Tags: []string{"floppy_disk", "rotating_light"}},
+		{Regex: regexp.MustCompile(`\[P2\]`), Priority: 4},
+	}
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, email, c, scanner, "250 2.0.0 OK: queued")
+}
+
+func TestSmtpBackend_MappingRules_SenderFrom(t *testing.T) {
+	email := `EHLO example.com
+MAIL FROM: monitoring@example.com
+RCPT TO: ntfy-mytopic@ntfy.sh
+DATA
+From: =?UTF-8?B?TW9uaXRvcmluZw==?= <monitoring@example.com>
+Subject: Test
+
+Test
+.
+`
+	s, c, conf, scanner := newTestSMTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "mailto:monitoring@example.com", r.Header.Get("Click"))
+	})
+	conf.SMTPServerSenderClick = true
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, email, c, scanner, "250 2.0.0 OK: queued")
+}
+
+func TestSmtpBackend_MappingRules_AddressParams(t *testing.T) {
+	email := `EHLO example.com
+MAIL FROM: phil@example.com
+RCPT TO: ntfy-mytopic+prio5+tag_warning+tag_rotating_light+tk_KLORUqSqvNRLpY11DfkHVbHu9NGG2@ntfy.sh
+DATA
+Subject: [P2] Disk full
+X-Priority: 5
+
+what's up
+.
+`
+	s, c, conf, scanner := newTestSMTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/mytopic", r.URL.Path)
+		require.Equal(t, "Bearer tk_KLORUqSqvNRLpY11DfkHVbHu9NGG2", r.Header.Get("Authorization"))
+		require.Equal(t, "5", r.Header.Get("Priority"))
+		require.Equal(t, "disk,warning,rotating_light", r.Header.Get("Tags"))
+	})
+	conf.SMTPServerHeaderPriority = true
+	conf.SMTPServerSubjectRules = []*SMTPServerSubjectRule{
+		{Regex: regexp.MustCompile(`\[P2\]`), Priority: 4, Tags: []string{"disk"}},
+	}
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, email, c, scanner, "250 2.0.0 OK: queued")
+}
+
+func TestSmtpBackend_MappingRules_AddressInvalidPriority(t *testing.T) {
+	email := `EHLO example.com
+MAIL FROM: phil@example.com
+RCPT TO: ntfy-mytopic+prio9@ntfy.sh
+`
+	s, c, _, scanner := newTestSMTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("This should not be called")
+	})
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, email, c, scanner, "451 4.0.0 invalid priority")
+}
+
+func TestSmtpBackend_MappingRules_RealServer(t *testing.T) {
+	email := `EHLO example.com
+MAIL FROM: phil@example.com
+RCPT TO: ntfy-mytopic+priohigh+tag_warning@ntfy.sh
+DATA
+From: Phil <phil@example.com>
+Subject: Backup failed
+
+Backup failed
+.
+`
+	srv := newTestServer(t, newTestConfig(t, ""))
+	s, c, conf, scanner := newTestSMTPServer(t, srv.handle)
+	conf.SMTPServerSenderClick = true
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, email, c, scanner, "250 2.0.0 OK: queued")
+
+	response := request(t, srv, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "Backup failed", messages[0].Message)
+	require.Equal(t, 4, messages[0].Priority)
+	require.Equal(t, []string{"warning"}, messages[0].Tags)
+	require.Equal(t, "mailto:phil@example.com", messages[0].Click)
+}
+
+func TestSmtpBackend_Reply(t *testing.T) {
+	address := ntfymail.ReplyAddress("a-very-secret-secret", "ntfy-", "ntfy.sh", &model.Message{ID: "abcDEF123456", Topic: "mytopic"})
+	email := `EHLO example.com
+MAIL FROM: customer@example.com
+RCPT TO: ` + address + `
+DATA
+Subject: Re: RE: Backup failed
+
+Thanks, I'm on it!
+
+On Mon, Jan 1, 2024 at 10:00 AM ntfy.sh/mytopic <ntfy@ntfy.sh>
+wrote:
+> Backup failed
+>
+> --
+> This message was sent by 1.2.3.4 at Mon, 01 Jan 2024 10:00:00 UTC via https://ntfy.sh/mytopic
+.
+`
+	s, c, conf, scanner := newTestSMTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/mytopic", r.URL.Path)
+		require.Equal(t, "abcDEF123456", r.Header.Get("X-In-Reply-To"))
+		require.Equal(t, "Backup failed", r.Header.Get("Title"))
+		require.Equal(t, "Thanks, I'm on it!", readAll(t, r.Body))
+	})
+	conf.SMTPServerReplySecret = "a-very-secret-secret"
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, email, c, scanner, "250 2.0.0 OK: queued")
+}
+
+func TestSmtpBackend_Reply_InvalidToken(t *testing.T) {
+	address := ntfymail.ReplyAddress("a-very-secret-secret", "ntfy-", "ntfy.sh", &model.Message{ID: "abcDEF123456", Topic: "othertopic"})
+	email := `EHLO example.com
+MAIL FROM: customer@example.com
+RCPT TO: ` + strings.Replace(address, "othertopic", "mytopic", 1) + `
+`
+	s, c, conf, scanner := newTestSMTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("This should not be called")
+	})
+	conf.SMTPServerReplySecret = "a-very-secret-secret"
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, email, c, scanner, "550 5.1.1 Invalid reply address")
+}
+
+func TestSmtpBackend_Reply_ProtectedTopic(t *testing.T) {
+	srv := newTestSMTPAuthServer(t)
+	s, c, conf, scanner := newTestSMTPServerWithAuther(t, srv, srv.handle)
+	conf.SMTPServerReplySecret = "a-very-secret-secret"
+	defer s.Close()
+	defer c.Close()
+
+	// The reply address does not grant write access, so replies to protected topics are rejected right away
+	address := ntfymail.ReplyAddress("a-very-secret-secret", "ntfy-", "ntfy.sh", &model.Message{ID: "abcDEF123456", Topic: "protected"})
+	writeAndReadUntilLine(t, "EHLO example.com\r\nMAIL FROM: <customer@example.com>\r\nRCPT TO: <"+address+">\r\n", c, scanner, "550 5.7.1 Not authorized to publish to topic")
+
+	// Authenticated senders with write access can reply
+	auth := base64.StdEncoding.EncodeToString([]byte("\x00phil\x00phil"))
+	writeAndReadUntilLine(t, "RSET\r\nAUTH PLAIN "+auth+"\r\nMAIL FROM: <customer@example.com>\r\nRCPT TO: <"+address+">\r\n", c, scanner, "250 2.0.0 I'll make sure <"+address+"> gets this")
+}
+
+func TestSmtpBackend_Reply_RealServer(t *testing.T) {
+	srv := newTestServer(t, newTestConfig(t, ""))
+	response := request(t, srv, "PUT", "/mytopic", "Backup failed", nil)
+	original := toMessage(t, response.Body.String())
+
+	address := ntfymail.ReplyAddress("a-very-secret-secret", "ntfy-", "ntfy.sh", original)
+	email := `EHLO example.com
+MAIL FROM: customer@example.com
+RCPT TO: ` + address + `
+DATA
+Subject: Re: Backup failed
+
+Restarted it, looks good now
+
+-----Original Message-----
+From: ntfy.sh/mytopic <ntfy@ntfy.sh>
+Subject: Backup failed
+.
+`
+	s, c, conf, scanner := newTestSMTPServer(t, srv.handle)
+	conf.SMTPServerReplySecret = "a-very-secret-secret"
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, email, c, scanner, "250 2.0.0 OK: queued")
+
+	response = request(t, srv, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "", messages[0].InReplyTo)
+	require.Equal(t, original.ID, messages[1].InReplyTo)
+	require.Equal(t, "Backup failed", messages[1].Title)
+	require.Equal(t, "Restarted it, looks good now", messages[1].Message)
+}
+
+func TestStripQuotedReply(t *testing.T) {
+	require.Equal(t, "Thanks!", stripQuotedReply("Thanks!\n\nOn Mon, Jan 1, 2024 at 10:00 AM ntfy <ntfy@ntfy.sh> wrote:\n> Backup failed"))
+	require.Equal(t, "Thanks!", stripQuotedReply("Thanks!\r\n\r\nOn Mon, Jan 1, 2024 at 10:00 AM ntfy\r\nwrote:\r\n> Backup failed"))
+	require.Equal(t, "Thanks!", stripQuotedReply("Thanks!\n\n________________________________\nFrom: ntfy <ntfy@ntfy.sh>\nSent: Monday"))
+	require.Equal(t, "Thanks!", stripQuotedReply("Thanks!\n-----Original Message-----\nFrom: ntfy <ntfy@ntfy.sh>"))
+	require.Equal(t, "First\n\nSecond", stripQuotedReply("> Backup failed\nFirst\n\n> Disk full\n\n\nSecond"))
+	require.Equal(t, "Online now, will check", stripQuotedReply("Online now, will check"))
+	require.Equal(t, "", stripQuotedReply("> Backup failed"))
+}
+
+func TestSmtpBackend_Auth_PlainAndLogin(t *testing.T) {
+	srv := newTestSMTPAuthServer(t)
+	for _, auth := range []string{
+		"AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00phil\x00phil")) + "\r\n",
+		"AUTH LOGIN\r\n" + base64.StdEncoding.EncodeToString([]byte("phil")) + "\r\n" + base64.StdEncoding.EncodeToString([]byte("phil")) + "\r\n",
+		"AUTH LOGIN " + base64.StdEncoding.EncodeToString([]byte("phil")) + "\r\n" + base64.StdEncoding.EncodeToString([]byte("phil")) + "\r\n",
+	} {
+		s, c, conf, scanner := newTestSMTPServerWithAuther(t, srv, srv.handle)
+		conf.SMTPServerRequireAuth = true
+		writeAndReadUntilLine(t, "EHLO example.com\r\n"+auth, c, scanner, "235 2.0.0 Authentication succeeded")
+		email := `MAIL FROM: phil@example.com
+RCPT TO: ntfy-protected@ntfy.sh
+DATA
+Subject: Authenticated
+
+Hi there
+.
+`
+		writeAndReadUntilLine(t, email, c, scanner, "250 2.0.0 OK: queued")
+		c.Close()
+		s.Close()
+	}
+	messages := toMessages(t, request(t, srv, "GET", "/protected/json?poll=1", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}).Body.String())
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "Hi there", messages[0].Message)
+	require.Equal(t, "Authenticated", messages[0].Title)
+}
+
+func TestSmtpBackend_Auth_Token(t *testing.T) {
+	srv := newTestSMTPAuthServer(t)
+	u, err := srv.userManager.User("phil")
+	require.Nil(t, err)
+	token, err := srv.userManager.CreateToken(u.ID, "", time.Unix(0, 0), netip.IPv4Unspecified(), nil, false)
+	require.Nil(t, err)
+	for _, username := range []string{"", "phil"} {
+		var authorization string
+		s, c, conf, scanner := newTestSMTPServerWithAuther(t, srv, func(w http.ResponseWriter, r *http.Request) {
+			authorization = r.Header.Get("Authorization")
+			srv.handle(w, r)
+		})
+		conf.SMTPServerRequireAuth = true
+		auth := base64.StdEncoding.EncodeToString([]byte("\x00" + username + "\x00" + token.Value))
+		email := `EHLO example.com
+AUTH PLAIN ` + auth + `
+MAIL FROM: phil@example.com
+RCPT TO: ntfy-protected@ntfy.sh
+DATA
+Subject: Token
+
+Hi there
+.
+`
+		writeAndReadUntilLine(t, email, c, scanner, "250 2.0.0 OK: queued")
+		require.Equal(t, "Bearer "+token.Value, authorization)
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestSmtpBackend_Auth_Failed(t *testing.T) {
+	srv := newTestSMTPAuthServer(t)
+	s, c, _, scanner := newTestSMTPServerWithAuther(t, srv, srv.handle)
+	defer s.Close()
+	defer c.Close()
+	auth := base64.StdEncoding.EncodeToString([]byte("\x00phil\x00wrong"))
+	writeAndReadUntilLine(t, "EHLO example.com\r\nAUTH PLAIN "+auth+"\r\n", c, scanner, "535 5.7.8 Authentication failed")
+}
+
+func TestSmtpBackend_Auth_RateLimited(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t, "")
+	conf.VisitorAuthFailureLimitBurst = 3
+	srv := newTestServer(t, conf)
+	require.Nil(t, srv.userManager.AddUser("phil", "phil", user.RoleUser, false))
+	s, c, _, scanner := newTestSMTPServerWithAuther(t, srv, srv.handle)
+	defer s.Close()
+	defer c.Close()
+
+	// Failed attempts count towards the same limit as failed HTTP logins, so even correct credentials are rejected
+	wrong := base64.StdEncoding.EncodeToString([]byte("\x00phil\x00wrong"))
+	right := base64.StdEncoding.EncodeToString([]byte("\x00phil\x00phil"))
+	writeAndReadUntilLine(t, "EHLO example.com\r\nAUTH PLAIN "+wrong+"\r\n", c, scanner, "535 5.7.8 Authentication failed")
+	writeAndReadUntilLine(t, "AUTH PLAIN "+wrong+"\r\n", c, scanner, "535 5.7.8 Authentication failed")
+	writeAndReadUntilLine(t, "AUTH PLAIN "+wrong+"\r\n", c, scanner, "535 5.7.8 Authentication failed")
+	writeAndReadUntilLine(t, "AUTH PLAIN "+right+"\r\n", c, scanner, "454 4.7.0 Too many failed authentication attempts, try again later")
+}
+
+func TestSmtpBackend_Auth_TOTP(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t, "")
+	conf.AuthRequireTOTP = []user.Role{user.RoleAdmin}
+	srv := newTestServer(t, conf)
+	require.Nil(t, srv.userManager.AddUser("phil", "phil", user.RoleUser, false))
+	require.Nil(t, srv.userManager.AddUser("ben", "ben", user.RoleAdmin, false))
+	require.Nil(t, srv.userManager.AllowAccess("phil", "protected", user.PermissionReadWrite))
+	token := strings.TrimPrefix(newTOTPEnabledSession(t, srv, "phil", "phil")["Authorization"], "Bearer ")
+	s, c, _, scanner := newTestSMTPServerWithAuther(t, srv, srv.handle)
+	defer s.Close()
+	defer c.Close()
+
+	// Two-factor authentication required for the role, but not set up
+	auth := base64.StdEncoding.EncodeToString([]byte("\x00ben\x00ben"))
+	writeAndReadUntilLine(t, "EHLO example.com\r\nAUTH PLAIN "+auth+"\r\n", c, scanner, "535 5.7.8 Two-factor authentication required, set it up in the web app first")
+
+	// Two-factor authentication enabled: password is rejected right away, access token works
+	auth = base64.StdEncoding.EncodeToString([]byte("\x00phil\x00phil"))
+	writeAndReadUntilLine(t, "AUTH PLAIN "+auth+"\r\n", c, scanner, "535 5.7.8 Two-factor authentication enabled, use an access token as password")
+	auth = base64.StdEncoding.EncodeToString([]byte("\x00phil\x00" + token))
+	writeAndReadUntilLine(t, "AUTH PLAIN "+auth+"\r\n", c, scanner, "235 2.0.0 Authentication succeeded")
+	email := `MAIL FROM: phil@example.com
+RCPT TO: ntfy-protected@ntfy.sh
+DATA
+Subject: Token
+
+Hi there
+.
+`
+	writeAndReadUntilLine(t, email, c, scanner, "250 2.0.0 OK: queued")
+}
+
+func TestSmtpBackend_Auth_RequireAuth(t *testing.T) {
+	srv := newTestSMTPAuthServer(t)
+	s, c, conf, scanner := newTestSMTPServerWithAuther(t, srv, srv.handle)
+	conf.SMTPServerRequireAuth = true
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, "EHLO example.com\r\nMAIL FROM: phil@example.com\r\nRCPT TO: ntfy-protected@ntfy.sh\r\n", c, scanner, "530 5.7.0 Authentication required")
+	writeAndReadUntilLine(t, "RCPT TO: ntfy-protected+tk_KLORUqSqvNRLpY11DfkHVbHu9NGG2@ntfy.sh\r\n", c, scanner, "550 5.7.1 Access tokens in addresses are not allowed, use SMTP AUTH")
+	email := `RCPT TO: ntfy-announcements@ntfy.sh
+DATA
+Subject: Public
+
+Anyone can write here
+.
+`
+	writeAndReadUntilLine(t, email, c, scanner, "250 2.0.0 OK: queued")
+}
+
+func TestSmtpBackend_Auth_RequireAuthNotAuthorized(t *testing.T) {
+	srv := newTestSMTPAuthServer(t)
+	require.Nil(t, srv.userManager.AddUser("ben", "ben", user.RoleUser, false))
+	s, c, conf, scanner := newTestSMTPServerWithAuther(t, srv, srv.handle)
+	conf.SMTPServerRequireAuth = true
+	defer s.Close()
+	defer c.Close()
+	auth := base64.StdEncoding.EncodeToString([]byte("\x00ben\x00ben"))
+	writeAndReadUntilLine(t, "EHLO example.com\r\nAUTH PLAIN "+auth+"\r\nMAIL FROM: ben@example.com\r\nRCPT TO: ntfy-protected@ntfy.sh\r\n", c, scanner, "550 5.7.1 Not authorized to publish to topic")
+}
+
+func TestSmtpBackend_SenderDomains(t *testing.T) {
+	s, c, conf, scanner := newTestSMTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/mytopic", r.URL.Path)
+	})
+	conf.SMTPServerSenderDomains = []string{"example.com"}
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, "EHLO example.com\r\nMAIL FROM: <spammer@example.net>\r\n", c, scanner, "550 5.7.1 Sender not allowed")
+	writeAndReadUntilLine(t, "MAIL FROM: <spammer@notexample.com>\r\n", c, scanner, "550 5.7.1 Sender not allowed")
+	writeAndReadUntilLine(t, "MAIL FROM: <>\r\n", c, scanner, "550 5.7.1 Sender not allowed")
+	email := `MAIL FROM: <nas@office.EXAMPLE.com>
+RCPT TO: ntfy-mytopic@ntfy.sh
+DATA
+Subject: Allowed
+
+Allowed
+.
+`
+	writeAndReadUntilLine(t, email, c, scanner, "250 2.0.0 OK: queued")
+}
+
+func TestSmtpBackend_SenderHosts(t *testing.T) {
+	s, c, conf, scanner := newTestSMTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/mytopic", r.URL.Path)
+	})
+	conf.SMTPServerSenderPrefixes = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, "EHLO example.com\r\nMAIL FROM: <nas@example.com>\r\n", c, scanner, "550 5.7.1 Sender not allowed")
+	conf.SMTPServerSenderPrefixes = append(conf.SMTPServerSenderPrefixes, netip.MustParsePrefix("127.0.0.0/8"))
+	email := `MAIL FROM: <nas@example.com>
+RCPT TO: ntfy-mytopic@ntfy.sh
+DATA
+Subject: Allowed
+
+Allowed
+.
+`
+	writeAndReadUntilLine(t, email, c, scanner, "250 2.0.0 OK: queued")
+}
+
+func TestSmtpBackend_SenderHosts_AuthenticatedBypass(t *testing.T) {
+	srv := newTestSMTPAuthServer(t)
+	s, c, conf, scanner := newTestSMTPServerWithAuther(t, srv, srv.handle)
+	conf.SMTPServerSenderDomains = []string{"example.com"}
+	conf.SMTPServerSenderPrefixes = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	defer s.Close()
+	defer c.Close()
+	auth := base64.StdEncoding.EncodeToString([]byte("\x00phil\x00phil"))
+	writeAndReadUntilLine(t, "EHLO example.com\r\nAUTH PLAIN "+auth+"\r\nMAIL FROM: <phil@example.net>\r\n", c, scanner, "250 2.0.0 Roger, accepting mail from <phil@example.net>")
+}
+
+func TestSmtpBackend_TLS_StartTLSAndImplicit(t *testing.T) {
+	srv := newTestSMTPAuthServer(t)
+	conf := newTestConfig(t, "")
+	conf.SMTPServerDomain = "ntfy.sh"
+	conf.SMTPServerAddrPrefix = "ntfy-"
+	conf.SMTPServerCertFile, conf.SMTPServerKeyFile = newTestSMTPServerCert(t)
+	tlsConfig, err := newSMTPServerTLSConfig(conf)
+	require.Nil(t, err)
+	require.NotNil(t, tlsConfig)
+
+	s := newSMTPServer(conf, newMailBackend(conf, srv, srv.handle), tlsConfig)
+	plainListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	tlsListener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	require.Nil(t, err)
+	go s.Serve(plainListener)
+	go s.Serve(tlsListener)
+	defer s.Close()
+
+	email := "Subject: Secure\r\n\r\nSent via TLS\r\n"
+
+	// No AUTH in cleartext
+	c, err := smtp.Dial(plainListener.Addr().String())
+	require.Nil(t, err)
+	require.NotNil(t, c.Auth(sasl.NewPlainClient("", "phil", "phil")))
+	c.Close()
+
+	// STARTTLS
+	c, err = smtp.Dial(plainListener.Addr().String())
+	require.Nil(t, err)
+	ok, _ := c.Extension("STARTTLS")
+	require.True(t, ok)
+	require.Nil(t, c.StartTLS(&tls.Config{InsecureSkipVerify: true}))
+	require.Nil(t, c.Auth(sasl.NewPlainClient("", "phil", "phil")))
+	require.Nil(t, c.SendMail("phil@example.com", []string{"ntfy-protected@ntfy.sh"}, strings.NewReader(email))) // Also sends QUIT
+
+	// Implicit TLS
+	c, err = smtp.DialTLS(tlsListener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	require.Nil(t, err)
+	require.Nil(t, c.Auth(sasl.NewLoginClient("phil", "phil")))
+	require.Nil(t, c.SendMail("phil@example.com", []string{"ntfy-protected@ntfy.sh"}, strings.NewReader(email))) // Also sends QUIT
+
+	messages := toMessages(t, request(t, srv, "GET", "/protected/json?poll=1", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}).Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "Sent via TLS", messages[1].Message)
+}
+
+func TestSmtpBackend_TLS_NoCert(t *testing.T) {
+	conf := newTestConfig(t, "")
+	tlsConfig, err := newSMTPServerTLSConfig(conf)
+	require.Nil(t, err)
+	require.Nil(t, tlsConfig)
+	require.True(t, newSMTPServer(conf, newMailBackend(conf, nil, nil), tlsConfig).AllowInsecureAuth)
+}
+
+// newTestSMTPAuthServer returns a server with auth enabled, user "phil" (password "phil") with write access to
+// topic "protected", and everyone with write access to topic "announcements"
+func newTestSMTPAuthServer(t *testing.T) *Server {
+	conf := newTestConfigWithAuthFile(t, "")
+	conf.AuthDefault = user.PermissionDenyAll
+	srv := newTestServer(t, conf)
+	require.Nil(t, srv.userManager.AddUser("phil", "phil", user.RoleUser, false))
+	require.Nil(t, srv.userManager.AllowAccess("phil", "protected", user.PermissionReadWrite))
+	require.Nil(t, srv.userManager.AllowAccess(user.Everyone, "announcements", user.PermissionWrite))
+	return srv
+}
+
+func newTestSMTPServerCert(t *testing.T) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ntfy.sh"},
+		DNSNames:     []string{"ntfy.sh"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
 type smtpHandlerFunc func(http.ResponseWriter, *http.Request)
 
 func newTestSMTPServer(t *testing.T, handler smtpHandlerFunc) (s *smtp.Server, c net.Conn, conf *Config, scanner *bufio.Scanner) {
+	return newTestSMTPServerWithAuther(t, nil, handler)
+}
+
+func newTestSMTPServerWithAuther(t *testing.T, auther smtpAuther, handler smtpHandlerFunc) (s *smtp.Server, c net.Conn, conf *Config, scanner *bufio.Scanner) {
 	conf = newTestConfig(t, "")
 	conf.SMTPServerListen = ":25"
 	conf.SMTPServerDomain = "ntfy.sh"
 	conf.SMTPServerAddrPrefix = "ntfy-"
-	backend := newMailBackend(conf, handler)
+	backend := newMailBackend(conf, auther, handler)
 	l, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		t.Fatal(err)
@@ -1456,6 +2280,7 @@ func newTestSMTPServer(t *testing.T, handler smtpHandlerFunc) (s *smtp.Server, c
 	s = smtp.NewServer(backend)
 	s.Domain = conf.SMTPServerDomain
 	s.AllowInsecureAuth = true
+	enableSMTPAuthLogin(s)
 	go func() {
 		require.Nil(t, s.Serve(l))
 	}()
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"heckel.io/ntfy/v2/model"
+)
+
+// Overflow policies for the per-subscriber queue, see Config.SubscriberQueuePolicy
+const (
+	SubscriberQueuePolicyDropOldest = "drop-oldest" // Drop the oldest queued message to make room for the new one
+	SubscriberQueuePolicyDisconnect = "disconnect"  // Close the subscriber connection; the client has to reconnect with since=
+	SubscriberQueuePolicyLagging    = "lagging"     // Mark the subscriber as lagging and drop new messages until the queue is drained
+)
+
+// subscriberQueueDisconnectTimeout is how long the disconnect policy waits for the messages_dropped event to be
+// written, before closing the connection anyway
+const subscriberQueueDisconnectTimeout = 5 * time.Second
+
+// subscriberQueue is a bounded buffer between a topic and a single subscriber connection. Topics
+// publish into the queue without blocking (Enqueue), and the connection drains it (Run). If a subscriber
+// cannot keep up and the queue is full, the overflow policy decides what happens. Whenever messages were
+// dropped, the subscriber is sent a messages_dropped event, so that the client can re-poll with since=.
+type subscriberQueue struct {
+	topic    string     // Topic(s) string, used for the messages_dropped event
+	size     int        // Max. number of queued messages
+	policy   string     // One of the SubscriberQueuePolicy* constants
+	sub      subscriber // Actual subscriber, writes to the connection
+	cancel   func()     // Closes the subscriber connection, used for the disconnect policy
+	messages []*queuedMessage
+	dropped  int  // Number of dropped messages since the last messages_dropped event
+	lagging  bool // True if policy is "lagging" and the queue overflowed
+	draining bool // True if policy is "disconnect" and the queue overflowed; Run sends messages_dropped and disconnects
+	closed   bool
+	notify   chan struct{}
+	mu       sync.Mutex
+}
+
+type queuedMessage struct {
+	v *visitor
+	m *model.Message
+}
+
+func newSubscriberQueue(topic string, size int, policy string, sub subscriber, cancel func()) *subscriberQueue {
+	return &subscriberQueue{
+		topic:    topic,
+		size:     size,
+		policy:   policy,
+		sub:      sub,
+		cancel:   cancel,
+		messages: make([]*queuedMessage, 0),
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+// Enqueue adds a message to the queue. It never blocks, and can be passed to topic.Subscribe as a subscriber.
+func (q *subscriberQueue) Enqueue(v *visitor, m *model.Message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed || q.draining {
+		return nil
+	} else if q.lagging {
+		q.drop(1)
+		return nil
+	}
+	if len(q.messages) >= q.size {
+		switch q.policy {
+		case SubscriberQueuePolicyDisconnect:
+			// Let Run send the messages_dropped event before disconnecting, but don't wait forever if the
+			// subscriber is stuck (which is likely, since it couldn't keep up in the first place)
+			q.drop(len(q.messages) + 1)
+			q.messages = q.messages[:0]
+			q.draining = true
+			time.AfterFunc(subscriberQueueDisconnectTimeout, q.cancel)
+			q.wake()
+			return nil
+		case SubscriberQueuePolicyLagging:
+			q.lagging = true
+			q.drop(1)
+			minc(metricSubscribersLagging)
+			return nil
+		default: // SubscriberQueuePolicyDropOldest
+			q.messages[0] = nil
+			q.messages = q.messages[1:]
+			q.drop(1)
+		}
+	}
+	q.messages = append(q.messages, &queuedMessage{v: v, m: m})
+	q.wake()
+	return nil
+}
+
+// Run forwards queued messages to the subscriber until the context is done, or writing to the subscriber fails.
+// With the disconnect policy, it also closes the subscriber connection once the messages_dropped event was sent.
+func (q *subscriberQueue) Run(ctx context.Context) error {
+	defer q.close()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-q.notify:
+			for {
+				qm := q.next()
+				if qm == nil {
+					break
+				}
+				if err := q.sub(qm.v, qm.m); err != nil {
+					return err
+				}
+			}
+			if q.disconnecting() {
+				q.cancel()
+				return nil
+			}
+		}
+	}
+}
+
+// next returns the next message to forward to the subscriber, or nil if the queue is empty. If messages were
+// dropped, a messages_dropped event is returned first (drop-oldest), or once the queue is drained (lagging).
+func (q *subscriberQueue) next() *queuedMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil
+	}
+	if q.dropped > 0 && (q.policy != SubscriberQueuePolicyLagging || len(q.messages) == 0) {
+		dropped := q.dropped
+		q.dropped = 0
+		if q.lagging {
+			q.lagging = false
+			mdec(metricSubscribersLagging)
+		}
+		return &queuedMessage{m: model.NewDroppedMessage(q.topic, dropped)}
+	}
+	if len(q.messages) == 0 {
+		return nil
+	}
+	qm := q.messages[0]
+	q.messages[0] = nil
+	q.messages = q.messages[1:]
+	return qm
+}
+
+// disconnecting returns true if the queue overflowed with the disconnect policy, and the
+// messages_dropped event was sent (i.e. if the connection can be closed)
+func (q *subscriberQueue) disconnecting() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.draining && q.dropped == 0
+}
+
+func (q *subscriberQueue) wake() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (q *subscriberQueue) drop(n int) {
+	q.dropped += n
+	madd(metricSubscriberMessagesDropped, n)
+}
+
+func (q *subscriberQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.messages = nil
+	if q.lagging {
+		q.lagging = false
+		mdec(metricSubscribersLagging)
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/model"
+)
+
+type subscriberQueueRecorder struct {
+	messages []*model.Message
+	mu       sync.Mutex
+}
+
+func (r *subscriberQueueRecorder) sub(v *visitor, m *model.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, m)
+	return nil
+}
+
+func (r *subscriberQueueRecorder) events() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	events := make([]string, 0)
+	for _, m := range r.messages {
+		events = append(events, m.Message)
+	}
+	return events
+}
+
+func TestSubscriberQueue_DropOldest(t *testing.T) {
+	r := &subscriberQueueRecorder{}
+	q := newSubscriberQueue("mytopic", 2, SubscriberQueuePolicyDropOldest, r.sub, func() {})
+	for _, m := range []string{"1", "2", "3", "4"} {
+		require.Nil(t, q.Enqueue(nil, model.NewDefaultMessage("mytopic", m)))
+	}
+	for qm := q.next(); qm != nil; qm = q.next() {
+		require.Nil(t, q.sub(qm.v, qm.m))
+	}
+	require.Equal(t, []string{"2 message(s) dropped", "3", "4"}, r.events())
+	require.Equal(t, model.DroppedEvent, r.messages[0].Event)
+	require.Equal(t, "mytopic", r.messages[0].Topic)
+}
+
+func TestSubscriberQueue_Lagging(t *testing.T) {
+	r := &subscriberQueueRecorder{}
+	q := newSubscriberQueue("mytopic", 2, SubscriberQueuePolicyLagging, r.sub, func() {})
+	for _, m := range []string{"1", "2", "3"} {
+		require.Nil(t, q.Enqueue(nil, model.NewDefaultMessage("mytopic", m)))
+	}
+	require.True(t, q.lagging)
+
+	// Messages are dropped until the queue is drained, then the subscriber catches up
+	qm := q.next()
+	require.Equal(t, "1", qm.m.Message)
+	require.Nil(t, q.Enqueue(nil, model.NewDefaultMessage("mytopic", "4")))
+	require.Equal(t, "2", q.next().m.Message)
+	qm = q.next()
+	require.Equal(t, model.DroppedEvent, qm.m.Event)
+	require.Equal(t, "2 message(s) dropped", qm.m.Message)
+	require.False(t, q.lagging)
+	require.Nil(t, q.next())
+
+	require.Nil(t, q.Enqueue(nil, model.NewDefaultMessage("mytopic", "5")))
+	require.Equal(t, "5", q.next().m.Message)
+}
+
+func TestSubscriberQueue_Disconnect(t *testing.T) {
+	r := &subscriberQueueRecorder{}
+	canceled := atomic.Bool{}
+	q := newSubscriberQueue("mytopic", 2, SubscriberQueuePolicyDisconnect, r.sub, func() {
+		canceled.Store(true)
+	})
+	require.Nil(t, q.Enqueue(nil, model.NewDefaultMessage("mytopic", "1")))
+	require.Nil(t, q.Enqueue(nil, model.NewDefaultMessage("mytopic", "2")))
+	require.Nil(t, q.Enqueue(nil, model.NewDefaultMessage("mytopic", "3")))
+	require.False(t, q.disconnecting())
+
+	// The messages_dropped event is sent before the connection is closed
+	qm := q.next()
+	require.Equal(t, model.DroppedEvent, qm.m.Event)
+	require.Equal(t, "3 message(s) dropped", qm.m.Message)
+	require.Nil(t, q.Enqueue(nil, model.NewDefaultMessage("mytopic", "4")))
+	require.Nil(t, q.next())
+	require.True(t, q.disconnecting())
+	require.False(t, canceled.Load())
+}
+
+func TestSubscriberQueue_Disconnect_Run(t *testing.T) {
+	r := &subscriberQueueRecorder{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q := newSubscriberQueue("mytopic", 2, SubscriberQueuePolicyDisconnect, r.sub, cancel)
+	for _, m := range []string{"1", "2", "3"} {
+		require.Nil(t, q.Enqueue(nil, model.NewDefaultMessage("mytopic", m)))
+	}
+	require.Nil(t, q.Run(ctx))
+	require.Equal(t, []string{"3 message(s) dropped"}, r.events())
+	require.NotNil(t, ctx.Err())
+}
+
+func TestSubscriberQueue_Run(t *testing.T) {
+	r := &subscriberQueueRecorder{}
+	ctx, cancel := context.WithCancel(context.Background())
+	q := newSubscriberQueue("mytopic", 10, SubscriberQueuePolicyDropOldest, r.sub, cancel)
+	done := make(chan error)
+	go func() {
+		done <- q.Run(ctx)
+	}()
+	for _, m := range []string{"1", "2", "3"} {
+		require.Nil(t, q.Enqueue(nil, model.NewDefaultMessage("mytopic", m)))
+	}
+	waitFor(t, func() bool {
+		return len(r.events()) == 3
+	})
+	require.Equal(t, []string{"1", "2", "3"}, r.events())
+	cancel()
+	require.Nil(t, <-done)
+	require.Nil(t, q.Enqueue(nil, model.NewDefaultMessage("mytopic", "4")))
+	require.Nil(t, q.next())
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"encoding/json"
 	"net/http"
 
 	"heckel.io/ntfy/v2/model"
@@ -12,6 +13,7 @@ import (
 type publishMessage struct {
 	Topic      string         `json:"topic"`
 	SequenceID string         `json:"sequence_id"`
+	InReplyTo  string         `json:"in_reply_to"`
 	Title      string         `json:"title"`
 	Message    string         `json:"message"`
 	Priority   int            `json:"priority"`
@@ -24,6 +26,7 @@ type publishMessage struct {
 	Filename   string         `json:"filename"`
 	Email      string         `json:"email"`
 	Call       string         `json:"call"`
+	SMS        string         `json:"sms"`
 	Cache      string         `json:"cache"`    // use string as it defaults to true (or use &bool instead)
 	Firebase   string         `json:"firebase"` // use string as it defaults to true (or use &bool instead)
 	Delay      string         `json:"delay"`
@@ -182,6 +185,101 @@ type apiAccessResetRequest struct {
 	Topic    string `json:"topic"`
 }
 
+type apiGroupResponse struct {
+	Name        string                  `json:"name"`
+	Members     []string                `json:"members"`
+	Grants      []*apiUserGrantResponse `json:"grants,omitempty"`
+	Provisioned bool                    `json:"provisioned,omitempty"`
+}
+
+type apiGroupAddOrDeleteRequest struct {
+	Name string `json:"name"`
+}
+
+type apiGroupMemberRequest struct {
+	Group    string `json:"group"`
+	Username string `json:"username"`
+}
+
+type apiGroupAccessAllowRequest struct {
+	Group      string `json:"group"`
+	Topic      string `json:"topic"` // This may be a pattern
+	Permission string `json:"permission"`
+}
+
+type apiGroupAccessResetRequest struct {
+	Group string `json:"group"`
+	Topic string `json:"topic"`
+}
+
+type apiAuditEntryResponse struct {
+	ID     int64           `json:"id"`
+	Time   int64           `json:"time"`
+	Actor  string          `json:"actor"`
+	IP     string          `json:"ip,omitempty"`
+	Action string          `json:"action"`
+	Target string          `json:"target"`
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+type apiAdminTierRequest struct {
+	Code                     string  `json:"code"`
+	Name                     *string `json:"name"`
+	MessageLimit             *int64  `json:"message_limit"`
+	MessageExpiryDuration    *string `json:"message_expiry_duration"` // Duration, e.g. "12h"
+	EmailLimit               *int64  `json:"email_limit"`
+	CallLimit                *int64  `json:"call_limit"`
+	SMSLimit                 *int64  `json:"sms_limit"`
+	ReservationLimit         *int64  `json:"reservation_limit"`
+	AttachmentFileSizeLimit  *string `json:"attachment_file_size_limit"`  // Size, e.g. "15M"
+	AttachmentTotalSizeLimit *string `json:"attachment_total_size_limit"` // Size, e.g. "100M"
+	AttachmentExpiryDuration *string `json:"attachment_expiry_duration"`  // Duration, e.g. "6h"
+	AttachmentBandwidthLimit *string `json:"attachment_bandwidth_limit"`  // Size, e.g. "1G"
+	StripeMonthlyPriceID     *string `json:"stripe_monthly_price_id"`
+	StripeYearlyPriceID      *string `json:"stripe_yearly_price_id"`
+}
+
+type apiAdminTierResponse struct {
+	ID                   string            `json:"id"`
+	Code                 string            `json:"code"`
+	Name                 string            `json:"name"`
+	Limits               *apiAccountLimits `json:"limits"`
+	StripeMonthlyPriceID string            `json:"stripe_monthly_price_id,omitempty"`
+	StripeYearlyPriceID  string            `json:"stripe_yearly_price_id,omitempty"`
+}
+
+type apiAdminTierDeleteRequest struct {
+	Code string `json:"code"`
+}
+
+type apiAdminTokenDeleteRequest struct {
+	Username string `json:"username"`
+	Token    string `json:"token"` // Token value or ID
+}
+
+type apiAdminReservationResponse struct {
+	Username string `json:"username"`
+	Topic    string `json:"topic"`
+	Everyone string `json:"everyone"`
+}
+
+type apiAdminReservationRequest struct {
+	Username       string `json:"username"`
+	Topic          string `json:"topic"`
+	Everyone       string `json:"everyone"`
+	DeleteMessages bool   `json:"delete_messages,omitempty"` // Only used when removing a reservation
+}
+
+type apiAdminVisitorResponse struct {
+	ID       string            `json:"id"`
+	IP       string            `json:"ip"`
+	Username string            `json:"username,omitempty"`
+	Tier     string            `json:"tier,omitempty"`
+	Limits   *apiAccountLimits `json:"limits"`
+	Stats    *apiAccountStats  `json:"stats"`
+}
+
 type apiAccountCreateRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
@@ -198,23 +296,57 @@ type apiAccountDeleteRequest struct {
 }
 
 type apiAccountTokenIssueRequest struct {
-	Label   *string `json:"label"`
-	Expires *int64  `json:"expires"` // Unix timestamp
+	Label   *string               `json:"label"`
+	Expires *int64                `json:"expires"` // Unix timestamp
+	TOTP    string                `json:"totp"`    // Two-factor authentication code (or recovery code), if enabled
+	Scope   *apiAccountTokenScope `json:"scope"`   // Restricts the token to certain topics and/or the account API, if set
 }
 
 type apiAccountTokenUpdateRequest struct {
-	Token   string  `json:"token"`
+	Token   string  `json:"token"` // Token value or ID
 	Label   *string `json:"label"`
 	Expires *int64  `json:"expires"` // Unix timestamp
 }
 
 type apiAccountTokenResponse struct {
-	Token       string `json:"token"`
-	Label       string `json:"label,omitempty"`
-	LastAccess  int64  `json:"last_access,omitempty"`
-	LastOrigin  string `json:"last_origin,omitempty"`
-	Expires     int64  `json:"expires,omitempty"`     // Unix timestamp
-	Provisioned bool   `json:"provisioned,omitempty"` // True if this token was provisioned by the server config
+	ID          string                `json:"id"`
+	Token       string                `json:"token,omitempty"` // Only set if the token was just created
+	Prefix      string                `json:"prefix"`
+	Label       string                `json:"label,omitempty"`
+	LastAccess  int64                 `json:"last_access,omitempty"`
+	LastOrigin  string                `json:"last_origin,omitempty"`
+	Expires     int64                 `json:"expires,omitempty"`     // Unix timestamp
+	Provisioned bool                  `json:"provisioned,omitempty"` // True if this token was provisioned by the server config
+	Current     bool                  `json:"current,omitempty"`     // True if this token was used to authenticate the request
+	Scope       *apiAccountTokenScope `json:"scope,omitempty"`
+}
+
+type apiAccountTokenScope struct {
+	Topics    []*apiAccountTokenScopeTopic `json:"topics,omitempty"`
+	NoAccount bool                         `json:"no_account,omitempty"`
+}
+
+type apiAccountTokenScopeTopic struct {
+	Topic      string `json:"topic"` // This may be a pattern
+	Permission string `json:"permission"`
+}
+
+type apiAccountTOTPResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`     // otpauth:// provisioning URI
+	QRCode string `json:"qr_code"` // Provisioning URI as PNG image, as data: URL
+}
+
+type apiAccountTOTPEnableRequest struct {
+	Code string `json:"code"`
+}
+
+type apiAccountTOTPEnableResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type apiAccountTOTPDeleteRequest struct {
+	Password string `json:"password"`
 }
 
 type apiAccountPhoneNumberVerifyRequest struct {
@@ -263,6 +395,7 @@ type apiAccountLimits struct {
 	MessagesExpiryDuration   int64  `json:"messages_expiry_duration"`
 	Emails                   int64  `json:"emails"`
 	Calls                    int64  `json:"calls"`
+	SMS                      int64  `json:"sms"`
 	Reservations             int64  `json:"reservations"`
 	AttachmentTotalSize      int64  `json:"attachment_total_size"`
 	AttachmentFileSize       int64  `json:"attachment_file_size"`
@@ -277,6 +410,8 @@ type apiAccountStats struct {
 	EmailsRemaining              int64 `json:"emails_remaining"`
 	Calls                        int64 `json:"calls"`
 	CallsRemaining               int64 `json:"calls_remaining"`
+	SMS                          int64 `json:"sms"`
+	SMSRemaining                 int64 `json:"sms_remaining"`
 	Reservations                 int64 `json:"reservations"`
 	ReservationsRemaining        int64 `json:"reservations_remaining"`
 	AttachmentTotalSize          int64 `json:"attachment_total_size"`
@@ -297,6 +432,12 @@ type apiAccountEmailInfo struct {
 	Pending bool   `json:"pending,omitempty"`
 }
 
+type apiAccountTOTP struct {
+	Enabled       bool `json:"enabled"`
+	Required      bool `json:"required,omitempty"`       // True if the user's role requires two-factor authentication
+	RecoveryCodes int  `json:"recovery_codes,omitempty"` // Number of unused recovery codes
+}
+
 type apiAccountBilling struct {
 	Customer     bool   `json:"customer"`
 	Subscription bool   `json:"subscription"`
@@ -319,7 +460,9 @@ type apiAccountResponse struct {
 	Reservations  []*apiAccountReservation   `json:"reservations,omitempty"`
 	Tokens        []*apiAccountTokenResponse `json:"tokens,omitempty"`
 	PhoneNumbers  []string                   `json:"phone_numbers,omitempty"`
+	TOTP          *apiAccountTOTP            `json:"totp,omitempty"`
 	Emails        []*apiAccountEmailInfo     `json:"emails,omitempty"`
+	Cursors       []*apiAccountCursor        `json:"cursors,omitempty"`
 	Tier          *apiAccountTier            `json:"tier,omitempty"`
 	Limits        *apiAccountLimits          `json:"limits,omitempty"`
 	Stats         *apiAccountStats           `json:"stats,omitempty"`
@@ -331,14 +474,33 @@ type apiAccountReservationRequest struct {
 	Everyone string `json:"everyone"`
 }
 
+type apiAccountCursor struct {
+	Name          string   `json:"name"`
+	Topics        []string `json:"topics"`
+	LastDelivered string   `json:"last_delivered,omitempty"`
+	LastAcked     string   `json:"last_acked,omitempty"`
+}
+
+type apiAccountCursorRequest struct {
+	Name   string   `json:"name"`
+	Topics []string `json:"topics"`
+}
+
+type apiAccountCursorAckRequest struct {
+	ID string `json:"id"`
+}
+
 type apiConfigResponse struct {
 	BaseURL             string   `json:"base_url"`
 	AppRoot             string   `json:"app_root"`
 	EnableLogin         bool     `json:"enable_login"`
+	EnableOIDC          bool     `json:"enable_oidc"`
+	EnableProxyAuth     bool     `json:"enable_proxy_auth"`
 	RequireLogin        bool     `json:"require_login"`
 	EnableSignup        bool     `json:"enable_signup"`
 	EnablePayments      bool     `json:"enable_payments"`
 	EnableCalls         bool     `json:"enable_calls"`
+	EnableSMS           bool     `json:"enable_sms"`
 	EnableEmails        bool     `json:"enable_emails"`
 	EnableResetPassword bool     `json:"enable_reset_password"`
 	EnableReservations  bool     `json:"enable_reservations"`
@@ -411,6 +573,11 @@ type apiStripeSubscriptionDeletedEvent struct {
 	Customer string `json:"customer"`
 }
 
+type apiAPNSUpdateDeviceRequest struct {
+	Token  string   `json:"token"`
+	Topics []string `json:"topics"`
+}
+
 type apiWebPushUpdateSubscriptionRequest struct {
 	Endpoint string   `json:"endpoint"`
 	Auth     string   `json:"auth"`
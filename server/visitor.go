@@ -30,6 +30,10 @@ const (
 	// visitorDefaultCallsLimit is the amount of calls a user without a tier is allowed to make.
 	// This number is zero, because phone numbers have to be verified first.
 	visitorDefaultCallsLimit = int64(0)
+
+	// visitorDefaultSMSLimit is the amount of SMS a user without a tier is allowed to send.
+	// This number is zero, because phone numbers have to be verified first.
+	visitorDefaultSMSLimit = int64(0)
 )
 
 // Constants used to convert a tier-user's MessageSizeLimit (see user.Tier) into adequate request limiter
@@ -63,6 +67,7 @@ type visitor struct {
 	messagesLimiter      *util.FixedLimiter // Rate limiter for messages
 	emailsLimiter        *util.RateLimiter  // Rate limiter for emails
 	callsLimiter         *util.FixedLimiter // Rate limiter for calls
+	smsLimiter           *util.FixedLimiter // Rate limiter for SMS
 	subscriptionLimiter  *util.FixedLimiter // Fixed limiter for active subscriptions (ongoing connections)
 	topicCreationLimiter *rate.Limiter      // Rate limiter for inserting new topics into the in-memory topic map
 	bandwidthLimiter     *util.RateLimiter  // Limiter for attachment bandwidth downloads
@@ -88,6 +93,7 @@ type visitorLimits struct {
 	EmailLimitBurst          int
 	EmailLimitReplenish      rate.Limit
 	CallLimit                int64
+	SMSLimit                 int64
 	ReservationsLimit        int64
 	AttachmentTotalSizeLimit int64
 	AttachmentFileSizeLimit  int64
@@ -102,6 +108,8 @@ type visitorStats struct {
 	EmailsRemaining              int64
 	Calls                        int64
 	CallsRemaining               int64
+	SMS                          int64
+	SMSRemaining                 int64
 	Reservations                 int64
 	ReservationsRemaining        int64
 	AttachmentTotalSize          int64
@@ -118,11 +126,12 @@ const (
 )
 
 func newVisitor(conf *Config, messageCache *message.Cache, userManager *user.Manager, ip netip.Addr, user *user.User) *visitor {
-	var messages, emails, calls int64
+	var messages, emails, calls, sms int64
 	if user != nil {
 		messages = user.Stats.Messages
 		emails = user.Stats.Emails
 		calls = user.Stats.Calls
+		sms = user.Stats.SMS
 	}
 	v := &visitor{
 		config:               conf,
@@ -137,12 +146,13 @@ func newVisitor(conf *Config, messageCache *message.Cache, userManager *user.Man
 		messagesLimiter:      nil, // Set in resetLimiters, may be nil
 		emailsLimiter:        nil, // Set in resetLimiters
 		callsLimiter:         nil, // Set in resetLimiters, may be nil
+		smsLimiter:           nil, // Set in resetLimiters, may be nil
 		topicCreationLimiter: nil, // Set in resetLimiters
 		bandwidthLimiter:     nil, // Set in resetLimiters
 		accountLimiter:       nil, // Set in resetLimiters, may be nil
 		authLimiter:          nil, // Set in resetLimiters, may be nil
 	}
-	v.resetLimitersNoLock(messages, emails, calls, false)
+	v.resetLimitersNoLock(messages, emails, calls, sms, false)
 	return v
 }
 
@@ -168,10 +178,13 @@ func (v *visitor) contextNoLock() log.Context {
 		fields["visitor_emails_limit"] = info.Limits.EmailLimit
 		fields["visitor_emails_remaining"] = info.Stats.EmailsRemaining
 	}
-	if v.config.TwilioAccount != "" {
+	if v.config.TwilioAccount != "" || v.config.TelephonyWebhookURL != "" {
 		fields["visitor_calls"] = info.Stats.Calls
 		fields["visitor_calls_limit"] = info.Limits.CallLimit
 		fields["visitor_calls_remaining"] = info.Stats.CallsRemaining
+		fields["visitor_sms"] = info.Stats.SMS
+		fields["visitor_sms_limit"] = info.Limits.SMSLimit
+		fields["visitor_sms_remaining"] = info.Stats.SMSRemaining
 	}
 	if v.authLimiter != nil {
 		fields["visitor_auth_attempts_remaining"] = int64(math.Floor(v.authLimiter.Tokens()))
@@ -244,6 +257,12 @@ func (v *visitor) CallAllowed() bool {
 	return v.callsLimiter.Allow()
 }
 
+func (v *visitor) SMSAllowed() bool {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	return v.smsLimiter.Allow()
+}
+
 func (v *visitor) SubscriptionAllowed() bool {
 	v.mu.RLock() // limiters could be replaced!
 	defer v.mu.RUnlock()
@@ -338,6 +357,7 @@ func (v *visitor) Stats() *user.Stats {
 		Messages: v.messagesLimiter.Value(),
 		Emails:   v.emailsLimiter.Value(),
 		Calls:    v.callsLimiter.Value(),
+		SMS:      v.smsLimiter.Value(),
 	}
 }
 
@@ -347,6 +367,7 @@ func (v *visitor) ResetStats() {
 	v.emailsLimiter.Reset()
 	v.messagesLimiter.Reset()
 	v.callsLimiter.Reset()
+	v.smsLimiter.Reset()
 }
 
 // User returns the visitor user, or nil if there is none
@@ -377,11 +398,11 @@ func (v *visitor) SetUser(u *user.User) {
 	shouldResetLimiters := v.user.TierID() != u.TierID() // TierID works with nil receiver
 	v.user = u                                           // u may be nil!
 	if shouldResetLimiters {
-		var messages, emails, calls int64
+		var messages, emails, calls, sms int64
 		if u != nil {
-			messages, emails, calls = u.Stats.Messages, u.Stats.Emails, u.Stats.Calls
+			messages, emails, calls, sms = u.Stats.Messages, u.Stats.Emails, u.Stats.Calls, u.Stats.SMS
 		}
-		v.resetLimitersNoLock(messages, emails, calls, true)
+		v.resetLimitersNoLock(messages, emails, calls, sms, true)
 	}
 }
 
@@ -396,12 +417,13 @@ func (v *visitor) MaybeUserID() string {
 	return ""
 }
 
-func (v *visitor) resetLimitersNoLock(messages, emails, calls int64, enqueueUpdate bool) {
+func (v *visitor) resetLimitersNoLock(messages, emails, calls, sms int64, enqueueUpdate bool) {
 	limits := v.limitsNoLock()
 	v.requestLimiter = rate.NewLimiter(limits.RequestLimitReplenish, limits.RequestLimitBurst)
 	v.messagesLimiter = util.NewFixedLimiterWithValue(limits.MessageLimit, messages)
 	v.emailsLimiter = util.NewRateLimiterWithValue(limits.EmailLimitReplenish, limits.EmailLimitBurst, emails)
 	v.callsLimiter = util.NewFixedLimiterWithValue(limits.CallLimit, calls)
+	v.smsLimiter = util.NewFixedLimiterWithValue(limits.SMSLimit, sms)
 	if v.config.VisitorTopicCreationLimitBurst > 0 && v.config.VisitorTopicCreationLimitReplenish > 0 {
 		v.topicCreationLimiter = rate.NewLimiter(rate.Every(v.config.VisitorTopicCreationLimitReplenish), v.config.VisitorTopicCreationLimitBurst)
 	} else {
@@ -420,6 +442,7 @@ func (v *visitor) resetLimitersNoLock(messages, emails, calls int64, enqueueUpda
 			Messages: messages,
 			Emails:   emails,
 			Calls:    calls,
+			SMS:      sms,
 		})
 	}
 	log.Fields(v.contextNoLock()).Debug("Rate limiters reset for visitor") // Must be after function, because contextNoLock() describes rate limiters
@@ -449,6 +472,7 @@ func tierBasedVisitorLimits(conf *Config, tier *user.Tier) *visitorLimits {
 		EmailLimitBurst:          util.MinMax(int(float64(tier.EmailLimit)*visitorEmailLimitBurstRate), conf.VisitorEmailLimitBurst, visitorEmailLimitBurstMax),
 		EmailLimitReplenish:      dailyLimitToRate(tier.EmailLimit),
 		CallLimit:                tier.CallLimit,
+		SMSLimit:                 tier.SMSLimit,
 		ReservationsLimit:        tier.ReservationLimit,
 		AttachmentTotalSizeLimit: tier.AttachmentTotalSizeLimit,
 		AttachmentFileSizeLimit:  tier.AttachmentFileSizeLimit,
@@ -476,6 +500,7 @@ func configBasedVisitorLimits(conf *Config) *visitorLimits {
 		EmailLimitBurst:          conf.VisitorEmailLimitBurst,
 		EmailLimitReplenish:      rate.Every(conf.VisitorEmailLimitReplenish),
 		CallLimit:                visitorDefaultCallsLimit,
+		SMSLimit:                 visitorDefaultSMSLimit,
 		ReservationsLimit:        visitorDefaultReservationsLimit,
 		AttachmentTotalSizeLimit: conf.VisitorAttachmentTotalSizeLimit,
 		AttachmentFileSizeLimit:  conf.AttachmentFileSizeLimit,
@@ -522,6 +547,7 @@ func (v *visitor) infoLightNoLock() *visitorInfo {
 	messages := v.messagesLimiter.Value()
 	emails := v.emailsLimiter.Value()
 	calls := v.callsLimiter.Value()
+	sms := v.smsLimiter.Value()
 	limits := v.limitsNoLock()
 	stats := &visitorStats{
 		Messages:          messages,
@@ -530,6 +556,8 @@ func (v *visitor) infoLightNoLock() *visitorInfo {
 		EmailsRemaining:   zeroIfNegative(limits.EmailLimit - emails),
 		Calls:             calls,
 		CallsRemaining:    zeroIfNegative(limits.CallLimit - calls),
+		SMS:               sms,
+		SMSRemaining:      zeroIfNegative(limits.SMSLimit - sms),
 	}
 	return &visitorInfo{
 		Limits: limits,
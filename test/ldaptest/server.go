@@ -0,0 +1,274 @@
+// Package ldaptest provides a minimal in-process LDAP server for tests. It supports simple binds and
+// searches (with and, or, not, equality and presence filters), which is enough to test LDAP authentication.
+// This code is not meant to be used outside of tests.
+package ldaptest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Filter tags, see RFC 4511, section 4.5.1.7
+const (
+	filterAnd      = 0
+	filterOr       = 1
+	filterNot      = 2
+	filterEquality = 3
+	filterPresent  = 7
+)
+
+// Entry is a directory entry. If Password is set, the entry can be used to bind.
+type Entry struct {
+	DN         string
+	Password   string
+	Attributes map[string][]string
+}
+
+// Server is an in-process LDAP server
+type Server struct {
+	URL      string
+	listener net.Listener
+	entries  []*Entry
+	binds    atomic.Int64
+	mu       sync.RWMutex
+}
+
+// NewServer starts a new LDAP server on a random local port, serving the given entries.
+// The server is stopped when the test ends.
+func NewServer(t *testing.T, entries ...*Entry) *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		URL:      fmt.Sprintf("ldap://%s", listener.Addr().String()),
+		listener: listener,
+		entries:  entries,
+	}
+	go s.serve()
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	return s
+}
+
+// Binds returns the number of bind requests the server received
+func (s *Server) Binds() int {
+	return int(s.binds.Load())
+}
+
+// SetPassword changes the password of the entry with the given DN
+func (s *Server) SetPassword(dn, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry := s.entry(dn); entry != nil {
+		entry.Password = password
+	}
+}
+
+// SetAttribute replaces the values of an attribute of the entry with the given DN, e.g. to change group members
+func (s *Server) SetAttribute(dn, name string, values ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry := s.entry(dn); entry != nil {
+		entry.Attributes[name] = values
+	}
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil {
+			return
+		} else if len(packet.Children) < 2 {
+			return
+		}
+		messageID, ok := packet.Children[0].Value.(int64)
+		if !ok {
+			return
+		}
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			s.handleBind(conn, messageID, op)
+		case ldap.ApplicationSearchRequest:
+			s.handleSearch(conn, messageID, op)
+		default: // Unbind, or anything else
+			return
+		}
+	}
+}
+
+func (s *Server) handleBind(w io.Writer, messageID int64, op *ber.Packet) {
+	s.binds.Add(1)
+	if len(op.Children) < 3 {
+		writeResult(w, messageID, ldap.ApplicationBindResponse, ldap.LDAPResultProtocolError)
+		return
+	}
+	dn := op.Children[1].Value.(string)
+	password := op.Children[2].Data.String()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entry := s.entry(dn)
+	if dn == "" && password == "" {
+		writeResult(w, messageID, ldap.ApplicationBindResponse, ldap.LDAPResultSuccess) // Anonymous bind
+	} else if entry == nil || entry.Password == "" || entry.Password != password {
+		writeResult(w, messageID, ldap.ApplicationBindResponse, ldap.LDAPResultInvalidCredentials)
+	} else {
+		writeResult(w, messageID, ldap.ApplicationBindResponse, ldap.LDAPResultSuccess)
+	}
+}
+
+func (s *Server) handleSearch(w io.Writer, messageID int64, op *ber.Packet) {
+	if len(op.Children) < 8 {
+		writeResult(w, messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultProtocolError)
+		return
+	}
+	baseDN := strings.ToLower(op.Children[0].Value.(string))
+	filter := op.Children[6]
+	attributes := make([]string, 0)
+	for _, attribute := range op.Children[7].Children {
+		attributes = append(attributes, attribute.Value.(string))
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, entry := range s.entries {
+		dn := strings.ToLower(entry.DN)
+		if dn != baseDN && !strings.HasSuffix(dn, ","+baseDN) {
+			continue
+		}
+		matches, err := match(entry, filter)
+		if err != nil {
+			writeResult(w, messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultUnwillingToPerform)
+			return
+		} else if matches {
+			writeEntry(w, messageID, entry, attributes)
+		}
+	}
+	writeResult(w, messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)
+}
+
+func (s *Server) entry(dn string) *Entry {
+	for _, entry := range s.entries {
+		if strings.EqualFold(entry.DN, dn) {
+			return entry
+		}
+	}
+	return nil
+}
+
+func match(entry *Entry, filter *ber.Packet) (bool, error) {
+	switch filter.Tag {
+	case filterAnd:
+		for _, child := range filter.Children {
+			if matches, err := match(entry, child); err != nil || !matches {
+				return false, err
+			}
+		}
+		return true, nil
+	case filterOr:
+		for _, child := range filter.Children {
+			if matches, err := match(entry, child); err != nil || matches {
+				return matches, err
+			}
+		}
+		return false, nil
+	case filterNot:
+		if len(filter.Children) != 1 {
+			return false, errors.New("invalid not filter")
+		}
+		matches, err := match(entry, filter.Children[0])
+		return !matches, err
+	case filterEquality:
+		if len(filter.Children) != 2 {
+			return false, errors.New("invalid equality filter")
+		}
+		name, value := filter.Children[0].Data.String(), filter.Children[1].Data.String()
+		for _, v := range attributeValues(entry, name) {
+			if strings.EqualFold(v, value) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case filterPresent:
+		return len(attributeValues(entry, filter.Data.String())) > 0, nil
+	}
+	return false, fmt.Errorf("unsupported filter tag %d", filter.Tag)
+}
+
+func attributeValues(entry *Entry, name string) []string {
+	for attribute, values := range entry.Attributes {
+		if strings.EqualFold(attribute, name) {
+			return values
+		}
+	}
+	return nil
+}
+
+func writeEntry(w io.Writer, messageID int64, entry *Entry, attributes []string) {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.DN, "Object Name"))
+	attributesPacket := ber.NewSequence("Attributes")
+	for name, values := range entry.Attributes {
+		if !requested(attributes, name) {
+			continue
+		}
+		attribute := ber.NewSequence("Attribute")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, value := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+		}
+		attribute.AppendChild(set)
+		attributesPacket.AppendChild(attribute)
+	}
+	op.AppendChild(attributesPacket)
+	write(w, messageID, op)
+}
+
+func requested(attributes []string, name string) bool {
+	if len(attributes) == 0 {
+		return true
+	}
+	for _, attribute := range attributes {
+		if attribute == "*" || strings.EqualFold(attribute, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeResult(w io.Writer, messageID int64, tag ber.Tag, resultCode uint16) {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(resultCode), "Result Code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	write(w, messageID, op)
+}
+
+func write(w io.Writer, messageID int64, op *ber.Packet) {
+	packet := ber.NewSequence("LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "Message ID"))
+	packet.AppendChild(op)
+	w.Write(packet.Bytes())
+}
@@ -20,11 +20,19 @@ import (
 // pattern[username] is the linear-scan list of %-bearing rules for that user.
 // Walked per request; trivially small in practice. Wildcards are NOT u_everyone-
 // only -- any user can create them.
+//
+// groupExact, groupPattern and members index the user_group_access and
+// user_group_member tables in the same way, keyed by group name. They are
+// always replaced wholesale by ReloadGroups.
 type accessCache struct {
-	exact   map[string]map[string]aclEntry
-	pattern map[string][]aclEntry
-	seq     uint64       // Bumped on every reload; lets a full reload detect a per-user reload that raced its scan
-	mu      sync.RWMutex // Protect exact, pattern, and seq
+	exact        map[string]map[string]aclEntry
+	pattern      map[string][]aclEntry
+	groupExact   map[string]map[string]aclEntry
+	groupPattern map[string][]aclEntry
+	members      map[string][]string // username -> group names
+	seq          uint64              // Bumped on every reload; lets a full reload detect a per-user reload that raced its scan
+	mu           sync.RWMutex        // Protect all maps and seq
+	groupMu      sync.Mutex          // Serializes ReloadGroups, so that an older scan cannot overwrite a newer one
 }
 
 // testHookReloadScanned, if non-nil, is invoked by Reload after the DB scan but
@@ -46,27 +54,38 @@ type aclEntry struct {
 
 func newAccessCache() *accessCache {
 	return &accessCache{
-		exact:   make(map[string]map[string]aclEntry),
-		pattern: make(map[string][]aclEntry),
+		exact:        make(map[string]map[string]aclEntry),
+		pattern:      make(map[string][]aclEntry),
+		groupExact:   make(map[string]map[string]aclEntry),
+		groupPattern: make(map[string][]aclEntry),
+		members:      make(map[string][]string),
 	}
 }
 
 // Lookup returns the effective (read, write, found) permission for the given
 // (username, topic), preserving the priority ordering of the original SQL query:
-//  1. specific user beats Everyone
+//  1. specific user beats the user's groups, which beat Everyone
 //  2. longer pattern beats shorter (more specific wins)
 //  3. write beats read at equal length (write is "stronger")
+//
+// If the user is a member of more than one group with a matching rule, the best
+// rule of each group is picked as above, and the permissions are combined.
 func (c *accessCache) Lookup(username, topic string) (read, write, found bool) {
 	escapedTopic := escapeUnderscore(topic)
 	c.mu.RLock()
 	if username != Everyone {
-		if entry, found := c.lookupNoLock(username, topic, escapedTopic); found {
+		if entry, found := lookupNoLock(c.exact[username], c.pattern[username], topic, escapedTopic); found {
 			c.mu.RUnlock()
 			maybeLogACLDecision(username, username, topic, entry.read, entry.write)
 			return entry.read, entry.write, true
 		}
+		if read, write, found := c.lookupGroupsNoLock(username, topic, escapedTopic); found {
+			c.mu.RUnlock()
+			maybeLogACLDecision(username, "group:"+strings.Join(c.members[username], ","), topic, read, write)
+			return read, write, true
+		}
 	}
-	if entry, found := c.lookupNoLock(Everyone, topic, escapedTopic); found {
+	if entry, found := lookupNoLock(c.exact[Everyone], c.pattern[Everyone], topic, escapedTopic); found {
 		c.mu.RUnlock()
 		maybeLogACLDecision(username, Everyone, topic, entry.read, entry.write)
 		return entry.read, entry.write, true
@@ -172,9 +191,90 @@ func (c *accessCache) Reload(d *db.DB, query string, usernames ...string) error
 	return nil
 }
 
-// lookupNoLock returns the highest-priority entry for a single user. When
-// more than one of that user's rules matches the requested topic, the winner
-// is chosen by:
+// ReloadGroups scans all group grants (group_name, topic, read, write) and all
+// group memberships (user_name, group_name), and replaces the group part of the
+// cache wholesale. Groups and their grants are few and change rarely, so unlike
+// Reload there is no per-user variant.
+func (c *accessCache) ReloadGroups(d *db.DB, accessQuery, membersQuery string) error {
+	c.groupMu.Lock()
+	defer c.groupMu.Unlock()
+	started := time.Now()
+	rows, err := d.Query(accessQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	exacts := make(map[string]map[string]aclEntry)
+	patterns := make(map[string][]aclEntry)
+	updatedEntries := 0
+	for rows.Next() {
+		var group, escapedTopic string
+		var read, write bool
+		if err := rows.Scan(&group, &escapedTopic, &read, &write); err != nil {
+			return err
+		}
+		entry, hasWildcard, err := toACLEntry(escapedTopic, read, write)
+		if err != nil {
+			return err
+		}
+		if hasWildcard {
+			patterns[group] = append(patterns[group], entry)
+		} else {
+			if exacts[group] == nil {
+				exacts[group] = make(map[string]aclEntry)
+			}
+			exacts[group][escapedTopic] = entry
+		}
+		updatedEntries++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	memberRows, err := d.Query(membersQuery)
+	if err != nil {
+		return err
+	}
+	defer memberRows.Close()
+	members := make(map[string][]string)
+	for memberRows.Next() {
+		var username, group string
+		if err := memberRows.Scan(&username, &group); err != nil {
+			return err
+		}
+		members[username] = append(members[username], group)
+	}
+	if err := memberRows.Err(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.groupExact = exacts
+	c.groupPattern = patterns
+	c.members = members
+	c.mu.Unlock()
+	log.Tag(tag).
+		Field("reload_scope", "groups").
+		Field("updated_entries", updatedEntries).
+		Field("duration_ms", time.Since(started).Milliseconds()).
+		Debug("ACL cache reloaded")
+	return nil
+}
+
+// lookupGroupsNoLock returns the combined permissions of all groups the user is a
+// member of. Within a group, the highest-priority entry is picked (see lookupNoLock);
+// across groups, the permissions are combined, i.e. read (or write) is granted if any
+// group grants it.
+func (c *accessCache) lookupGroupsNoLock(username, topic, escapedTopic string) (read, write, found bool) {
+	for _, group := range c.members[username] {
+		if entry, ok := lookupNoLock(c.groupExact[group], c.groupPattern[group], topic, escapedTopic); ok {
+			read, write, found = read || entry.read, write || entry.write, true
+		}
+	}
+	return read, write, found
+}
+
+// lookupNoLock returns the highest-priority entry for a single user or group,
+// given its exact and wildcard rules. When more than one rule matches the
+// requested topic, the winner is chosen by:
 //
 //  1. longer stored pattern beats shorter (a more specific rule wins over a
 //     more general one)
@@ -183,15 +283,13 @@ func (c *accessCache) Reload(d *db.DB, query string, usernames ...string) error
 // Exact and wildcard rules are ranked together under the same criteria, so
 // an exact "foo" (length 3) beats a wildcard "f%" (length 2), but a wildcard
 // "foo%" (length 4) beats an exact "foo" (length 3).
-func (c *accessCache) lookupNoLock(username, topic, escapedTopic string) (*aclEntry, bool) {
+func lookupNoLock(exact map[string]aclEntry, patterns []aclEntry, topic, escapedTopic string) (*aclEntry, bool) {
 	var best aclEntry
 	var found bool
-	if exact, exists := c.exact[username]; exists {
-		if entry, exists := exact[escapedTopic]; exists {
-			best, found = entry, true
-		}
+	if entry, exists := exact[escapedTopic]; exists {
+		best, found = entry, true
 	}
-	for _, pattern := range c.pattern[username] {
+	for _, pattern := range patterns {
 		if !pattern.pattern.MatchString(topic) {
 			continue
 		} else if !found || better(pattern, best) {
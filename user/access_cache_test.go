@@ -271,6 +271,63 @@ func TestACLCache_ConcurrentLookupAndReload(t *testing.T) {
 	wg.Wait()
 }
 
+func TestACLCache_GroupBeatsEveryone(t *testing.T) {
+	c := newAccessCache()
+	loadCache(t, c, []rawACLRow{
+		{user: Everyone, topic: "alerts", read: true, write: false},
+	})
+	loadGroups(t, c, []rawACLRow{
+		{user: "oncall", topic: "alerts", read: true, write: true},
+	}, map[string][]string{"phil": {"oncall"}})
+	read, write, found := c.Lookup("phil", "alerts")
+	require.True(t, found)
+	require.True(t, read)
+	require.True(t, write)
+
+	// Non-members fall through to Everyone
+	read, write, found = c.Lookup("ben", "alerts")
+	require.True(t, found)
+	require.True(t, read)
+	require.False(t, write)
+}
+
+func TestACLCache_UserBeatsGroup(t *testing.T) {
+	c := newAccessCache()
+	loadCache(t, c, []rawACLRow{
+		{user: "phil", topic: "alerts", read: false, write: false},
+	})
+	loadGroups(t, c, []rawACLRow{
+		{user: "oncall", topic: "alert%", read: true, write: true},
+	}, map[string][]string{"phil": {"oncall"}})
+	read, write, found := c.Lookup("phil", "alerts")
+	require.True(t, found)
+	require.False(t, read)
+	require.False(t, write)
+}
+
+func TestACLCache_GroupsCombined(t *testing.T) {
+	// Within a group the most specific rule wins (oncall: "alerts-db" read-only beats
+	// "alerts%" read-write); across groups the permissions are combined.
+	c := newAccessCache()
+	loadGroups(t, c, []rawACLRow{
+		{user: "oncall", topic: "alerts%", read: true, write: true},
+		{user: "oncall", topic: "alerts-db", read: true, write: false},
+		{user: "dba", topic: "alerts-db", read: false, write: true},
+	}, map[string][]string{
+		"phil": {"oncall"},
+		"ben":  {"oncall", "dba"},
+	})
+	read, write, found := c.Lookup("phil", "alerts-db")
+	require.True(t, found)
+	require.True(t, read)
+	require.False(t, write)
+
+	read, write, found = c.Lookup("ben", "alerts-db")
+	require.True(t, found)
+	require.True(t, read)
+	require.True(t, write)
+}
+
 // rawACLRow models the rows that reload would Scan from the DB but avoids
 // actually opening a DB for these unit tests.
 type rawACLRow struct {
@@ -310,3 +367,28 @@ func mustCompileLikeToRegex(t *testing.T, pattern string) *regexp.Regexp {
 	require.NoError(t, err)
 	return r
 }
+
+// loadGroups writes the given group rows (with rawACLRow.user holding the group name) and
+// memberships into the cache, like ReloadGroups would.
+func loadGroups(t *testing.T, c *accessCache, rows []rawACLRow, members map[string][]string) {
+	t.Helper()
+	exact := make(map[string]map[string]aclEntry)
+	wildcards := make(map[string][]aclEntry)
+	for _, r := range rows {
+		e, hasWildcard, err := toACLEntry(r.topic, r.read, r.write)
+		require.NoError(t, err)
+		if hasWildcard {
+			wildcards[r.user] = append(wildcards[r.user], e)
+		} else {
+			if exact[r.user] == nil {
+				exact[r.user] = make(map[string]aclEntry)
+			}
+			exact[r.user][r.topic] = e
+		}
+	}
+	c.mu.Lock()
+	c.groupExact = exact
+	c.groupPattern = wildcards
+	c.members = members
+	c.mu.Unlock()
+}
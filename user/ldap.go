@@ -0,0 +1,370 @@
+package user
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/util"
+)
+
+const (
+	ldapTag              = "ldap"
+	ldapExternalIDPrefix = "ldap:" // Prefix of User.ExternalID for users managed via LDAP, followed by the username
+	ldapTimeout          = 10 * time.Second
+	ldapPasswordLength   = 32
+	ldapUsernamePattern  = "{username}"
+	ldapUserDNPattern    = "{dn}"
+	ldapCacheKeyLength   = 32
+	ldapCacheMaxEntries  = 10000 // Max. number of cached binds, to avoid unbounded memory usage
+	ldapSearchSizeLimit  = 2     // User searches must return exactly one entry; 2 to detect ambiguous results
+	ldapGroupsSizeLimit  = 1000
+	ldapNoAttributes     = "1.1" // Special attribute list to only return the DN, see RFC 4511, section 4.5.1.8
+)
+
+// Default constants for the LDAP config
+const (
+	DefaultLDAPUserFilter     = "(uid={username})"
+	DefaultLDAPGroupFilter    = "(member={dn})"
+	DefaultLDAPGroupAttribute = "cn"
+	DefaultLDAPCacheDuration  = 5 * time.Minute
+)
+
+var errLDAPUserNotFound = errors.New("user not found in directory")
+
+// LDAPConfig is the configuration for the LDAPAuther
+type LDAPConfig struct {
+	URL            string              // ldap://host:389 or ldaps://host:636
+	StartTLS       bool                // Upgrade ldap:// connections via StartTLS
+	BindDN         string              // Service account used to search users and groups (optional)
+	BindPassword   string              // Password of the service account
+	UserDN         string              // DN template to bind as user directly, e.g. uid={username},ou=people,dc=example,dc=com
+	UserBaseDN     string              // Base DN to search users in, if UserDN is not set
+	UserFilter     string              // Filter to search users, e.g. (uid={username}) or (sAMAccountName={username})
+	GroupBaseDN    string              // Base DN to search groups in, groups are not resolved if empty
+	GroupFilter    string              // Filter to search the user's groups, e.g. (member={dn})
+	GroupAttribute string              // Attribute containing the group name, e.g. cn
+	AdminGroups    []string            // Members of these groups get the admin role
+	GroupAccess    map[string][]*Grant // Group -> access control entries
+	CacheDuration  time.Duration       // How long successful binds are cached, 0 to disable the cache
+}
+
+// LDAPAuther is an Auther that verifies passwords by binding to an LDAP server (or Active Directory) as the user.
+//
+// On a successful bind, the user is created in (or updated in) the user database, with the role and access control
+// entries derived from the user's LDAP groups. This means that tokens, tiers, reservations and the ACL work exactly
+// like for local users, and that Authorize is simply delegated to the Manager.
+//
+// Users that are provisioned via the config file (e.g. service accounts) are authenticated against the
+// local user database, and never against LDAP.
+//
+// Successful binds are cached for CacheDuration. On a cached bind, the user's groups are still re-resolved (as the
+// service account) and synced, so that role and group changes apply right away. If groups are resolved, but no
+// service account is configured, groups can only be read as the user, so the cache is not used at all.
+type LDAPAuther struct {
+	config   *LDAPConfig
+	manager  *Manager
+	cache    map[string]*ldapCacheEntry // Username -> successful bind
+	cacheKey []byte                     // Random HMAC key, so cached passwords can't be recovered from memory dumps
+	mu       sync.Mutex
+}
+
+type ldapCacheEntry struct {
+	hash    []byte
+	expires time.Time
+}
+
+var _ Auther = (*LDAPAuther)(nil)
+
+// NewLDAPAuther creates a new LDAPAuther, using the given Manager for provisioned users, user storage and authorization
+func NewLDAPAuther(config *LDAPConfig, manager *Manager) (*LDAPAuther, error) {
+	if config.URL == "" {
+		return nil, errors.New("LDAP URL must be set")
+	} else if config.UserDN == "" && config.UserBaseDN == "" {
+		return nil, errors.New("either LDAP user DN template or user base DN must be set")
+	}
+	if config.UserFilter == "" {
+		config.UserFilter = DefaultLDAPUserFilter
+	}
+	if config.GroupFilter == "" {
+		config.GroupFilter = DefaultLDAPGroupFilter
+	}
+	if config.GroupAttribute == "" {
+		config.GroupAttribute = DefaultLDAPGroupAttribute
+	}
+	cacheKey := make([]byte, ldapCacheKeyLength)
+	if _, err := rand.Read(cacheKey); err != nil {
+		return nil, err
+	}
+	return &LDAPAuther{
+		config:   config,
+		manager:  manager,
+		cache:    make(map[string]*ldapCacheEntry),
+		cacheKey: cacheKey,
+	}, nil
+}
+
+// Authenticate checks username and password against the LDAP server, and returns the (synced) user if correct.
+// Provisioned users are authenticated against the local user database instead.
+func (a *LDAPAuther) Authenticate(username, password string) (*User, error) {
+	if username == Everyone || !AllowedUsername(username) || password == "" {
+		return nil, ErrUnauthenticated // Empty passwords are "unauthenticated binds" in LDAP, which always succeed!
+	}
+	if u, err := a.manager.User(username); err == nil && u.Provisioned {
+		return a.manager.Authenticate(username, password)
+	}
+	cached := a.cached(username, password)
+	if cached && a.config.GroupBaseDN == "" {
+		// Without groups, role and access control entries never change, so there is nothing to sync
+		u, err := a.manager.User(username)
+		if err == nil && !u.Deleted && u.ExternalID == ldapExternalIDPrefix+username {
+			log.Tag(ldapTag).Field("user_name", username).Trace("Authenticated user via cached LDAP bind")
+			return u, nil
+		}
+	}
+	var groups []string
+	var err error
+	if cached && a.config.GroupBaseDN != "" && a.config.BindDN != "" {
+		groups, err = a.lookup(username)
+	} else {
+		groups, err = a.bind(username, password)
+	}
+	if err != nil {
+		log.Tag(ldapTag).Field("user_name", username).Err(err).Debug("LDAP authentication of user failed")
+		a.uncache(username)
+		return nil, ErrUnauthenticated
+	}
+	u, err := a.sync(username, groups)
+	if err != nil {
+		log.Tag(ldapTag).Field("user_name", username).Err(err).Warn("Cannot sync LDAP user to user database")
+		a.uncache(username)
+		return nil, ErrUnauthenticated
+	}
+	if !cached {
+		a.addToCache(username, password)
+	}
+	return u, nil
+}
+
+// Authorize returns nil if the given user has access to the given topic using the desired permission.
+// Since LDAP users are synced to the user database, this is delegated to the Manager.
+func (a *LDAPAuther) Authorize(user *User, topic string, perm Permission) error {
+	return a.manager.Authorize(user, topic, perm)
+}
+
+// bind verifies the user's password by binding as the user, and returns the user's groups
+func (a *LDAPAuther) bind(username, password string) ([]string, error) {
+	conn, err := a.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	userDN, err := a.userDN(conn, username)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Bind(userDN, password); err != nil {
+		return nil, err
+	}
+	if a.config.GroupBaseDN == "" {
+		return nil, nil
+	}
+	if a.config.BindDN != "" {
+		if err := conn.Bind(a.config.BindDN, a.config.BindPassword); err != nil {
+			return nil, fmt.Errorf("cannot bind as service account: %w", err)
+		}
+	}
+	return a.groups(conn, userDN, username)
+}
+
+// lookup returns the user's groups as the service account, without binding as the user. It is used
+// to re-resolve the groups of a user whose password was verified recently (see cached).
+func (a *LDAPAuther) lookup(username string) ([]string, error) {
+	conn, err := a.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	userDN, err := a.userDN(conn, username)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Bind(a.config.BindDN, a.config.BindPassword); err != nil {
+		return nil, fmt.Errorf("cannot bind as service account: %w", err)
+	}
+	return a.groups(conn, userDN, username)
+}
+
+func (a *LDAPAuther) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(a.config.URL, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(ldapTimeout)
+	if a.config.StartTLS {
+		u, err := url.Parse(a.config.URL)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if err := conn.StartTLS(&tls.Config{ServerName: u.Hostname()}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// userDN returns the user's DN, either from the DN template, or by searching the user (as the service
+// account, if configured, or anonymously otherwise)
+func (a *LDAPAuther) userDN(conn *ldap.Conn, username string) (string, error) {
+	if a.config.UserDN != "" {
+		return strings.ReplaceAll(a.config.UserDN, ldapUsernamePattern, ldap.EscapeDN(username)), nil
+	}
+	if a.config.BindDN != "" {
+		if err := conn.Bind(a.config.BindDN, a.config.BindPassword); err != nil {
+			return "", fmt.Errorf("cannot bind as service account: %w", err)
+		}
+	}
+	filter := strings.ReplaceAll(a.config.UserFilter, ldapUsernamePattern, ldap.EscapeFilter(username))
+	req := ldap.NewSearchRequest(a.config.UserBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, ldapSearchSizeLimit, int(ldapTimeout.Seconds()), false, filter, []string{ldapNoAttributes}, nil)
+	res, err := conn.Search(req)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return "", err
+	} else if res == nil || len(res.Entries) == 0 {
+		return "", errLDAPUserNotFound
+	} else if len(res.Entries) > 1 {
+		return "", fmt.Errorf("user search returned more than one entry for filter %s", filter)
+	}
+	return res.Entries[0].DN, nil
+}
+
+// groups returns the names of the groups the user is a member of
+func (a *LDAPAuther) groups(conn *ldap.Conn, userDN, username string) ([]string, error) {
+	filter := strings.ReplaceAll(a.config.GroupFilter, ldapUserDNPattern, ldap.EscapeFilter(userDN))
+	filter = strings.ReplaceAll(filter, ldapUsernamePattern, ldap.EscapeFilter(username))
+	req := ldap.NewSearchRequest(a.config.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, ldapGroupsSizeLimit, int(ldapTimeout.Seconds()), false, filter, []string{a.config.GroupAttribute}, nil)
+	res, err := conn.Search(req)
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]string, 0, len(res.Entries))
+	for _, entry := range res.Entries {
+		if group := entry.GetAttributeValue(a.config.GroupAttribute); group != "" {
+			groups = append(groups, group)
+		}
+	}
+	return groups, nil
+}
+
+// sync creates the user in the user database on first login, and updates the role and access control entries
+// from the LDAP groups. Existing users that were not created via LDAP (local users, or users of another identity
+// provider) are never taken over, since they may have a different owner, role or access. Roles are only managed if admin groups are
+// configured. Access control entries from the groups are managed entries (see Manager.SetManagedAccess), so they
+// are removed if the user leaves a group, while entries that were added manually are left alone.
+func (a *LDAPAuther) sync(username string, groups []string) (*User, error) {
+	role := RoleUser
+	if slices.ContainsFunc(groups, func(group string) bool { return slices.Contains(a.config.AdminGroups, group) }) {
+		role = RoleAdmin
+	}
+	externalID := ldapExternalIDPrefix + username
+	u, err := a.manager.User(username)
+	if errors.Is(err, ErrUserNotFound) {
+		log.Tag(ldapTag).Field("user_name", username).Info("Creating user %s from LDAP", username)
+		if err := a.manager.AddExternalUser(username, util.RandomString(ldapPasswordLength), role, externalID); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else if u.Deleted {
+		return nil, errors.New("user is marked for deletion")
+	} else if u.ExternalID == "" {
+		return nil, errors.New("user exists, but is not linked to LDAP")
+	} else if u.ExternalID != externalID {
+		return nil, fmt.Errorf("user is linked to another identity provider (%s)", u.ExternalID)
+	} else if len(a.config.AdminGroups) > 0 && u.Role != role {
+		log.Tag(ldapTag).Field("user_name", username).Info("Changing role of user %s to %s", username, role)
+		if err := a.manager.ChangeRole(username, role); err != nil {
+			return nil, err
+		}
+	}
+	grants := make([]*Grant, 0)
+	if role == RoleUser {
+		for _, group := range groups {
+			grants = append(grants, a.config.GroupAccess[group]...)
+		}
+	}
+	if err := a.manager.SetManagedAccess(username, grants); err != nil {
+		return nil, err
+	}
+	return a.manager.User(username)
+}
+
+// IsLDAPUser returns true if the user is managed via LDAP, i.e. if it was created by the LDAPAuther.
+// The password of these users is verified against the LDAP server, and their role and managed access control
+// entries are overwritten on the next login.
+func IsLDAPUser(u *User) bool {
+	return strings.HasPrefix(u.ExternalID, ldapExternalIDPrefix)
+}
+
+func (a *LDAPAuther) cached(username, password string) bool {
+	if a.config.CacheDuration <= 0 {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entry, ok := a.cache[username]
+	if !ok {
+		return false
+	} else if time.Now().After(entry.expires) {
+		delete(a.cache, username)
+		return false
+	}
+	return hmac.Equal(entry.hash, a.hash(password))
+}
+
+func (a *LDAPAuther) addToCache(username, password string) {
+	if a.config.CacheDuration <= 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.cache) >= ldapCacheMaxEntries {
+		now := time.Now()
+		for name, entry := range a.cache {
+			if now.After(entry.expires) {
+				delete(a.cache, name)
+			}
+		}
+		if len(a.cache) >= ldapCacheMaxEntries {
+			return
+		}
+	}
+	a.cache[username] = &ldapCacheEntry{
+		hash:    a.hash(password),
+		expires: time.Now().Add(a.config.CacheDuration),
+	}
+}
+
+func (a *LDAPAuther) uncache(username string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.cache, username)
+}
+
+func (a *LDAPAuther) hash(password string) []byte {
+	mac := hmac.New(sha256.New, a.cacheKey)
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,352 @@
+package user
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"heckel.io/ntfy/v2/test/ldaptest"
+)
+
+func newTestLDAPServer(t *testing.T) *ldaptest.Server {
+	return ldaptest.NewServer(t,
+		&ldaptest.Entry{
+			DN:       "cn=ntfy,ou=services,dc=example,dc=com",
+			Password: "service-pass",
+		},
+		&ldaptest.Entry{
+			DN:       "uid=phil,ou=people,dc=example,dc=com",
+			Password: "phil-pass",
+			Attributes: map[string][]string{
+				"objectClass": {"inetOrgPerson"},
+				"uid":         {"phil"},
+				"mail":        {"phil@example.com"},
+			},
+		},
+		&ldaptest.Entry{
+			DN:       "uid=ben,ou=people,dc=example,dc=com",
+			Password: "ben-pass",
+			Attributes: map[string][]string{
+				"objectClass": {"inetOrgPerson"},
+				"uid":         {"ben"},
+				"mail":        {"ben@example.com"},
+			},
+		},
+		&ldaptest.Entry{
+			DN: "cn=ntfy-admins,ou=groups,dc=example,dc=com",
+			Attributes: map[string][]string{
+				"objectClass": {"groupOfNames"},
+				"cn":          {"ntfy-admins"},
+				"member":      {"uid=phil,ou=people,dc=example,dc=com"},
+			},
+		},
+		&ldaptest.Entry{
+			DN: "cn=alerts,ou=groups,dc=example,dc=com",
+			Attributes: map[string][]string{
+				"objectClass": {"groupOfNames"},
+				"cn":          {"alerts"},
+				"member":      {"uid=phil,ou=people,dc=example,dc=com", "uid=ben,ou=people,dc=example,dc=com"},
+			},
+		},
+	)
+}
+
+func newTestLDAPAuther(t *testing.T, manager *Manager, config *LDAPConfig) *LDAPAuther {
+	a, err := NewLDAPAuther(config, manager)
+	require.Nil(t, err)
+	return a
+}
+
+func TestLDAPAuther_Authenticate_UserDNTemplate(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, newManager newManagerFunc) {
+		server := newTestLDAPServer(t)
+		manager := newTestManager(t, newManager, PermissionDenyAll)
+		a := newTestLDAPAuther(t, manager, &LDAPConfig{
+			URL:    server.URL,
+			UserDN: "uid={username},ou=people,dc=example,dc=com",
+		})
+
+		u, err := a.Authenticate("ben", "ben-pass")
+		require.Nil(t, err)
+		require.Equal(t, "ben", u.Name)
+		require.Equal(t, RoleUser, u.Role)
+
+		// User was created in the user database, with a random password
+		u, err = manager.User("ben")
+		require.Nil(t, err)
+		require.Equal(t, RoleUser, u.Role)
+		require.Equal(t, "ldap:ben", u.ExternalID)
+		require.True(t, IsLDAPUser(u))
+		_, err = manager.Authenticate("ben", "ben-pass")
+		require.Equal(t, ErrUnauthenticated, err)
+
+		_, err = a.Authenticate("ben", "wrong-pass")
+		require.Equal(t, ErrUnauthenticated, err)
+		_, err = a.Authenticate("nobody", "ben-pass")
+		require.Equal(t, ErrUnauthenticated, err)
+	})
+}
+
+func TestLDAPAuther_Authenticate_SearchWithGroups(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, newManager newManagerFunc) {
+		server := newTestLDAPServer(t)
+		manager := newTestManager(t, newManager, PermissionDenyAll)
+		a := newTestLDAPAuther(t, manager, &LDAPConfig{
+			URL:          server.URL,
+			BindDN:       "cn=ntfy,ou=services,dc=example,dc=com",
+			BindPassword: "service-pass",
+			UserBaseDN:   "ou=people,dc=example,dc=com",
+			UserFilter:   "(&(objectClass=inetOrgPerson)(|(uid={username})(mail={username})))",
+			GroupBaseDN:  "ou=groups,dc=example,dc=com",
+			AdminGroups:  []string{"ntfy-admins"},
+			GroupAccess: map[string][]*Grant{
+				"alerts": {
+					{TopicPattern: "alerts", Permission: PermissionReadWrite},
+					{TopicPattern: "alerts_*", Permission: PermissionRead},
+				},
+			},
+		})
+
+		phil, err := a.Authenticate("phil", "phil-pass")
+		require.Nil(t, err)
+		require.Equal(t, RoleAdmin, phil.Role)
+
+		ben, err := a.Authenticate("ben", "ben-pass")
+		require.Nil(t, err)
+		require.Equal(t, RoleUser, ben.Role)
+		grants, err := manager.Grants("ben")
+		require.Nil(t, err)
+		require.Equal(t, []Grant{
+			{TopicPattern: "alerts_*", Permission: PermissionRead, Managed: true},
+			{TopicPattern: "alerts", Permission: PermissionReadWrite, Managed: true},
+		}, grants)
+
+		// ACL semantics are unchanged, since authorization is delegated to the manager
+		require.Nil(t, a.Authorize(ben, "alerts", PermissionWrite))
+		require.Nil(t, a.Authorize(ben, "alerts_prod", PermissionRead))
+		require.Equal(t, ErrUnauthorized, a.Authorize(ben, "alerts_prod", PermissionWrite))
+		require.Equal(t, ErrUnauthorized, a.Authorize(ben, "other", PermissionRead))
+		require.Nil(t, a.Authorize(phil, "other", PermissionWrite))
+	})
+}
+
+func TestLDAPAuther_Authenticate_RoleChange(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, newManager newManagerFunc) {
+		server := newTestLDAPServer(t)
+		manager := newTestManager(t, newManager, PermissionDenyAll)
+		a := newTestLDAPAuther(t, manager, &LDAPConfig{
+			URL:         server.URL,
+			UserDN:      "uid={username},ou=people,dc=example,dc=com",
+			GroupBaseDN: "ou=groups,dc=example,dc=com",
+			AdminGroups: []string{"ntfy-admins"},
+		})
+
+		// Existing users are not re-created, but their role follows the LDAP groups
+		phil, err := a.Authenticate("phil", "phil-pass")
+		require.Nil(t, err)
+		require.Equal(t, RoleAdmin, phil.Role)
+		require.Nil(t, manager.ChangeRole("phil", RoleUser))
+		phil, err = a.Authenticate("phil", "phil-pass")
+		require.Nil(t, err)
+		require.Equal(t, RoleAdmin, phil.Role)
+		require.Equal(t, "ldap:phil", phil.ExternalID)
+	})
+}
+
+func TestLDAPAuther_Authenticate_RevokeGrants(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, newManager newManagerFunc) {
+		server := newTestLDAPServer(t)
+		manager := newTestManager(t, newManager, PermissionDenyAll)
+		a := newTestLDAPAuther(t, manager, &LDAPConfig{
+			URL:         server.URL,
+			UserDN:      "uid={username},ou=people,dc=example,dc=com",
+			GroupBaseDN: "ou=groups,dc=example,dc=com",
+			GroupAccess: map[string][]*Grant{
+				"alerts": {{TopicPattern: "alerts", Permission: PermissionReadWrite}},
+			},
+		})
+
+		ben, err := a.Authenticate("ben", "ben-pass")
+		require.Nil(t, err)
+		require.Nil(t, a.Authorize(ben, "alerts", PermissionWrite))
+		require.Nil(t, manager.AllowAccess("ben", "manual", PermissionRead))
+
+		// Leaving the group removes the group's entries, but not the manual ones
+		server.SetAttribute("cn=alerts,ou=groups,dc=example,dc=com", "member", "uid=phil,ou=people,dc=example,dc=com")
+		ben, err = a.Authenticate("ben", "ben-pass")
+		require.Nil(t, err)
+		require.Equal(t, ErrUnauthorized, a.Authorize(ben, "alerts", PermissionWrite))
+		grants, err := manager.Grants("ben")
+		require.Nil(t, err)
+		require.Equal(t, []Grant{{TopicPattern: "manual", Permission: PermissionRead}}, grants)
+	})
+}
+
+func TestLDAPAuther_Authenticate_ExistingUserNotTakenOver(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, newManager newManagerFunc) {
+		server := newTestLDAPServer(t)
+		manager := newTestManager(t, newManager, PermissionDenyAll)
+		require.Nil(t, manager.AddUser("phil", "local-pass", RoleAdmin, false))
+		require.Nil(t, manager.AddExternalUser("ben", "random-pass", RoleUser, "oidc:1234"))
+		a := newTestLDAPAuther(t, manager, &LDAPConfig{
+			URL:    server.URL,
+			UserDN: "uid={username},ou=people,dc=example,dc=com",
+		})
+
+		// Local users are not linked to LDAP, even if the directory has a user with the same name
+		_, err := a.Authenticate("phil", "phil-pass")
+		require.Equal(t, ErrUnauthenticated, err)
+		_, err = a.Authenticate("phil", "local-pass")
+		require.Equal(t, ErrUnauthenticated, err)
+		u, err := manager.User("phil")
+		require.Nil(t, err)
+		require.Equal(t, RoleAdmin, u.Role)
+		require.Equal(t, "", u.ExternalID)
+
+		// Users linked to another identity provider are never taken over either
+		_, err = a.Authenticate("ben", "ben-pass")
+		require.Equal(t, ErrUnauthenticated, err)
+		u, err = manager.User("ben")
+		require.Nil(t, err)
+		require.Equal(t, "oidc:1234", u.ExternalID)
+	})
+}
+
+func TestLDAPAuther_Authenticate_Cache(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, newManager newManagerFunc) {
+		server := newTestLDAPServer(t)
+		manager := newTestManager(t, newManager, PermissionDenyAll)
+		a := newTestLDAPAuther(t, manager, &LDAPConfig{
+			URL:           server.URL,
+			UserDN:        "uid={username},ou=people,dc=example,dc=com",
+			CacheDuration: time.Minute,
+		})
+
+		_, err := a.Authenticate("ben", "ben-pass")
+		require.Nil(t, err)
+		require.Equal(t, 1, server.Binds())
+
+		// Cached bind, no LDAP roundtrip
+		_, err = a.Authenticate("ben", "ben-pass")
+		require.Nil(t, err)
+		require.Equal(t, 1, server.Binds())
+
+		// Wrong password is never served from the cache, and evicts the cache entry
+		_, err = a.Authenticate("ben", "wrong-pass")
+		require.Equal(t, ErrUnauthenticated, err)
+		require.Equal(t, 2, server.Binds())
+
+		server.SetPassword("uid=ben,ou=people,dc=example,dc=com", "new-pass")
+		_, err = a.Authenticate("ben", "ben-pass")
+		require.Equal(t, ErrUnauthenticated, err)
+		require.Equal(t, 3, server.Binds())
+		_, err = a.Authenticate("ben", "new-pass")
+		require.Nil(t, err)
+		require.Equal(t, 4, server.Binds())
+	})
+}
+
+func TestLDAPAuther_Authenticate_CacheWithGroups(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, newManager newManagerFunc) {
+		server := newTestLDAPServer(t)
+		manager := newTestManager(t, newManager, PermissionDenyAll)
+		a := newTestLDAPAuther(t, manager, &LDAPConfig{
+			URL:           server.URL,
+			BindDN:        "cn=ntfy,ou=services,dc=example,dc=com",
+			BindPassword:  "service-pass",
+			UserDN:        "uid={username},ou=people,dc=example,dc=com",
+			GroupBaseDN:   "ou=groups,dc=example,dc=com",
+			AdminGroups:   []string{"ntfy-admins"},
+			CacheDuration: time.Minute,
+		})
+
+		phil, err := a.Authenticate("phil", "phil-pass")
+		require.Nil(t, err)
+		require.Equal(t, RoleAdmin, phil.Role)
+
+		// Cached bind: the password is not verified again, but the groups are re-resolved as the service account
+		server.SetPassword("uid=phil,ou=people,dc=example,dc=com", "new-pass")
+		server.SetAttribute("cn=ntfy-admins,ou=groups,dc=example,dc=com", "member")
+		phil, err = a.Authenticate("phil", "phil-pass")
+		require.Nil(t, err)
+		require.Equal(t, RoleUser, phil.Role)
+	})
+}
+
+func TestLDAPAuther_Authenticate_CacheWithGroupsNoServiceAccount(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, newManager newManagerFunc) {
+		server := newTestLDAPServer(t)
+		manager := newTestManager(t, newManager, PermissionDenyAll)
+		a := newTestLDAPAuther(t, manager, &LDAPConfig{
+			URL:           server.URL,
+			UserDN:        "uid={username},ou=people,dc=example,dc=com",
+			GroupBaseDN:   "ou=groups,dc=example,dc=com",
+			CacheDuration: time.Minute,
+		})
+
+		// Groups can only be read as the user, so every login binds as the user
+		_, err := a.Authenticate("ben", "ben-pass")
+		require.Nil(t, err)
+		_, err = a.Authenticate("ben", "ben-pass")
+		require.Nil(t, err)
+		require.Equal(t, 2, server.Binds())
+		server.SetPassword("uid=ben,ou=people,dc=example,dc=com", "new-pass")
+		_, err = a.Authenticate("ben", "ben-pass")
+		require.Equal(t, ErrUnauthenticated, err)
+	})
+}
+
+func TestLDAPAuther_Authenticate_EmptyPassword(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, newManager newManagerFunc) {
+		server := newTestLDAPServer(t)
+		manager := newTestManager(t, newManager, PermissionDenyAll)
+		a := newTestLDAPAuther(t, manager, &LDAPConfig{
+			URL:    server.URL,
+			UserDN: "uid={username},ou=people,dc=example,dc=com",
+		})
+
+		// Empty passwords are unauthenticated binds in LDAP, which must never be accepted
+		_, err := a.Authenticate("ben", "")
+		require.Equal(t, ErrUnauthenticated, err)
+		_, err = a.Authenticate(Everyone, "ben-pass")
+		require.Equal(t, ErrUnauthenticated, err)
+		require.Equal(t, 0, server.Binds())
+	})
+}
+
+func TestLDAPAuther_Authenticate_ProvisionedUserFallback(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, newManager newManagerFunc) {
+		hash, err := bcrypt.GenerateFromPassword([]byte("local-pass"), bcrypt.MinCost)
+		require.Nil(t, err)
+		server := newTestLDAPServer(t)
+		manager := newTestManagerFromConfig(t, newManager, &Config{
+			DefaultAccess:       PermissionDenyAll,
+			BcryptCost:          bcrypt.MinCost,
+			QueueWriterInterval: DefaultUserStatsQueueWriterInterval,
+			ProvisionEnabled:    true,
+			Users: []*User{
+				{Name: "ben", Hash: string(hash), Role: RoleUser},
+			},
+		})
+		a := newTestLDAPAuther(t, manager, &LDAPConfig{
+			URL:    server.URL,
+			UserDN: "uid={username},ou=people,dc=example,dc=com",
+		})
+
+		// Provisioned users are authenticated locally, even if they exist in LDAP
+		u, err := a.Authenticate("ben", "local-pass")
+		require.Nil(t, err)
+		require.True(t, u.Provisioned)
+		_, err = a.Authenticate("ben", "ben-pass")
+		require.Equal(t, ErrUnauthenticated, err)
+		require.Equal(t, 0, server.Binds())
+	})
+}
+
+func TestNewLDAPAuther_InvalidConfig(t *testing.T) {
+	_, err := NewLDAPAuther(&LDAPConfig{UserDN: "uid={username},dc=example,dc=com"}, nil)
+	require.Error(t, err)
+	_, err = NewLDAPAuther(&LDAPConfig{URL: "ldap://localhost"}, nil)
+	require.Error(t, err)
+}
@@ -7,12 +7,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"net/netip"
 	"slices"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
 	"golang.org/x/crypto/bcrypt"
 	"heckel.io/ntfy/v2/db"
 	"heckel.io/ntfy/v2/log"
@@ -27,11 +30,23 @@ const (
 	syncTopicLength                 = 16
 	userIDPrefix                    = "u_"
 	userIDLength                    = 12
+	ephemeralUserIDPrefix           = "e_" // Followed by the username, see NewEphemeralUser
+	groupIDPrefix                   = "gr_"
+	groupIDLength                   = 12
 	userAuthIntentionalSlowDownHash = "$2a$10$YFCQvqQDwIIwnJM1xkAYOeih0dg17UVGanaTStnrSzC8NCWxcLDwy" // Cost should match DefaultUserPasswordBcryptCost
 	userHardDeleteAfterDuration     = 7 * 24 * time.Hour
 	tokenPrefix                     = "tk_"
 	tokenLength                     = 32
 	tokenMaxCount                   = 60 // Only keep this many tokens in the table per user
+	tokenDisplayPrefixLength        = 8  // "tk_" + 5 characters, stored in plaintext to identify a token in lists
+	cursorMaxCount                  = 50 // Maximum number of subscription cursors per user
+	totpPeriod                      = 30 // Seconds, see RFC 6238; most authenticator apps only support 30 seconds
+	totpSkew                        = 1  // Number of periods before and after the current one in which codes are accepted
+	totpDigits                      = otp.DigitsSix
+	totpAlgorithm                   = otp.AlgorithmSHA1
+	totpRecoveryCodeCount           = 10
+	totpRecoveryCodeLength          = 10 // Displayed as two groups of five characters, e.g. abcde-12345
+	auditMaxLimit                   = 1000
 	tag                             = "user_manager"
 )
 
@@ -42,6 +57,7 @@ const (
 	DefaultAccessCacheEnabled           = false
 	DefaultAccessCacheReloadInterval    = 87 * time.Second
 	DefaultExpiredMagicLinkReapInterval = time.Hour // How often expired email-verify/password-reset links are swept
+	DefaultAuditLimit                   = 100       // Number of audit log entries returned if no limit is given
 )
 
 var (
@@ -57,6 +73,7 @@ type Manager struct {
 	queries     queries
 	statsQueue  map[string]*Stats       // "Queue" to asynchronously write user stats to the database (UserID -> Stats)
 	tokenQueue  map[string]*TokenUpdate // "Queue" to asynchronously write token access stats to the database (Token ID -> TokenUpdate)
+	cursorQueue map[cursorKey]string    // "Queue" to asynchronously write the last delivered message of cursors to the database (Cursor -> Message ID)
 	accessCache *accessCache            // In-memory snapshot of user_access; refreshed by maybeReloadAccessCache after every ACL mutation
 	quit        chan struct{}           // Closed by Close() to signal background goroutines to stop
 	mu          sync.Mutex
@@ -78,12 +95,13 @@ func newManager(d *db.DB, queries queries, config *Config) (*Manager, error) {
 		config.ExpiredMagicLinkReapInterval = DefaultExpiredMagicLinkReapInterval
 	}
 	manager := &Manager{
-		config:     config,
-		db:         d,
-		statsQueue: make(map[string]*Stats),
-		tokenQueue: make(map[string]*TokenUpdate),
-		quit:       make(chan struct{}),
-		queries:    queries,
+		config:      config,
+		db:          d,
+		statsQueue:  make(map[string]*Stats),
+		tokenQueue:  make(map[string]*TokenUpdate),
+		cursorQueue: make(map[cursorKey]string),
+		quit:        make(chan struct{}),
+		queries:     queries,
 	}
 	if err := manager.maybeProvisionUsersAccessAndTokens(); err != nil {
 		return nil, err
@@ -102,18 +120,30 @@ func newManager(d *db.DB, queries queries, config *Config) (*Manager, error) {
 
 // maybeReloadAccessCache refreshes the in-memory access cache from the
 // primary database. No-op when the cache is disabled. With no usernames it
-// does a full bulk reload; with one or more it refreshes only those users'
-// slices in a single DB round-trip via an IN clause.
+// does a full bulk reload (including groups); with one or more it refreshes
+// only those users' slices in a single DB round-trip via an IN clause.
 func (a *Manager) maybeReloadAccessCache(usernames ...string) error {
 	if a.accessCache == nil {
 		return nil
 	}
 	if len(usernames) == 0 {
-		return a.accessCache.Reload(a.db, a.queries.selectAccessCacheAll)
+		if err := a.accessCache.Reload(a.db, a.queries.selectAccessCacheAll); err != nil {
+			return err
+		}
+		return a.maybeReloadGroupAccessCache()
 	}
 	return a.accessCache.Reload(a.db, a.queries.selectAccessCacheUsers(len(usernames)), usernames...)
 }
 
+// maybeReloadGroupAccessCache refreshes the group grants and memberships in the
+// in-memory access cache. No-op when the cache is disabled.
+func (a *Manager) maybeReloadGroupAccessCache() error {
+	if a.accessCache == nil {
+		return nil
+	}
+	return a.accessCache.ReloadGroups(a.db, a.queries.selectAccessCacheGroupAll, a.queries.selectAccessCacheGroupMember)
+}
+
 // asyncAccessCacheReloadLoop periodically bulk-reloads the access cache so that
 // writes made by other processes against the same database (most notably the
 // `ntfy access` CLI subcommand running while a server holds the cache) become
@@ -187,7 +217,12 @@ func (a *Manager) AuthenticateToken(token string) (*User, error) {
 		log.Tag(tag).Field("token", token).Err(err).Trace("Authentication of token failed")
 		return nil, ErrUnauthenticated
 	}
+	t, err := a.tokenFromPrimary(user.ID, token)
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
 	user.Token = token
+	user.Scope = t.Scope
 	return user, nil
 }
 
@@ -219,6 +254,24 @@ func (a *Manager) addUserTx(tx *sql.Tx, username, hash string, role Role, provis
 	return nil
 }
 
+// AddExternalUser adds a user that is linked to an identity at an external identity provider (OIDC, LDAP),
+// e.g. "oidc:<sub>". The external ID must be unique; the user can later be found via UserByExternalID.
+func (a *Manager) AddExternalUser(username, password string, role Role, externalID string) error {
+	if externalID == "" {
+		return ErrInvalidArgument
+	}
+	hash, err := a.maybeHashPassword(password, false)
+	if err != nil {
+		return err
+	}
+	return db.ExecTx(a.db, func(tx *sql.Tx) error {
+		if err := a.addUserTx(tx, username, hash, role, false); err != nil {
+			return err
+		}
+		return a.changeExternalIDTx(tx, username, externalID)
+	})
+}
+
 // RemoveUser deletes the user with the given username. The function returns nil on success, even
 // if the user did not exist in the first place.
 func (a *Manager) RemoveUser(username string) error {
@@ -231,8 +284,11 @@ func (a *Manager) RemoveUser(username string) error {
 	if err != nil {
 		return err
 	}
-	// Reload user-specific parts of the access cache
-	return a.maybeReloadAccessCache(username, Everyone)
+	// Reload user-specific parts of the access cache, and group memberships
+	if err := a.maybeReloadAccessCache(username, Everyone); err != nil {
+		return err
+	}
+	return a.maybeReloadGroupAccessCache()
 }
 
 // removeUserTx deletes the user with the given username
@@ -356,6 +412,20 @@ func (a *Manager) CanChangeUser(username string) error {
 	return nil
 }
 
+func (a *Manager) changeExternalIDTx(tx *sql.Tx, username, externalID string) error {
+	var value sql.NullString
+	if externalID != "" {
+		value = sql.NullString{String: externalID, Valid: true}
+	}
+	if _, err := tx.Exec(a.queries.updateUserExternalID, value, username); err != nil {
+		if isUniqueConstraintError(err) {
+			return ErrUserExists
+		}
+		return err
+	}
+	return nil
+}
+
 // changeProvisionedTx changes the provisioned status of a user
 func (a *Manager) changeProvisionedTx(tx *sql.Tx, username string, provisioned bool) error {
 	if _, err := tx.Exec(a.queries.updateUserProvisioned, provisioned, username); err != nil {
@@ -462,6 +532,9 @@ func (a *Manager) asyncQueueWriteLoop(interval time.Duration) {
 			if err := a.writeTokenUpdateQueue(); err != nil {
 				log.Tag(tag).Err(err).Warn("Writing token update queue failed")
 			}
+			if err := a.writeCursorDeliveredQueue(); err != nil {
+				log.Tag(tag).Err(err).Warn("Writing cursor delivery queue failed")
+			}
 		}
 	}
 }
@@ -487,9 +560,10 @@ func (a *Manager) writeUserStatsQueue() error {
 					"messages_count": update.Messages,
 					"emails_count":   update.Emails,
 					"calls_count":    update.Calls,
+					"sms_count":      update.SMS,
 				}).
 				Trace("Updating stats for user %s", userID)
-			if _, err := tx.Exec(a.queries.updateUserStats, update.Messages, update.Emails, update.Calls, userID); err != nil {
+			if _, err := tx.Exec(a.queries.updateUserStats, update.Messages, update.Emails, update.Calls, update.SMS, userID); err != nil {
 				return err
 			}
 		}
@@ -534,7 +608,7 @@ func (a *Manager) UserByEmailOrUsername(identifier string) (*User, error) {
 
 // userByToken returns the user with the given token if it exists and is not expired, or ErrUserNotFound otherwise
 func (a *Manager) userByToken(token string) (*User, error) {
-	rows, err := a.db.Query(a.queries.selectUserByToken, token, time.Now().Unix())
+	rows, err := a.db.Query(a.queries.selectUserByToken, hashToken(token), time.Now().Unix())
 	if err != nil {
 		return nil, err
 	}
@@ -550,6 +624,16 @@ func (a *Manager) UserByStripeCustomer(customerID string) (*User, error) {
 	return a.readUser(rows)
 }
 
+// UserByExternalID returns the user linked to the given external identity (see AddExternalUser) if it
+// exists, or ErrUserNotFound otherwise
+func (a *Manager) UserByExternalID(externalID string) (*User, error) {
+	rows, err := a.db.Query(a.queries.selectUserByExternalID, externalID)
+	if err != nil {
+		return nil, err
+	}
+	return a.readUser(rows)
+}
+
 // Users returns a list of users. It loads all users in a single query
 // rather than one query per user to avoid N+1 performance issues.
 func (a *Manager) Users() ([]*User, error) {
@@ -605,10 +689,11 @@ func (a *Manager) readUsers(rows *sql.Rows) ([]*User, error) {
 func (a *Manager) scanUser(rows *sql.Rows) (*User, error) {
 	var id, username, hash, role, prefs, syncTopic string
 	var provisioned bool
+	var externalID sql.NullString
 	var stripeCustomerID, stripeSubscriptionID, stripeSubscriptionStatus, stripeSubscriptionInterval, stripeMonthlyPriceID, stripeYearlyPriceID, tierID, tierCode, tierName sql.NullString
-	var messages, emails, calls int64
-	var messagesLimit, messagesExpiryDuration, emailsLimit, callsLimit, reservationsLimit, attachmentFileSizeLimit, attachmentTotalSizeLimit, attachmentExpiryDuration, attachmentBandwidthLimit, stripeSubscriptionPaidUntil, stripeSubscriptionCancelAt, deleted sql.NullInt64
-	if err := rows.Scan(&id, &username, &hash, &role, &prefs, &syncTopic, &provisioned, &messages, &emails, &calls, &stripeCustomerID, &stripeSubscriptionID, &stripeSubscriptionStatus, &stripeSubscriptionInterval, &stripeSubscriptionPaidUntil, &stripeSubscriptionCancelAt, &deleted, &tierID, &tierCode, &tierName, &messagesLimit, &messagesExpiryDuration, &emailsLimit, &callsLimit, &reservationsLimit, &attachmentFileSizeLimit, &attachmentTotalSizeLimit, &attachmentExpiryDuration, &attachmentBandwidthLimit, &stripeMonthlyPriceID, &stripeYearlyPriceID); err != nil {
+	var messages, emails, calls, sms int64
+	var messagesLimit, messagesExpiryDuration, emailsLimit, callsLimit, smsLimit, reservationsLimit, attachmentFileSizeLimit, attachmentTotalSizeLimit, attachmentExpiryDuration, attachmentBandwidthLimit, stripeSubscriptionPaidUntil, stripeSubscriptionCancelAt, deleted sql.NullInt64
+	if err := rows.Scan(&id, &username, &hash, &role, &prefs, &syncTopic, &provisioned, &externalID, &messages, &emails, &calls, &sms, &stripeCustomerID, &stripeSubscriptionID, &stripeSubscriptionStatus, &stripeSubscriptionInterval, &stripeSubscriptionPaidUntil, &stripeSubscriptionCancelAt, &deleted, &tierID, &tierCode, &tierName, &messagesLimit, &messagesExpiryDuration, &emailsLimit, &callsLimit, &smsLimit, &reservationsLimit, &attachmentFileSizeLimit, &attachmentTotalSizeLimit, &attachmentExpiryDuration, &attachmentBandwidthLimit, &stripeMonthlyPriceID, &stripeYearlyPriceID); err != nil {
 		return nil, err
 	} else if err := rows.Err(); err != nil {
 		return nil, err
@@ -621,10 +706,12 @@ func (a *Manager) scanUser(rows *sql.Rows) (*User, error) {
 		Prefs:       &Prefs{},
 		SyncTopic:   syncTopic,
 		Provisioned: provisioned,
+		ExternalID:  externalID.String, // May be empty
 		Stats: &Stats{
 			Messages: messages,
 			Emails:   emails,
 			Calls:    calls,
+			SMS:      sms,
 		},
 		Billing: &Billing{
 			StripeCustomerID:            stripeCustomerID.String,                                            // May be empty
@@ -649,6 +736,7 @@ func (a *Manager) scanUser(rows *sql.Rows) (*User, error) {
 			MessageExpiryDuration:    time.Duration(messagesExpiryDuration.Int64) * time.Second,
 			EmailLimit:               emailsLimit.Int64,
 			CallLimit:                callsLimit.Int64,
+			SMSLimit:                 smsLimit.Int64,
 			ReservationLimit:         reservationsLimit.Int64,
 			AttachmentFileSizeLimit:  attachmentFileSizeLimit.Int64,
 			AttachmentTotalSizeLimit: attachmentTotalSizeLimit.Int64,
@@ -674,8 +762,12 @@ func (a *Manager) maybeHashPassword(password string, hashed bool) (string, error
 // Authorize returns nil if the given user has access to the given topic using the desired
 // permission. The user param may be nil to signal an anonymous user.
 func (a *Manager) Authorize(user *User, topic string, perm Permission) error {
-	if user != nil && user.Role == RoleAdmin {
+	if user != nil && !user.Scope.Allows(topic, perm) {
+		return ErrUnauthorized // Token scope restricts access, even for admins
+	} else if user != nil && user.Role == RoleAdmin {
 		return nil // Admin can do everything
+	} else if user != nil && user.Ephemeral {
+		return a.authorizeEphemeral(user, topic, perm)
 	}
 	// A user always has full access to their own sync topic, which the apps use
 	// to sync subscriptions/settings across devices. Without this, an
@@ -698,6 +790,28 @@ func (a *Manager) Authorize(user *User, topic string, perm Permission) error {
 	return a.resolvePerms(NewPermission(read, write), perm)
 }
 
+// authorizeEphemeral checks the in-memory grants of an ephemeral user. Like for the access control list, the
+// most specific (longest) matching topic pattern wins. If none matches, the entries for everyone and the
+// default access apply, just like for a regular user without entries of their own.
+func (a *Manager) authorizeEphemeral(user *User, topic string, perm Permission) error {
+	var match *Grant
+	for i, grant := range user.Grants {
+		if grant.Matches(topic) && (match == nil || len(grant.TopicPattern) > len(match.TopicPattern)) {
+			match = &user.Grants[i]
+		}
+	}
+	if match != nil {
+		return a.resolvePerms(match.Permission, perm)
+	}
+	read, write, found, err := a.authorizeTopicAccess(Everyone, topic)
+	if err != nil {
+		return err
+	} else if !found {
+		return a.resolvePerms(a.config.DefaultAccess, perm)
+	}
+	return a.resolvePerms(NewPermission(read, write), perm)
+}
+
 func (a *Manager) resolvePerms(base, perm Permission) error {
 	if perm == PermissionRead && base.IsRead() {
 		return nil
@@ -721,6 +835,68 @@ func (a *Manager) AllowAccess(username string, topicPattern string, permission P
 	return a.maybeReloadAccessCache(username)
 }
 
+// SetManagedAccess replaces the user's access control entries that are managed by an external identity provider
+// (OIDC, LDAP) with the given grants, i.e. managed grants that are not given anymore are revoked. Grants for the
+// same topic pattern are merged. Entries that were added manually (e.g. via "ntfy access") are never changed, and
+// take precedence over a managed grant for the same topic pattern. The database is only written to if the managed
+// grants changed.
+func (a *Manager) SetManagedAccess(username string, grants []*Grant) error {
+	if !AllowedUsername(username) {
+		return ErrInvalidArgument
+	}
+	managed := make(map[string]Permission)
+	for _, grant := range grants {
+		if !AllowedTopicPattern(grant.TopicPattern) {
+			return ErrInvalidArgument
+		}
+		permission := managed[grant.TopicPattern]
+		managed[grant.TopicPattern] = NewPermission(permission.IsRead() || grant.Permission.IsRead(), permission.IsWrite() || grant.Permission.IsWrite())
+	}
+	var changed bool
+	err := db.ExecTx(a.db, func(tx *sql.Tx) error {
+		current, err := a.grantsTx(tx, username)
+		if err != nil {
+			return err
+		}
+		changed = managedGrantsChanged(current, managed)
+		if !changed {
+			return nil
+		}
+		if _, err := tx.Exec(a.queries.deleteUserAccessManaged, username); err != nil {
+			return err
+		}
+		for topicPattern, permission := range managed {
+			if _, err := tx.Exec(a.queries.insertUserAccessManaged, username, toSQLWildcard(topicPattern), permission.IsRead(), permission.IsWrite()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil || !changed {
+		return err
+	}
+	return a.maybeReloadAccessCache(username)
+}
+
+// managedGrantsChanged returns true if the managed grants in current differ from the wanted ones. Manually
+// added grants override managed grants for the same topic pattern, so they are ignored in the comparison.
+func managedGrantsChanged(current []Grant, managed map[string]Permission) bool {
+	count := 0
+	for _, grant := range current {
+		permission, ok := managed[grant.TopicPattern]
+		if !grant.Managed {
+			if ok {
+				count++
+			}
+			continue
+		} else if !ok || permission != grant.Permission {
+			return true
+		}
+		count++
+	}
+	return count != len(managed)
+}
+
 func (a *Manager) allowAccessTx(tx *sql.Tx, username string, topicPattern string, permission Permission, provisioned bool) error {
 	if !AllowedUsername(username) && username != Everyone {
 		return ErrInvalidArgument
@@ -790,10 +966,11 @@ func (a *Manager) AllowReservation(username string, topic string) error {
 // The found return value indicates whether an ACL entry was found at all.
 //
 // Priority:
-//   - Specific user beats Everyone
+//   - Specific user beats the user's groups, which beat Everyone
 //   - Longer pattern beats shorter (a more specific rule beats a more general one,
 //     e.g. "test*" > "*")
 //   - Write beats read at equal length
+//   - If more than one group matches, the permissions of all groups are combined
 //
 // When AccessCacheEnabled is true (config), the lookup is served entirely from
 // the in-memory snapshot maintained by accessCache. Otherwise the original SQL
@@ -803,20 +980,59 @@ func (a *Manager) authorizeTopicAccess(usernameOrEveryone, topic string) (read,
 		read, write, found = a.accessCache.Lookup(usernameOrEveryone, topic)
 		return read, write, found, nil
 	}
-	rows, err := a.db.ReadOnly().Query(a.queries.selectTopicPerms, Everyone, usernameOrEveryone, topic)
+	var matchedUser string
+	err = func() error {
+		rows, err := a.db.ReadOnly().Query(a.queries.selectTopicPerms, Everyone, usernameOrEveryone, topic)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		if !rows.Next() {
+			return rows.Err()
+		}
+		if err := rows.Scan(&matchedUser, &read, &write); err != nil {
+			return err
+		}
+		found = true
+		return rows.Err()
+	}()
 	if err != nil {
 		return false, false, false, err
+	} else if (found && matchedUser == usernameOrEveryone) || usernameOrEveryone == Everyone {
+		return read, write, found, nil // Specific user, or anonymous request (Everyone is not in any group)
 	}
-	defer rows.Close()
-	if !rows.Next() {
-		return false, false, false, nil
+	groupRead, groupWrite, groupFound, err := a.authorizeGroupTopicAccess(usernameOrEveryone, topic)
+	if err != nil {
+		return false, false, false, err
+	} else if groupFound {
+		return groupRead, groupWrite, true, nil
 	}
-	if err := rows.Scan(&read, &write); err != nil {
+	return read, write, found, nil // Everyone, or nothing found
+}
+
+// authorizeGroupTopicAccess returns the combined read/write permissions of all groups the given
+// user is a member of. Rows are ordered by group, so the first row of each group is its best entry.
+func (a *Manager) authorizeGroupTopicAccess(username, topic string) (read, write, found bool, err error) {
+	rows, err := a.db.ReadOnly().Query(a.queries.selectGroupTopicPerms, username, topic)
+	if err != nil {
 		return false, false, false, err
-	} else if err := rows.Err(); err != nil {
+	}
+	defer rows.Close()
+	var lastGroup string
+	for rows.Next() {
+		var group string
+		var groupRead, groupWrite bool
+		if err := rows.Scan(&group, &groupRead, &groupWrite); err != nil {
+			return false, false, false, err
+		} else if found && group == lastGroup {
+			continue
+		}
+		read, write, found, lastGroup = read || groupRead, write || groupWrite, true, group
+	}
+	if err := rows.Err(); err != nil {
 		return false, false, false, err
 	}
-	return read, write, true, nil
+	return read, write, found, nil
 }
 
 // AllGrants returns all user-specific access control entries, mapped to their respective user IDs
@@ -849,7 +1065,11 @@ func (a *Manager) AllGrants() (map[string][]Grant, error) {
 
 // Grants returns all user-specific access control entries
 func (a *Manager) Grants(username string) ([]Grant, error) {
-	rows, err := a.db.ReadOnly().Query(a.queries.selectUserAccess, username)
+	return a.grantsTx(a.db.ReadOnly(), username)
+}
+
+func (a *Manager) grantsTx(tx db.Querier, username string) ([]Grant, error) {
+	rows, err := tx.Query(a.queries.selectUserAccess, username)
 	if err != nil {
 		return nil, err
 	}
@@ -857,8 +1077,8 @@ func (a *Manager) Grants(username string) ([]Grant, error) {
 	grants := make([]Grant, 0)
 	for rows.Next() {
 		var topic string
-		var read, write, provisioned bool
-		if err := rows.Scan(&topic, &read, &write, &provisioned); err != nil {
+		var read, write, provisioned, managed bool
+		if err := rows.Scan(&topic, &read, &write, &provisioned, &managed); err != nil {
 			return nil, err
 		} else if err := rows.Err(); err != nil {
 			return nil, err
@@ -867,9 +1087,392 @@ func (a *Manager) Grants(username string) ([]Grant, error) {
 			TopicPattern: fromSQLWildcard(topic),
 			Permission:   NewPermission(read, write),
 			Provisioned:  provisioned,
+			Managed:      managed,
+		})
+	}
+	return grants, nil
+}
+
+// AddGroup creates a new, empty group with the given name. Grants and members can be added to
+// the group with AllowGroupAccess and AddGroupMember.
+func (a *Manager) AddGroup(name string) error {
+	return db.ExecTx(a.db, func(tx *sql.Tx) error {
+		_, err := a.addGroupTx(tx, name, false)
+		return err
+	})
+}
+
+func (a *Manager) addGroupTx(tx *sql.Tx, name string, provisioned bool) (string, error) {
+	if !AllowedGroupName(name) {
+		return "", ErrInvalidArgument
+	}
+	groupID := util.RandomStringPrefix(groupIDPrefix, groupIDLength)
+	if _, err := tx.Exec(a.queries.insertGroup, groupID, name, provisioned); err != nil {
+		if isUniqueConstraintError(err) {
+			return "", ErrGroupExists
+		}
+		return "", err
+	}
+	return groupID, nil
+}
+
+// RemoveGroup deletes the group with the given name, including all of its grants and memberships.
+// Provisioned groups cannot be removed.
+func (a *Manager) RemoveGroup(name string) error {
+	err := db.ExecTx(a.db, func(tx *sql.Tx) error {
+		group, err := a.changeableGroupTx(tx, name)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(a.queries.deleteGroup, group.ID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return a.maybeReloadGroupAccessCache()
+}
+
+// Group returns the group with the given name, including its members and grants, or
+// ErrGroupNotFound if it does not exist
+func (a *Manager) Group(name string) (*Group, error) {
+	return a.groupTx(a.db.ReadOnly(), name)
+}
+
+func (a *Manager) groupTx(tx db.Querier, name string) (*Group, error) {
+	rows, err := tx.Query(a.queries.selectGroupByName, name)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := a.readGroups(rows)
+	if err != nil {
+		return nil, err
+	} else if len(groups) == 0 {
+		return nil, ErrGroupNotFound
+	}
+	group := groups[0]
+	if group.Members, err = a.groupMembersTx(tx, group.ID); err != nil {
+		return nil, err
+	}
+	if group.Grants, err = a.groupGrantsTx(tx, group.ID, group.Provisioned); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// changeableGroupTx returns the group with the given name, or ErrProvisionedGroupChange if the
+// group was provisioned by the config file and must therefore not be changed.
+func (a *Manager) changeableGroupTx(tx *sql.Tx, name string) (*Group, error) {
+	group, err := a.groupTx(tx, name)
+	if err != nil {
+		return nil, err
+	} else if group.Provisioned {
+		return nil, ErrProvisionedGroupChange
+	}
+	return group, nil
+}
+
+// Groups returns all groups, including their members and grants, ordered by name
+func (a *Manager) Groups() ([]*Group, error) {
+	rows, err := a.db.ReadOnly().Query(a.queries.selectGroups)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := a.readGroups(rows)
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		if group.Members, err = a.groupMembersTx(a.db.ReadOnly(), group.ID); err != nil {
+			return nil, err
+		}
+		if group.Grants, err = a.groupGrantsTx(a.db.ReadOnly(), group.ID, group.Provisioned); err != nil {
+			return nil, err
+		}
+	}
+	return groups, nil
+}
+
+func (a *Manager) readGroups(rows *sql.Rows) ([]*Group, error) {
+	defer rows.Close()
+	groups := make([]*Group, 0)
+	for rows.Next() {
+		var id, name string
+		var provisioned bool
+		if err := rows.Scan(&id, &name, &provisioned); err != nil {
+			return nil, err
+		}
+		groups = append(groups, &Group{
+			ID:          id,
+			Name:        name,
+			Provisioned: provisioned,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+func (a *Manager) groupMembersTx(tx db.Querier, groupID string) ([]string, error) {
+	rows, err := tx.Query(a.queries.selectGroupMembers, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	members := make([]string, 0)
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		members = append(members, username)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+func (a *Manager) groupGrantsTx(tx db.Querier, groupID string, provisioned bool) ([]Grant, error) {
+	rows, err := tx.Query(a.queries.selectGroupAccess, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	grants := make([]Grant, 0)
+	for rows.Next() {
+		var topic string
+		var read, write bool
+		if err := rows.Scan(&topic, &read, &write); err != nil {
+			return nil, err
+		}
+		grants = append(grants, Grant{
+			TopicPattern: fromSQLWildcard(topic),
+			Permission:   NewPermission(read, write),
+			Provisioned:  provisioned,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return grants, nil
+}
+
+// UserGroups returns the names of all groups the given user is a member of
+func (a *Manager) UserGroups(username string) ([]string, error) {
+	rows, err := a.db.ReadOnly().Query(a.queries.selectUserGroups, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	groups := make([]string, 0)
+	for rows.Next() {
+		var group string
+		if err := rows.Scan(&group); err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// AddGroupMember adds the given user to the given group. Adding a user that is already a member
+// of the group is not an error.
+func (a *Manager) AddGroupMember(groupName, username string) error {
+	err := db.ExecTx(a.db, func(tx *sql.Tx) error {
+		group, err := a.changeableGroupTx(tx, groupName)
+		if err != nil {
+			return err
+		}
+		return a.addGroupMemberTx(tx, group.ID, username)
+	})
+	if err != nil {
+		return err
+	}
+	return a.maybeReloadGroupAccessCache()
+}
+
+func (a *Manager) addGroupMemberTx(tx *sql.Tx, groupID, username string) error {
+	if !AllowedUsername(username) {
+		return ErrInvalidArgument // Also rejects Everyone
+	}
+	userID, err := a.userIDTx(tx, username)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(a.queries.insertGroupMember, groupID, userID)
+	return err
+}
+
+// RemoveGroupMember removes the given user from the given group. Removing a user that is not
+// a member of the group is not an error.
+func (a *Manager) RemoveGroupMember(groupName, username string) error {
+	err := db.ExecTx(a.db, func(tx *sql.Tx) error {
+		group, err := a.changeableGroupTx(tx, groupName)
+		if err != nil {
+			return err
+		}
+		userID, err := a.userIDTx(tx, username)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(a.queries.deleteGroupMember, group.ID, userID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return a.maybeReloadGroupAccessCache()
+}
+
+func (a *Manager) userIDTx(tx *sql.Tx, username string) (string, error) {
+	var userID string
+	if err := tx.QueryRow(a.queries.selectUserIDFromUsername, username).Scan(&userID); errors.Is(err, sql.ErrNoRows) {
+		return "", ErrUserNotFound
+	} else if err != nil {
+		return "", err
+	}
+	return userID, nil
+}
+
+// AllowGroupAccess adds or updates an entry in the access control list for a group. It controls
+// read/write access to a topic for all members of the group. The parameter topicPattern may
+// include wildcards (*).
+func (a *Manager) AllowGroupAccess(groupName string, topicPattern string, permission Permission) error {
+	err := db.ExecTx(a.db, func(tx *sql.Tx) error {
+		group, err := a.changeableGroupTx(tx, groupName)
+		if err != nil {
+			return err
+		}
+		return a.allowGroupAccessTx(tx, group.ID, topicPattern, permission)
+	})
+	if err != nil {
+		return err
+	}
+	return a.maybeReloadGroupAccessCache()
+}
+
+func (a *Manager) allowGroupAccessTx(tx *sql.Tx, groupID string, topicPattern string, permission Permission) error {
+	if !AllowedTopicPattern(topicPattern) {
+		return ErrInvalidArgument
+	}
+	_, err := tx.Exec(a.queries.upsertGroupAccess, groupID, toSQLWildcard(topicPattern), permission.IsRead(), permission.IsWrite())
+	return err
+}
+
+// ResetGroupAccess removes an access control list entry for a specific group/topic, or (if topic
+// is empty) all entries of the group. The parameter topicPattern may include wildcards (*).
+func (a *Manager) ResetGroupAccess(groupName string, topicPattern string) error {
+	if !AllowedTopicPattern(topicPattern) && topicPattern != "" {
+		return ErrInvalidArgument
+	}
+	err := db.ExecTx(a.db, func(tx *sql.Tx) error {
+		group, err := a.changeableGroupTx(tx, groupName)
+		if err != nil {
+			return err
+		}
+		if topicPattern == "" {
+			_, err = tx.Exec(a.queries.deleteAllGroupAccess, group.ID)
+		} else {
+			_, err = tx.Exec(a.queries.deleteGroupAccess, group.ID, toSQLWildcard(topicPattern))
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return a.maybeReloadGroupAccessCache()
+}
+
+// AddAuditEntry appends an entry to the audit log. The before and after values are JSON-encoded,
+// unless they are nil (or encode to null), in which case they are stored as empty strings.
+func (a *Manager) AddAuditEntry(actor, ip string, action AuditAction, target string, before, after any) error {
+	beforeJSON, err := auditValue(before)
+	if err != nil {
+		return err
+	}
+	afterJSON, err := auditValue(after)
+	if err != nil {
+		return err
+	}
+	_, err = a.db.Exec(a.queries.insertAuditEntry, time.Now().Unix(), actor, ip, string(action), target, beforeJSON, afterJSON)
+	return err
+}
+
+// AuditEntries returns the audit log entries matching the given filter, newest first
+func (a *Manager) AuditEntries(filter *AuditFilter) ([]*AuditEntry, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DefaultAuditLimit
+	} else if limit > auditMaxLimit {
+		limit = auditMaxLimit
+	}
+	until := int64(math.MaxInt64)
+	if !filter.Until.IsZero() {
+		until = filter.Until.Unix()
+	}
+	action := string(filter.Action)
+	rows, err := a.db.ReadOnly().Query(
+		a.queries.selectAuditEntries,
+		filter.Actor, filter.Actor,
+		action, action,
+		filter.Target, filter.Target,
+		filter.Since.Unix(), until,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := make([]*AuditEntry, 0)
+	for rows.Next() {
+		var id, timestamp int64
+		var actor, ip, action, target, before, after string
+		if err := rows.Scan(&id, &timestamp, &actor, &ip, &action, &target, &before, &after); err != nil {
+			return nil, err
+		}
+		entries = append(entries, &AuditEntry{
+			ID:     id,
+			Time:   time.Unix(timestamp, 0),
+			Actor:  actor,
+			IP:     ip,
+			Action: AuditAction(action),
+			Target: target,
+			Before: before,
+			After:  after,
 		})
 	}
-	return grants, nil
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// RemoveExpiredAuditEntries deletes all audit log entries older than the configured retention
+// duration. If no retention is configured, entries are kept forever.
+func (a *Manager) RemoveExpiredAuditEntries() error {
+	if a.config.AuditRetention <= 0 {
+		return nil
+	}
+	_, err := a.db.Exec(a.queries.deleteAuditEntries, time.Now().Add(-a.config.AuditRetention).Unix())
+	return err
+}
+
+func auditValue(v any) (string, error) {
+	if v == nil {
+		return "", nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	} else if string(b) == "null" { // Typed nil values, e.g. an empty []*AuditGrant
+		return "", nil
+	}
+	return string(b), nil
 }
 
 // AddReservation creates two access control entries for the given topic: one with full read/write
@@ -1108,18 +1711,24 @@ func (a *Manager) resetTopicAccessTx(tx *sql.Tx, username, topicPattern string)
 }
 
 // CreateToken generates a random token for the given user and returns it. The token expires
-// after a fixed duration unless ChangeToken is called. This function also prunes tokens for the
+// after a fixed duration unless ChangeToken is called. If scope is not nil, the token is restricted
+// to the given topics and permissions (see TokenScope). This function also prunes tokens for the
 // given user, if there are too many of them.
-func (a *Manager) CreateToken(userID, label string, expires time.Time, origin netip.Addr, provisioned bool) (*Token, error) {
+func (a *Manager) CreateToken(userID, label string, expires time.Time, origin netip.Addr, scope *TokenScope, provisioned bool) (*Token, error) {
 	return db.QueryTx(a.db, func(tx *sql.Tx) (*Token, error) {
-		return a.createTokenTx(tx, userID, GenerateToken(), label, time.Now(), origin, expires, tokenMaxCount, provisioned)
+		return a.createTokenTx(tx, userID, GenerateToken(), label, time.Now(), origin, expires, scope, tokenMaxCount, provisioned)
 	})
 }
 
 // createTokenTx creates a new token and prunes excess tokens if the count exceeds maxTokenCount.
 // If maxTokenCount is 0, no pruning is performed.
-func (a *Manager) createTokenTx(tx *sql.Tx, userID, token, label string, lastAccess time.Time, lastOrigin netip.Addr, expires time.Time, maxTokenCount int, provisioned bool) (*Token, error) {
-	if _, err := tx.Exec(a.queries.upsertToken, userID, token, label, lastAccess.Unix(), lastOrigin.String(), expires.Unix(), provisioned); err != nil {
+func (a *Manager) createTokenTx(tx *sql.Tx, userID, token, label string, lastAccess time.Time, lastOrigin netip.Addr, expires time.Time, scope *TokenScope, maxTokenCount int, provisioned bool) (*Token, error) {
+	scopeJSON, err := marshalTokenScope(scope)
+	if err != nil {
+		return nil, err
+	}
+	tokenID, prefix := hashToken(token), tokenDisplayPrefix(token)
+	if _, err := tx.Exec(a.queries.upsertToken, userID, tokenID, prefix, label, lastAccess.Unix(), lastOrigin.String(), expires.Unix(), provisioned, scopeJSON); err != nil {
 		return nil, err
 	}
 	if maxTokenCount > 0 {
@@ -1136,16 +1745,19 @@ func (a *Manager) createTokenTx(tx *sql.Tx, userID, token, label string, lastAcc
 		}
 	}
 	return &Token{
+		ID:          tokenID,
 		Value:       token,
+		Prefix:      prefix,
 		Label:       label,
 		LastAccess:  lastAccess,
 		LastOrigin:  lastOrigin,
 		Expires:     expires,
 		Provisioned: provisioned,
+		Scope:       scope,
 	}, nil
 }
 
-// ChangeToken updates a token's label and/or expiry date
+// ChangeToken updates a token's label and/or expiry date. The token may be given as value or ID.
 func (a *Manager) ChangeToken(userID, token string, label *string, expires *time.Time) (*Token, error) {
 	if token == "" {
 		return nil, errNoTokenProvided
@@ -1163,13 +1775,13 @@ func (a *Manager) ChangeToken(userID, token string, label *string, expires *time
 	if expires != nil {
 		t.Expires = *expires
 	}
-	if _, err := a.db.Exec(a.queries.updateToken, t.Label, t.Expires.Unix(), userID, token); err != nil {
+	if _, err := a.db.Exec(a.queries.updateToken, t.Label, t.Expires.Unix(), userID, t.ID); err != nil {
 		return nil, err
 	}
 	return t, nil
 }
 
-// RemoveToken deletes the token defined in User.Token
+// RemoveToken deletes the given token. The token may be given as value or ID.
 func (a *Manager) RemoveToken(userID, token string) error {
 	if err := a.canChangeToken(userID, token); err != nil {
 		return err
@@ -1177,7 +1789,7 @@ func (a *Manager) RemoveToken(userID, token string) error {
 	if token == "" {
 		return errNoTokenProvided
 	}
-	if _, err := a.db.Exec(a.queries.deleteToken, userID, token); err != nil {
+	if _, err := a.db.Exec(a.queries.deleteToken, userID, TokenID(token)); err != nil {
 		return err
 	}
 	return nil
@@ -1194,9 +1806,20 @@ func (a *Manager) canChangeToken(userID, token string) error {
 	return nil
 }
 
-// Token returns a specific token for a user
+// Token returns a specific token for a user. The token may be given as value or ID.
 func (a *Manager) Token(userID, token string) (*Token, error) {
-	rows, err := a.db.ReadOnly().Query(a.queries.selectToken, userID, token)
+	rows, err := a.db.ReadOnly().Query(a.queries.selectToken, userID, TokenID(token))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return a.readToken(rows)
+}
+
+// tokenFromPrimary is like Token, but reads from the primary, since it is used right after
+// authenticating a user, which also reads from the primary
+func (a *Manager) tokenFromPrimary(userID, token string) (*Token, error) {
+	rows, err := a.db.Query(a.queries.selectToken, userID, TokenID(token))
 	if err != nil {
 		return nil, err
 	}
@@ -1253,11 +1876,11 @@ func (a *Manager) RemoveExpiredTokens() error {
 }
 
 // EnqueueTokenUpdate adds the token update to a queue which writes out token access times
-// in batches at a regular interval
-func (a *Manager) EnqueueTokenUpdate(tokenID string, update *TokenUpdate) {
+// in batches at a regular interval. The token may be given as value or ID.
+func (a *Manager) EnqueueTokenUpdate(token string, update *TokenUpdate) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
-	a.tokenQueue[tokenID] = update
+	a.tokenQueue[TokenID(token)] = update
 }
 
 func (a *Manager) writeTokenUpdateQueue() error {
@@ -1291,13 +1914,14 @@ func (a *Manager) updateTokenLastAccessTx(tx *sql.Tx, token string, lastAccess i
 }
 
 func (a *Manager) readToken(rows *sql.Rows) (*Token, error) {
-	var token, label, lastOrigin string
+	var id, prefix, label, lastOrigin string
 	var lastAccess, expires int64
 	var provisioned bool
+	var scopeJSON sql.NullString
 	if !rows.Next() {
 		return nil, ErrTokenNotFound
 	}
-	if err := rows.Scan(&token, &label, &lastAccess, &lastOrigin, &expires, &provisioned); err != nil {
+	if err := rows.Scan(&id, &prefix, &label, &lastAccess, &lastOrigin, &expires, &provisioned, &scopeJSON); err != nil {
 		return nil, err
 	} else if err := rows.Err(); err != nil {
 		return nil, err
@@ -1306,22 +1930,82 @@ func (a *Manager) readToken(rows *sql.Rows) (*Token, error) {
 	if err != nil {
 		lastOriginIP = netip.IPv4Unspecified()
 	}
+	scope, err := unmarshalTokenScope(scopeJSON)
+	if err != nil {
+		return nil, err
+	}
 	return &Token{
-		Value:       token,
+		ID:          id,
+		Prefix:      prefix,
 		Label:       label,
 		LastAccess:  time.Unix(lastAccess, 0),
 		LastOrigin:  lastOriginIP,
 		Expires:     time.Unix(expires, 0),
 		Provisioned: provisioned,
+		Scope:       scope,
 	}, nil
 }
 
+// tokenScopeJSON is the representation of a TokenScope in the scope column of the user_token table
+type tokenScopeJSON struct {
+	Topics    []tokenScopeTopicJSON `json:"topics,omitempty"`
+	NoAccount bool                  `json:"no_account,omitempty"`
+}
+
+type tokenScopeTopicJSON struct {
+	Topic      string `json:"topic"`
+	Permission string `json:"permission"`
+}
+
+func marshalTokenScope(scope *TokenScope) (sql.NullString, error) {
+	if scope == nil {
+		return sql.NullString{}, nil
+	}
+	s := &tokenScopeJSON{
+		Topics:    make([]tokenScopeTopicJSON, 0, len(scope.Grants)),
+		NoAccount: scope.NoAccount,
+	}
+	for _, grant := range scope.Grants {
+		if !AllowedTopicPattern(grant.TopicPattern) || grant.Permission == PermissionDenyAll {
+			return sql.NullString{}, ErrInvalidArgument
+		}
+		s.Topics = append(s.Topics, tokenScopeTopicJSON{Topic: grant.TopicPattern, Permission: grant.Permission.String()})
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return nullString(string(b)), nil
+}
+
+func unmarshalTokenScope(s sql.NullString) (*TokenScope, error) {
+	if !s.Valid || s.String == "" {
+		return nil, nil
+	}
+	var scopeJSON tokenScopeJSON
+	if err := json.Unmarshal([]byte(s.String), &scopeJSON); err != nil {
+		return nil, err
+	}
+	scope := &TokenScope{
+		Grants:    make([]Grant, 0, len(scopeJSON.Topics)),
+		NoAccount: scopeJSON.NoAccount,
+	}
+	for _, topic := range scopeJSON.Topics {
+		perm, err := ParsePermission(topic.Permission)
+		if err != nil {
+			return nil, err
+		}
+		scope.Grants = append(scope.Grants, Grant{TopicPattern: topic.Topic, Permission: perm})
+	}
+	return scope, nil
+}
+
 // AddTier creates a new tier in the database
 func (a *Manager) AddTier(tier *Tier) error {
 	if tier.ID == "" {
 		tier.ID = util.RandomStringPrefix(tierIDPrefix, tierIDLength)
 	}
-	if _, err := a.db.Exec(a.queries.insertTier, tier.ID, tier.Code, tier.Name, tier.MessageLimit, int64(tier.MessageExpiryDuration.Seconds()), tier.EmailLimit, tier.CallLimit, tier.ReservationLimit, tier.AttachmentFileSizeLimit, tier.AttachmentTotalSizeLimit, int64(tier.AttachmentExpiryDuration.Seconds()), tier.AttachmentBandwidthLimit, nullString(tier.StripeMonthlyPriceID), nullString(tier.StripeYearlyPriceID)); err != nil {
+	if _, err := a.db.Exec(a.queries.insertTier, tier.ID, tier.Code, tier.Name, tier.MessageLimit, int64(tier.MessageExpiryDuration.Seconds()), tier.EmailLimit, tier.CallLimit, tier.SMSLimit, tier.ReservationLimit, tier.AttachmentFileSizeLimit, tier.AttachmentTotalSizeLimit, int64(tier.AttachmentExpiryDuration.Seconds()), tier.AttachmentBandwidthLimit, nullString(tier.StripeMonthlyPriceID), nullString(tier.StripeYearlyPriceID)); err != nil {
 		return err
 	}
 	return nil
@@ -1329,7 +2013,7 @@ func (a *Manager) AddTier(tier *Tier) error {
 
 // UpdateTier updates a tier's properties in the database
 func (a *Manager) UpdateTier(tier *Tier) error {
-	if _, err := a.db.Exec(a.queries.updateTier, tier.Name, tier.MessageLimit, int64(tier.MessageExpiryDuration.Seconds()), tier.EmailLimit, tier.CallLimit, tier.ReservationLimit, tier.AttachmentFileSizeLimit, tier.AttachmentTotalSizeLimit, int64(tier.AttachmentExpiryDuration.Seconds()), tier.AttachmentBandwidthLimit, nullString(tier.StripeMonthlyPriceID), nullString(tier.StripeYearlyPriceID), tier.Code); err != nil {
+	if _, err := a.db.Exec(a.queries.updateTier, tier.Name, tier.MessageLimit, int64(tier.MessageExpiryDuration.Seconds()), tier.EmailLimit, tier.CallLimit, tier.SMSLimit, tier.ReservationLimit, tier.AttachmentFileSizeLimit, tier.AttachmentTotalSizeLimit, int64(tier.AttachmentExpiryDuration.Seconds()), tier.AttachmentBandwidthLimit, nullString(tier.StripeMonthlyPriceID), nullString(tier.StripeYearlyPriceID), tier.Code); err != nil {
 		return err
 	}
 	return nil
@@ -1390,11 +2074,11 @@ func (a *Manager) TierByStripePrice(priceID string) (*Tier, error) {
 func (a *Manager) readTier(rows *sql.Rows) (*Tier, error) {
 	var id, code, name string
 	var stripeMonthlyPriceID, stripeYearlyPriceID sql.NullString
-	var messagesLimit, messagesExpiryDuration, emailsLimit, callsLimit, reservationsLimit, attachmentFileSizeLimit, attachmentTotalSizeLimit, attachmentExpiryDuration, attachmentBandwidthLimit sql.NullInt64
+	var messagesLimit, messagesExpiryDuration, emailsLimit, callsLimit, smsLimit, reservationsLimit, attachmentFileSizeLimit, attachmentTotalSizeLimit, attachmentExpiryDuration, attachmentBandwidthLimit sql.NullInt64
 	if !rows.Next() {
 		return nil, ErrTierNotFound
 	}
-	if err := rows.Scan(&id, &code, &name, &messagesLimit, &messagesExpiryDuration, &emailsLimit, &callsLimit, &reservationsLimit, &attachmentFileSizeLimit, &attachmentTotalSizeLimit, &attachmentExpiryDuration, &attachmentBandwidthLimit, &stripeMonthlyPriceID, &stripeYearlyPriceID); err != nil {
+	if err := rows.Scan(&id, &code, &name, &messagesLimit, &messagesExpiryDuration, &emailsLimit, &callsLimit, &smsLimit, &reservationsLimit, &attachmentFileSizeLimit, &attachmentTotalSizeLimit, &attachmentExpiryDuration, &attachmentBandwidthLimit, &stripeMonthlyPriceID, &stripeYearlyPriceID); err != nil {
 		return nil, err
 	} else if err := rows.Err(); err != nil {
 		return nil, err
@@ -1408,6 +2092,7 @@ func (a *Manager) readTier(rows *sql.Rows) (*Tier, error) {
 		MessageExpiryDuration:    time.Duration(messagesExpiryDuration.Int64) * time.Second,
 		EmailLimit:               emailsLimit.Int64,
 		CallLimit:                callsLimit.Int64,
+		SMSLimit:                 smsLimit.Int64,
 		ReservationLimit:         reservationsLimit.Int64,
 		AttachmentFileSizeLimit:  attachmentFileSizeLimit.Int64,
 		AttachmentTotalSizeLimit: attachmentTotalSizeLimit.Int64,
@@ -1469,6 +2154,355 @@ func (a *Manager) readPhoneNumber(rows *sql.Rows) (string, error) {
 	return phoneNumber, nil
 }
 
+// Cursors returns all durable subscription cursors for the user with the given user ID
+func (a *Manager) Cursors(userID string) ([]*Cursor, error) {
+	// Primary read: backs GET /account (read-your-writes after a sync event).
+	rows, err := a.db.Query(a.queries.selectCursors, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cursors := make([]*Cursor, 0)
+	for {
+		cursor, err := a.readCursor(rows)
+		if errors.Is(err, ErrCursorNotFound) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		cursors = append(cursors, a.withPendingCursorDelivered(userID, cursor))
+	}
+	return cursors, nil
+}
+
+// Cursor returns the durable subscription cursor with the given name, or ErrCursorNotFound
+func (a *Manager) Cursor(userID, name string) (*Cursor, error) {
+	rows, err := a.db.Query(a.queries.selectCursor, userID, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cursor, err := a.readCursor(rows)
+	if err != nil {
+		return nil, err
+	}
+	return a.withPendingCursorDelivered(userID, cursor), nil
+}
+
+// AddCursor creates a durable subscription cursor for the given topics, or updates the topics of an
+// existing cursor with the same name. The delivered and acknowledged message IDs of an existing cursor
+// are kept as they are.
+func (a *Manager) AddCursor(userID, name string, topics []string) error {
+	if !AllowedCursorName(name) || len(topics) == 0 {
+		return ErrInvalidArgument
+	}
+	for _, t := range topics {
+		if !AllowedTopic(t) {
+			return ErrInvalidArgument
+		}
+	}
+	return db.ExecTx(a.db, func(tx *sql.Tx) error {
+		var count int
+		if err := tx.QueryRow(a.queries.selectCursorCount, userID).Scan(&count); err != nil {
+			return err
+		}
+		if count >= cursorMaxCount {
+			if _, err := a.cursorTx(tx, userID, name); errors.Is(err, ErrCursorNotFound) {
+				return ErrTooManyCursors
+			} else if err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(a.queries.upsertCursor, userID, name, strings.Join(topics, ","), time.Now().Unix())
+		return err
+	})
+}
+
+// EnqueueCursorDelivered adds the ID of the last message that was delivered to the client of the given cursor
+// to a queue which writes it out in batches at a regular interval. Until then, Cursor and Cursors return the
+// queued message ID. This is safe to call for every delivered message.
+func (a *Manager) EnqueueCursorDelivered(userID, name, messageID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.cursorQueue[cursorKey{userID: userID, name: name}] = messageID
+}
+
+func (a *Manager) writeCursorDeliveredQueue() error {
+	a.mu.Lock()
+	if len(a.cursorQueue) == 0 {
+		a.mu.Unlock()
+		log.Tag(tag).Trace("No cursor deliveries to commit")
+		return nil
+	}
+	cursorQueue := a.cursorQueue
+	a.cursorQueue = make(map[cursorKey]string)
+	a.mu.Unlock()
+
+	return db.ExecTx(a.db, func(tx *sql.Tx) error {
+		log.Tag(tag).Debug("Writing cursor delivery queue for %d cursor(s)", len(cursorQueue))
+		for key, messageID := range cursorQueue {
+			log.Tag(tag).Trace("Updating cursor %s of user %s with last delivered message %s", key.name, key.userID, messageID)
+			if _, err := tx.Exec(a.queries.updateCursorDelivered, messageID, time.Now().Unix(), key.userID, key.name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (a *Manager) withPendingCursorDelivered(userID string, cursor *Cursor) *Cursor {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if messageID, ok := a.cursorQueue[cursorKey{userID: userID, name: cursor.Name}]; ok {
+		cursor.LastDelivered = messageID
+	}
+	return cursor
+}
+
+// AckCursor advances the given cursor to the given message ID, marking all messages up to and including
+// that message as acknowledged by the client. Reconnecting with the cursor replays messages after it.
+func (a *Manager) AckCursor(userID, name, messageID string) error {
+	return a.updateCursor(a.queries.updateCursorAcked, userID, name, messageID)
+}
+
+// RemoveCursor deletes the durable subscription cursor with the given name
+func (a *Manager) RemoveCursor(userID, name string) error {
+	a.mu.Lock()
+	delete(a.cursorQueue, cursorKey{userID: userID, name: name})
+	a.mu.Unlock()
+	_, err := a.db.Exec(a.queries.deleteCursor, userID, name)
+	return err
+}
+
+func (a *Manager) updateCursor(query, userID, name, messageID string) error {
+	res, err := a.db.Exec(query, messageID, time.Now().Unix(), userID, name)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrCursorNotFound
+	}
+	return nil
+}
+
+func (a *Manager) cursorTx(tx *sql.Tx, userID, name string) (*Cursor, error) {
+	rows, err := tx.Query(a.queries.selectCursor, userID, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return a.readCursor(rows)
+}
+
+func (a *Manager) readCursor(rows *sql.Rows) (*Cursor, error) {
+	var name, topics, lastDelivered, lastAcked string
+	var updated int64
+	if !rows.Next() {
+		return nil, ErrCursorNotFound
+	}
+	if err := rows.Scan(&name, &topics, &lastDelivered, &lastAcked, &updated); err != nil {
+		return nil, err
+	} else if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return &Cursor{
+		Name:          name,
+		Topics:        strings.Split(topics, ","),
+		LastDelivered: lastDelivered,
+		LastAcked:     lastAcked,
+		Updated:       time.Unix(updated, 0),
+	}, nil
+}
+
+// TOTP returns the two-factor authentication settings of the user with the given user ID, or ErrTOTPNotFound
+// if the user never started the enrollment
+func (a *Manager) TOTP(userID string) (*TOTP, error) {
+	var secret string
+	var enabled bool
+	var lastCounter, created int64
+	var recoveryCodes int
+	err := a.db.QueryRow(a.queries.selectTOTP, userID).Scan(&secret, &enabled, &lastCounter, &created, &recoveryCodes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrTOTPNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &TOTP{
+		Secret:        secret,
+		Enabled:       enabled,
+		LastCounter:   lastCounter,
+		RecoveryCodes: recoveryCodes,
+		Created:       time.Unix(created, 0),
+	}, nil
+}
+
+// TOTPEnabled returns true if the user with the given user ID has completed the two-factor authentication
+// enrollment, i.e. if a second factor must be provided when logging in with a password
+func (a *Manager) TOTPEnabled(userID string) (bool, error) {
+	t, err := a.TOTP(userID)
+	if errors.Is(err, ErrTOTPNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return t.Enabled, nil
+}
+
+// AddTOTP starts the two-factor authentication enrollment for the user with the given user ID. It generates
+// and stores a new secret, replacing any pending (not yet confirmed) secret. The returned key contains the
+// otpauth:// provisioning URI, which is typically displayed as a QR code. The enrollment must be completed
+// with EnableTOTP. If two-factor authentication is already enabled, ErrTOTPEnabled is returned.
+func (a *Manager) AddTOTP(userID, issuer, accountName string) (*otp.Key, error) {
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      issuer,
+		AccountName: accountName,
+		Period:      totpPeriod,
+		Digits:      totpDigits,
+		Algorithm:   totpAlgorithm,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = db.ExecTx(a.db, func(tx *sql.Tx) error {
+		var enabled bool
+		err := tx.QueryRow(a.queries.selectTOTP, userID).Scan(new(string), &enabled, new(int64), new(int64), new(int))
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		} else if enabled {
+			return ErrTOTPEnabled
+		}
+		_, err = tx.Exec(a.queries.upsertTOTP, userID, key.Secret(), time.Now().Unix())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// EnableTOTP completes the two-factor authentication enrollment for the user with the given user ID, if the
+// given code matches the pending secret. It returns a new set of single-use recovery codes, which can be
+// used in place of a code if the user loses access to their authenticator app. Only hashes of the recovery
+// codes are stored, so they can only be shown to the user once.
+func (a *Manager) EnableTOTP(userID, code string) ([]string, error) {
+	t, err := a.TOTP(userID)
+	if err != nil {
+		return nil, err
+	} else if t.Enabled {
+		return nil, ErrTOTPEnabled
+	}
+	counter, ok := totpCounter(t.Secret, code, time.Now())
+	if !ok {
+		return nil, ErrTOTPCodeInvalid
+	}
+	recoveryCodes := make([]string, totpRecoveryCodeCount)
+	for i := range recoveryCodes {
+		recoveryCodes[i] = generateRecoveryCode()
+	}
+	err = db.ExecTx(a.db, func(tx *sql.Tx) error {
+		res, err := tx.Exec(a.queries.updateTOTPEnabled, counter, userID)
+		if err != nil {
+			return err
+		} else if affected, err := res.RowsAffected(); err != nil {
+			return err
+		} else if affected == 0 {
+			return ErrTOTPEnabled // Enabled concurrently
+		}
+		if _, err := tx.Exec(a.queries.deleteAllTOTPRecoveryCodes, userID); err != nil {
+			return err
+		}
+		for _, recoveryCode := range recoveryCodes {
+			if _, err := tx.Exec(a.queries.insertTOTPRecoveryCode, userID, hashToken(normalizeRecoveryCode(recoveryCode))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return recoveryCodes, nil
+}
+
+// VerifyTOTP checks the given second factor of the user with the given user ID. The code is either a code
+// from the authenticator app, or one of the recovery codes. Each code can only be used once: app codes are
+// rejected if the same (or an earlier) code was already accepted, and recovery codes are deleted when used.
+// If the code is not valid, or two-factor authentication is not enabled, ErrTOTPCodeInvalid is returned.
+func (a *Manager) VerifyTOTP(userID, code string) error {
+	t, err := a.TOTP(userID)
+	if errors.Is(err, ErrTOTPNotFound) {
+		return ErrTOTPCodeInvalid
+	} else if err != nil {
+		return err
+	} else if !t.Enabled {
+		return ErrTOTPCodeInvalid
+	}
+	if counter, ok := totpCounter(t.Secret, code, time.Now()); ok {
+		return a.execAffected(ErrTOTPCodeInvalid, a.queries.updateTOTPLastCounter, counter, userID, counter)
+	}
+	if recoveryCode := normalizeRecoveryCode(code); len(recoveryCode) == totpRecoveryCodeLength {
+		if err := a.execAffected(ErrTOTPCodeInvalid, a.queries.deleteTOTPRecoveryCode, userID, hashToken(recoveryCode)); err != nil {
+			return err
+		}
+		log.Tag(tag).Field("user_id", userID).Info("Recovery code used, %d recovery code(s) left", t.RecoveryCodes-1)
+		return nil
+	}
+	return ErrTOTPCodeInvalid
+}
+
+// RemoveTOTP disables two-factor authentication for the user with the given user ID, and deletes the secret
+// and all recovery codes
+func (a *Manager) RemoveTOTP(userID string) error {
+	return db.ExecTx(a.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(a.queries.deleteAllTOTPRecoveryCodes, userID); err != nil {
+			return err
+		}
+		_, err := tx.Exec(a.queries.deleteTOTP, userID)
+		return err
+	})
+}
+
+// execAffected executes the given query, and returns notFoundErr if no rows were affected
+func (a *Manager) execAffected(notFoundErr error, query string, args ...any) error {
+	res, err := a.db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	} else if affected == 0 {
+		return notFoundErr
+	}
+	return nil
+}
+
+// totpCounter returns the time step (counter) of the given code, if it is valid for the given secret
+// at the given time, allowing for totpSkew periods of clock drift in both directions
+func totpCounter(secret, code string, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits.Length() {
+		return 0, false
+	}
+	for i := -totpSkew; i <= totpSkew; i++ {
+		t := now.Add(time.Duration(i*totpPeriod) * time.Second)
+		expected, err := totp.GenerateCodeCustom(secret, t, totp.ValidateOpts{
+			Period:    totpPeriod,
+			Digits:    totpDigits,
+			Algorithm: totpAlgorithm,
+		})
+		if err != nil {
+			return 0, false
+		} else if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return t.Unix() / totpPeriod, true
+		}
+	}
+	return 0, false
+}
+
 // Emails returns all verified email addresses for the user with the given user ID, each carrying
 // whether it is the primary (recovery) address. Because the primary flag is included, callers that
 // need it (e.g. the account view) do not need a separate PrimaryEmail call.
@@ -1794,7 +2828,7 @@ func (a *Manager) maybeProvisionUsersAccessAndTokens() error {
 	}
 	// If there is nothing to provision, remove any previously provisioned items using
 	// cheap targeted queries, avoiding the expensive Users() call that loads all users.
-	if len(a.config.Users) == 0 && len(a.config.Access) == 0 && len(a.config.Tokens) == 0 {
+	if len(a.config.Users) == 0 && len(a.config.Access) == 0 && len(a.config.Tokens) == 0 && len(a.config.Groups) == 0 && len(a.config.GroupAccess) == 0 {
 		return a.removeAllProvisioned()
 	}
 	// If there are provisioned users, do it the slow way
@@ -1816,6 +2850,9 @@ func (a *Manager) maybeProvisionUsersAccessAndTokens() error {
 		if err := a.maybeProvisionGrants(tx); err != nil {
 			return fmt.Errorf("failed to provision grants: %v", err)
 		}
+		if err := a.maybeProvisionGroups(tx, provisionUsernames); err != nil {
+			return fmt.Errorf("failed to provision groups: %v", err)
+		}
 		if err := a.maybeProvisionTokens(tx, provisionUsernames, existingTokens); err != nil {
 			return fmt.Errorf("failed to provision tokens: %v", err)
 		}
@@ -1823,13 +2860,16 @@ func (a *Manager) maybeProvisionUsersAccessAndTokens() error {
 	})
 }
 
-// removeAllProvisioned removes all provisioned users, access entries, and tokens. This is the fast path
-// for when there is nothing to provision, avoiding the expensive Users() call.
+// removeAllProvisioned removes all provisioned users, access entries, groups, and tokens. This is the fast
+// path for when there is nothing to provision, avoiding the expensive Users() call.
 func (a *Manager) removeAllProvisioned() error {
 	return db.ExecTx(a.db, func(tx *sql.Tx) error {
 		if _, err := tx.Exec(a.queries.deleteUserAccessProvisioned); err != nil {
 			return err
 		}
+		if _, err := tx.Exec(a.queries.deleteGroupsProvisioned); err != nil {
+			return err
+		}
 		if _, err := tx.Exec(a.queries.deleteAllProvisionedTokens); err != nil {
 			return err
 		}
@@ -1917,18 +2957,64 @@ func (a *Manager) maybeProvisionGrants(tx *sql.Tx) error {
 	return nil
 }
 
+// maybeProvisionGroups removes all provisioned groups, and (re-)adds the groups, their members and
+// their grants from the config. A manually created group with the same name as a provisioned group is
+// replaced by the provisioned group.
+//
+// Like grants, groups can be just re-added, because they do not carry any state. Their members and
+// grants are removed along with them via foreign keys.
+func (a *Manager) maybeProvisionGroups(tx *sql.Tx, provisionUsernames []string) error {
+	// Remove all provisioned groups
+	if _, err := tx.Exec(a.queries.deleteGroupsProvisioned); err != nil {
+		return err
+	}
+	for groupName := range a.config.GroupAccess {
+		if _, exists := a.config.Groups[groupName]; !exists {
+			return fmt.Errorf("group %s is not a provisioned group, refusing to add ACL entry", groupName)
+		}
+	}
+	// (Re-)add provisioned groups
+	for groupName, usernames := range a.config.Groups {
+		if existing, err := a.groupTx(tx, groupName); err == nil {
+			if _, err := tx.Exec(a.queries.deleteGroup, existing.ID); err != nil {
+				return fmt.Errorf("failed to replace group %s: %v", groupName, err)
+			}
+		} else if !errors.Is(err, ErrGroupNotFound) {
+			return err
+		}
+		groupID, err := a.addGroupTx(tx, groupName, true)
+		if err != nil {
+			return fmt.Errorf("failed to add provisioned group %s: %v", groupName, err)
+		}
+		for _, username := range usernames {
+			if !slices.Contains(provisionUsernames, username) {
+				return fmt.Errorf("user %s is not a provisioned user, refusing to add to group %s", username, groupName)
+			}
+			if err := a.addGroupMemberTx(tx, groupID, username); err != nil {
+				return fmt.Errorf("failed to add user %s to provisioned group %s: %v", username, groupName, err)
+			}
+		}
+		for _, grant := range a.config.GroupAccess[groupName] {
+			if err := a.allowGroupAccessTx(tx, groupID, grant.TopicPattern, grant.Permission); err != nil {
+				return fmt.Errorf("failed to add access for group %s and topic %s: %v", groupName, grant.TopicPattern, err)
+			}
+		}
+	}
+	return nil
+}
+
 func (a *Manager) maybeProvisionTokens(tx *sql.Tx, provisionUsernames []string, existingTokens []*Token) error {
 	// Remove tokens that are provisioned, but not in the config anymore
-	var provisionTokens []string
+	var provisionTokenIDs []string
 	for _, userTokens := range a.config.Tokens {
 		for _, token := range userTokens {
-			provisionTokens = append(provisionTokens, token.Value)
+			provisionTokenIDs = append(provisionTokenIDs, hashToken(token.Value))
 		}
 	}
 	for _, existingToken := range existingTokens {
-		if !slices.Contains(provisionTokens, existingToken.Value) {
-			if _, err := tx.Exec(a.queries.deleteProvisionedToken, existingToken.Value); err != nil {
-				return fmt.Errorf("failed to remove provisioned token %s: %v", existingToken.Value, err)
+		if !slices.Contains(provisionTokenIDs, existingToken.ID) {
+			if _, err := tx.Exec(a.queries.deleteProvisionedToken, existingToken.ID); err != nil {
+				return fmt.Errorf("failed to remove provisioned token %s...: %v", existingToken.Prefix, err)
 			}
 		}
 	}
@@ -1942,7 +3028,7 @@ func (a *Manager) maybeProvisionTokens(tx *sql.Tx, provisionUsernames []string,
 			return fmt.Errorf("failed to find provisioned user %s for provisioned tokens: %v", username, err)
 		}
 		for _, token := range tokens {
-			if _, err := a.createTokenTx(tx, userID, token.Value, token.Label, time.Unix(0, 0), netip.IPv4Unspecified(), time.Unix(0, 0), 0, true); err != nil {
+			if _, err := a.createTokenTx(tx, userID, token.Value, token.Label, time.Unix(0, 0), netip.IPv4Unspecified(), time.Unix(0, 0), token.Scope, 0, true); err != nil {
 				return err
 			}
 		}
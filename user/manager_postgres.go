@@ -11,7 +11,7 @@ import (
 const (
 	// User queries
 	postgresSelectUsersQuery = `
-		SELECT u.id, u.user_name, u.pass, u.role, u.prefs, u.sync_topic, u.provisioned, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, u.deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		SELECT u.id, u.user_name, u.pass, u.role, u.prefs, u.sync_topic, u.provisioned, u.external_id, u.stats_messages, u.stats_emails, u.stats_calls, u.stats_sms, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, u.deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.sms_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
 		FROM "user" u
 		LEFT JOIN tier t on t.id = u.tier_id
 		ORDER BY
@@ -22,30 +22,36 @@ const (
 			END, u.user_name
 	`
 	postgresSelectUserByIDQuery = `
-		SELECT u.id, u.user_name, u.pass, u.role, u.prefs, u.sync_topic, u.provisioned, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, u.deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		SELECT u.id, u.user_name, u.pass, u.role, u.prefs, u.sync_topic, u.provisioned, u.external_id, u.stats_messages, u.stats_emails, u.stats_calls, u.stats_sms, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, u.deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.sms_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
 		FROM "user" u
 		LEFT JOIN tier t on t.id = u.tier_id
 		WHERE u.id = $1
 	`
 	postgresSelectUserByNameQuery = `
-		SELECT u.id, u.user_name, u.pass, u.role, u.prefs, u.sync_topic, u.provisioned, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, u.deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		SELECT u.id, u.user_name, u.pass, u.role, u.prefs, u.sync_topic, u.provisioned, u.external_id, u.stats_messages, u.stats_emails, u.stats_calls, u.stats_sms, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, u.deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.sms_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
 		FROM "user" u
 		LEFT JOIN tier t on t.id = u.tier_id
 		WHERE user_name = $1
 	`
 	postgresSelectUserByTokenQuery = `
-		SELECT u.id, u.user_name, u.pass, u.role, u.prefs, u.sync_topic, u.provisioned, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, u.deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		SELECT u.id, u.user_name, u.pass, u.role, u.prefs, u.sync_topic, u.provisioned, u.external_id, u.stats_messages, u.stats_emails, u.stats_calls, u.stats_sms, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, u.deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.sms_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
 		FROM "user" u
 		JOIN user_token tk on u.id = tk.user_id
 		LEFT JOIN tier t on t.id = u.tier_id
-		WHERE tk.token = $1 AND (tk.expires = 0 OR tk.expires >= $2)
+		WHERE tk.token_hash = $1 AND (tk.expires = 0 OR tk.expires >= $2)
 	`
 	postgresSelectUserByStripeCustomerIDQuery = `
-		SELECT u.id, u.user_name, u.pass, u.role, u.prefs, u.sync_topic, u.provisioned, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, u.deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		SELECT u.id, u.user_name, u.pass, u.role, u.prefs, u.sync_topic, u.provisioned, u.external_id, u.stats_messages, u.stats_emails, u.stats_calls, u.stats_sms, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, u.deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.sms_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
 		FROM "user" u
 		LEFT JOIN tier t on t.id = u.tier_id
 		WHERE u.stripe_customer_id = $1
 	`
+	postgresSelectUserByExternalIDQuery = `
+		SELECT u.id, u.user_name, u.pass, u.role, u.prefs, u.sync_topic, u.provisioned, u.external_id, u.stats_messages, u.stats_emails, u.stats_calls, u.stats_sms, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, u.deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.sms_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		FROM "user" u
+		LEFT JOIN tier t on t.id = u.tier_id
+		WHERE u.external_id = $1
+	`
 	postgresSelectUsernamesQuery = `
 		SELECT user_name
 		FROM "user"
@@ -62,9 +68,10 @@ const (
 	postgresUpdateUserPassQuery           = `UPDATE "user" SET pass = $1 WHERE user_name = $2`
 	postgresUpdateUserRoleQuery           = `UPDATE "user" SET role = $1 WHERE user_name = $2`
 	postgresUpdateUserProvisionedQuery    = `UPDATE "user" SET provisioned = $1 WHERE user_name = $2`
+	postgresUpdateUserExternalIDQuery     = `UPDATE "user" SET external_id = $1 WHERE user_name = $2`
 	postgresUpdateUserPrefsQuery          = `UPDATE "user" SET prefs = $1 WHERE id = $2`
-	postgresUpdateUserStatsQuery          = `UPDATE "user" SET stats_messages = $1, stats_emails = $2, stats_calls = $3 WHERE id = $4`
-	postgresUpdateUserStatsResetAllQuery  = `UPDATE "user" SET stats_messages = 0, stats_emails = 0, stats_calls = 0`
+	postgresUpdateUserStatsQuery          = `UPDATE "user" SET stats_messages = $1, stats_emails = $2, stats_calls = $3, stats_sms = $4 WHERE id = $5`
+	postgresUpdateUserStatsResetAllQuery  = `UPDATE "user" SET stats_messages = 0, stats_emails = 0, stats_calls = 0, stats_sms = 0`
 	postgresUpdateUserTierQuery           = `UPDATE "user" SET tier_id = (SELECT id FROM tier WHERE code = $1) WHERE user_name = $2`
 	postgresUpdateUserDeletedQuery        = `UPDATE "user" SET deleted = $1 WHERE id = $2`
 	postgresDeleteUserQuery               = `DELETE FROM "user" WHERE user_name = $1`
@@ -74,7 +81,7 @@ const (
 
 	// Access queries
 	postgresSelectTopicPermsQuery = `
-		SELECT read, write
+		SELECT u.user_name, read, write
 		FROM user_access a
 		JOIN "user" u ON u.id = a.user_id
 		WHERE (u.user_name = $1 OR u.user_name = $2) AND $3 LIKE a.topic ESCAPE '\'
@@ -91,7 +98,7 @@ const (
 		ORDER BY LENGTH(topic) DESC, CASE WHEN write THEN 1 ELSE 0 END DESC, CASE WHEN read THEN 1 ELSE 0 END DESC, topic
 	`
 	postgresSelectUserAccessQuery = `
-		SELECT topic, read, write, provisioned
+		SELECT topic, read, write, provisioned, managed
 		FROM user_access
 		WHERE user_id = (SELECT id FROM "user" WHERE user_name = $1)
 		ORDER BY LENGTH(topic) DESC, CASE WHEN write THEN 1 ELSE 0 END DESC, CASE WHEN read THEN 1 ELSE 0 END DESC, topic
@@ -140,7 +147,12 @@ const (
 			$7
 		)
 		ON CONFLICT (user_id, topic)
-		DO UPDATE SET read=excluded.read, write=excluded.write, owner_user_id=excluded.owner_user_id, provisioned=excluded.provisioned
+		DO UPDATE SET read=excluded.read, write=excluded.write, owner_user_id=excluded.owner_user_id, provisioned=excluded.provisioned, managed=excluded.managed
+	`
+	postgresInsertUserAccessManagedQuery = `
+		INSERT INTO user_access (user_id, topic, read, write, owner_user_id, provisioned, managed)
+		VALUES ((SELECT id FROM "user" WHERE user_name = $1), $2, $3, $4, NULL, false, true)
+		ON CONFLICT (user_id, topic) DO NOTHING
 	`
 	postgresDeleteUserAccessQuery = `
 		DELETE FROM user_access
@@ -148,6 +160,7 @@ const (
 		   OR owner_user_id = (SELECT id FROM "user" WHERE user_name = $2)
 	`
 	postgresDeleteUserAccessProvisionedQuery = `DELETE FROM user_access WHERE provisioned = true`
+	postgresDeleteUserAccessManagedQuery     = `DELETE FROM user_access WHERE user_id = (SELECT id FROM "user" WHERE user_name = $1) AND managed = true`
 	postgresDeleteTopicAccessQuery           = `
 		DELETE FROM user_access
 	   	WHERE (user_id = (SELECT id FROM "user" WHERE user_name = $1) OR owner_user_id = (SELECT id FROM "user" WHERE user_name = $2))
@@ -155,29 +168,105 @@ const (
   	`
 	postgresDeleteAllAccessQuery = `DELETE FROM user_access`
 
+	// Group queries
+	postgresSelectGroupTopicPermsQuery = `
+		SELECT g.name, a.read, a.write
+		FROM user_group_access a
+		JOIN user_group g ON g.id = a.group_id
+		JOIN user_group_member m ON m.group_id = a.group_id
+		JOIN "user" u ON u.id = m.user_id
+		WHERE u.user_name = $1 AND $2 LIKE a.topic ESCAPE '\'
+		ORDER BY g.name, LENGTH(a.topic) DESC, CASE WHEN a.write THEN 1 ELSE 0 END DESC
+	`
+	postgresSelectAccessCacheGroupAllQuery = `
+		SELECT g.name, a.topic, a.read, a.write
+		FROM user_group_access a
+		JOIN user_group g ON g.id = a.group_id
+	`
+	postgresSelectAccessCacheGroupMembersQuery = `
+		SELECT u.user_name, g.name
+		FROM user_group_member m
+		JOIN user_group g ON g.id = m.group_id
+		JOIN "user" u ON u.id = m.user_id
+	`
+	postgresSelectGroupsQuery       = `SELECT id, name, provisioned FROM user_group ORDER BY name`
+	postgresSelectGroupByNameQuery  = `SELECT id, name, provisioned FROM user_group WHERE name = $1`
+	postgresSelectGroupMembersQuery = `
+		SELECT u.user_name
+		FROM user_group_member m
+		JOIN "user" u ON u.id = m.user_id
+		WHERE m.group_id = $1
+		ORDER BY u.user_name
+	`
+	postgresSelectGroupAccessQuery = `
+		SELECT topic, read, write
+		FROM user_group_access
+		WHERE group_id = $1
+		ORDER BY LENGTH(topic) DESC, CASE WHEN write THEN 1 ELSE 0 END DESC, CASE WHEN read THEN 1 ELSE 0 END DESC, topic
+	`
+	postgresSelectUserGroupsQuery = `
+		SELECT g.name
+		FROM user_group g
+		JOIN user_group_member m ON m.group_id = g.id
+		JOIN "user" u ON u.id = m.user_id
+		WHERE u.user_name = $1
+		ORDER BY g.name
+	`
+	postgresInsertGroupQuery             = `INSERT INTO user_group (id, name, provisioned) VALUES ($1, $2, $3)`
+	postgresDeleteGroupQuery             = `DELETE FROM user_group WHERE id = $1`
+	postgresDeleteGroupsProvisionedQuery = `DELETE FROM user_group WHERE provisioned = true`
+	postgresInsertGroupMemberQuery       = `INSERT INTO user_group_member (group_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+	postgresDeleteGroupMemberQuery       = `DELETE FROM user_group_member WHERE group_id = $1 AND user_id = $2`
+	postgresUpsertGroupAccessQuery       = `
+		INSERT INTO user_group_access (group_id, topic, read, write)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (group_id, topic)
+		DO UPDATE SET read=excluded.read, write=excluded.write
+	`
+	postgresDeleteGroupAccessQuery    = `DELETE FROM user_group_access WHERE group_id = $1 AND topic = $2`
+	postgresDeleteAllGroupAccessQuery = `DELETE FROM user_group_access WHERE group_id = $1`
+
+	// Audit log queries
+	postgresInsertAuditEntryQuery = `
+		INSERT INTO user_audit (time, actor, ip, action, target, value_before, value_after)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+	postgresSelectAuditEntriesQuery = `
+		SELECT id, time, actor, ip, action, target, value_before, value_after
+		FROM user_audit
+		WHERE ($1 = '' OR actor = $2)
+		  AND ($3 = '' OR action = $4)
+		  AND ($5 = '' OR target = $6)
+		  AND time >= $7
+		  AND time <= $8
+		ORDER BY id DESC
+		LIMIT $9
+	`
+	postgresDeleteAuditEntriesQuery = `DELETE FROM user_audit WHERE time < $1`
+
 	// Token queries
-	postgresSelectTokenQuery                = `SELECT token, label, last_access, last_origin, expires, provisioned FROM user_token WHERE user_id = $1 AND token = $2`
-	postgresSelectTokensQuery               = `SELECT token, label, last_access, last_origin, expires, provisioned FROM user_token WHERE user_id = $1`
+	postgresSelectTokenQuery                = `SELECT token_hash, token_prefix, label, last_access, last_origin, expires, provisioned, scope FROM user_token WHERE user_id = $1 AND token_hash = $2`
+	postgresSelectTokensQuery               = `SELECT token_hash, token_prefix, label, last_access, last_origin, expires, provisioned, scope FROM user_token WHERE user_id = $1`
 	postgresSelectTokenCountQuery           = `SELECT COUNT(*) FROM user_token WHERE user_id = $1`
-	postgresSelectAllProvisionedTokensQuery = `SELECT token, label, last_access, last_origin, expires, provisioned FROM user_token WHERE provisioned = true`
+	postgresSelectAllProvisionedTokensQuery = `SELECT token_hash, token_prefix, label, last_access, last_origin, expires, provisioned, scope FROM user_token WHERE provisioned = true`
 	postgresUpsertTokenQuery                = `
-		INSERT INTO user_token (user_id, token, label, last_access, last_origin, expires, provisioned)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
-		ON CONFLICT (user_id, token)
-		DO UPDATE SET label = excluded.label, expires = excluded.expires, provisioned = excluded.provisioned
+		INSERT INTO user_token (user_id, token_hash, token_prefix, label, last_access, last_origin, expires, provisioned, scope)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (user_id, token_hash)
+		DO UPDATE SET label = excluded.label, expires = excluded.expires, provisioned = excluded.provisioned, scope = excluded.scope
 	`
-	postgresUpdateTokenQuery                = `UPDATE user_token SET label = $1, expires = $2 WHERE user_id = $3 AND token = $4`
-	postgresUpdateTokenLastAccessQuery      = `UPDATE user_token SET last_access = $1, last_origin = $2 WHERE token = $3`
-	postgresDeleteTokenQuery                = `DELETE FROM user_token WHERE user_id = $1 AND token = $2`
-	postgresDeleteProvisionedTokenQuery     = `DELETE FROM user_token WHERE token = $1`
+	postgresUpdateTokenQuery                = `UPDATE user_token SET label = $1, expires = $2 WHERE user_id = $3 AND token_hash = $4`
+	postgresUpdateTokenLastAccessQuery      = `UPDATE user_token SET last_access = $1, last_origin = $2 WHERE token_hash = $3`
+	postgresDeleteTokenQuery                = `DELETE FROM user_token WHERE user_id = $1 AND token_hash = $2`
+	postgresDeleteProvisionedTokenQuery     = `DELETE FROM user_token WHERE token_hash = $1`
 	postgresDeleteAllProvisionedTokensQuery = `DELETE FROM user_token WHERE provisioned = true`
 	postgresDeleteAllTokenQuery             = `DELETE FROM user_token WHERE user_id = $1`
 	postgresDeleteExpiredTokensQuery        = `DELETE FROM user_token WHERE expires > 0 AND expires < $1`
 	postgresDeleteExcessTokensQuery         = `
 		DELETE FROM user_token
 		WHERE user_id = $1
-		  AND (user_id, token) NOT IN (
-			SELECT user_id, token
+		  AND (user_id, token_hash) NOT IN (
+			SELECT user_id, token_hash
 			FROM user_token
 			WHERE user_id = $2
 			ORDER BY expires DESC
@@ -187,25 +276,25 @@ const (
 
 	// Tier queries
 	postgresInsertTierQuery = `
-		INSERT INTO tier (id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		INSERT INTO tier (id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, sms_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
 	`
 	postgresUpdateTierQuery = `
 		UPDATE tier
-		SET name = $1, messages_limit = $2, messages_expiry_duration = $3, emails_limit = $4, calls_limit = $5, reservations_limit = $6, attachment_file_size_limit = $7, attachment_total_size_limit = $8, attachment_expiry_duration = $9, attachment_bandwidth_limit = $10, stripe_monthly_price_id = $11, stripe_yearly_price_id = $12
-		WHERE code = $13
+		SET name = $1, messages_limit = $2, messages_expiry_duration = $3, emails_limit = $4, calls_limit = $5, sms_limit = $6, reservations_limit = $7, attachment_file_size_limit = $8, attachment_total_size_limit = $9, attachment_expiry_duration = $10, attachment_bandwidth_limit = $11, stripe_monthly_price_id = $12, stripe_yearly_price_id = $13
+		WHERE code = $14
 	`
 	postgresSelectTiersQuery = `
-		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id
+		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, sms_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id
 		FROM tier
 	`
 	postgresSelectTierByCodeQuery = `
-		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id
+		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, sms_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id
 		FROM tier
 		WHERE code = $1
 	`
 	postgresSelectTierByPriceIDQuery = `
-		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id
+		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, sms_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id
 		FROM tier
 		WHERE (stripe_monthly_price_id = $1 OR stripe_yearly_price_id = $2)
 	`
@@ -235,6 +324,39 @@ const (
 	postgresSelectPendingEmailsQuery     = `SELECT email FROM user_magic_link WHERE kind = $1 AND user_id = $2 ORDER BY email`
 	postgresDeleteExpiredMagicLinksQuery = `DELETE FROM user_magic_link WHERE expires < $1`
 
+	// Cursor queries
+	postgresSelectCursorsQuery     = `SELECT name, topics, last_delivered, last_acked, updated FROM user_cursor WHERE user_id = $1 ORDER BY name`
+	postgresSelectCursorQuery      = `SELECT name, topics, last_delivered, last_acked, updated FROM user_cursor WHERE user_id = $1 AND name = $2`
+	postgresSelectCursorCountQuery = `SELECT COUNT(*) FROM user_cursor WHERE user_id = $1`
+	postgresUpsertCursorQuery      = `
+		INSERT INTO user_cursor (user_id, name, topics, last_delivered, last_acked, updated)
+		VALUES ($1, $2, $3, '', '', $4)
+		ON CONFLICT (user_id, name)
+		DO UPDATE SET topics = excluded.topics, updated = excluded.updated
+	`
+	postgresUpdateCursorDeliveredQuery = `UPDATE user_cursor SET last_delivered = $1, updated = $2 WHERE user_id = $3 AND name = $4`
+	postgresUpdateCursorAckedQuery     = `UPDATE user_cursor SET last_acked = $1, updated = $2 WHERE user_id = $3 AND name = $4`
+	postgresDeleteCursorQuery          = `DELETE FROM user_cursor WHERE user_id = $1 AND name = $2`
+
+	// TOTP queries
+	postgresSelectTOTPQuery = `
+		SELECT t.secret, t.enabled, t.last_counter, t.created, (SELECT COUNT(*) FROM user_totp_recovery_code WHERE user_id = t.user_id)
+		FROM user_totp t
+		WHERE t.user_id = $1
+	`
+	postgresUpsertTOTPQuery = `
+		INSERT INTO user_totp (user_id, secret, enabled, last_counter, created)
+		VALUES ($1, $2, FALSE, 0, $3)
+		ON CONFLICT (user_id)
+		DO UPDATE SET secret = excluded.secret, enabled = FALSE, last_counter = 0, created = excluded.created
+	`
+	postgresUpdateTOTPEnabledQuery          = `UPDATE user_totp SET enabled = TRUE, last_counter = $1 WHERE user_id = $2 AND NOT enabled`
+	postgresUpdateTOTPLastCounterQuery      = `UPDATE user_totp SET last_counter = $1 WHERE user_id = $2 AND enabled AND last_counter < $3`
+	postgresDeleteTOTPQuery                 = `DELETE FROM user_totp WHERE user_id = $1`
+	postgresInsertTOTPRecoveryCodeQuery     = `INSERT INTO user_totp_recovery_code (user_id, code_hash) VALUES ($1, $2)`
+	postgresDeleteTOTPRecoveryCodeQuery     = `DELETE FROM user_totp_recovery_code WHERE user_id = $1 AND code_hash = $2`
+	postgresDeleteAllTOTPRecoveryCodesQuery = `DELETE FROM user_totp_recovery_code WHERE user_id = $1`
+
 	// Billing queries
 	postgresUpdateBillingQuery = `
 		UPDATE "user"
@@ -264,6 +386,7 @@ var postgresQueries = queries{
 	selectUserByName:             postgresSelectUserByNameQuery,
 	selectUserByToken:            postgresSelectUserByTokenQuery,
 	selectUserByStripeCustomerID: postgresSelectUserByStripeCustomerIDQuery,
+	selectUserByExternalID:       postgresSelectUserByExternalIDQuery,
 	selectUsernames:              postgresSelectUsernamesQuery,
 	selectUsers:                  postgresSelectUsersQuery,
 	selectUserCount:              postgresSelectUserCountQuery,
@@ -272,6 +395,7 @@ var postgresQueries = queries{
 	updateUserPass:               postgresUpdateUserPassQuery,
 	updateUserRole:               postgresUpdateUserRoleQuery,
 	updateUserProvisioned:        postgresUpdateUserProvisionedQuery,
+	updateUserExternalID:         postgresUpdateUserExternalIDQuery,
 	updateUserPrefs:              postgresUpdateUserPrefsQuery,
 	updateUserStats:              postgresUpdateUserStatsQuery,
 	updateUserStatsResetAll:      postgresUpdateUserStatsResetAllQuery,
@@ -294,8 +418,29 @@ var postgresQueries = queries{
 	upsertUserAccess:             postgresUpsertUserAccessQuery,
 	deleteUserAccess:             postgresDeleteUserAccessQuery,
 	deleteUserAccessProvisioned:  postgresDeleteUserAccessProvisionedQuery,
+	insertUserAccessManaged:      postgresInsertUserAccessManagedQuery,
+	deleteUserAccessManaged:      postgresDeleteUserAccessManagedQuery,
 	deleteTopicAccess:            postgresDeleteTopicAccessQuery,
 	deleteAllAccess:              postgresDeleteAllAccessQuery,
+	selectGroupTopicPerms:        postgresSelectGroupTopicPermsQuery,
+	selectAccessCacheGroupAll:    postgresSelectAccessCacheGroupAllQuery,
+	selectAccessCacheGroupMember: postgresSelectAccessCacheGroupMembersQuery,
+	selectGroups:                 postgresSelectGroupsQuery,
+	selectGroupByName:            postgresSelectGroupByNameQuery,
+	selectGroupMembers:           postgresSelectGroupMembersQuery,
+	selectGroupAccess:            postgresSelectGroupAccessQuery,
+	selectUserGroups:             postgresSelectUserGroupsQuery,
+	insertGroup:                  postgresInsertGroupQuery,
+	deleteGroup:                  postgresDeleteGroupQuery,
+	deleteGroupsProvisioned:      postgresDeleteGroupsProvisionedQuery,
+	insertGroupMember:            postgresInsertGroupMemberQuery,
+	deleteGroupMember:            postgresDeleteGroupMemberQuery,
+	upsertGroupAccess:            postgresUpsertGroupAccessQuery,
+	deleteGroupAccess:            postgresDeleteGroupAccessQuery,
+	deleteAllGroupAccess:         postgresDeleteAllGroupAccessQuery,
+	insertAuditEntry:             postgresInsertAuditEntryQuery,
+	selectAuditEntries:           postgresSelectAuditEntriesQuery,
+	deleteAuditEntries:           postgresDeleteAuditEntriesQuery,
 	selectToken:                  postgresSelectTokenQuery,
 	selectTokens:                 postgresSelectTokensQuery,
 	selectTokenCount:             postgresSelectTokenCountQuery,
@@ -333,6 +478,21 @@ var postgresQueries = queries{
 	deleteMagicLinkResetPassword: postgresDeleteResetScopeQuery,
 	selectPendingEmails:          postgresSelectPendingEmailsQuery,
 	deleteExpiredMagicLinks:      postgresDeleteExpiredMagicLinksQuery,
+	selectCursors:                postgresSelectCursorsQuery,
+	selectCursor:                 postgresSelectCursorQuery,
+	selectCursorCount:            postgresSelectCursorCountQuery,
+	upsertCursor:                 postgresUpsertCursorQuery,
+	updateCursorDelivered:        postgresUpdateCursorDeliveredQuery,
+	updateCursorAcked:            postgresUpdateCursorAckedQuery,
+	deleteCursor:                 postgresDeleteCursorQuery,
+	selectTOTP:                   postgresSelectTOTPQuery,
+	upsertTOTP:                   postgresUpsertTOTPQuery,
+	updateTOTPEnabled:            postgresUpdateTOTPEnabledQuery,
+	updateTOTPLastCounter:        postgresUpdateTOTPLastCounterQuery,
+	deleteTOTP:                   postgresDeleteTOTPQuery,
+	insertTOTPRecoveryCode:       postgresInsertTOTPRecoveryCodeQuery,
+	deleteTOTPRecoveryCode:       postgresDeleteTOTPRecoveryCodeQuery,
+	deleteAllTOTPRecoveryCodes:   postgresDeleteAllTOTPRecoveryCodesQuery,
 	updateBilling:                postgresUpdateBillingQuery,
 }
 
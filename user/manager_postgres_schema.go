@@ -16,6 +16,7 @@ const (
 			messages_expiry_duration BIGINT NOT NULL,
 			emails_limit BIGINT NOT NULL,
 			calls_limit BIGINT NOT NULL,
+			sms_limit BIGINT NOT NULL DEFAULT 0,
 			reservations_limit BIGINT NOT NULL,
 			attachment_file_size_limit BIGINT NOT NULL,
 			attachment_total_size_limit BIGINT NOT NULL,
@@ -36,9 +37,11 @@ const (
 			prefs JSONB NOT NULL DEFAULT '{}',
 			sync_topic TEXT NOT NULL,
 			provisioned BOOLEAN NOT NULL,
+			external_id TEXT UNIQUE,
 			stats_messages BIGINT NOT NULL DEFAULT 0,
 			stats_emails BIGINT NOT NULL DEFAULT 0,
 			stats_calls BIGINT NOT NULL DEFAULT 0,
+			stats_sms BIGINT NOT NULL DEFAULT 0,
 			stripe_customer_id TEXT UNIQUE,
 			stripe_subscription_id TEXT UNIQUE,
 			stripe_subscription_status TEXT,
@@ -55,17 +58,20 @@ const (
 			write BOOLEAN NOT NULL,
 			owner_user_id TEXT REFERENCES "user"(id) ON DELETE CASCADE,
 			provisioned BOOLEAN NOT NULL,
+			managed BOOLEAN NOT NULL DEFAULT false,
 			PRIMARY KEY (user_id, topic)
 		);
 		CREATE TABLE IF NOT EXISTS user_token (
 			user_id TEXT NOT NULL REFERENCES "user"(id) ON DELETE CASCADE,
-			token TEXT NOT NULL UNIQUE,
+			token_hash TEXT NOT NULL UNIQUE,
+			token_prefix TEXT NOT NULL,
 			label TEXT NOT NULL,
 			last_access BIGINT NOT NULL,
 			last_origin TEXT NOT NULL,
 			expires BIGINT NOT NULL,
 			provisioned BOOLEAN NOT NULL,
-			PRIMARY KEY (user_id, token)
+			scope JSONB,
+			PRIMARY KEY (user_id, token_hash)
 		);
 		CREATE TABLE IF NOT EXISTS user_phone (
 			user_id TEXT NOT NULL REFERENCES "user"(id) ON DELETE CASCADE,
@@ -90,6 +96,58 @@ const (
 			PRIMARY KEY (token_hash)
 		);
 		CREATE INDEX idx_magic_link_user_kind ON user_magic_link (user_id, kind);
+		CREATE TABLE IF NOT EXISTS user_cursor (
+			user_id TEXT NOT NULL REFERENCES "user"(id) ON DELETE CASCADE,
+			name TEXT NOT NULL,
+			topics TEXT NOT NULL,
+			last_delivered TEXT NOT NULL,
+			last_acked TEXT NOT NULL,
+			updated BIGINT NOT NULL,
+			PRIMARY KEY (user_id, name)
+		);
+		CREATE TABLE IF NOT EXISTS user_totp (
+			user_id TEXT NOT NULL REFERENCES "user"(id) ON DELETE CASCADE,
+			secret TEXT NOT NULL,
+			enabled BOOLEAN NOT NULL,
+			last_counter BIGINT NOT NULL DEFAULT 0,
+			created BIGINT NOT NULL,
+			PRIMARY KEY (user_id)
+		);
+		CREATE TABLE IF NOT EXISTS user_totp_recovery_code (
+			user_id TEXT NOT NULL REFERENCES "user"(id) ON DELETE CASCADE,
+			code_hash TEXT NOT NULL,
+			PRIMARY KEY (user_id, code_hash)
+		);
+		CREATE TABLE IF NOT EXISTS user_group (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL UNIQUE,
+			provisioned BOOLEAN NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS user_group_member (
+			group_id TEXT NOT NULL REFERENCES user_group(id) ON DELETE CASCADE,
+			user_id TEXT NOT NULL REFERENCES "user"(id) ON DELETE CASCADE,
+			PRIMARY KEY (group_id, user_id)
+		);
+		CREATE INDEX IF NOT EXISTS idx_user_group_member_user_id ON user_group_member (user_id);
+		CREATE TABLE IF NOT EXISTS user_group_access (
+			group_id TEXT NOT NULL REFERENCES user_group(id) ON DELETE CASCADE,
+			topic TEXT NOT NULL,
+			read BOOLEAN NOT NULL,
+			write BOOLEAN NOT NULL,
+			PRIMARY KEY (group_id, topic)
+		);
+		CREATE TABLE IF NOT EXISTS user_audit (
+			id BIGSERIAL PRIMARY KEY,
+			time BIGINT NOT NULL,
+			actor TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			action TEXT NOT NULL,
+			target TEXT NOT NULL,
+			value_before TEXT NOT NULL,
+			value_after TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_user_audit_time ON user_audit (time);
+		CREATE INDEX IF NOT EXISTS idx_user_audit_target ON user_audit (target);
 		CREATE TABLE IF NOT EXISTS schema_version (
 			store TEXT PRIMARY KEY,
 			version INT NOT NULL
@@ -102,7 +160,7 @@ const (
 
 // Schema table management queries for Postgres
 const (
-	postgresCurrentSchemaVersion     = 8
+	postgresCurrentSchemaVersion     = 16
 	postgresSelectSchemaVersionQuery = `SELECT version FROM schema_version WHERE store = 'user'`
 	postgresInsertSchemaVersionQuery = `INSERT INTO schema_version (store, version) VALUES ('user', $1)`
 )
@@ -133,12 +191,112 @@ const (
 		);
 		CREATE INDEX idx_magic_link_user_kind ON user_magic_link (user_id, kind);
 	`
+
+	// 8 -> 9: durable subscription cursors
+	postgresMigrate8To9UpdateQueries = `
+		CREATE TABLE IF NOT EXISTS user_cursor (
+			user_id TEXT NOT NULL REFERENCES "user"(id) ON DELETE CASCADE,
+			name TEXT NOT NULL,
+			topics TEXT NOT NULL,
+			last_delivered TEXT NOT NULL,
+			last_acked TEXT NOT NULL,
+			updated BIGINT NOT NULL,
+			PRIMARY KEY (user_id, name)
+		);
+	`
+
+	// 9 -> 10: TOTP two-factor authentication
+	postgresMigrate9To10UpdateQueries = `
+		CREATE TABLE IF NOT EXISTS user_totp (
+			user_id TEXT NOT NULL REFERENCES "user"(id) ON DELETE CASCADE,
+			secret TEXT NOT NULL,
+			enabled BOOLEAN NOT NULL,
+			last_counter BIGINT NOT NULL DEFAULT 0,
+			created BIGINT NOT NULL,
+			PRIMARY KEY (user_id)
+		);
+		CREATE TABLE IF NOT EXISTS user_totp_recovery_code (
+			user_id TEXT NOT NULL REFERENCES "user"(id) ON DELETE CASCADE,
+			code_hash TEXT NOT NULL,
+			PRIMARY KEY (user_id, code_hash)
+		);
+	`
+
+	// 10 -> 11: scoped access tokens
+	postgresMigrate10To11UpdateQueries = `
+		ALTER TABLE user_token ADD COLUMN IF NOT EXISTS scope JSONB;
+	`
+
+	// 11 -> 12: user groups
+	postgresMigrate11To12UpdateQueries = `
+		CREATE TABLE IF NOT EXISTS user_group (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL UNIQUE,
+			provisioned BOOLEAN NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS user_group_member (
+			group_id TEXT NOT NULL REFERENCES user_group(id) ON DELETE CASCADE,
+			user_id TEXT NOT NULL REFERENCES "user"(id) ON DELETE CASCADE,
+			PRIMARY KEY (group_id, user_id)
+		);
+		CREATE INDEX IF NOT EXISTS idx_user_group_member_user_id ON user_group_member (user_id);
+		CREATE TABLE IF NOT EXISTS user_group_access (
+			group_id TEXT NOT NULL REFERENCES user_group(id) ON DELETE CASCADE,
+			topic TEXT NOT NULL,
+			read BOOLEAN NOT NULL,
+			write BOOLEAN NOT NULL,
+			PRIMARY KEY (group_id, topic)
+		);
+	`
+
+	// 12 -> 13: audit log
+	postgresMigrate12To13UpdateQueries = `
+		CREATE TABLE IF NOT EXISTS user_audit (
+			id BIGSERIAL PRIMARY KEY,
+			time BIGINT NOT NULL,
+			actor TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			action TEXT NOT NULL,
+			target TEXT NOT NULL,
+			value_before TEXT NOT NULL,
+			value_after TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_user_audit_time ON user_audit (time);
+		CREATE INDEX IF NOT EXISTS idx_user_audit_target ON user_audit (target);
+	`
+
+	// 13 -> 14: hashed access tokens
+	postgresMigrate13To14UpdateQueries = `
+		ALTER TABLE user_token RENAME COLUMN token TO token_hash;
+		ALTER TABLE user_token ADD COLUMN IF NOT EXISTS token_prefix TEXT NOT NULL DEFAULT '';
+		UPDATE user_token SET token_hash = encode(sha256(convert_to(token_hash, 'UTF8')), 'hex'), token_prefix = left(token_hash, 8);
+	`
+
+	// 14 -> 15: SMS limit and stats
+	postgresMigrate14To15UpdateQueries = `
+		ALTER TABLE tier ADD COLUMN IF NOT EXISTS sms_limit BIGINT NOT NULL DEFAULT 0;
+		ALTER TABLE "user" ADD COLUMN IF NOT EXISTS stats_sms BIGINT NOT NULL DEFAULT 0;
+	`
+
+	// 15 -> 16: external identities (OIDC, LDAP) and grants managed by them
+	postgresMigrate15To16UpdateQueries = `
+		ALTER TABLE "user" ADD COLUMN IF NOT EXISTS external_id TEXT UNIQUE;
+		ALTER TABLE user_access ADD COLUMN IF NOT EXISTS managed BOOLEAN NOT NULL DEFAULT false;
+	`
 	postgresUpdateSchemaVersionQuery = `UPDATE schema_version SET version = $1 WHERE store = 'user'`
 )
 
 var postgresMigrations = map[int]func(db *sql.DB) error{
-	6: postgresMigrateFrom6,
-	7: postgresMigrateFrom7,
+	6:  postgresMigrateFrom6,
+	7:  postgresMigrateFrom7,
+	8:  postgresMigrateFrom8,
+	9:  postgresMigrateFrom9,
+	10: postgresMigrateFrom10,
+	11: postgresMigrateFrom11,
+	12: postgresMigrateFrom12,
+	13: postgresMigrateFrom13,
+	14: postgresMigrateFrom14,
+	15: postgresMigrateFrom15,
 }
 
 func setupPostgres(db *sql.DB) error {
@@ -183,6 +341,86 @@ func postgresMigrateFrom7(db *sql.DB) error {
 	return nil
 }
 
+func postgresMigrateFrom8(db *sql.DB) error {
+	if _, err := db.Exec(postgresMigrate8To9UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := db.Exec(postgresUpdateSchemaVersionQuery, 9); err != nil {
+		return err
+	}
+	return nil
+}
+
+func postgresMigrateFrom9(db *sql.DB) error {
+	if _, err := db.Exec(postgresMigrate9To10UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := db.Exec(postgresUpdateSchemaVersionQuery, 10); err != nil {
+		return err
+	}
+	return nil
+}
+
+func postgresMigrateFrom10(db *sql.DB) error {
+	if _, err := db.Exec(postgresMigrate10To11UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := db.Exec(postgresUpdateSchemaVersionQuery, 11); err != nil {
+		return err
+	}
+	return nil
+}
+
+func postgresMigrateFrom11(db *sql.DB) error {
+	if _, err := db.Exec(postgresMigrate11To12UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := db.Exec(postgresUpdateSchemaVersionQuery, 12); err != nil {
+		return err
+	}
+	return nil
+}
+
+func postgresMigrateFrom12(db *sql.DB) error {
+	if _, err := db.Exec(postgresMigrate12To13UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := db.Exec(postgresUpdateSchemaVersionQuery, 13); err != nil {
+		return err
+	}
+	return nil
+}
+
+func postgresMigrateFrom13(db *sql.DB) error {
+	if _, err := db.Exec(postgresMigrate13To14UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := db.Exec(postgresUpdateSchemaVersionQuery, 14); err != nil {
+		return err
+	}
+	return nil
+}
+
+func postgresMigrateFrom14(db *sql.DB) error {
+	if _, err := db.Exec(postgresMigrate14To15UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := db.Exec(postgresUpdateSchemaVersionQuery, 15); err != nil {
+		return err
+	}
+	return nil
+}
+
+func postgresMigrateFrom15(db *sql.DB) error {
+	if _, err := db.Exec(postgresMigrate15To16UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := db.Exec(postgresUpdateSchemaVersionQuery, 16); err != nil {
+		return err
+	}
+	return nil
+}
+
 func setupNewPostgres(db *sql.DB) error {
 	if _, err := db.Exec(postgresCreateTablesQueries); err != nil {
 		return err
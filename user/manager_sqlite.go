@@ -15,7 +15,7 @@ import (
 const (
 	// User queries
 	sqliteSelectUsersQuery = `
-		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.provisioned, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.provisioned, u.external_id, u.stats_messages, u.stats_emails, u.stats_calls, u.stats_sms, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.sms_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
 		FROM user u
 		LEFT JOIN tier t on t.id = u.tier_id
 		ORDER BY
@@ -26,30 +26,36 @@ const (
 			END, u.user
 	`
 	sqliteSelectUserByIDQuery = `
-		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.provisioned, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.provisioned, u.external_id, u.stats_messages, u.stats_emails, u.stats_calls, u.stats_sms, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.sms_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
 		FROM user u
 		LEFT JOIN tier t on t.id = u.tier_id
 		WHERE u.id = ?
 	`
 	sqliteSelectUserByNameQuery = `
-		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.provisioned, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.provisioned, u.external_id, u.stats_messages, u.stats_emails, u.stats_calls, u.stats_sms, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.sms_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
 		FROM user u
 		LEFT JOIN tier t on t.id = u.tier_id
 		WHERE user = ?
 	`
 	sqliteSelectUserByTokenQuery = `
-		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.provisioned, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.provisioned, u.external_id, u.stats_messages, u.stats_emails, u.stats_calls, u.stats_sms, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.sms_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
 		FROM user u
 		JOIN user_token tk on u.id = tk.user_id
 		LEFT JOIN tier t on t.id = u.tier_id
-		WHERE tk.token = ? AND (tk.expires = 0 OR tk.expires >= ?)
+		WHERE tk.token_hash = ? AND (tk.expires = 0 OR tk.expires >= ?)
 	`
 	sqliteSelectUserByStripeCustomerIDQuery = `
-		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.provisioned, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.provisioned, u.external_id, u.stats_messages, u.stats_emails, u.stats_calls, u.stats_sms, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.sms_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
 		FROM user u
 		LEFT JOIN tier t on t.id = u.tier_id
 		WHERE u.stripe_customer_id = ?
 	`
+	sqliteSelectUserByExternalIDQuery = `
+		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.provisioned, u.external_id, u.stats_messages, u.stats_emails, u.stats_calls, u.stats_sms, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.sms_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		FROM user u
+		LEFT JOIN tier t on t.id = u.tier_id
+		WHERE u.external_id = ?
+	`
 	sqliteSelectUsernamesQuery = `
 		SELECT user
 		FROM user
@@ -66,9 +72,10 @@ const (
 	sqliteUpdateUserPassQuery           = `UPDATE user SET pass = ? WHERE user = ?`
 	sqliteUpdateUserRoleQuery           = `UPDATE user SET role = ? WHERE user = ?`
 	sqliteUpdateUserProvisionedQuery    = `UPDATE user SET provisioned = ? WHERE user = ?`
+	sqliteUpdateUserExternalIDQuery     = `UPDATE user SET external_id = ? WHERE user = ?`
 	sqliteUpdateUserPrefsQuery          = `UPDATE user SET prefs = ? WHERE id = ?`
-	sqliteUpdateUserStatsQuery          = `UPDATE user SET stats_messages = ?, stats_emails = ?, stats_calls = ? WHERE id = ?`
-	sqliteUpdateUserStatsResetAllQuery  = `UPDATE user SET stats_messages = 0, stats_emails = 0, stats_calls = 0`
+	sqliteUpdateUserStatsQuery          = `UPDATE user SET stats_messages = ?, stats_emails = ?, stats_calls = ?, stats_sms = ? WHERE id = ?`
+	sqliteUpdateUserStatsResetAllQuery  = `UPDATE user SET stats_messages = 0, stats_emails = 0, stats_calls = 0, stats_sms = 0`
 	sqliteUpdateUserTierQuery           = `UPDATE user SET tier_id = (SELECT id FROM tier WHERE code = ?) WHERE user = ?`
 	sqliteUpdateUserDeletedQuery        = `UPDATE user SET deleted = ? WHERE id = ?`
 	sqliteDeleteUserQuery               = `DELETE FROM user WHERE user = ?`
@@ -78,7 +85,7 @@ const (
 
 	// Access queries
 	sqliteSelectTopicPermsQuery = `
-		SELECT read, write
+		SELECT u.user, read, write
 		FROM user_access a
 		JOIN user u ON u.id = a.user_id
 		WHERE (u.user = ? OR u.user = ?) AND ? LIKE a.topic ESCAPE '\'
@@ -95,7 +102,7 @@ const (
 		ORDER BY LENGTH(topic) DESC, write DESC, read DESC, topic
 	`
 	sqliteSelectUserAccessQuery = `
-		SELECT topic, read, write, provisioned
+		SELECT topic, read, write, provisioned, managed
 		FROM user_access
 		WHERE user_id = (SELECT id FROM user WHERE user = ?)
 		ORDER BY LENGTH(topic) DESC, write DESC, read DESC, topic
@@ -137,7 +144,12 @@ const (
 		INSERT INTO user_access (user_id, topic, read, write, owner_user_id, provisioned)
 		VALUES ((SELECT id FROM user WHERE user = ?), ?, ?, ?, (SELECT IIF(?='',NULL,(SELECT id FROM user WHERE user=?))), ?)
 		ON CONFLICT (user_id, topic)
-		DO UPDATE SET read=excluded.read, write=excluded.write, owner_user_id=excluded.owner_user_id, provisioned=excluded.provisioned
+		DO UPDATE SET read=excluded.read, write=excluded.write, owner_user_id=excluded.owner_user_id, provisioned=excluded.provisioned, managed=excluded.managed
+	`
+	sqliteInsertUserAccessManagedQuery = `
+		INSERT INTO user_access (user_id, topic, read, write, owner_user_id, provisioned, managed)
+		VALUES ((SELECT id FROM user WHERE user = ?), ?, ?, ?, NULL, 0, 1)
+		ON CONFLICT (user_id, topic) DO NOTHING
 	`
 	sqliteDeleteUserAccessQuery = `
 		DELETE FROM user_access
@@ -145,6 +157,7 @@ const (
 		   OR owner_user_id = (SELECT id FROM user WHERE user = ?)
 	`
 	sqliteDeleteUserAccessProvisionedQuery = `DELETE FROM user_access WHERE provisioned = 1`
+	sqliteDeleteUserAccessManagedQuery     = `DELETE FROM user_access WHERE user_id = (SELECT id FROM user WHERE user = ?) AND managed = 1`
 	sqliteDeleteTopicAccessQuery           = `
 		DELETE FROM user_access
 	   	WHERE (user_id = (SELECT id FROM user WHERE user = ?) OR owner_user_id = (SELECT id FROM user WHERE user = ?))
@@ -152,29 +165,105 @@ const (
   	`
 	sqliteDeleteAllAccessQuery = `DELETE FROM user_access`
 
+	// Group queries
+	sqliteSelectGroupTopicPermsQuery = `
+		SELECT g.name, a.read, a.write
+		FROM user_group_access a
+		JOIN user_group g ON g.id = a.group_id
+		JOIN user_group_member m ON m.group_id = a.group_id
+		JOIN user u ON u.id = m.user_id
+		WHERE u.user = ? AND ? LIKE a.topic ESCAPE '\'
+		ORDER BY g.name, LENGTH(a.topic) DESC, a.write DESC
+	`
+	sqliteSelectAccessCacheGroupAllQuery = `
+		SELECT g.name, a.topic, a.read, a.write
+		FROM user_group_access a
+		JOIN user_group g ON g.id = a.group_id
+	`
+	sqliteSelectAccessCacheGroupMembersQuery = `
+		SELECT u.user, g.name
+		FROM user_group_member m
+		JOIN user_group g ON g.id = m.group_id
+		JOIN user u ON u.id = m.user_id
+	`
+	sqliteSelectGroupsQuery       = `SELECT id, name, provisioned FROM user_group ORDER BY name`
+	sqliteSelectGroupByNameQuery  = `SELECT id, name, provisioned FROM user_group WHERE name = ?`
+	sqliteSelectGroupMembersQuery = `
+		SELECT u.user
+		FROM user_group_member m
+		JOIN user u ON u.id = m.user_id
+		WHERE m.group_id = ?
+		ORDER BY u.user
+	`
+	sqliteSelectGroupAccessQuery = `
+		SELECT topic, read, write
+		FROM user_group_access
+		WHERE group_id = ?
+		ORDER BY LENGTH(topic) DESC, write DESC, read DESC, topic
+	`
+	sqliteSelectUserGroupsQuery = `
+		SELECT g.name
+		FROM user_group g
+		JOIN user_group_member m ON m.group_id = g.id
+		JOIN user u ON u.id = m.user_id
+		WHERE u.user = ?
+		ORDER BY g.name
+	`
+	sqliteInsertGroupQuery             = `INSERT INTO user_group (id, name, provisioned) VALUES (?, ?, ?)`
+	sqliteDeleteGroupQuery             = `DELETE FROM user_group WHERE id = ?`
+	sqliteDeleteGroupsProvisionedQuery = `DELETE FROM user_group WHERE provisioned = 1`
+	sqliteInsertGroupMemberQuery       = `INSERT INTO user_group_member (group_id, user_id) VALUES (?, ?) ON CONFLICT DO NOTHING`
+	sqliteDeleteGroupMemberQuery       = `DELETE FROM user_group_member WHERE group_id = ? AND user_id = ?`
+	sqliteUpsertGroupAccessQuery       = `
+		INSERT INTO user_group_access (group_id, topic, read, write)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (group_id, topic)
+		DO UPDATE SET read=excluded.read, write=excluded.write
+	`
+	sqliteDeleteGroupAccessQuery    = `DELETE FROM user_group_access WHERE group_id = ? AND topic = ?`
+	sqliteDeleteAllGroupAccessQuery = `DELETE FROM user_group_access WHERE group_id = ?`
+
+	// Audit log queries
+	sqliteInsertAuditEntryQuery = `
+		INSERT INTO user_audit (time, actor, ip, action, target, value_before, value_after)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+	sqliteSelectAuditEntriesQuery = `
+		SELECT id, time, actor, ip, action, target, value_before, value_after
+		FROM user_audit
+		WHERE (? = '' OR actor = ?)
+		  AND (? = '' OR action = ?)
+		  AND (? = '' OR target = ?)
+		  AND time >= ?
+		  AND time <= ?
+		ORDER BY id DESC
+		LIMIT ?
+	`
+	sqliteDeleteAuditEntriesQuery = `DELETE FROM user_audit WHERE time < ?`
+
 	// Token queries
-	sqliteSelectTokenQuery                = `SELECT token, label, last_access, last_origin, expires, provisioned FROM user_token WHERE user_id = ? AND token = ?`
-	sqliteSelectTokensQuery               = `SELECT token, label, last_access, last_origin, expires, provisioned FROM user_token WHERE user_id = ?`
+	sqliteSelectTokenQuery                = `SELECT token_hash, token_prefix, label, last_access, last_origin, expires, provisioned, scope FROM user_token WHERE user_id = ? AND token_hash = ?`
+	sqliteSelectTokensQuery               = `SELECT token_hash, token_prefix, label, last_access, last_origin, expires, provisioned, scope FROM user_token WHERE user_id = ?`
 	sqliteSelectTokenCountQuery           = `SELECT COUNT(*) FROM user_token WHERE user_id = ?`
-	sqliteSelectAllProvisionedTokensQuery = `SELECT token, label, last_access, last_origin, expires, provisioned FROM user_token WHERE provisioned = 1`
+	sqliteSelectAllProvisionedTokensQuery = `SELECT token_hash, token_prefix, label, last_access, last_origin, expires, provisioned, scope FROM user_token WHERE provisioned = 1`
 	sqliteUpsertTokenQuery                = `
-		INSERT INTO user_token (user_id, token, label, last_access, last_origin, expires, provisioned)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-		ON CONFLICT (user_id, token)
-		DO UPDATE SET label = excluded.label, expires = excluded.expires, provisioned = excluded.provisioned
+		INSERT INTO user_token (user_id, token_hash, token_prefix, label, last_access, last_origin, expires, provisioned, scope)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id, token_hash)
+		DO UPDATE SET label = excluded.label, expires = excluded.expires, provisioned = excluded.provisioned, scope = excluded.scope
 	`
-	sqliteUpdateTokenQuery                = `UPDATE user_token SET label = ?, expires = ? WHERE user_id = ? AND token = ?`
-	sqliteUpdateTokenLastAccessQuery      = `UPDATE user_token SET last_access = ?, last_origin = ? WHERE token = ?`
-	sqliteDeleteTokenQuery                = `DELETE FROM user_token WHERE user_id = ? AND token = ?`
-	sqliteDeleteProvisionedTokenQuery     = `DELETE FROM user_token WHERE token = ?`
+	sqliteUpdateTokenQuery                = `UPDATE user_token SET label = ?, expires = ? WHERE user_id = ? AND token_hash = ?`
+	sqliteUpdateTokenLastAccessQuery      = `UPDATE user_token SET last_access = ?, last_origin = ? WHERE token_hash = ?`
+	sqliteDeleteTokenQuery                = `DELETE FROM user_token WHERE user_id = ? AND token_hash = ?`
+	sqliteDeleteProvisionedTokenQuery     = `DELETE FROM user_token WHERE token_hash = ?`
 	sqliteDeleteAllProvisionedTokensQuery = `DELETE FROM user_token WHERE provisioned = 1`
 	sqliteDeleteAllTokenQuery             = `DELETE FROM user_token WHERE user_id = ?`
 	sqliteDeleteExpiredTokensQuery        = `DELETE FROM user_token WHERE expires > 0 AND expires < ?`
 	sqliteDeleteExcessTokensQuery         = `
 		DELETE FROM user_token
 		WHERE user_id = ?
-		  AND (user_id, token) NOT IN (
-			SELECT user_id, token
+		  AND (user_id, token_hash) NOT IN (
+			SELECT user_id, token_hash
 			FROM user_token
 			WHERE user_id = ?
 			ORDER BY expires DESC
@@ -184,25 +273,25 @@ const (
 
 	// Tier queries
 	sqliteInsertTierQuery = `
-		INSERT INTO tier (id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO tier (id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, sms_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 	sqliteUpdateTierQuery = `
 		UPDATE tier
-		SET name = ?, messages_limit = ?, messages_expiry_duration = ?, emails_limit = ?, calls_limit = ?, reservations_limit = ?, attachment_file_size_limit = ?, attachment_total_size_limit = ?, attachment_expiry_duration = ?, attachment_bandwidth_limit = ?, stripe_monthly_price_id = ?, stripe_yearly_price_id = ?
+		SET name = ?, messages_limit = ?, messages_expiry_duration = ?, emails_limit = ?, calls_limit = ?, sms_limit = ?, reservations_limit = ?, attachment_file_size_limit = ?, attachment_total_size_limit = ?, attachment_expiry_duration = ?, attachment_bandwidth_limit = ?, stripe_monthly_price_id = ?, stripe_yearly_price_id = ?
 		WHERE code = ?
 	`
 	sqliteSelectTiersQuery = `
-		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id
+		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, sms_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id
 		FROM tier
 	`
 	sqliteSelectTierByCodeQuery = `
-		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id
+		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, sms_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id
 		FROM tier
 		WHERE code = ?
 	`
 	sqliteSelectTierByPriceIDQuery = `
-		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id
+		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, sms_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id
 		FROM tier
 		WHERE (stripe_monthly_price_id = ? OR stripe_yearly_price_id = ?)
 	`
@@ -232,6 +321,39 @@ const (
 	sqliteSelectPendingEmailsQuery     = `SELECT email FROM user_magic_link WHERE kind = ? AND user_id = ? ORDER BY email`
 	sqliteDeleteExpiredMagicLinksQuery = `DELETE FROM user_magic_link WHERE expires < ?`
 
+	// Cursor queries
+	sqliteSelectCursorsQuery     = `SELECT name, topics, last_delivered, last_acked, updated FROM user_cursor WHERE user_id = ? ORDER BY name`
+	sqliteSelectCursorQuery      = `SELECT name, topics, last_delivered, last_acked, updated FROM user_cursor WHERE user_id = ? AND name = ?`
+	sqliteSelectCursorCountQuery = `SELECT COUNT(*) FROM user_cursor WHERE user_id = ?`
+	sqliteUpsertCursorQuery      = `
+		INSERT INTO user_cursor (user_id, name, topics, last_delivered, last_acked, updated)
+		VALUES (?, ?, ?, '', '', ?)
+		ON CONFLICT (user_id, name)
+		DO UPDATE SET topics = excluded.topics, updated = excluded.updated
+	`
+	sqliteUpdateCursorDeliveredQuery = `UPDATE user_cursor SET last_delivered = ?, updated = ? WHERE user_id = ? AND name = ?`
+	sqliteUpdateCursorAckedQuery     = `UPDATE user_cursor SET last_acked = ?, updated = ? WHERE user_id = ? AND name = ?`
+	sqliteDeleteCursorQuery          = `DELETE FROM user_cursor WHERE user_id = ? AND name = ?`
+
+	// TOTP queries
+	sqliteSelectTOTPQuery = `
+		SELECT t.secret, t.enabled, t.last_counter, t.created, (SELECT COUNT(*) FROM user_totp_recovery_code WHERE user_id = t.user_id)
+		FROM user_totp t
+		WHERE t.user_id = ?
+	`
+	sqliteUpsertTOTPQuery = `
+		INSERT INTO user_totp (user_id, secret, enabled, last_counter, created)
+		VALUES (?, ?, 0, 0, ?)
+		ON CONFLICT (user_id)
+		DO UPDATE SET secret = excluded.secret, enabled = 0, last_counter = 0, created = excluded.created
+	`
+	sqliteUpdateTOTPEnabledQuery          = `UPDATE user_totp SET enabled = 1, last_counter = ? WHERE user_id = ? AND enabled = 0`
+	sqliteUpdateTOTPLastCounterQuery      = `UPDATE user_totp SET last_counter = ? WHERE user_id = ? AND enabled = 1 AND last_counter < ?`
+	sqliteDeleteTOTPQuery                 = `DELETE FROM user_totp WHERE user_id = ?`
+	sqliteInsertTOTPRecoveryCodeQuery     = `INSERT INTO user_totp_recovery_code (user_id, code_hash) VALUES (?, ?)`
+	sqliteDeleteTOTPRecoveryCodeQuery     = `DELETE FROM user_totp_recovery_code WHERE user_id = ? AND code_hash = ?`
+	sqliteDeleteAllTOTPRecoveryCodesQuery = `DELETE FROM user_totp_recovery_code WHERE user_id = ?`
+
 	// Billing queries
 	sqliteUpdateBillingQuery = `
 		UPDATE user
@@ -260,6 +382,7 @@ var sqliteQueries = queries{
 	selectUserByName:             sqliteSelectUserByNameQuery,
 	selectUserByToken:            sqliteSelectUserByTokenQuery,
 	selectUserByStripeCustomerID: sqliteSelectUserByStripeCustomerIDQuery,
+	selectUserByExternalID:       sqliteSelectUserByExternalIDQuery,
 	selectUsernames:              sqliteSelectUsernamesQuery,
 	selectUsers:                  sqliteSelectUsersQuery,
 	selectUserCount:              sqliteSelectUserCountQuery,
@@ -268,6 +391,7 @@ var sqliteQueries = queries{
 	updateUserPass:               sqliteUpdateUserPassQuery,
 	updateUserRole:               sqliteUpdateUserRoleQuery,
 	updateUserProvisioned:        sqliteUpdateUserProvisionedQuery,
+	updateUserExternalID:         sqliteUpdateUserExternalIDQuery,
 	updateUserPrefs:              sqliteUpdateUserPrefsQuery,
 	updateUserStats:              sqliteUpdateUserStatsQuery,
 	updateUserStatsResetAll:      sqliteUpdateUserStatsResetAllQuery,
@@ -290,8 +414,29 @@ var sqliteQueries = queries{
 	upsertUserAccess:             sqliteUpsertUserAccessQuery,
 	deleteUserAccess:             sqliteDeleteUserAccessQuery,
 	deleteUserAccessProvisioned:  sqliteDeleteUserAccessProvisionedQuery,
+	insertUserAccessManaged:      sqliteInsertUserAccessManagedQuery,
+	deleteUserAccessManaged:      sqliteDeleteUserAccessManagedQuery,
 	deleteTopicAccess:            sqliteDeleteTopicAccessQuery,
 	deleteAllAccess:              sqliteDeleteAllAccessQuery,
+	selectGroupTopicPerms:        sqliteSelectGroupTopicPermsQuery,
+	selectAccessCacheGroupAll:    sqliteSelectAccessCacheGroupAllQuery,
+	selectAccessCacheGroupMember: sqliteSelectAccessCacheGroupMembersQuery,
+	selectGroups:                 sqliteSelectGroupsQuery,
+	selectGroupByName:            sqliteSelectGroupByNameQuery,
+	selectGroupMembers:           sqliteSelectGroupMembersQuery,
+	selectGroupAccess:            sqliteSelectGroupAccessQuery,
+	selectUserGroups:             sqliteSelectUserGroupsQuery,
+	insertGroup:                  sqliteInsertGroupQuery,
+	deleteGroup:                  sqliteDeleteGroupQuery,
+	deleteGroupsProvisioned:      sqliteDeleteGroupsProvisionedQuery,
+	insertGroupMember:            sqliteInsertGroupMemberQuery,
+	deleteGroupMember:            sqliteDeleteGroupMemberQuery,
+	upsertGroupAccess:            sqliteUpsertGroupAccessQuery,
+	deleteGroupAccess:            sqliteDeleteGroupAccessQuery,
+	deleteAllGroupAccess:         sqliteDeleteAllGroupAccessQuery,
+	insertAuditEntry:             sqliteInsertAuditEntryQuery,
+	selectAuditEntries:           sqliteSelectAuditEntriesQuery,
+	deleteAuditEntries:           sqliteDeleteAuditEntriesQuery,
 	selectToken:                  sqliteSelectTokenQuery,
 	selectTokens:                 sqliteSelectTokensQuery,
 	selectTokenCount:             sqliteSelectTokenCountQuery,
@@ -329,6 +474,21 @@ var sqliteQueries = queries{
 	deleteMagicLinkResetPassword: sqliteDeleteResetScopeQuery,
 	selectPendingEmails:          sqliteSelectPendingEmailsQuery,
 	deleteExpiredMagicLinks:      sqliteDeleteExpiredMagicLinksQuery,
+	selectCursors:                sqliteSelectCursorsQuery,
+	selectCursor:                 sqliteSelectCursorQuery,
+	selectCursorCount:            sqliteSelectCursorCountQuery,
+	upsertCursor:                 sqliteUpsertCursorQuery,
+	updateCursorDelivered:        sqliteUpdateCursorDeliveredQuery,
+	updateCursorAcked:            sqliteUpdateCursorAckedQuery,
+	deleteCursor:                 sqliteDeleteCursorQuery,
+	selectTOTP:                   sqliteSelectTOTPQuery,
+	upsertTOTP:                   sqliteUpsertTOTPQuery,
+	updateTOTPEnabled:            sqliteUpdateTOTPEnabledQuery,
+	updateTOTPLastCounter:        sqliteUpdateTOTPLastCounterQuery,
+	deleteTOTP:                   sqliteDeleteTOTPQuery,
+	insertTOTPRecoveryCode:       sqliteInsertTOTPRecoveryCodeQuery,
+	deleteTOTPRecoveryCode:       sqliteDeleteTOTPRecoveryCodeQuery,
+	deleteAllTOTPRecoveryCodes:   sqliteDeleteAllTOTPRecoveryCodesQuery,
 	updateBilling:                sqliteUpdateBillingQuery,
 }
 
@@ -20,6 +20,7 @@ const (
 			messages_expiry_duration INT NOT NULL,
 			emails_limit INT NOT NULL,
 			calls_limit INT NOT NULL,
+			sms_limit INT NOT NULL DEFAULT (0),
 			reservations_limit INT NOT NULL,
 			attachment_file_size_limit INT NOT NULL,
 			attachment_total_size_limit INT NOT NULL,
@@ -40,9 +41,11 @@ const (
 			prefs JSON NOT NULL DEFAULT '{}',
 			sync_topic TEXT NOT NULL,
 			provisioned INT NOT NULL,
+			external_id TEXT,
 			stats_messages INT NOT NULL DEFAULT (0),
 			stats_emails INT NOT NULL DEFAULT (0),
 			stats_calls INT NOT NULL DEFAULT (0),
+			stats_sms INT NOT NULL DEFAULT (0),
 			stripe_customer_id TEXT,
 			stripe_subscription_id TEXT,
 			stripe_subscription_status TEXT,
@@ -56,6 +59,7 @@ const (
 		CREATE UNIQUE INDEX idx_user ON user (user);
 		CREATE UNIQUE INDEX idx_user_stripe_customer_id ON user (stripe_customer_id);
 		CREATE UNIQUE INDEX idx_user_stripe_subscription_id ON user (stripe_subscription_id);
+		CREATE UNIQUE INDEX idx_user_external_id ON user (external_id);
 		CREATE TABLE IF NOT EXISTS user_access (
 			user_id TEXT NOT NULL,
 			topic TEXT NOT NULL,
@@ -63,22 +67,25 @@ const (
 			write INT NOT NULL,
 			owner_user_id INT,
 			provisioned INT NOT NULL,
+			managed INT NOT NULL DEFAULT (0),
 			PRIMARY KEY (user_id, topic),
 			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE,
 		    FOREIGN KEY (owner_user_id) REFERENCES user (id) ON DELETE CASCADE
 		);
 		CREATE TABLE IF NOT EXISTS user_token (
 			user_id TEXT NOT NULL,
-			token TEXT NOT NULL,
+			token_hash TEXT NOT NULL,
+			token_prefix TEXT NOT NULL,
 			label TEXT NOT NULL,
 			last_access INT NOT NULL,
 			last_origin TEXT NOT NULL,
 			expires INT NOT NULL,
 			provisioned INT NOT NULL,
-			PRIMARY KEY (user_id, token),
+			scope JSON,
+			PRIMARY KEY (user_id, token_hash),
 			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
 		);
-		CREATE UNIQUE INDEX idx_user_token ON user_token (token);
+		CREATE UNIQUE INDEX idx_user_token ON user_token (token_hash);
 		CREATE TABLE IF NOT EXISTS user_phone (
 			user_id TEXT NOT NULL,
 			phone_number TEXT NOT NULL,
@@ -105,6 +112,65 @@ const (
 			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
 		);
 		CREATE INDEX idx_magic_link_user_kind ON user_magic_link (user_id, kind);
+		CREATE TABLE IF NOT EXISTS user_cursor (
+			user_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			topics TEXT NOT NULL,
+			last_delivered TEXT NOT NULL,
+			last_acked TEXT NOT NULL,
+			updated INT NOT NULL,
+			PRIMARY KEY (user_id, name),
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS user_totp (
+			user_id TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			enabled INT NOT NULL,
+			last_counter INT NOT NULL DEFAULT (0),
+			created INT NOT NULL,
+			PRIMARY KEY (user_id),
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS user_totp_recovery_code (
+			user_id TEXT NOT NULL,
+			code_hash TEXT NOT NULL,
+			PRIMARY KEY (user_id, code_hash),
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS user_group (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			provisioned INT NOT NULL
+		);
+		CREATE UNIQUE INDEX idx_user_group_name ON user_group (name);
+		CREATE TABLE IF NOT EXISTS user_group_member (
+			group_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			PRIMARY KEY (group_id, user_id),
+			FOREIGN KEY (group_id) REFERENCES user_group (id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE INDEX idx_user_group_member_user_id ON user_group_member (user_id);
+		CREATE TABLE IF NOT EXISTS user_group_access (
+			group_id TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			read INT NOT NULL,
+			write INT NOT NULL,
+			PRIMARY KEY (group_id, topic),
+			FOREIGN KEY (group_id) REFERENCES user_group (id) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS user_audit (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			time INT NOT NULL,
+			actor TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			action TEXT NOT NULL,
+			target TEXT NOT NULL,
+			value_before TEXT NOT NULL,
+			value_after TEXT NOT NULL
+		);
+		CREATE INDEX idx_user_audit_time ON user_audit (time);
+		CREATE INDEX idx_user_audit_target ON user_audit (target);
 		CREATE TABLE IF NOT EXISTS schemaVersion (
 			id INT PRIMARY KEY,
 			version INT NOT NULL
@@ -121,7 +187,7 @@ const (
 
 // Schema version table management for SQLite
 const (
-	sqliteCurrentSchemaVersion     = 8
+	sqliteCurrentSchemaVersion     = 16
 	sqliteInsertSchemaVersionQuery = `INSERT INTO schemaVersion VALUES (1, ?)`
 	sqliteUpdateSchemaVersionQuery = `UPDATE schemaVersion SET version = ? WHERE id = 1`
 	sqliteSelectSchemaVersionQuery = `SELECT version FROM schemaVersion WHERE id = 1`
@@ -270,6 +336,107 @@ const (
 		CREATE INDEX idx_magic_link_user_kind ON user_magic_link (user_id, kind);
 	`
 
+	// 8 -> 9: durable subscription cursors
+	sqliteMigrate8To9UpdateQueries = `
+		CREATE TABLE IF NOT EXISTS user_cursor (
+			user_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			topics TEXT NOT NULL,
+			last_delivered TEXT NOT NULL,
+			last_acked TEXT NOT NULL,
+			updated INT NOT NULL,
+			PRIMARY KEY (user_id, name),
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+	`
+
+	// 9 -> 10: TOTP two-factor authentication
+	sqliteMigrate9To10UpdateQueries = `
+		CREATE TABLE IF NOT EXISTS user_totp (
+			user_id TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			enabled INT NOT NULL,
+			last_counter INT NOT NULL DEFAULT (0),
+			created INT NOT NULL,
+			PRIMARY KEY (user_id),
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS user_totp_recovery_code (
+			user_id TEXT NOT NULL,
+			code_hash TEXT NOT NULL,
+			PRIMARY KEY (user_id, code_hash),
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+	`
+
+	// 10 -> 11: scoped access tokens
+	sqliteMigrate10To11UpdateQueries = `
+		ALTER TABLE user_token ADD COLUMN scope JSON;
+	`
+
+	// 11 -> 12: user groups
+	sqliteMigrate11To12UpdateQueries = `
+		CREATE TABLE IF NOT EXISTS user_group (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			provisioned INT NOT NULL
+		);
+		CREATE UNIQUE INDEX idx_user_group_name ON user_group (name);
+		CREATE TABLE IF NOT EXISTS user_group_member (
+			group_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			PRIMARY KEY (group_id, user_id),
+			FOREIGN KEY (group_id) REFERENCES user_group (id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE INDEX idx_user_group_member_user_id ON user_group_member (user_id);
+		CREATE TABLE IF NOT EXISTS user_group_access (
+			group_id TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			read INT NOT NULL,
+			write INT NOT NULL,
+			PRIMARY KEY (group_id, topic),
+			FOREIGN KEY (group_id) REFERENCES user_group (id) ON DELETE CASCADE
+		);
+	`
+
+	// 12 -> 13: audit log
+	sqliteMigrate12To13UpdateQueries = `
+		CREATE TABLE IF NOT EXISTS user_audit (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			time INT NOT NULL,
+			actor TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			action TEXT NOT NULL,
+			target TEXT NOT NULL,
+			value_before TEXT NOT NULL,
+			value_after TEXT NOT NULL
+		);
+		CREATE INDEX idx_user_audit_time ON user_audit (time);
+		CREATE INDEX idx_user_audit_target ON user_audit (target);
+	`
+
+	// 13 -> 14: hashed access tokens
+	sqliteMigrate13To14UpdateQueries = `
+		ALTER TABLE user_token RENAME COLUMN token TO token_hash;
+		ALTER TABLE user_token ADD COLUMN token_prefix TEXT NOT NULL DEFAULT '';
+	`
+	sqliteMigrate13To14SelectTokensQuery = `SELECT token_hash FROM user_token`
+	sqliteMigrate13To14UpdateTokenQuery  = `UPDATE user_token SET token_hash = ?, token_prefix = ? WHERE token_hash = ?`
+
+	// 14 -> 15: SMS limit and stats
+	sqliteMigrate14To15UpdateQueries = `
+		ALTER TABLE tier ADD COLUMN sms_limit INT NOT NULL DEFAULT (0);
+		ALTER TABLE user ADD COLUMN stats_sms INT NOT NULL DEFAULT (0);
+	`
+
+	// 15 -> 16: external identities (OIDC, LDAP) and grants managed by them
+	sqliteMigrate15To16UpdateQueries = `
+		ALTER TABLE user ADD COLUMN external_id TEXT;
+		CREATE UNIQUE INDEX idx_user_external_id ON user (external_id);
+		ALTER TABLE user_access ADD COLUMN managed INT NOT NULL DEFAULT (0);
+	`
+
 	// 5 -> 6
 	sqliteMigrate5To6UpdateQueries = `
 		PRAGMA foreign_keys=off;
@@ -367,13 +534,21 @@ const (
 
 var (
 	sqliteMigrations = map[int]func(db *sql.DB) error{
-		1: sqliteMigrateFrom1,
-		2: sqliteMigrateFrom2,
-		3: sqliteMigrateFrom3,
-		4: sqliteMigrateFrom4,
-		5: sqliteMigrateFrom5,
-		6: sqliteMigrateFrom6,
-		7: sqliteMigrateFrom7,
+		1:  sqliteMigrateFrom1,
+		2:  sqliteMigrateFrom2,
+		3:  sqliteMigrateFrom3,
+		4:  sqliteMigrateFrom4,
+		5:  sqliteMigrateFrom5,
+		6:  sqliteMigrateFrom6,
+		7:  sqliteMigrateFrom7,
+		8:  sqliteMigrateFrom8,
+		9:  sqliteMigrateFrom9,
+		10: sqliteMigrateFrom10,
+		11: sqliteMigrateFrom11,
+		12: sqliteMigrateFrom12,
+		13: sqliteMigrateFrom13,
+		14: sqliteMigrateFrom14,
+		15: sqliteMigrateFrom15,
 	}
 )
 
@@ -541,3 +716,130 @@ func sqliteMigrateFrom7(sqlDB *sql.DB) error {
 		return nil
 	})
 }
+
+func sqliteMigrateFrom8(sqlDB *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 8 to 9")
+	return db.ExecTx(sqlDB, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(sqliteMigrate8To9UpdateQueries); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteUpdateSchemaVersionQuery, 9); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func sqliteMigrateFrom9(sqlDB *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 9 to 10")
+	return db.ExecTx(sqlDB, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(sqliteMigrate9To10UpdateQueries); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteUpdateSchemaVersionQuery, 10); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func sqliteMigrateFrom10(sqlDB *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 10 to 11")
+	return db.ExecTx(sqlDB, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(sqliteMigrate10To11UpdateQueries); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteUpdateSchemaVersionQuery, 11); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func sqliteMigrateFrom11(sqlDB *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 11 to 12")
+	return db.ExecTx(sqlDB, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(sqliteMigrate11To12UpdateQueries); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteUpdateSchemaVersionQuery, 12); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func sqliteMigrateFrom12(sqlDB *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 12 to 13")
+	return db.ExecTx(sqlDB, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(sqliteMigrate12To13UpdateQueries); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteUpdateSchemaVersionQuery, 13); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func sqliteMigrateFrom13(sqlDB *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 13 to 14")
+	return db.ExecTx(sqlDB, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(sqliteMigrate13To14UpdateQueries); err != nil {
+			return err
+		}
+		// SQLite has no built-in SHA-256 function, so existing tokens are hashed here
+		rows, err := tx.Query(sqliteMigrate13To14SelectTokensQuery)
+		if err != nil {
+			return err
+		}
+		tokens := make([]string, 0)
+		for rows.Next() {
+			var token string
+			if err := rows.Scan(&token); err != nil {
+				rows.Close()
+				return err
+			}
+			tokens = append(tokens, token)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, token := range tokens {
+			if _, err := tx.Exec(sqliteMigrate13To14UpdateTokenQuery, hashToken(token), tokenDisplayPrefix(token), token); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(sqliteUpdateSchemaVersionQuery, 14); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func sqliteMigrateFrom14(sqlDB *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 14 to 15")
+	return db.ExecTx(sqlDB, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(sqliteMigrate14To15UpdateQueries); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteUpdateSchemaVersionQuery, 15); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func sqliteMigrateFrom15(sqlDB *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 15 to 16")
+	return db.ExecTx(sqlDB, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(sqliteMigrate15To16UpdateQueries); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteUpdateSchemaVersionQuery, 16); err != nil {
+			return err
+		}
+		return nil
+	})
+}
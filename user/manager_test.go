@@ -10,6 +10,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/pquerna/otp/totp"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/crypto/bcrypt"
 	"heckel.io/ntfy/v2/db"
@@ -84,10 +85,10 @@ func TestManager_FullScenario_Default_DenyAll(t *testing.T) {
 		benGrants, err := a.Grants("ben")
 		require.Nil(t, err)
 		require.Equal(t, []Grant{
-			{"everyonewrite", PermissionDenyAll, false},
-			{"mytopic", PermissionReadWrite, false},
-			{"writeme", PermissionWrite, false},
-			{"readme", PermissionRead, false},
+			{"everyonewrite", PermissionDenyAll, false, false},
+			{"mytopic", PermissionReadWrite, false, false},
+			{"writeme", PermissionWrite, false, false},
+			{"readme", PermissionRead, false, false},
 		}, benGrants)
 
 		john, err := a.Authenticate("john", "john")
@@ -99,10 +100,10 @@ func TestManager_FullScenario_Default_DenyAll(t *testing.T) {
 		johnGrants, err := a.Grants("john")
 		require.Nil(t, err)
 		require.Equal(t, []Grant{
-			{"mytopic_deny*", PermissionDenyAll, false},
-			{"mytopic_ro*", PermissionRead, false},
-			{"mytopic*", PermissionReadWrite, false},
-			{"*", PermissionRead, false},
+			{"mytopic_deny*", PermissionDenyAll, false, false},
+			{"mytopic_ro*", PermissionRead, false, false},
+			{"mytopic*", PermissionReadWrite, false, false},
+			{"*", PermissionRead, false, false},
 		}, johnGrants)
 
 		notben, err := a.Authenticate("ben", "this is wrong")
@@ -240,7 +241,7 @@ func TestManager_MarkUserRemoved_RemoveDeletedUsers(t *testing.T) {
 		require.Nil(t, err)
 		require.False(t, u.Deleted)
 
-		token, err := a.CreateToken(u.ID, "", time.Now().Add(time.Hour), netip.IPv4Unspecified(), false)
+		token, err := a.CreateToken(u.ID, "", time.Now().Add(time.Hour), netip.IPv4Unspecified(), nil, false)
 		require.Nil(t, err)
 
 		u, err = a.Authenticate("user", "pass")
@@ -290,7 +291,7 @@ func TestManager_CreateToken_Only_Lower(t *testing.T) {
 		u, err := a.User("user")
 		require.Nil(t, err)
 
-		token, err := a.CreateToken(u.ID, "", time.Now().Add(time.Hour), netip.IPv4Unspecified(), false)
+		token, err := a.CreateToken(u.ID, "", time.Now().Add(time.Hour), netip.IPv4Unspecified(), nil, false)
 		require.Nil(t, err)
 		require.Equal(t, token.Value, strings.ToLower(token.Value))
 	})
@@ -328,10 +329,10 @@ func TestManager_UserManagement(t *testing.T) {
 		benGrants, err := a.Grants("ben")
 		require.Nil(t, err)
 		require.Equal(t, []Grant{
-			{"everyonewrite", PermissionDenyAll, false},
-			{"mytopic", PermissionReadWrite, false},
-			{"writeme", PermissionWrite, false},
-			{"readme", PermissionRead, false},
+			{"everyonewrite", PermissionDenyAll, false, false},
+			{"mytopic", PermissionReadWrite, false, false},
+			{"writeme", PermissionWrite, false, false},
+			{"readme", PermissionRead, false, false},
 		}, benGrants)
 
 		everyone, err := a.User(Everyone)
@@ -343,8 +344,8 @@ func TestManager_UserManagement(t *testing.T) {
 		everyoneGrants, err := a.Grants(Everyone)
 		require.Nil(t, err)
 		require.Equal(t, []Grant{
-			{"everyonewrite", PermissionReadWrite, false},
-			{"announcements", PermissionRead, false},
+			{"everyonewrite", PermissionReadWrite, false, false},
+			{"announcements", PermissionRead, false, false},
 		}, everyoneGrants)
 
 		// Ben: Before revoking
@@ -584,7 +585,7 @@ func TestManager_Token_Valid(t *testing.T) {
 		require.Nil(t, err)
 
 		// Create token for user
-		token, err := a.CreateToken(u.ID, "some label", time.Now().Add(72*time.Hour), netip.IPv4Unspecified(), false)
+		token, err := a.CreateToken(u.ID, "some label", time.Now().Add(72*time.Hour), netip.IPv4Unspecified(), nil, false)
 		require.Nil(t, err)
 		require.NotEmpty(t, token.Value)
 		require.Equal(t, "some label", token.Label)
@@ -597,7 +598,7 @@ func TestManager_Token_Valid(t *testing.T) {
 
 		token2, err := a.Token(u.ID, token.Value)
 		require.Nil(t, err)
-		require.Equal(t, token.Value, token2.Value)
+		require.Equal(t, token.ID, token2.ID)
 		require.Equal(t, "some label", token2.Label)
 
 		tokens, err := a.Tokens(u.ID)
@@ -653,12 +654,12 @@ func TestManager_Token_Expire(t *testing.T) {
 		require.Nil(t, err)
 
 		// Create tokens for user
-		token1, err := a.CreateToken(u.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified(), false)
+		token1, err := a.CreateToken(u.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified(), nil, false)
 		require.Nil(t, err)
 		require.NotEmpty(t, token1.Value)
 		require.True(t, time.Now().Add(71*time.Hour).Unix() < token1.Expires.Unix())
 
-		token2, err := a.CreateToken(u.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified(), false)
+		token2, err := a.CreateToken(u.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified(), nil, false)
 		require.Nil(t, err)
 		require.NotEmpty(t, token2.Value)
 		require.NotEqual(t, token1.Value, token2.Value)
@@ -690,7 +691,7 @@ func TestManager_Token_Expire(t *testing.T) {
 		tokens, err = a.Tokens(u.ID)
 		require.Nil(t, err)
 		require.Equal(t, 1, len(tokens))
-		require.Equal(t, token2.Value, tokens[0].Value)
+		require.Equal(t, token2.ID, tokens[0].ID)
 	})
 }
 
@@ -707,7 +708,7 @@ func TestManager_Token_Extend(t *testing.T) {
 		require.Equal(t, errNoTokenProvided, err)
 
 		// Create token for user
-		token, err := a.CreateToken(u.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified(), false)
+		token, err := a.CreateToken(u.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified(), nil, false)
 		require.Nil(t, err)
 		require.NotEmpty(t, token.Value)
 
@@ -716,7 +717,7 @@ func TestManager_Token_Extend(t *testing.T) {
 
 		extendedToken, err := a.ChangeToken(userWithToken.ID, userWithToken.Token, util.String("changed label"), util.Time(time.Now().Add(100*time.Hour)))
 		require.Nil(t, err)
-		require.Equal(t, token.Value, extendedToken.Value)
+		require.Equal(t, token.ID, extendedToken.ID)
 		require.Equal(t, "changed label", extendedToken.Label)
 		require.True(t, token.Expires.Unix() < extendedToken.Expires.Unix())
 		require.True(t, time.Now().Add(99*time.Hour).Unix() < extendedToken.Expires.Unix())
@@ -738,12 +739,12 @@ func TestManager_Token_MaxCount_AutoDelete(t *testing.T) {
 
 		// Create 2 tokens for phil
 		philTokens := make([]string, 0)
-		token, err := a.CreateToken(phil.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified(), false)
+		token, err := a.CreateToken(phil.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified(), nil, false)
 		require.Nil(t, err)
 		require.NotEmpty(t, token.Value)
 		philTokens = append(philTokens, token.Value)
 
-		token, err = a.CreateToken(phil.ID, "", time.Unix(0, 0), netip.IPv4Unspecified(), false)
+		token, err = a.CreateToken(phil.ID, "", time.Unix(0, 0), netip.IPv4Unspecified(), nil, false)
 		require.Nil(t, err)
 		require.NotEmpty(t, token.Value)
 		philTokens = append(philTokens, token.Value)
@@ -752,7 +753,7 @@ func TestManager_Token_MaxCount_AutoDelete(t *testing.T) {
 		baseTime := time.Now().Add(24 * time.Hour)
 		benTokens := make([]string, 0)
 		for i := 0; i < 62; i++ { //
-			token, err := a.CreateToken(ben.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified(), false)
+			token, err := a.CreateToken(ben.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified(), nil, false)
 			require.Nil(t, err)
 			require.NotEmpty(t, token.Value)
 			benTokens = append(benTokens, token.Value)
@@ -857,7 +858,7 @@ func TestManager_EnqueueTokenUpdate(t *testing.T) {
 		u, err := a.User("ben")
 		require.Nil(t, err)
 
-		token, err := a.CreateToken(u.ID, "", time.Now().Add(time.Hour), netip.IPv4Unspecified(), false)
+		token, err := a.CreateToken(u.ID, "", time.Now().Add(time.Hour), netip.IPv4Unspecified(), nil, false)
 		require.Nil(t, err)
 
 		// Queue token update
@@ -1274,14 +1275,14 @@ func TestManager_WithProvisionedUsers(t *testing.T) {
 		tokens, err := a.Tokens(provisionedUserID)
 		require.Nil(t, err)
 		require.Equal(t, 1, len(tokens))
-		require.Equal(t, "tk_op56p8lz5bf3cxkz9je99v9oc37lo", tokens[0].Value)
+		require.Equal(t, TokenID("tk_op56p8lz5bf3cxkz9je99v9oc37lo"), tokens[0].ID)
 		require.Equal(t, "Alerts token", tokens[0].Label)
 		require.True(t, tokens[0].Provisioned)
 
 		// Update the token last access time and origin (so we can check that it is persisted)
 		lastAccessTime := time.Now().Add(time.Hour)
 		lastOrigin := netip.MustParseAddr("1.1.9.9")
-		a.EnqueueTokenUpdate(tokens[0].Value, &TokenUpdate{LastAccess: lastAccessTime, LastOrigin: lastOrigin})
+		a.EnqueueTokenUpdate(tokens[0].ID, &TokenUpdate{LastAccess: lastAccessTime, LastOrigin: lastOrigin})
 		err = a.writeTokenUpdateQueue()
 		require.Nil(t, err)
 
@@ -1325,12 +1326,16 @@ func TestManager_WithProvisionedUsers(t *testing.T) {
 		tokens, err = a.Tokens(provisionedUserID)
 		require.Nil(t, err)
 		require.Equal(t, 2, len(tokens))
-		require.Equal(t, "tk_op56p8lz5bf3cxkz9je99v9oc37lo", tokens[0].Value)
+		if tokens[0].ID != TokenID("tk_op56p8lz5bf3cxkz9je99v9oc37lo") {
+			tokens[0], tokens[1] = tokens[1], tokens[0] // Tokens are not ordered
+		}
+		require.Equal(t, TokenID("tk_op56p8lz5bf3cxkz9je99v9oc37lo"), tokens[0].ID)
+		require.Equal(t, "tk_op56p", tokens[0].Prefix)
 		require.Equal(t, "Alerts token updated", tokens[0].Label)
 		require.Equal(t, lastAccessTime.Unix(), tokens[0].LastAccess.Unix())
 		require.Equal(t, lastOrigin, tokens[0].LastOrigin)
 		require.True(t, tokens[0].Provisioned)
-		require.Equal(t, "tk_u48wqendnkx9er21pqqcadlytbutx", tokens[1].Value)
+		require.Equal(t, TokenID("tk_u48wqendnkx9er21pqqcadlytbutx"), tokens[1].ID)
 		require.Equal(t, "Another token", tokens[1].Label)
 
 		// Try changing provisioned user's password
@@ -1420,7 +1425,7 @@ func TestManager_WithProvisionedUsers_RemoveToken(t *testing.T) {
 		tokens, err = a.Tokens(philUserID)
 		require.Nil(t, err)
 		require.Equal(t, 1, len(tokens))
-		require.Equal(t, "tk_aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", tokens[0].Value)
+		require.Equal(t, TokenID("tk_aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"), tokens[0].ID)
 	})
 }
 
@@ -1746,6 +1751,8 @@ func TestMigrationFrom4(t *testing.T) {
 		INSERT INTO user_access (user_id, topic, read, write) values ('u_everyone', 'mytopic_', 1, 1);
 		INSERT INTO user_access (user_id, topic, read, write) values ('u_everyone', 'up%', 1, 1);
 		INSERT INTO user_access (user_id, topic, read, write) values ('u_everyone', 'down_%', 1, 1);
+		INSERT INTO user (id, user, pass, role, sync_topic, created) values ('u_phil', 'phil', '$2a$10$YLiO8U21sX1uhZamTLJXHuxgVC0Z/GKISibrKCLohPgtG7yIxSk4C', 'user', '', UNIXEPOCH());
+		INSERT INTO user_token (user_id, token, label, last_access, last_origin, expires) values ('u_phil', 'tk_3wwsgnzwd5ipd5oqiqdhx2rk8xk2e', 'my token', 0, '', 0);
 		COMMIT;
 	`)
 	require.Nil(t, err)
@@ -1795,6 +1802,16 @@ func TestMigrationFrom4(t *testing.T) {
 
 	require.Nil(t, a.Authorize(nil, "up123", PermissionRead))
 	require.Nil(t, a.Authorize(nil, "up", PermissionRead)) // % matches 0 or more characters
+
+	// Check that tokens were hashed, and can still be used
+	var tokenHash, tokenPrefix string
+	require.Nil(t, db.QueryRow(`SELECT token_hash, token_prefix FROM user_token`).Scan(&tokenHash, &tokenPrefix))
+	require.Equal(t, TokenID("tk_3wwsgnzwd5ipd5oqiqdhx2rk8xk2e"), tokenHash)
+	require.Equal(t, "tk_3wwsg", tokenPrefix)
+
+	u, err := a.AuthenticateToken("tk_3wwsgnzwd5ipd5oqiqdhx2rk8xk2e")
+	require.Nil(t, err)
+	require.Equal(t, "phil", u.Name)
 }
 
 func checkSchemaVersion(t *testing.T, d *db.DB) {
@@ -1905,7 +1922,7 @@ func TestStoreUserByToken(t *testing.T) {
 		u, err := manager.User("phil")
 		require.Nil(t, err)
 
-		tk, err := manager.CreateToken(u.ID, "test token", time.Now().Add(24*time.Hour), netip.MustParseAddr("1.2.3.4"), false)
+		tk, err := manager.CreateToken(u.ID, "test token", time.Now().Add(24*time.Hour), netip.MustParseAddr("1.2.3.4"), nil, false)
 		require.Nil(t, err)
 		require.NotEmpty(t, tk.Value)
 
@@ -1930,6 +1947,23 @@ func TestStoreUserByStripeCustomer(t *testing.T) {
 	})
 }
 
+func TestStoreUserByExternalID(t *testing.T) {
+	forEachStoreBackend(t, func(t *testing.T, manager *Manager) {
+		require.Nil(t, manager.AddExternalUser("phil", "mypass", RoleUser, "oidc:1234"))
+		require.Nil(t, manager.AddUser("ben", "benpass", RoleUser, false))
+		require.Equal(t, ErrUserExists, manager.AddExternalUser("ben", "benpass", RoleUser, "oidc:5678"))
+		require.Equal(t, ErrUserExists, manager.AddExternalUser("john", "johnpass", RoleUser, "oidc:1234"))
+		require.Equal(t, ErrInvalidArgument, manager.AddExternalUser("john", "johnpass", RoleUser, ""))
+
+		u, err := manager.UserByExternalID("oidc:1234")
+		require.Nil(t, err)
+		require.Equal(t, "phil", u.Name)
+		require.Equal(t, "oidc:1234", u.ExternalID)
+		_, err = manager.UserByExternalID("oidc:5678")
+		require.Equal(t, ErrUserNotFound, err)
+	})
+}
+
 func TestStoreUsers(t *testing.T) {
 	forEachStoreBackend(t, func(t *testing.T, manager *Manager) {
 		require.Nil(t, manager.AddUser("phil", "mypass", RoleUser, false))
@@ -1991,7 +2025,7 @@ func TestStoreTokens(t *testing.T) {
 		expires := time.Now().Add(24 * time.Hour)
 		origin := netip.MustParseAddr("9.9.9.9")
 
-		tk, err := manager.CreateToken(u.ID, "my token", expires, origin, false)
+		tk, err := manager.CreateToken(u.ID, "my token", expires, origin, nil, false)
 		require.Nil(t, err)
 		require.NotEmpty(t, tk.Value)
 		require.Equal(t, "my token", tk.Label)
@@ -1999,14 +2033,158 @@ func TestStoreTokens(t *testing.T) {
 		// Get single token
 		tk2, err := manager.Token(u.ID, tk.Value)
 		require.Nil(t, err)
-		require.Equal(t, tk.Value, tk2.Value)
+		require.Equal(t, tk.ID, tk2.ID)
 		require.Equal(t, "my token", tk2.Label)
 
 		// Get all tokens
 		tokens, err := manager.Tokens(u.ID)
 		require.Nil(t, err)
 		require.Len(t, tokens, 1)
-		require.Equal(t, tk.Value, tokens[0].Value)
+		require.Equal(t, tk.ID, tokens[0].ID)
+	})
+}
+
+func TestStoreTokensHashed(t *testing.T) {
+	forEachStoreBackend(t, func(t *testing.T, manager *Manager) {
+		require.Nil(t, manager.AddUser("phil", "mypass", RoleUser, false))
+		u, err := manager.User("phil")
+		require.Nil(t, err)
+
+		tk, err := manager.CreateToken(u.ID, "my token", time.Unix(0, 0), netip.IPv4Unspecified(), nil, false)
+		require.Nil(t, err)
+		require.Equal(t, TokenID(tk.Value), tk.ID)
+		require.Equal(t, tk.Value[:8], tk.Prefix)
+
+		// Only the hash and the prefix are stored
+		var tokenHash, tokenPrefix string
+		require.Nil(t, testDB(manager).QueryRow(`SELECT token_hash, token_prefix FROM user_token`).Scan(&tokenHash, &tokenPrefix))
+		require.Equal(t, tk.ID, tokenHash)
+		require.Equal(t, tk.Prefix, tokenPrefix)
+		require.NotContains(t, tokenHash, tk.Value)
+
+		// Token value is not returned when listing tokens
+		tokens, err := manager.Tokens(u.ID)
+		require.Nil(t, err)
+		require.Len(t, tokens, 1)
+		require.Empty(t, tokens[0].Value)
+		require.Equal(t, tk.Prefix, tokens[0].Prefix)
+
+		// The hash cannot be used to authenticate
+		_, err = manager.AuthenticateToken(tk.ID)
+		require.Equal(t, ErrUnauthenticated, err)
+		u2, err := manager.AuthenticateToken(tk.Value)
+		require.Nil(t, err)
+		require.Equal(t, tk.Value, u2.Token)
+
+		// Tokens can be changed and removed by value or by ID
+		tk2, err := manager.ChangeToken(u.ID, tk.ID, util.String("changed"), nil)
+		require.Nil(t, err)
+		require.Equal(t, "changed", tk2.Label)
+		require.Nil(t, manager.RemoveToken(u.ID, tk.ID))
+		_, err = manager.Token(u.ID, tk.Value)
+		require.Equal(t, ErrTokenNotFound, err)
+	})
+}
+
+func TestStoreTokenScope(t *testing.T) {
+	forEachStoreBackend(t, func(t *testing.T, manager *Manager) {
+		require.Nil(t, manager.AddUser("phil", "mypass", RoleUser, false))
+		require.Nil(t, manager.AllowAccess("phil", "ci-*", PermissionReadWrite))
+		require.Nil(t, manager.AllowAccess("phil", "status", PermissionRead))
+		require.Nil(t, manager.AllowAccess("phil", "mytopic", PermissionReadWrite))
+		u, err := manager.User("phil")
+		require.Nil(t, err)
+
+		// Invalid scopes are rejected
+		_, err = manager.CreateToken(u.ID, "", time.Unix(0, 0), netip.IPv4Unspecified(), &TokenScope{Grants: []Grant{{TopicPattern: "ci/*", Permission: PermissionWrite}}}, false)
+		require.Equal(t, ErrInvalidArgument, err)
+		_, err = manager.CreateToken(u.ID, "", time.Unix(0, 0), netip.IPv4Unspecified(), &TokenScope{Grants: []Grant{{TopicPattern: "ci-*", Permission: PermissionDenyAll}}}, false)
+		require.Equal(t, ErrInvalidArgument, err)
+
+		scope := &TokenScope{
+			Grants: []Grant{
+				{TopicPattern: "ci-*", Permission: PermissionWrite},
+				{TopicPattern: "status", Permission: PermissionReadWrite},
+			},
+			NoAccount: true,
+		}
+		tk, err := manager.CreateToken(u.ID, "ci", time.Unix(0, 0), netip.IPv4Unspecified(), scope, false)
+		require.Nil(t, err)
+		require.Equal(t, scope, tk.Scope)
+		tk2, err := manager.Token(u.ID, tk.Value)
+		require.Nil(t, err)
+		require.Equal(t, scope, tk2.Scope)
+
+		// Unscoped tokens have no scope
+		unscoped, err := manager.CreateToken(u.ID, "", time.Unix(0, 0), netip.IPv4Unspecified(), nil, false)
+		require.Nil(t, err)
+		tokenUser, err := manager.AuthenticateToken(unscoped.Value)
+		require.Nil(t, err)
+		require.Nil(t, tokenUser.Scope)
+
+		// Scope narrows down the user's access, but never widens it
+		tokenUser, err = manager.AuthenticateToken(tk.Value)
+		require.Nil(t, err)
+		require.Equal(t, scope, tokenUser.Scope)
+		require.Nil(t, manager.Authorize(tokenUser, "ci-builds", PermissionWrite))
+		require.Equal(t, ErrUnauthorized, manager.Authorize(tokenUser, "ci-builds", PermissionRead))
+		require.Nil(t, manager.Authorize(tokenUser, "status", PermissionRead))
+		require.Equal(t, ErrUnauthorized, manager.Authorize(tokenUser, "status", PermissionWrite))
+		require.Equal(t, ErrUnauthorized, manager.Authorize(tokenUser, "mytopic", PermissionRead))
+		require.Equal(t, ErrUnauthorized, manager.Authorize(tokenUser, u.SyncTopic, PermissionRead))
+
+		// Password logins are not affected
+		passwordUser, err := manager.Authenticate("phil", "mypass")
+		require.Nil(t, err)
+		require.Nil(t, manager.Authorize(passwordUser, "mytopic", PermissionRead))
+	})
+}
+
+func TestStoreTokenScope_Admin(t *testing.T) {
+	forEachStoreBackend(t, func(t *testing.T, manager *Manager) {
+		require.Nil(t, manager.AddUser("phil", "mypass", RoleAdmin, false))
+		u, err := manager.User("phil")
+		require.Nil(t, err)
+		tk, err := manager.CreateToken(u.ID, "", time.Unix(0, 0), netip.IPv4Unspecified(), &TokenScope{Grants: []Grant{{TopicPattern: "ci-*", Permission: PermissionWrite}}}, false)
+		require.Nil(t, err)
+		tokenUser, err := manager.AuthenticateToken(tk.Value)
+		require.Nil(t, err)
+		require.Nil(t, manager.Authorize(tokenUser, "ci-builds", PermissionWrite))
+		require.Equal(t, ErrUnauthorized, manager.Authorize(tokenUser, "anything", PermissionWrite))
+
+		// Empty grants do not restrict topics
+		tk, err = manager.CreateToken(u.ID, "", time.Unix(0, 0), netip.IPv4Unspecified(), &TokenScope{NoAccount: true}, false)
+		require.Nil(t, err)
+		tokenUser, err = manager.AuthenticateToken(tk.Value)
+		require.Nil(t, err)
+		require.True(t, tokenUser.Scope.NoAccount)
+		require.Nil(t, manager.Authorize(tokenUser, "anything", PermissionWrite))
+	})
+}
+
+func TestManager_AuthorizeEphemeral(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, newManager newManagerFunc) {
+		a := newTestManager(t, newManager, PermissionDenyAll)
+		require.Nil(t, a.AddUser("phil", "phil", RoleUser, false))
+		require.Nil(t, a.AllowAccess("phil", "alerts", PermissionReadWrite))
+		require.Nil(t, a.AllowAccess(Everyone, "announcements", PermissionRead))
+
+		// Ephemeral users only have their in-memory grants, not those of a stored user with the same name
+		u := NewEphemeralUser("phil", RoleUser, []Grant{
+			{TopicPattern: "ci-*", Permission: PermissionReadWrite},
+			{TopicPattern: "ci-secret", Permission: PermissionDenyAll},
+		})
+		require.Equal(t, "e_phil", u.ID)
+		require.True(t, u.Scope.NoAccount)
+		require.Nil(t, a.Authorize(u, "ci-builds", PermissionWrite))
+		require.Nil(t, a.Authorize(u, "ci-builds", PermissionRead))
+		require.Equal(t, ErrUnauthorized, a.Authorize(u, "ci-secret", PermissionRead))
+		require.Equal(t, ErrUnauthorized, a.Authorize(u, "alerts", PermissionWrite))
+		require.Nil(t, a.Authorize(u, "announcements", PermissionRead))
+		require.Equal(t, ErrUnauthorized, a.Authorize(u, "announcements", PermissionWrite))
+
+		// Ephemeral admins can do everything
+		require.Nil(t, a.Authorize(NewEphemeralUser("ben", RoleAdmin, nil), "anything", PermissionWrite))
 	})
 }
 
@@ -2017,7 +2195,7 @@ func TestStoreTokenChange(t *testing.T) {
 		require.Nil(t, err)
 
 		expires := time.Now().Add(time.Hour)
-		tk, err := manager.CreateToken(u.ID, "old label", expires, netip.MustParseAddr("1.2.3.4"), false)
+		tk, err := manager.CreateToken(u.ID, "old label", expires, netip.MustParseAddr("1.2.3.4"), nil, false)
 		require.Nil(t, err)
 
 		newLabel := "new label"
@@ -2035,7 +2213,7 @@ func TestStoreTokenRemove(t *testing.T) {
 		u, err := manager.User("phil")
 		require.Nil(t, err)
 
-		tk, err := manager.CreateToken(u.ID, "label", time.Now().Add(time.Hour), netip.MustParseAddr("1.2.3.4"), false)
+		tk, err := manager.CreateToken(u.ID, "label", time.Now().Add(time.Hour), netip.MustParseAddr("1.2.3.4"), nil, false)
 		require.Nil(t, err)
 
 		require.Nil(t, manager.RemoveToken(u.ID, tk.Value))
@@ -2051,9 +2229,9 @@ func TestStoreTokenRemoveExpired(t *testing.T) {
 		require.Nil(t, err)
 
 		// Create expired token and active token
-		tkExpired, err := manager.CreateToken(u.ID, "expired", time.Now().Add(-time.Hour), netip.MustParseAddr("1.2.3.4"), false)
+		tkExpired, err := manager.CreateToken(u.ID, "expired", time.Now().Add(-time.Hour), netip.MustParseAddr("1.2.3.4"), nil, false)
 		require.Nil(t, err)
-		tkActive, err := manager.CreateToken(u.ID, "active", time.Now().Add(time.Hour), netip.MustParseAddr("1.2.3.4"), false)
+		tkActive, err := manager.CreateToken(u.ID, "active", time.Now().Add(time.Hour), netip.MustParseAddr("1.2.3.4"), nil, false)
 		require.Nil(t, err)
 
 		require.Nil(t, manager.RemoveExpiredTokens())
@@ -2065,7 +2243,7 @@ func TestStoreTokenRemoveExpired(t *testing.T) {
 		// Active token should still exist
 		tk, err := manager.Token(u.ID, tkActive.Value)
 		require.Nil(t, err)
-		require.Equal(t, tkActive.Value, tk.Value)
+		require.Equal(t, tkActive.ID, tk.ID)
 	})
 }
 
@@ -2075,7 +2253,7 @@ func TestStoreTokenUpdateLastAccess(t *testing.T) {
 		u, err := manager.User("phil")
 		require.Nil(t, err)
 
-		tk, err := manager.CreateToken(u.ID, "label", time.Now().Add(time.Hour), netip.MustParseAddr("1.2.3.4"), false)
+		tk, err := manager.CreateToken(u.ID, "label", time.Now().Add(time.Hour), netip.MustParseAddr("1.2.3.4"), nil, false)
 		require.Nil(t, err)
 
 		newTime := time.Now().Add(5 * time.Minute)
@@ -2110,6 +2288,53 @@ func TestStoreAllowAccessReadOnly(t *testing.T) {
 	})
 }
 
+func TestStoreSetManagedAccess(t *testing.T) {
+	forEachStoreBackend(t, func(t *testing.T, manager *Manager) {
+		require.Nil(t, manager.AddUser("phil", "mypass", RoleUser, false))
+		require.Nil(t, manager.AllowAccess("phil", "manual", PermissionRead))
+
+		// Grants for the same topic are merged, manual grants take precedence
+		require.Nil(t, manager.SetManagedAccess("phil", []*Grant{
+			{TopicPattern: "alerts_*", Permission: PermissionRead},
+			{TopicPattern: "alerts_*", Permission: PermissionWrite},
+			{TopicPattern: "status", Permission: PermissionRead},
+			{TopicPattern: "manual", Permission: PermissionReadWrite},
+		}))
+		grants, err := manager.Grants("phil")
+		require.Nil(t, err)
+		require.Equal(t, []Grant{
+			{"alerts_*", PermissionReadWrite, false, true},
+			{"manual", PermissionRead, false, false},
+			{"status", PermissionRead, false, true},
+		}, grants)
+		require.Nil(t, manager.Authorize(&User{Name: "phil"}, "alerts_1", PermissionWrite))
+
+		// Stale managed grants are revoked
+		require.Nil(t, manager.SetManagedAccess("phil", []*Grant{
+			{TopicPattern: "status", Permission: PermissionRead},
+		}))
+		grants, err = manager.Grants("phil")
+		require.Nil(t, err)
+		require.Equal(t, []Grant{
+			{"manual", PermissionRead, false, false},
+			{"status", PermissionRead, false, true},
+		}, grants)
+		require.Equal(t, ErrUnauthorized, manager.Authorize(&User{Name: "phil"}, "alerts_1", PermissionWrite))
+
+		// Manually changing a managed grant makes it a manual grant
+		require.Nil(t, manager.AllowAccess("phil", "status", PermissionReadWrite))
+		require.Nil(t, manager.SetManagedAccess("phil", nil))
+		grants, err = manager.Grants("phil")
+		require.Nil(t, err)
+		require.Equal(t, []Grant{
+			{"status", PermissionReadWrite, false, false},
+			{"manual", PermissionRead, false, false},
+		}, grants)
+
+		require.Equal(t, ErrInvalidArgument, manager.SetManagedAccess("phil", []*Grant{{TopicPattern: "bad,topic"}}))
+	})
+}
+
 func TestStoreResetAccess(t *testing.T) {
 	forEachStoreBackend(t, func(t *testing.T, manager *Manager) {
 		require.Nil(t, manager.AddUser("phil", "mypass", RoleUser, false))
@@ -2216,6 +2441,19 @@ func TestAuthorizeTopicAccess_CacheAndDirectDBAgree(t *testing.T) {
 		require.Nil(t, writer.AllowAccess(Everyone, "up*", PermissionWrite))
 		require.Nil(t, writer.AllowAccess(Everyone, "mytopic", PermissionDenyAll))
 
+		// Groups: ben and alice are on-call, alice is also in ops
+		require.Nil(t, writer.AddGroup("oncall"))
+		require.Nil(t, writer.AddGroup("ops"))
+		require.Nil(t, writer.AddGroupMember("oncall", "ben"))
+		require.Nil(t, writer.AddGroupMember("oncall", "alice"))
+		require.Nil(t, writer.AddGroupMember("ops", "alice"))
+		require.Nil(t, writer.AllowGroupAccess("oncall", "alerts*", PermissionWrite))
+		require.Nil(t, writer.AllowGroupAccess("oncall", "alerts-db", PermissionRead))
+		require.Nil(t, writer.AllowGroupAccess("oncall", "ben_topic", PermissionDenyAll))
+		require.Nil(t, writer.AllowGroupAccess("oncall", "incidents", PermissionRead))
+		require.Nil(t, writer.AllowGroupAccess("ops", "incidents", PermissionWrite))
+		require.Nil(t, writer.AllowGroupAccess("ops", "up*", PermissionRead))
+
 		// Build a reader Manager with the cache OFF, pointing at the same backend.
 		reader := newManager(&Config{
 			DefaultAccess:      PermissionDenyAll,
@@ -2256,6 +2494,16 @@ func TestAuthorizeTopicAccess_CacheAndDirectDBAgree(t *testing.T) {
 			{"ben", "mytopicYZ"}, // only wildcard matches
 			// Deny-all override.
 			{"alice", "secret"},
+			// Groups: user rule beats group rule, group rule beats Everyone,
+			// best rule per group, combined across groups.
+			{"ben", "ben_topic"},
+			{"ben", "alerts-web"},
+			{"ben", "alerts-db"},
+			{"ben", "incidents"},
+			{"alice", "incidents"},
+			{"alice", "up5"},
+			{"ben", "up5"},
+			{Everyone, "incidents"},
 			// No matching rule anywhere.
 			{"ben", "completely_unmatched"},
 			{"alice", "completely_unmatched"},
@@ -2275,6 +2523,198 @@ func TestAuthorizeTopicAccess_CacheAndDirectDBAgree(t *testing.T) {
 	})
 }
 
+func TestManager_Groups(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, newManager newManagerFunc) {
+		for _, cacheEnabled := range []bool{false, true} {
+			a := newManager(&Config{
+				DefaultAccess:      PermissionDenyAll,
+				BcryptCost:         bcrypt.MinCost,
+				AccessCacheEnabled: cacheEnabled,
+			})
+			require.Nil(t, a.AddUser("ben", "ben", RoleUser, false))
+			require.Nil(t, a.AddUser("john", "john", RoleUser, false))
+			ben, err := a.User("ben")
+			require.Nil(t, err)
+			john, err := a.User("john")
+			require.Nil(t, err)
+
+			// Create group with members and grants
+			require.Nil(t, a.AddGroup("oncall"))
+			require.Equal(t, ErrGroupExists, a.AddGroup("oncall"))
+			require.Equal(t, ErrInvalidArgument, a.AddGroup("on call"))
+			require.Nil(t, a.AddGroupMember("oncall", "ben"))
+			require.Nil(t, a.AddGroupMember("oncall", "ben")) // Idempotent
+			require.Equal(t, ErrUserNotFound, a.AddGroupMember("oncall", "nobody"))
+			require.Equal(t, ErrInvalidArgument, a.AddGroupMember("oncall", Everyone))
+			require.Equal(t, ErrGroupNotFound, a.AddGroupMember("nogroup", "ben"))
+			require.Nil(t, a.AllowGroupAccess("oncall", "alerts*", PermissionReadWrite))
+			require.Nil(t, a.AllowGroupAccess("oncall", "status", PermissionRead))
+			require.Equal(t, ErrInvalidArgument, a.AllowGroupAccess("oncall", "no/topic", PermissionRead))
+
+			group, err := a.Group("oncall")
+			require.Nil(t, err)
+			require.Equal(t, "oncall", group.Name)
+			require.False(t, group.Provisioned)
+			require.Equal(t, []string{"ben"}, group.Members)
+			require.Equal(t, []Grant{
+				{TopicPattern: "alerts*", Permission: PermissionReadWrite},
+				{TopicPattern: "status", Permission: PermissionRead},
+			}, group.Grants)
+			groups, err := a.UserGroups("ben")
+			require.Nil(t, err)
+			require.Equal(t, []string{"oncall"}, groups)
+
+			// Members inherit the group grants, others do not
+			require.Nil(t, a.Authorize(ben, "alerts-db", PermissionWrite))
+			require.Nil(t, a.Authorize(ben, "status", PermissionRead))
+			require.Equal(t, ErrUnauthorized, a.Authorize(ben, "status", PermissionWrite))
+			require.Equal(t, ErrUnauthorized, a.Authorize(john, "alerts-db", PermissionRead))
+			require.Equal(t, ErrUnauthorized, a.Authorize(nil, "alerts-db", PermissionRead))
+
+			// A user's own grant beats the group grant
+			require.Nil(t, a.AllowAccess("ben", "alerts-secret", PermissionDenyAll))
+			require.Equal(t, ErrUnauthorized, a.Authorize(ben, "alerts-secret", PermissionRead))
+
+			// Reset single grant, then remove member
+			require.Nil(t, a.ResetGroupAccess("oncall", "status"))
+			require.Equal(t, ErrUnauthorized, a.Authorize(ben, "status", PermissionRead))
+			require.Nil(t, a.RemoveGroupMember("oncall", "ben"))
+			require.Equal(t, ErrUnauthorized, a.Authorize(ben, "alerts-db", PermissionRead))
+
+			// Removing a group removes its memberships and grants
+			require.Nil(t, a.AddGroupMember("oncall", "john"))
+			require.Nil(t, a.Authorize(john, "alerts-db", PermissionRead))
+			require.Nil(t, a.RemoveGroup("oncall"))
+			require.Equal(t, ErrUnauthorized, a.Authorize(john, "alerts-db", PermissionRead))
+			_, err = a.Group("oncall")
+			require.Equal(t, ErrGroupNotFound, err)
+			require.Equal(t, ErrGroupNotFound, a.RemoveGroup("oncall"))
+
+			// Clean up for the next iteration
+			require.Nil(t, a.RemoveUser("ben"))
+			require.Nil(t, a.RemoveUser("john"))
+			require.Nil(t, a.Close())
+		}
+	})
+}
+
+func TestManager_Groups_RemoveUser(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, newManager newManagerFunc) {
+		a := newManager(&Config{
+			DefaultAccess:      PermissionDenyAll,
+			BcryptCost:         bcrypt.MinCost,
+			AccessCacheEnabled: true,
+		})
+		t.Cleanup(func() { a.Close() })
+		require.Nil(t, a.AddUser("ben", "ben", RoleUser, false))
+		require.Nil(t, a.AddGroup("oncall"))
+		require.Nil(t, a.AddGroupMember("oncall", "ben"))
+		require.Nil(t, a.AllowGroupAccess("oncall", "alerts", PermissionReadWrite))
+
+		// Re-creating a user with the same name must not inherit the old memberships
+		require.Nil(t, a.RemoveUser("ben"))
+		require.Nil(t, a.AddUser("ben", "ben", RoleUser, false))
+		ben, err := a.User("ben")
+		require.Nil(t, err)
+		require.Equal(t, ErrUnauthorized, a.Authorize(ben, "alerts", PermissionRead))
+		group, err := a.Group("oncall")
+		require.Nil(t, err)
+		require.Empty(t, group.Members)
+	})
+}
+
+func TestManager_WithProvisionedGroups(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, newManager newManagerFunc) {
+		conf := &Config{
+			DefaultAccess:    PermissionDenyAll,
+			ProvisionEnabled: true,
+			BcryptCost:       bcrypt.MinCost,
+			Users: []*User{
+				{Name: "philuser", Hash: "$2a$10$YLiO8U21sX1uhZamTLJXHuxgVC0Z/GKISibrKCLohPgtG7yIxSk4C", Role: RoleUser},
+			},
+			Groups: map[string][]string{
+				"oncall": {"philuser"},
+			},
+			GroupAccess: map[string][]*Grant{
+				"oncall": {
+					{TopicPattern: "alerts*", Permission: PermissionReadWrite},
+				},
+			},
+		}
+		a := newTestManagerFromConfig(t, newManager, conf)
+		require.Nil(t, a.AddUser("philmanual", "manual", RoleUser, false))
+
+		group, err := a.Group("oncall")
+		require.Nil(t, err)
+		require.True(t, group.Provisioned)
+		require.Equal(t, []string{"philuser"}, group.Members)
+		require.Equal(t, []Grant{{TopicPattern: "alerts*", Permission: PermissionReadWrite, Provisioned: true}}, group.Grants)
+		philuser, err := a.User("philuser")
+		require.Nil(t, err)
+		require.Nil(t, a.Authorize(philuser, "alerts-db", PermissionWrite))
+
+		// Provisioned groups cannot be changed
+		require.Equal(t, ErrProvisionedGroupChange, a.RemoveGroup("oncall"))
+		require.Equal(t, ErrProvisionedGroupChange, a.AddGroupMember("oncall", "philmanual"))
+		require.Equal(t, ErrProvisionedGroupChange, a.RemoveGroupMember("oncall", "philuser"))
+		require.Equal(t, ErrProvisionedGroupChange, a.AllowGroupAccess("oncall", "other", PermissionRead))
+		require.Equal(t, ErrProvisionedGroupChange, a.ResetGroupAccess("oncall", ""))
+
+		// A manual group with the same name as a newly provisioned group is replaced
+		require.Nil(t, a.AddGroup("ops"))
+		require.Nil(t, a.AddGroupMember("ops", "philmanual"))
+		require.Nil(t, a.Close())
+		conf.Groups["ops"] = []string{"philuser"}
+		conf.GroupAccess = map[string][]*Grant{
+			"ops": {
+				{TopicPattern: "deploys", Permission: PermissionRead},
+			},
+		}
+		a = newTestManagerFromConfig(t, newManager, conf)
+		groups, err := a.Groups()
+		require.Nil(t, err)
+		require.Len(t, groups, 2)
+		require.Equal(t, "oncall", groups[0].Name)
+		require.Empty(t, groups[0].Grants)
+		require.Equal(t, "ops", groups[1].Name)
+		require.True(t, groups[1].Provisioned)
+		require.Equal(t, []string{"philuser"}, groups[1].Members)
+		require.Equal(t, []Grant{{TopicPattern: "deploys", Permission: PermissionRead, Provisioned: true}}, groups[1].Grants)
+
+		// Removing the groups from the config removes them from the database
+		require.Nil(t, a.Close())
+		conf.Users = nil
+		conf.Groups = nil
+		conf.GroupAccess = nil
+		a = newTestManagerFromConfig(t, newManager, conf)
+		groups, err = a.Groups()
+		require.Nil(t, err)
+		require.Empty(t, groups)
+	})
+}
+
+func TestManager_WithProvisionedGroups_Invalid(t *testing.T) {
+	_, err := NewSQLiteManager(filepath.Join(t.TempDir(), "user.db"), "", &Config{
+		DefaultAccess:    PermissionDenyAll,
+		ProvisionEnabled: true,
+		BcryptCost:       bcrypt.MinCost,
+		Groups: map[string][]string{
+			"oncall": {"notprovisioned"},
+		},
+	})
+	require.ErrorContains(t, err, "user notprovisioned is not a provisioned user")
+
+	_, err = NewSQLiteManager(filepath.Join(t.TempDir(), "user.db"), "", &Config{
+		DefaultAccess:    PermissionDenyAll,
+		ProvisionEnabled: true,
+		BcryptCost:       bcrypt.MinCost,
+		GroupAccess: map[string][]*Grant{
+			"nogroup": {{TopicPattern: "alerts", Permission: PermissionRead}},
+		},
+	})
+	require.ErrorContains(t, err, "group nogroup is not a provisioned group")
+}
+
 // TestAccessCacheReloadInterval_PicksUpExternalWrite proves that the
 // background reloader actually closes the cross-process coherence gap: a
 // write made through a *different* Manager on the same backend becomes
@@ -2558,6 +2998,7 @@ func TestStoreTiers(t *testing.T) {
 			MessageExpiryDuration:    24 * time.Hour,
 			EmailLimit:               100,
 			CallLimit:                10,
+			SMSLimit:                 30,
 			ReservationLimit:         20,
 			AttachmentFileSizeLimit:  10 * 1024 * 1024,
 			AttachmentTotalSizeLimit: 100 * 1024 * 1024,
@@ -2575,6 +3016,7 @@ func TestStoreTiers(t *testing.T) {
 		require.Equal(t, int64(5000), t2.MessageLimit)
 		require.Equal(t, int64(100), t2.EmailLimit)
 		require.Equal(t, int64(10), t2.CallLimit)
+		require.Equal(t, int64(30), t2.SMSLimit)
 		require.Equal(t, int64(20), t2.ReservationLimit)
 
 		// List all tiers
@@ -2705,6 +3147,153 @@ func TestStoreEmails(t *testing.T) {
 	})
 }
 
+func TestStoreCursors(t *testing.T) {
+	forEachStoreBackend(t, func(t *testing.T, manager *Manager) {
+		require.Nil(t, manager.AddUser("phil", "mypass", RoleUser, false))
+		u, err := manager.User("phil")
+		require.Nil(t, err)
+
+		require.Nil(t, manager.AddCursor(u.ID, "phone", []string{"alerts", "builds"}))
+		require.Nil(t, manager.AddCursor(u.ID, "laptop", []string{"alerts"}))
+		require.Equal(t, ErrInvalidArgument, manager.AddCursor(u.ID, "bad name", []string{"alerts"}))
+		require.Equal(t, ErrInvalidArgument, manager.AddCursor(u.ID, "tablet", []string{}))
+		require.Equal(t, ErrInvalidArgument, manager.AddCursor(u.ID, "tablet", []string{"bad,topic"}))
+
+		cursors, err := manager.Cursors(u.ID)
+		require.Nil(t, err)
+		require.Len(t, cursors, 2)
+		require.Equal(t, "laptop", cursors[0].Name)
+		require.Equal(t, "phone", cursors[1].Name)
+		require.Equal(t, []string{"alerts", "builds"}, cursors[1].Topics)
+		require.Equal(t, "", cursors[1].LastDelivered)
+		require.Equal(t, "", cursors[1].LastAcked)
+
+		manager.EnqueueCursorDelivered(u.ID, "phone", "msg2")
+		require.Nil(t, manager.writeCursorDeliveredQueue())
+		require.Nil(t, manager.AckCursor(u.ID, "phone", "msg1"))
+		require.Equal(t, ErrCursorNotFound, manager.AckCursor(u.ID, "tablet", "msg1"))
+
+		// Re-adding keeps the delivered/acked IDs, but updates the topics
+		require.Nil(t, manager.AddCursor(u.ID, "phone", []string{"alerts"}))
+		cursor, err := manager.Cursor(u.ID, "phone")
+		require.Nil(t, err)
+		require.Equal(t, []string{"alerts"}, cursor.Topics)
+		require.Equal(t, "msg2", cursor.LastDelivered)
+		require.Equal(t, "msg1", cursor.LastAcked)
+
+		require.Nil(t, manager.RemoveCursor(u.ID, "phone"))
+		_, err = manager.Cursor(u.ID, "phone")
+		require.Equal(t, ErrCursorNotFound, err)
+		cursors, err = manager.Cursors(u.ID)
+		require.Nil(t, err)
+		require.Len(t, cursors, 1)
+	})
+}
+
+func TestStoreCursorsEnqueueDelivered(t *testing.T) {
+	forEachStoreBackend(t, func(t *testing.T, manager *Manager) {
+		require.Nil(t, manager.AddUser("phil", "mypass", RoleUser, false))
+		u, err := manager.User("phil")
+		require.Nil(t, err)
+		require.Nil(t, manager.AddCursor(u.ID, "phone", []string{"alerts"}))
+		require.Nil(t, manager.AddCursor(u.ID, "laptop", []string{"alerts"}))
+
+		// Queued deliveries are visible before they are written
+		manager.EnqueueCursorDelivered(u.ID, "phone", "msg1")
+		manager.EnqueueCursorDelivered(u.ID, "phone", "msg2")
+		manager.EnqueueCursorDelivered(u.ID, "laptop", "msg1")
+		cursor, err := manager.Cursor(u.ID, "phone")
+		require.Nil(t, err)
+		require.Equal(t, "msg2", cursor.LastDelivered)
+		cursors, err := manager.Cursors(u.ID)
+		require.Nil(t, err)
+		require.Equal(t, "msg1", cursors[0].LastDelivered)
+		require.Equal(t, "msg2", cursors[1].LastDelivered)
+
+		// Removing a cursor drops its queued delivery
+		require.Nil(t, manager.RemoveCursor(u.ID, "laptop"))
+		require.Nil(t, manager.writeCursorDeliveredQueue())
+		require.Len(t, manager.cursorQueue, 0)
+		cursor, err = manager.Cursor(u.ID, "phone")
+		require.Nil(t, err)
+		require.Equal(t, "msg2", cursor.LastDelivered)
+		_, err = manager.Cursor(u.ID, "laptop")
+		require.Equal(t, ErrCursorNotFound, err)
+	})
+}
+
+func TestStoreCursorsLimit(t *testing.T) {
+	forEachStoreBackend(t, func(t *testing.T, manager *Manager) {
+		require.Nil(t, manager.AddUser("phil", "mypass", RoleUser, false))
+		u, err := manager.User("phil")
+		require.Nil(t, err)
+		for i := 0; i < cursorMaxCount; i++ {
+			require.Nil(t, manager.AddCursor(u.ID, fmt.Sprintf("device%d", i), []string{"alerts"}))
+		}
+		require.Equal(t, ErrTooManyCursors, manager.AddCursor(u.ID, "onetoomany", []string{"alerts"}))
+		require.Nil(t, manager.AddCursor(u.ID, "device0", []string{"alerts", "builds"})) // Updating existing is fine
+	})
+}
+
+func TestStoreTOTP(t *testing.T) {
+	forEachStoreBackend(t, func(t *testing.T, manager *Manager) {
+		require.Nil(t, manager.AddUser("phil", "mypass", RoleUser, false))
+		u, err := manager.User("phil")
+		require.Nil(t, err)
+		enabled, err := manager.TOTPEnabled(u.ID)
+		require.Nil(t, err)
+		require.False(t, enabled)
+
+		// Start enrollment, restarting replaces the pending secret
+		key, err := manager.AddTOTP(u.ID, "ntfy.example.com", "phil")
+		require.Nil(t, err)
+		key, err = manager.AddTOTP(u.ID, "ntfy.example.com", "phil")
+		require.Nil(t, err)
+		require.Contains(t, key.URL(), "otpauth://totp/ntfy.example.com:phil?")
+		require.Equal(t, ErrTOTPCodeInvalid, manager.VerifyTOTP(u.ID, mustTOTPCode(t, key.Secret(), time.Now())))
+
+		// Complete enrollment
+		_, err = manager.EnableTOTP(u.ID, "000000x")
+		require.Equal(t, ErrTOTPCodeInvalid, err)
+		recoveryCodes, err := manager.EnableTOTP(u.ID, mustTOTPCode(t, key.Secret(), time.Now()))
+		require.Nil(t, err)
+		require.Len(t, recoveryCodes, totpRecoveryCodeCount)
+		require.Regexp(t, `^[a-z0-9]{5}-[a-z0-9]{5}$`, recoveryCodes[0])
+		_, err = manager.AddTOTP(u.ID, "ntfy.example.com", "phil")
+		require.Equal(t, ErrTOTPEnabled, err)
+		settings, err := manager.TOTP(u.ID)
+		require.Nil(t, err)
+		require.True(t, settings.Enabled)
+		require.Equal(t, totpRecoveryCodeCount, settings.RecoveryCodes)
+
+		// Codes cannot be replayed, but the next code works
+		require.Equal(t, ErrTOTPCodeInvalid, manager.VerifyTOTP(u.ID, mustTOTPCode(t, key.Secret(), time.Now())))
+		require.Equal(t, ErrTOTPCodeInvalid, manager.VerifyTOTP(u.ID, "123"))
+		require.Nil(t, manager.VerifyTOTP(u.ID, mustTOTPCode(t, key.Secret(), time.Now().Add(totpPeriod*time.Second))))
+		require.Equal(t, ErrTOTPCodeInvalid, manager.VerifyTOTP(u.ID, mustTOTPCode(t, key.Secret(), time.Now().Add(totpPeriod*time.Second))))
+
+		// Recovery codes are single-use, and can be entered in any format
+		require.Nil(t, manager.VerifyTOTP(u.ID, strings.ToUpper(strings.ReplaceAll(recoveryCodes[3], "-", " "))))
+		require.Equal(t, ErrTOTPCodeInvalid, manager.VerifyTOTP(u.ID, recoveryCodes[3]))
+		settings, err = manager.TOTP(u.ID)
+		require.Nil(t, err)
+		require.Equal(t, totpRecoveryCodeCount-1, settings.RecoveryCodes)
+
+		// Remove
+		require.Nil(t, manager.RemoveTOTP(u.ID))
+		enabled, err = manager.TOTPEnabled(u.ID)
+		require.Nil(t, err)
+		require.False(t, enabled)
+		require.Equal(t, ErrTOTPCodeInvalid, manager.VerifyTOTP(u.ID, recoveryCodes[4]))
+	})
+}
+
+func mustTOTPCode(t *testing.T, secret string, now time.Time) string {
+	code, err := totp.GenerateCode(secret, now)
+	require.Nil(t, err)
+	return code
+}
+
 func TestStoreChangeSettings(t *testing.T) {
 	forEachStoreBackend(t, func(t *testing.T, manager *Manager) {
 		require.Nil(t, manager.AddUser("phil", "mypass", RoleUser, false))
@@ -2745,7 +3334,7 @@ func TestStoreUpdateStats(t *testing.T) {
 		u, err := manager.User("phil")
 		require.Nil(t, err)
 
-		manager.EnqueueUserStats(u.ID, &Stats{Messages: 42, Emails: 3, Calls: 1})
+		manager.EnqueueUserStats(u.ID, &Stats{Messages: 42, Emails: 3, Calls: 1, SMS: 7})
 		require.Nil(t, manager.writeUserStatsQueue())
 
 		u2, err := manager.User("phil")
@@ -2753,6 +3342,7 @@ func TestStoreUpdateStats(t *testing.T) {
 		require.Equal(t, int64(42), u2.Stats.Messages)
 		require.Equal(t, int64(3), u2.Stats.Emails)
 		require.Equal(t, int64(1), u2.Stats.Calls)
+		require.Equal(t, int64(7), u2.Stats.SMS)
 	})
 }
 
@@ -2762,7 +3352,7 @@ func TestStoreResetStats(t *testing.T) {
 		u, err := manager.User("phil")
 		require.Nil(t, err)
 
-		manager.EnqueueUserStats(u.ID, &Stats{Messages: 42, Emails: 3, Calls: 1})
+		manager.EnqueueUserStats(u.ID, &Stats{Messages: 42, Emails: 3, Calls: 1, SMS: 7})
 		require.Nil(t, manager.writeUserStatsQueue())
 		require.Nil(t, manager.ResetStats())
 
@@ -2771,6 +3361,7 @@ func TestStoreResetStats(t *testing.T) {
 		require.Equal(t, int64(0), u2.Stats.Messages)
 		require.Equal(t, int64(0), u2.Stats.Emails)
 		require.Equal(t, int64(0), u2.Stats.Calls)
+		require.Equal(t, int64(0), u2.Stats.SMS)
 	})
 }
 
@@ -3277,7 +3868,7 @@ func TestManager_AccountReadsUsePrimary(t *testing.T) {
 	require.Nil(t, a.AddUser("phil", "phil", RoleUser, false))
 	u, err := a.User("phil")
 	require.Nil(t, err)
-	_, err = a.CreateToken(u.ID, "test token", time.Now().Add(time.Hour), netip.IPv4Unspecified(), false)
+	_, err = a.CreateToken(u.ID, "test token", time.Now().Add(time.Hour), netip.IPv4Unspecified(), nil, false)
 	require.Nil(t, err)
 	require.Nil(t, a.AddReservation("phil", "mytopic", PermissionDenyAll, 10))
 	require.Nil(t, a.AddPhoneNumber(u.ID, "+12223334444"))
@@ -3313,3 +3904,71 @@ func TestManager_AccountReadsUsePrimary(t *testing.T) {
 	require.Nil(t, err)
 	require.Len(t, pendingEmails, 1)
 }
+
+func TestManager_AuditEntries(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, newManager newManagerFunc) {
+		a := newManager(&Config{
+			DefaultAccess: PermissionDenyAll,
+			BcryptCost:    bcrypt.MinCost,
+		})
+		require.Nil(t, a.AddAuditEntry("phil", "1.2.3.4", AuditActionUserAdd, "ben", nil, map[string]string{"role": "user"}))
+		require.Nil(t, a.AddAuditEntry("phil", "1.2.3.4", AuditActionAccessAllow, "ben", nil, map[string]string{"topic": "prod-alerts", "permission": "read-only"}))
+		require.Nil(t, a.AddAuditEntry("cli:root", "", AuditActionAccessAllow, "ben", map[string]string{"topic": "prod-alerts", "permission": "read-only"}, map[string]string{"topic": "prod-alerts", "permission": "read-write"}))
+		require.Nil(t, a.AddAuditEntry("phil", "1.2.3.4", AuditActionUserAdd, "john", nil, map[string]string{"role": "user"}))
+
+		// All entries, newest first
+		entries, err := a.AuditEntries(&AuditFilter{})
+		require.Nil(t, err)
+		require.Len(t, entries, 4)
+		require.Equal(t, "john", entries[0].Target)
+		require.Equal(t, "cli:root", entries[1].Actor)
+		require.Equal(t, "", entries[1].IP)
+		require.Equal(t, AuditActionAccessAllow, entries[1].Action)
+		require.Equal(t, `{"permission":"read-only","topic":"prod-alerts"}`, entries[1].Before)
+		require.Equal(t, `{"permission":"read-write","topic":"prod-alerts"}`, entries[1].After)
+		require.Equal(t, "", entries[3].Before)
+		require.True(t, entries[0].ID > entries[1].ID)
+		require.True(t, time.Since(entries[0].Time) < time.Minute)
+
+		// Filters
+		entries, err = a.AuditEntries(&AuditFilter{Target: "ben", Action: AuditActionAccessAllow})
+		require.Nil(t, err)
+		require.Len(t, entries, 2)
+		entries, err = a.AuditEntries(&AuditFilter{Actor: "phil"})
+		require.Nil(t, err)
+		require.Len(t, entries, 3)
+		entries, err = a.AuditEntries(&AuditFilter{Actor: "phil", Limit: 1})
+		require.Nil(t, err)
+		require.Len(t, entries, 1)
+		require.Equal(t, "john", entries[0].Target)
+		entries, err = a.AuditEntries(&AuditFilter{Since: time.Now().Add(time.Hour)})
+		require.Nil(t, err)
+		require.Len(t, entries, 0)
+		entries, err = a.AuditEntries(&AuditFilter{Until: time.Now().Add(-time.Hour)})
+		require.Nil(t, err)
+		require.Len(t, entries, 0)
+	})
+}
+
+func TestManager_RemoveExpiredAuditEntries(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, newManager newManagerFunc) {
+		a := newManager(&Config{
+			DefaultAccess:  PermissionReadWrite,
+			BcryptCost:     bcrypt.MinCost,
+			AuditRetention: 24 * time.Hour,
+		})
+		require.Nil(t, a.AddAuditEntry("phil", "1.2.3.4", AuditActionUserAdd, "ben", nil, nil))
+		_, err := a.db.Exec(a.queries.insertAuditEntry, time.Now().Add(-48*time.Hour).Unix(), "phil", "1.2.3.4", string(AuditActionUserRemove), "john", "", "")
+		require.Nil(t, err)
+
+		entries, err := a.AuditEntries(&AuditFilter{})
+		require.Nil(t, err)
+		require.Len(t, entries, 2)
+
+		require.Nil(t, a.RemoveExpiredAuditEntries())
+		entries, err = a.AuditEntries(&AuditFilter{})
+		require.Nil(t, err)
+		require.Len(t, entries, 1)
+		require.Equal(t, "ben", entries[0].Target)
+	})
+}
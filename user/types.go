@@ -14,16 +14,23 @@ import (
 type User struct {
 	ID          string
 	Name        string
-	Hash        string // Password hash (bcrypt)
-	Token       string // Only set if token was used to log in
+	Hash        string      // Password hash (bcrypt)
+	Token       string      // Only set if token was used to log in
+	Scope       *TokenScope // Only set if a scoped token was used to log in
+	ProxyAuth   bool        // Only set if the user was authenticated by a trusted reverse proxy (auth-proxy-header)
+	ClientCert  bool        // Only set if the user was authenticated with a TLS client certificate (client-ca-file)
+	JWT         bool        // Only set if an external JWT was used to log in (jwt-jwks)
+	Ephemeral   bool        // Whether the user only exists for the current request, and is not stored in the database
+	Grants      []Grant     // Only set for ephemeral users, whose access control entries are not stored in the database
 	Role        Role
 	Prefs       *Prefs
 	Tier        *Tier
 	Stats       *Stats
 	Billing     *Billing
 	SyncTopic   string
-	Provisioned bool // Whether the user was provisioned by the config file
-	Deleted     bool // Whether the user was soft-deleted
+	Provisioned bool   // Whether the user was provisioned by the config file
+	ExternalID  string // Identity at an external identity provider, e.g. "oidc:<sub>" or "ldap:<username>" (empty for local users)
+	Deleted     bool   // Whether the user was soft-deleted
 }
 
 // TierID returns the ID of the User.Tier, or an empty string if the user has no tier,
@@ -35,6 +42,28 @@ func (u *User) TierID() string {
 	return u.Tier.ID
 }
 
+// NewEphemeralUser creates a user that is not stored in the database, e.g. a user authenticated with an external
+// JWT. Its role and grants only exist for the duration of the request. Ephemeral users cannot use the account API.
+func NewEphemeralUser(username string, role Role, grants []Grant) *User {
+	return &User{
+		ID:        ephemeralUserIDPrefix + username,
+		Name:      username,
+		Role:      role,
+		Scope:     &TokenScope{NoAccount: true},
+		Ephemeral: true,
+		Grants:    grants,
+		Prefs:     &Prefs{},
+		Stats:     &Stats{},
+		Billing:   &Billing{},
+	}
+}
+
+// PasswordAuth returns true if the user logged in with username and password, and not with an access token,
+// a JWT, a TLS client certificate, or via a trusted reverse proxy
+func (u *User) PasswordAuth() bool {
+	return u.Token == "" && !u.JWT && !u.ClientCert && !u.ProxyAuth
+}
+
 // IsAdmin returns true if the user is an admin
 func (u *User) IsAdmin() bool {
 	return u != nil && u.Role == RoleAdmin
@@ -57,14 +86,43 @@ type Auther interface {
 	Authorize(user *User, topic string, perm Permission) error
 }
 
-// Token represents a user token, including expiry date
+// Token represents a user token, including expiry date. Tokens are stored hashed, so the token
+// value is only known when the token is created, or when it is passed in (e.g. provisioned tokens).
 type Token struct {
-	Value       string
+	ID          string // Hex-encoded SHA-256 hash of the token value, see TokenID
+	Value       string // Only set if the token was just created
+	Prefix      string // First characters of the token value, to identify the token in lists
 	Label       string
 	LastAccess  time.Time
 	LastOrigin  netip.Addr
 	Expires     time.Time
 	Provisioned bool
+	Scope       *TokenScope // Nil if the token is not restricted
+}
+
+// TokenScope restricts what a token can be used for. The scope only ever narrows down what
+// the token's user is allowed to do, it never grants additional access. If Grants is empty,
+// topic access is not restricted. If NoAccount is set, the token cannot be used for the account API.
+type TokenScope struct {
+	Grants    []Grant
+	NoAccount bool
+}
+
+// Allows returns true if the scope permits the given permission on the topic, i.e. if any of
+// the scope's topic patterns matches the topic and grants the permission
+func (s *TokenScope) Allows(topic string, perm Permission) bool {
+	if s == nil || len(s.Grants) == 0 {
+		return true
+	}
+	for _, grant := range s.Grants {
+		if (perm == PermissionRead && !grant.Permission.IsRead()) || (perm == PermissionWrite && !grant.Permission.IsWrite()) {
+			continue
+		}
+		if grant.Matches(topic) {
+			return true
+		}
+	}
+	return false
 }
 
 // TokenUpdate holds information about the last access time and origin IP address of a token
@@ -112,6 +170,7 @@ type Tier struct {
 	MessageExpiryDuration    time.Duration // Cache duration for messages
 	EmailLimit               int64         // Daily email limit
 	CallLimit                int64         // Daily phone call limit
+	SMSLimit                 int64         // Daily SMS limit
 	ReservationLimit         int64         // Number of topic reservations allowed by user
 	AttachmentFileSizeLimit  int64         // Max file size per file (bytes)
 	AttachmentTotalSizeLimit int64         // Total file size for all files of this user (bytes)
@@ -158,6 +217,7 @@ type Stats struct {
 	Messages int64
 	Emails   int64
 	Calls    int64
+	SMS      int64
 }
 
 // Billing is a struct holding a user's billing information
@@ -175,6 +235,170 @@ type Grant struct {
 	TopicPattern string // May include wildcard (*)
 	Permission   Permission
 	Provisioned  bool // Whether the grant was provisioned by the config file
+	Managed      bool // Whether the grant is managed by an external identity provider (OIDC, LDAP), see Manager.SetManagedAccess
+}
+
+// Matches returns true if the grant's topic pattern matches the given topic
+func (g Grant) Matches(topic string) bool {
+	re, err := compileLikeToRegex(toSQLWildcard(g.TopicPattern))
+	return err == nil && re.MatchString(topic)
+}
+
+// Group is a named set of users that share access control entries. A group's grants apply
+// to all of its members, unless a member has a grant of their own for the same topic.
+type Group struct {
+	ID          string
+	Name        string
+	Members     []string // Usernames
+	Grants      []Grant
+	Provisioned bool // Whether the group was provisioned by the config file
+}
+
+// AuditEntry is a single entry in the append-only audit log. It records a change to a user, tier,
+// access control entry, group, token or reservation, and who made it.
+type AuditEntry struct {
+	ID     int64
+	Time   time.Time
+	Actor  string // Username of the user making the change, "*" for anonymous users, or "cli:<os-user>" for the CLI
+	IP     string // IP address of the actor, empty for the CLI
+	Action AuditAction
+	Target string // Username, tier code or group (see GroupTarget) the change applies to
+	Before string // JSON-encoded value before the change, empty if there was none
+	After  string // JSON-encoded value after the change, empty if it was removed
+}
+
+// AuditAction describes the type of change recorded in an AuditEntry
+type AuditAction string
+
+// Audit actions
+const (
+	AuditActionUserAdd           = AuditAction("user_add")
+	AuditActionUserRemove        = AuditAction("user_remove")
+	AuditActionUserPassword      = AuditAction("user_password")
+	AuditActionUserRole          = AuditAction("user_role")
+	AuditActionUserTier          = AuditAction("user_tier")
+	AuditActionTierAdd           = AuditAction("tier_add")
+	AuditActionTierChange        = AuditAction("tier_change")
+	AuditActionTierRemove        = AuditAction("tier_remove")
+	AuditActionAccessAllow       = AuditAction("access_allow")
+	AuditActionAccessReset       = AuditAction("access_reset")
+	AuditActionGroupAdd          = AuditAction("group_add")
+	AuditActionGroupRemove       = AuditAction("group_remove")
+	AuditActionGroupMemberAdd    = AuditAction("group_member_add")
+	AuditActionGroupMemberRemove = AuditAction("group_member_remove")
+	AuditActionTokenAdd          = AuditAction("token_add")
+	AuditActionTokenChange       = AuditAction("token_change")
+	AuditActionTokenRemove       = AuditAction("token_remove")
+	AuditActionReservationAdd    = AuditAction("reservation_add")
+	AuditActionReservationRemove = AuditAction("reservation_remove")
+)
+
+// AuditUser is the before/after value recorded in the audit log for user changes
+type AuditUser struct {
+	Role Role   `json:"role,omitempty"`
+	Tier string `json:"tier,omitempty"`
+}
+
+// NewAuditUser converts the given user to an audit log value
+func NewAuditUser(u *User) *AuditUser {
+	tier := ""
+	if u.Tier != nil {
+		tier = u.Tier.Code
+	}
+	return &AuditUser{
+		Role: u.Role,
+		Tier: tier,
+	}
+}
+
+// AuditTier is the before/after value recorded in the audit log for tier changes
+type AuditTier struct {
+	Name                     string `json:"name"`
+	MessageLimit             int64  `json:"message_limit"`
+	MessageExpiryDuration    int64  `json:"message_expiry_duration"` // Seconds
+	EmailLimit               int64  `json:"email_limit"`
+	CallLimit                int64  `json:"call_limit"`
+	SMSLimit                 int64  `json:"sms_limit"`
+	ReservationLimit         int64  `json:"reservation_limit"`
+	AttachmentFileSizeLimit  int64  `json:"attachment_file_size_limit"`
+	AttachmentTotalSizeLimit int64  `json:"attachment_total_size_limit"`
+	AttachmentExpiryDuration int64  `json:"attachment_expiry_duration"` // Seconds
+	AttachmentBandwidthLimit int64  `json:"attachment_bandwidth_limit"`
+	StripeMonthlyPriceID     string `json:"stripe_monthly_price_id,omitempty"`
+	StripeYearlyPriceID      string `json:"stripe_yearly_price_id,omitempty"`
+}
+
+// NewAuditTier converts the given tier to an audit log value
+func NewAuditTier(t *Tier) *AuditTier {
+	return &AuditTier{
+		Name:                     t.Name,
+		MessageLimit:             t.MessageLimit,
+		MessageExpiryDuration:    int64(t.MessageExpiryDuration.Seconds()),
+		EmailLimit:               t.EmailLimit,
+		CallLimit:                t.CallLimit,
+		SMSLimit:                 t.SMSLimit,
+		ReservationLimit:         t.ReservationLimit,
+		AttachmentFileSizeLimit:  t.AttachmentFileSizeLimit,
+		AttachmentTotalSizeLimit: t.AttachmentTotalSizeLimit,
+		AttachmentExpiryDuration: int64(t.AttachmentExpiryDuration.Seconds()),
+		AttachmentBandwidthLimit: t.AttachmentBandwidthLimit,
+		StripeMonthlyPriceID:     t.StripeMonthlyPriceID,
+		StripeYearlyPriceID:      t.StripeYearlyPriceID,
+	}
+}
+
+// GroupTarget returns the audit log target for the given group, to distinguish it from usernames
+func GroupTarget(name string) string {
+	return "group:" + name
+}
+
+// AuditGrant is the before/after value recorded in the audit log for access control entries
+type AuditGrant struct {
+	Topic      string `json:"topic"` // This may be a pattern
+	Permission string `json:"permission"`
+}
+
+// NewAuditGrants converts the given grants to audit log values. If topicPattern is not empty, only
+// the grant for that topic pattern is included. It returns nil if no grants match.
+func NewAuditGrants(grants []Grant, topicPattern string) []*AuditGrant {
+	var auditGrants []*AuditGrant
+	for _, g := range grants {
+		if topicPattern == "" || g.TopicPattern == topicPattern {
+			auditGrants = append(auditGrants, &AuditGrant{Topic: g.TopicPattern, Permission: g.Permission.String()})
+		}
+	}
+	return auditGrants
+}
+
+// AuditToken is the before/after value recorded in the audit log for token changes. It only
+// contains the beginning of the token, so the log cannot be used to authenticate.
+type AuditToken struct {
+	Token   string `json:"token"`
+	Label   string `json:"label,omitempty"`
+	Expires int64  `json:"expires,omitempty"`
+}
+
+// NewAuditToken converts the given token to an audit log value
+func NewAuditToken(t *Token) *AuditToken {
+	var expires int64
+	if !t.Expires.IsZero() {
+		expires = t.Expires.Unix()
+	}
+	return &AuditToken{
+		Token:   t.Prefix + "...",
+		Label:   t.Label,
+		Expires: expires,
+	}
+}
+
+// AuditFilter restricts the entries returned by Manager.AuditEntries. Empty fields are ignored.
+type AuditFilter struct {
+	Actor  string
+	Action AuditAction
+	Target string
+	Since  time.Time
+	Until  time.Time
+	Limit  int // Maximum number of entries, newest first; defaults to DefaultAuditLimit
 }
 
 // Reservation is a struct that represents the ownership over a topic by a user
@@ -214,6 +438,34 @@ func (e Emails) Contains(address string) bool {
 	return false
 }
 
+// Cursor is a durable, named subscription of a user (e.g. one per device). It remembers the ID of the
+// last message that was delivered to the client, and the last message the client acknowledged, so that a
+// reconnecting client can be sent exactly the messages it missed.
+type Cursor struct {
+	Name          string
+	Topics        []string
+	LastDelivered string // Message ID, may be empty if nothing was delivered yet
+	LastAcked     string // Message ID, may be empty if nothing was acknowledged yet
+	Updated       time.Time
+}
+
+// cursorKey identifies a durable subscription cursor of a user
+type cursorKey struct {
+	userID string
+	name   string
+}
+
+// TOTP holds the time-based one-time password (two-factor authentication) settings of a user. Until the
+// user confirms the enrollment with a valid code, the secret is pending and two-factor authentication is
+// not enforced.
+type TOTP struct {
+	Secret        string
+	Enabled       bool
+	LastCounter   int64 // Time step of the last accepted code, to prevent replaying codes
+	RecoveryCodes int   // Number of unused recovery codes
+	Created       time.Time
+}
+
 // Permission represents a read or write permission to a topic
 type Permission uint8
 
@@ -305,12 +557,15 @@ type Config struct {
 	ProvisionEnabled             bool                // Hack: Enable auto-provisioning of users and access grants, disabled for "ntfy user" commands
 	Users                        []*User             // Predefined users to create on startup
 	Access                       map[string][]*Grant // Predefined access grants to create on startup (username -> []*Grant)
+	Groups                       map[string][]string // Predefined groups to create on startup (group name -> []username)
+	GroupAccess                  map[string][]*Grant // Predefined group access grants to create on startup (group name -> []*Grant)
 	Tokens                       map[string][]*Token // Predefined users to create on startup (username -> []*Token)
 	QueueWriterInterval          time.Duration       // Interval for the async queue writer to flush stats and token updates to the database
 	BcryptCost                   int                 // Cost of generated passwords; lowering makes testing faster
 	AccessCacheEnabled           bool                // Enables the in-memory ACL cache (high volume servers only)
 	AccessCacheReloadInterval    time.Duration       // Reload interval for access cache, relevant for ACL writes from CLI
 	ExpiredMagicLinkReapInterval time.Duration       // Interval for sweeping expired email-verify/password-reset links
+	AuditRetention               time.Duration       // Duration after which audit log entries are removed; zero keeps them forever
 }
 
 // Error constants used by the package
@@ -333,6 +588,14 @@ var (
 	ErrMagicLinkNotFound      = errors.New("magic link not found")
 	ErrProvisionedUserChange  = errors.New("cannot change or delete provisioned user")
 	ErrProvisionedTokenChange = errors.New("cannot change or delete provisioned token")
+	ErrProvisionedGroupChange = errors.New("cannot change or delete provisioned group")
+	ErrGroupNotFound          = errors.New("group not found")
+	ErrGroupExists            = errors.New("group already exists")
+	ErrCursorNotFound         = errors.New("subscription cursor not found")
+	ErrTooManyCursors         = errors.New("too many subscription cursors")
+	ErrTOTPNotFound           = errors.New("two-factor authentication not set up")
+	ErrTOTPEnabled            = errors.New("two-factor authentication already enabled")
+	ErrTOTPCodeInvalid        = errors.New("two-factor authentication code invalid")
 )
 
 // queries holds the database-specific SQL queries
@@ -342,6 +605,7 @@ type queries struct {
 	selectUserByName             string
 	selectUserByToken            string
 	selectUserByStripeCustomerID string
+	selectUserByExternalID       string
 	selectUsernames              string
 	selectUsers                  string
 	selectUserCount              string
@@ -350,6 +614,7 @@ type queries struct {
 	updateUserPass               string
 	updateUserRole               string
 	updateUserProvisioned        string
+	updateUserExternalID         string
 	updateUserPrefs              string
 	updateUserStats              string
 	updateUserStatsResetAll      string
@@ -374,9 +639,34 @@ type queries struct {
 	upsertUserAccess            string
 	deleteUserAccess            string
 	deleteUserAccessProvisioned string
+	insertUserAccessManaged     string
+	deleteUserAccessManaged     string
 	deleteTopicAccess           string
 	deleteAllAccess             string
 
+	// Group queries
+	selectGroupTopicPerms        string // Direct-DB group part of authorizeTopicAccess; used when the in-memory cache is disabled
+	selectAccessCacheGroupAll    string // Bulk load: (group_name, topic, read, write) for the in-memory ACL cache
+	selectAccessCacheGroupMember string // Bulk load: (user_name, group_name) for the in-memory ACL cache
+	selectGroups                 string
+	selectGroupByName            string
+	selectGroupMembers           string
+	selectGroupAccess            string
+	selectUserGroups             string
+	insertGroup                  string
+	deleteGroup                  string
+	deleteGroupsProvisioned      string
+	insertGroupMember            string
+	deleteGroupMember            string
+	upsertGroupAccess            string
+	deleteGroupAccess            string
+	deleteAllGroupAccess         string
+
+	// Audit log queries
+	insertAuditEntry   string
+	selectAuditEntries string
+	deleteAuditEntries string
+
 	// Token queries
 	selectToken                string
 	selectTokens               string
@@ -424,6 +714,25 @@ type queries struct {
 	selectPendingEmails          string // Pending (unverified) email addresses for a user
 	deleteExpiredMagicLinks      string
 
+	// Cursor queries
+	selectCursors         string
+	selectCursor          string
+	selectCursorCount     string
+	upsertCursor          string
+	updateCursorDelivered string
+	updateCursorAcked     string
+	deleteCursor          string
+
+	// TOTP queries
+	selectTOTP                 string
+	upsertTOTP                 string
+	updateTOTPEnabled          string
+	updateTOTPLastCounter      string
+	deleteTOTP                 string
+	insertTOTPRecoveryCode     string
+	deleteTOTPRecoveryCode     string
+	deleteAllTOTPRecoveryCodes string
+
 	// Billing queries
 	updateBilling string
 }
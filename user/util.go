@@ -21,6 +21,8 @@ var (
 	allowedTopicRegex        = regexp.MustCompile(`^[-_A-Za-z0-9]{1,64}$`)  // No '*'
 	allowedTopicPatternRegex = regexp.MustCompile(`^[-_*A-Za-z0-9]{1,64}$`) // Adds '*' for wildcards!
 	allowedTierRegex         = regexp.MustCompile(`^[-_A-Za-z0-9]{1,64}$`)
+	allowedCursorNameRegex   = regexp.MustCompile(`^[-_A-Za-z0-9]{1,64}$`)
+	allowedGroupNameRegex    = regexp.MustCompile(`^[-_.A-Za-z0-9]{1,64}$`)
 	allowedTokenRegex        = regexp.MustCompile(`^tk_[-_A-Za-z0-9]{29}$`) // Must be tokenLength-len(tokenPrefix)
 )
 
@@ -49,6 +51,16 @@ func AllowedTier(tier string) bool {
 	return allowedTierRegex.MatchString(tier)
 }
 
+// AllowedCursorName returns true if the given subscription cursor name is valid
+func AllowedCursorName(name string) bool {
+	return allowedCursorNameRegex.MatchString(name)
+}
+
+// AllowedGroupName returns true if the given group name is valid
+func AllowedGroupName(name string) bool {
+	return allowedGroupNameRegex.MatchString(name)
+}
+
 // ValidPasswordHash checks if the given password hash is a valid bcrypt hash
 func ValidPasswordHash(hash string, minCost int) error {
 	if !strings.HasPrefix(hash, "$2a$") && !strings.HasPrefix(hash, "$2b$") && !strings.HasPrefix(hash, "$2y$") {
@@ -68,6 +80,25 @@ func ValidToken(token string) bool {
 	return allowedTokenRegex.MatchString(token)
 }
 
+// TokenID returns the ID of the given token, which is the hex-encoded SHA-256 hash under which
+// the token is stored. If the given value is not a token value (e.g. because it already is a
+// token ID), it is returned as is, so that tokens can be referred to by either value or ID.
+func TokenID(token string) string {
+	if strings.HasPrefix(token, tokenPrefix) {
+		return hashToken(token)
+	}
+	return token
+}
+
+// tokenDisplayPrefix returns the first few characters of the given token value, which are stored
+// in plaintext to allow users to tell their tokens apart
+func tokenDisplayPrefix(token string) string {
+	if len(token) > tokenDisplayPrefixLength {
+		return token[:tokenDisplayPrefixLength]
+	}
+	return token
+}
+
 // GenerateToken generates a new token with a prefix and a fixed length
 // Lowercase only to support "<topic>+<token>@<domain>" email addresses
 func GenerateToken() string {
@@ -81,8 +112,21 @@ func generateLinkToken() string {
 	return util.RandomString(linkTokenLength)
 }
 
-// hashToken returns the hex-encoded SHA-256 digest of a raw magic-link token.
-// Tokens are stored hashed so a database read cannot yield working links; a high-entropy
+// generateRecoveryCode returns a random two-factor authentication recovery code, formatted as two
+// groups of lowercase characters, e.g. abcde-12345
+func generateRecoveryCode() string {
+	code := util.RandomLowerStringPrefix("", totpRecoveryCodeLength)
+	return code[:totpRecoveryCodeLength/2] + "-" + code[totpRecoveryCodeLength/2:]
+}
+
+// normalizeRecoveryCode removes dashes and spaces from the given recovery code, and converts it to
+// lowercase, so that codes can be entered in any format
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// hashToken returns the hex-encoded SHA-256 digest of a raw magic-link or access token.
+// Tokens are stored hashed so a database read cannot yield working credentials; a high-entropy
 // token makes a fast (unsalted) hash sufficient, unlike a password.
 func hashToken(raw string) string {
 	sum := sha256.Sum256([]byte(raw))
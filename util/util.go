@@ -243,6 +243,31 @@ func DetectContentType(b []byte, filename string) (mimeType string, ext string)
 	return
 }
 
+// DetectContentTypeDeclared is like DetectContentType, but prefers the declared mime type (e.g. the Content-Type of an
+// e-mail attachment) if it is the detected type or a more specific variant of it, e.g. text/csv if text/plain was
+// detected. Declared types that do not match the content are ignored, so the sender cannot pass off arbitrary content
+// as a different type. The returned file extension always matches the returned mime type.
+func DetectContentTypeDeclared(b []byte, filename, declared string) (mimeType string, ext string) {
+	mimeType, ext = DetectContentType(b, filename)
+	declaredMIME := mimetype.Lookup(declared)
+	if declaredMIME == nil || strings.HasSuffix(strings.ToLower(filename), ".apk") {
+		return
+	}
+	detected := mimetype.Detect(b)
+	if detected.Is(declaredMIME.String()) {
+		return // Keep the detected type, including parameters such as the charset
+	}
+	for m := declaredMIME.Parent(); m != nil && m.Parent() != nil; m = m.Parent() { // Root (application/octet-stream) matches anything
+		if detected.Is(m.String()) {
+			if declaredMIME.Extension() == "" {
+				return declaredMIME.String(), ".bin"
+			}
+			return declaredMIME.String(), declaredMIME.Extension()
+		}
+	}
+	return
+}
+
 // ParseSize parses a size string like 2K or 2M into bytes. If no unit is found, e.g. 123, bytes is assumed.
 func ParseSize(s string) (int64, error) {
 	matches := sizeStrRegex.FindStringSubmatch(s)
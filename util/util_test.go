@@ -133,6 +133,30 @@ func TestShortTopicURL(t *testing.T) {
 	require.Equal(t, "lalala", ShortTopicURL("lalala"))
 }
 
+func TestDetectContentTypeDeclared(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	exe := []byte("MZ\x90\x00\x03\x00\x00\x00\x04\x00\x00\x00\xff\xff\x00\x00")
+
+	// Same or more specific type is accepted
+	mimeType, ext := DetectContentTypeDeclared(png, "", "image/png")
+	require.Equal(t, "image/png", mimeType)
+	require.Equal(t, ".png", ext)
+	mimeType, ext = DetectContentTypeDeclared([]byte("some text"), "", "text/calendar; charset=utf-8")
+	require.Equal(t, "text/calendar", mimeType)
+	require.Equal(t, ".ics", ext)
+
+	// Declared type that contradicts the content is ignored
+	mimeType, ext = DetectContentTypeDeclared(exe, "", "image/png")
+	require.Equal(t, "application/vnd.microsoft.portable-executable", mimeType)
+	require.Equal(t, ".exe", ext)
+	mimeType, ext = DetectContentTypeDeclared([]byte{0x01, 0x02, 0x03}, "", "image/png")
+	require.Equal(t, "application/octet-stream", mimeType)
+	require.Equal(t, ".bin", ext)
+	mimeType, ext = DetectContentTypeDeclared([]byte("some text"), "", "not a type")
+	require.Equal(t, "text/plain; charset=utf-8", mimeType)
+	require.Equal(t, ".txt", ext)
+}
+
 func TestParseSize_10GSuccess(t *testing.T) {
 	s, err := ParseSize("10G")
 	require.Nil(t, err)
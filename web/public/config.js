@@ -9,6 +9,8 @@ var config = {
   base_url: window.location.origin, // Change to test against a different server
   app_root: "/",
   enable_login: true,
+  enable_oidc: false,
+  enable_proxy_auth: false,
   require_login: false,
   enable_signup: true,
   enable_payments: false,
@@ -16,6 +16,7 @@ import {
   accountSettingsUrl,
   accountSubscriptionUrl,
   accountTokenUrl,
+  accountTOTPUrl,
   accountUrl,
   maybeWithBearerAuth,
   tiersUrl,
@@ -46,12 +47,13 @@ class AccountApi {
     this.listener = null;
   }
 
-  async login(user) {
+  async login(user, totp) {
     const url = accountTokenUrl(config.base_url);
     console.log(`[AccountApi] Checking auth for ${url}`);
     const response = await fetchOrThrow(url, {
       method: "POST",
       headers: withBasicAuth({}, user.username, user.password),
+      body: totp ? JSON.stringify({ totp }) : undefined,
     });
     const json = await response.json(); // May throw SyntaxError
     if (!json.token) {
@@ -60,6 +62,21 @@ class AccountApi {
     return json.token;
   }
 
+  async loginWithProxy() {
+    const url = accountTokenUrl(config.base_url);
+    console.log(`[AccountApi] Checking reverse proxy auth for ${url}`);
+    const response = await fetchOrThrow(url, { method: "POST" });
+    const json = await response.json(); // May throw SyntaxError
+    if (!json.token) {
+      throw new Error(`Unexpected server response: Cannot find token`);
+    }
+    const accountResponse = await fetchOrThrow(accountUrl(config.base_url), {
+      headers: withBearerAuth({}, json.token),
+    });
+    const account = await accountResponse.json(); // May throw SyntaxError
+    return { username: account.username, token: json.token };
+  }
+
   async logout() {
     const url = accountTokenUrl(config.base_url);
     console.log(`[AccountApi] Logging out from ${url} using token ${session.token()}`);
@@ -122,6 +139,38 @@ class AccountApi {
     });
   }
 
+  async addTOTP() {
+    const url = accountTOTPUrl(config.base_url);
+    console.log(`[AccountApi] Starting two-factor authentication enrollment ${url}`);
+    const response = await fetchOrThrow(url, {
+      method: "POST",
+      headers: withBearerAuth({}, session.token()),
+    });
+    return response.json(); // May throw SyntaxError
+  }
+
+  async enableTOTP(code) {
+    const url = accountTOTPUrl(config.base_url);
+    console.log(`[AccountApi] Enabling two-factor authentication ${url}`);
+    const response = await fetchOrThrow(url, {
+      method: "PUT",
+      headers: withBearerAuth({}, session.token()),
+      body: JSON.stringify({ code }),
+    });
+    const json = await response.json(); // May throw SyntaxError
+    return json.recovery_codes;
+  }
+
+  async deleteTOTP(password) {
+    const url = accountTOTPUrl(config.base_url);
+    console.log(`[AccountApi] Disabling two-factor authentication ${url}`);
+    await fetchOrThrow(url, {
+      method: "DELETE",
+      headers: withBearerAuth({}, session.token()),
+      body: JSON.stringify({ password }),
+    });
+  }
+
   async createToken(label, expires) {
     const url = accountTokenUrl(config.base_url);
     const body = {
@@ -129,17 +178,19 @@ class AccountApi {
       expires: expires > 0 ? Math.floor(Date.now() / 1000) + expires : 0,
     };
     console.log(`[AccountApi] Creating user access token ${url}`);
-    await fetchOrThrow(url, {
+    const response = await fetchOrThrow(url, {
       method: "POST",
       headers: withBearerAuth({}, session.token()),
       body: JSON.stringify(body),
     });
+    const json = await response.json(); // May throw SyntaxError
+    return json.token;
   }
 
-  async updateToken(token, label, expires) {
+  async updateToken(tokenId, label, expires) {
     const url = accountTokenUrl(config.base_url);
     const body = {
-      token,
+      token: tokenId,
       label,
     };
     if (expires >= 0) {
@@ -163,12 +214,12 @@ class AccountApi {
     await session.setLastExtendedAtAsync();
   }
 
-  async deleteToken(token) {
+  async deleteToken(tokenId) {
     const url = accountTokenUrl(config.base_url);
     console.log(`[AccountApi] Deleting user access token ${url}`);
     await fetchOrThrow(url, {
       method: "DELETE",
-      headers: withBearerAuth({ "X-Token": token }, session.token()),
+      headers: withBearerAuth({ "X-Token": tokenId }, session.token()),
     });
   }
 
@@ -63,9 +63,33 @@ export class EmailPrimaryElsewhereError extends Error {
   }
 }
 
+export class TOTPRequiredError extends Error {
+  static CODE = 40103; // errHTTPUnauthorizedTOTPRequired
+
+  constructor() {
+    super("Two-factor authentication code required");
+  }
+}
+
+export class TOTPCodeInvalidError extends Error {
+  static CODE = 40104; // errHTTPUnauthorizedTOTPInvalid
+
+  static ENROLLMENT_CODE = 40060; // errHTTPBadRequestTOTPCodeInvalid
+
+  constructor() {
+    super("Two-factor authentication code invalid");
+  }
+}
+
 export const throwAppError = async (response) => {
   if (response.status === 401 || response.status === 403) {
     console.log(`[Error] HTTP ${response.status}`, response);
+    const error = await maybeToJson(response);
+    if (error?.code === TOTPRequiredError.CODE) {
+      throw new TOTPRequiredError();
+    } else if (error?.code === TOTPCodeInvalidError.CODE) {
+      throw new TOTPCodeInvalidError();
+    }
     throw new UnauthorizedError();
   }
   const error = await maybeToJson(response);
@@ -83,6 +107,8 @@ export const throwAppError = async (response) => {
       throw new EmailVerificationCodeInvalidError();
     } else if (error.code === EmailPrimaryElsewhereError.CODE) {
       throw new EmailPrimaryElsewhereError();
+    } else if (error.code === TOTPCodeInvalidError.ENROLLMENT_CODE) {
+      throw new TOTPCodeInvalidError();
     } else if (error?.error) {
       throw new Error(`Error ${error.code}: ${error.error}`);
     }
@@ -25,6 +25,8 @@ export const webPushUrl = (baseUrl) => `${baseUrl}/v1/webpush`;
 export const accountUrl = (baseUrl) => `${baseUrl}/v1/account`;
 export const accountPasswordUrl = (baseUrl) => `${baseUrl}/v1/account/password`;
 export const accountTokenUrl = (baseUrl) => `${baseUrl}/v1/account/token`;
+export const accountTOTPUrl = (baseUrl) => `${baseUrl}/v1/account/totp`;
+export const oidcLoginUrl = (baseUrl) => `${baseUrl}/v1/auth/oidc/login`;
 export const accountSettingsUrl = (baseUrl) => `${baseUrl}/v1/account/settings`;
 export const accountSubscriptionUrl = (baseUrl) => `${baseUrl}/v1/account/subscription`;
 export const accountReservationUrl = (baseUrl) => `${baseUrl}/v1/account/reservation`;
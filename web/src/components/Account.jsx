@@ -61,7 +61,7 @@ import AccountContext from "./AccountContext";
 import { usePrefCache } from "./PrefCache";
 import DialogFooter from "./DialogFooter";
 import { Paragraph } from "./styles";
-import { EmailPrimaryElsewhereError, IncorrectPasswordError, UnauthorizedError } from "../app/errors";
+import { EmailPrimaryElsewhereError, IncorrectPasswordError, TOTPCodeInvalidError, UnauthorizedError } from "../app/errors";
 import { ProChip } from "./SubscriptionPopup";
 import session from "../app/Session";
 
@@ -92,6 +92,7 @@ const Basics = () => {
       <PrefGroup>
         <Username />
         <ChangePassword />
+        <TwoFactor />
         <Emails />
         <PhoneNumbers />
         <AccountType />
@@ -242,6 +243,217 @@ const ChangePasswordDialog = (props) => {
   );
 };
 
+const TwoFactor = () => {
+  const { t } = useTranslation();
+  const { account } = useContext(AccountContext);
+  const [dialogKey, setDialogKey] = useState(0);
+  const [enrollDialogOpen, setEnrollDialogOpen] = useState(false);
+  const [disableDialogOpen, setDisableDialogOpen] = useState(false);
+  const labelId = "prefTwoFactor";
+
+  const handleEnrollDialogOpen = () => {
+    setDialogKey((prev) => prev + 1);
+    setEnrollDialogOpen(true);
+  };
+
+  const handleDisableDialogOpen = () => {
+    setDialogKey((prev) => prev + 1);
+    setDisableDialogOpen(true);
+  };
+
+  if (!account?.totp) {
+    return null;
+  }
+
+  return (
+    <Pref labelId={labelId} title={t("account_basics_totp_title")} description={t("account_basics_totp_description")}>
+      <div aria-labelledby={labelId}>
+        {account.totp.enabled ? (
+          <>
+            {t("account_basics_totp_enabled", { count: account.totp.recovery_codes || 0 })}
+            {!account.totp.required && (
+              <Tooltip title={t("account_basics_totp_disable_dialog_title")}>
+                <IconButton onClick={handleDisableDialogOpen} aria-label={t("account_basics_totp_disable_dialog_title")}>
+                  <DeleteOutlineIcon />
+                </IconButton>
+              </Tooltip>
+            )}
+          </>
+        ) : (
+          <>
+            <em>{t("account_basics_totp_disabled")}</em>
+            <Tooltip title={t("account_basics_totp_enroll_dialog_title")}>
+              <IconButton onClick={handleEnrollDialogOpen} aria-label={t("account_basics_totp_enroll_dialog_title")}>
+                <AddIcon />
+              </IconButton>
+            </Tooltip>
+          </>
+        )}
+      </div>
+      <TOTPEnrollDialog key={`totpEnrollDialog${dialogKey}`} open={enrollDialogOpen} onClose={() => setEnrollDialogOpen(false)} />
+      <TOTPDisableDialog key={`totpDisableDialog${dialogKey}`} open={disableDialogOpen} onClose={() => setDisableDialogOpen(false)} />
+    </Pref>
+  );
+};
+
+export const TOTPEnrollDialog = (props) => {
+  const theme = useTheme();
+  const { t } = useTranslation();
+  const [error, setError] = useState("");
+  const [enrollment, setEnrollment] = useState(null);
+  const [code, setCode] = useState("");
+  const [recoveryCodes, setRecoveryCodes] = useState(null);
+  const fullScreen = useMediaQuery(theme.breakpoints.down("sm"));
+
+  const handleError = async (e) => {
+    if (e instanceof TOTPCodeInvalidError) {
+      setError(t("account_basics_totp_enroll_dialog_code_invalid"));
+    } else if (e instanceof UnauthorizedError) {
+      await session.resetAndRedirect(routes.login);
+    } else {
+      setError(e.message);
+    }
+  };
+
+  const handleStart = async () => {
+    try {
+      setEnrollment(await accountApi.addTOTP());
+    } catch (e) {
+      console.log(`[Account] Error starting two-factor authentication enrollment`, e);
+      await handleError(e);
+    }
+  };
+
+  const handleConfirm = async () => {
+    try {
+      setRecoveryCodes(await accountApi.enableTOTP(code));
+      setError("");
+    } catch (e) {
+      console.log(`[Account] Error enabling two-factor authentication`, e);
+      await handleError(e);
+    }
+  };
+
+  const handleDone = async () => {
+    props.onClose();
+    await accountApi.sync();
+  };
+
+  return (
+    <Dialog open={props.open} onClose={props.required ? undefined : props.onClose} fullScreen={fullScreen}>
+      <DialogTitle>{t("account_basics_totp_enroll_dialog_title")}</DialogTitle>
+      <DialogContent>
+        {!enrollment && (
+          <DialogContentText>
+            {props.required ? t("account_basics_totp_enroll_dialog_required") : t("account_basics_totp_enroll_dialog_description")}
+          </DialogContentText>
+        )}
+        {enrollment && !recoveryCodes && (
+          <>
+            <DialogContentText>{t("account_basics_totp_enroll_dialog_scan")}</DialogContentText>
+            <Box sx={{ display: "flex", justifyContent: "center", mt: 2, mb: 1 }}>
+              <img src={enrollment.qr_code} alt={t("account_basics_totp_enroll_dialog_qr_code")} width={200} height={200} />
+            </Box>
+            <Typography variant="body2" sx={{ textAlign: "center", fontFamily: "monospace", wordBreak: "break-all" }}>
+              {enrollment.secret}
+            </Typography>
+            <TextField
+              margin="dense"
+              label={t("account_basics_totp_enroll_dialog_code_label")}
+              aria-label={t("account_basics_totp_enroll_dialog_code_label")}
+              placeholder={t("account_basics_phone_numbers_dialog_code_placeholder")}
+              type="text"
+              value={code}
+              onChange={(ev) => setCode(ev.target.value.trim())}
+              fullWidth
+              autoComplete="one-time-code"
+              slotProps={{ htmlInput: { inputMode: "numeric", pattern: "[0-9]*" } }}
+              variant="standard"
+            />
+          </>
+        )}
+        {recoveryCodes && (
+          <>
+            <DialogContentText>{t("account_basics_totp_enroll_dialog_recovery_codes")}</DialogContentText>
+            <Box sx={{ display: "grid", gridTemplateColumns: "1fr 1fr", gap: 1, mt: 2, fontFamily: "monospace" }}>
+              {recoveryCodes.map((recoveryCode) => (
+                <span key={recoveryCode}>{recoveryCode}</span>
+              ))}
+            </Box>
+          </>
+        )}
+      </DialogContent>
+      <DialogFooter status={error}>
+        {!recoveryCodes && !props.required && <Button onClick={props.onClose}>{t("common_cancel")}</Button>}
+        {!enrollment && <Button onClick={handleStart}>{t("account_basics_totp_enroll_dialog_button_start")}</Button>}
+        {enrollment && !recoveryCodes && (
+          <Button onClick={handleConfirm} disabled={code === ""}>
+            {t("account_basics_totp_enroll_dialog_button_confirm")}
+          </Button>
+        )}
+        {recoveryCodes && (
+          <>
+            <Button onClick={() => copyToClipboard(recoveryCodes.join("\n"))}>{t("common_copy_to_clipboard")}</Button>
+            <Button onClick={handleDone}>{t("account_basics_totp_enroll_dialog_button_done")}</Button>
+          </>
+        )}
+      </DialogFooter>
+    </Dialog>
+  );
+};
+
+const TOTPDisableDialog = (props) => {
+  const theme = useTheme();
+  const { t } = useTranslation();
+  const [error, setError] = useState("");
+  const [password, setPassword] = useState("");
+  const fullScreen = useMediaQuery(theme.breakpoints.down("sm"));
+
+  const handleDialogSubmit = async () => {
+    try {
+      console.debug(`[Account] Disabling two-factor authentication`);
+      await accountApi.deleteTOTP(password);
+      props.onClose();
+      await accountApi.sync();
+    } catch (e) {
+      console.log(`[Account] Error disabling two-factor authentication`, e);
+      if (e instanceof IncorrectPasswordError) {
+        setError(t("account_basics_password_dialog_current_password_incorrect"));
+      } else if (e instanceof UnauthorizedError) {
+        await session.resetAndRedirect(routes.login);
+      } else {
+        setError(e.message);
+      }
+    }
+  };
+
+  return (
+    <Dialog open={props.open} onClose={props.onClose} fullScreen={fullScreen}>
+      <DialogTitle>{t("account_basics_totp_disable_dialog_title")}</DialogTitle>
+      <DialogContent>
+        <DialogContentText>{t("account_basics_totp_disable_dialog_description")}</DialogContentText>
+        <TextField
+          margin="dense"
+          id="totp-disable-password"
+          label={t("account_basics_password_dialog_current_password_label")}
+          aria-label={t("account_basics_password_dialog_current_password_label")}
+          type="password"
+          value={password}
+          onChange={(ev) => setPassword(ev.target.value)}
+          fullWidth
+          variant="standard"
+        />
+      </DialogContent>
+      <DialogFooter status={error}>
+        <Button onClick={props.onClose}>{t("common_cancel")}</Button>
+        <Button onClick={handleDialogSubmit} color="error" disabled={password.length === 0}>
+          {t("account_basics_totp_disable_dialog_button_submit")}
+        </Button>
+      </DialogFooter>
+    </Dialog>
+  );
+};
+
 const AccountType = () => {
   const { t } = useTranslation();
   const { dateFormat } = usePrefCache();
@@ -660,7 +872,7 @@ const PhoneNumbers = () => {
     return null;
   }
 
-  if (account?.limits.calls === 0) {
+  if (account?.limits.calls === 0 && !account?.limits.sms) {
     return (
       <Pref
         title={
@@ -967,6 +1179,37 @@ const Stats = () => {
             />
           </Pref>
         )}
+        {config.enable_sms && (account.role === Role.ADMIN || account.limits.sms > 0) && (
+          <Pref
+            title={
+              <>
+                {t("account_usage_sms_title")}
+                <Tooltip title={t("account_usage_limits_reset_daily")}>
+                  <span>
+                    <InfoIcon />
+                  </span>
+                </Tooltip>
+              </>
+            }
+          >
+            <div>
+              <Typography variant="body2" sx={{ float: "left" }}>
+                {account.stats.sms.toLocaleString()}
+              </Typography>
+              <Typography variant="body2" sx={{ float: "right" }}>
+                {account.role === Role.USER
+                  ? t("account_usage_of_limit", {
+                      limit: account.limits.sms.toLocaleString(),
+                    })
+                  : t("account_usage_unlimited")}
+              </Typography>
+            </div>
+            <LinearProgress
+              variant="determinate"
+              value={account.role === Role.USER && account.limits.sms > 0 ? normalize(account.stats.sms, account.limits.sms) : 100}
+            />
+          </Pref>
+        )}
         <Pref
           alignTop
           title={t("account_usage_attachment_storage_title")}
@@ -1080,20 +1323,19 @@ const Tokens = () => {
 const TokensTable = (props) => {
   const { t } = useTranslation();
   const { dateFormat, timeFormat } = usePrefCache();
-  const [snackOpen, setSnackOpen] = useState(false);
   const [upsertDialogKey, setUpsertDialogKey] = useState(0);
   const [upsertDialogOpen, setUpsertDialogOpen] = useState(false);
   const [deleteDialogOpen, setDeleteDialogOpen] = useState(false);
   const [selectedToken, setSelectedToken] = useState(null);
 
   const tokens = (props.tokens || []).sort((a, b) => {
-    if (a.token === session.token()) {
+    if (a.current) {
       return -1;
     }
-    if (b.token === session.token()) {
+    if (b.current) {
       return 1;
     }
-    return a.token.localeCompare(b.token);
+    return a.prefix.localeCompare(b.prefix);
   });
 
   const handleEditClick = (token) => {
@@ -1113,9 +1355,16 @@ const TokensTable = (props) => {
     setDeleteDialogOpen(true);
   };
 
-  const handleCopy = async (token) => {
-    copyToClipboard(token);
-    setSnackOpen(true);
+  const tokenScopeTooltip = (scope) => {
+    const lines = [];
+    if (scope.topics?.length > 0) {
+      const topics = scope.topics.map((s) => `${s.topic} (${s.permission})`).join(", ");
+      lines.push(t("account_tokens_table_scope_topics_tooltip", { topics }));
+    }
+    if (scope.no_account) {
+      lines.push(t("account_tokens_table_scope_no_account_tooltip"));
+    }
+    return lines.join(". ");
   };
 
   return (
@@ -1135,26 +1384,23 @@ const TokensTable = (props) => {
           const hasLastOrigin = !!token.last_origin;
 
           return (
-            <TableRow key={token.token} sx={{ "&:last-child td, &:last-child th": { border: 0 } }}>
+            <TableRow key={token.id} sx={{ "&:last-child td, &:last-child th": { border: 0 } }}>
               <TableCell
                 component="th"
                 scope="row"
                 sx={{ paddingLeft: 0, whiteSpace: "nowrap" }}
                 aria-label={t("account_tokens_table_token_header")}
               >
-                <span>
-                  <span style={{ fontFamily: "Monospace", fontSize: "0.9rem" }}>{token.token.slice(0, 12)}</span>
-                  ...
-                  <Tooltip title={t("common_copy_to_clipboard")} placement="right">
-                    <IconButton onClick={() => handleCopy(token.token)}>
-                      <ContentCopy />
-                    </IconButton>
-                  </Tooltip>
-                </span>
+                <span style={{ fontFamily: "Monospace", fontSize: "0.9rem" }}>{token.prefix}</span>...
               </TableCell>
               <TableCell aria-label={t("account_tokens_table_label_header")}>
-                {token.token === session.token() && <em>{t("account_tokens_table_current_session")}</em>}
-                {token.token !== session.token() && (token.label || "-")}
+                {token.current && <em>{t("account_tokens_table_current_session")}</em>}
+                {!token.current && (token.label || "-")}
+                {token.scope && (
+                  <Tooltip title={tokenScopeTooltip(token.scope)}>
+                    <Chip size="small" label={t("account_tokens_table_scoped")} sx={{ ml: 1 }} />
+                  </Tooltip>
+                )}
               </TableCell>
               <TableCell sx={{ whiteSpace: "nowrap" }} aria-label={t("account_tokens_table_expires_header")}>
                 {token.expires ? formatDateTime(token.expires, dateFormat, timeFormat) : <em>{t("account_tokens_table_never_expires")}</em>}
@@ -1176,7 +1422,7 @@ const TokensTable = (props) => {
                 </div>
               </TableCell>
               <TableCell align="right" sx={{ whiteSpace: "nowrap" }}>
-                {token.token !== session.token() && !token.provisioned && (
+                {!token.current && !token.provisioned && (
                   <>
                     <Tooltip title={t("account_tokens_dialog_title_edit")}>
                       <IconButton onClick={() => handleEditClick(token)} aria-label={t("account_tokens_dialog_title_edit")}>
@@ -1190,7 +1436,7 @@ const TokensTable = (props) => {
                     </Tooltip>
                   </>
                 )}
-                {token.token === session.token() && (
+                {token.current && (
                   <Tooltip title={t("account_tokens_table_cannot_delete_or_edit")}>
                     <span>
                       <IconButton disabled>
@@ -1219,14 +1465,6 @@ const TokensTable = (props) => {
           );
         })}
       </TableBody>
-      <Portal>
-        <Snackbar
-          open={snackOpen}
-          autoHideDuration={3000}
-          onClose={() => setSnackOpen(false)}
-          message={t("account_tokens_table_copied_to_clipboard")}
-        />
-      </Portal>
       <TokenDialog key={`tokenDialogEdit${upsertDialogKey}`} open={upsertDialogOpen} token={selectedToken} onClose={handleDialogClose} />
       <TokenDeleteDialog open={deleteDialogOpen} token={selectedToken} onClose={handleDialogClose} />
     </Table>
@@ -1239,17 +1477,20 @@ const TokenDialog = (props) => {
   const [error, setError] = useState("");
   const [label, setLabel] = useState(props.token?.label || "");
   const [expires, setExpires] = useState(props.token ? -1 : 0);
+  const [createdToken, setCreatedToken] = useState(null);
+  const [snackOpen, setSnackOpen] = useState(false);
   const fullScreen = useMediaQuery(theme.breakpoints.down("sm"));
   const editMode = !!props.token;
 
   const handleSubmit = async () => {
     try {
       if (editMode) {
-        await accountApi.updateToken(props.token.token, label, expires);
+        await accountApi.updateToken(props.token.id, label, expires);
+        props.onClose();
       } else {
-        await accountApi.createToken(label, expires);
+        setCreatedToken(await accountApi.createToken(label, expires)); // Token is only shown once, see below
+        setError("");
       }
-      props.onClose();
     } catch (e) {
       console.log(`[Account] Error creating token`, e);
       if (e instanceof UnauthorizedError) {
@@ -1264,37 +1505,74 @@ const TokenDialog = (props) => {
     <Dialog open={props.open} onClose={props.onClose} maxWidth="sm" fullWidth fullScreen={fullScreen}>
       <DialogTitle>{editMode ? t("account_tokens_dialog_title_edit") : t("account_tokens_dialog_title_create")}</DialogTitle>
       <DialogContent>
-        <TextField
-          margin="dense"
-          id="token-label"
-          label={t("account_tokens_dialog_label")}
-          aria-label={t("account_delete_dialog_label")}
-          type="text"
-          value={label}
-          onChange={(ev) => setLabel(ev.target.value)}
-          fullWidth
-          variant="standard"
-        />
-        <FormControl fullWidth variant="standard" sx={{ mt: 1 }}>
-          <Select value={expires} onChange={(ev) => setExpires(ev.target.value)} aria-label={t("account_tokens_dialog_expires_label")}>
-            {editMode && <MenuItem value={-1}>{t("account_tokens_dialog_expires_unchanged")}</MenuItem>}
-            <MenuItem value={0}>{t("account_tokens_dialog_expires_never")}</MenuItem>
-            <MenuItem value={21600}>{t("account_tokens_dialog_expires_x_hours", { hours: 6 })}</MenuItem>
-            <MenuItem value={43200}>{t("account_tokens_dialog_expires_x_hours", { hours: 12 })}</MenuItem>
-            <MenuItem value={259200}>{t("account_tokens_dialog_expires_x_days", { days: 3 })}</MenuItem>
-            <MenuItem value={604800}>{t("account_tokens_dialog_expires_x_days", { days: 7 })}</MenuItem>
-            <MenuItem value={2592000}>{t("account_tokens_dialog_expires_x_days", { days: 30 })}</MenuItem>
-            <MenuItem value={7776000}>{t("account_tokens_dialog_expires_x_days", { days: 90 })}</MenuItem>
-            <MenuItem value={15552000}>{t("account_tokens_dialog_expires_x_days", { days: 180 })}</MenuItem>
-          </Select>
-        </FormControl>
+        {createdToken && (
+          <>
+            <DialogContentText>{t("account_tokens_dialog_created")}</DialogContentText>
+            <Typography variant="body2" sx={{ mt: 2, fontFamily: "monospace", wordBreak: "break-all" }}>
+              {createdToken}
+            </Typography>
+          </>
+        )}
+        {!createdToken && (
+          <>
+            <TextField
+              margin="dense"
+              id="token-label"
+              label={t("account_tokens_dialog_label")}
+              aria-label={t("account_delete_dialog_label")}
+              type="text"
+              value={label}
+              onChange={(ev) => setLabel(ev.target.value)}
+              fullWidth
+              variant="standard"
+            />
+            <FormControl fullWidth variant="standard" sx={{ mt: 1 }}>
+              <Select value={expires} onChange={(ev) => setExpires(ev.target.value)} aria-label={t("account_tokens_dialog_expires_label")}>
+                {editMode && <MenuItem value={-1}>{t("account_tokens_dialog_expires_unchanged")}</MenuItem>}
+                <MenuItem value={0}>{t("account_tokens_dialog_expires_never")}</MenuItem>
+                <MenuItem value={21600}>{t("account_tokens_dialog_expires_x_hours", { hours: 6 })}</MenuItem>
+                <MenuItem value={43200}>{t("account_tokens_dialog_expires_x_hours", { hours: 12 })}</MenuItem>
+                <MenuItem value={259200}>{t("account_tokens_dialog_expires_x_days", { days: 3 })}</MenuItem>
+                <MenuItem value={604800}>{t("account_tokens_dialog_expires_x_days", { days: 7 })}</MenuItem>
+                <MenuItem value={2592000}>{t("account_tokens_dialog_expires_x_days", { days: 30 })}</MenuItem>
+                <MenuItem value={7776000}>{t("account_tokens_dialog_expires_x_days", { days: 90 })}</MenuItem>
+                <MenuItem value={15552000}>{t("account_tokens_dialog_expires_x_days", { days: 180 })}</MenuItem>
+              </Select>
+            </FormControl>
+          </>
+        )}
       </DialogContent>
       <DialogFooter status={error}>
-        <Button onClick={props.onClose}>{t("account_tokens_dialog_button_cancel")}</Button>
-        <Button onClick={handleSubmit}>
-          {editMode ? t("account_tokens_dialog_button_update") : t("account_tokens_dialog_button_create")}
-        </Button>
+        {!createdToken && (
+          <>
+            <Button onClick={props.onClose}>{t("account_tokens_dialog_button_cancel")}</Button>
+            <Button onClick={handleSubmit}>
+              {editMode ? t("account_tokens_dialog_button_update") : t("account_tokens_dialog_button_create")}
+            </Button>
+          </>
+        )}
+        {createdToken && (
+          <>
+            <Button
+              onClick={() => {
+                copyToClipboard(createdToken);
+                setSnackOpen(true);
+              }}
+            >
+              {t("common_copy_to_clipboard")}
+            </Button>
+            <Button onClick={props.onClose}>{t("account_tokens_dialog_button_done")}</Button>
+          </>
+        )}
       </DialogFooter>
+      <Portal>
+        <Snackbar
+          open={snackOpen}
+          autoHideDuration={3000}
+          onClose={() => setSnackOpen(false)}
+          message={t("account_tokens_table_copied_to_clipboard")}
+        />
+      </Portal>
     </Dialog>
   );
 };
@@ -1305,7 +1583,7 @@ const TokenDeleteDialog = (props) => {
 
   const handleSubmit = async () => {
     try {
-      await accountApi.deleteToken(props.token.token);
+      await accountApi.deleteToken(props.token.id);
       props.onClose();
     } catch (e) {
       console.log(`[Account] Error deleting token`, e);
@@ -19,7 +19,7 @@ import PublishDialog from "./PublishDialog";
 import Messaging from "./Messaging";
 import Login from "./Login";
 import Signup from "./Signup";
-import Account from "./Account";
+import Account, { TOTPEnrollDialog } from "./Account";
 import EmailVerify from "./EmailVerify";
 import PasswordReset from "./PasswordReset";
 import PasswordResetRequest from "./PasswordResetRequest";
@@ -167,6 +167,7 @@ const Layout = () => {
           />
         </Main>
         <Messaging selected={selected} dialogOpenMode={sendDialogOpenMode} onDialogOpenModeChange={setSendDialogOpenMode} />
+        {account?.totp?.required && !account.totp.enabled && <TOTPEnrollDialog open required onClose={() => {}} />}
       </Box>
     </PrefCacheProvider>
   );
@@ -1,5 +1,5 @@
 import * as React from "react";
-import { useState } from "react";
+import { useEffect, useState } from "react";
 import { Typography, TextField, Button, Box, IconButton, InputAdornment } from "@mui/material";
 import WarningAmberIcon from "@mui/icons-material/WarningAmber";
 import { NavLink } from "react-router-dom";
@@ -10,8 +10,9 @@ import accountApi from "../app/AccountApi";
 import AvatarBox from "./AvatarBox";
 import session from "../app/Session";
 import routes from "./routes";
-import { UnauthorizedError } from "../app/errors";
+import { TOTPCodeInvalidError, TOTPRequiredError, UnauthorizedError } from "../app/errors";
 import { fadeReload } from "../app/transition";
+import { oidcLoginUrl } from "../app/utils";
 
 const Login = () => {
   const { t } = useTranslation();
@@ -19,18 +20,58 @@ const Login = () => {
   const [username, setUsername] = useState("");
   const [password, setPassword] = useState("");
   const [showPassword, setShowPassword] = useState(false);
+  const [totpRequired, setTotpRequired] = useState(false);
+  const [totp, setTotp] = useState("");
+
+  // After an OpenID Connect login, the server redirects here and passes the session token in the URL fragment
+  useEffect(() => {
+    const params = new URLSearchParams(window.location.hash.substring(1));
+    const oidcToken = params.get("oidc_token");
+    const oidcUsername = params.get("oidc_username");
+    if (!oidcToken || !oidcUsername) {
+      return;
+    }
+    window.history.replaceState(null, "", window.location.pathname); // Remove token from URL
+    (async () => {
+      console.log(`[Login] OpenID Connect login for user ${oidcUsername} successful`);
+      await session.store(oidcUsername, oidcToken);
+      fadeReload(routes.app);
+    })();
+  }, []);
+
+  // If a reverse proxy authenticates users (e.g. oauth2-proxy or Authelia), log in without asking for a password
+  useEffect(() => {
+    if (!config.enable_proxy_auth) {
+      return;
+    }
+    (async () => {
+      try {
+        const { username: proxyUsername, token } = await accountApi.loginWithProxy();
+        console.log(`[Login] Reverse proxy login for user ${proxyUsername} successful`);
+        await session.store(proxyUsername, token);
+        fadeReload(routes.app);
+      } catch (e) {
+        console.log(`[Login] Reverse proxy login failed, falling back to login form`, e);
+      }
+    })();
+  }, []);
 
   const handleSubmit = async (event) => {
     event.preventDefault();
     const user = { username, password };
     try {
-      const token = await accountApi.login(user);
+      const token = await accountApi.login(user, totpRequired ? totp : "");
       console.log(`[Login] User auth for user ${user.username} successful, token is ${token}`);
       await session.store(user.username, token);
       fadeReload(routes.app);
     } catch (e) {
       console.log(`[Login] User auth for user ${user.username} failed`, e);
-      if (e instanceof UnauthorizedError) {
+      if (e instanceof TOTPRequiredError) {
+        setTotpRequired(true);
+        setError("");
+      } else if (e instanceof TOTPCodeInvalidError) {
+        setError(t("login_form_totp_invalid"));
+      } else if (e instanceof UnauthorizedError) {
         setError(t("Login failed: Invalid username or password"));
       } else {
         setError(e.message);
@@ -87,9 +128,35 @@ const Login = () => {
             },
           }}
         />
-        <Button type="submit" fullWidth variant="contained" disabled={username === "" || password === ""} sx={{ mt: 2, mb: 2 }}>
+        {totpRequired && (
+          <TextField
+            margin="dense"
+            required
+            fullWidth
+            id="totp"
+            label={t("login_form_totp")}
+            helperText={t("login_form_totp_description")}
+            name="totp"
+            value={totp}
+            onChange={(ev) => setTotp(ev.target.value.trim())}
+            autoComplete="one-time-code"
+            autoFocus
+          />
+        )}
+        <Button
+          type="submit"
+          fullWidth
+          variant="contained"
+          disabled={username === "" || password === "" || (totpRequired && totp === "")}
+          sx={{ mt: 2, mb: 2 }}
+        >
           {t("login_form_button_submit")}
         </Button>
+        {config.enable_oidc && (
+          <Button href={oidcLoginUrl(config.base_url)} fullWidth variant="outlined" sx={{ mb: 2 }}>
+            {t("login_form_button_oidc")}
+          </Button>
+        )}
         {error && (
           <Box
             sx={{